@@ -16,8 +16,12 @@ import (
 	"strings"
 
 	"go.starlark.net/internal/compile"
+	"go.starlark.net/lib/bisect"
+	"go.starlark.net/lib/immutable"
 	"go.starlark.net/lib/json"
+	"go.starlark.net/lib/linalg"
 	"go.starlark.net/lib/math"
+	"go.starlark.net/lib/table"
 	"go.starlark.net/lib/time"
 	"go.starlark.net/repl"
 	"go.starlark.net/resolve"
@@ -32,14 +36,31 @@ var (
 	profile    = flag.String("profile", "", "gather Starlark time profile in this file")
 	showenv    = flag.Bool("showenv", false, "on success, print final global environment")
 	execprog   = flag.String("c", "", "execute program `prog`")
+	breakpoint = flag.Bool("breakpoint", false, "enable the breakpoint() built-in, which starts a REPL in the calling frame")
+	dis        = flag.Bool("dis", false, "print the annotated bytecode of the program instead of executing it")
+	bazel      = flag.Bool("bazelcompat", false, "match the behavior of Bazel's Starlark implementation where it differs")
 )
 
 func init() {
 	flag.BoolVar(&compile.Disassemble, "disassemble", compile.Disassemble, "show disassembly during compilation of each function")
 
 	// non-standard dialect flags
+	flag.Func("dialect", "enable the options of the named `dialect` ("+strings.Join(resolve.DialectNames(), ", ")+"), optionally with a version, such as bazel@1; later flags override it", func(name string) error {
+		d, err := resolve.LookupDialect(name)
+		if err != nil {
+			return err
+		}
+		d.Apply()
+		return nil
+	})
 	flag.BoolVar(&resolve.AllowSet, "set", resolve.AllowSet, "allow set data type")
 	flag.BoolVar(&resolve.AllowRecursion, "recursion", resolve.AllowRecursion, "allow while statements and recursive functions")
+	flag.BoolVar(&resolve.AllowDel, "del", resolve.AllowDel, "allow del statements")
+	flag.BoolVar(&resolve.AllowWith, "with", resolve.AllowWith, "allow with statements")
+	flag.BoolVar(&resolve.AllowCatch, "catch", resolve.AllowCatch, "allow catch built-in")
+	flag.BoolVar(&resolve.AllowYield, "yield", resolve.AllowYield, "allow yield expressions and generator functions")
+	flag.BoolVar(&resolve.LazyIterators, "lazyiter", resolve.LazyIterators, "make enumerate, zip, and reversed return lazy iterables")
+	flag.BoolVar(&resolve.FunctionAttrs, "funcattrs", resolve.FunctionAttrs, "give functions the __name__, __doc__, and __params__ attributes")
 	flag.BoolVar(&resolve.AllowGlobalReassign, "globalreassign", resolve.AllowGlobalReassign, "allow reassignment of globals, and if/for/while statements at top level")
 
 	// flags that are now standard
@@ -90,14 +111,25 @@ func doMain() int {
 		}()
 	}
 
-	thread := &starlark.Thread{Load: repl.MakeLoad()}
+	thread := &starlark.Thread{Load: repl.MakeLoad(), BazelCompatible: *bazel}
 	globals := make(starlark.StringDict)
 
+	// predeclared is the environment of a file executed or disassembled;
+	// the modules below are added to the universe instead.
+	var predeclared starlark.StringDict
+
 	// Ideally this statement would update the predeclared environment.
 	// TODO(adonovan): plumb predeclared env through to the REPL.
 	starlark.Universe["json"] = json.Module
 	starlark.Universe["time"] = time.Module
 	starlark.Universe["math"] = math.Module
+	starlark.Universe["bisect"] = bisect.Module
+	starlark.Universe["linalg"] = linalg.Module
+	starlark.Universe["table"] = table.Module
+	starlark.Universe["immutable"] = immutable.Module
+	if *breakpoint {
+		starlark.Universe["breakpoint"] = repl.Breakpoint
+	}
 
 	switch {
 	case flag.NArg() == 1 || *execprog != "":
@@ -114,8 +146,11 @@ func doMain() int {
 			// Execute specified file.
 			filename = flag.Arg(0)
 		}
+		if *dis {
+			return disassemble(filename, src, predeclared)
+		}
 		thread.Name = "exec " + filename
-		globals, err = starlark.ExecFile(thread, filename, src, nil)
+		globals, err = starlark.ExecFile(thread, filename, src, predeclared)
 		if err != nil {
 			repl.PrintError(err)
 			return 1
@@ -147,6 +182,29 @@ func doMain() int {
 	return 0
 }
 
+// disassemble compiles the specified file, resolving it against the
+// same predeclared environment as execution, and prints its bytecode.
+func disassemble(filename string, src interface{}, predeclared starlark.StringDict) int {
+	var data []byte
+	if src != nil {
+		data = []byte(src.(string))
+	} else {
+		var err error
+		data, err = os.ReadFile(filename)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	_, prog, err := starlark.SourceProgram(filename, data, predeclared.Has)
+	if err != nil {
+		repl.PrintError(err)
+		return 1
+	}
+	fmt.Print(prog.Disassemble(data))
+	return 0
+}
+
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,182 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The starlarkc command compiles Starlark files ahead of time.
+//
+// Usage:
+//
+//	starlarkc [flags] file.star ...
+//
+// For each file x.star, starlarkc writes the compiled program to
+// x.starc, in the format read by starlark.CompiledProgram, so that an
+// application may execute it without parsing or compiling the source,
+// for example using starlark.ExecCompiled.
+//
+// With the -go=pkg flag, starlarkc also writes a Go source file,
+// x.starc.go, in package pkg, that embeds the compiled program and
+// declares a function to execute it:
+//
+//	func ExecX(thread *starlark.Thread, predeclared starlark.StringDict) (starlark.StringDict, error)
+//
+// A typical use is a go:generate directive in the package that
+// contains the Starlark files:
+//
+//	//go:generate starlarkc -go=mypkg -predeclared=config,rule x.star
+//
+// The -predeclared flag specifies the comma-separated names predeclared
+// by the application. If it is empty, any name not defined in the file
+// or by the Starlark universe is assumed to be predeclared, and the
+// application must supply its value at execution.
+//
+// A compiled program is specific to the version of the compiler that
+// produced it; see starlark.CompilerVersion.
+package main // import "go.starlark.net/cmd/starlarkc"
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"go.starlark.net/repl"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+)
+
+// flags
+var (
+	output      = flag.String("o", "", "write the compiled program to `file` (only with a single input file)")
+	gopkg       = flag.String("go", "", "also write a Go file in package `pkg` that embeds the compiled program")
+	predeclared = flag.String("predeclared", "", "comma-separated `names` predeclared by the application")
+)
+
+func init() {
+	// non-standard dialect flags
+	flag.Func("dialect", "enable the options of the named `dialect` ("+strings.Join(resolve.DialectNames(), ", ")+"), optionally with a version, such as bazel@1; later flags override it", func(name string) error {
+		d, err := resolve.LookupDialect(name)
+		if err != nil {
+			return err
+		}
+		d.Apply()
+		return nil
+	})
+	flag.BoolVar(&resolve.AllowSet, "set", resolve.AllowSet, "allow set data type")
+	flag.BoolVar(&resolve.AllowRecursion, "recursion", resolve.AllowRecursion, "allow while statements and recursive functions")
+	flag.BoolVar(&resolve.AllowDel, "del", resolve.AllowDel, "allow del statements")
+	flag.BoolVar(&resolve.AllowWith, "with", resolve.AllowWith, "allow with statements")
+	flag.BoolVar(&resolve.AllowCatch, "catch", resolve.AllowCatch, "allow catch built-in")
+	flag.BoolVar(&resolve.AllowYield, "yield", resolve.AllowYield, "allow yield expressions and generator functions")
+	flag.BoolVar(&resolve.AllowGlobalReassign, "globalreassign", resolve.AllowGlobalReassign, "allow reassignment of globals, and if/for/while statements at top level")
+}
+
+func main() {
+	log.SetPrefix("starlarkc: ")
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: starlarkc [flags] file.star ...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output != "" && flag.NArg() > 1 {
+		log.Fatal("-o requires a single input file")
+	}
+
+	isPredeclared := func(name string) bool { return !starlark.Universe.Has(name) }
+	if *predeclared != "" {
+		names := make(map[string]bool)
+		for _, name := range strings.Split(*predeclared, ",") {
+			names[strings.TrimSpace(name)] = true
+		}
+		isPredeclared = func(name string) bool { return names[name] }
+	}
+
+	status := 0
+	for _, filename := range flag.Args() {
+		out := *output
+		if out == "" {
+			out = strings.TrimSuffix(filename, ".star") + ".starc"
+		}
+		if err := compileFile(filename, out, isPredeclared); err != nil {
+			repl.PrintError(err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+// compileFile compiles the specified file and writes the
+// program (and, if requested, the Go file) to out.
+func compileFile(filename, out string, isPredeclared func(string) bool) error {
+	_, prog, err := starlark.SourceProgram(filename, nil, isPredeclared)
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err := prog.Write(buf); err != nil {
+		return err
+	}
+	if err := os.WriteFile(out, buf.Bytes(), 0666); err != nil {
+		return err
+	}
+	if *gopkg != "" {
+		src, err := goFile(*gopkg, filename, out)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(out+".go", src, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// goFile returns the source of a Go file in package pkg
+// that embeds the compiled program out.
+func goFile(pkg, filename, out string) ([]byte, error) {
+	base := filepath.Base(out)
+	name := exportedName(strings.TrimSuffix(filepath.Base(filename), ".star"))
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "// Code generated by starlarkc from %s. DO NOT EDIT.\n\n", filepath.Base(filename))
+	fmt.Fprintf(buf, "package %s\n\n", pkg)
+	fmt.Fprintf(buf, "import (\n\t_ \"embed\"\n\n\t\"go.starlark.net/starlark\"\n)\n\n")
+	fmt.Fprintf(buf, "//go:embed %s\n", base)
+	fmt.Fprintf(buf, "var compiled%s []byte\n\n", name)
+	fmt.Fprintf(buf, "// Exec%s executes the compiled program %s\n", name, filepath.Base(filename))
+	fmt.Fprintf(buf, "// and returns its frozen global environment.\n")
+	fmt.Fprintf(buf, "func Exec%s(thread *starlark.Thread, predeclared starlark.StringDict) (starlark.StringDict, error) {\n", name)
+	fmt.Fprintf(buf, "\treturn starlark.ExecCompiled(thread, compiled%s, predeclared)\n}\n", name)
+	return format.Source(buf.Bytes())
+}
+
+// exportedName converts a file name such as "my-rules" to an
+// exported Go identifier such as "MyRules".
+func exportedName(s string) string {
+	var buf strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		buf.WriteRune(r)
+	}
+	if buf.Len() == 0 || !unicode.IsLetter([]rune(buf.String())[0]) {
+		return "X" + buf.String()
+	}
+	return buf.String()
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The starlarkdiff command tests this Starlark interpreter against one
+// or more other implementations, by executing random programs in each
+// and reporting those whose results differ.
+//
+// Usage:
+//
+//	starlarkdiff [flags] name=command ...
+//
+// Each argument names an implementation and specifies the command that
+// executes a Starlark file, whose name is appended to the command. The
+// command must write the output of print statements to its standard
+// output, and exit with a non-zero status if execution fails. For
+// example:
+//
+//	starlarkdiff -n=1000 rust='starlark --check=false'
+//
+// Each divergence is printed after reduction to the fewest statements
+// that still diverge. The exit status is 1 if any program diverged.
+package main // import "go.starlark.net/cmd/starlarkdiff"
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go.starlark.net/internal/difftest"
+)
+
+// flags
+var (
+	n          = flag.Int("n", 100, "number of programs to test")
+	seed       = flag.Int64("seed", 1, "seed of the random program generator")
+	statements = flag.Int("statements", 10, "number of statements per program")
+	depth      = flag.Int("depth", 4, "maximum depth of expressions")
+	maxfail    = flag.Int("maxfail", 10, "stop after this many divergences")
+)
+
+func main() {
+	log.SetPrefix("starlarkdiff: ")
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: starlarkdiff [flags] name=command ...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	impls := []difftest.Implementation{difftest.Local{}}
+	for _, arg := range flag.Args() {
+		eq := strings.IndexByte(arg, '=')
+		if eq < 0 {
+			log.Fatalf("invalid argument %q, want name=command", arg)
+		}
+		words := strings.Fields(arg[eq+1:])
+		if len(words) == 0 {
+			log.Fatalf("empty command for %s", arg[:eq])
+		}
+		impls = append(impls, &difftest.Command{Label: arg[:eq], Path: words[0], Args: words[1:]})
+	}
+
+	g := difftest.NewGenerator(*seed)
+	g.Statements = *statements
+	g.MaxDepth = *depth
+	failures := 0
+	for i := 0; i < *n && failures < *maxfail; i++ {
+		if d := difftest.Compare(g.Program(), impls...); d != nil {
+			failures++
+			fmt.Printf("divergence in program %d:\n%s\n", i, difftest.Minimize(d, impls...))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d divergences\n", failures)
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
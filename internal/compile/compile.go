@@ -24,6 +24,10 @@
 // Operands, logically uint32s, are encoded using little-endian 7-bit
 // varints, the top bit indicating that more bytes follow.
 //
+// The compiler first converts each function to a control-flow graph of
+// Blocks of Insns, then runs each registered optimization Pass over the
+// graph, and finally encodes it as bytecode.
+//
 package compile // import "go.starlark.net/internal/compile"
 
 import (
@@ -47,7 +51,7 @@ var Disassemble = false
 const debug = false // make code generation verbose, for debugging the compiler
 
 // Increment this to force recompilation of saved bytecode files.
-const Version = 13
+const Version = 17
 
 type Opcode uint8
 
@@ -105,6 +109,7 @@ const (
 	NOT          //          value NOT          bool
 	RETURN       //          value RETURN       -
 	SETINDEX     //        a i new SETINDEX     -
+	DELINDEX     //            a i DELINDEX     -
 	INDEX        //            a i INDEX        elem
 	SETDICT      // dict key value SETDICT      -
 	SETDICTUNIQ  // dict key value SETDICTUNIQ  -
@@ -113,6 +118,9 @@ const (
 	INPLACE_ADD  //            x y INPLACE_ADD  z      where z is x+y or x.extend(y)
 	INPLACE_PIPE //            x y INPLACE_PIPE z      where z is x|y
 	MAKEDICT     //              - MAKEDICT     dict
+	WITHENTER    //        manager WITHENTER    value  [pushes the with stack]
+	WITHEXIT     //              - WITHEXIT     -      [pops the with stack]
+	YIELD        //          value YIELD        sent   [suspends the generator]
 
 	// --- opcodes with an argument must go below this line ---
 
@@ -139,6 +147,7 @@ const (
 	UNIVERSAL    //                 - UNIVERSAL<name>     value
 	ATTR         //                 x ATTR<name>          y           y = x.name
 	SETFIELD     //               x y SETFIELD<name>      -           x.name = y
+	DELFIELD     //                 x DELFIELD<name>      -           del x.name
 	UNPACK       //          iterable UNPACK<n>           vn ... v1
 
 	// n>>8 is #positional args and n&0xff is #named args (pairs).
@@ -164,6 +173,8 @@ var opcodeNames = [...]string{
 	CIRCUMFLEX:   "circumflex",
 	CJMP:         "cjmp",
 	CONSTANT:     "constant",
+	DELFIELD:     "delfield",
+	DELINDEX:     "delindex",
 	DUP2:         "dup2",
 	DUP:          "dup",
 	EQL:          "eql",
@@ -222,6 +233,9 @@ var opcodeNames = [...]string{
 	UNIVERSAL:    "universal",
 	UNPACK:       "unpack",
 	UPLUS:        "uplus",
+	WITHENTER:    "withenter",
+	WITHEXIT:     "withexit",
+	YIELD:        "yield",
 }
 
 const variableStackEffect = 0x7f
@@ -239,6 +253,8 @@ var stackEffect = [...]int8{
 	CIRCUMFLEX:   -1,
 	CJMP:         -1,
 	CONSTANT:     +1,
+	DELFIELD:     -1,
+	DELINDEX:     -2,
 	DUP2:         +2,
 	DUP:          +1,
 	EQL:          -1,
@@ -295,6 +311,9 @@ var stackEffect = [...]int8{
 	UNIVERSAL:    +1,
 	UNPACK:       variableStackEffect,
 	UPLUS:        0,
+	WITHENTER:    0,
+	WITHEXIT:     0,
+	YIELD:        0,
 }
 
 func (op Opcode) String() string {
@@ -333,6 +352,7 @@ type Funcode struct {
 	Doc                   string          // docstring of this function
 	Code                  []byte          // the byte code
 	pclinetab             []uint16        // mapping from pc to linenum
+	pcendtab              []int32         // end line and column of each pclinetab row (0 => unknown)
 	Locals                []Binding       // locals, parameters first
 	Cells                 []int           // indices of Locals that require cells
 	Freevars              []Binding       // for tracing
@@ -340,6 +360,7 @@ type Funcode struct {
 	NumParams             int
 	NumKwonlyParams       int
 	HasVarargs, HasKwargs bool
+	Generator             bool // body contains a yield expression
 
 	// -- transient state --
 
@@ -365,6 +386,8 @@ type pcomp struct {
 	names     map[string]uint32
 	constants map[interface{}]uint32
 	functions map[*Funcode]uint32
+
+	profile Profile // optional execution profile
 }
 
 // An fcomp holds the compiler state for a Funcode.
@@ -373,22 +396,34 @@ type fcomp struct {
 
 	pcomp *pcomp
 	pos   syntax.Position // current position of generated code
+	end   syntax.Position // end of current span of generated code, if known
 	loops []loop
-	block *block
+	withs int // number of enclosing with statements
+	block *Block
 }
 
 type loop struct {
-	break_, continue_ *block
+	break_, continue_ *Block
+	withs             int // number of with statements enclosing the loop
 }
 
-type block struct {
-	insns []insn
+// A Block is a basic block of the control-flow graph of a function:
+// a sequence of instructions executed in order, followed by a transfer
+// of control to its successors. Blocks and their instructions form the
+// intermediate representation on which optimization passes operate;
+// see Pass.
+type Block struct {
+	Insns []Insn
 
-	// If the last insn is a RETURN, jmp and cjmp are nil.
+	// If the last insn is a RETURN, Jmp and Cjmp are nil.
 	// If the last insn is a CJMP or ITERJMP,
-	//  cjmp and jmp are the "true" and "false" successors.
-	// Otherwise, jmp is the sole successor.
-	jmp, cjmp *block
+	//  Cjmp and Jmp are the "true" and "false" successors.
+	// Otherwise, Jmp is the sole successor.
+	// The unconditional jump to Jmp is implicit: it is not
+	// among Insns, and the encoder omits it when Jmp follows
+	// this block in the linear code.
+	// A block with no instructions is bypassed by its predecessors.
+	Jmp, Cjmp *Block
 
 	initialstack int // for stack depth computation
 
@@ -397,14 +432,29 @@ type block struct {
 	addr  uint32
 }
 
-type insn struct {
-	op        Opcode
-	arg       uint32
-	line, col int32
+// An Insn is an instruction in a Block.
+// The Arg operand is meaningful only for opcodes >= OpcodeArgMin,
+// and the operand of a CJMP or ITERJMP is assigned during encoding.
+// A non-zero Line records the source position of the instruction;
+// a non-zero EndLine additionally records the end of the source
+// span of the operation, such as the closing parenthesis of a call.
+type Insn struct {
+	Op              Opcode
+	Arg             uint32
+	Line, Col       int32
+	EndLine, EndCol int32
 }
 
 // Position returns the source position for program counter pc.
 func (fn *Funcode) Position(pc uint32) syntax.Position {
+	start, _ := fn.Span(pc)
+	return start
+}
+
+// Span returns the start and end source positions for program counter pc.
+// The end position is not valid (see syntax.Position.IsValid)
+// if the compiler did not record the extent of the operation.
+func (fn *Funcode) Span(pc uint32) (start, end syntax.Position) {
 	fn.lntOnce.Do(fn.decodeLNT)
 
 	// Binary search to find last LNT entry not greater than pc.
@@ -422,16 +472,23 @@ func (fn *Funcode) Position(pc uint32) syntax.Position {
 		}
 	}
 
-	var line, col int32
+	var line, col, endline, endcol int32
 	if i < n {
 		line = fn.lnt[i].line
 		col = fn.lnt[i].col
+		if 2*i+1 < len(fn.pcendtab) {
+			endline = fn.pcendtab[2*i]
+			endcol = fn.pcendtab[2*i+1]
+		}
 	}
 
-	pos := fn.Pos // copy the (annoyingly inaccessible) filename
-	pos.Col = col
-	pos.Line = line
-	return pos
+	start = fn.Pos // copy the (annoyingly inaccessible) filename
+	start.Line = line
+	start.Col = col
+	end = fn.Pos
+	end.Line = endline
+	end.Col = endcol
+	return start, end
 }
 
 // decodeLNT decodes the line number table and populates fn.lnt.
@@ -494,17 +551,7 @@ func Expr(expr syntax.Expr, name string, locals []*resolve.Binding) *Program {
 
 // File compiles the statements of a file into a program.
 func File(stmts []syntax.Stmt, pos syntax.Position, name string, locals, globals []*resolve.Binding) *Program {
-	pcomp := &pcomp{
-		prog: &Program{
-			Globals: bindings(globals),
-		},
-		names:     make(map[string]uint32),
-		constants: make(map[interface{}]uint32),
-		functions: make(map[*Funcode]uint32),
-	}
-	pcomp.prog.Toplevel = pcomp.function(name, pos, stmts, locals, nil)
-
-	return pcomp.prog
+	return FileProfile(stmts, pos, name, locals, globals, nil)
 }
 
 func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.Stmt, locals, freevars []*resolve.Binding) *Funcode {
@@ -541,9 +588,53 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 		fcomp.emit(RETURN)
 	}
 
-	var oops bool // something bad happened
+	entry = fcomp.runPasses(entry)
 
-	setinitialstack := func(b *block, depth int) {
+	// Linearize the CFG. If the function has an execution profile,
+	// linearize it a second time, placing cold blocks last.
+	blocks, pc, maxstack, oops := fcomp.linearize(entry, nil)
+	if cold := fcomp.pcomp.profile.coldBlocks(fcomp.fn, blocks, pc); cold != nil {
+		for _, b := range blocks {
+			b.index, b.initialstack = -1, -1
+		}
+		blocks, pc, maxstack, oops = fcomp.linearize(entry, cold)
+	}
+
+	fn := fcomp.fn
+	fn.MaxStack = maxstack
+
+	// Emit bytecode (and position table).
+	if Disassemble {
+		fmt.Fprintf(os.Stderr, "Function %s: (%d blocks, %d bytes)\n", name, len(blocks), pc)
+	}
+	fcomp.generate(blocks, pc)
+
+	if debug {
+		fmt.Fprintf(os.Stderr, "code=%d maxstack=%d\n", fn.Code, fn.MaxStack)
+	}
+
+	// Don't panic until we've completed printing of the function.
+	if oops {
+		panic("internal error")
+	}
+
+	if debug {
+		fmt.Fprintf(os.Stderr, "end function(%s @ %s)\n", name, pos)
+	}
+
+	return fn
+}
+
+// linearize computes the order, address, and initial stack depth of
+// each block reachable from entry, and returns the blocks in order,
+// the code length, and the maximum stack depth. The successor of a
+// block is placed next if possible, unless it is in the cold set, in
+// which case it is placed after all other blocks. linearize reports
+// oops if the stack depths are inconsistent.
+func (fcomp *fcomp) linearize(entry *Block, cold map[*Block]bool) (blocks []*Block, codelen uint32, maxstack int, oops bool) {
+	name := fcomp.fn.Name
+
+	setinitialstack := func(b *Block, depth int) {
 		if b.initialstack == -1 {
 			b.initialstack = depth
 		} else if b.initialstack != depth {
@@ -553,52 +644,34 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 		}
 	}
 
-	// Linearize the CFG:
-	// compute order, address, and initial
-	// stack depth of each reachable block.
-	var pc uint32
-	var blocks []*block
-	var maxstack int
-	var visit func(b *block)
-	visit = func(b *block) {
+	// Compute the order and initial stack depth of each block.
+	var deferred []*Block // cold blocks, to be placed last
+	var visit func(b *Block)
+	visit = func(b *Block) {
 		if b.index >= 0 {
 			return // already visited
 		}
 		b.index = len(blocks)
-		b.addr = pc
 		blocks = append(blocks, b)
 
 		stack := b.initialstack
 		if debug {
 			fmt.Fprintf(os.Stderr, "%s block %d: (stack = %d)\n", name, b.index, stack)
 		}
-		var cjmpAddr *uint32
 		var isiterjmp int
-		for i, insn := range b.insns {
-			pc++
-
-			// Compute size of argument.
-			if insn.op >= OpcodeArgMin {
-				switch insn.op {
-				case ITERJMP:
-					isiterjmp = 1
-					fallthrough
-				case CJMP:
-					cjmpAddr = &b.insns[i].arg
-					pc += 4
-				default:
-					pc += uint32(argLen(insn.arg))
-				}
+		for _, insn := range b.Insns {
+			if insn.Op == ITERJMP {
+				isiterjmp = 1
 			}
 
 			// Compute effect on stack.
 			se := insn.stackeffect()
 			if debug {
-				fmt.Fprintln(os.Stderr, "\t", insn.op, stack, stack+se)
+				fmt.Fprintln(os.Stderr, "\t", insn.Op, stack, stack+se)
 			}
 			stack += se
 			if stack < 0 {
-				fmt.Fprintf(os.Stderr, "After pc=%d: stack underflow\n", pc)
+				fmt.Fprintf(os.Stderr, "In block %d: stack underflow\n", b.index)
 				oops = true
 			}
 			if stack+isiterjmp > maxstack {
@@ -606,78 +679,69 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 			}
 		}
 
-		if debug {
-			fmt.Fprintf(os.Stderr, "successors of block %d (start=%d):\n",
-				b.addr, b.index)
-			if b.jmp != nil {
-				fmt.Fprintf(os.Stderr, "jmp to %d\n", b.jmp.index)
-			}
-			if b.cjmp != nil {
-				fmt.Fprintf(os.Stderr, "cjmp to %d\n", b.cjmp.index)
-			}
-		}
-
-		// Place the jmp block next.
-		if b.jmp != nil {
+		// Place the jmp block next (unless it is cold),
+		// then the cjmp block.
+		if b.Jmp != nil {
 			// jump threading (empty cycles are impossible)
-			for b.jmp.insns == nil {
-				b.jmp = b.jmp.jmp
+			for b.Jmp.Insns == nil {
+				b.Jmp = b.Jmp.Jmp
 			}
-
-			setinitialstack(b.jmp, stack+isiterjmp)
-			if b.jmp.index < 0 {
-				// Successor is not yet visited:
-				// place it next and fall through.
-				visit(b.jmp)
+			setinitialstack(b.Jmp, stack+isiterjmp)
+			if cold[b.Jmp] && !cold[b] {
+				deferred = append(deferred, b.Jmp)
 			} else {
-				// Successor already visited;
-				// explicit backward jump required.
-				pc += 5
+				visit(b.Jmp)
 			}
 		}
-
-		// Then the cjmp block.
-		if b.cjmp != nil {
+		if b.Cjmp != nil {
 			// jump threading (empty cycles are impossible)
-			for b.cjmp.insns == nil {
-				b.cjmp = b.cjmp.jmp
+			for b.Cjmp.Insns == nil {
+				b.Cjmp = b.Cjmp.Jmp
 			}
-
-			setinitialstack(b.cjmp, stack)
-			visit(b.cjmp)
-
-			// Patch the CJMP/ITERJMP, if present.
-			if cjmpAddr != nil {
-				*cjmpAddr = b.cjmp.addr
+			setinitialstack(b.Cjmp, stack)
+			if cold[b.Cjmp] && !cold[b] {
+				deferred = append(deferred, b.Cjmp)
+			} else {
+				visit(b.Cjmp)
 			}
 		}
 	}
 	setinitialstack(entry, 0)
 	visit(entry)
-
-	fn := fcomp.fn
-	fn.MaxStack = maxstack
-
-	// Emit bytecode (and position table).
-	if Disassemble {
-		fmt.Fprintf(os.Stderr, "Function %s: (%d blocks, %d bytes)\n", name, len(blocks), pc)
+	for i := 0; i < len(deferred); i++ {
+		visit(deferred[i])
 	}
-	fcomp.generate(blocks, pc)
 
-	if debug {
-		fmt.Fprintf(os.Stderr, "code=%d maxstack=%d\n", fn.Code, fn.MaxStack)
-	}
-
-	// Don't panic until we've completed printing of the function.
-	if oops {
-		panic("internal error")
+	// Compute the address of each block.
+	var pc uint32
+	for i, b := range blocks {
+		b.addr = pc
+		for _, insn := range b.Insns {
+			pc++
+			if insn.Op >= OpcodeArgMin {
+				switch insn.Op {
+				case ITERJMP, CJMP:
+					pc += 4
+				default:
+					pc += uint32(argLen(insn.Arg))
+				}
+			}
+		}
+		if b.Jmp != nil && (i+1 == len(blocks) || blocks[i+1] != b.Jmp) {
+			pc += 5 // explicit jump required
+		}
 	}
 
-	if debug {
-		fmt.Fprintf(os.Stderr, "end function(%s @ %s)\n", name, pos)
+	// Patch the CJMP/ITERJMP of each block, if present.
+	for _, b := range blocks {
+		if b.Cjmp != nil {
+			if n := len(b.Insns); n > 0 && (b.Insns[n-1].Op == CJMP || b.Insns[n-1].Op == ITERJMP) {
+				b.Insns[n-1].Arg = b.Cjmp.addr
+			}
+		}
 	}
 
-	return fn
+	return blocks, pc, maxstack, oops
 }
 
 func docStringFromBody(body []syntax.Stmt) string {
@@ -698,17 +762,17 @@ func docStringFromBody(body []syntax.Stmt) string {
 	return lit.Value.(string)
 }
 
-func (insn *insn) stackeffect() int {
-	se := int(stackEffect[insn.op])
+func (insn *Insn) stackeffect() int {
+	se := int(stackEffect[insn.Op])
 	if se == variableStackEffect {
-		arg := int(insn.arg)
-		switch insn.op {
+		arg := int(insn.Arg)
+		switch insn.Op {
 		case CALL, CALL_KW, CALL_VAR, CALL_VAR_KW:
-			se = -int(2*(insn.arg&0xff) + insn.arg>>8)
-			if insn.op != CALL {
+			se = -int(2*(insn.Arg&0xff) + insn.Arg>>8)
+			if insn.Op != CALL {
 				se--
 			}
-			if insn.op == CALL_VAR_KW {
+			if insn.Op == CALL_VAR_KW {
 				se--
 			}
 		case ITERJMP:
@@ -722,7 +786,7 @@ func (insn *insn) stackeffect() int {
 		case UNPACK:
 			se = arg - 1
 		default:
-			panic(insn.op)
+			panic(insn.Op)
 		}
 	}
 	return se
@@ -730,9 +794,10 @@ func (insn *insn) stackeffect() int {
 
 // generate emits the linear instruction stream from the CFG,
 // and builds the PC-to-line number table.
-func (fcomp *fcomp) generate(blocks []*block, codelen uint32) {
+func (fcomp *fcomp) generate(blocks []*Block, codelen uint32) {
 	code := make([]byte, 0, codelen)
 	var pclinetab []uint16
+	var pcendtab []int32
 	prev := pclinecol{
 		pc:   0,
 		line: fcomp.fn.Pos.Line,
@@ -744,8 +809,8 @@ func (fcomp *fcomp) generate(blocks []*block, codelen uint32) {
 			fmt.Fprintf(os.Stderr, "%d:\n", b.index)
 		}
 		pc := b.addr
-		for _, insn := range b.insns {
-			if insn.line != 0 {
+		for _, insn := range b.Insns {
+			if insn.Line != 0 {
 				// Instruction has a source position.  Delta-encode it.
 				// See Funcode.Position for the encoding.
 				for {
@@ -760,14 +825,14 @@ func (fcomp *fcomp) generate(blocks []*block, codelen uint32) {
 					prev.pc += deltapc
 
 					// Δline, int5
-					deltaline, ok := clip(insn.line-prev.line, -0x10, 0x0f)
+					deltaline, ok := clip(insn.Line-prev.line, -0x10, 0x0f)
 					if !ok {
 						incomplete = 1
 					}
 					prev.line += deltaline
 
 					// Δcol, int6
-					deltacol, ok := clip(insn.col-prev.col, -0x20, 0x1f)
+					deltacol, ok := clip(insn.Col-prev.col, -0x20, 0x1f)
 					if !ok {
 						incomplete = 1
 					}
@@ -779,32 +844,33 @@ func (fcomp *fcomp) generate(blocks []*block, codelen uint32) {
 						break
 					}
 				}
+				pcendtab = append(pcendtab, insn.EndLine, insn.EndCol)
 
 				if Disassemble {
 					fmt.Fprintf(os.Stderr, "\t\t\t\t\t; %s:%d:%d\n",
-						filepath.Base(fcomp.fn.Pos.Filename()), insn.line, insn.col)
+						filepath.Base(fcomp.fn.Pos.Filename()), insn.Line, insn.Col)
 				}
 			}
 			if Disassemble {
-				PrintOp(fcomp.fn, pc, insn.op, insn.arg)
+				PrintOp(fcomp.fn, pc, insn.Op, insn.Arg)
 			}
-			code = append(code, byte(insn.op))
+			code = append(code, byte(insn.Op))
 			pc++
-			if insn.op >= OpcodeArgMin {
-				if insn.op == CJMP || insn.op == ITERJMP {
-					code = addUint32(code, insn.arg, 4) // pad arg to 4 bytes
+			if insn.Op >= OpcodeArgMin {
+				if insn.Op == CJMP || insn.Op == ITERJMP {
+					code = addUint32(code, insn.Arg, 4) // pad arg to 4 bytes
 				} else {
-					code = addUint32(code, insn.arg, 0)
+					code = addUint32(code, insn.Arg, 0)
 				}
 				pc = uint32(len(code))
 			}
 		}
 
-		if b.jmp != nil && b.jmp.index != b.index+1 {
-			addr := b.jmp.addr
+		if b.Jmp != nil && b.Jmp.index != b.index+1 {
+			addr := b.Jmp.addr
 			if Disassemble {
 				fmt.Fprintf(os.Stderr, "\t%d\tjmp\t\t%d\t; block %d\n",
-					pc, addr, b.jmp.index)
+					pc, addr, b.Jmp.index)
 			}
 			code = append(code, byte(JMP))
 			code = addUint32(code, addr, 4)
@@ -815,6 +881,7 @@ func (fcomp *fcomp) generate(blocks []*block, codelen uint32) {
 	}
 
 	fcomp.fn.pclinetab = pclinetab
+	fcomp.fn.pcendtab = pcendtab
 	fcomp.fn.Code = code
 }
 
@@ -856,11 +923,37 @@ func argLen(x uint32) int {
 	return n + 1
 }
 
+// DecodeOp decodes the instruction at the specified pc of code,
+// returning its opcode and argument (zero if it has none)
+// and the pc of the following instruction.
+func DecodeOp(code []byte, pc uint32) (op Opcode, arg, next uint32) {
+	op = Opcode(code[pc])
+	pc++
+	if op >= OpcodeArgMin {
+		for s := uint(0); ; s += 7 {
+			b := code[pc]
+			pc++
+			arg |= uint32(b&0x7f) << s
+			if b < 0x80 {
+				break
+			}
+		}
+	}
+	return op, arg, pc
+}
+
 // PrintOp prints an instruction.
 // It is provided for debugging.
 func PrintOp(fn *Funcode, pc uint32, op Opcode, arg uint32) {
+	var buf bytes.Buffer
+	writeOp(&buf, fn, pc, op, arg)
+	os.Stderr.Write(buf.Bytes())
+}
+
+// writeOp writes a line describing an instruction to buf.
+func writeOp(buf *bytes.Buffer, fn *Funcode, pc uint32, op Opcode, arg uint32) {
 	if op < OpcodeArgMin {
-		fmt.Fprintf(os.Stderr, "\t%d\t%s\n", pc, op)
+		fmt.Fprintf(buf, "\t%d\t%s\n", pc, op)
 		return
 	}
 
@@ -881,7 +974,7 @@ func PrintOp(fn *Funcode, pc uint32, op Opcode, arg uint32) {
 		comment = fn.Locals[arg].Name
 	case SETGLOBAL, GLOBAL:
 		comment = fn.Prog.Globals[arg].Name
-	case ATTR, SETFIELD, PREDECLARED, UNIVERSAL:
+	case ATTR, SETFIELD, DELFIELD, PREDECLARED, UNIVERSAL:
 		comment = fn.Prog.Names[arg]
 	case FREE:
 		comment = fn.Freevars[arg].Name
@@ -891,18 +984,58 @@ func PrintOp(fn *Funcode, pc uint32, op Opcode, arg uint32) {
 		// JMP, CJMP, ITERJMP, MAKETUPLE, MAKELIST, LOAD, UNPACK:
 		// arg is just a number
 	}
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "\t%d\t%-10s\t%d", pc, op, arg)
+	fmt.Fprintf(buf, "\t%d\t%-10s\t%d", pc, op, arg)
 	if comment != "" {
-		fmt.Fprint(&buf, "\t; ", comment)
+		fmt.Fprint(buf, "\t; ", comment)
 	}
-	fmt.Fprintln(&buf)
-	os.Stderr.Write(buf.Bytes())
+	fmt.Fprintln(buf)
+}
+
+// Disassemble returns a listing of the bytecode of each function of
+// the program, starting with the toplevel function. Each instruction
+// is annotated with the operand it refers to, if any, and each change
+// of source position is noted before the first instruction it applies to.
+// If src is non-nil, it is the source text of the program's file, and
+// each such note includes the text of the corresponding source line.
+func (prog *Program) Disassemble(src []byte) string {
+	var lines []string
+	if src != nil {
+		lines = strings.Split(string(src), "\n")
+	}
+	var buf bytes.Buffer
+	for _, fn := range append([]*Funcode{prog.Toplevel}, prog.Functions...) {
+		fn.disassemble(&buf, lines)
+	}
+	return buf.String()
+}
+
+func (fn *Funcode) disassemble(buf *bytes.Buffer, lines []string) {
+	fmt.Fprintf(buf, "function %s @ %s (%d bytes, maxstack %d, %d locals, %d cells, %d freevars)\n",
+		fn.Name, fn.Pos, len(fn.Code), fn.MaxStack, len(fn.Locals), len(fn.Cells), len(fn.Freevars))
+	var prev syntax.Position
+	for pc := uint32(0); pc < uint32(len(fn.Code)); {
+		op, arg, next := DecodeOp(fn.Code, pc)
+		if op == NOP {
+			pc = next
+			continue // (operand padding)
+		}
+		if pos := fn.Position(pc); pos.Line != prev.Line || pos.Col != prev.Col {
+			fmt.Fprintf(buf, "\t\t\t\t\t; %s:%d:%d", filepath.Base(pos.Filename()), pos.Line, pos.Col)
+			if pos.Line != prev.Line && 0 < pos.Line && int(pos.Line) <= len(lines) {
+				fmt.Fprintf(buf, ": %s", strings.TrimSpace(lines[pos.Line-1]))
+			}
+			buf.WriteByte('\n')
+			prev = pos
+		}
+		writeOp(buf, fn, pc, op, arg)
+		pc = next
+	}
+	buf.WriteByte('\n')
 }
 
 // newBlock returns a new block.
-func (fcomp) newBlock() *block {
-	return &block{index: -1, initialstack: -1}
+func (fcomp) newBlock() *Block {
+	return &Block{index: -1, initialstack: -1}
 }
 
 // emit emits an instruction to the current block.
@@ -910,10 +1043,12 @@ func (fcomp *fcomp) emit(op Opcode) {
 	if op >= OpcodeArgMin {
 		panic("missing arg: " + op.String())
 	}
-	insn := insn{op: op, line: fcomp.pos.Line, col: fcomp.pos.Col}
-	fcomp.block.insns = append(fcomp.block.insns, insn)
+	insn := Insn{Op: op, Line: fcomp.pos.Line, Col: fcomp.pos.Col, EndLine: fcomp.end.Line, EndCol: fcomp.end.Col}
+	fcomp.block.Insns = append(fcomp.block.Insns, insn)
 	fcomp.pos.Line = 0
 	fcomp.pos.Col = 0
+	fcomp.end.Line = 0
+	fcomp.end.Col = 0
 }
 
 // emit1 emits an instruction with an immediate operand.
@@ -921,19 +1056,21 @@ func (fcomp *fcomp) emit1(op Opcode, arg uint32) {
 	if op < OpcodeArgMin {
 		panic("unwanted arg: " + op.String())
 	}
-	insn := insn{op: op, arg: arg, line: fcomp.pos.Line, col: fcomp.pos.Col}
-	fcomp.block.insns = append(fcomp.block.insns, insn)
+	insn := Insn{Op: op, Arg: arg, Line: fcomp.pos.Line, Col: fcomp.pos.Col, EndLine: fcomp.end.Line, EndCol: fcomp.end.Col}
+	fcomp.block.Insns = append(fcomp.block.Insns, insn)
 	fcomp.pos.Line = 0
 	fcomp.pos.Col = 0
+	fcomp.end.Line = 0
+	fcomp.end.Col = 0
 }
 
 // jump emits a jump to the specified block.
 // On return, the current block is unset.
-func (fcomp *fcomp) jump(b *block) {
+func (fcomp *fcomp) jump(b *Block) {
 	if b == fcomp.block {
 		panic("self-jump") // unreachable: Starlark has no arbitrary looping constructs
 	}
-	fcomp.block.jmp = b
+	fcomp.block.Jmp = b
 	fcomp.block = nil
 }
 
@@ -941,12 +1078,12 @@ func (fcomp *fcomp) jump(b *block) {
 // to the specified true/false blocks.
 // (For ITERJMP, the cases are jmp/f/ok and cjmp/t/exhausted.)
 // On return, the current block is unset.
-func (fcomp *fcomp) condjump(op Opcode, t, f *block) {
+func (fcomp *fcomp) condjump(op Opcode, t, f *Block) {
 	if !(op == CJMP || op == ITERJMP) {
 		panic("not a conditional jump: " + op.String())
 	}
 	fcomp.emit1(op, 0) // fill in address later
-	fcomp.block.cjmp = t
+	fcomp.block.Cjmp = t
 	fcomp.jump(f)
 }
 
@@ -996,6 +1133,14 @@ func (fcomp *fcomp) string(s string) {
 // All positions are assumed to belong to the same file.
 func (fcomp *fcomp) setPos(pos syntax.Position) {
 	fcomp.pos = pos
+	fcomp.end = syntax.Position{}
+}
+
+// setSpan is like setPos but also records the end of
+// the source span of the operation, for error reporting.
+func (fcomp *fcomp) setSpan(start, end syntax.Position) {
+	fcomp.pos = start
+	fcomp.end = end
 }
 
 // set emits code to store the top-of-stack value
@@ -1045,6 +1190,12 @@ func (fcomp *fcomp) stmts(stmts []syntax.Stmt) {
 }
 
 func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
+	// Record the start of each statement in the line number
+	// table, so that every executable line has at least one
+	// instruction (used by coverage). Expressions within the
+	// statement may further refine the position.
+	fcomp.setPos(syntax.Start(stmt))
+
 	switch stmt := stmt.(type) {
 	case *syntax.ExprStmt:
 		if _, ok := stmt.X.(*syntax.Literal); ok {
@@ -1060,12 +1211,14 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 		case syntax.PASS:
 			// no-op
 		case syntax.BREAK:
-			b := fcomp.loops[len(fcomp.loops)-1].break_
-			fcomp.jump(b)
+			l := fcomp.loops[len(fcomp.loops)-1]
+			fcomp.exitWiths(l.withs)
+			fcomp.jump(l.break_)
 			fcomp.block = fcomp.newBlock() // dead code
 		case syntax.CONTINUE:
-			b := fcomp.loops[len(fcomp.loops)-1].continue_
-			fcomp.jump(b)
+			l := fcomp.loops[len(fcomp.loops)-1]
+			fcomp.exitWiths(l.withs)
+			fcomp.jump(l.continue_)
 			fcomp.block = fcomp.newBlock() // dead code
 		}
 
@@ -1158,7 +1311,7 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 				fcomp.setPos(stmt.OpPos)
 				fcomp.emit(INPLACE_PIPE)
 			default:
-				fcomp.binop(stmt.OpPos, stmt.Op-syntax.PLUS_EQ+syntax.PLUS)
+				fcomp.binop(stmt.OpPos, syntax.End(stmt), stmt.Op-syntax.PLUS_EQ+syntax.PLUS)
 			}
 			set()
 		}
@@ -1183,7 +1336,7 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 
 		fcomp.block = body
 		fcomp.assign(stmt.For, stmt.Vars)
-		fcomp.loops = append(fcomp.loops, loop{break_: tail, continue_: head})
+		fcomp.loops = append(fcomp.loops, loop{break_: tail, continue_: head, withs: fcomp.withs})
 		fcomp.stmts(stmt.Body)
 		fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
 		fcomp.jump(head)
@@ -1201,13 +1354,47 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 		fcomp.ifelse(stmt.Cond, body, done)
 
 		fcomp.block = body
-		fcomp.loops = append(fcomp.loops, loop{break_: done, continue_: head})
+		fcomp.loops = append(fcomp.loops, loop{break_: done, continue_: head, withs: fcomp.withs})
 		fcomp.stmts(stmt.Body)
 		fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
 		fcomp.jump(head)
 
 		fcomp.block = done
 
+	case *syntax.WithStmt:
+		fcomp.expr(stmt.X)
+		fcomp.setPos(stmt.With)
+		fcomp.emit(WITHENTER)
+		if stmt.Var != nil {
+			fcomp.assign(stmt.As, stmt.Var)
+		} else {
+			fcomp.emit(POP)
+		}
+		fcomp.withs++
+		fcomp.stmts(stmt.Body)
+		fcomp.withs--
+		fcomp.setPos(stmt.With)
+		fcomp.emit(WITHEXIT)
+
+	case *syntax.DelStmt:
+		switch x := stmt.X.(type) {
+		case *syntax.IndexExpr:
+			// del x[y]
+			fcomp.expr(x.X)
+			fcomp.expr(x.Y)
+			fcomp.setPos(x.Lbrack)
+			fcomp.emit(DELINDEX)
+
+		case *syntax.DotExpr:
+			// del x.f
+			fcomp.expr(x.X)
+			fcomp.setPos(x.Dot)
+			fcomp.emit1(DELFIELD, fcomp.pcomp.nameIndex(x.Name.Name))
+
+		default:
+			panic(x)
+		}
+
 	case *syntax.ReturnStmt:
 		if stmt.Result != nil {
 			fcomp.expr(stmt.Result)
@@ -1239,6 +1426,16 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 	}
 }
 
+// exitWiths emits a WITHEXIT for each enclosing with statement
+// entered since the depth was n, as when a loop is exited by
+// break or continue. (Return statements and errors leave the
+// remaining context managers to be exited by the interpreter.)
+func (fcomp *fcomp) exitWiths(n int) {
+	for i := n; i < fcomp.withs; i++ {
+		fcomp.emit(WITHEXIT)
+	}
+}
+
 // assign implements lhs = rhs for arbitrary expressions lhs.
 // RHS is on top of stack, consumed.
 func (fcomp *fcomp) assign(pos syntax.Position, lhs syntax.Expr) {
@@ -1331,7 +1528,7 @@ func (fcomp *fcomp) expr(e syntax.Expr) {
 	case *syntax.IndexExpr:
 		fcomp.expr(e.X)
 		fcomp.expr(e.Y)
-		fcomp.setPos(e.Lbrack)
+		fcomp.setSpan(e.Lbrack, syntax.End(e))
 		fcomp.emit(INDEX)
 
 	case *syntax.SliceExpr:
@@ -1378,7 +1575,7 @@ func (fcomp *fcomp) expr(e syntax.Expr) {
 
 	case *syntax.UnaryExpr:
 		fcomp.expr(e.X)
-		fcomp.setPos(e.OpPos)
+		fcomp.setSpan(e.OpPos, syntax.End(e))
 		switch e.Op {
 		case syntax.MINUS:
 			fcomp.emit(UMINUS)
@@ -1435,12 +1632,12 @@ func (fcomp *fcomp) expr(e syntax.Expr) {
 			// all other strict binary operator (includes comparisons)
 			fcomp.expr(e.X)
 			fcomp.expr(e.Y)
-			fcomp.binop(e.OpPos, e.Op)
+			fcomp.binop(e.OpPos, syntax.End(e), e.Op)
 		}
 
 	case *syntax.DotExpr:
 		fcomp.expr(e.X)
-		fcomp.setPos(e.Dot)
+		fcomp.setSpan(e.Dot, syntax.End(e))
 		fcomp.emit1(ATTR, fcomp.pcomp.nameIndex(e.Name.Name))
 
 	case *syntax.CallExpr:
@@ -1449,6 +1646,15 @@ func (fcomp *fcomp) expr(e syntax.Expr) {
 	case *syntax.LambdaExpr:
 		fcomp.function(e.Function.(*resolve.Function))
 
+	case *syntax.YieldExpr:
+		if e.Value != nil {
+			fcomp.expr(e.Value)
+		} else {
+			fcomp.emit(NONE)
+		}
+		fcomp.setPos(e.Yield)
+		fcomp.emit(YIELD)
+
 	default:
 		start, _ := e.Span()
 		log.Panicf("%s: unexpected expr %T", start, e)
@@ -1597,9 +1803,9 @@ func unparen(e syntax.Expr) syntax.Expr {
 	return e
 }
 
-func (fcomp *fcomp) binop(pos syntax.Position, op syntax.Token) {
+func (fcomp *fcomp) binop(pos, end syntax.Position, op syntax.Token) {
 	// TODO(adonovan): simplify by assuming syntax and compiler constants align.
-	fcomp.setPos(pos)
+	fcomp.setSpan(pos, end)
 	switch op {
 	// arithmetic
 	case syntax.PLUS:
@@ -1657,7 +1863,7 @@ func (fcomp *fcomp) call(call *syntax.CallExpr) {
 	// usual case
 	fcomp.expr(call.Fn)
 	op, arg := fcomp.args(call)
-	fcomp.setPos(call.Lparen)
+	fcomp.setSpan(call.Lparen, syntax.End(call))
 	fcomp.emit1(op, arg)
 }
 
@@ -1865,12 +2071,13 @@ func (fcomp *fcomp) function(f *resolve.Function) {
 	funcode.NumKwonlyParams = f.NumKwonlyParams
 	funcode.HasVarargs = f.HasVarargs
 	funcode.HasKwargs = f.HasKwargs
+	funcode.Generator = f.Generator
 	fcomp.emit1(MAKEFUNC, fcomp.pcomp.functionIndex(funcode))
 }
 
 // ifelse emits a Boolean control flow decision.
 // On return, the current block is unset.
-func (fcomp *fcomp) ifelse(cond syntax.Expr, t, f *block) {
+func (fcomp *fcomp) ifelse(cond syntax.Expr, t, f *Block) {
 	switch cond := cond.(type) {
 	case *syntax.UnaryExpr:
 		if cond.Op == syntax.NOT {
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"go.starlark.net/internal/compile"
 	"go.starlark.net/starlark"
 )
 
@@ -72,3 +73,200 @@ func TestGarbage(t *testing.T) {
 		t.Fatalf("CompiledProgram reported the wrong error when decoding garbage: %v", err)
 	}
 }
+
+func TestVersionMismatch(t *testing.T) {
+	_, prog, err := starlark.SourceProgram("x.star", `x = 1`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := prog.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if v, err := starlark.CompiledProgramVersion(data); err != nil || v != starlark.CompilerVersion {
+		t.Errorf("CompiledProgramVersion = %d, %v, want %d", v, err, starlark.CompilerVersion)
+	}
+
+	// Patch the version (a one-byte zig-zag varint) to the previous one.
+	data[8] = byte(2 * (starlark.CompilerVersion - 1))
+	if v, err := starlark.CompiledProgramVersion(data); err != nil || v != starlark.CompilerVersion-1 {
+		t.Errorf("CompiledProgramVersion = %d, %v, want %d", v, err, starlark.CompilerVersion-1)
+	}
+	_, err = starlark.CompiledProgram(bytes.NewReader(data))
+	if err, ok := err.(*starlark.CompilerVersionError); !ok || err.Version != starlark.CompilerVersion-1 {
+		t.Errorf("CompiledProgram returned %v, want CompilerVersionError", err)
+	}
+}
+
+// TestCorrupt verifies that decoding a truncated or corrupt program
+// reports an error and does not panic.
+func TestCorrupt(t *testing.T) {
+	_, prog, err := starlark.SourceProgram("x.star", `
+def f(x, y=1.5, *args, **kwargs):
+    "doc"
+    return [x, y, "s", b"b", 1 << 70]
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := prog.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for i := range data {
+		if _, err := starlark.CompiledProgram(bytes.NewReader(data[:i])); err == nil {
+			t.Errorf("decoding %d-byte prefix succeeded unexpectedly", i)
+		}
+	}
+	for i := 9; i < len(data); i++ {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0xff
+		starlark.CompiledProgram(bytes.NewReader(corrupt)) // must not panic
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	const src = `def twice(x):
+    return x + x
+
+y = twice("a")
+`
+	_, prog, err := starlark.SourceProgram("twice.star", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := prog.Disassemble([]byte(src))
+	for _, want := range []string{
+		"function <toplevel> @ twice.star:1:1",
+		"; twice.star:4:5: y = twice(\"a\")",
+		"makefunc  \t0\t; twice",
+		"constant  \t0\t; \"a\"",
+		"call      \t256\t; 1 pos, 0 named",
+		"function twice @ twice.star:1:1",
+		"; twice.star:2:12: return x + x",
+		"local     \t0\t; x",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("disassembly does not contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "nop") {
+		t.Errorf("disassembly contains operand padding:\n%s", got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	_, prog, err := starlark.SourceProgram("x.star", `
+load("m", "a", b="c")
+
+def f(x, y=1, *args, z, **kwargs):
+    w = [e for e in x if e]
+    def g():
+        return w + [y]
+    return {k: v for k, v in kwargs.items()}, g, z
+
+def h(seq):
+    n = 0
+    for x in seq:
+        for y in x:
+            n += y[1:2]
+    return n
+`, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := prog.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if _, err := compile.DecodeProgram(data); err != nil {
+		t.Fatalf("valid program failed verification: %v", err)
+	}
+
+	for _, test := range []struct {
+		code []byte
+		want string
+	}{
+		{[]byte{byte(compile.POP), byte(compile.NONE), byte(compile.RETURN)}, "operand stack underflow"},
+		{[]byte{byte(compile.JMP), 1, byte(compile.NONE), byte(compile.RETURN)}, "invalid jump target 1"},
+		{[]byte{byte(compile.NONE), byte(compile.POP)}, "execution falls off end of code"},
+		{[]byte{byte(compile.CONSTANT), 99, byte(compile.RETURN)}, "invalid operand 99"},
+		{[]byte{byte(compile.ITERPOP), byte(compile.NONE), byte(compile.RETURN)}, "no active iterator"},
+		{[]byte{byte(compile.WITHEXIT), byte(compile.NONE), byte(compile.RETURN)}, "no active with statement"},
+		{[]byte{byte(compile.NONE), byte(compile.YIELD), byte(compile.RETURN)}, "yield in non-generator function"},
+		{[]byte{byte(compile.TRUE), byte(compile.CJMP), 4, byte(compile.NONE), byte(compile.NONE), byte(compile.RETURN)}, "inconsistent stack depths"},
+		{[]byte{255}, "invalid opcode 255"},
+		{[]byte{byte(compile.CONSTANT), 0x80}, "truncated or invalid operand"},
+	} {
+		p, err := compile.DecodeProgram(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Toplevel.Code = test.code
+		if err := p.Verify(); err == nil {
+			t.Errorf("Verify(% x) succeeded, want error %q", test.code, test.want)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Verify(% x) = %v, want error containing %q", test.code, err, test.want)
+		}
+
+		// An encoding of the invalid program is rejected on loading.
+		if _, err := starlark.CompiledProgram(bytes.NewReader(p.Encode())); err == nil {
+			t.Errorf("loading % x succeeded unexpectedly", test.code)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("loading % x: got %v, want error containing %q", test.code, err, test.want)
+		}
+	}
+}
+
+// rewriteGreeting enables a test pass that replaces
+// the constant "__greeting__" by "hello".
+var rewriteGreeting = false
+
+func init() {
+	compile.RegisterPass(compile.Pass{
+		Name: "test-rewrite-greeting",
+		Run: func(cfg *compile.CFG) {
+			if !rewriteGreeting {
+				return
+			}
+			consts := cfg.Funcode.Prog.Constants
+			for _, b := range cfg.Blocks() {
+				for i, insn := range b.Insns {
+					if insn.Op == compile.CONSTANT && consts[insn.Arg] == "__greeting__" {
+						b.Insns[i].Arg = cfg.ConstantIndex("hello")
+					}
+				}
+			}
+		},
+	})
+}
+
+func TestPass(t *testing.T) {
+	found := false
+	for _, name := range compile.Passes() {
+		if name == "test-rewrite-greeting" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Passes() = %v, missing test pass", compile.Passes())
+	}
+
+	rewriteGreeting = true
+	defer func() { rewriteGreeting = false }()
+	globals, err := starlark.ExecFile(new(starlark.Thread), "pass.star", `
+def f(suffix):
+    return "__greeting__" + suffix
+x = f(", world")
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["x"], starlark.String("hello, world"); got != want {
+		t.Errorf("x = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package compile
+
+// This file defines the framework for optimization passes.
+
+import "fmt"
+
+// A Pass is an optimization pass over the control-flow graph of a
+// function, run after the function's syntax tree has been converted to
+// Blocks and before they are encoded as bytecode.
+//
+// A pass may add, remove, or replace instructions and blocks, and may
+// add entries to the program's constant and name pools, but it must
+// preserve the program's meaning and its stack discipline: every block
+// must be entered with the same operand stack depth along every path,
+// and no instruction may pop more operands than the block has pushed
+// plus that depth. The compiler panics if a pass violates this rule.
+type Pass struct {
+	Name string         // unique name of the pass, for diagnostics
+	Run  func(cfg *CFG) // transforms the graph in place
+}
+
+// passes holds the registered passes, in order of registration.
+var passes []Pass
+
+// RegisterPass adds a pass to the sequence run by the compiler on every
+// function, after all previously registered passes.
+// It panics if a pass of the same name is already registered.
+// RegisterPass is not concurrency-safe; it is typically called
+// from an init function.
+func RegisterPass(pass Pass) {
+	if pass.Name == "" || pass.Run == nil {
+		panic("invalid pass")
+	}
+	for _, p := range passes {
+		if p.Name == pass.Name {
+			panic(fmt.Sprintf("duplicate pass %s", pass.Name))
+		}
+	}
+	passes = append(passes, pass)
+}
+
+// Passes returns the names of the registered passes, in order.
+func Passes() []string {
+	names := make([]string, len(passes))
+	for i, p := range passes {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// A CFG is the control-flow graph of a function under compilation.
+type CFG struct {
+	// Funcode is the function under compilation. Its Code,
+	// MaxStack, and position table are not yet computed.
+	Funcode *Funcode
+
+	Entry *Block // the entry block, whose initial stack is empty; a pass may replace it
+
+	fcomp *fcomp
+}
+
+// Blocks returns the blocks reachable from the entry, in depth-first
+// preorder. Blocks with no instructions are included.
+func (cfg *CFG) Blocks() []*Block {
+	var blocks []*Block
+	seen := make(map[*Block]bool)
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		if b == nil || seen[b] {
+			return
+		}
+		seen[b] = true
+		blocks = append(blocks, b)
+		visit(b.Jmp)
+		visit(b.Cjmp)
+	}
+	visit(cfg.Entry)
+	return blocks
+}
+
+// NewBlock returns a new empty block.
+func (cfg *CFG) NewBlock() *Block { return cfg.fcomp.newBlock() }
+
+// ConstantIndex returns the index of the specified constant within the
+// program's constant pool, adding it if necessary. The constant must
+// be of a type that may appear in Program.Constants.
+func (cfg *CFG) ConstantIndex(v interface{}) uint32 { return cfg.fcomp.pcomp.constantIndex(v) }
+
+// NameIndex returns the index of the specified name within the
+// program's name pool, adding it if necessary.
+func (cfg *CFG) NameIndex(name string) uint32 { return cfg.fcomp.pcomp.nameIndex(name) }
+
+// runPasses runs the registered passes over the graph of the function,
+// and returns its (possibly new) entry block.
+func (fcomp *fcomp) runPasses(entry *Block) *Block {
+	if len(passes) == 0 {
+		return entry
+	}
+	cfg := &CFG{Funcode: fcomp.fn, Entry: entry, fcomp: fcomp}
+	for _, pass := range passes {
+		pass.Run(cfg)
+		if cfg.Entry == nil {
+			panic(fmt.Sprintf("pass %s removed the entry block", pass.Name))
+		}
+	}
+	return cfg.Entry
+}
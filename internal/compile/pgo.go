@@ -0,0 +1,75 @@
+package compile
+
+// This file defines profile-guided compilation.
+//
+// The only optimization guided by a profile is block layout: code that
+// was never executed is moved out of the way of code that was. The
+// profile does not yet guide the choice of superinstructions, which
+// this compiler does not have, nor the inlining of calls, which it
+// does not do.
+//
+// TODO: use the profile to select superinstructions for the hottest
+// instruction sequences and to inline small, frequently called
+// functions, once the compiler supports them.
+
+import (
+	"fmt"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/syntax"
+)
+
+// A Profile holds the execution counts of the instructions of
+// functions, gathered by the interpreter, for profile-guided
+// compilation. It maps the ProfileKey of each function to the counts of
+// its instructions, indexed by program counter.
+//
+// Counts are meaningful only for code produced from the same source by
+// the same compiler without a profile, because a profile changes the
+// layout of the code.
+type Profile map[string][]uint64
+
+// ProfileKey returns the key of the function in a Profile.
+func (fn *Funcode) ProfileKey() string {
+	return fmt.Sprintf("%s %s", fn.Pos, fn.Name)
+}
+
+// FileProfile is a variant of File that uses a profile to guide
+// compilation. Blocks of code that the profile shows were never
+// executed are placed after all others, so that the frequently
+// executed code of each function is contiguous.
+func FileProfile(stmts []syntax.Stmt, pos syntax.Position, name string, locals, globals []*resolve.Binding, profile Profile) *Program {
+	pcomp := &pcomp{
+		prog: &Program{
+			Globals: bindings(globals),
+		},
+		names:     make(map[string]uint32),
+		constants: make(map[interface{}]uint32),
+		functions: make(map[*Funcode]uint32),
+		profile:   profile,
+	}
+	pcomp.prog.Toplevel = pcomp.function(name, pos, stmts, locals, nil)
+
+	return pcomp.prog
+}
+
+// coldBlocks returns the set of blocks of fn never executed according
+// to the profile, given the blocks and code length of the function's
+// default layout. It returns nil if the profile has no information
+// about the function, or if there are no cold blocks.
+func (p Profile) coldBlocks(fn *Funcode, blocks []*Block, codelen uint32) map[*Block]bool {
+	counts := p[fn.ProfileKey()]
+	if len(counts) != int(codelen) || counts[0] == 0 {
+		return nil // no profile, a profile of different code, or never called
+	}
+	var cold map[*Block]bool
+	for _, b := range blocks {
+		if counts[b.addr] == 0 {
+			if cold == nil {
+				cold = make(map[*Block]bool)
+			}
+			cold[b] = true
+		}
+	}
+	return cold
+}
@@ -2,10 +2,27 @@ package compile
 
 // This file defines functions to read and write a compile.Program to a file.
 //
-// It is the client's responsibility to avoid version skew between the
-// compiler used to produce a file and the interpreter that consumes it.
-// The version number is provided as a constant.
-// Incompatible protocol changes should also increment the version number.
+// Versioning
+//
+// Every encoding starts with a header that is the same in all versions:
+// the magic number, the offset of the string section, and the version
+// number of the encoder, which is the Version constant. Thus a decoder
+// can always determine the version of an encoding (see ReadVersion),
+// even one produced by a later version of this package.
+//
+// The version number identifies both the encoding and the semantics
+// of the bytecode it contains, so a decoder accepts only programs of
+// exactly its own version, and rejects all others with a VersionError.
+// It is the client's responsibility to recompile programs from source
+// when the version changes; clients that cache compiled programs should
+// incorporate the version into the cache key.
+// Any change to the encoding, or to the meaning of the bytecode,
+// must increment the version number.
+//
+// A decoder reports an error for a truncated or otherwise corrupt
+// encoding, rather than panicking, and verifies the bytecode
+// (see Program.Verify) so that the interpreter may safely execute
+// programs from untrusted sources.
 //
 // Encoding
 //
@@ -33,6 +50,8 @@ package compile
 //	code		[]byte
 //	pclinetablen	varint
 //	pclinetab	[]varint
+//	pcendtablen	varint
+//	pcendtab	[]varint	# end line and column of each pclinetab row
 //	numlocals	varint
 //	locals		[]Ident
 //	numcells	varint
@@ -44,6 +63,7 @@ package compile
 //	numkwonlyparams	varint
 //	hasvarargs	varint (0 or 1)
 //	haskwargs	varint (0 or 1)
+//	generator	varint (0 or 1)
 //
 // Ident:
 //	filename	string
@@ -188,6 +208,10 @@ func (e *encoder) function(fn *Funcode) {
 	for _, x := range fn.pclinetab {
 		e.int64(int64(x))
 	}
+	e.int(len(fn.pcendtab))
+	for _, x := range fn.pcendtab {
+		e.int64(int64(x))
+	}
 	e.bindings(fn.Locals)
 	e.int(len(fn.Cells))
 	for _, index := range fn.Cells {
@@ -199,6 +223,7 @@ func (e *encoder) function(fn *Funcode) {
 	e.int(fn.NumKwonlyParams)
 	e.int(b2i(fn.HasVarargs))
 	e.int(b2i(fn.HasKwargs))
+	e.int(b2i(fn.Generator))
 }
 
 func b2i(b bool) int {
@@ -209,47 +234,84 @@ func b2i(b bool) int {
 	}
 }
 
-// DecodeProgram decodes a compiled Starlark program from data.
-func DecodeProgram(data []byte) (_ *Program, err error) {
+// A VersionError reports an attempt to decode a program
+// encoded by a different version of the compiler.
+type VersionError struct {
+	Version int // version of the encoding
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("version mismatch: read %d, want %d", e.Version, Version)
+}
+
+// ReadVersion returns the version number of the encoded program,
+// which need not be the current Version, by reading only its header.
+func ReadVersion(data []byte) (int, error) {
 	if len(data) < len(magic) {
-		return nil, fmt.Errorf("not a compiled module: no magic number")
+		return 0, fmt.Errorf("not a compiled module: no magic number")
 	}
 	if got := string(data[:4]); got != magic {
-		return nil, fmt.Errorf("not a compiled module: got magic number %q, want %q",
+		return 0, fmt.Errorf("not a compiled module: got magic number %q, want %q",
 			got, magic)
 	}
+	if len(data) < 8 {
+		return 0, fmt.Errorf("corrupt compiled program: truncated header")
+	}
+	v, n := binary.Varint(data[8:])
+	if n <= 0 {
+		return 0, fmt.Errorf("corrupt compiled program: invalid version")
+	}
+	return int(v), nil
+}
+
+// DecodeProgram decodes a compiled Starlark program from data.
+// It returns a *VersionError if the program was encoded by a
+// different version of the compiler.
+func DecodeProgram(data []byte) (_ *Program, err error) {
+	v, err := ReadVersion(data)
+	if err != nil {
+		return nil, err
+	}
+	if v != Version {
+		return nil, &VersionError{v}
+	}
+	offset := binary.LittleEndian.Uint32(data[4:8])
+	if offset < 8 || int64(offset) > int64(len(data)) {
+		return nil, fmt.Errorf("corrupt compiled program: invalid string offset %d", offset)
+	}
+
 	defer func() {
 		if x := recover(); x != nil {
+			if x, ok := x.(corruptError); ok {
+				err = fmt.Errorf("corrupt compiled program: %s", string(x))
+				return
+			}
 			debugpkg.PrintStack()
 			err = fmt.Errorf("internal error while decoding program: %v", x)
 		}
 	}()
 
-	offset := binary.LittleEndian.Uint32(data[4:8])
 	d := decoder{
 		p: data[8:offset],
 		s: append([]byte(nil), data[offset:]...), // allocate a copy, which will persist
 	}
-
-	if v := d.int(); v != Version {
-		return nil, fmt.Errorf("version mismatch: read %d, want %d", v, Version)
-	}
+	d.int() // version
 
 	filename := d.string()
 	d.filename = &filename
 
 	loads := d.bindings()
 
-	names := make([]string, d.int())
+	names := make([]string, d.count())
 	for i := range names {
 		names[i] = d.string()
 	}
 
 	// constants
-	constants := make([]interface{}, d.int())
+	constants := make([]interface{}, d.count())
 	for i := range constants {
 		var c interface{}
-		switch d.int() {
+		switch t := d.int(); t {
 		case 0:
 			c = d.string()
 		case 1:
@@ -259,14 +321,20 @@ func DecodeProgram(data []byte) (_ *Program, err error) {
 		case 3:
 			c = math.Float64frombits(d.uint64())
 		case 4:
-			c, _ = new(big.Int).SetString(d.string(), 10)
+			s := d.string()
+			var ok bool
+			if c, ok = new(big.Int).SetString(s, 10); !ok {
+				panic(corruptError(fmt.Sprintf("invalid big integer constant %q", s)))
+			}
+		default:
+			panic(corruptError(fmt.Sprintf("invalid constant type %d", t)))
 		}
 		constants[i] = c
 	}
 
 	globals := d.bindings()
 	toplevel := d.function()
-	funcs := make([]*Funcode, d.int())
+	funcs := make([]*Funcode, d.count())
 	for i := range funcs {
 		funcs[i] = d.function()
 	}
@@ -285,7 +353,11 @@ func DecodeProgram(data []byte) (_ *Program, err error) {
 	}
 
 	if len(d.p)+len(d.s) > 0 {
-		return nil, fmt.Errorf("internal error: unconsumed data during decoding")
+		return nil, fmt.Errorf("corrupt compiled program: unconsumed data during decoding")
+	}
+
+	if err := prog.Verify(); err != nil {
+		return nil, fmt.Errorf("corrupt compiled program: %v", err)
 	}
 
 	return prog, nil
@@ -297,22 +369,42 @@ type decoder struct {
 	filename *string // (indirect to avoid keeping decoder live)
 }
 
+// A corruptError is the panic value by which the decoder
+// reports an invalid encoding. DecodeProgram recovers it.
+type corruptError string
+
 func (d *decoder) int() int {
 	return int(d.int64())
 }
 
 func (d *decoder) int64() int64 {
 	x, len := binary.Varint(d.p[:])
+	if len <= 0 {
+		panic(corruptError("truncated or invalid integer"))
+	}
 	d.p = d.p[len:]
 	return x
 }
 
 func (d *decoder) uint64() uint64 {
 	x, len := binary.Uvarint(d.p[:])
+	if len <= 0 {
+		panic(corruptError("truncated or invalid integer"))
+	}
 	d.p = d.p[len:]
 	return x
 }
 
+// count decodes the length of a sequence of encoded items.
+func (d *decoder) count() int {
+	n := d.int()
+	// Each item occupies at least one byte.
+	if n < 0 || n > len(d.p) {
+		panic(corruptError(fmt.Sprintf("invalid sequence length %d", n)))
+	}
+	return n
+}
+
 func (d *decoder) string() (s string) {
 	if slice := d.bytes(); len(slice) > 0 {
 		// Avoid a memory allocation for each string
@@ -329,9 +421,12 @@ func (d *decoder) string() (s string) {
 }
 
 func (d *decoder) bytes() []byte {
-	len := d.int()
-	r := d.s[:len:len]
-	d.s = d.s[len:]
+	n := d.int()
+	if n < 0 || n > len(d.s) {
+		panic(corruptError(fmt.Sprintf("invalid string length %d", n)))
+	}
+	r := d.s[:n:n]
+	d.s = d.s[n:]
 	return r
 }
 
@@ -343,7 +438,7 @@ func (d *decoder) binding() Binding {
 }
 
 func (d *decoder) bindings() []Binding {
-	bindings := make([]Binding, d.int())
+	bindings := make([]Binding, d.count())
 	for i := range bindings {
 		bindings[i] = d.binding()
 	}
@@ -351,7 +446,7 @@ func (d *decoder) bindings() []Binding {
 }
 
 func (d *decoder) ints() []int {
-	ints := make([]int, d.int())
+	ints := make([]int, d.count())
 	for i := range ints {
 		ints[i] = d.int()
 	}
@@ -364,10 +459,14 @@ func (d *decoder) function() *Funcode {
 	id := d.binding()
 	doc := d.string()
 	code := d.bytes()
-	pclinetab := make([]uint16, d.int())
+	pclinetab := make([]uint16, d.count())
 	for i := range pclinetab {
 		pclinetab[i] = uint16(d.int())
 	}
+	pcendtab := make([]int32, d.count())
+	for i := range pcendtab {
+		pcendtab[i] = int32(d.int())
+	}
 	locals := d.bindings()
 	cells := d.ints()
 	freevars := d.bindings()
@@ -376,6 +475,7 @@ func (d *decoder) function() *Funcode {
 	numKwonlyParams := d.int()
 	hasVarargs := d.int() != 0
 	hasKwargs := d.int() != 0
+	generator := d.int() != 0
 	return &Funcode{
 		// Prog is filled in later.
 		Pos:             id.Pos,
@@ -383,6 +483,7 @@ func (d *decoder) function() *Funcode {
 		Doc:             doc,
 		Code:            code,
 		pclinetab:       pclinetab,
+		pcendtab:        pcendtab,
 		Locals:          locals,
 		Cells:           cells,
 		Freevars:        freevars,
@@ -391,5 +492,6 @@ func (d *decoder) function() *Funcode {
 		NumKwonlyParams: numKwonlyParams,
 		HasVarargs:      hasVarargs,
 		HasKwargs:       hasKwargs,
+		Generator:       generator,
 	}
 }
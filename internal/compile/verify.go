@@ -0,0 +1,298 @@
+package compile
+
+// This file defines the bytecode verifier.
+
+import "fmt"
+
+// Verify checks that the program is well formed, so that the
+// interpreter may execute it without crashing even if the program was
+// decoded from untrusted input. For each function, it checks that
+// every instruction is valid; that every operand refers to an existing
+// constant, name, variable, or function; that every jump targets the
+// start of an instruction; that execution cannot fall off the end of
+// the code; and that the depths of the operand, iterator, and with
+// stacks are consistent at every instruction, never negative, and
+// within the declared maximum.
+//
+// Verify does not check the types of operands. The interpreter checks
+// dynamically any type assumptions the compiler relies upon.
+func (prog *Program) Verify() error {
+	if prog.Toplevel == nil {
+		return fmt.Errorf("no toplevel function")
+	}
+	if err := prog.Toplevel.verify(); err != nil {
+		return err
+	}
+	for _, fn := range prog.Functions {
+		if err := fn.verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyState is the abstract state of the machine before an instruction.
+type verifyState struct {
+	sp, iters, withs int // depths of operand, iterator, and with stacks
+}
+
+func (fn *Funcode) verify() error {
+	_, err := fn.analyze()
+	return err
+}
+
+// StackDepths returns, indexed by pc, the depths of the operand and
+// iterator stacks before each reachable instruction of the function,
+// or -1 at other offsets. It reports an error if the function is not
+// well formed, as for Verify.
+func (fn *Funcode) StackDepths() (operands, iters []int, err error) {
+	states, err := fn.analyze()
+	if err != nil {
+		return nil, nil, err
+	}
+	operands = make([]int, len(fn.Code))
+	iters = make([]int, len(fn.Code))
+	for pc := range fn.Code {
+		operands[pc], iters[pc] = -1, -1
+	}
+	for pc, st := range states {
+		operands[pc], iters[pc] = st.sp, st.iters
+	}
+	return operands, iters, nil
+}
+
+// analyze checks the function, and returns the
+// abstract state before each reachable instruction.
+func (fn *Funcode) analyze() (states map[uint32]verifyState, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("invalid bytecode in function %s: %v", fn.Name, err)
+		}
+	}()
+
+	// Check the function's declarations.
+	nparams := fn.NumParams
+	if nparams < 0 || nparams > len(fn.Locals) ||
+		fn.NumKwonlyParams < 0 || fn.NumKwonlyParams > nparams ||
+		b2i(fn.HasVarargs)+b2i(fn.HasKwargs)+fn.NumKwonlyParams > nparams {
+		return nil, fmt.Errorf("invalid parameters")
+	}
+	if fn.MaxStack < 0 {
+		return nil, fmt.Errorf("invalid maximum stack depth %d", fn.MaxStack)
+	}
+	isCell := make([]bool, len(fn.Locals))
+	for _, index := range fn.Cells {
+		if index < 0 || index >= len(fn.Locals) || isCell[index] {
+			return nil, fmt.Errorf("invalid cell index %d", index)
+		}
+		isCell[index] = true
+	}
+
+	// Decode the instructions, and mark where each starts.
+	code := fn.Code
+	start := make([]bool, len(code))
+	for pc := 0; pc < len(code); {
+		start[pc] = true
+		op := Opcode(code[pc])
+		if op > OpcodeMax || opcodeNames[op] == "" {
+			return nil, fmt.Errorf("pc %d: invalid opcode %d", pc, op)
+		}
+		pc++
+		if op >= OpcodeArgMin {
+			// Decode a uint32 operand, as DecodeOp does.
+			for i := 0; ; i++ {
+				if pc == len(code) || i == 5 {
+					return nil, fmt.Errorf("pc %d: truncated or invalid operand", pc)
+				}
+				b := code[pc]
+				pc++
+				if b < 0x80 {
+					break
+				}
+			}
+		}
+	}
+	if len(code) == 0 {
+		return nil, fmt.Errorf("empty code")
+	}
+
+	// Interpret the code abstractly, propagating the state
+	// before each instruction to its successors.
+	states = make(map[uint32]verifyState)
+	var worklist []uint32
+	flow := func(from, to uint32, st verifyState) error {
+		if int(to) >= len(code) || !start[to] {
+			return fmt.Errorf("pc %d: invalid jump target %d", from, to)
+		}
+		if prev, ok := states[to]; !ok {
+			states[to] = st
+			worklist = append(worklist, to)
+		} else if prev != st {
+			return fmt.Errorf("pc %d: inconsistent stack depths (%+v vs. %+v)", to, prev, st)
+		}
+		return nil
+	}
+	if err := flow(0, 0, verifyState{}); err != nil {
+		return nil, err
+	}
+	for len(worklist) > 0 {
+		pc := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+		st := states[pc]
+
+		op, arg, next := DecodeOp(code, pc)
+		if err := fn.checkOperand(op, arg, isCell); err != nil {
+			return nil, fmt.Errorf("pc %d: %s: %v", pc, op, err)
+		}
+
+		// Check the operand stack.
+		in, out := stackInputsOutputs(op, arg)
+		if st.sp < in {
+			return nil, fmt.Errorf("pc %d: %s: operand stack underflow", pc, op)
+		}
+		st.sp += out - in
+		if st.sp > fn.MaxStack {
+			return nil, fmt.Errorf("pc %d: %s: operand stack overflow", pc, op)
+		}
+
+		// Check the iterator and with stacks.
+		switch op {
+		case ITERPUSH:
+			st.iters++
+		case ITERPOP, ITERJMP:
+			if st.iters == 0 {
+				return nil, fmt.Errorf("pc %d: %s: no active iterator", pc, op)
+			}
+			if op == ITERPOP {
+				st.iters--
+			}
+		case WITHENTER:
+			st.withs++
+		case WITHEXIT:
+			if st.withs == 0 {
+				return nil, fmt.Errorf("pc %d: %s: no active with statement", pc, op)
+			}
+			st.withs--
+		case YIELD:
+			if !fn.Generator {
+				return nil, fmt.Errorf("pc %d: yield in non-generator function", pc)
+			}
+		}
+
+		// Propagate the state to the successors.
+		switch op {
+		case RETURN:
+			continue
+		case JMP:
+			if err := flow(pc, arg, st); err != nil {
+				return nil, err
+			}
+			continue
+		case CJMP:
+			if err := flow(pc, arg, st); err != nil {
+				return nil, err
+			}
+		case ITERJMP:
+			// The jump (when the iterator is exhausted) pushes nothing.
+			if err := flow(pc, arg, st); err != nil {
+				return nil, err
+			}
+			st.sp++ // the fall-through pushes the next element
+			if st.sp > fn.MaxStack {
+				return nil, fmt.Errorf("pc %d: %s: operand stack overflow", pc, op)
+			}
+		}
+		if int(next) == len(code) {
+			return nil, fmt.Errorf("pc %d: %s: execution falls off end of code", pc, op)
+		}
+		if err := flow(pc, next, st); err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+// checkOperand checks that the operand of an instruction
+// refers to an existing entity of the appropriate kind.
+func (fn *Funcode) checkOperand(op Opcode, arg uint32, isCell []bool) error {
+	var n int // size of the referenced table
+	switch op {
+	case CONSTANT:
+		n = len(fn.Prog.Constants)
+	case MAKEFUNC:
+		n = len(fn.Prog.Functions)
+	case SETGLOBAL, GLOBAL:
+		n = len(fn.Prog.Globals)
+	case ATTR, SETFIELD, DELFIELD, PREDECLARED, UNIVERSAL:
+		n = len(fn.Prog.Names)
+	case FREE, FREECELL:
+		n = len(fn.Freevars)
+	case SETLOCAL, LOCAL, LOCALCELL, SETLOCALCELL:
+		if int64(arg) >= int64(len(fn.Locals)) {
+			return fmt.Errorf("invalid local index %d", arg)
+		}
+		// The contents of a cell are accessed only by the *CELL
+		// operations, though LOCAL may load a cell itself
+		// (to capture it in a closure).
+		if wantCell := op == LOCALCELL || op == SETLOCALCELL; op != LOCAL && isCell[arg] != wantCell {
+			return fmt.Errorf("invalid access to local %s", fn.Locals[arg].Name)
+		}
+		return nil
+	default:
+		return nil
+	}
+	if int64(arg) >= int64(n) {
+		return fmt.Errorf("invalid operand %d", arg)
+	}
+	return nil
+}
+
+// stackInputsOutputs returns the number of operands consumed and
+// produced by an instruction. (For ITERJMP, the element pushed on
+// the fall-through path is handled by the caller.)
+func stackInputsOutputs(op Opcode, arg uint32) (in, out int) {
+	switch op {
+	case CALL, CALL_VAR, CALL_KW, CALL_VAR_KW:
+		in = 1 + int(arg>>8) + 2*int(arg&0xff)
+		if op == CALL_VAR || op == CALL_VAR_KW {
+			in++
+		}
+		if op == CALL_KW || op == CALL_VAR_KW {
+			in++
+		}
+		return in, 1
+	case MAKETUPLE, MAKELIST:
+		return int(arg), 1
+	case UNPACK:
+		return 1, int(arg)
+	case LOAD:
+		return int(arg) + 1, int(arg)
+	case ITERJMP:
+		return 0, 0
+	case DUP:
+		return 1, 2
+	case DUP2:
+		return 2, 4
+	case EXCH:
+		return 2, 2
+	case NOT, UPLUS, UMINUS, TILDE, ATTR, MAKEFUNC, WITHENTER, YIELD:
+		return 1, 1
+	case INDEX:
+		return 2, 1
+	case SLICE:
+		return 4, 1
+	}
+	// All remaining instructions consume their operands and
+	// produce at most one result, as their stack effect shows.
+	se := int(stackEffect[op])
+	switch op {
+	case LT, GT, GE, LE, EQL, NEQ, PLUS, MINUS, STAR, SLASH, SLASHSLASH,
+		PERCENT, AMP, PIPE, CIRCUMFLEX, LTLT, GTGT, IN,
+		INPLACE_ADD, INPLACE_PIPE:
+		return 2, 1
+	}
+	if se > 0 {
+		return 0, se
+	}
+	return -se, 0
+}
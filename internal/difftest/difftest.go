@@ -0,0 +1,377 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package difftest provides differential testing of this Starlark
+// interpreter against other implementations, such as starlark-rust or
+// the Java implementation in Bazel.
+//
+// A Generator produces random programs in the core dialect of Starlark
+// shared by all implementations. Each program is executed by every
+// Implementation, and any difference in the printed output, or in
+// whether execution failed, is reported as a divergence, after the
+// program has been reduced by Minimize to the fewest statements that
+// still diverge. Error messages are not compared, as they are not
+// specified.
+package difftest // import "go.starlark.net/internal/difftest"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// A Result is the outcome of executing a program.
+type Result struct {
+	Output string // text printed by the program
+	Failed bool   // execution failed, statically or dynamically
+	Err    string // description of the failure, for reporting only
+}
+
+// Equal reports whether two results are equivalent,
+// ignoring the descriptions of any failures.
+func (r Result) Equal(s Result) bool {
+	return r.Output == s.Output && r.Failed == s.Failed
+}
+
+// An Implementation executes Starlark programs.
+type Implementation interface {
+	Name() string
+	Run(src string) Result
+}
+
+// Local is the Implementation provided by this interpreter.
+// A panic during execution is reported as a failure.
+type Local struct{}
+
+func (Local) Name() string { return "go" }
+
+func (Local) Run(src string) (res Result) {
+	defer func() {
+		if x := recover(); x != nil {
+			res.Failed, res.Err = true, fmt.Sprintf("panic: %v", x)
+		}
+	}()
+	var out bytes.Buffer
+	thread := &starlark.Thread{
+		Name:  "difftest",
+		Print: func(_ *starlark.Thread, msg string) { fmt.Fprintln(&out, msg) },
+	}
+	thread.SetMaxExecutionSteps(1e7)
+	_, err := starlark.ExecFile(thread, "prog.star", src, nil)
+	res.Output = out.String()
+	if err != nil {
+		res.Failed, res.Err = true, err.Error()
+	}
+	return res
+}
+
+// A Command is an Implementation that executes each program in a
+// subprocess, by running the specified command with the name of a
+// temporary file containing the program appended to its arguments.
+// The command must write the output of the program's print
+// statements to its standard output, and must exit with a non-zero
+// status if execution fails.
+type Command struct {
+	Label string   // name of the implementation
+	Path  string   // name or path of the executable
+	Args  []string // arguments preceding the file name
+	Env   []string // additional environment variables
+}
+
+func (c *Command) Name() string { return c.Label }
+
+func (c *Command) Run(src string) Result {
+	f, err := ioutil.TempFile("", "difftest*.star")
+	if err != nil {
+		return Result{Failed: true, Err: err.Error()}
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(src)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return Result{Failed: true, Err: err.Error()}
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.Path, append(c.Args[:len(c.Args):len(c.Args)], f.Name())...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	res := Result{Output: stdout.String()}
+	if err != nil {
+		res.Failed, res.Err = true, strings.TrimSpace(err.Error()+"\n"+stderr.String())
+	}
+	return res
+}
+
+// A Divergence is a program whose results differ between implementations.
+type Divergence struct {
+	Program string
+	Names   []string // names of the implementations
+	Results []Result // results, in the same order
+}
+
+func (d *Divergence) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "program:\n%s", d.Program)
+	for i, name := range d.Names {
+		res := d.Results[i]
+		fmt.Fprintf(&buf, "%s output:\n%s", name, res.Output)
+		if res.Failed {
+			fmt.Fprintf(&buf, "%s failed: %s\n", name, res.Err)
+		}
+	}
+	return buf.String()
+}
+
+// Compare executes the program using each implementation, and
+// returns a Divergence if the results are not all equivalent.
+func Compare(src string, impls ...Implementation) *Divergence {
+	d := &Divergence{Program: src}
+	diverged := false
+	for _, impl := range impls {
+		res := impl.Run(src)
+		if len(d.Results) > 0 && !res.Equal(d.Results[0]) {
+			diverged = true
+		}
+		d.Names = append(d.Names, impl.Name())
+		d.Results = append(d.Results, res)
+	}
+	if !diverged {
+		return nil
+	}
+	return d
+}
+
+// Minimize returns a reduction of the divergent program, obtained by
+// repeatedly removing single lines while the implementations continue
+// to diverge, and the divergence of the reduced program.
+func Minimize(d *Divergence, impls ...Implementation) *Divergence {
+	lines := strings.SplitAfter(d.Program, "\n")
+	for changed := true; changed; {
+		changed = false
+		for i := len(lines) - 1; i >= 0; i-- {
+			reduced := append(append([]string(nil), lines[:i]...), lines[i+1:]...)
+			if d2 := Compare(strings.Join(reduced, ""), impls...); d2 != nil {
+				lines, d, changed = reduced, d2, true
+			}
+		}
+	}
+	return d
+}
+
+// A Generator produces random programs in the core dialect of Starlark,
+// consisting of assignments of random expressions to variables, each
+// followed by a statement to print the variable. Most expressions are
+// well typed, but some fail dynamically, for example by division by
+// zero or by an out-of-range index, so that error semantics are tested
+// too.
+type Generator struct {
+	Statements int // number of assignments per program (default 10)
+	MaxDepth   int // maximum depth of expressions (default 4)
+
+	rand *rand.Rand
+	vars []variable // variables of the current program
+}
+
+type variable struct {
+	name string
+	typ  typ
+}
+
+type typ int
+
+const (
+	intType typ = iota
+	stringType
+	boolType
+	listType // of int
+	dictType // from string to int
+	numTypes
+)
+
+// NewGenerator returns a generator whose
+// programs are determined by the seed.
+func NewGenerator(seed int64) *Generator {
+	return &Generator{rand: rand.New(rand.NewSource(seed))}
+}
+
+// Program returns a new random program.
+func (g *Generator) Program() string {
+	n := g.Statements
+	if n <= 0 {
+		n = 10
+	}
+	g.vars = g.vars[:0]
+	var buf strings.Builder
+	for i := 0; i < n; i++ {
+		t := typ(g.rand.Intn(int(numTypes)))
+		v := variable{fmt.Sprintf("v%d", i), t}
+		fmt.Fprintf(&buf, "%s = %s\n", v.name, g.expr(t, g.maxDepth()))
+		fmt.Fprintf(&buf, "print(%q, repr(%s))\n", v.name, v.name)
+		g.vars = append(g.vars, v)
+	}
+	return buf.String()
+}
+
+func (g *Generator) maxDepth() int {
+	if g.MaxDepth <= 0 {
+		return 4
+	}
+	return g.MaxDepth
+}
+
+// expr returns a random expression of type t.
+func (g *Generator) expr(t typ, depth int) string {
+	if depth <= 0 || g.rand.Intn(4) == 0 {
+		return g.leaf(t)
+	}
+	d := depth - 1
+	switch t {
+	case intType:
+		switch g.rand.Intn(8) {
+		case 0, 1:
+			op := []string{"+", "-", "*", "//", "%", "&", "|", "^"}[g.rand.Intn(8)]
+			return fmt.Sprintf("(%s %s %s)", g.expr(intType, d), op, g.expr(intType, d))
+		case 2:
+			return fmt.Sprintf("-%s", g.expr(intType, d))
+		case 3:
+			return fmt.Sprintf("len(%s)", g.expr([]typ{stringType, listType, dictType}[g.rand.Intn(3)], d))
+		case 4:
+			// The list is non-empty, and the index usually valid.
+			i := []string{"0", "-1", g.index()}[g.rand.Intn(3)]
+			return fmt.Sprintf("(%s + [%s])[%s]", g.expr(listType, d), g.leaf(intType), i)
+		case 5:
+			return fmt.Sprintf("%s.find(%s)", g.expr(stringType, d), g.expr(stringType, d))
+		case 6:
+			return fmt.Sprintf("(%s if %s else %s)", g.expr(intType, d), g.expr(boolType, d), g.expr(intType, d))
+		default:
+			return fmt.Sprintf("%s.get(%s, %s)", g.expr(dictType, d), g.expr(stringType, d), g.expr(intType, d))
+		}
+
+	case stringType:
+		switch g.rand.Intn(7) {
+		case 0, 1:
+			return fmt.Sprintf("(%s + %s)", g.expr(stringType, d), g.expr(stringType, d))
+		case 2:
+			return fmt.Sprintf("str(%s)", g.expr([]typ{intType, boolType, listType, dictType}[g.rand.Intn(4)], d))
+		case 3:
+			return fmt.Sprintf("%s[%s:%s]", g.expr(stringType, d), g.index(), g.index())
+		case 4:
+			method := []string{"upper", "lower", "strip", "title"}[g.rand.Intn(4)]
+			return fmt.Sprintf("%s.%s()", g.expr(stringType, d), method)
+		case 5:
+			return fmt.Sprintf("%s.replace(%s, %s)", g.expr(stringType, d), g.leaf(stringType), g.leaf(stringType))
+		default:
+			return fmt.Sprintf("%s.join([str(x) for x in %s])", g.leaf(stringType), g.expr(listType, d))
+		}
+
+	case boolType:
+		switch g.rand.Intn(5) {
+		case 0:
+			op := []string{"<", "<=", ">", ">=", "==", "!="}[g.rand.Intn(6)]
+			return fmt.Sprintf("(%s %s %s)", g.expr(intType, d), op, g.expr(intType, d))
+		case 1:
+			op := []string{"<", "==", "!="}[g.rand.Intn(3)]
+			return fmt.Sprintf("(%s %s %s)", g.expr(stringType, d), op, g.expr(stringType, d))
+		case 2:
+			return fmt.Sprintf("(%s in %s)", g.expr(intType, d), g.expr(listType, d))
+		case 3:
+			op := []string{"and", "or"}[g.rand.Intn(2)]
+			return fmt.Sprintf("(%s %s %s)", g.expr(boolType, d), op, g.expr(boolType, d))
+		default:
+			return fmt.Sprintf("(not %s)", g.expr(boolType, d))
+		}
+
+	case listType:
+		switch g.rand.Intn(6) {
+		case 0:
+			return fmt.Sprintf("(%s + %s)", g.expr(listType, d), g.expr(listType, d))
+		case 1:
+			return fmt.Sprintf("%s[%s:%s:%s]", g.expr(listType, d), g.index(), g.index(), g.nonzero())
+		case 2:
+			return fmt.Sprintf("sorted(%s)", g.expr(listType, d))
+		case 3:
+			return fmt.Sprintf("[x * %s for x in %s if x %% 2 == %d]", g.expr(intType, d), g.expr(listType, d), g.rand.Intn(2))
+		case 4:
+			// (Bounds are small, lest the list be too large.)
+			return fmt.Sprintf("list(range(%d, %d, %s))", g.rand.Intn(21)-10, g.rand.Intn(21)-10, g.nonzero())
+		default:
+			return fmt.Sprintf("%s.values()", g.expr(dictType, d))
+		}
+
+	default: // dictType
+		switch g.rand.Intn(3) {
+		case 0:
+			return fmt.Sprintf("dict(%s, %s=%s)", g.expr(dictType, d), g.ident(), g.expr(intType, d))
+		case 1:
+			return fmt.Sprintf("{str(k): k for k in %s}", g.expr(listType, d))
+		default:
+			return fmt.Sprintf("{%s: %s}", g.expr(stringType, d), g.expr(intType, d))
+		}
+	}
+}
+
+// leaf returns a literal or variable of type t.
+func (g *Generator) leaf(t typ) string {
+	if g.rand.Intn(3) == 0 {
+		var candidates []string
+		for _, v := range g.vars {
+			if v.typ == t {
+				candidates = append(candidates, v.name)
+			}
+		}
+		if len(candidates) > 0 {
+			return candidates[g.rand.Intn(len(candidates))]
+		}
+	}
+	switch t {
+	case intType:
+		if g.rand.Intn(8) == 0 {
+			return fmt.Sprint(g.rand.Int63()) // a large int
+		}
+		return fmt.Sprint(g.rand.Intn(21) - 10)
+	case stringType:
+		return fmt.Sprintf("%q", []string{"", "a", "abc", "Hello, World", " x y ", "b,a,b"}[g.rand.Intn(6)])
+	case boolType:
+		return []string{"True", "False"}[g.rand.Intn(2)]
+	case listType:
+		elems := make([]string, g.rand.Intn(5))
+		for i := range elems {
+			elems[i] = g.leaf(intType)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	default:
+		keys := g.rand.Perm(3)[:g.rand.Intn(3)] // distinct
+		elems := make([]string, len(keys))
+		for i, k := range keys {
+			elems[i] = fmt.Sprintf("%q: %s", identNames[k], g.leaf(intType))
+		}
+		return "{" + strings.Join(elems, ", ") + "}"
+	}
+}
+
+// index returns a small integer literal, for use as an index.
+func (g *Generator) index() string {
+	return fmt.Sprint(g.rand.Intn(9) - 4)
+}
+
+func (g *Generator) nonzero() string {
+	return fmt.Sprint([]int{-2, -1, 1, 2, 3}[g.rand.Intn(5)])
+}
+
+var identNames = []string{"a", "b", "k"}
+
+func (g *Generator) ident() string {
+	return identNames[g.rand.Intn(len(identNames))]
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package difftest_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"go.starlark.net/internal/difftest"
+)
+
+// When run with this environment variable set, the test binary acts as
+// a reference implementation, executing the file named by its last
+// argument using Local.
+func TestMain(m *testing.M) {
+	if os.Getenv("DIFFTEST_HELPER") == "1" {
+		src, err := ioutil.ReadFile(os.Args[len(os.Args)-1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		res := difftest.Local{}.Run(string(src))
+		fmt.Print(res.Output)
+		if res.Failed {
+			fmt.Fprintln(os.Stderr, res.Err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestGenerator(t *testing.T) {
+	if a, b := difftest.NewGenerator(1).Program(), difftest.NewGenerator(1).Program(); a != b {
+		t.Fatalf("programs of same seed differ:\n%s\n%s", a, b)
+	}
+
+	// Generated programs are valid Starlark, and most execute successfully.
+	g := difftest.NewGenerator(1)
+	ok := 0
+	const n = 200
+	for i := 0; i < n; i++ {
+		src := g.Program()
+		res := difftest.Local{}.Run(src)
+		if !res.Failed {
+			ok++
+		} else if strings.Contains(res.Err, "syntax error") || strings.Contains(res.Err, "undefined") {
+			t.Errorf("invalid program: %s\n%s", res.Err, src)
+		}
+	}
+	if ok < n/2 {
+		t.Errorf("only %d of %d programs succeeded", ok, n)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	ref := &difftest.Command{Label: "ref", Path: os.Args[0], Env: []string{"DIFFTEST_HELPER=1"}}
+	g := difftest.NewGenerator(2)
+	for i := 0; i < 5; i++ {
+		if d := difftest.Compare(g.Program(), difftest.Local{}, ref); d != nil {
+			t.Errorf("unexpected divergence:\n%s", d)
+		}
+	}
+	if res := ref.Run("x = 1 // 0"); !res.Failed || !strings.Contains(res.Err, "division by zero") {
+		t.Errorf("Run of failing program = %+v", res)
+	}
+}
+
+// broken is an implementation that evaluates % incorrectly.
+type broken struct{}
+
+func (broken) Name() string { return "broken" }
+
+func (broken) Run(src string) difftest.Result {
+	return difftest.Local{}.Run(strings.Replace(src, "%", "//", -1))
+}
+
+func TestMinimize(t *testing.T) {
+	const src = `a = 1
+print(a)
+b = 7 % 3
+print(b)
+c = "x"
+print(c)
+`
+	d := difftest.Compare(src, difftest.Local{}, broken{})
+	if d == nil {
+		t.Fatal("no divergence")
+	}
+	d = difftest.Minimize(d, difftest.Local{}, broken{})
+	if want := "b = 7 % 3\nprint(b)\n"; d.Program != want {
+		t.Errorf("minimized program = %q", d.Program)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bisect provides binary search and insertion for sorted lists,
+// in the manner of Python's bisect module.
+package bisect // import "go.starlark.net/lib/bisect"
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// Module bisect is a Starlark module of functions for sorted sequences.
+// The module defines the following functions:
+//
+//     bisect_left(a, x, lo=0, hi=len(a), key=None) - Returns the index at which to insert x
+//                   into the sorted sequence a so as to keep it sorted, before any elements equal to x.
+//     bisect_right(a, x, lo=0, hi=len(a), key=None) - Like bisect_left, but returns the index
+//                   after any elements equal to x.
+//     bisect(a, x, lo=0, hi=len(a), key=None) - Same as bisect_right.
+//     insort_left(a, x, lo=0, hi=len(a), key=None) - Inserts x into the sorted list a
+//                   at the index returned by bisect_left.
+//     insort_right(a, x, lo=0, hi=len(a), key=None) - Inserts x into the sorted list a
+//                   at the index returned by bisect_right.
+//     insort(a, x, lo=0, hi=len(a), key=None) - Same as insort_right.
+//
+// The search considers only the elements a[lo:hi]. If key is not None,
+// it is a function of one argument that is applied to each element of a
+// before comparison. The bisect functions compare x itself to the keys,
+// whereas the insort functions compare key(x). Each function calls key
+// O(log n) times, and compares values using the < operator.
+//
+var Module = &starlarkstruct.Module{
+	Name: "bisect",
+	Members: starlark.StringDict{
+		"bisect":       starlark.NewBuiltin("bisect", bisect),
+		"bisect_left":  starlark.NewBuiltin("bisect_left", bisect),
+		"bisect_right": starlark.NewBuiltin("bisect_right", bisect),
+		"insort":       starlark.NewBuiltin("insort", insort),
+		"insort_left":  starlark.NewBuiltin("insort_left", insort),
+		"insort_right": starlark.NewBuiltin("insort_right", insort),
+	},
+}
+
+// args holds the arguments common to all functions of the module.
+type args struct {
+	a      starlark.Indexable
+	x      starlark.Value
+	lo, hi int
+	key    starlark.Callable
+	left   bool // search before equal elements
+}
+
+func unpack(b *starlark.Builtin, tuple starlark.Tuple, kwargs []starlark.Tuple) (*args, error) {
+	var p args
+	var hi, key starlark.Value = starlark.None, starlark.None
+	if err := starlark.UnpackArgs(b.Name(), tuple, kwargs,
+		"a", &p.a, "x", &p.x, "lo?", &p.lo, "hi?", &hi, "key?", &key); err != nil {
+		return nil, err
+	}
+	p.hi = p.a.Len()
+	if hi != starlark.None {
+		if err := starlark.AsInt(hi, &p.hi); err != nil {
+			return nil, fmt.Errorf("%s: for parameter hi: %v", b.Name(), err)
+		}
+	}
+	if p.lo < 0 {
+		return nil, fmt.Errorf("%s: lo must be non-negative", b.Name())
+	}
+	if p.hi > p.a.Len() {
+		p.hi = p.a.Len()
+	}
+	if key != starlark.None {
+		fn, ok := key.(starlark.Callable)
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter key: got %s, want callable", b.Name(), key.Type())
+		}
+		p.key = fn
+	}
+	p.left = strings.HasSuffix(b.Name(), "_left")
+	return &p, nil
+}
+
+// search returns the insertion index of x in p.a[p.lo:p.hi],
+// comparing x to the key of each element.
+func (p *args) search(thread *starlark.Thread, x starlark.Value) (int, error) {
+	lo, hi := p.lo, p.hi
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		elem := p.a.Index(mid)
+		if p.key != nil {
+			var err error
+			elem, err = starlark.Call(thread, p.key, starlark.Tuple{elem}, nil)
+			if err != nil {
+				return 0, err
+			}
+		}
+		var before bool // x belongs before elem
+		var err error
+		if p.left {
+			before, err = starlark.Compare(syntax.LT, elem, x)
+			before = !before
+		} else {
+			before, err = starlark.Compare(syntax.LT, x, elem)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if before {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
+
+func bisect(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	p, err := unpack(b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	i, err := p.search(thread, p.x)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.MakeInt(i), nil
+}
+
+func insort(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	p, err := unpack(b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := p.a.(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("%s: got %s, want list", b.Name(), p.a.Type())
+	}
+	k := p.x
+	if p.key != nil {
+		if k, err = starlark.Call(thread, p.key, starlark.Tuple{p.x}, nil); err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+	}
+	i, err := p.search(thread, k)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	if err := list.InsertAll(i, []starlark.Value{p.x}); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.None, nil
+}
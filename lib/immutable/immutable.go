@@ -0,0 +1,94 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package immutable provides persistent map and list types for Starlark.
+package immutable // import "go.starlark.net/lib/immutable"
+
+import (
+	"fmt"
+	"sort"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Module immutable is a Starlark module of persistent collections.
+// The module defines the following functions:
+//
+//     map(pairs=None, **kwargs) - Returns a map whose initial items are those of pairs, a dict
+//                                 or iterable of pairs, followed by kwargs, like the dict function.
+//     list(iterable=None) - Returns a list whose elements are those of the iterable.
+//
+// A map or list is never modified. Instead, its methods return new
+// versions that share most of their structure with the original, so
+// each takes time and space logarithmic in the size of the collection,
+// making them suitable for long chains of derived values.
+//
+// A map is a mapping, like a dict, that supports len, indexing, the in
+// operator, and iteration over its keys in insertion order. Its methods:
+//
+//     set(k, v) - Returns a map in which k maps to v.
+//     delete(k) - Returns a map without the key k, which need not be present.
+//     update(pairs=None, **kwargs) - Returns a map updated by pairs and kwargs, like dict.update.
+//     get(k, default=None) - Returns the value of k, or default if k is not present.
+//     keys(), values(), items() - Return new lists of the keys, values, and items, in insertion order.
+//
+// A list is a sequence that supports len, indexing, and iteration. Its methods:
+//
+//     append(x) - Returns a list with x appended.
+//     extend(iterable) - Returns a list with the elements of iterable appended.
+//     set(i, x) - Returns a list in which element i is x.
+//
+var Module = &starlarkstruct.Module{
+	Name: "immutable",
+	Members: starlark.StringDict{
+		"map":  starlark.NewBuiltin("map", newMap),
+		"list": starlark.NewBuiltin("list", newList),
+	},
+}
+
+func newMap(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("%s: got %d arguments, want at most 1", b.Name(), len(args))
+	}
+	m, err := new(Map).update(args, kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return m, nil
+}
+
+func newList(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var iterable starlark.Iterable
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0, &iterable); err != nil {
+		return nil, err
+	}
+	l := emptyList
+	if iterable != nil {
+		var err error
+		if l, err = l.extend(iterable); err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+	}
+	return l, nil
+}
+
+// methods maps the name of each method of a value to its implementation.
+type methods map[string]func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
+
+func (methods methods) attr(recv starlark.Value, name string) starlark.Value {
+	if method, ok := methods[name]; ok {
+		return starlark.NewBuiltin(name, method).BindReceiver(recv)
+	}
+	return nil
+}
+
+func (methods methods) names() []string {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,260 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package immutable
+
+// This file defines List, a persistent vector trie.
+//
+// The elements of a list, but for the last few, are held in the leaves
+// of a trie of nodes with 32 children each, indexed by successive 5-bit
+// portions of the element's index. The last up to 32 elements are held
+// in a separate tail, so that most appends copy only the tail, and an
+// update copies only the nodes on the path to the affected element.
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// A List is a persistent sequence of values.
+type List struct {
+	len    int
+	shift  uint      // depth of the trie, times 5
+	root   *listNode // never nil
+	tail   []starlark.Value
+	frozen bool
+}
+
+type listNode struct {
+	children []*listNode      // for interior nodes
+	elems    []starlark.Value // for leaves
+}
+
+var emptyList = &List{shift: 5, root: new(listNode)}
+
+var (
+	_ starlark.Indexable  = (*List)(nil)
+	_ starlark.Sequence   = (*List)(nil)
+	_ starlark.HasAttrs   = (*List)(nil)
+	_ starlark.Comparable = (*List)(nil)
+)
+
+func (l *List) String() string {
+	var buf strings.Builder
+	buf.WriteString("immutable.list([")
+	for i := 0; i < l.len; i++ {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(l.Index(i).String())
+	}
+	buf.WriteString("])")
+	return buf.String()
+}
+func (l *List) Type() string          { return "immutable.list" }
+func (l *List) Truth() starlark.Bool  { return l.len > 0 }
+func (l *List) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: immutable.list") }
+func (l *List) Len() int              { return l.len }
+func (l *List) Freeze() {
+	if !l.frozen {
+		l.frozen = true
+		for i := 0; i < l.len; i++ {
+			l.Index(i).Freeze()
+		}
+	}
+}
+
+func (l *List) Attr(name string) (starlark.Value, error) { return listMethods.attr(l, name), nil }
+func (l *List) AttrNames() []string                      { return listMethods.names() }
+
+// tailOffset returns the index of the first element of the tail.
+func (l *List) tailOffset() int {
+	if l.len < 32 {
+		return 0
+	}
+	return (l.len - 1) >> 5 << 5
+}
+
+// Index returns the element at index i, which must be in range.
+func (l *List) Index(i int) starlark.Value {
+	if i >= l.tailOffset() {
+		return l.tail[i&31]
+	}
+	n := l.root
+	for level := l.shift; level > 0; level -= 5 {
+		n = n.children[i>>level&31]
+	}
+	return n.elems[i&31]
+}
+
+func (l *List) Iterate() starlark.Iterator { return &listIterator{l: l} }
+
+type listIterator struct {
+	l *List
+	i int
+}
+
+func (it *listIterator) Next(p *starlark.Value) bool {
+	if it.i < it.l.len {
+		*p = it.l.Index(it.i)
+		it.i++
+		return true
+	}
+	return false
+}
+func (it *listIterator) Done() {}
+
+// Append returns a list with x appended.
+func (l *List) Append(x starlark.Value) *List {
+	if l.len-l.tailOffset() < 32 {
+		tail := make([]starlark.Value, len(l.tail)+1)
+		copy(tail, l.tail)
+		tail[len(l.tail)] = x
+		return &List{len: l.len + 1, shift: l.shift, root: l.root, tail: tail}
+	}
+
+	// The tail is full; push it into the trie.
+	leaf := &listNode{elems: l.tail}
+	z := &List{len: l.len + 1, shift: l.shift, tail: []starlark.Value{x}}
+	if l.len>>5 > 1<<l.shift {
+		// The trie is full; add a level.
+		z.root = &listNode{children: []*listNode{l.root, newPath(l.shift, leaf)}}
+		z.shift += 5
+	} else {
+		z.root = l.pushTail(l.shift, l.root, leaf)
+	}
+	return z
+}
+
+// pushTail returns a copy of node n at the specified level
+// with the leaf added after its last element.
+func (l *List) pushTail(level uint, n, leaf *listNode) *listNode {
+	i := (l.len - 1) >> level & 31
+	z := &listNode{children: make([]*listNode, i+1)}
+	copy(z.children, n.children)
+	if level == 5 {
+		z.children[i] = leaf
+	} else if i < len(n.children) {
+		z.children[i] = l.pushTail(level-5, n.children[i], leaf)
+	} else {
+		z.children[i] = newPath(level-5, leaf)
+	}
+	return z
+}
+
+// newPath returns a path of nodes from the specified level down to the leaf.
+func newPath(level uint, leaf *listNode) *listNode {
+	if level == 0 {
+		return leaf
+	}
+	return &listNode{children: []*listNode{newPath(level-5, leaf)}}
+}
+
+// SetIndex returns a list in which the element at index i, which
+// must be in range, is x.
+func (l *List) SetIndex(i int, x starlark.Value) *List {
+	z := &List{len: l.len, shift: l.shift, root: l.root, tail: l.tail}
+	if i >= l.tailOffset() {
+		z.tail = append([]starlark.Value(nil), l.tail...)
+		z.tail[i&31] = x
+	} else {
+		z.root = setIndex(l.shift, l.root, i, x)
+	}
+	return z
+}
+
+func setIndex(level uint, n *listNode, i int, x starlark.Value) *listNode {
+	if level == 0 {
+		z := &listNode{elems: append([]starlark.Value(nil), n.elems...)}
+		z.elems[i&31] = x
+		return z
+	}
+	z := &listNode{children: append([]*listNode(nil), n.children...)}
+	j := i >> level & 31
+	z.children[j] = setIndex(level-5, n.children[j], i, x)
+	return z
+}
+
+// extend returns a list with the elements of the iterable appended.
+func (l *List) extend(iterable starlark.Iterable) (*List, error) {
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var x starlark.Value
+	for iter.Next(&x) {
+		l = l.Append(x)
+	}
+	if iter, ok := iter.(starlark.ErrIterator); ok && iter.Err() != nil {
+		return nil, iter.Err()
+	}
+	return l, nil
+}
+
+func (l *List) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	switch op {
+	case syntax.EQL:
+		return listsEqual(l, y.(*List), depth)
+	case syntax.NEQ:
+		eq, err := listsEqual(l, y.(*List), depth)
+		return !eq, err
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", l.Type(), op, y.Type())
+}
+
+func listsEqual(x, y *List, depth int) (bool, error) {
+	if x.len != y.len {
+		return false, nil
+	}
+	for i := 0; i < x.len; i++ {
+		if eq, err := starlark.EqualDepth(x.Index(i), y.Index(i), depth-1); err != nil || !eq {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+var listMethods = methods{
+	"append": listAppend,
+	"extend": listExtend,
+	"set":    listSet,
+}
+
+func listAppend(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	return b.Receiver().(*List).Append(x), nil
+}
+
+func listExtend(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var iterable starlark.Iterable
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &iterable); err != nil {
+		return nil, err
+	}
+	l, err := b.Receiver().(*List).extend(iterable)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return l, nil
+}
+
+func listSet(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var i int
+	var x starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &i, &x); err != nil {
+		return nil, err
+	}
+	l := b.Receiver().(*List)
+	orig := i
+	if i < 0 {
+		i += l.len
+	}
+	if i < 0 || i >= l.len {
+		return nil, fmt.Errorf("%s: index %d out of range [%d:%d]", b.Name(), orig, -l.len, l.len-1)
+	}
+	return l.SetIndex(i, x), nil
+}
@@ -0,0 +1,471 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package immutable
+
+// This file defines Map, a hash array mapped trie (HAMT).
+//
+// Each node of the trie has up to 32 slots, indexed by successive
+// 5-bit portions of the hash of a key, of which only the occupied
+// slots are stored. A slot holds either a subtree or a leaf, the
+// entries whose hashes agree in all the bits that lead to it.
+// An update copies only the nodes on the path to the affected leaf.
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// A Map is a persistent mapping from keys to values.
+// Its zero value is an empty map.
+type Map struct {
+	root   *mapNode // nil if empty
+	len    int
+	seq    uint64 // sequence number of the next new entry
+	frozen bool
+}
+
+type mapNode struct {
+	bitmap uint32    // the set of occupied slots
+	slots  []mapSlot // the occupied slots, in order
+}
+
+type mapSlot struct {
+	child *mapNode    // subtree, or nil if a leaf
+	leaf  []*mapEntry // entries with equal hashes
+}
+
+type mapEntry struct {
+	hash       uint32
+	key, value starlark.Value
+	seq        uint64 // order of insertion
+}
+
+var (
+	_ starlark.IterableMapping = (*Map)(nil)
+	_ starlark.HasAttrs        = (*Map)(nil)
+	_ starlark.Comparable      = (*Map)(nil)
+)
+
+func (m *Map) String() string {
+	var buf strings.Builder
+	buf.WriteString("immutable.map({")
+	for i, e := range m.entries() {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(e.key.String())
+		buf.WriteString(": ")
+		buf.WriteString(e.value.String())
+	}
+	buf.WriteString("})")
+	return buf.String()
+}
+func (m *Map) Type() string          { return "immutable.map" }
+func (m *Map) Truth() starlark.Bool  { return m.len > 0 }
+func (m *Map) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: immutable.map") }
+func (m *Map) Len() int              { return m.len }
+func (m *Map) Freeze() {
+	if !m.frozen {
+		m.frozen = true
+		for _, e := range m.entries() {
+			e.key.Freeze()
+			e.value.Freeze()
+		}
+	}
+}
+
+func (m *Map) Attr(name string) (starlark.Value, error) { return mapMethods.attr(m, name), nil }
+func (m *Map) AttrNames() []string                      { return mapMethods.names() }
+
+// Get returns the value associated with key k.
+func (m *Map) Get(k starlark.Value) (v starlark.Value, found bool, err error) {
+	h, err := k.Hash()
+	if err != nil {
+		return nil, false, err
+	}
+	for n, shift := m.root, uint(0); n != nil; shift += 5 {
+		bit := uint32(1) << (h >> shift & 31)
+		if n.bitmap&bit == 0 {
+			break
+		}
+		slot := &n.slots[bits.OnesCount32(n.bitmap&(bit-1))]
+		if slot.child == nil {
+			for _, e := range slot.leaf {
+				if e.hash == h {
+					if eq, err := starlark.Equal(k, e.key); err != nil {
+						return nil, false, err
+					} else if eq {
+						return e.value, true, nil
+					}
+				}
+			}
+			break
+		}
+		n = slot.child
+	}
+	return nil, false, nil
+}
+
+// Set returns a map in which key k maps to value v.
+func (m *Map) Set(k, v starlark.Value) (*Map, error) {
+	h, err := k.Hash()
+	if err != nil {
+		return nil, err
+	}
+	e := &mapEntry{hash: h, key: k, value: v, seq: m.seq}
+	root, added, err := m.root.insert(0, e)
+	if err != nil {
+		return nil, err
+	}
+	z := &Map{root: root, len: m.len, seq: m.seq}
+	if added {
+		z.len++
+		z.seq++
+	}
+	return z, nil
+}
+
+// Delete returns a map without key k.
+func (m *Map) Delete(k starlark.Value) (*Map, error) {
+	h, err := k.Hash()
+	if err != nil {
+		return nil, err
+	}
+	root, removed, err := m.root.remove(0, h, k)
+	if err != nil {
+		return nil, err
+	}
+	if !removed {
+		return m, nil
+	}
+	return &Map{root: root, len: m.len - 1, seq: m.seq}, nil
+}
+
+// insert returns a copy of the subtree n, which may be nil, at the
+// specified depth, with entry e added or replacing an entry of
+// the same key, and reports whether it was added.
+func (n *mapNode) insert(shift uint, e *mapEntry) (*mapNode, bool, error) {
+	if n == nil {
+		n = new(mapNode)
+	}
+	bit := uint32(1) << (e.hash >> shift & 31)
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	if n.bitmap&bit == 0 {
+		z := &mapNode{bitmap: n.bitmap | bit, slots: make([]mapSlot, len(n.slots)+1)}
+		copy(z.slots, n.slots[:i])
+		z.slots[i] = mapSlot{leaf: []*mapEntry{e}}
+		copy(z.slots[i+1:], n.slots[i:])
+		return z, true, nil
+	}
+
+	slot := n.slots[i]
+	added := true
+	switch {
+	case slot.child != nil:
+		child, a, err := slot.child.insert(shift+5, e)
+		if err != nil {
+			return nil, false, err
+		}
+		slot, added = mapSlot{child: child}, a
+
+	case slot.leaf[0].hash == e.hash:
+		leaf := make([]*mapEntry, len(slot.leaf), len(slot.leaf)+1)
+		copy(leaf, slot.leaf)
+		for j, old := range leaf {
+			if eq, err := starlark.Equal(old.key, e.key); err != nil {
+				return nil, false, err
+			} else if eq {
+				// Replace the value, but keep the key's original position.
+				leaf[j] = &mapEntry{hash: old.hash, key: old.key, value: e.value, seq: old.seq}
+				added = false
+				break
+			}
+		}
+		if added {
+			leaf = append(leaf, e)
+		}
+		slot = mapSlot{leaf: leaf}
+
+	default:
+		// Push the leaf down into a new subtree, then add e.
+		// The hashes differ, so they eventually occupy different slots.
+		bit := uint32(1) << (slot.leaf[0].hash >> (shift + 5) & 31)
+		child := &mapNode{bitmap: bit, slots: []mapSlot{slot}}
+		child, _, _ = child.insert(shift+5, e) // can't fail
+		slot = mapSlot{child: child}
+	}
+	z := &mapNode{bitmap: n.bitmap, slots: append([]mapSlot(nil), n.slots...)}
+	z.slots[i] = slot
+	return z, added, nil
+}
+
+// remove returns a copy of the subtree n, which may be nil, at the
+// specified depth, without the entry for key k, whose hash is h,
+// and reports whether it was present. The result is nil if empty.
+func (n *mapNode) remove(shift uint, h uint32, k starlark.Value) (*mapNode, bool, error) {
+	if n == nil {
+		return nil, false, nil
+	}
+	bit := uint32(1) << (h >> shift & 31)
+	if n.bitmap&bit == 0 {
+		return n, false, nil
+	}
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	slot := n.slots[i]
+	if slot.child != nil {
+		child, removed, err := slot.child.remove(shift+5, h, k)
+		if err != nil || !removed {
+			return n, false, err
+		}
+		slot = mapSlot{child: child}
+	} else {
+		j := -1
+		for jj, e := range slot.leaf {
+			if e.hash == h {
+				if eq, err := starlark.Equal(k, e.key); err != nil {
+					return nil, false, err
+				} else if eq {
+					j = jj
+					break
+				}
+			}
+		}
+		if j < 0 {
+			return n, false, nil
+		}
+		leaf := make([]*mapEntry, 0, len(slot.leaf)-1)
+		leaf = append(leaf, slot.leaf[:j]...)
+		leaf = append(leaf, slot.leaf[j+1:]...)
+		slot = mapSlot{leaf: leaf}
+	}
+
+	if slot.child == nil && len(slot.leaf) == 0 {
+		// Remove the empty slot.
+		if n.bitmap == bit {
+			return nil, true, nil
+		}
+		z := &mapNode{bitmap: n.bitmap &^ bit, slots: make([]mapSlot, 0, len(n.slots)-1)}
+		z.slots = append(z.slots, n.slots[:i]...)
+		z.slots = append(z.slots, n.slots[i+1:]...)
+		return z, true, nil
+	}
+	z := &mapNode{bitmap: n.bitmap, slots: append([]mapSlot(nil), n.slots...)}
+	z.slots[i] = slot
+	return z, true, nil
+}
+
+// entries returns the entries of the map in insertion order.
+func (m *Map) entries() []*mapEntry {
+	entries := make([]*mapEntry, 0, m.len)
+	var visit func(n *mapNode)
+	visit = func(n *mapNode) {
+		for _, slot := range n.slots {
+			if slot.child != nil {
+				visit(slot.child)
+			} else {
+				entries = append(entries, slot.leaf...)
+			}
+		}
+	}
+	if m.root != nil {
+		visit(m.root)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries
+}
+
+// Items returns a new slice of the key/value pairs of the map, in insertion order.
+func (m *Map) Items() []starlark.Tuple {
+	entries := m.entries()
+	items := make([]starlark.Tuple, len(entries))
+	for i, e := range entries {
+		items[i] = starlark.Tuple{e.key, e.value}
+	}
+	return items
+}
+
+// Keys returns a new slice of the keys of the map, in insertion order.
+func (m *Map) Keys() []starlark.Value {
+	entries := m.entries()
+	keys := make([]starlark.Value, len(entries))
+	for i, e := range entries {
+		keys[i] = e.key
+	}
+	return keys
+}
+
+func (m *Map) Iterate() starlark.Iterator { return starlark.NewList(m.Keys()).Iterate() }
+
+func (m *Map) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	switch op {
+	case syntax.EQL:
+		return mapsEqual(m, y.(*Map), depth)
+	case syntax.NEQ:
+		eq, err := mapsEqual(m, y.(*Map), depth)
+		return !eq, err
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", m.Type(), op, y.Type())
+}
+
+func mapsEqual(x, y *Map, depth int) (bool, error) {
+	if x.len != y.len {
+		return false, nil
+	}
+	if x.root == y.root {
+		return true, nil
+	}
+	for _, e := range x.entries() {
+		v, found, err := y.Get(e.key)
+		if err != nil || !found {
+			return false, err
+		}
+		if eq, err := starlark.EqualDepth(e.value, v, depth-1); err != nil || !eq {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// update returns the map updated by the items of the optional
+// positional argument, a mapping or iterable of pairs, then by kwargs.
+func (m *Map) update(args starlark.Tuple, kwargs []starlark.Tuple) (*Map, error) {
+	var items []starlark.Tuple
+	if len(args) == 1 {
+		switch x := args[0].(type) {
+		case starlark.IterableMapping:
+			items = x.Items()
+		case starlark.Iterable:
+			iter := x.Iterate()
+			defer iter.Done()
+			var pair starlark.Value
+			for i := 0; iter.Next(&pair); i++ {
+				iterable, ok := pair.(starlark.Iterable)
+				if !ok {
+					return nil, fmt.Errorf("update sequence element #%d is not iterable (%s)", i, pair.Type())
+				}
+				var item starlark.Tuple
+				it := iterable.Iterate()
+				var elem starlark.Value
+				for it.Next(&elem) {
+					item = append(item, elem)
+				}
+				it.Done()
+				if len(item) != 2 {
+					return nil, fmt.Errorf("update sequence element #%d has length %d, want 2", i, len(item))
+				}
+				items = append(items, item)
+			}
+			if iter, ok := iter.(starlark.ErrIterator); ok && iter.Err() != nil {
+				return nil, iter.Err()
+			}
+		case starlark.NoneType:
+		default:
+			return nil, fmt.Errorf("got %s, want iterable", x.Type())
+		}
+	}
+	for _, item := range append(items, kwargs...) {
+		var err error
+		if m, err = m.Set(item[0], item[1]); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+var mapMethods = methods{
+	"delete": mapDelete,
+	"get":    mapGet,
+	"items":  mapItems,
+	"keys":   mapKeys,
+	"set":    mapSet,
+	"update": mapUpdate,
+	"values": mapValues,
+}
+
+func mapSet(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var k, v starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &k, &v); err != nil {
+		return nil, err
+	}
+	m, err := b.Receiver().(*Map).Set(k, v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return m, nil
+}
+
+func mapDelete(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var k starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &k); err != nil {
+		return nil, err
+	}
+	m, err := b.Receiver().(*Map).Delete(k)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return m, nil
+}
+
+func mapUpdate(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("%s: got %d arguments, want at most 1", b.Name(), len(args))
+	}
+	m, err := b.Receiver().(*Map).update(args, kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return m, nil
+}
+
+func mapGet(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var k, dflt starlark.Value = nil, starlark.None
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &k, &dflt); err != nil {
+		return nil, err
+	}
+	v, found, err := b.Receiver().(*Map).Get(k)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	if !found {
+		return dflt, nil
+	}
+	return v, nil
+}
+
+func mapKeys(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return starlark.NewList(b.Receiver().(*Map).Keys()), nil
+}
+
+func mapValues(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	entries := b.Receiver().(*Map).entries()
+	values := make([]starlark.Value, len(entries))
+	for i, e := range entries {
+		values[i] = e.value
+	}
+	return starlark.NewList(values), nil
+}
+
+func mapItems(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	items := b.Receiver().(*Map).Items()
+	elems := make([]starlark.Value, len(items))
+	for i, item := range items {
+		elems[i] = item
+	}
+	return starlark.NewList(elems), nil
+}
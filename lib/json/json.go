@@ -54,13 +54,16 @@ import (
 // (e.g. it implements both Iterable and HasFields), the first case takes precedence.
 // Encoding any other value yields an error.
 //
-// def decode(x):
+// def decode(x, into=None):
 //
 // The decode function accepts one positional parameter, a JSON string.
 // It returns the Starlark value that the string denotes.
 // - Numbers are parsed as int or float, depending on whether they
 //   contain a decimal point.
 // - JSON objects are parsed as new unfrozen Starlark dicts.
+//   If the optional into parameter is not None, JSON objects are
+//   instead parsed as structs whose constructor is into, at every
+//   level of nesting, giving attribute access to their fields.
 // - JSON arrays are parsed as new unfrozen Starlark lists.
 // Decoding fails if x is not a valid JSON string.
 //
@@ -81,12 +84,27 @@ var Module = &starlarkstruct.Module{
 	},
 }
 
+func init() {
+	// Provide the encoder for the to_json method of structs.
+	starlarkstruct.EncodeJSON = Encode
+}
+
 func encode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var x starlark.Value
 	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
 		return nil, err
 	}
+	s, err := Encode(x)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.String(s), nil
+}
 
+// Encode returns the JSON encoding of x,
+// as described for the encode function of Module.
+// It is equivalent to json.encode(x).
+func Encode(x starlark.Value) (string, error) {
 	buf := new(bytes.Buffer)
 
 	var quoteSpace [128]byte
@@ -221,9 +239,9 @@ func encode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 	}
 
 	if err := emit(x); err != nil {
-		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		return "", err
 	}
-	return starlark.String(buf.String()), nil
+	return buf.String(), nil
 }
 
 func pointer(i interface{}) unsafe.Pointer {
@@ -283,16 +301,29 @@ func indent(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 	return starlark.String(buf.String()), nil
 }
 
-func decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (_ starlark.Value, err error) {
+func decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var s string
-	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &s); err != nil {
+	var into starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &s, "into?", &into); err != nil {
 		return nil, err
 	}
+	if into == starlark.None {
+		into = nil
+	}
+	return Decode(s, into)
+}
 
+// Decode returns the Starlark value denoted by the JSON string s,
+// as described for the decode function of Module.
+//
+// If into is non-nil, each JSON object is decoded as an immutable
+// struct whose constructor is into (see starlarkstruct.FromStringDict),
+// rather than as a dict. Otherwise Decode is equivalent to json.decode(s).
+func Decode(s string, into starlark.Value) (_ starlark.Value, err error) {
 	// The decoder necessarily makes certain representation choices
-	// such as list vs tuple, struct vs dict, int vs float.
-	// In principle, we could parameterize it to allow the caller to
-	// control the returned types, but there's no compelling need yet.
+	// such as list vs tuple, int vs float. The choice of struct vs
+	// dict is parameterized by into; there's no compelling need yet
+	// to parameterize the others.
 
 	// Use panic/recover with a distinguished type (failure) for error handling.
 	type failure string
@@ -411,6 +442,10 @@ func decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 		case '{':
 			// object
 			dict := new(starlark.Dict)
+			var fields starlark.StringDict
+			if into != nil {
+				fields = make(starlark.StringDict)
+			}
 
 			i++ // '{'
 			b = next()
@@ -426,7 +461,11 @@ func decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 					}
 					i++ // ':'
 					value := parse()
-					dict.SetKey(key, value) // can't fail
+					if fields != nil {
+						fields[string(key.(starlark.String))] = value
+					} else {
+						dict.SetKey(key, value) // can't fail
+					}
 					b = next()
 					if b != ',' {
 						if b != '}' {
@@ -438,6 +477,13 @@ func decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 				}
 			}
 			i++ // '}'
+			if fields != nil {
+				s, err := starlarkstruct.NewFromStringDict(into, fields)
+				if err != nil {
+					fail("%v", err)
+				}
+				return s
+			}
 			return dict
 
 		default:
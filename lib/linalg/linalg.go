@@ -0,0 +1,546 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package linalg provides fixed-size vectors and matrices of floats.
+package linalg // import "go.starlark.net/lib/linalg"
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// Module linalg is a Starlark module of linear algebra functions.
+// The module defines the following functions:
+//
+//     vector(x) - Returns a vector whose elements are those of the iterable x, which must be numbers.
+//     matrix(rows) - Returns a matrix whose rows are the elements of the iterable rows, each an
+//                    iterable of numbers. All rows must have the same length.
+//     identity(n) - Returns the n x n identity matrix.
+//     zeros(rows, cols) - Returns a rows x cols matrix of zeros.
+//
+//     dot(a, b) - Returns the dot product of the vectors a and b, which must have the same length.
+//     matmul(a, b) - Returns the product of the matrix a and the matrix or vector b.
+//     transpose(m) - Returns the transpose of the matrix m.
+//     inverse(m) - Returns the inverse of the square matrix m, or fails if m is singular.
+//
+// Vectors and matrices are immutable. They support + and - with values
+// of the same shape, and * and / by a number. Indexing a vector yields
+// a float, and indexing a matrix yields a row, as a vector. A matrix has
+// attributes rows and cols, its dimensions. Both are stored as contiguous
+// slices of float64, so arithmetic on them allocates only its result.
+//
+var Module = &starlarkstruct.Module{
+	Name: "linalg",
+	Members: starlark.StringDict{
+		"vector":   starlark.NewBuiltin("vector", vector),
+		"matrix":   starlark.NewBuiltin("matrix", matrix),
+		"identity": starlark.NewBuiltin("identity", identity),
+		"zeros":    starlark.NewBuiltin("zeros", zeros),
+
+		"dot":       starlark.NewBuiltin("dot", dot),
+		"matmul":    starlark.NewBuiltin("matmul", matmul),
+		"transpose": starlark.NewBuiltin("transpose", transpose),
+		"inverse":   starlark.NewBuiltin("inverse", inverse),
+	},
+}
+
+// A Vector is an immutable sequence of float64 values.
+type Vector struct {
+	elems []float64
+}
+
+// NewVector returns a vector of the specified elements, which it retains.
+func NewVector(elems []float64) *Vector { return &Vector{elems} }
+
+// Elems returns the elements of the vector, which must not be modified.
+func (v *Vector) Elems() []float64 { return v.elems }
+
+var (
+	_ starlark.Indexable  = (*Vector)(nil)
+	_ starlark.Sequence   = (*Vector)(nil)
+	_ starlark.HasBinary  = (*Vector)(nil)
+	_ starlark.Comparable = (*Vector)(nil)
+	_ starlark.Indexable  = (*Matrix)(nil)
+	_ starlark.HasAttrs   = (*Matrix)(nil)
+	_ starlark.HasBinary  = (*Matrix)(nil)
+	_ starlark.Comparable = (*Matrix)(nil)
+)
+
+func (v *Vector) String() string {
+	var buf strings.Builder
+	buf.WriteString("vector(")
+	writeFloats(&buf, v.elems)
+	buf.WriteString(")")
+	return buf.String()
+}
+func (v *Vector) Type() string               { return "linalg.vector" }
+func (v *Vector) Freeze()                    {} // immutable
+func (v *Vector) Truth() starlark.Bool       { return len(v.elems) > 0 }
+func (v *Vector) Hash() (uint32, error)      { return 0, fmt.Errorf("unhashable type: linalg.vector") }
+func (v *Vector) Len() int                   { return len(v.elems) }
+func (v *Vector) Index(i int) starlark.Value { return starlark.Float(v.elems[i]) }
+func (v *Vector) Iterate() starlark.Iterator { return &vectorIterator{elems: v.elems} }
+
+func (v *Vector) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	w := y.(*Vector)
+	switch op {
+	case syntax.EQL:
+		return equalFloats(v.elems, w.elems), nil
+	case syntax.NEQ:
+		return !equalFloats(v.elems, w.elems), nil
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", v.Type(), op, y.Type())
+}
+
+func (v *Vector) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	switch op {
+	case syntax.PLUS, syntax.MINUS:
+		if w, ok := y.(*Vector); ok {
+			if len(v.elems) != len(w.elems) {
+				return nil, fmt.Errorf("vector length mismatch: %d %s %d", len(v.elems), op, len(w.elems))
+			}
+			return NewVector(combine(op, v.elems, w.elems, side)), nil
+		}
+	case syntax.STAR, syntax.SLASH:
+		if k, ok := scalar(y); ok {
+			elems, err := scale(op, v.elems, k, side)
+			if err != nil {
+				return nil, err
+			}
+			return NewVector(elems), nil
+		}
+	}
+	return nil, nil // unhandled
+}
+
+type vectorIterator struct {
+	elems []float64
+}
+
+func (it *vectorIterator) Next(p *starlark.Value) bool {
+	if len(it.elems) == 0 {
+		return false
+	}
+	*p = starlark.Float(it.elems[0])
+	it.elems = it.elems[1:]
+	return true
+}
+func (it *vectorIterator) Done() {}
+
+// A Matrix is an immutable two-dimensional array of float64 values,
+// stored in row-major order.
+type Matrix struct {
+	rows, cols int
+	elems      []float64 // len = rows * cols
+}
+
+// NewMatrix returns a rows x cols matrix of the specified elements,
+// in row-major order, which it retains. It panics if the number of
+// elements is not rows * cols.
+func NewMatrix(rows, cols int, elems []float64) *Matrix {
+	if len(elems) != rows*cols {
+		panic(fmt.Sprintf("NewMatrix: %d elements, want %d x %d", len(elems), rows, cols))
+	}
+	return &Matrix{rows, cols, elems}
+}
+
+// Dims returns the number of rows and columns of the matrix.
+func (m *Matrix) Dims() (rows, cols int) { return m.rows, m.cols }
+
+// Elems returns the elements of the matrix in row-major order.
+// They must not be modified.
+func (m *Matrix) Elems() []float64 { return m.elems }
+
+// At returns the element at row i and column j.
+func (m *Matrix) At(i, j int) float64 { return m.elems[i*m.cols+j] }
+
+func (m *Matrix) row(i int) []float64 { return m.elems[i*m.cols : (i+1)*m.cols : (i+1)*m.cols] }
+
+func (m *Matrix) String() string {
+	var buf strings.Builder
+	buf.WriteString("matrix([")
+	for i := 0; i < m.rows; i++ {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		writeFloats(&buf, m.row(i))
+	}
+	buf.WriteString("])")
+	return buf.String()
+}
+func (m *Matrix) Type() string               { return "linalg.matrix" }
+func (m *Matrix) Freeze()                    {} // immutable
+func (m *Matrix) Truth() starlark.Bool       { return len(m.elems) > 0 }
+func (m *Matrix) Hash() (uint32, error)      { return 0, fmt.Errorf("unhashable type: linalg.matrix") }
+func (m *Matrix) Len() int                   { return m.rows }
+func (m *Matrix) Index(i int) starlark.Value { return NewVector(m.row(i)) }
+func (m *Matrix) Iterate() starlark.Iterator { return &matrixIterator{m: m} }
+
+func (m *Matrix) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "rows":
+		return starlark.MakeInt(m.rows), nil
+	case "cols":
+		return starlark.MakeInt(m.cols), nil
+	}
+	return nil, nil
+}
+
+func (m *Matrix) AttrNames() []string { return []string{"cols", "rows"} }
+
+func (m *Matrix) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	n := y.(*Matrix)
+	eq := m.rows == n.rows && m.cols == n.cols && equalFloats(m.elems, n.elems)
+	switch op {
+	case syntax.EQL:
+		return eq, nil
+	case syntax.NEQ:
+		return !eq, nil
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", m.Type(), op, y.Type())
+}
+
+func (m *Matrix) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	switch op {
+	case syntax.PLUS, syntax.MINUS:
+		if n, ok := y.(*Matrix); ok {
+			if m.rows != n.rows || m.cols != n.cols {
+				return nil, fmt.Errorf("matrix shape mismatch: %dx%d %s %dx%d", m.rows, m.cols, op, n.rows, n.cols)
+			}
+			return NewMatrix(m.rows, m.cols, combine(op, m.elems, n.elems, side)), nil
+		}
+	case syntax.STAR, syntax.SLASH:
+		if k, ok := scalar(y); ok {
+			elems, err := scale(op, m.elems, k, side)
+			if err != nil {
+				return nil, err
+			}
+			return NewMatrix(m.rows, m.cols, elems), nil
+		}
+	}
+	return nil, nil // unhandled
+}
+
+type matrixIterator struct {
+	m *Matrix
+	i int
+}
+
+func (it *matrixIterator) Next(p *starlark.Value) bool {
+	if it.i == it.m.rows {
+		return false
+	}
+	*p = it.m.Index(it.i)
+	it.i++
+	return true
+}
+func (it *matrixIterator) Done() {}
+
+// writeFloats writes a list of floats to buf, in Starlark notation.
+func writeFloats(buf *strings.Builder, elems []float64) {
+	buf.WriteByte('[')
+	for i, x := range elems {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(starlark.Float(x).String())
+	}
+	buf.WriteByte(']')
+}
+
+func equalFloats(x, y []float64) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// combine returns the elementwise sum or difference of x and y,
+// which have the same length. If side is Right, x is the right operand.
+func combine(op syntax.Token, x, y []float64, side starlark.Side) []float64 {
+	z := make([]float64, len(x))
+	for i := range z {
+		a, b := x[i], y[i]
+		if side == starlark.Right {
+			a, b = b, a
+		}
+		if op == syntax.PLUS {
+			z[i] = a + b
+		} else {
+			z[i] = a - b
+		}
+	}
+	return z
+}
+
+// scale returns the elementwise product or quotient of x and k.
+// Only x / k is permitted, not k / x.
+func scale(op syntax.Token, x []float64, k float64, side starlark.Side) ([]float64, error) {
+	if op == syntax.SLASH {
+		if side == starlark.Right {
+			return nil, fmt.Errorf("unsupported division by vector or matrix")
+		}
+		if k == 0 {
+			return nil, fmt.Errorf("floating-point division by zero")
+		}
+	}
+	z := make([]float64, len(x))
+	for i := range z {
+		if op == syntax.STAR {
+			z[i] = x[i] * k
+		} else {
+			z[i] = x[i] / k
+		}
+	}
+	return z, nil
+}
+
+// scalar returns the value of the int or float x.
+func scalar(x starlark.Value) (float64, bool) {
+	switch x := x.(type) {
+	case starlark.Int:
+		return float64(x.Float()), true
+	case starlark.Float:
+		return float64(x), true
+	}
+	return 0, false
+}
+
+// floats appends the elements of the iterable x, which must be numbers, to elems.
+func floats(elems []float64, x starlark.Iterable) ([]float64, error) {
+	if v, ok := x.(*Vector); ok {
+		return append(elems, v.elems...), nil
+	}
+	iter := x.Iterate()
+	defer iter.Done()
+	var elem starlark.Value
+	for iter.Next(&elem) {
+		f, ok := scalar(elem)
+		if !ok {
+			return nil, fmt.Errorf("got %s element, want float or int", elem.Type())
+		}
+		elems = append(elems, f)
+	}
+	if iter, ok := iter.(starlark.ErrIterator); ok && iter.Err() != nil {
+		return nil, iter.Err()
+	}
+	return elems, nil
+}
+
+func vector(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x starlark.Iterable
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	var elems []float64
+	if n := starlark.Len(x); n > 0 {
+		elems = make([]float64, 0, n)
+	}
+	elems, err := floats(elems, x)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return NewVector(elems), nil
+}
+
+func matrix(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x starlark.Iterable
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	if m, ok := x.(*Matrix); ok {
+		return m, nil
+	}
+	iter := x.Iterate()
+	defer iter.Done()
+	var elems []float64
+	rows, cols := 0, 0
+	var row starlark.Value
+	for iter.Next(&row) {
+		r, ok := row.(starlark.Iterable)
+		if !ok {
+			return nil, fmt.Errorf("%s: got %s row, want iterable", b.Name(), row.Type())
+		}
+		n := len(elems)
+		var err error
+		elems, err = floats(elems, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: row %d: %v", b.Name(), rows, err)
+		}
+		if rows == 0 {
+			cols = len(elems)
+		} else if len(elems)-n != cols {
+			return nil, fmt.Errorf("%s: row %d has %d elements, want %d", b.Name(), rows, len(elems)-n, cols)
+		}
+		rows++
+	}
+	return NewMatrix(rows, cols, elems), nil
+}
+
+func identity(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var n int
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("%s: negative size %d", b.Name(), n)
+	}
+	m := NewMatrix(n, n, make([]float64, n*n))
+	for i := 0; i < n; i++ {
+		m.elems[i*n+i] = 1
+	}
+	return m, nil
+}
+
+func zeros(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var rows, cols int
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &rows, &cols); err != nil {
+		return nil, err
+	}
+	if rows < 0 || cols < 0 {
+		return nil, fmt.Errorf("%s: negative size %dx%d", b.Name(), rows, cols)
+	}
+	return NewMatrix(rows, cols, make([]float64, rows*cols)), nil
+}
+
+func dot(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x, y *Vector
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &x, &y); err != nil {
+		return nil, err
+	}
+	if len(x.elems) != len(y.elems) {
+		return nil, fmt.Errorf("%s: vector length mismatch: %d, %d", b.Name(), len(x.elems), len(y.elems))
+	}
+	return starlark.Float(dotFloats(x.elems, y.elems)), nil
+}
+
+func dotFloats(x, y []float64) float64 {
+	var sum float64
+	for i := range x {
+		sum += x[i] * y[i]
+	}
+	return sum
+}
+
+func matmul(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x *Matrix
+	var y starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &x, &y); err != nil {
+		return nil, err
+	}
+	switch y := y.(type) {
+	case *Vector:
+		if x.cols != len(y.elems) {
+			return nil, fmt.Errorf("%s: shape mismatch: %dx%d matrix, %d vector", b.Name(), x.rows, x.cols, len(y.elems))
+		}
+		z := make([]float64, x.rows)
+		for i := range z {
+			z[i] = dotFloats(x.row(i), y.elems)
+		}
+		return NewVector(z), nil
+
+	case *Matrix:
+		if x.cols != y.rows {
+			return nil, fmt.Errorf("%s: shape mismatch: %dx%d matrix, %dx%d matrix", b.Name(), x.rows, x.cols, y.rows, y.cols)
+		}
+		z := NewMatrix(x.rows, y.cols, make([]float64, x.rows*y.cols))
+		for i := 0; i < x.rows; i++ {
+			zi := z.row(i)
+			for k, xik := range x.row(i) {
+				for j, ykj := range y.row(k) {
+					zi[j] += xik * ykj
+				}
+			}
+		}
+		return z, nil
+	}
+	return nil, fmt.Errorf("%s: for parameter 2: got %s, want linalg.matrix or linalg.vector", b.Name(), y.Type())
+}
+
+func transpose(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var m *Matrix
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &m); err != nil {
+		return nil, err
+	}
+	t := NewMatrix(m.cols, m.rows, make([]float64, len(m.elems)))
+	for i := 0; i < m.rows; i++ {
+		for j, x := range m.row(i) {
+			t.elems[j*t.cols+i] = x
+		}
+	}
+	return t, nil
+}
+
+func inverse(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var m *Matrix
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &m); err != nil {
+		return nil, err
+	}
+	if m.rows != m.cols {
+		return nil, fmt.Errorf("%s: %dx%d matrix is not square", b.Name(), m.rows, m.cols)
+	}
+
+	// Gauss-Jordan elimination with partial pivoting,
+	// reducing a to the identity and inv from it.
+	n := m.rows
+	a := NewMatrix(n, n, append([]float64(nil), m.elems...))
+	inv := NewMatrix(n, n, make([]float64, n*n))
+	for i := 0; i < n; i++ {
+		inv.elems[i*n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for i := col + 1; i < n; i++ {
+			if math.Abs(a.At(i, col)) > math.Abs(a.At(pivot, col)) {
+				pivot = i
+			}
+		}
+		if a.At(pivot, col) == 0 {
+			return nil, fmt.Errorf("%s: matrix is singular", b.Name())
+		}
+		if pivot != col {
+			swapRows(a.row(pivot), a.row(col))
+			swapRows(inv.row(pivot), inv.row(col))
+		}
+		k := 1 / a.At(col, col)
+		scaleRow(a.row(col), k)
+		scaleRow(inv.row(col), k)
+		for i := 0; i < n; i++ {
+			if f := a.At(i, col); i != col && f != 0 {
+				subRow(a.row(i), a.row(col), f)
+				subRow(inv.row(i), inv.row(col), f)
+			}
+		}
+	}
+	return inv, nil
+}
+
+func swapRows(x, y []float64) {
+	for i := range x {
+		x[i], y[i] = y[i], x[i]
+	}
+}
+
+func scaleRow(x []float64, k float64) {
+	for i := range x {
+		x[i] *= k
+	}
+}
+
+// subRow subtracts k times y from x.
+func subRow(x, y []float64, k float64) {
+	for i := range x {
+		x[i] -= k * y[i]
+	}
+}
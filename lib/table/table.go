@@ -0,0 +1,664 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package table provides a column-oriented table type for Starlark.
+package table // import "go.starlark.net/lib/table"
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// Module table is a Starlark module of functions for columnar tables.
+// The module defines the following functions:
+//
+//     table(**columns) - Returns a table whose columns are the keyword arguments, in order.
+//                        Each is an iterable, and all must have the same length.
+//     from_rows(rows, columns=None) - Returns a table whose rows are the dicts in the iterable rows.
+//                        Its columns are those named by columns, or else the keys of the rows,
+//                        in order of first appearance. Missing values are None.
+//
+// A table is an immutable value. Its len is the number of rows, and
+// indexing it yields a row, as a new dict. It has the following attributes:
+//
+//     columns - A tuple of the names of the columns.
+//     column(name) - Returns the values of the named column, as a new list.
+//     rows() - Returns the rows of the table, as a new list of dicts.
+//     select(*names) - Returns a table of the named columns, in the specified order.
+//     filter(fn=None, **where) - Returns a table of the rows whose values equal those of where,
+//                        and for which fn, if not None, returns true when called with the row as a dict.
+//     group_by(*keys, **aggregates) - Returns a table with one row for each distinct combination
+//                        of values of the key columns, in order of first appearance. Its columns are
+//                        the keys followed by the aggregates, each of which is "count" or a pair
+//                        (op, column), where op is one of "count", "sum", "mean", "min", "max",
+//                        "first", "last", or "list".
+//     join(other, on, how="inner") - Returns the table of the pairs of rows of this table and the
+//                        other whose values of the columns on, a name or a list of names, are equal.
+//                        Its columns are those of this table followed by the other columns of the
+//                        other table. If how is "left", rows of this table that match no row of the
+//                        other are kept, with None values for the other columns.
+//
+// Operations other than filter with fn and group_by with aggregates
+// that add values are executed without calling Starlark code.
+//
+var Module = &starlarkstruct.Module{
+	Name: "table",
+	Members: starlark.StringDict{
+		"table":     starlark.NewBuiltin("table", newTable),
+		"from_rows": starlark.NewBuiltin("from_rows", fromRows),
+	},
+}
+
+// A Table is an immutable table of values, stored by column.
+type Table struct {
+	names []string
+	cols  [][]starlark.Value // cols[i] holds the values of column names[i]
+	nrows int
+}
+
+var (
+	_ starlark.Indexable = (*Table)(nil)
+	_ starlark.HasAttrs  = (*Table)(nil)
+)
+
+// New returns a table of the specified named columns, which it retains.
+// It panics if the names are not distinct or the columns differ in length.
+func New(names []string, cols [][]starlark.Value) *Table {
+	if len(names) != len(cols) {
+		panic("table.New: len(names) != len(cols)")
+	}
+	t := &Table{names: names, cols: cols}
+	seen := make(map[string]bool)
+	for i, name := range names {
+		if seen[name] {
+			panic(fmt.Sprintf("table.New: duplicate column %q", name))
+		}
+		seen[name] = true
+		if i == 0 {
+			t.nrows = len(cols[i])
+		} else if len(cols[i]) != t.nrows {
+			panic(fmt.Sprintf("table.New: column %q has %d values, want %d", name, len(cols[i]), t.nrows))
+		}
+	}
+	return t
+}
+
+func (t *Table) String() string {
+	return fmt.Sprintf("<table columns=(%s) rows=%d>", strings.Join(t.names, ", "), t.nrows)
+}
+func (t *Table) Type() string               { return "table" }
+func (t *Table) Truth() starlark.Bool       { return t.nrows > 0 }
+func (t *Table) Hash() (uint32, error)      { return 0, fmt.Errorf("unhashable type: table") }
+func (t *Table) Len() int                   { return t.nrows }
+func (t *Table) Index(i int) starlark.Value { return t.row(i) }
+func (t *Table) Freeze() {
+	for _, col := range t.cols {
+		for _, v := range col {
+			v.Freeze()
+		}
+	}
+}
+
+// column returns the index of the named column, or -1.
+func (t *Table) column(name string) int {
+	for i, n := range t.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// mustColumn is like column but returns an error if there is no such column.
+func (t *Table) mustColumn(name string) (int, error) {
+	if i := t.column(name); i >= 0 {
+		return i, nil
+	}
+	return -1, fmt.Errorf("table has no column %q", name)
+}
+
+// row returns row i as a new dict.
+func (t *Table) row(i int) *starlark.Dict {
+	d := starlark.NewDict(len(t.names))
+	for j, name := range t.names {
+		d.SetKey(starlark.String(name), t.cols[j][i]) // can't fail
+	}
+	return d
+}
+
+// take returns a new table of the specified rows of t.
+func (t *Table) take(rows []int) *Table {
+	cols := make([][]starlark.Value, len(t.cols))
+	for j, col := range t.cols {
+		cols[j] = make([]starlark.Value, len(rows))
+		for k, i := range rows {
+			cols[j][k] = col[i]
+		}
+	}
+	return &Table{names: t.names, cols: cols, nrows: len(rows)}
+}
+
+func (t *Table) Attr(name string) (starlark.Value, error) {
+	if name == "columns" {
+		names := make(starlark.Tuple, len(t.names))
+		for i, name := range t.names {
+			names[i] = starlark.String(name)
+		}
+		return names, nil
+	}
+	if method, ok := tableMethods[name]; ok {
+		return starlark.NewBuiltin(name, method).BindReceiver(t), nil
+	}
+	return nil, nil
+}
+
+func (t *Table) AttrNames() []string {
+	names := []string{"columns"}
+	for name := range tableMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var tableMethods = map[string]func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error){
+	"column":   tableColumn,
+	"filter":   tableFilter,
+	"group_by": tableGroupBy,
+	"join":     tableJoin,
+	"rows":     tableRows,
+	"select":   tableSelect,
+}
+
+func newTable(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%s: unexpected positional arguments", b.Name())
+	}
+	names := make([]string, len(kwargs))
+	cols := make([][]starlark.Value, len(kwargs))
+	for i, kwarg := range kwargs {
+		names[i] = string(kwarg[0].(starlark.String))
+		iterable, ok := kwarg[1].(starlark.Iterable)
+		if !ok {
+			return nil, fmt.Errorf("%s: for column %s: got %s, want iterable", b.Name(), names[i], kwarg[1].Type())
+		}
+		col, err := collect(iterable)
+		if err != nil {
+			return nil, fmt.Errorf("%s: for column %s: %v", b.Name(), names[i], err)
+		}
+		if i > 0 && len(col) != len(cols[0]) {
+			return nil, fmt.Errorf("%s: column %s has %d values, want %d", b.Name(), names[i], len(col), len(cols[0]))
+		}
+		cols[i] = col
+	}
+	return New(names, cols), nil
+}
+
+func fromRows(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var rowsArg starlark.Iterable
+	var columns *starlark.List
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "rows", &rowsArg, "columns?", &columns); err != nil {
+		return nil, err
+	}
+	list, err := collect(rowsArg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	rows := make([]starlark.IterableMapping, len(list))
+	for i, x := range list {
+		row, ok := x.(starlark.IterableMapping)
+		if !ok {
+			return nil, fmt.Errorf("%s: row %d: got %s, want dict", b.Name(), i, x.Type())
+		}
+		rows[i] = row
+	}
+
+	var names []string
+	if columns != nil {
+		if names, err = stringList(columns); err != nil {
+			return nil, fmt.Errorf("%s: for parameter columns: %v", b.Name(), err)
+		}
+	} else {
+		seen := make(map[string]bool)
+		for i, row := range rows {
+			for _, item := range row.Items() {
+				name, ok := starlark.AsString(item[0])
+				if !ok {
+					return nil, fmt.Errorf("%s: row %d: got %s key, want string", b.Name(), i, item[0].Type())
+				}
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	cols := make([][]starlark.Value, len(names))
+	for j, name := range names {
+		col := make([]starlark.Value, len(rows))
+		for i, row := range rows {
+			v, found, err := row.Get(starlark.String(name))
+			if err != nil {
+				return nil, fmt.Errorf("%s: row %d: %v", b.Name(), i, err)
+			}
+			if !found {
+				v = starlark.None
+			}
+			col[i] = v
+		}
+		cols[j] = col
+	}
+	return New(names, cols), nil
+}
+
+func tableColumn(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t := b.Receiver().(*Table)
+	var name string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	j, err := t.mustColumn(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.NewList(append([]starlark.Value(nil), t.cols[j]...)), nil
+}
+
+func tableRows(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t := b.Receiver().(*Table)
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	rows := make([]starlark.Value, t.nrows)
+	for i := range rows {
+		rows[i] = t.row(i)
+	}
+	return starlark.NewList(rows), nil
+}
+
+func tableSelect(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t := b.Receiver().(*Table)
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+	}
+	names, err := stringList(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	cols := make([][]starlark.Value, len(names))
+	seen := make(map[string]bool)
+	for i, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("%s: duplicate column %q", b.Name(), name)
+		}
+		seen[name] = true
+		j, err := t.mustColumn(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		cols[i] = t.cols[j]
+	}
+	return &Table{names: names, cols: cols, nrows: t.nrows}, nil
+}
+
+func tableFilter(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t := b.Receiver().(*Table)
+	var fn starlark.Callable
+	if len(args) > 1 {
+		return nil, fmt.Errorf("%s: got %d positional arguments, want at most 1", b.Name(), len(args))
+	} else if len(args) == 1 && args[0] != starlark.None {
+		var ok bool
+		if fn, ok = args[0].(starlark.Callable); !ok {
+			return nil, fmt.Errorf("%s: got %s, want callable", b.Name(), args[0].Type())
+		}
+	}
+
+	// Compare the where columns first, so that fn is called
+	// only for the rows that match them.
+	type cond struct {
+		col []starlark.Value
+		v   starlark.Value
+	}
+	conds := make([]cond, len(kwargs))
+	for i, kwarg := range kwargs {
+		j, err := t.mustColumn(string(kwarg[0].(starlark.String)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		conds[i] = cond{t.cols[j], kwarg[1]}
+	}
+
+	var keep []int
+rows:
+	for i := 0; i < t.nrows; i++ {
+		for _, c := range conds {
+			if eq, err := starlark.Equal(c.col[i], c.v); err != nil {
+				return nil, fmt.Errorf("%s: %v", b.Name(), err)
+			} else if !eq {
+				continue rows
+			}
+		}
+		if fn != nil {
+			v, err := starlark.Call(thread, fn, starlark.Tuple{t.row(i)}, nil)
+			if err != nil {
+				return nil, err
+			}
+			if !v.Truth() {
+				continue
+			}
+		}
+		keep = append(keep, i)
+	}
+	return t.take(keep), nil
+}
+
+// An aggregate computes a column of a grouped table from the values
+// of a column of each group.
+type aggregate struct {
+	name string
+	op   string
+	col  []starlark.Value // nil for count
+}
+
+func (agg *aggregate) apply(group []int) (starlark.Value, error) {
+	switch agg.op {
+	case "count":
+		return starlark.MakeInt(len(group)), nil
+	case "first":
+		return agg.col[group[0]], nil
+	case "last":
+		return agg.col[group[len(group)-1]], nil
+	case "list":
+		elems := make([]starlark.Value, len(group))
+		for k, i := range group {
+			elems[k] = agg.col[i]
+		}
+		return starlark.NewList(elems), nil
+	case "sum", "mean":
+		var sum starlark.Value = starlark.MakeInt(0)
+		for _, i := range group {
+			var err error
+			if sum, err = starlark.Binary(syntax.PLUS, sum, agg.col[i]); err != nil {
+				return nil, err
+			}
+		}
+		if agg.op == "mean" {
+			return starlark.Binary(syntax.SLASH, sum, starlark.MakeInt(len(group)))
+		}
+		return sum, nil
+	case "min", "max":
+		op := syntax.LT
+		if agg.op == "max" {
+			op = syntax.GT
+		}
+		best := agg.col[group[0]]
+		for _, i := range group[1:] {
+			if better, err := starlark.Compare(op, agg.col[i], best); err != nil {
+				return nil, err
+			} else if better {
+				best = agg.col[i]
+			}
+		}
+		return best, nil
+	}
+	panic(agg.op)
+}
+
+func tableGroupBy(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t := b.Receiver().(*Table)
+	keys, err := stringList(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no key columns", b.Name())
+	}
+	keyCols := make([][]starlark.Value, len(keys))
+	for i, key := range keys {
+		j, err := t.mustColumn(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		keyCols[i] = t.cols[j]
+	}
+
+	aggs := make([]*aggregate, len(kwargs))
+	for i, kwarg := range kwargs {
+		agg := &aggregate{name: string(kwarg[0].(starlark.String))}
+		switch x := kwarg[1].(type) {
+		case starlark.String:
+			agg.op = string(x)
+			if agg.op != "count" {
+				return nil, fmt.Errorf("%s: for %s: got %q, want \"count\" or (op, column)", b.Name(), agg.name, agg.op)
+			}
+		case starlark.Tuple:
+			var column string
+			if err := starlark.UnpackPositionalArgs(agg.name, x, nil, 2, &agg.op, &column); err != nil {
+				return nil, fmt.Errorf("%s: %v", b.Name(), err)
+			}
+			switch agg.op {
+			case "count", "sum", "mean", "min", "max", "first", "last", "list":
+			default:
+				return nil, fmt.Errorf("%s: for %s: unknown aggregate %q", b.Name(), agg.name, agg.op)
+			}
+			j, err := t.mustColumn(column)
+			if err != nil {
+				return nil, fmt.Errorf("%s: for %s: %v", b.Name(), agg.name, err)
+			}
+			agg.col = t.cols[j]
+		default:
+			return nil, fmt.Errorf("%s: for %s: got %s, want \"count\" or (op, column)", b.Name(), agg.name, x.Type())
+		}
+		aggs[i] = agg
+	}
+
+	names := append([]string(nil), keys...)
+	seen := make(map[string]bool)
+	for _, agg := range aggs {
+		names = append(names, agg.name)
+	}
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("%s: duplicate column %q", b.Name(), name)
+		}
+		seen[name] = true
+	}
+
+	// Partition the rows into groups, in order of first appearance.
+	index := new(starlark.Dict) // maps key tuple to group number
+	var groups [][]int
+	for i := 0; i < t.nrows; i++ {
+		key := make(starlark.Tuple, len(keyCols))
+		for k, col := range keyCols {
+			key[k] = col[i]
+		}
+		g, found, err := index.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		if !found {
+			g = starlark.MakeInt(len(groups))
+			index.SetKey(key, g) // can't fail
+			groups = append(groups, nil)
+		}
+		n, _ := starlark.AsInt32(g)
+		groups[n] = append(groups[n], i)
+	}
+
+	cols := make([][]starlark.Value, len(names))
+	for k, col := range keyCols {
+		cols[k] = make([]starlark.Value, len(groups))
+		for g, group := range groups {
+			cols[k][g] = col[group[0]]
+		}
+	}
+	for a, agg := range aggs {
+		col := make([]starlark.Value, len(groups))
+		for g, group := range groups {
+			if col[g], err = agg.apply(group); err != nil {
+				return nil, fmt.Errorf("%s: for %s: %v", b.Name(), agg.name, err)
+			}
+		}
+		cols[len(keys)+a] = col
+	}
+	return &Table{names: names, cols: cols, nrows: len(groups)}, nil
+}
+
+func tableJoin(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	t := b.Receiver().(*Table)
+	var other *Table
+	var on starlark.Value
+	how := "inner"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "other", &other, "on", &on, "how?", &how); err != nil {
+		return nil, err
+	}
+	if how != "inner" && how != "left" {
+		return nil, fmt.Errorf("%s: got how=%q, want \"inner\" or \"left\"", b.Name(), how)
+	}
+	var keys []string
+	if s, ok := starlark.AsString(on); ok {
+		keys = []string{s}
+	} else if iterable, ok := on.(starlark.Iterable); ok {
+		list, err := collect(iterable)
+		if err != nil {
+			return nil, fmt.Errorf("%s: for parameter on: %v", b.Name(), err)
+		}
+		if keys, err = stringList(list); err != nil {
+			return nil, fmt.Errorf("%s: for parameter on: %v", b.Name(), err)
+		}
+	} else {
+		return nil, fmt.Errorf("%s: for parameter on: got %s, want string or list of strings", b.Name(), on.Type())
+	}
+
+	// Index the rows of the other table by key.
+	leftKeys := make([][]starlark.Value, len(keys))
+	rightKeys := make([][]starlark.Value, len(keys))
+	isKey := make(map[string]bool)
+	for k, key := range keys {
+		i, err := t.mustColumn(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		j, err := other.mustColumn(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: other %v", b.Name(), err)
+		}
+		leftKeys[k], rightKeys[k] = t.cols[i], other.cols[j]
+		isKey[key] = true
+	}
+	keyAt := func(cols [][]starlark.Value, i int) starlark.Tuple {
+		key := make(starlark.Tuple, len(cols))
+		for k, col := range cols {
+			key[k] = col[i]
+		}
+		return key
+	}
+	index := new(starlark.Dict) // maps key tuple to list of row numbers
+	var matches [][]int
+	for i := 0; i < other.nrows; i++ {
+		key := keyAt(rightKeys, i)
+		m, found, err := index.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		if !found {
+			m = starlark.MakeInt(len(matches))
+			index.SetKey(key, m) // can't fail
+			matches = append(matches, nil)
+		}
+		n, _ := starlark.AsInt32(m)
+		matches[n] = append(matches[n], i)
+	}
+
+	// Pair each row of t with its matches.
+	var left, right []int // right[k] is -1 for an unmatched left row
+	for i := 0; i < t.nrows; i++ {
+		m, found, err := index.Get(keyAt(leftKeys, i))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		if found {
+			n, _ := starlark.AsInt32(m)
+			for _, j := range matches[n] {
+				left = append(left, i)
+				right = append(right, j)
+			}
+		} else if how == "left" {
+			left = append(left, i)
+			right = append(right, -1)
+		}
+	}
+
+	result := t.take(left)
+	names := append([]string(nil), t.names...)
+	cols := result.cols
+	for j, name := range other.names {
+		if isKey[name] {
+			continue
+		}
+		if t.column(name) >= 0 {
+			return nil, fmt.Errorf("%s: column %q is in both tables", b.Name(), name)
+		}
+		col := make([]starlark.Value, len(right))
+		for k, i := range right {
+			if i < 0 {
+				col[k] = starlark.None
+			} else {
+				col[k] = other.cols[j][i]
+			}
+		}
+		names = append(names, name)
+		cols = append(cols, col)
+	}
+	return &Table{names: names, cols: cols, nrows: len(left)}, nil
+}
+
+// collect returns the elements of an iterable.
+func collect(iterable starlark.Iterable) ([]starlark.Value, error) {
+	var elems []starlark.Value
+	if n := starlark.Len(iterable); n > 0 {
+		elems = make([]starlark.Value, 0, n)
+	}
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var x starlark.Value
+	for iter.Next(&x) {
+		elems = append(elems, x)
+	}
+	if iter, ok := iter.(starlark.ErrIterator); ok && iter.Err() != nil {
+		return nil, iter.Err()
+	}
+	return elems, nil
+}
+
+// stringList returns the elements of a list or tuple of strings.
+func stringList(x interface{}) ([]string, error) {
+	var elems []starlark.Value
+	switch x := x.(type) {
+	case starlark.Tuple:
+		elems = x
+	case []starlark.Value:
+		elems = x
+	case *starlark.List:
+		elems = make([]starlark.Value, x.Len())
+		for i := range elems {
+			elems[i] = x.Index(i)
+		}
+	}
+	strs := make([]string, len(elems))
+	for i, elem := range elems {
+		s, ok := starlark.AsString(elem)
+		if !ok {
+			return nil, fmt.Errorf("got %s, want string", elem.Type())
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
@@ -8,6 +8,7 @@ package time // import "go.starlark.net/lib/time"
 import (
 	"fmt"
 	"sort"
+	"sync"
 	"time"
 
 	"go.starlark.net/starlark"
@@ -24,11 +25,19 @@ import (
 //
 //     is_valid_timezone(loc) - Reports whether loc is a valid time zone name.
 //
-//     now() - Returns the current local time. Applications may replace this function by a deterministic one.
+//     now() - Returns the current local time, according to the thread's clock (see SetClock).
 //
 //     parse_duration(d) - Parses the given duration string. For more details, refer to
 //                         https://pkg.go.dev/time#ParseDuration.
 //
+//     rate_limiter(every, burst) - Returns a token-bucket rate limiter that permits one event per
+//                                  duration every on average, and bursts of up to burst (default 1)
+//                                  events. Its wait() method sleeps until an event is permitted, and
+//                                  its allow() method reports whether one is permitted now.
+//
+//     sleep(d) - Suspends the thread for the duration d, according to the thread's clock.
+//                A sleeping thread may be cancelled.
+//
 //     parse_time(x, format, location) - Parses the given time string using a specific time format and location.
 //                                      The expected arguments are a time string (mandatory), a time format
 //                                      (optional, set to RFC3339 by default, e.g. "2021-03-22T23:20:50.52Z")
@@ -57,6 +66,8 @@ var Module = &starlarkstruct.Module{
 		"now":               starlark.NewBuiltin("now", now),
 		"parse_duration":    starlark.NewBuiltin("parse_duration", parseDuration),
 		"parse_time":        starlark.NewBuiltin("parse_time", parseTime),
+		"rate_limiter":      starlark.NewBuiltin("rate_limiter", newRateLimiter),
+		"sleep":             starlark.NewBuiltin("sleep", sleep),
 		"time":              starlark.NewBuiltin("time", newTime),
 
 		"nanosecond":  Duration(time.Nanosecond),
@@ -70,9 +81,75 @@ var Module = &starlarkstruct.Module{
 
 // NowFunc is a function that generates the current time. Intentionally exported
 // so that it can be overridden, for example by applications that require their
-// Starlark scripts to be fully deterministic.
+// Starlark scripts to be fully deterministic. It is the source of the current
+// time for threads without a clock of their own.
 var NowFunc = time.Now
 
+// A Clock is a source of time for the functions of this package,
+// such as now and sleep, called by a Starlark thread.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc arranges to call f, perhaps in another goroutine,
+	// once the duration d has elapsed.
+	AfterFunc(d time.Duration, f func())
+}
+
+// SetClock associates a clock with the specified Starlark thread.
+// Threads without a clock use the system clock and NowFunc.
+func SetClock(thread *starlark.Thread, clock Clock) {
+	thread.SetLocal(clockKey, clock)
+}
+
+// ThreadClock returns the clock of the specified thread.
+func ThreadClock(thread *starlark.Thread) Clock {
+	if clock, ok := thread.Local(clockKey).(Clock); ok {
+		return clock
+	}
+	return systemClock{}
+}
+
+const clockKey = "time.Clock"
+
+// systemClock is the default clock, which uses NowFunc and real timers.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                      { return NowFunc() }
+func (systemClock) AfterFunc(d time.Duration, f func()) { time.AfterFunc(d, f) }
+
+// A FakeClock is a Clock whose time advances only when it is told to,
+// for deterministic tests of scripts. A thread sleeping on a FakeClock
+// advances its time by the duration of the sleep and resumes at once.
+// A FakeClock is safe for concurrent use.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock whose current time is t.
+func NewFakeClock(t time.Time) *FakeClock { return &FakeClock{now: t} }
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock's time forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// AfterFunc advances the clock's time by d and calls f.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) {
+	c.Advance(d)
+	f()
+}
+
 func parseDuration(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var d Duration
 	err := starlark.UnpackPositionalArgs("parse_duration", args, kwargs, 1, &d)
@@ -129,7 +206,26 @@ func fromTimestamp(thread *starlark.Thread, _ *starlark.Builtin, args starlark.T
 }
 
 func now(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	return Time(NowFunc()), nil
+	return Time(ThreadClock(thread).Now()), nil
+}
+
+func sleep(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var d Duration
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &d); err != nil {
+		return nil, err
+	}
+	if d < 0 {
+		return nil, fmt.Errorf("%s: negative duration %s", b.Name(), d)
+	}
+	return sleepFuture(thread, time.Duration(d)), nil
+}
+
+// sleepFuture returns a Future that completes with None once the
+// duration d has elapsed according to the thread's clock.
+func sleepFuture(thread *starlark.Thread, d time.Duration) *starlark.Future {
+	f := starlark.NewFuture()
+	ThreadClock(thread).AfterFunc(d, func() { f.Complete(starlark.None, nil) })
+	return f
 }
 
 // Duration is a Starlark representation of a duration.
@@ -505,3 +601,114 @@ func threeway(op syntax.Token, cmp int) bool {
 	}
 	panic(op)
 }
+
+// A RateLimiter is a token bucket that permits events at an average
+// rate of one per interval, with bursts of up to a fixed number of
+// events. Tokens accumulate according to the clock of the thread that
+// uses the limiter. Unlike most values, a RateLimiter remains usable
+// when frozen, and it is safe for concurrent use by several threads.
+type RateLimiter struct {
+	every time.Duration
+	burst int
+
+	mu     sync.Mutex
+	tokens float64   // may be negative while waiters hold reservations
+	last   time.Time // time at which tokens was last updated; zero before first use
+}
+
+// NewRateLimiter returns a new RateLimiter that permits one event
+// per duration every, with bursts of up to burst events. Its bucket
+// is initially full.
+func NewRateLimiter(every time.Duration, burst int) *RateLimiter {
+	return &RateLimiter{every: every, burst: burst, tokens: float64(burst)}
+}
+
+var _ starlark.HasAttrs = (*RateLimiter)(nil)
+
+func (r *RateLimiter) String() string {
+	return fmt.Sprintf("<time.rate_limiter every=%s burst=%d>", r.every, r.burst)
+}
+func (r *RateLimiter) Type() string          { return "time.rate_limiter" }
+func (r *RateLimiter) Freeze()               {} // internally synchronized
+func (r *RateLimiter) Truth() starlark.Bool  { return starlark.True }
+func (r *RateLimiter) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: time.rate_limiter") }
+
+func (r *RateLimiter) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "every":
+		return Duration(r.every), nil
+	case "burst":
+		return starlark.MakeInt(r.burst), nil
+	case "allow":
+		return starlark.NewBuiltin(name, rateLimiterAllow).BindReceiver(r), nil
+	case "wait":
+		return starlark.NewBuiltin(name, rateLimiterWait).BindReceiver(r), nil
+	}
+	return nil, nil
+}
+
+func (r *RateLimiter) AttrNames() []string { return []string{"allow", "burst", "every", "wait"} }
+
+// reserve takes a token from the bucket at time now, and returns
+// how long the caller must wait before the token may be used.
+// If wait is false, reserve takes a token only if one is available
+// immediately, and reports whether it did so by a zero delay.
+func (r *RateLimiter) reserve(now time.Time, wait bool) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.last.IsZero() && now.After(r.last) {
+		r.tokens += float64(now.Sub(r.last)) / float64(r.every)
+		if r.tokens > float64(r.burst) {
+			r.tokens = float64(r.burst)
+		}
+	}
+	if r.last.IsZero() || now.After(r.last) {
+		r.last = now
+	}
+	if r.tokens >= 1 {
+		r.tokens--
+		return 0, true
+	}
+	if !wait {
+		return 0, false
+	}
+	delay := time.Duration((1 - r.tokens) * float64(r.every))
+	r.tokens--
+	return delay, true
+}
+
+func newRateLimiter(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var every Duration
+	burst := 1
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "every", &every, "burst?", &burst); err != nil {
+		return nil, err
+	}
+	if every <= 0 {
+		return nil, fmt.Errorf("%s: interval must be positive, got %s", b.Name(), every)
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("%s: burst must be positive, got %d", b.Name(), burst)
+	}
+	return NewRateLimiter(time.Duration(every), burst), nil
+}
+
+func rateLimiterAllow(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	r := b.Receiver().(*RateLimiter)
+	_, ok := r.reserve(ThreadClock(thread).Now(), false)
+	return starlark.Bool(ok), nil
+}
+
+func rateLimiterWait(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	r := b.Receiver().(*RateLimiter)
+	delay, _ := r.reserve(ThreadClock(thread).Now(), true)
+	if delay == 0 {
+		return starlark.None, nil
+	}
+	return sleepFuture(thread, delay), nil
+}
@@ -0,0 +1,281 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader
+
+// This file defines an on-disk cache of module sources and compiled programs.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+)
+
+// A DiskCache is a content-addressed cache of module data in a
+// directory of the file system, which may be shared by concurrent
+// processes. It stores each datum in a file named by the SHA-256 hash
+// of its content, and records the hash of the module data most recently
+// obtained for each key, such as a label or the source text of a
+// compiled program, in an index.
+//
+// Files are written atomically, so a process never observes a partial
+// file written by another, but the cache is not otherwise locked:
+// concurrent processes may redundantly fetch or compile the same module.
+type DiskCache struct {
+	// Dir is the cache directory.
+	Dir string
+
+	// MaxAge, if positive, is the time for which a fetched source
+	// remains valid, after which it is fetched again. Otherwise,
+	// fetched sources remain valid until removed by GC.
+	MaxAge time.Duration
+}
+
+// DefaultCacheDir returns the default cache directory,
+// "starlark" within the user's cache directory.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "starlark"), nil
+}
+
+// Sources returns a resolver that resolves each label using r only if
+// the cache has no valid copy of the module, and updates the cache.
+// It is intended for resolvers that fetch remote modules, such as HTTP,
+// and may be combined with Lockfile.Verify to check cached content.
+func (c *DiskCache) Sources(r Resolver) Resolver {
+	return ResolverFunc(func(label string) (*Module, error) {
+		key := "source\x00" + label
+		if m, ok := c.lookup(key, c.MaxAge); ok {
+			return m, nil
+		}
+		m, err := r.Resolve(label)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.store(key, m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	})
+}
+
+// Compiled returns a resolver that resolves each label using r, and
+// returns the compiled program for the module's source, compiling it
+// only if the cache has no program for the same source, file name,
+// predeclared names, dialect options, and compiler version.
+//
+// A source that fails to compile is returned as is, so that
+// the error is reported when the module is executed.
+func (c *DiskCache) Compiled(r Resolver, predeclared starlark.StringDict) Resolver {
+	names := predeclared.Keys()
+	sort.Strings(names)
+	params := fmt.Sprintf("compiled\x00%d\x00%s\x00%v", starlark.CompilerVersion, strings.Join(names, ","), dialect())
+	return ResolverFunc(func(label string) (*Module, error) {
+		m, err := r.Resolve(label)
+		if err != nil || m.IsCompiled() {
+			return m, err
+		}
+		key := params + "\x00" + m.Filename + "\x00" + string(m.Data)
+		if cm, ok := c.lookup(key, 0); ok {
+			return cm, nil
+		}
+
+		_, prog, err := starlark.SourceProgram(m.Filename, m.Data, predeclared.Has)
+		if err != nil {
+			return m, nil
+		}
+		var buf bytes.Buffer
+		if err := prog.Write(&buf); err != nil {
+			return nil, err
+		}
+		cm := &Module{Filename: m.Filename, Data: buf.Bytes()}
+		if err := c.store(key, cm); err != nil {
+			return nil, err
+		}
+		return cm, nil
+	})
+}
+
+// dialect returns the dialect options that affect compilation.
+func dialect() []bool {
+	return []bool{
+		resolve.AllowSet,
+		resolve.AllowGlobalReassign,
+		resolve.AllowRecursion,
+		resolve.AllowDel,
+		resolve.AllowWith,
+		resolve.AllowCatch,
+		resolve.AllowYield,
+		resolve.LoadBindsGlobally,
+	}
+}
+
+// The cache directory has two subdirectories:
+//
+//	data/xx/<hash>    module data, named by the hash of its content
+//	index/xx/<hash>   for each key, named by the hash of the key, the
+//	                  hash of its module's data and the module's file name
+//
+// in which xx is the first two digits of the hash.
+// The modification time of a file is the time of its most recent use.
+
+func (c *DiskCache) path(kind, hash string) string {
+	return filepath.Join(c.Dir, kind, hash[:2], hash)
+}
+
+func hashString(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// lookup returns the module recorded for key, if any, provided that
+// the index entry is younger than maxAge, if positive.
+func (c *DiskCache) lookup(key string, maxAge time.Duration) (*Module, bool) {
+	indexFile := c.path("index", hashString([]byte(key)))
+	if maxAge > 0 {
+		info, err := os.Stat(indexFile)
+		if err != nil || time.Since(info.ModTime()) > maxAge {
+			return nil, false
+		}
+	}
+	index, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		return nil, false
+	}
+	i := bytes.IndexByte(index, '\n')
+	if i < 0 {
+		return nil, false
+	}
+	hash, filename := string(index[:i]), string(index[i+1:])
+	if len(hash) != 2*sha256.Size {
+		return nil, false
+	}
+	dataFile := c.path("data", hash)
+	data, err := ioutil.ReadFile(dataFile)
+	if err != nil || hashString(data) != hash {
+		return nil, false // missing or corrupt
+	}
+	now := time.Now()
+	os.Chtimes(dataFile, now, now) // record use
+	if maxAge <= 0 {
+		os.Chtimes(indexFile, now, now)
+	}
+	return &Module{Filename: filename, Data: data}, true
+}
+
+// store records the module for key.
+func (c *DiskCache) store(key string, m *Module) error {
+	hash := hashString(m.Data)
+	if err := writeFileAtomic(c.path("data", hash), m.Data); err != nil {
+		return fmt.Errorf("module cache: %v", err)
+	}
+	index := hash + "\n" + m.Filename
+	if err := writeFileAtomic(c.path("index", hashString([]byte(key))), []byte(index)); err != nil {
+		return fmt.Errorf("module cache: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file by renaming a temporary file,
+// so that concurrent readers never observe a partial file.
+func writeFileAtomic(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// GC removes cached data that has not been used for longer than maxAge,
+// if positive, and then the least recently used data until the total
+// size of the data is at most maxSize, if positive. It also removes
+// index entries older than maxAge.
+func (c *DiskCache) GC(maxAge time.Duration, maxSize int64) error {
+	type file struct {
+		path string
+		info fs.FileInfo
+	}
+	list := func(kind string) ([]file, error) {
+		var files []file
+		err := filepath.WalkDir(filepath.Join(c.Dir, kind), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.Type().IsRegular() {
+				info, err := d.Info()
+				if err != nil {
+					return nil // removed concurrently
+				}
+				files = append(files, file{path, info})
+			}
+			return nil
+		})
+		return files, err
+	}
+
+	now := time.Now()
+	expired := func(f file) bool { return maxAge > 0 && now.Sub(f.info.ModTime()) > maxAge }
+
+	index, err := list("index")
+	if err != nil {
+		return err
+	}
+	for _, f := range index {
+		if expired(f) {
+			os.Remove(f.path)
+		}
+	}
+
+	data, err := list("data")
+	if err != nil {
+		return err
+	}
+	// Remove the least recently used data first.
+	sort.Slice(data, func(i, j int) bool { return data[i].info.ModTime().Before(data[j].info.ModTime()) })
+	var total int64
+	for _, f := range data {
+		total += f.info.Size()
+	}
+	for _, f := range data {
+		if expired(f) || maxSize > 0 && total > maxSize {
+			if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			total -= f.info.Size()
+		}
+	}
+	return nil
+}
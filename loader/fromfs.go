@@ -0,0 +1,88 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader
+
+// This file defines a Loader for a tree of modules in an fs.FS.
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// initFile is the name of the file that defines a directory module.
+const initFile = "__init__.star"
+
+// FromFS returns a Loader for the modules in the file system fsys,
+// such as an embed.FS containing a library shipped within a binary:
+//
+//	//go:embed stdlib/*.star stdlib/*/*.star
+//	var stdlib embed.FS
+//
+//	l := loader.FromFS(stdlib)
+//	thread := &starlark.Thread{Load: l.Load}
+//
+// (A go:embed directive that names a directory, rather than a pattern,
+// omits the __init__.star files within it.)
+//
+// A label is a slash-separated path within fsys. A label starting with
+// "./" or "../" is relative to the directory of the loading module;
+// any other label is relative to the root of fsys. A label that denotes
+// a directory refers to the file __init__.star within it.
+//
+// The caller may set other fields of the Loader, such as Predeclared,
+// before its first use.
+func FromFS(fsys fs.FS) *Loader {
+	return &Loader{
+		Resolver: FS(fsys),
+		Canonicalize: func(from, label string) (string, error) {
+			return fsCanonicalize(fsys, from, label)
+		},
+	}
+}
+
+// fsCanonicalize returns the path within fsys
+// of the module of a label appearing in module from.
+func fsCanonicalize(fsys fs.FS, from, label string) (string, error) {
+	var name string
+	if strings.HasPrefix(label, "./") || strings.HasPrefix(label, "../") {
+		name = path.Join(path.Dir(from), label)
+	} else {
+		name = path.Clean(strings.TrimPrefix(label, "/"))
+	}
+	if !fs.ValidPath(name) || name == "." {
+		return "", fmt.Errorf("invalid module label %q", label)
+	}
+	if info, err := fs.Stat(fsys, name); err == nil && info.IsDir() {
+		name = path.Join(name, initFile)
+	}
+	return name, nil
+}
+
+// Modules returns the labels of the modules in fsys, in lexical order:
+// the paths of its .star files, and of its directories that contain an
+// __init__.star file.
+func Modules(fsys fs.FS) ([]string, error) {
+	var labels []string
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(name, ".star") {
+			labels = append(labels, name)
+			if path.Base(name) == initFile && name != initFile {
+				labels = append(labels, path.Dir(name))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader
+
+// This file defines the module dependency graph recorded by a Loader.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// An Edge records a load statement.
+type Edge struct {
+	From string          // canonical label of the loading module, or file name of top-level code
+	To   string          // canonical label of the loaded module
+	Pos  syntax.Position // position of the load statement, if known
+}
+
+// A Graph is the dependency graph of the modules loaded by a Loader.
+type Graph struct {
+	Edges []Edge // in order of Pos, then From and To
+}
+
+// Graph returns the dependency graph of the load statements executed so
+// far by the modules loaded by l, and by code that uses l.Load or
+// l.LoadLazy. Load statements that failed (for example, because of
+// the Visibility check) are not recorded.
+func (l *Loader) Graph() *Graph {
+	l.mu.Lock()
+	edges := make([]Edge, 0, len(l.edges))
+	for _, e := range l.edges {
+		edges = append(edges, e)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(edges, func(i, j int) bool {
+		x, y := edges[i], edges[j]
+		if x.Pos.Filename() != y.Pos.Filename() {
+			return x.Pos.Filename() < y.Pos.Filename()
+		}
+		if x.Pos.Line != y.Pos.Line {
+			return x.Pos.Line < y.Pos.Line
+		}
+		if x.Pos.Col != y.Pos.Col {
+			return x.Pos.Col < y.Pos.Col
+		}
+		if x.From != y.From {
+			return x.From < y.From
+		}
+		return x.To < y.To
+	})
+	return &Graph{Edges: edges}
+}
+
+// recordEdge records a load statement of the specified
+// canonical label executed by thread.
+func (l *Loader) recordEdge(thread *starlark.Thread, from, to string) {
+	var pos syntax.Position
+	if thread.CallStackDepth() > 0 {
+		pos = thread.CallFrame(0).Pos
+	}
+	if from == "" {
+		from = pos.Filename()
+	}
+	// Positions in distinct executions of the same file are distinct,
+	// so edges are identified by the string form of the position.
+	key := edgeKey{from, to, pos.String()}
+	l.mu.Lock()
+	if l.edges == nil {
+		l.edges = make(map[edgeKey]Edge)
+	}
+	l.edges[key] = Edge{From: from, To: to, Pos: pos}
+	l.mu.Unlock()
+}
+
+type edgeKey struct{ from, to, pos string }
+
+// Modules returns the names of the nodes of the graph, in lexical order.
+func (g *Graph) Modules() []string {
+	set := make(map[string]bool)
+	for _, e := range g.Edges {
+		set[e.From] = true
+		set[e.To] = true
+	}
+	return sortedKeys(set)
+}
+
+// Deps returns the modules directly loaded by the specified
+// module, in lexical order.
+func (g *Graph) Deps(label string) []string {
+	set := make(map[string]bool)
+	for _, e := range g.Edges {
+		if e.From == label {
+			set[e.To] = true
+		}
+	}
+	return sortedKeys(set)
+}
+
+// Rdeps returns the modules that depend directly or indirectly on any of
+// the specified modules, in lexical order: the modules that may be
+// affected by a change to them. The result does not include the
+// specified modules themselves, unless they are part of a cycle.
+func (g *Graph) Rdeps(labels ...string) []string {
+	rdeps := make(map[string][]string)
+	for _, e := range g.Edges {
+		rdeps[e.To] = append(rdeps[e.To], e.From)
+	}
+	seen := make(map[string]bool)
+	var visit func(label string)
+	visit = func(label string) {
+		for _, from := range rdeps[label] {
+			if !seen[from] {
+				seen[from] = true
+				visit(from)
+			}
+		}
+	}
+	for _, label := range labels {
+		visit(label)
+	}
+	return sortedKeys(seen)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteDOT writes the graph to w in the DOT language of Graphviz.
+// Each edge is labeled with the position of its load statement.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "digraph modules {")
+	for _, e := range g.Edges {
+		fmt.Fprintf(out, "\t%q -> %q", e.From, e.To)
+		if e.Pos.IsValid() {
+			fmt.Fprintf(out, " [label=%q]", e.Pos.String())
+		}
+		fmt.Fprintln(out, ";")
+	}
+	fmt.Fprintln(out, "}")
+	return out.Flush()
+}
+
+// WriteJSON writes the graph to w as a JSON object of the form
+//
+//	{"modules": ["a.star", ...],
+//	 "edges": [{"from": "a.star", "to": "b.star", "pos": "a.star:1:1"}, ...]}
+func (g *Graph) WriteJSON(w io.Writer) error {
+	type edge struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		Pos  string `json:"pos,omitempty"`
+	}
+	var doc struct {
+		Modules []string `json:"modules"`
+		Edges   []edge   `json:"edges"`
+	}
+	doc.Modules = g.Modules()
+	doc.Edges = []edge{}
+	for _, e := range g.Edges {
+		var pos string
+		if e.Pos.IsValid() {
+			pos = e.Pos.String()
+		}
+		doc.Edges = append(doc.Edges, edge{e.From, e.To, pos})
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
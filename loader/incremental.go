@@ -0,0 +1,323 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader
+
+// This file defines Incremental, a loader that re-executes only the
+// modules affected by a change to their inputs.
+//
+// The design follows that of Bazel's Skyframe and of other
+// "red-green" incremental computation engines. The loader records, for
+// each node of the dependency graph (a module, the source of a module,
+// or another input), the nodes on which it depends, in the order they
+// were first used, and two versions: verifiedAt, the latest version at
+// which the node's value is known to be current, and changedAt, the
+// version at which the value last changed. Invalidate starts a new
+// version in which the specified inputs are stale. A request for a
+// node that is not current at the new version brings its dependencies
+// up to date, in order, and re-executes the module only if one of them
+// changed since the node was last verified. If the re-executed module
+// produces the same globals as before, its changedAt is unchanged, so
+// the modules that depend on it need not be re-executed either.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// An Incremental loads modules found by a Resolver, caching the globals
+// of each one together with the dependencies it used: its source text,
+// the modules it loaded, and any inputs read by built-in functions
+// through the Input method. After a call to Invalidate, the next Load
+// re-executes only those modules whose dependencies have changed,
+// reusing the cached globals of all others.
+//
+// Because the globals of a module are compared using starlark.Equal,
+// a module that defines functions always differs from its previous
+// execution; only modules that define data may cut off further
+// re-execution.
+//
+// An Incremental is safe for concurrent use, but loads are serialized.
+// The zero value is not usable; Resolver must be set.
+type Incremental struct {
+	// Resolver finds the module for each label.
+	Resolver Resolver
+
+	// Predeclared holds the predeclared names of every module.
+	Predeclared starlark.StringDict
+
+	// NewThread, if non-nil, returns the thread in which to execute the
+	// module of the specified label, as for Loader.
+	NewThread func(label string) *starlark.Thread
+
+	// ReadInput, if non-nil, returns the current contents of the named
+	// input, such as a data file. See the Input method.
+	ReadInput func(name string) ([]byte, error)
+
+	mu      sync.Mutex
+	version uint64 // current version; zero before first use
+	nodes   map[nodeKey]*node
+}
+
+// A nodeKey identifies a node of the dependency graph.
+type nodeKey struct {
+	kind nodeKind
+	name string // label of module or source, or name of input
+}
+
+type nodeKind uint8
+
+const (
+	moduleNode nodeKind = iota // the globals of an executed module
+	sourceNode                 // the resolved source of a module
+	inputNode                  // an input read by ReadInput
+)
+
+type node struct {
+	nodeKey
+	deps       []*node // dependencies, in order of first use (modules only)
+	changedAt  uint64  // version at which the value last changed
+	verifiedAt uint64  // version at which the value was last known current
+	stale      bool    // input or source was invalidated since verifiedAt
+	busy       bool    // node is being updated; used to detect cycles
+
+	// value
+	module  *Module             // for sourceNode
+	data    []byte              // for inputNode
+	sum     [sha256.Size]byte   // for sourceNode and inputNode
+	globals starlark.StringDict // for moduleNode
+	err     error
+}
+
+// incrementalKey is the thread-local key of the module node being
+// executed by a thread of an Incremental.
+const incrementalKey = "go.starlark.net/loader.incremental"
+
+type incrementalFrame struct {
+	inc *Incremental
+	n   *node
+}
+
+// Load returns the globals of the module of the specified label,
+// executing it if it has not been executed, or if any of its
+// dependencies have changed since it was. Its signature is that of the
+// Load hook of starlark.Thread.
+func (inc *Incremental) Load(thread *starlark.Thread, label string) (starlark.StringDict, error) {
+	if f, ok := thread.Local(incrementalKey).(*incrementalFrame); ok && f.inc == inc {
+		// A load statement executed by a module of this loader.
+		// The lock is already held.
+		return inc.get(f.n, inc.node(moduleNode, label))
+	}
+
+	inc.mu.Lock()
+	defer inc.mu.Unlock()
+	return inc.get(nil, inc.node(moduleNode, label))
+}
+
+// Input returns the current contents of the named input, obtained from
+// ReadInput, and records that the module executed by thread depends on
+// it, so that Invalidate(name) causes the module to be re-executed if
+// the contents have changed. It is intended for use by built-in
+// functions that read files or other external state. When called from
+// a thread not executing a module of inc, it simply calls ReadInput.
+func (inc *Incremental) Input(thread *starlark.Thread, name string) ([]byte, error) {
+	if inc.ReadInput == nil {
+		return nil, fmt.Errorf("reading input %s: no ReadInput function", name)
+	}
+	f, ok := thread.Local(incrementalKey).(*incrementalFrame)
+	if !ok || f.inc != inc {
+		return inc.ReadInput(name)
+	}
+	d := inc.node(inputNode, name)
+	if err := inc.use(f.n, d); err != nil {
+		return nil, err
+	}
+	return d.data, d.err
+}
+
+// Invalidate records that the specified module sources or inputs, named
+// by their labels or input names, may have changed. The next Load
+// re-reads them, and re-executes the modules that depend, directly or
+// indirectly, on those whose contents did change.
+func (inc *Incremental) Invalidate(names ...string) {
+	inc.mu.Lock()
+	defer inc.mu.Unlock()
+	inc.version++
+	for _, name := range names {
+		for _, kind := range []nodeKind{sourceNode, inputNode} {
+			if n := inc.nodes[nodeKey{kind, name}]; n != nil {
+				n.stale = true
+			}
+		}
+	}
+}
+
+// node returns the node of the specified key, creating it if necessary.
+func (inc *Incremental) node(kind nodeKind, name string) *node {
+	if inc.version == 0 {
+		inc.version = 1
+	}
+	if inc.nodes == nil {
+		inc.nodes = make(map[nodeKey]*node)
+	}
+	key := nodeKey{kind, name}
+	n := inc.nodes[key]
+	if n == nil {
+		n = &node{nodeKey: key}
+		inc.nodes[key] = n
+	}
+	return n
+}
+
+// get brings module node n up to date, recording it as a dependency of
+// the module node from, if any, and returns its globals.
+func (inc *Incremental) get(from, n *node) (starlark.StringDict, error) {
+	if err := inc.use(from, n); err != nil {
+		return nil, err
+	}
+	return n.globals, n.err
+}
+
+// use brings node n up to date, recording it
+// as a dependency of the module node from, if any.
+func (inc *Incremental) use(from, n *node) error {
+	if from != nil {
+		from.deps = append(from.deps, n)
+	}
+	return inc.update(n)
+}
+
+// update brings node n up to date with the current version.
+// It fails only if n is part of a cycle.
+func (inc *Incremental) update(n *node) error {
+	if n.verifiedAt == inc.version {
+		return nil
+	}
+	if n.busy {
+		return fmt.Errorf("cycle in load graph")
+	}
+	n.busy = true
+	defer func() { n.busy = false }()
+
+	if n.verifiedAt == 0 || !inc.unchanged(n) {
+		changed := inc.compute(n)
+		if changed || n.changedAt == 0 {
+			n.changedAt = inc.version
+		}
+	}
+	n.verifiedAt = inc.version
+	return nil
+}
+
+// unchanged reports whether none of the dependencies
+// of node n have changed since it was last verified.
+func (inc *Incremental) unchanged(n *node) bool {
+	if n.kind != moduleNode {
+		return !n.stale
+	}
+	for _, d := range n.deps {
+		if inc.update(d) != nil || d.changedAt > n.verifiedAt {
+			return false
+		}
+	}
+	return true
+}
+
+// compute computes the value of node n, and
+// reports whether it differs from the previous one.
+func (inc *Incremental) compute(n *node) bool {
+	switch n.kind {
+	case sourceNode:
+		m, err := inc.Resolver.Resolve(n.name)
+		h := sha256.New()
+		if err != nil {
+			fmt.Fprintf(h, "error\x00%v", err)
+		} else {
+			fmt.Fprintf(h, "module\x00%s\x00", m.Filename)
+			h.Write(m.Data)
+		}
+		n.module, n.err = m, err
+		return n.setSum(h.Sum(nil))
+
+	case inputNode:
+		data, err := inc.ReadInput(n.name)
+		h := sha256.New()
+		if err != nil {
+			fmt.Fprintf(h, "error\x00%v", err)
+		} else {
+			h.Write(data)
+		}
+		n.data, n.err = data, err
+		return n.setSum(h.Sum(nil))
+	}
+
+	globals, err := inc.exec(n)
+	if sameResult(n.globals, n.err, globals, err) && n.changedAt != 0 {
+		// Retain the previous globals, which dependent
+		// modules that are not re-executed may hold.
+		return false
+	}
+	n.globals, n.err = globals, err
+	return true
+}
+
+// setSum sets the content hash of an input or source node,
+// and reports whether it differs from the previous one.
+func (n *node) setSum(sum []byte) bool {
+	changed := string(sum) != string(n.sum[:])
+	copy(n.sum[:], sum)
+	n.stale = false
+	return changed
+}
+
+// exec executes the module of node n, recording its dependencies.
+func (inc *Incremental) exec(n *node) (starlark.StringDict, error) {
+	n.deps = nil
+	src := inc.node(sourceNode, n.name)
+	if err := inc.use(n, src); err != nil {
+		return nil, err
+	}
+	if src.err != nil {
+		return nil, src.err
+	}
+
+	var thread *starlark.Thread
+	if inc.NewThread != nil {
+		thread = inc.NewThread(n.name)
+	} else {
+		thread = &starlark.Thread{Name: "exec " + n.name}
+	}
+	thread.Load = inc.Load
+	thread.LoadLazy = nil
+	thread.SetLocal(incrementalKey, &incrementalFrame{inc, n})
+
+	m := src.module
+	if m.IsCompiled() {
+		return starlark.ExecCompiled(thread, m.Data, inc.Predeclared)
+	}
+	return starlark.ExecFile(thread, m.Filename, m.Data, inc.Predeclared)
+}
+
+// sameResult reports whether two results of executing a module are equal.
+func sameResult(xglobals starlark.StringDict, xerr error, yglobals starlark.StringDict, yerr error) bool {
+	if xerr != nil || yerr != nil {
+		return xerr != nil && yerr != nil && xerr.Error() == yerr.Error()
+	}
+	if len(xglobals) != len(yglobals) {
+		return false
+	}
+	for name, x := range xglobals {
+		y, ok := yglobals[name]
+		if !ok {
+			return false
+		}
+		if eq, err := starlark.Equal(x, y); err != nil || !eq {
+			return false
+		}
+	}
+	return true
+}
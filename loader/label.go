@@ -0,0 +1,139 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader
+
+// This file defines Bazel-style labels.
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// A Label identifies a module within a multi-repository code base,
+// in the manner of Bazel. Its canonical text form is
+// "@repo//pkg:name", or "//pkg:name" in the main repository,
+// whose Repo is empty.
+type Label struct {
+	Repo string // canonical repository name
+	Pkg  string // slash-separated package path within the repository
+	Name string // slash-separated file name within the package
+}
+
+// ParseLabel parses an absolute label, one that starts with "@" or "//".
+// The repository name is used as is, without mapping.
+func ParseLabel(s string) (Label, error) {
+	if !strings.HasPrefix(s, "@") && !strings.HasPrefix(s, "//") {
+		return Label{}, fmt.Errorf("invalid label %q: not absolute", s)
+	}
+	return parseLabel(Label{}, s)
+}
+
+// String returns the canonical text form of the label.
+func (l Label) String() string {
+	if l.Repo == "" {
+		return "//" + l.Pkg + ":" + l.Name
+	}
+	return "@" + l.Repo + "//" + l.Pkg + ":" + l.Name
+}
+
+// Path returns the slash-separated path
+// of the label's file within its repository.
+func (l Label) Path() string {
+	if l.Pkg == "" {
+		return l.Name
+	}
+	return l.Pkg + "/" + l.Name
+}
+
+// parseLabel parses a label relative to the label of the calling module.
+// The forms ":name" and "name" denote a file in the caller's package,
+// "//pkg:name" a file in the caller's repository, and "@repo//pkg:name"
+// a file in another repository; "@//pkg:name" denotes the main repository.
+// If the name is omitted from "//pkg", it is the last element of pkg.
+func parseLabel(from Label, s string) (Label, error) {
+	l := from
+	rest := s
+	if strings.HasPrefix(rest, "@") {
+		i := strings.Index(rest, "//")
+		if i < 0 {
+			return Label{}, fmt.Errorf("invalid label %q: missing // after repository name", s)
+		}
+		l.Repo, rest = rest[1:i], rest[i:]
+		if strings.ContainsAny(l.Repo, "/:@") {
+			return Label{}, fmt.Errorf("invalid label %q: invalid repository name", s)
+		}
+	}
+	if strings.HasPrefix(rest, "//") {
+		rest = rest[2:]
+		if i := strings.IndexByte(rest, ':'); i >= 0 {
+			l.Pkg, l.Name = rest[:i], rest[i+1:]
+		} else {
+			l.Pkg = rest
+			l.Name = rest[strings.LastIndexByte(rest, '/')+1:]
+		}
+	} else {
+		l.Name = strings.TrimPrefix(rest, ":")
+	}
+	if l.Pkg != "" && !fs.ValidPath(l.Pkg) {
+		return Label{}, fmt.Errorf("invalid label %q: invalid package name", s)
+	}
+	if l.Name == "" || !fs.ValidPath(l.Name) {
+		return Label{}, fmt.Errorf("invalid label %q: invalid file name", s)
+	}
+	return l, nil
+}
+
+// Labels defines the interpretation of Bazel-style labels in load
+// statements. Its Canonicalize method may be used as the Canonicalize
+// field of a Loader, whose Resolver then receives canonical labels.
+type Labels struct {
+	// RepoMapping maps the canonical name of the repository of a calling
+	// module to a mapping from the repository names that appear in its
+	// labels (apparent names) to canonical names, allowing each
+	// repository to refer to its dependencies by names of its choosing.
+	// Names that are not mapped are canonical.
+	RepoMapping map[string]map[string]string
+}
+
+// Canonicalize returns the canonical form of a label appearing in the
+// module whose canonical label is from, or at top level if from is
+// empty, in which case relative labels denote files in the root package
+// of the main repository.
+func (ls *Labels) Canonicalize(from, label string) (string, error) {
+	var caller Label
+	if from != "" {
+		var err error
+		if caller, err = ParseLabel(from); err != nil {
+			return "", err
+		}
+	}
+	l, err := parseLabel(caller, label)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(label, "@") {
+		if canonical, ok := ls.RepoMapping[caller.Repo][l.Repo]; ok {
+			l.Repo = canonical
+		}
+	}
+	return l.String(), nil
+}
+
+// Resolver returns a resolver for canonical labels that resolves the
+// path of each label using the resolver for its repository.
+func (ls *Labels) Resolver(repos map[string]Resolver) Resolver {
+	return ResolverFunc(func(label string) (*Module, error) {
+		l, err := ParseLabel(label)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := repos[l.Repo]
+		if !ok {
+			return nil, &fs.PathError{Op: "resolve", Path: label, Err: fs.ErrNotExist}
+		}
+		return r.Resolve(l.Path())
+	})
+}
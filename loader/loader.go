@@ -0,0 +1,463 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package loader provides composable building blocks for the
+// implementation of Starlark's load statement.
+//
+// A Resolver maps the label of a module, the first operand of a load
+// statement, to the module's source text or compiled program. This
+// package provides resolvers for files in an operating system
+// directory (Dir), in an fs.FS such as an embed.FS (FS), and at HTTPS
+// URLs (HTTP), and a Mux that dispatches labels to other resolvers by
+// prefix, so that an application may support several label schemes.
+//
+// A Loader executes the modules found by a Resolver, caching the
+// result of each one, and its Load method may be used directly as the
+// Load hook of a starlark.Thread:
+//
+//	mux := new(loader.Mux)
+//	mux.Handle("@std/", loader.FS(stdlib))
+//	mux.Handle("https://", loader.HTTP("https://", nil))
+//	mux.Handle("", loader.Dir("."))
+//	l := &loader.Loader{Resolver: mux, Predeclared: predeclared}
+//	thread := &starlark.Thread{Load: l.Load}
+//
+// An Incremental is a loader for interactive use, such as an editor or
+// a long-running build server: it records the dependencies of each
+// module, and after a change to some of them, re-executes only the
+// modules that are affected.
+package loader // import "go.starlark.net/loader"
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"go.starlark.net/starlark"
+)
+
+// A Resolver finds the module denoted by a label.
+type Resolver interface {
+	// Resolve returns the module denoted by label. If there is no
+	// such module, the error should satisfy errors.Is(err, fs.ErrNotExist).
+	Resolve(label string) (*Module, error)
+}
+
+// A ResolverFunc is a function that implements Resolver.
+type ResolverFunc func(label string) (*Module, error)
+
+func (f ResolverFunc) Resolve(label string) (*Module, error) { return f(label) }
+
+// A Module is the content of a resolved module: either Starlark source
+// text, or a program compiled by starlark.Program.Write.
+type Module struct {
+	Filename string // file name recorded in the positions of the module's code
+	Data     []byte // source text or compiled program
+}
+
+// IsCompiled reports whether the module's data is a compiled program.
+func (m *Module) IsCompiled() bool {
+	_, err := starlark.CompiledProgramVersion(m.Data)
+	return err == nil
+}
+
+// Dir returns a resolver for the files beneath the specified directory
+// of the operating system. A label is a slash-separated path relative
+// to the directory; it may not contain ".." elements.
+func Dir(dir string) Resolver {
+	fsys := os.DirFS(dir)
+	return ResolverFunc(func(label string) (*Module, error) {
+		m, err := FS(fsys).Resolve(label)
+		if err != nil {
+			return nil, err
+		}
+		m.Filename = filepath.Join(dir, filepath.FromSlash(m.Filename))
+		return m, nil
+	})
+}
+
+// FS returns a resolver for the files of the file system fsys, such as
+// an embed.FS. A label is a slash-separated path within fsys, with an
+// optional leading slash; it may not contain ".." elements.
+func FS(fsys fs.FS) Resolver {
+	return ResolverFunc(func(label string) (*Module, error) {
+		name := strings.TrimPrefix(label, "/")
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("invalid module label %q", label)
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		return &Module{Filename: name, Data: data}, nil
+	})
+}
+
+// HTTP returns a resolver that fetches each module using an HTTP GET
+// request for the URL formed by appending the label to base, such as
+// "https://example.com/modules/". If client is nil, http.DefaultClient
+// is used. A response whose status is 404 is reported as an error
+// satisfying errors.Is(err, fs.ErrNotExist).
+func HTTP(base string, client *http.Client) Resolver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return ResolverFunc(func(label string) (*Module, error) {
+		url := base + label
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, &fs.PathError{Op: "get", Path: url, Err: fs.ErrNotExist}
+		case resp.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("get %s: %s", url, resp.Status)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %v", url, err)
+		}
+		return &Module{Filename: url, Data: data}, nil
+	})
+}
+
+// A Mux is a Resolver that dispatches each label to the resolver
+// registered for the longest prefix of the label, after removing the
+// prefix. The zero value is an empty Mux, which resolves no labels.
+type Mux struct {
+	mu       sync.RWMutex
+	prefixes []string // in decreasing order of length
+	handlers map[string]Resolver
+}
+
+// Handle registers the resolver for labels with the specified prefix.
+// The empty prefix matches every label. Handle panics if a resolver
+// is already registered for the prefix.
+func (mux *Mux) Handle(prefix string, r Resolver) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if _, ok := mux.handlers[prefix]; ok {
+		panic(fmt.Sprintf("loader: multiple registrations for prefix %q", prefix))
+	}
+	if mux.handlers == nil {
+		mux.handlers = make(map[string]Resolver)
+	}
+	mux.handlers[prefix] = r
+	mux.prefixes = append(mux.prefixes, prefix)
+	sort.SliceStable(mux.prefixes, func(i, j int) bool { return len(mux.prefixes[i]) > len(mux.prefixes[j]) })
+}
+
+// Resolve resolves the label using the resolver
+// registered for its longest matching prefix.
+func (mux *Mux) Resolve(label string) (*Module, error) {
+	mux.mu.RLock()
+	var r Resolver
+	var rest string
+	for _, prefix := range mux.prefixes {
+		if strings.HasPrefix(label, prefix) {
+			r, rest = mux.handlers[prefix], label[len(prefix):]
+			break
+		}
+	}
+	mux.mu.RUnlock()
+	if r == nil {
+		return nil, &fs.PathError{Op: "resolve", Path: label, Err: fs.ErrNotExist}
+	}
+	return r.Resolve(rest)
+}
+
+// Map returns a resolver for the modules whose source text is
+// specified by files, keyed by label, as is convenient for tests.
+func Map(files map[string]string) Resolver {
+	return ResolverFunc(func(label string) (*Module, error) {
+		src, ok := files[label]
+		if !ok {
+			return nil, &fs.PathError{Op: "resolve", Path: label, Err: fs.ErrNotExist}
+		}
+		return &Module{Filename: path.Clean(label), Data: []byte(src)}, nil
+	})
+}
+
+// Overlay returns a resolver that resolves each label in files to the
+// specified source text, and each other label using r. It allows a test
+// to inject fake modules, or replace a dependency, without touching the
+// file system.
+func Overlay(r Resolver, files map[string]string) Resolver {
+	overlay := Map(files)
+	return ResolverFunc(func(label string) (*Module, error) {
+		if _, ok := files[label]; ok {
+			return overlay.Resolve(label)
+		}
+		return r.Resolve(label)
+	})
+}
+
+// A Loader loads modules found by a Resolver, executing each one at
+// most once and caching its globals. It is safe for concurrent use,
+// and reports an error for a cycle in the load graph rather than
+// deadlocking. The zero value is not usable; Resolver must be set.
+type Loader struct {
+	// Resolver finds the module for each label.
+	Resolver Resolver
+
+	// Predeclared holds the predeclared names of every module.
+	Predeclared starlark.StringDict
+
+	// NewThread, if non-nil, returns the thread in which to execute the
+	// module of the specified label, allowing the application to set
+	// its Print function and so on. Its Load and LoadLazy fields are
+	// ignored.
+	NewThread func(label string) *starlark.Thread
+
+	// Canonicalize, if non-nil, returns the canonical form of a label
+	// appearing in the module whose canonical label is from, or in code
+	// not loaded by this Loader if from is empty. Modules are cached,
+	// and resolved, by canonical label. See Labels.Canonicalize.
+	Canonicalize func(from, label string) (string, error)
+
+	// Visibility, if non-nil, is called for each load statement
+	// executed by a module, or by code not loaded by this Loader, with
+	// the canonical labels of the loading module (or "") and of the
+	// module to be loaded. If it returns an error, the load fails,
+	// allowing the application to enforce layering rules, such as that
+	// product configurations may not load internal macros. The check
+	// precedes the cache, so it applies to every load statement.
+	Visibility func(from, to string) error
+
+	// Lazy causes the load statements of modules executed by the Loader
+	// to defer loading until one of the names they bind is first used.
+	// (To make the load statements of a top-level module lazy, set the
+	// LoadLazy field of its thread to the Loader's LoadLazy method.)
+	Lazy bool
+
+	// AllowCycles causes the load statements of modules executed by the
+	// Loader to tolerate cycles in the load graph. A load statement that
+	// would complete a cycle binds its names lazily, as if by Lazy, so
+	// that an error is reported only if one of them is used before the
+	// module that defines it has been initialized, typically by the
+	// top-level statements of a module in the cycle. Other load
+	// statements are executed as usual. Lazy loading implies AllowCycles.
+	AllowCycles bool
+
+	mu    sync.Mutex
+	cache map[string]*entry
+	edges map[edgeKey]Edge // see Graph
+}
+
+type entry struct {
+	owner   unsafe.Pointer // a *cycleChecker; see cycleCheck
+	globals starlark.StringDict
+	err     error
+	ready   chan struct{}
+}
+
+// Thread-local keys of the state of a module's thread:
+// the cycleChecker it uses for the modules it loads,
+// and the module's canonical label.
+const (
+	cycleCheckerKey = "go.starlark.net/loader.cycleChecker"
+	labelKey        = "go.starlark.net/loader.label"
+)
+
+// Load returns the globals of the module of the specified label,
+// executing it if necessary. Its signature is that of the Load hook of
+// starlark.Thread.
+func (l *Loader) Load(thread *starlark.Thread, label string) (starlark.StringDict, error) {
+	label, err := l.canonicalize(thread, label)
+	if err != nil {
+		return nil, err
+	}
+	return l.load(thread, label)
+}
+
+// LoadLazy returns a function that loads the module of the specified
+// label. Its signature is that of the LoadLazy hook of starlark.Thread.
+// The label is canonicalized immediately, relative to the module
+// executing the load statement.
+func (l *Loader) LoadLazy(thread *starlark.Thread, label string) (func(*starlark.Thread) (starlark.StringDict, error), error) {
+	label, err := l.canonicalize(thread, label)
+	if err != nil {
+		return nil, err
+	}
+	return func(thread *starlark.Thread) (starlark.StringDict, error) {
+		return l.load(thread, label)
+	}, nil
+}
+
+// loadAllowingCycles is the LoadLazy hook of modules executed by a
+// Loader that allows cycles. It loads the module immediately, unless
+// the load would complete a cycle, in which case loading is deferred.
+func (l *Loader) loadAllowingCycles(thread *starlark.Thread, label string) (func(*starlark.Thread) (starlark.StringDict, error), error) {
+	label, err := l.canonicalize(thread, label)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, _ := thread.Local(cycleCheckerKey).(*cycleChecker)
+	l.mu.Lock()
+	e := l.cache[label]
+	l.mu.Unlock()
+	if e != nil && cc != nil && cycleCheck(e, cc) != nil {
+		return func(thread *starlark.Thread) (starlark.StringDict, error) {
+			return l.load(thread, label)
+		}, nil
+	}
+
+	globals, err := l.load(thread, label)
+	if err != nil {
+		return nil, err
+	}
+	return func(*starlark.Thread) (starlark.StringDict, error) { return globals, nil }, nil
+}
+
+// canonicalize returns the canonical form of a label appearing in the
+// module executed by thread, after checking that the load is permitted.
+func (l *Loader) canonicalize(thread *starlark.Thread, label string) (string, error) {
+	from, _ := thread.Local(labelKey).(string)
+	if l.Canonicalize != nil {
+		var err error
+		if label, err = l.Canonicalize(from, label); err != nil {
+			return "", err
+		}
+	}
+	if l.Visibility != nil {
+		if err := l.Visibility(from, label); err != nil {
+			return "", err
+		}
+	}
+	l.recordEdge(thread, from, label)
+	return label, nil
+}
+
+// load returns the globals of the module of the specified canonical
+// label, executing it if necessary.
+func (l *Loader) load(thread *starlark.Thread, label string) (starlark.StringDict, error) {
+	cc, _ := thread.Local(cycleCheckerKey).(*cycleChecker)
+	if cc == nil {
+		cc = new(cycleChecker)
+	}
+
+	l.mu.Lock()
+	if l.cache == nil {
+		l.cache = make(map[string]*entry)
+	}
+	e := l.cache[label]
+	if e != nil {
+		l.mu.Unlock()
+		starlark.CountMetric(starlark.MetricLoadCacheHits, 1)
+		// Some other goroutine is loading this module.
+		// Wait for it to become ready.
+
+		// Detect load cycles to avoid deadlocks.
+		if err := cycleCheck(e, cc); err != nil {
+			return nil, err
+		}
+
+		cc.setWaitsFor(e)
+		<-e.ready
+		cc.setWaitsFor(nil)
+	} else {
+		// First request for this module.
+		e = &entry{ready: make(chan struct{})}
+		l.cache[label] = e
+		l.mu.Unlock()
+		starlark.CountMetric(starlark.MetricLoadCacheMisses, 1)
+
+		e.setOwner(cc)
+		e.globals, e.err = l.exec(cc, label)
+		e.setOwner(nil)
+
+		// Broadcast that the entry is now ready.
+		close(e.ready)
+	}
+	return e.globals, e.err
+}
+
+// exec resolves and executes the module of the specified label.
+func (l *Loader) exec(cc *cycleChecker, label string) (starlark.StringDict, error) {
+	m, err := l.Resolver.Resolve(label)
+	if err != nil {
+		return nil, err
+	}
+
+	var thread *starlark.Thread
+	if l.NewThread != nil {
+		thread = l.NewThread(label)
+	} else {
+		thread = &starlark.Thread{Name: "exec " + label}
+	}
+	thread.Load = l.Load
+	switch {
+	case l.Lazy:
+		thread.LoadLazy = l.LoadLazy
+	case l.AllowCycles:
+		thread.LoadLazy = l.loadAllowingCycles
+	default:
+		thread.LoadLazy = nil
+	}
+	// Tunnel the cycle-checker state for this "thread of loading".
+	thread.SetLocal(cycleCheckerKey, cc)
+	thread.SetLocal(labelKey, label)
+
+	if m.IsCompiled() {
+		return starlark.ExecCompiled(thread, m.Data, l.Predeclared)
+	}
+	return starlark.ExecFile(thread, m.Filename, m.Data, l.Predeclared)
+}
+
+// -- concurrent cycle checking --
+
+// A cycleChecker is used for concurrent deadlock detection.
+// Each top-level call to Load creates its own cycleChecker,
+// which is passed to all recursive calls it makes.
+// It corresponds to a logical thread in the deadlock detection literature.
+type cycleChecker struct {
+	waitsFor unsafe.Pointer // an *entry; see cycleCheck
+}
+
+func (cc *cycleChecker) setWaitsFor(e *entry) {
+	atomic.StorePointer(&cc.waitsFor, unsafe.Pointer(e))
+}
+
+func (e *entry) setOwner(cc *cycleChecker) {
+	atomic.StorePointer(&e.owner, unsafe.Pointer(cc))
+}
+
+// cycleCheck reports whether there is a path in the waits-for graph
+// from resource 'e' to thread 'me'.
+//
+// The waits-for graph (WFG) is a bipartite graph whose nodes are
+// alternately of type entry and cycleChecker.  Each node has at most
+// one outgoing edge.  An entry has an "owner" edge to a cycleChecker
+// while it is being readied by that cycleChecker, and a cycleChecker
+// has a "waits-for" edge to an entry while it is waiting for that entry
+// to become ready.
+//
+// Before adding a waits-for edge, the cache checks whether the new edge
+// would form a cycle.  If so, this indicates that the load graph is
+// cyclic and that the following wait operation would deadlock.
+func cycleCheck(e *entry, me *cycleChecker) error {
+	for e != nil {
+		cc := (*cycleChecker)(atomic.LoadPointer(&e.owner))
+		if cc == nil {
+			break
+		}
+		if cc == me {
+			return fmt.Errorf("cycle in load graph")
+		}
+		e = (*entry)(atomic.LoadPointer(&cc.waitsFor))
+	}
+	return nil
+}
@@ -0,0 +1,702 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"go.starlark.net/loader"
+	"go.starlark.net/starlark"
+)
+
+func TestResolvers(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.star"), []byte("a = 1"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{"lib/b.star": {Data: []byte("b = 2")}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/c.star":
+			fmt.Fprint(w, "c = 3")
+		case "/broken.star":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	mux := new(loader.Mux)
+	mux.Handle("", loader.Dir(dir))
+	mux.Handle("@lib//", loader.FS(fsys))
+	mux.Handle("http://", loader.HTTP(srv.URL+"/", srv.Client()))
+
+	for _, test := range []struct {
+		label, filename, data, err string
+	}{
+		{label: "a.star", filename: filepath.Join(dir, "a.star"), data: "a = 1"},
+		{label: "@lib//lib/b.star", filename: "lib/b.star", data: "b = 2"},
+		{label: "http://c.star", filename: srv.URL + "/c.star", data: "c = 3"},
+		{label: "../a.star", err: `invalid module label "../a.star"`},
+		{label: "missing.star", err: "not exist"},
+		{label: "@lib//missing.star", err: "not exist"},
+		{label: "http://missing.star", err: "not exist"},
+		{label: "http://broken.star", err: "500 Internal Server Error"},
+	} {
+		m, err := mux.Resolve(test.label)
+		if err != nil {
+			if test.err == "not exist" {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Resolve(%q) error %v does not satisfy errors.Is(err, fs.ErrNotExist)", test.label, err)
+				}
+			} else if test.err == "" || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Resolve(%q) failed: %v", test.label, err)
+			}
+			continue
+		}
+		if test.err != "" {
+			t.Errorf("Resolve(%q) succeeded, want error containing %q", test.label, test.err)
+		} else if m.Filename != test.filename || string(m.Data) != test.data {
+			t.Errorf("Resolve(%q) = {%q, %q}, want {%q, %q}", test.label, m.Filename, m.Data, test.filename, test.data)
+		}
+	}
+
+	// An empty Mux resolves no labels.
+	if _, err := new(loader.Mux).Resolve("a.star"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("empty Mux: got %v, want not-exist error", err)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	_, prog, err := starlark.SourceProgram("compiled.star", "compiled = 'yes'", func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compiled bytes.Buffer
+	if err := prog.Write(&compiled); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var execs []string
+	l := &loader.Loader{
+		Resolver: loader.ResolverFunc(func(label string) (*loader.Module, error) {
+			if label == "compiled.star" {
+				return &loader.Module{Filename: label, Data: compiled.Bytes()}, nil
+			}
+			return loader.Map(map[string]string{
+				"a.star":      "load('b.star', 'b'); load('c.star', 'c'); a = b + c + x",
+				"b.star":      "load('c.star', 'c'); b = c * 2",
+				"c.star":      "c = 1",
+				"cycle1.star": "load('cycle2.star', 'y')",
+				"cycle2.star": "load('cycle1.star', 'y')",
+				"error.star":  "1 // 0",
+			}).Resolve(label)
+		}),
+		Predeclared: starlark.StringDict{"x": starlark.MakeInt(100)},
+		NewThread: func(label string) *starlark.Thread {
+			mu.Lock()
+			execs = append(execs, label)
+			mu.Unlock()
+			return &starlark.Thread{Name: label}
+		},
+	}
+
+	// Load the same modules concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			thread := &starlark.Thread{Load: l.Load}
+			globals, err := l.Load(thread, "a.star")
+			if err != nil {
+				t.Error(err)
+			} else if got := globals["a"].String(); got != "103" {
+				t.Errorf("a = %s, want 103", got)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(execs) != 3 {
+		t.Errorf("executed modules %v, want each of a, b, c once", execs)
+	}
+
+	thread := &starlark.Thread{Load: l.Load}
+	for _, test := range []struct{ label, want string }{
+		{"compiled.star", "compiled"},
+		{"cycle1.star", "cycle in load graph"},
+		{"error.star", "floored division by zero"},
+		{"missing.star", "resolve missing.star: file does not exist"},
+	} {
+		globals, err := l.Load(thread, test.label)
+		var got string
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = fmt.Sprint(globals.Keys())
+		}
+		if !strings.Contains(got, test.want) {
+			t.Errorf("Load(%q) = %s, want %s", test.label, got, test.want)
+		}
+	}
+}
+
+func TestLockfile(t *testing.T) {
+	files := map[string]string{"a.star": "a = 1", "b.star": "b = 2"}
+	r := loader.Map(files)
+
+	// In update mode, unpinned modules are recorded.
+	lf, err := loader.ParseLockfile([]byte("# comment\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.Update = true
+	for _, label := range []string{"b.star", "a.star"} {
+		if _, err := lf.Verify(r).Resolve(label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := lf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	const want = "a.star sha256:b5bc1ffd90912fb18bef6e7d80909192c7a6492896320156d67fbaf104c6544a\n" +
+		"b.star sha256:f74f51ca02a3709d12a81f18f276abaab20f5f50a0e8144cbf9d0004e4af3eda\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("lockfile = %q, want %q", got, want)
+	}
+
+	// Otherwise, unpinned or modified modules are refused.
+	lf, err = loader.ParseLockfile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["b.star"] = "b = 3"
+	files["c.star"] = "c = 4"
+	for _, test := range []struct{ label, want string }{
+		{"a.star", ""},
+		{"b.star", "module b.star has checksum sha256:"},
+		{"c.star", "module c.star is not pinned by the lockfile"},
+	} {
+		_, err := lf.Verify(r).Resolve(test.label)
+		if got := fmt.Sprint(err); test.want == "" && err != nil || test.want != "" && !strings.HasPrefix(got, test.want) {
+			t.Errorf("Resolve(%q) = %v, want %q", test.label, err, test.want)
+		}
+	}
+
+	for _, test := range []struct{ data, want string }{
+		{"a.star", "lockfile:1: want <name> sha256:<hex>"},
+		{"a.star sha256:xyz", `lockfile:1: invalid checksum "sha256:xyz"`},
+		{"\n" + strings.Repeat("a.star sha256:"+strings.Repeat("0", 64)+"\n", 2), "lockfile:3: duplicate entry for a.star"},
+	} {
+		if _, err := loader.ParseLockfile([]byte(test.data)); fmt.Sprint(err) != test.want {
+			t.Errorf("ParseLockfile(%q) = %v, want %s", test.data, err, test.want)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	labels := &loader.Labels{
+		RepoMapping: map[string]map[string]string{
+			"":      {"lib": "lib~1.0"},
+			"other": {"lib": "lib~2.0"},
+		},
+	}
+	for _, test := range []struct{ from, label, want string }{
+		{"", "a.star", "//:a.star"},
+		{"", "//pkg:a.star", "//pkg:a.star"},
+		{"", "@lib//x:y.star", "@lib~1.0//x:y.star"},
+		{"", "@//pkg:a.star", "//pkg:a.star"},
+		{"", "//pkg/sub", "//pkg/sub:sub"},
+		{"//pkg:a.star", ":b.star", "//pkg:b.star"},
+		{"//pkg:a.star", "sub/b.star", "//pkg:sub/b.star"},
+		{"@other//pkg:a.star", "//x:b.star", "@other//x:b.star"},
+		{"@other//pkg:a.star", "@lib//x:y.star", "@lib~2.0//x:y.star"},
+		{"@other//pkg:a.star", "@unmapped//x:y.star", "@unmapped//x:y.star"},
+		{"", "@lib", `invalid label "@lib": missing // after repository name`},
+		{"", "//../x:y.star", `invalid label "//../x:y.star": invalid package name`},
+		{"", "//x:", `invalid label "//x:": invalid file name`},
+		{"a.star", "b.star", `invalid label "a.star": not absolute`},
+	} {
+		got, err := labels.Canonicalize(test.from, test.label)
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("Canonicalize(%q, %q) = %s, want %s", test.from, test.label, got, test.want)
+		}
+	}
+
+	l := &loader.Loader{
+		Resolver: labels.Resolver(map[string]loader.Resolver{
+			"": loader.Map(map[string]string{
+				"pkg/main.star":   "load('helper.star', 'h'); load('@lib//:lib.star', 'lib'); main = h + lib",
+				"pkg/helper.star": "h = 'helper '",
+			}),
+			"lib~1.0": loader.Map(map[string]string{
+				"lib.star":           "load('//internal:impl.star', 'impl'); lib = impl",
+				"internal/impl.star": "impl = 'lib 1.0'",
+			}),
+		}),
+		Canonicalize: labels.Canonicalize,
+	}
+	globals, err := l.Load(&starlark.Thread{}, "//pkg:main.star")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["main"], starlark.String("helper lib 1.0"); got != want {
+		t.Errorf("main = %s, want %s", got, want)
+	}
+	if _, err := l.Load(&starlark.Thread{}, "@nonesuch//:x.star"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load of unknown repository: got %v, want not-exist error", err)
+	}
+}
+
+func TestLazy(t *testing.T) {
+	var execs []string
+	l := &loader.Loader{
+		Resolver: loader.Map(map[string]string{
+			"//pkg:main.star":   "load(':used.star', 'u'); load(':unused.star', 'v'); main = u",
+			"//pkg:used.star":   "u = 'used'",
+			"//pkg:unused.star": "fail('unused module executed')",
+		}),
+		Canonicalize: new(loader.Labels).Canonicalize,
+		Lazy:         true,
+		NewThread: func(label string) *starlark.Thread {
+			execs = append(execs, label)
+			return new(starlark.Thread)
+		},
+	}
+	globals, err := l.Load(new(starlark.Thread), "//pkg:main.star")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(globals["main"], execs); got != `"used"[//pkg:main.star //pkg:used.star]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestAllowCycles(t *testing.T) {
+	l := &loader.Loader{
+		Resolver: loader.Map(map[string]string{
+			// f and g refer to each other only within functions.
+			"f.star": `
+load("g.star", "g")
+def f():
+    return g() + 1
+def one():
+    return 1
+`,
+			"g.star": `
+load("f.star", "one")
+def g():
+    return one() + 1
+`,
+			// a uses a value of b, which uses a value of a, during initialization.
+			"a.star": "load('b.star', 'b'); a = b",
+			"b.star": "load('a.star', 'a'); b = a",
+		}),
+		AllowCycles: true,
+	}
+	thread := new(starlark.Thread)
+	globals, err := l.Load(thread, "f.star")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := starlark.Call(thread, globals["f"], nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != starlark.MakeInt(3) {
+		t.Errorf("f() = %v, want 3", v)
+	}
+
+	if _, err := l.Load(thread, "a.star"); err == nil || !strings.Contains(err.Error(), "cannot load a.star: cycle in load graph") {
+		t.Errorf("cyclic use during initialization: got %v, want cycle error", err)
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	labels := new(loader.Labels)
+	var checks []string
+	l := &loader.Loader{
+		Resolver: labels.Resolver(map[string]loader.Resolver{
+			"": loader.Map(map[string]string{
+				"product/config.star":    "load('//lib:macros.star', 'm'); config = m",
+				"product/bad.star":       "load('//lib/internal:impl.star', 'impl')",
+				"lib/macros.star":        "load('//lib/internal:impl.star', 'impl'); m = impl",
+				"lib/internal/impl.star": "impl = 'impl'",
+			}),
+		}),
+		Canonicalize: labels.Canonicalize,
+		Visibility: func(from, to string) error {
+			checks = append(checks, from+" -> "+to)
+			if strings.HasPrefix(to, "//lib/internal:") && !strings.HasPrefix(from, "//lib:") {
+				return fmt.Errorf("%s is not visible to %s", to, from)
+			}
+			return nil
+		},
+	}
+	thread := &starlark.Thread{Load: l.Load}
+	if _, err := starlark.ExecFile(thread, "main.star", "load('//product:config.star', 'config')", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := starlark.ExecFile(thread, "main.star", "load('//product:bad.star', 'impl')", nil)
+	const want = "cannot load //lib/internal:impl.star: //lib/internal:impl.star is not visible to //product:bad.star"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+	if got := strings.Join(checks, "\n"); !strings.HasPrefix(got, ` -> //product:config.star
+//product:config.star -> //lib:macros.star
+//lib:macros.star -> //lib/internal:impl.star
+ -> //product:bad.star`) {
+		t.Errorf("checks:\n%s", got)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	cache := &loader.DiskCache{Dir: t.TempDir()}
+	var fetches int
+	remote := loader.ResolverFunc(func(label string) (*loader.Module, error) {
+		fetches++
+		return loader.Map(map[string]string{"m.star": "x = 1 + y"}).Resolve(label)
+	})
+	predeclared := starlark.StringDict{"y": starlark.MakeInt(2)}
+
+	// Sources are fetched once, and compiled once, even by
+	// another DiskCache for the same directory.
+	for i := 0; i < 2; i++ {
+		c := &loader.DiskCache{Dir: cache.Dir}
+		r := c.Compiled(c.Sources(remote), predeclared)
+		m, err := r.Resolve("m.star")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.IsCompiled() || m.Filename != "m.star" {
+			t.Fatalf("Resolve returned %s (compiled=%t)", m.Filename, m.IsCompiled())
+		}
+		globals, err := starlark.ExecCompiled(new(starlark.Thread), m.Data, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if globals["x"] != starlark.MakeInt(3) {
+			t.Errorf("x = %v, want 3", globals["x"])
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("%d fetches, want 1", fetches)
+	}
+	if _, err := cache.Sources(remote).Resolve("missing.star"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing module: got %v", err)
+	}
+
+	// Sources expire after MaxAge.
+	cache.MaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := cache.Sources(remote).Resolve("m.star"); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 3 {
+		t.Errorf("%d fetches, want 3", fetches)
+	}
+
+	// Invalid sources are returned uncompiled.
+	bad := loader.Map(map[string]string{"bad.star": "x = "})
+	if m, err := cache.Compiled(bad, nil).Resolve("bad.star"); err != nil || m.IsCompiled() {
+		t.Errorf("invalid source: got %v, %v", m, err)
+	}
+
+	// GC by size removes all data; the sources are then fetched again.
+	if err := cache.GC(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	cache.MaxAge = 0
+	if _, err := cache.Sources(remote).Resolve("m.star"); err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 4 {
+		t.Errorf("after GC, %d fetches, want 4", fetches)
+	}
+
+	// GC by age removes everything.
+	time.Sleep(time.Millisecond)
+	if err := cache.GC(time.Nanosecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	filepath.WalkDir(cache.Dir, func(path string, d fs.DirEntry, err error) error {
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) > 0 {
+		t.Errorf("after GC, files remain: %s", files)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"main.star":  "load('dep.star', 'dep'); load('other.star', 'other'); main = dep + other",
+		"dep.star":   "dep = 'real '",
+		"other.star": "other = 'other'",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := &loader.Loader{
+		Resolver: loader.Overlay(loader.Dir(dir), map[string]string{
+			"dep.star":  "dep = 'fake '",
+			"fake.star": "fake = True",
+		}),
+	}
+	thread := new(starlark.Thread)
+	globals, err := l.Load(thread, "main.star")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["main"], starlark.String("fake other"); got != want {
+		t.Errorf("main = %s, want %s", got, want)
+	}
+	if _, err := l.Load(thread, "fake.star"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "fake.star")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("overlay touched the file system: %v", err)
+	}
+}
+
+func TestFromFS(t *testing.T) {
+	stdlib := os.DirFS("testdata/stdlib")
+	l := loader.FromFS(stdlib)
+	thread := &starlark.Thread{Load: l.Load}
+	globals, err := starlark.ExecFile(thread, "main.star", `
+load("greet.star", "greet", "same")
+load("strings", "shout")
+msg = greet("world")
+ok = same
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(globals["msg"], " ", globals["ok"]); got != `"HELLO WORLD!" True` {
+		t.Errorf("got %s", got)
+	}
+
+	if _, err := l.Load(thread, "../x.star"); fmt.Sprint(err) != `invalid module label "../x.star"` {
+		t.Errorf("Load of label outside file system: got %v", err)
+	}
+	if _, err := l.Load(thread, "nonesuch.star"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load of missing module: got %v, want not-exist error", err)
+	}
+
+	labels, err := loader.Modules(stdlib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(labels), "[greet.star strings strings/__init__.star strings/impl.star]"; got != want {
+		t.Errorf("Modules = %s, want %s", got, want)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	l := &loader.Loader{
+		Resolver: loader.Map(map[string]string{
+			"a.star": "load('b.star', 'b')\nload('c.star', 'c')\na = b + c",
+			"b.star": "load('c.star', 'c')\nb = c",
+			"c.star": "c = 1",
+			"d.star": "d = 1",
+		}),
+	}
+	thread := &starlark.Thread{Load: l.Load}
+	for i := 0; i < 2; i++ {
+		if _, err := starlark.ExecFile(thread, "main.star", "load('a.star', 'a')\nload('d.star', 'd')", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g := l.Graph()
+	for _, test := range []struct{ got, want string }{
+		{fmt.Sprint(g.Modules()), "[a.star b.star c.star d.star main.star]"},
+		{fmt.Sprint(g.Deps("a.star")), "[b.star c.star]"},
+		{fmt.Sprint(g.Rdeps("c.star")), "[a.star b.star main.star]"},
+		{fmt.Sprint(g.Rdeps("d.star", "b.star")), "[a.star main.star]"},
+	} {
+		if test.got != test.want {
+			t.Errorf("got %s, want %s", test.got, test.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := g.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	const wantDOT = `digraph modules {
+	"a.star" -> "b.star" [label="a.star:1:1"];
+	"a.star" -> "c.star" [label="a.star:2:1"];
+	"b.star" -> "c.star" [label="b.star:1:1"];
+	"main.star" -> "a.star" [label="main.star:1:1"];
+	"main.star" -> "d.star" [label="main.star:2:1"];
+}
+`
+	if got := buf.String(); got != wantDOT {
+		t.Errorf("DOT:\n%s\nwant:\n%s", got, wantDOT)
+	}
+
+	buf.Reset()
+	if err := g.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	const wantJSON = `{"modules":["a.star","b.star","c.star","d.star","main.star"],"edges":[` +
+		`{"from":"a.star","to":"b.star","pos":"a.star:1:1"},` +
+		`{"from":"a.star","to":"c.star","pos":"a.star:2:1"},` +
+		`{"from":"b.star","to":"c.star","pos":"b.star:1:1"},` +
+		`{"from":"main.star","to":"a.star","pos":"main.star:1:1"},` +
+		`{"from":"main.star","to":"d.star","pos":"main.star:2:1"}]}` + "\n"
+	if got := buf.String(); got != wantJSON {
+		t.Errorf("JSON:\n%s\nwant:\n%s", got, wantJSON)
+	}
+}
+
+// cacheCounter is a MetricsSink that counts load cache hits and misses.
+type cacheCounter struct{ hits, misses int64 }
+
+func (c *cacheCounter) Count(name string, delta int64) {
+	switch name {
+	case starlark.MetricLoadCacheHits:
+		c.hits += delta
+	case starlark.MetricLoadCacheMisses:
+		c.misses += delta
+	}
+}
+
+func (c *cacheCounter) Observe(name string, value float64) {}
+
+func TestCacheMetrics(t *testing.T) {
+	c := new(cacheCounter)
+	starlark.SetMetricsSink(c)
+	defer starlark.SetMetricsSink(nil)
+
+	l := &loader.Loader{Resolver: loader.Map(map[string]string{
+		"a.star": `load("c.star", "c"); a = c`,
+		"b.star": `load("c.star", "c"); b = c`,
+		"c.star": `c = 1`,
+	})}
+	for _, label := range []string{"a.star", "b.star", "a.star"} {
+		if _, err := l.Load(new(starlark.Thread), label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.hits != 2 || c.misses != 3 {
+		t.Errorf("got %d hits and %d misses, want 2 and 3", c.hits, c.misses)
+	}
+}
+
+func TestIncremental(t *testing.T) {
+	files := map[string]string{
+		"a.star":      "load('b.star', 'b'); load('d.star', 'd'); a = b + d",
+		"b.star":      "load('c.star', 'c'); b = c * 2",
+		"c.star":      "c = 1",
+		"d.star":      "d = len(read('data.txt'))",
+		"cycle1.star": "load('cycle2.star', 'y')",
+		"cycle2.star": "load('cycle1.star', 'y')",
+	}
+	inputs := map[string]string{"data.txt": "hello"}
+	var execs []string
+	inc := &loader.Incremental{
+		Resolver: loader.ResolverFunc(func(label string) (*loader.Module, error) {
+			return loader.Map(files).Resolve(label)
+		}),
+		ReadInput: func(name string) ([]byte, error) {
+			data, ok := inputs[name]
+			if !ok {
+				return nil, fmt.Errorf("no input %s", name)
+			}
+			return []byte(data), nil
+		},
+		NewThread: func(label string) *starlark.Thread {
+			execs = append(execs, label)
+			return &starlark.Thread{Name: label}
+		},
+	}
+	inc.Predeclared = starlark.StringDict{
+		"read": starlark.NewBuiltin("read", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+				return nil, err
+			}
+			data, err := inc.Input(thread, name)
+			if err != nil {
+				return nil, err
+			}
+			return starlark.String(data), nil
+		}),
+	}
+
+	thread := &starlark.Thread{Load: inc.Load}
+	for i, test := range []struct {
+		changes   map[string]string // files or inputs changed before the load
+		want      string            // value of a, or error
+		wantExecs string
+	}{
+		{want: "7", wantExecs: "a.star b.star c.star d.star"},
+		{want: "7", wantExecs: ""},
+		{changes: map[string]string{"c.star": "c = 1"}, want: "7", wantExecs: ""},
+		// c changes, but its globals do not.
+		{changes: map[string]string{"c.star": "c = 2 - 1"}, want: "7", wantExecs: "c.star"},
+		{changes: map[string]string{"c.star": "c = 3"}, want: "11", wantExecs: "c.star b.star a.star"},
+		{changes: map[string]string{"data.txt": "hi"}, want: "8", wantExecs: "d.star a.star"},
+		{changes: map[string]string{"c.star": "c = 1 // 0"}, want: "floored division by zero", wantExecs: "c.star b.star a.star"},
+		// a no longer depends on d, having failed before loading it.
+		{changes: map[string]string{"data.txt": "hello"}, want: "floored division by zero", wantExecs: ""},
+		{changes: map[string]string{"c.star": "c = 1"}, want: "7", wantExecs: "c.star b.star a.star d.star"},
+	} {
+		var names []string
+		for name, content := range test.changes {
+			if _, ok := files[name]; ok {
+				files[name] = content
+			} else {
+				inputs[name] = content
+			}
+			names = append(names, name)
+		}
+		inc.Invalidate(names...)
+
+		execs = nil
+		globals, err := inc.Load(thread, "a.star")
+		var got string
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = globals["a"].String()
+		}
+		if !strings.Contains(got, test.want) {
+			t.Errorf("#%d: a = %s, want %s", i, got, test.want)
+		}
+		if got := strings.Join(execs, " "); got != test.wantExecs {
+			t.Errorf("#%d: executed modules [%s], want [%s]", i, got, test.wantExecs)
+		}
+	}
+
+	if _, err := inc.Load(thread, "cycle1.star"); err == nil || !strings.Contains(err.Error(), "cycle in load graph") {
+		t.Errorf("Load(cycle1.star) = %v, want cycle error", err)
+	}
+}
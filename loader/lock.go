@@ -0,0 +1,128 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader
+
+// This file defines checksum pinning of modules via a lockfile.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Lockfile records the expected SHA-256 checksum of each module,
+// keyed by its Filename, such as the URL from which it was fetched.
+// Its Verify method wraps a Resolver so that it refuses modules whose
+// content is unpinned or does not match, protecting an application
+// that loads remote modules against unexpected changes to them.
+//
+// The text form of a lockfile, read by ParseLockfile and written by
+// WriteTo, has one line per module, of the form
+//
+//	https://example.com/lib.star sha256:3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7
+//
+// in increasing order of name. Blank lines and lines starting with
+// '#' are ignored.
+type Lockfile struct {
+	// Update causes Verify to record the checksum of each unpinned or
+	// mismatching module instead of reporting an error, so that the
+	// lockfile may be written afterwards.
+	Update bool
+
+	mu   sync.Mutex
+	sums map[string]string // maps name to hex-encoded SHA-256
+}
+
+// ParseLockfile parses the text form of a lockfile.
+func ParseLockfile(data []byte) (*Lockfile, error) {
+	lf := &Lockfile{sums: make(map[string]string)}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "sha256:") {
+			return nil, fmt.Errorf("lockfile:%d: want <name> sha256:<hex>", line)
+		}
+		sum := strings.TrimPrefix(fields[1], "sha256:")
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("lockfile:%d: invalid checksum %q", line, fields[1])
+		}
+		if _, ok := lf.sums[fields[0]]; ok {
+			return nil, fmt.Errorf("lockfile:%d: duplicate entry for %s", line, fields[0])
+		}
+		lf.sums[fields[0]] = strings.ToLower(sum)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// WriteTo writes the text form of the lockfile to w.
+func (lf *Lockfile) WriteTo(w io.Writer) (int64, error) {
+	lf.mu.Lock()
+	names := make([]string, 0, len(lf.sums))
+	for name := range lf.sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s sha256:%s\n", name, lf.sums[name])
+	}
+	lf.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+// Sum returns the hex-encoded SHA-256 checksum
+// pinned for the named module, if any.
+func (lf *Lockfile) Sum(name string) (string, bool) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	sum, ok := lf.sums[name]
+	return sum, ok
+}
+
+// Verify returns a resolver that resolves labels using r, and checks
+// the content of each module against the checksum pinned for its
+// Filename. Unless Update is set, it reports an error for a module
+// that is unpinned or whose checksum does not match.
+func (lf *Lockfile) Verify(r Resolver) Resolver {
+	return ResolverFunc(func(label string) (*Module, error) {
+		m, err := r.Resolve(label)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.Sum256(m.Data)
+		got := hex.EncodeToString(h[:])
+
+		lf.mu.Lock()
+		defer lf.mu.Unlock()
+		want, ok := lf.sums[m.Filename]
+		switch {
+		case ok && want == got:
+			return m, nil
+		case lf.Update:
+			if lf.sums == nil {
+				lf.sums = make(map[string]string)
+			}
+			lf.sums[m.Filename] = got
+			return m, nil
+		case !ok:
+			return nil, fmt.Errorf("module %s is not pinned by the lockfile (sha256:%s)", m.Filename, got)
+		default:
+			return nil, fmt.Errorf("module %s has checksum sha256:%s, but the lockfile requires sha256:%s", m.Filename, got, want)
+		}
+	})
+}
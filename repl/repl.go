@@ -18,6 +18,7 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"sync"
 
 	"github.com/chzyer/readline"
 	"go.starlark.net/resolve"
@@ -25,7 +26,50 @@ import (
 	"go.starlark.net/syntax"
 )
 
-var interrupted = make(chan os.Signal, 1)
+// interrupts records the SIGINT channel of the innermost active REPL.
+// A REPL started at a breakpoint within another takes over SIGINT for
+// its duration and hands it back to the outer one when it exits.
+var interrupts struct {
+	mu      sync.Mutex
+	current chan os.Signal
+}
+
+// notifyInterrupts directs SIGINT to a new channel, which it returns,
+// and a function that restores the previous channel.
+func notifyInterrupts() (chan os.Signal, func()) {
+	interrupted := make(chan os.Signal, 1)
+
+	interrupts.mu.Lock()
+	defer interrupts.mu.Unlock()
+	outer := interrupts.current
+	if outer != nil {
+		signal.Stop(outer)
+	}
+	signal.Notify(interrupted, os.Interrupt)
+	interrupts.current = interrupted
+
+	return interrupted, func() {
+		interrupts.mu.Lock()
+		defer interrupts.mu.Unlock()
+		signal.Stop(interrupted)
+		interrupts.current = outer
+		if outer != nil {
+			signal.Notify(outer, os.Interrupt)
+		}
+	}
+}
+
+// newReadline returns the line reader of a REPL.
+// Tests replace it to supply input.
+var newReadline = func() (*readline.Instance, error) { return readline.New(">>> ") }
+
+// PrettyOptions controls the formatting of expression values printed
+// by the REPL, unless the thread specifies its own PrettyOptions.
+var PrettyOptions = starlark.PrettyOptions{
+	MaxDepth: 16,
+	MaxElems: 100,
+	Width:    80,
+}
 
 // REPL executes a read, eval, print loop.
 //
@@ -35,17 +79,17 @@ var interrupted = make(chan os.Signal, 1)
 // context to make long-running operations interruptable.
 //
 func REPL(thread *starlark.Thread, globals starlark.StringDict) {
-	signal.Notify(interrupted, os.Interrupt)
-	defer signal.Stop(interrupted)
+	interrupted, restore := notifyInterrupts()
+	defer restore()
 
-	rl, err := readline.New(">>> ")
+	rl, err := newReadline()
 	if err != nil {
 		PrintError(err)
 		return
 	}
 	defer rl.Close()
 	for {
-		if err := rep(rl, thread, globals); err != nil {
+		if err := rep(rl, interrupted, thread, globals); err != nil {
 			if err == readline.ErrInterrupt {
 				fmt.Println(err)
 				continue
@@ -59,7 +103,7 @@ func REPL(thread *starlark.Thread, globals starlark.StringDict) {
 //
 // It returns an error (possibly readline.ErrInterrupt)
 // only if readline failed. Starlark errors are printed.
-func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.StringDict) error {
+func rep(rl *readline.Instance, interrupted <-chan os.Signal, thread *starlark.Thread, globals starlark.StringDict) error {
 	// Each item gets its own context,
 	// which is cancelled by a SIGINT.
 	//
@@ -75,6 +119,9 @@ func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.String
 		}
 	}()
 
+	// Restore the previous context, such as that of a program
+	// suspended at a breakpoint, once the item is done.
+	defer thread.SetLocal("context", thread.Local("context"))
 	thread.SetLocal("context", ctx)
 
 	eof := false
@@ -120,7 +167,11 @@ func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.String
 
 		// print
 		if v != starlark.None {
-			fmt.Println(v)
+			opts := &PrettyOptions
+			if thread.PrettyOptions != nil {
+				opts = thread.PrettyOptions
+			}
+			fmt.Println(starlark.PrettyPrint(v, *opts))
 		}
 	} else if err := starlark.ExecREPLChunk(f, thread, globals); err != nil {
 		PrintError(err)
@@ -139,6 +190,46 @@ func soleExpr(f *syntax.File) syntax.Expr {
 	return nil
 }
 
+// Breakpoint is the breakpoint() built-in function. When called, it
+// suspends execution of the calling Starlark function and runs a REPL
+// in which the caller's global, local, and free variables are
+// accessible. Execution resumes when the REPL reads end of input
+// (Control-D).
+//
+// Assignments made within the REPL do not affect the variables of the
+// suspended function, though mutations of the values they refer to do.
+//
+// Breakpoint is not part of the Starlark universe; applications that
+// want it must add it to the predeclared environment explicitly.
+var Breakpoint = starlark.NewBuiltin("breakpoint", breakpoint)
+
+func breakpoint(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+
+	if thread.CallStackDepth() < 2 {
+		return nil, fmt.Errorf("%s: not called from Starlark", b.Name())
+	}
+
+	env := make(starlark.StringDict)
+	caller := thread.DebugFrame(1)
+	if fn, ok := caller.Callable().(*starlark.Function); ok {
+		for name, v := range fn.Globals() {
+			env[name] = v
+		}
+	}
+	for name, v := range caller.Locals() {
+		env[name] = v
+	}
+
+	fmt.Fprintf(os.Stderr, "breakpoint at %s in %s (Control-D to continue)\n",
+		caller.Position(), caller.Callable().Name())
+	REPL(thread, env)
+	fmt.Fprintln(os.Stderr)
+	return starlark.None, nil
+}
+
 // PrintError prints the error to stderr,
 // or its backtrace if it is a Starlark evaluation error.
 func PrintError(err error) {
@@ -172,7 +263,7 @@ func MakeLoad() func(thread *starlark.Thread, module string) (starlark.StringDic
 			cache[module] = nil
 
 			// Load it.
-			thread := &starlark.Thread{Name: "exec " + module, Load: thread.Load}
+			thread := &starlark.Thread{Name: "exec " + module, Load: thread.Load, BazelCompatible: thread.BazelCompatible}
 			globals, err := starlark.ExecFile(thread, module, nil, nil)
 			e = &entry{globals, err}
 
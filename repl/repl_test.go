@@ -0,0 +1,96 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repl
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chzyer/readline"
+	"go.starlark.net/starlark"
+)
+
+// withInput arranges for REPLs started during the test to read the
+// given input and discard their output.
+func withInput(t *testing.T, input string) {
+	prev := newReadline
+	t.Cleanup(func() { newReadline = prev })
+	newReadline = func() (*readline.Instance, error) {
+		return readline.NewEx(&readline.Config{
+			Prompt:         ">>> ",
+			Stdin:          ioutil.NopCloser(strings.NewReader(input)),
+			Stdout:         ioutil.Discard,
+			Stderr:         ioutil.Discard,
+			FuncIsTerminal: func() bool { return false },
+		})
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	withInput(t, "acc.append(x + y)\n")
+
+	const src = `
+y = 2
+
+def f(x):
+    acc = []
+    breakpoint()
+    return acc
+
+result = f(1)
+`
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{"breakpoint": Breakpoint}
+	globals, err := starlark.ExecFile(thread, "bp.star", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["result"].String(), "[3]"; got != want {
+		t.Errorf("result = %s, want %s", got, want)
+	}
+}
+
+func TestBreakpointNoCaller(t *testing.T) {
+	withInput(t, "")
+
+	_, err := starlark.Call(new(starlark.Thread), Breakpoint, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "not called from Starlark") {
+		t.Errorf("breakpoint without caller: got error %v", err)
+	}
+}
+
+func TestNestedInterrupts(t *testing.T) {
+	outer, restoreOuter := notifyInterrupts()
+	inner, restoreInner := notifyInterrupts()
+	if interrupts.current != inner {
+		t.Errorf("inner REPL does not receive interrupts")
+	}
+	restoreInner()
+	if interrupts.current != outer {
+		t.Errorf("interrupts not restored to outer REPL")
+	}
+
+	// After the inner REPL exits, Control-C must reach the outer one.
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(os.Interrupt); err != nil {
+		t.Skip(err)
+	}
+	select {
+	case <-outer:
+	case <-time.After(5 * time.Second):
+		t.Errorf("outer REPL did not receive SIGINT")
+	}
+
+	restoreOuter()
+	if interrupts.current != nil {
+		t.Errorf("interrupts not released")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolve
+
+// This file defines named bundles of the global dialect options.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Dialect is a named, versioned bundle of the global dialect options
+// of this package, so that applications that must accept the same
+// language need not each enable the same dozen options by hand. A
+// published version of a dialect never changes; a change to a dialect
+// is published as a new version.
+type Dialect struct {
+	Name    string
+	Version int
+
+	Set               bool // see AllowSet
+	GlobalReassign    bool // see AllowGlobalReassign
+	Recursion         bool // see AllowRecursion
+	Del               bool // see AllowDel
+	With              bool // see AllowWith
+	Catch             bool // see AllowCatch
+	Yield             bool // see AllowYield
+	LazyIterators     bool // see LazyIterators
+	FunctionAttrs     bool // see FunctionAttrs
+	LoadBindsGlobally bool // see LoadBindsGlobally
+}
+
+// The predefined dialects, at their latest versions.
+var (
+	// DialectStandard is the language of the Starlark specification.
+	DialectStandard = &Dialect{Name: "standard", Version: 1}
+
+	// DialectBazel is the language of Bazel's BUILD and .bzl files,
+	// which additionally have the set type.
+	DialectBazel = &Dialect{Name: "bazel", Version: 1, Set: true}
+
+	// DialectExtended is the language with every extension of this
+	// implementation that does not alter the meaning of standard
+	// programs; it excludes LazyIterators, FunctionAttrs, and
+	// LoadBindsGlobally.
+	DialectExtended = &Dialect{
+		Name:           "extended",
+		Version:        1,
+		Set:            true,
+		GlobalReassign: true,
+		Recursion:      true,
+		Del:            true,
+		With:           true,
+		Catch:          true,
+		Yield:          true,
+	}
+)
+
+// dialects holds every published version of each dialect,
+// including the latest ones above.
+var dialects = []*Dialect{DialectStandard, DialectBazel, DialectExtended}
+
+// String returns the name and version of the dialect, such as "bazel@1".
+func (d *Dialect) String() string {
+	return fmt.Sprintf("%s@%d", d.Name, d.Version)
+}
+
+// Apply sets the global dialect options of this package to those of d.
+func (d *Dialect) Apply() {
+	AllowSet = d.Set
+	AllowGlobalReassign = d.GlobalReassign
+	AllowRecursion = d.Recursion
+	AllowDel = d.Del
+	AllowWith = d.With
+	AllowCatch = d.Catch
+	AllowYield = d.Yield
+	LazyIterators = d.LazyIterators
+	FunctionAttrs = d.FunctionAttrs
+	LoadBindsGlobally = d.LoadBindsGlobally
+}
+
+// CurrentDialect returns an unnamed dialect
+// of the current global dialect options.
+func CurrentDialect() *Dialect {
+	return &Dialect{
+		Set:               AllowSet,
+		GlobalReassign:    AllowGlobalReassign,
+		Recursion:         AllowRecursion,
+		Del:               AllowDel,
+		With:              AllowWith,
+		Catch:             AllowCatch,
+		Yield:             AllowYield,
+		LazyIterators:     LazyIterators,
+		FunctionAttrs:     FunctionAttrs,
+		LoadBindsGlobally: LoadBindsGlobally,
+	}
+}
+
+// LookupDialect returns the dialect of the specified name, which is
+// either a plain name, such as "bazel", denoting the latest version
+// of the dialect, or a name and version, such as "bazel@1".
+func LookupDialect(name string) (*Dialect, error) {
+	version := 0 // latest
+	if at := strings.IndexByte(name, '@'); at >= 0 {
+		v, err := strconv.Atoi(name[at+1:])
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid dialect version in %q", name)
+		}
+		name, version = name[:at], v
+	}
+	var found *Dialect
+	for _, d := range dialects {
+		if d.Name == name && (version == 0 && (found == nil || d.Version > found.Version) || d.Version == version) {
+			found = d
+		}
+	}
+	if found == nil {
+		names := DialectNames()
+		if contains(names, name) {
+			return nil, fmt.Errorf("unknown version %d of dialect %q", version, name)
+		}
+		return nil, fmt.Errorf("unknown dialect %q (want one of %s)", name, strings.Join(names, ", "))
+	}
+	return found, nil
+}
+
+// DialectNames returns the names of the predefined dialects, in lexical order.
+func DialectNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, d := range dialects {
+		if !seen[d.Name] {
+			seen[d.Name] = true
+			names = append(names, d.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
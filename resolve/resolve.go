@@ -101,6 +101,12 @@ var (
 	AllowSet            = false // allow the 'set' built-in
 	AllowGlobalReassign = false // allow reassignment to top-level names; also, allow if/for/while at top-level
 	AllowRecursion      = false // allow while statements and recursive functions
+	AllowDel            = false // allow del statements
+	AllowWith           = false // allow with statements
+	AllowCatch          = false // allow the 'catch' built-in
+	AllowYield          = false // allow yield expressions (generators)
+	LazyIterators       = false // enumerate, zip, and reversed return lazy iterables, not lists
+	FunctionAttrs       = false // functions have the __name__, __doc__, and __params__ attributes
 	LoadBindsGlobally   = false // load creates global not file-local bindings (deprecated)
 
 	// obsolete flags for features that are now standard. No effect.
@@ -140,6 +146,8 @@ func REPLChunk(file *syntax.File, isGlobal, isPredeclared, isUniversal func(name
 	// Function bodies may contain forward references to later global declarations.
 	r.resolveNonLocalUses(r.env)
 
+	r.checkCalls()
+
 	file.Module = &Module{
 		Locals:  r.moduleLocals,
 		Globals: r.moduleGlobals,
@@ -160,6 +168,7 @@ func Expr(expr syntax.Expr, isPredeclared, isUniversal func(name string) bool) (
 	r.expr(expr)
 	r.env.resolveLocalUses()
 	r.resolveNonLocalUses(r.env) // globals & universals
+	r.checkCalls()
 	if len(r.errors) > 0 {
 		return nil, r.errors
 	}
@@ -216,6 +225,10 @@ type resolver struct {
 	// isGlobal may be nil.
 	isGlobal, isPredeclared, isUniversal func(name string) bool
 
+	// calls holds the calls to be checked against Signatures
+	// once all identifiers are resolved.
+	calls []*syntax.CallExpr
+
 	loops   int // number of enclosing for/while loops
 	ifstmts int // number of enclosing if statements loops
 
@@ -423,6 +436,9 @@ func (r *resolver) useToplevel(use use) (bind *Binding) {
 		if !AllowSet && id.Name == "set" {
 			r.errorf(id.NamePos, doesnt+"support sets")
 		}
+		if !AllowCatch && id.Name == "catch" {
+			r.errorf(id.NamePos, doesnt+"support catch")
+		}
 		bind = &Binding{Scope: Universal}
 		r.predeclared[id.Name] = bind // save it
 	} else {
@@ -507,6 +523,12 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		isAugmented := stmt.Op != syntax.EQ
 		r.assign(stmt.LHS, isAugmented)
 
+	case *syntax.DelStmt:
+		if !AllowDel {
+			r.errorf(stmt.Del, doesnt+"support del statements")
+		}
+		r.expr(stmt.X)
+
 	case *syntax.DefStmt:
 		r.bind(stmt.Name)
 		fn := &Function{
@@ -541,6 +563,17 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		r.stmts(stmt.Body)
 		r.loops--
 
+	case *syntax.WithStmt:
+		if !AllowWith {
+			r.errorf(stmt.With, doesnt+"support with statements")
+		}
+		r.expr(stmt.X)
+		if stmt.Var != nil {
+			const isAugmented = false
+			r.assign(stmt.Var, isAugmented)
+		}
+		r.stmts(stmt.Body)
+
 	case *syntax.ReturnStmt:
 		if r.container().function == nil {
 			r.errorf(stmt.Return, "return statement not within a function")
@@ -768,6 +801,10 @@ func (r *resolver) expr(e syntax.Expr) {
 			}
 		}
 
+		if Signatures != nil {
+			r.calls = append(r.calls, e)
+		}
+
 		// Fail gracefully if compiler-imposed limit is exceeded.
 		if p >= 256 {
 			pos, _ := e.Span()
@@ -791,6 +828,23 @@ func (r *resolver) expr(e syntax.Expr) {
 	case *syntax.ParenExpr:
 		r.expr(e.X)
 
+	case *syntax.YieldExpr:
+		if !AllowYield {
+			r.errorf(e.Yield, doesnt+"support yield")
+		}
+		if fn := r.container().function; fn == nil {
+			r.errorf(e.Yield, "yield not within a function")
+		} else if fn.Name == "lambda" {
+			r.errorf(e.Yield, "yield within a lambda")
+		} else if r.env.comp != nil {
+			r.errorf(e.Yield, "yield within a comprehension")
+		} else {
+			fn.Generator = true
+		}
+		if e.Value != nil {
+			r.expr(e.Value)
+		}
+
 	default:
 		log.Panicf("unexpected expr %T", e)
 	}
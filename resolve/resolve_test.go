@@ -18,6 +18,10 @@ func setOptions(src string) {
 	resolve.AllowGlobalReassign = option(src, "globalreassign")
 	resolve.AllowRecursion = option(src, "recursion")
 	resolve.AllowSet = option(src, "set")
+	resolve.AllowDel = option(src, "del")
+	resolve.AllowWith = option(src, "with")
+	resolve.AllowCatch = option(src, "catch")
+	resolve.AllowYield = option(src, "yield")
 	resolve.LoadBindsGlobally = option(src, "loadbindsglobally")
 }
 
@@ -86,3 +90,89 @@ func TestLambdaVarargsAndKwargsSet(t *testing.T) {
 func isPredeclared(name string) bool { return name == "M" }
 
 func isUniversal(name string) bool { return name == "U" || name == "float" }
+
+func TestSignatures(t *testing.T) {
+	resolve.Signatures = map[string]*resolve.Signature{
+		"float":    {Params: []string{"x?"}, Positional: true},
+		"U":        {Params: []string{"a", "b?", "c?"}},
+		"M.encode": {Params: []string{"x", "indent?"}},
+		"M.call":   {Params: []string{"f"}, Varargs: true, Kwargs: true},
+	}
+	defer func() { resolve.Signatures = nil }()
+
+	for _, test := range []struct {
+		src, want string
+	}{
+		{`float(); float(1); U(1); U(1, 2, c=3); M.encode(1, indent=2)`, ""},
+		{`M.call(M, 1, 2, x=3); U(*M); U(**M); M.other(1, 2, 3)`, ""},
+		{`def f(U): U(1, 2, 3, 4)`, ""},   // local shadows universal
+		{`U = M.call; U(1, 2, 3, 4)`, ""}, // global shadows universal
+		{`float(1, 2)`, "float: got 2 arguments, want at most 1"},
+		{`float(x=1)`, "float: unexpected keyword arguments"},
+		{`U(1, 2, 3, 4)`, "U: got 4 arguments, want at most 3"},
+		{`U(b=2)`, "U: missing argument for a"},
+		{`U(1, a=2)`, "U: got multiple values for keyword argument a"},
+		{`M.encode(1, indnet=2)`, "M.encode: unexpected keyword argument indnet (did you mean indent?)"},
+		{`def f(): return M.encode()`, "M.encode: missing argument for x"},
+		{`U(*args, 1, 2, 3, 4)`, "positional argument may not follow *args"},
+	} {
+		f, err := syntax.Parse("sig.star", test.src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := resolve.File(f, isPredeclared, isUniversal); err != nil {
+			got = err.(resolve.ErrorList)[0].Msg
+		}
+		if got != test.want {
+			t.Errorf("%s: got error %q, want %q", test.src, got, test.want)
+		}
+	}
+}
+
+func TestDialect(t *testing.T) {
+	defer resolve.DialectStandard.Apply()
+
+	for _, test := range []struct{ name, want string }{
+		{"standard", "standard@1"},
+		{"bazel", "bazel@1"},
+		{"extended@1", "extended@1"},
+		{"extended@2", `unknown version 2 of dialect "extended"`},
+		{"bazel@x", `invalid dialect version in "bazel@x"`},
+		{"python", `unknown dialect "python" (want one of bazel, extended, standard)`},
+	} {
+		var got string
+		if d, err := resolve.LookupDialect(test.name); err != nil {
+			got = err.Error()
+		} else {
+			got = d.String()
+		}
+		if got != test.want {
+			t.Errorf("LookupDialect(%q) = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	resolve.DialectExtended.Apply()
+	if !resolve.AllowRecursion || !resolve.AllowYield || resolve.LazyIterators {
+		t.Errorf("extended dialect not applied")
+	}
+	d := resolve.CurrentDialect()
+	d.Name, d.Version = resolve.DialectExtended.Name, resolve.DialectExtended.Version
+	if *d != *resolve.DialectExtended {
+		t.Errorf("CurrentDialect() = %+v, want %+v", d, resolve.DialectExtended)
+	}
+
+	// A program that uses extensions resolves only in a dialect that has them.
+	const src = "def f():\n    while 1:\n        pass\n"
+	for _, dialect := range []*resolve.Dialect{resolve.DialectStandard, resolve.DialectExtended} {
+		dialect.Apply()
+		f, err := syntax.Parse("dialect.star", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = resolve.File(f, func(string) bool { return false }, func(string) bool { return false })
+		if ok := err == nil; ok != (dialect == resolve.DialectExtended) {
+			t.Errorf("%s: resolve error %v", dialect, err)
+		}
+	}
+}
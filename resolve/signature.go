@@ -0,0 +1,171 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolve
+
+import (
+	"strings"
+
+	"go.starlark.net/internal/spell"
+	"go.starlark.net/syntax"
+)
+
+// Signatures maps the names of predeclared and universal functions to
+// their signatures, so that the resolver may report calls whose
+// arguments cannot match the function's parameters, such as len(x, y),
+// as static errors rather than failing during execution.
+//
+// A key of the form "m.f" denotes the attribute f of the predeclared or
+// universal value m, as in the call m.f(...). A call is checked only if
+// its callee refers to the predeclared or universal binding of the
+// name, not to a global or local variable that shadows it.
+//
+// Calls that use *args or **kwargs are checked only in part.
+var Signatures map[string]*Signature
+
+// A Signature describes the parameters of a built-in function.
+type Signature struct {
+	// Params holds the names of the parameters, in order.
+	// As for starlark.UnpackArgs, a "?" suffix marks an optional
+	// parameter; all parameters that follow it must be optional too.
+	Params []string
+
+	Positional bool // arguments may not be supplied by keyword, as for starlark.UnpackPositionalArgs
+	Varargs    bool // additional positional arguments are permitted
+	Kwargs     bool // additional keyword arguments are permitted
+}
+
+// calleeName returns the key in Signatures of the function called by
+// call, or "" if the call does not refer to a predeclared function.
+// It must be called after the callee's identifiers are resolved.
+func calleeName(call *syntax.CallExpr) string {
+	var id *syntax.Ident
+	var attr string
+	switch fn := call.Fn.(type) {
+	case *syntax.Ident:
+		id = fn
+	case *syntax.DotExpr:
+		x, ok := fn.X.(*syntax.Ident)
+		if !ok {
+			return ""
+		}
+		id, attr = x, "."+fn.Name.Name
+	default:
+		return ""
+	}
+	if bind, ok := id.Binding.(*Binding); !ok || bind.Scope != Predeclared && bind.Scope != Universal {
+		return ""
+	}
+	return id.Name + attr
+}
+
+// checkCalls checks the arguments of each call to a function in Signatures.
+func (r *resolver) checkCalls() {
+	for _, call := range r.calls {
+		name := calleeName(call)
+		if sig := Signatures[name]; sig != nil {
+			r.checkCall(name, sig, call)
+		}
+	}
+}
+
+func (r *resolver) checkCall(fnname string, sig *Signature, call *syntax.CallExpr) {
+	pos, _ := call.Span()
+
+	// Classify the arguments.
+	var npos int
+	var named []*syntax.Ident
+	var varargs, kwargs bool
+	for _, arg := range call.Args {
+		if unop, ok := arg.(*syntax.UnaryExpr); ok && unop.Op == syntax.STARSTAR {
+			kwargs = true
+		} else if ok && unop.Op == syntax.STAR {
+			varargs = true
+		} else if binop, ok := arg.(*syntax.BinaryExpr); ok && binop.Op == syntax.EQ {
+			named = append(named, binop.X.(*syntax.Ident))
+		} else {
+			npos++
+		}
+	}
+
+	// Determine the parameter names and the number of required ones.
+	params := make([]string, len(sig.Params))
+	min := len(params)
+	for i, param := range sig.Params {
+		params[i] = strings.TrimRight(param, "?")
+		if params[i] != param && i < min {
+			min = i
+		}
+	}
+	max := len(params)
+
+	if sig.Positional {
+		if len(named) > 0 && !sig.Kwargs {
+			r.errorf(pos, "%s: unexpected keyword arguments", fnname)
+			return
+		}
+		if npos < min && !varargs && !kwargs {
+			var atleast string
+			if min < max {
+				atleast = "at least "
+			}
+			r.errorf(pos, "%s: got %d arguments, want %s%d", fnname, npos, atleast, min)
+		} else if npos > max && !sig.Varargs {
+			var atmost string
+			if max > min {
+				atmost = "at most "
+			}
+			r.errorf(pos, "%s: got %d arguments, want %s%d", fnname, npos, atmost, max)
+		}
+		return
+	}
+
+	if npos > max && !sig.Varargs {
+		r.errorf(pos, "%s: got %d arguments, want at most %d", fnname, npos, max)
+		return
+	}
+
+	defined := make([]bool, max)
+	for i := 0; i < npos && i < max; i++ {
+		defined[i] = true
+	}
+	for _, id := range named {
+		i := indexOf(params, id.Name)
+		if i < 0 {
+			if !sig.Kwargs {
+				msg := fnname + ": unexpected keyword argument " + id.Name
+				if n := spell.Nearest(id.Name, params); n != "" {
+					msg += " (did you mean " + n + "?)"
+				}
+				r.errorf(id.NamePos, "%s", msg)
+				return
+			}
+			continue
+		}
+		if defined[i] {
+			r.errorf(id.NamePos, "%s: got multiple values for keyword argument %s", fnname, id.Name)
+			return
+		}
+		defined[i] = true
+	}
+
+	// Any required parameter might be supplied by *args or **kwargs.
+	if !varargs && !kwargs {
+		for i := 0; i < min; i++ {
+			if !defined[i] {
+				r.errorf(pos, "%s: missing argument for %s", fnname, params[i])
+				return
+			}
+		}
+	}
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the behavior of a thread whose BazelCompatible
+// field is set, which matches the Java implementation of Starlark used
+// by Bazel where it differs from this one:
+//
+//   - The string methods absent in Bazel (center, codepoint_ords,
+//     codepoints, elem_ords, expandtabs, ljust, maketrans, rjust,
+//     translate, and zfill) are not provided.
+//   - The dict method setdefault_all is not provided.
+//   - String interpolation does not support the %i, %o, %x, %X, and
+//     %c conversions, which the "Dialect differences" section of
+//     doc/spec.md lists as absent from Bazel.
+//
+// The mode does not yet cover differences in integer and floating-point
+// edge cases; numeric behavior is the same as that of other threads.
+// TODO: audit the numeric operations against Bazel's implementation and
+// add the differences found here. See
+// https://github.com/bazelbuild/starlark/issues/20.
+//
+// The methods are hidden from the attribute operations of the thread
+// (x.f, getattr, hasattr, and dir), not from the Attr methods called
+// by Go code. The dialect options of the resolve package, such as set,
+// which Bazel does not support, are controlled separately; see
+// resolve.DialectBazel. The starlarkstruct package prints instances of
+// providers created by such a thread as struct(...).
+
+var (
+	bazelStringMethods = without(stringMethods, "center", "codepoint_ords", "codepoints", "elem_ords", "expandtabs", "ljust", "maketrans", "rjust", "translate", "zfill")
+	bazelDictMethods   = without(dictMethods, "setdefault_all")
+)
+
+// without returns a copy of the methods without the named ones.
+func without(methods map[string]*Builtin, names ...string) map[string]*Builtin {
+	res := make(map[string]*Builtin, len(methods))
+	for name, b := range methods {
+		res[name] = b
+	}
+	for _, name := range names {
+		delete(res, name)
+	}
+	return res
+}
+
+// attrsOf returns x as seen by the attribute operations of the thread:
+// if the thread is Bazel-compatible, strings and dicts lack the methods
+// that Bazel does not provide.
+func (thread *Thread) attrsOf(x Value) Value {
+	if thread.BazelCompatible {
+		switch x := x.(type) {
+		case String:
+			return bazelString{x}
+		case *Dict:
+			return bazelDict{x}
+		}
+	}
+	return x
+}
+
+// bazelString and bazelDict restrict the methods of a String or *Dict
+// to those of Bazel.
+type (
+	bazelString struct{ Value }
+	bazelDict   struct{ Value }
+)
+
+func (s bazelString) Attr(name string) (Value, error) {
+	return builtinAttr(s.Value, name, bazelStringMethods)
+}
+func (s bazelString) AttrNames() []string { return builtinAttrNames(bazelStringMethods) }
+func (d bazelDict) Attr(name string) (Value, error) {
+	return builtinAttr(d.Value, name, bazelDictMethods)
+}
+func (d bazelDict) AttrNames() []string { return builtinAttrNames(bazelDictMethods) }
@@ -0,0 +1,80 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+import "sync"
+
+// A CancelGroup is a set of threads that are cancelled together, such
+// as the threads among which one logical evaluation fans out its work.
+// A call to the group's Cancel method, or the first failure of a
+// function called by Run, cancels every thread of the group, including
+// those that join it later. The zero value is an empty group that has
+// not been cancelled. It is safe for concurrent use.
+type CancelGroup struct {
+	mu        sync.Mutex
+	threads   map[*Thread]bool
+	cancelled bool
+	reason    string
+}
+
+// Join adds the thread to the group. If the group has already been
+// cancelled, the thread is cancelled immediately.
+func (g *CancelGroup) Join(thread *Thread) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cancelled {
+		thread.Cancel(g.reason)
+		return
+	}
+	if g.threads == nil {
+		g.threads = make(map[*Thread]bool)
+	}
+	g.threads[thread] = true
+}
+
+// Leave removes the thread from the group. It does not
+// uncancel a thread that the group has cancelled.
+func (g *CancelGroup) Leave(thread *Thread) {
+	g.mu.Lock()
+	delete(g.threads, thread)
+	g.mu.Unlock()
+}
+
+// Cancel cancels every thread of the group, present and future, with
+// the specified reason. Only the first call to Cancel has any effect.
+func (g *CancelGroup) Cancel(reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cancelled {
+		return
+	}
+	g.cancelled, g.reason = true, reason
+	for thread := range g.threads {
+		thread.Cancel(reason)
+	}
+	g.threads = nil
+}
+
+// Cancelled reports whether the group has been cancelled,
+// and if so, the reason given by the first call to Cancel.
+func (g *CancelGroup) Cancelled() (reason string, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.reason, g.cancelled
+}
+
+// Run calls f with the thread as a member of the group, and returns
+// its error. If f fails, the group is cancelled, with the error message
+// as the reason, so that the first failure among the group's threads
+// promptly aborts the others.
+func (g *CancelGroup) Run(thread *Thread, f func(thread *Thread) error) error {
+	g.Join(thread)
+	defer g.Leave(thread)
+	err := f(thread)
+	if err != nil {
+		g.Cancel(err.Error())
+	}
+	return err
+}
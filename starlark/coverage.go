@@ -0,0 +1,171 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines a line coverage collector for Starlark.
+//
+// When a thread has a Coverage, the interpreter records each
+// instruction executed by a Starlark function in a table of hit counts
+// specific to that function's code, obtained once per call. The first
+// time any function of a program is called, every function of the
+// program is registered, so that lines of functions that are never
+// called are reported as uncovered. Hits are mapped to source lines
+// only when a report is requested.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"go.starlark.net/internal/compile"
+)
+
+// A Coverage records which source lines of Starlark programs have been
+// executed by threads whose Coverage field refers to it. A single
+// Coverage may be shared by many threads, so that it accumulates the
+// coverage of all of them. It is safe for concurrent use.
+type Coverage struct {
+	mu       sync.Mutex
+	programs map[*compile.Program]bool
+	funcs    map[*compile.Funcode][]uint32 // hit flags, indexed by pc
+	excluded map[string]bool               // filenames omitted from reports
+}
+
+// NewCoverage returns a new, empty coverage collector.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		programs: make(map[*compile.Program]bool),
+		funcs:    make(map[*compile.Funcode][]uint32),
+		excluded: make(map[string]bool),
+	}
+}
+
+// Exclude omits the specified file, such as a test helper library,
+// from subsequent reports.
+func (cov *Coverage) Exclude(filename string) {
+	cov.mu.Lock()
+	cov.excluded[filename] = true
+	cov.mu.Unlock()
+}
+
+// hits returns the table of hit flags for the code of function fn,
+// registering fn's program if this is the first call to any of its functions.
+func (cov *Coverage) hits(fn *Function) []uint32 {
+	cov.mu.Lock()
+	defer cov.mu.Unlock()
+	if prog := fn.module.program; !cov.programs[prog] {
+		cov.programs[prog] = true
+		cov.funcs[prog.Toplevel] = make([]uint32, len(prog.Toplevel.Code))
+		for _, f := range prog.Functions {
+			cov.funcs[f] = make([]uint32, len(f.Code))
+		}
+	}
+	hits := cov.funcs[fn.funcode]
+	if hits == nil {
+		// Unreachable in practice: every Funcode
+		// belongs to the Functions of its program.
+		hits = make([]uint32, len(fn.funcode.Code))
+		cov.funcs[fn.funcode] = hits
+	}
+	return hits
+}
+
+// A FileCoverage reports the line coverage of a single file.
+type FileCoverage struct {
+	Filename string
+	Lines    []int // executable lines, in increasing order
+	Covered  []int // executed lines, a subset of Lines, in increasing order
+}
+
+// Files returns the coverage of each file whose code has been
+// executed, ordered by filename.
+func (cov *Coverage) Files() []FileCoverage {
+	type lineSets struct{ lines, covered map[int]bool }
+	files := make(map[string]*lineSets)
+
+	cov.mu.Lock()
+	for f, hits := range cov.funcs {
+		filename := f.Pos.Filename()
+		if cov.excluded[filename] {
+			continue
+		}
+		sets := files[filename]
+		if sets == nil {
+			sets = &lineSets{make(map[int]bool), make(map[int]bool)}
+			files[filename] = sets
+		}
+		for pc := uint32(0); pc < uint32(len(f.Code)); {
+			_, _, next := compile.DecodeOp(f.Code, pc)
+			if line := int(f.Position(pc).Line); line > 0 {
+				sets.lines[line] = true
+				if atomic.LoadUint32(&hits[pc]) != 0 {
+					sets.covered[line] = true
+				}
+			}
+			pc = next
+		}
+	}
+	cov.mu.Unlock()
+
+	sorted := func(set map[int]bool) []int {
+		lines := make([]int, 0, len(set))
+		for line := range set {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		return lines
+	}
+	result := make([]FileCoverage, 0, len(files))
+	for filename, sets := range files {
+		result = append(result, FileCoverage{
+			Filename: filename,
+			Lines:    sorted(sets.lines),
+			Covered:  sorted(sets.covered),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Filename < result[j].Filename })
+	return result
+}
+
+// Percent returns the percentage of executable lines of all files
+// that have been executed, or zero if there are none.
+func (cov *Coverage) Percent() float64 {
+	var lines, covered int
+	for _, f := range cov.Files() {
+		lines += len(f.Lines)
+		covered += len(f.Covered)
+	}
+	if lines == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(lines)
+}
+
+// WriteProfile writes the coverage in the format of a Go coverage
+// profile (as produced by 'go test -coverprofile' in "set" mode),
+// with one block for each executable line.
+func (cov *Coverage) WriteProfile(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "mode: set"); err != nil {
+		return err
+	}
+	for _, f := range cov.Files() {
+		covered := make(map[int]bool, len(f.Covered))
+		for _, line := range f.Covered {
+			covered[line] = true
+		}
+		for _, line := range f.Lines {
+			count := 0
+			if covered[line] {
+				count = 1
+			}
+			if _, err := fmt.Fprintf(w, "%s:%d.1,%d.1 1 %d\n", f.Filename, line, line+1, count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
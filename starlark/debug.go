@@ -19,6 +19,37 @@ import "go.starlark.net/syntax"
 // THIS API IS EXPERIMENTAL AND MAY CHANGE WITHOUT NOTICE.
 func (fr *frame) Local(i int) Value { return fr.locals[i] }
 
+// Locals returns a new dictionary mapping the names of the frame's
+// local and free variables to their current values. Variables that
+// are not yet assigned are omitted. Cells are unwrapped.
+//
+// Locals returns nil for frames whose Callable is not a *Function.
+//
+// This function is provided only for debugging tools.
+//
+// THIS API IS EXPERIMENTAL AND MAY CHANGE WITHOUT NOTICE.
+func (fr *frame) Locals() StringDict {
+	fn, ok := fr.callable.(*Function)
+	if !ok {
+		return nil
+	}
+	locals := make(StringDict)
+	for i, v := range fn.freevars {
+		if v := v.(*cell).v; v != nil {
+			locals[fn.funcode.Freevars[i].Name] = v
+		}
+	}
+	for i, v := range fr.locals {
+		if c, ok := v.(*cell); ok {
+			v = c.v
+		}
+		if v != nil {
+			locals[fn.funcode.Locals[i].Name] = v
+		}
+	}
+	return locals
+}
+
 // DebugFrame is the debugger API for a frame of the interpreter's call stack.
 //
 // Most applications have no need for this API; use CallFrame instead.
@@ -30,6 +61,7 @@ func (fr *frame) Local(i int) Value { return fr.locals[i] }
 type DebugFrame interface {
 	Callable() Callable        // returns the frame's function
 	Local(i int) Value         // returns the value of the (Starlark) frame's ith local variable
+	Locals() StringDict        // returns the (Starlark) frame's named local and free variables
 	Position() syntax.Position // returns the current position of execution in this frame
 }
 
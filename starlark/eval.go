@@ -5,6 +5,7 @@
 package starlark
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -34,11 +35,32 @@ type Thread struct {
 	// stack is the stack of (internal) call frames.
 	stack []*frame
 
+	// fwdKwargs is the **kwargs dict forwarded by CALL
+	// to a Starlark function, if any; see setArgs.
+	fwdKwargs *Dict
+
 	// Print is the client-supplied implementation of the Starlark
 	// 'print' function. If nil, fmt.Fprintln(os.Stderr, msg) is
 	// used instead.
 	Print func(thread *Thread, msg string)
 
+	// PrettyOptions, if non-nil, causes the 'print' function to
+	// format its non-string arguments using PrettyPrint with these
+	// options, instead of their usual string form.
+	PrettyOptions *PrettyOptions
+
+	// StringLimits, if non-nil, bounds the string forms of values
+	// produced by the built-in functions called by this thread,
+	// such as str and print, and by its % operations. The String
+	// methods of values are not limited.
+	StringLimits *StringLimits
+
+	// BazelCompatible causes programs executed by this thread to match
+	// the behavior of Bazel's implementation of Starlark where it
+	// differs from this one, by omitting some methods of strings and
+	// dicts and some conversions of the % operator; see bazelcompat.go.
+	BazelCompatible bool
+
 	// Load is the client-supplied implementation of module loading.
 	// Repeated calls with the same module name must return the same
 	// module environment or error.
@@ -47,6 +69,69 @@ type Thread struct {
 	// See example_test.go for some example implementations of Load.
 	Load func(thread *Thread, module string) (StringDict, error)
 
+	// LoadLazy, if non-nil, is used in place of Load by load statements,
+	// which then defer the execution of the module until one of the
+	// names they bind is first used. LoadLazy is called immediately,
+	// and returns a function that is called at most once, upon that
+	// first use, to obtain the module environment; it may be called by
+	// another thread, such as one calling a function that refers to
+	// the name. Errors, including a missing name, are reported at the
+	// first use. Names bound to module globals (see
+	// resolve.LoadBindsGlobally) are used when the module's
+	// initialization completes.
+	LoadLazy func(thread *Thread, module string) (func(thread *Thread) (StringDict, error), error)
+
+	// Coverage, if non-nil, records the source lines executed
+	// by this thread. It may be shared by several threads.
+	Coverage *Coverage
+
+	// ExecProfile, if non-nil, counts the executions of each
+	// instruction by this thread, for profile-guided compilation.
+	// It may be shared by several threads.
+	ExecProfile *ExecProfile
+
+	// Tracer, if non-nil, is notified before the execution of each
+	// instruction by this thread. It must not be shared by threads
+	// that execute concurrently.
+	Tracer *Tracer
+
+	// Instrumenter, if non-nil, is notified of the start and end of
+	// each file execution and load statement by this thread, for
+	// reporting to a distributed tracing system.
+	Instrumenter Instrumenter
+
+	// CallSpanThreshold, if positive, causes each function call by
+	// this thread that takes at least this long to be reported to the
+	// Instrumenter too.
+	CallSpanThreshold time.Duration
+
+	// OnIteratorLeak, if non-nil, is called for each iterator leaked
+	// by a top-level execution of this thread while the iterator leak
+	// detector is enabled; see SetIteratorLeakCheck.
+	OnIteratorLeak func(thread *Thread, leak *IteratorLeak)
+
+	// Registry, if non-nil, records the thread
+	// during each of its top-level executions.
+	Registry *ThreadRegistry
+
+	// OnSlowCall, if non-nil, is called when a single call of a
+	// function or built-in by this thread has been outstanding for
+	// SlowCallThreshold, allowing the application to log offending
+	// programs without cancelling them. It is called at most once per
+	// call, usually on another goroutine while the call is still
+	// running, so it must not use the thread except to call Cancel;
+	// see SlowCall.
+	OnSlowCall        func(thread *Thread, call *SlowCall)
+	SlowCallThreshold time.Duration
+
+	// RestrictIntrospection denies programs executed by this thread the
+	// introspection facilities that may reveal details of the host
+	// application, for sandboxing; see IntrospectionKind. If
+	// IntrospectionPolicy is non-nil, it is called for each use of
+	// such a facility on value x, and permits the use if it returns true.
+	RestrictIntrospection bool
+	IntrospectionPolicy   func(thread *Thread, kind IntrospectionKind, x Value) bool
+
 	// OnMaxSteps is called when the thread reaches the limit set by SetMaxExecutionSteps.
 	// The default behavior is to call thread.Cancel("too many steps").
 	OnMaxSteps func(thread *Thread)
@@ -59,9 +144,37 @@ type Thread struct {
 	// The precise meaning of "step" is not specified and may change.
 	Steps, maxSteps uint64
 
+	// stepTrap is the value of Steps at which the interpreter leaves
+	// its fast path, to enforce maxSteps or call instruction hooks.
+	stepTrap uint64
+
 	// cancelReason records the reason from the first call to Cancel.
 	cancelReason *string
 
+	// wake, if non-nil, is the channel through which Cancel
+	// wakes the thread while it awaits a Future.
+	wake *chan struct{}
+
+	// onDone holds the functions registered by OnDone.
+	onDone []func(err error)
+
+	// finalizers holds the finalizers registered by Finalize,
+	// in order of registration. Released ones are nil.
+	finalizers []*Finalizer
+
+	// iterators holds the records of the active iterators created
+	// by this thread, while it is checked for iterator leaks.
+	iterators map[*iterRecord]bool
+
+	// leakGoroutine is the goroutine of the thread's top-level execution
+	// while it is checked for iterator leaks, and leakOuter is the thread
+	// whose check it interrupted on that goroutine, if any.
+	leakGoroutine uint64
+	leakOuter     *Thread
+
+	// memo holds the caches of the memoized functions called by this thread.
+	memo map[*memoized]*memoCache
+
 	// locals holds arbitrary "thread-local" Go values belonging to the client.
 	// They are accessible to the client but not to any Starlark program.
 	locals map[string]interface{}
@@ -82,6 +195,18 @@ func (thread *Thread) ExecutionSteps() uint64 {
 // of calling thread.Cancel("too many steps").
 func (thread *Thread) SetMaxExecutionSteps(max uint64) {
 	thread.maxSteps = max
+	thread.setStepTrap()
+}
+
+// setStepTrap sets the step count at which the interpreter leaves its
+// fast path: at once if the thread has per-instruction hooks,
+// otherwise at the step limit.
+func (thread *Thread) setStepTrap() {
+	if thread.Coverage != nil || thread.ExecProfile != nil || thread.Tracer != nil || thread.Registry != nil {
+		thread.stepTrap = 0
+	} else {
+		thread.stepTrap = thread.maxSteps
+	}
 }
 
 // Uncancel resets the cancellation state.
@@ -95,7 +220,8 @@ func (thread *Thread) Uncancel() {
 // Cancel causes execution of Starlark code in the specified thread to
 // promptly fail with an EvalError that includes the specified reason.
 // There may be a delay before the interpreter observes the cancellation
-// if the thread is currently in a call to a built-in function.
+// if the thread is currently in a call to a built-in function, unless
+// the thread is awaiting a [Future].
 //
 // Call [Uncancel] to reset the cancellation state.
 //
@@ -104,6 +230,95 @@ func (thread *Thread) Uncancel() {
 func (thread *Thread) Cancel(reason string) {
 	// Atomically set cancelReason, preserving earlier reason if any.
 	atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason)), nil, unsafe.Pointer(&reason))
+	thread.wakeAwait()
+}
+
+// cancelled reports whether the thread has been cancelled.
+func (thread *Thread) cancelled() bool {
+	return atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason))) != nil
+}
+
+// OnDone registers f to be called once, when the current or next
+// top-level execution of the thread finishes, whether it succeeds,
+// fails, or is cancelled. A top-level execution is an outermost call
+// to [Call], including those made by [ExecFile], [ExecREPLChunk], and
+// [EvalExpr]. The function's argument is the execution's error, if any.
+// Hooks are called in the order they were registered, after the
+// thread's call stack has been unwound; each is then discarded, so a
+// hook that must observe later executions must register itself again.
+// Hooks are not called if the execution panics.
+//
+// Hooks may be used to release per-thread caches, flush audit logs,
+// or record metrics. They are called after the thread's finalizers
+// have run (see [Thread.Finalize]).
+func (thread *Thread) OnDone(f func(err error)) {
+	thread.onDone = append(thread.onDone, f)
+}
+
+// A Finalizer is a cleanup function registered by [Thread.Finalize].
+type Finalizer struct {
+	thread *Thread
+	index  int // index in thread.finalizers
+	fn     func() error
+}
+
+// Finalize registers fn as a cleanup function for a Go resource, such
+// as a file handle or database connection, wrapped by a value created
+// by a built-in function on behalf of this thread. The function is called
+// when the value is explicitly released, by calling the Release method of
+// the result, or else when the current or next top-level execution of
+// the thread finishes (see [Thread.OnDone]), even if it fails or panics.
+// Thus a program cannot leak host resources by abandoning the values
+// that hold them, and such values must not be used once the execution
+// that created them has finished.
+//
+// If the execution would otherwise succeed, the first error reported
+// by a finalizer becomes its error.
+func (thread *Thread) Finalize(fn func() error) *Finalizer {
+	f := &Finalizer{thread: thread, index: len(thread.finalizers), fn: fn}
+	thread.finalizers = append(thread.finalizers, f)
+	return f
+}
+
+// Release calls the finalizer's cleanup function and returns its
+// error. Subsequent calls have no effect and return nil.
+func (f *Finalizer) Release() error {
+	fn := f.fn
+	if fn == nil {
+		return nil // already released
+	}
+	f.fn = nil
+	fins := f.thread.finalizers
+	if f.index < len(fins) && fins[f.index] == f {
+		fins[f.index] = nil
+		// Trim released finalizers from the end.
+		n := len(fins)
+		for n > 0 && fins[n-1] == nil {
+			n--
+		}
+		f.thread.finalizers = fins[:n]
+	}
+	return fn()
+}
+
+// Released reports whether the finalizer has been released.
+func (f *Finalizer) Released() bool { return f.fn == nil }
+
+// RunFinalizers releases all outstanding finalizers of the thread,
+// most recently registered first, and returns the first error
+// reported by any of them. Finalizers registered during the call
+// are also released. A top-level execution calls RunFinalizers when
+// it finishes; clients need call it only for finalizers registered
+// outside any execution.
+func (thread *Thread) RunFinalizers() error {
+	var first error
+	for len(thread.finalizers) > 0 {
+		f := thread.finalizers[len(thread.finalizers)-1]
+		if err := f.Release(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
 // SetLocal sets the thread-local value associated with the specified key.
@@ -134,6 +349,9 @@ func (thread *Thread) frameAt(depth int) *frame {
 }
 
 // CallStack returns a new slice containing the thread's stack of call frames.
+// It may be called at any time, for example from within a built-in,
+// to obtain a snapshot of the current stack; the result is not
+// affected by subsequent execution.
 func (thread *Thread) CallStack() CallStack {
 	frames := make([]CallFrame, len(thread.stack))
 	for i, fr := range thread.stack {
@@ -209,6 +427,16 @@ func (fr *frame) Position() syntax.Position {
 
 var builtinFilename = "<builtin>"
 
+// span returns the start and end positions of the operation currently
+// executing in this frame. The end position is valid only for
+// Starlark frames whose current operation has a known extent.
+func (fr *frame) span() (start, end syntax.Position) {
+	if fn, ok := fr.callable.(*Function); ok {
+		return fn.funcode.Span(fr.pc)
+	}
+	return fr.Position(), syntax.Position{}
+}
+
 // Function returns the frame's function or built-in.
 func (fr *frame) Callable() Callable { return fr.callable }
 
@@ -249,15 +477,24 @@ type EvalError struct {
 
 // A CallFrame represents the function name and current
 // position of execution of an enclosing call frame.
+//
+// Pos and End delimit the source span of the current operation,
+// such as the call expression f(x) or the index expression a[i].
+// End is invalid if the extent of the operation is unknown.
 type CallFrame struct {
-	Name string
-	Pos  syntax.Position
+	Name     string
+	Pos, End syntax.Position
+	Builtin  bool // frame is a call to a built-in, not a Starlark function
 }
 
 func (fr *frame) asCallFrame() CallFrame {
+	_, isFunc := fr.callable.(*Function)
+	start, end := fr.span()
 	return CallFrame{
-		Name: fr.Callable().Name(),
-		Pos:  fr.Position(),
+		Name:    fr.Callable().Name(),
+		Pos:     start,
+		End:     end,
+		Builtin: !isFunc,
 	}
 }
 
@@ -271,6 +508,11 @@ func (thread *Thread) evalError(err error) *EvalError {
 
 func (e *EvalError) Error() string { return e.Msg }
 
+// An internalError reports a bug in a built-in function.
+type internalError string
+
+func (e internalError) Error() string { return "internal error: " + string(e) }
+
 // Backtrace returns a user-friendly error message describing the stack
 // of calls that led to this error.
 func (e *EvalError) Backtrace() string {
@@ -285,8 +527,22 @@ func (e *EvalError) Backtrace() string {
 	return fmt.Sprintf("%sError%s: %s", stack, suffix, e.Msg)
 }
 
+// Unwrap returns the underlying error, such as the error returned by a
+// built-in function, allowing errors.Is and errors.As to match it.
 func (e *EvalError) Unwrap() error { return e.cause }
 
+// Span returns the source span of the innermost Starlark
+// operation that was executing at the moment of the error.
+// The end position is invalid if the extent is unknown.
+func (e *EvalError) Span() (start, end syntax.Position) {
+	for i := len(e.CallStack) - 1; i >= 0; i-- {
+		if fr := e.CallStack[i]; !fr.Builtin {
+			return fr.Pos, fr.End
+		}
+	}
+	return
+}
+
 // A Program is a compiled Starlark program.
 //
 // Programs are immutable, and contain no Values.
@@ -300,8 +556,20 @@ type Program struct {
 // files. Applications must not run programs compiled by one version
 // with an interpreter at another version, and should thus incorporate
 // the compiler version into the cache key when reusing compiled code.
+// CompiledProgram rejects a program of another version with a
+// *CompilerVersionError.
 const CompilerVersion = compile.Version
 
+// Disassemble returns a human-readable listing of the program's
+// bytecode, function by function, for use in understanding the
+// behavior and performance of the interpreter. Each instruction is
+// annotated with its operand and source position. If src is non-nil,
+// it is the source text of the program, and each position is annotated
+// with its line of source.
+//
+// The format of the listing is not specified and may change.
+func (prog *Program) Disassemble(src []byte) string { return prog.compiled.Disassemble(src) }
+
 // Filename returns the name of the file from which this program was loaded.
 func (prog *Program) Filename() string { return prog.compiled.Toplevel.Pos.Filename() }
 
@@ -354,6 +622,22 @@ func ExecFile(thread *Thread, filename string, src interface{}, predeclared Stri
 	return g, err
 }
 
+// ExecCompiled executes a program previously compiled and saved by
+// Program.Write, such as the output of the starlarkc command,
+// and returns the frozen global environment like ExecFile.
+//
+// predeclared must define every predeclared name used by the program.
+func ExecCompiled(thread *Thread, data []byte, predeclared StringDict) (StringDict, error) {
+	prog, err := CompiledProgram(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := prog.Init(thread, predeclared)
+	g.Freeze()
+	return g, err
+}
+
 // SourceProgram produces a new program by parsing, resolving,
 // and compiling a Starlark source file.
 // On success, it returns the parsed file and the compiled program.
@@ -384,6 +668,18 @@ func SourceProgram(filename string, src interface{}, isPredeclared func(string)
 // Its typical value is predeclared.Has,
 // where predeclared is a StringDict of pre-declared values.
 func FileProgram(f *syntax.File, isPredeclared func(string) bool) (*Program, error) {
+	return FileProgramWithProfile(f, isPredeclared, nil)
+}
+
+// FileProgramWithProfile is a variant of FileProgram that uses an
+// execution profile to optimize the layout of the compiled code, placing
+// code that was never executed after the code of each function that
+// was. Block layout is the only optimization that uses the profile.
+// The profile, which may be nil, should have been gathered by
+// executing the program compiled from the same source without a profile.
+func FileProgramWithProfile(f *syntax.File, isPredeclared func(string) bool, profile *ExecProfile) (*Program, error) {
+	defer observeSince(MetricCompileSeconds, time.Now())
+
 	if err := resolve.File(f, isPredeclared, Universe.Has); err != nil {
 		return nil, err
 	}
@@ -396,7 +692,7 @@ func FileProgram(f *syntax.File, isPredeclared func(string) bool) (*Program, err
 	}
 
 	module := f.Module.(*resolve.Module)
-	compiled := compile.File(f.Stmts, pos, "<toplevel>", module.Locals, module.Globals)
+	compiled := compile.FileProfile(f.Stmts, pos, "<toplevel>", module.Locals, module.Globals, profile.compileProfile())
 
 	return &Program{compiled}, nil
 }
@@ -410,24 +706,62 @@ func CompiledProgram(in io.Reader) (*Program, error) {
 	}
 	compiled, err := compile.DecodeProgram(data)
 	if err != nil {
+		if err, ok := err.(*compile.VersionError); ok {
+			return nil, &CompilerVersionError{Version: err.Version}
+		}
 		return nil, err
 	}
 	return &Program{compiled}, nil
 }
 
+// A CompilerVersionError is the error reported by CompiledProgram
+// for a program compiled by a different CompilerVersion.
+// The program must be recompiled from source.
+type CompilerVersionError struct {
+	Version int // version of the compiled program
+}
+
+func (e *CompilerVersionError) Error() string {
+	return fmt.Sprintf("compiled program has version %d, want %d", e.Version, CompilerVersion)
+}
+
+// CompiledProgramVersion returns the CompilerVersion of the compiler
+// that produced the compiled program data, which need not be the
+// current one, without decoding the program.
+func CompiledProgramVersion(data []byte) (int, error) {
+	return compile.ReadVersion(data)
+}
+
 // Init creates a set of global variables for the program,
 // executes the toplevel code of the specified program,
 // and returns a new, unfrozen dictionary of the globals.
 func (prog *Program) Init(thread *Thread, predeclared StringDict) (StringDict, error) {
 	toplevel := makeToplevelFunction(prog.compiled, predeclared)
 
+	span := thread.startSpan(ExecSpan, prog.Filename(), prog.compiled.Toplevel.Pos)
 	_, err := Call(thread, toplevel, nil, nil)
+	err = toplevel.module.settleLazy(thread, err)
+	thread.endSpan(span, err)
 
 	// Convert the global environment to a map.
 	// We return a (partial) map even in case of error.
 	return toplevel.Globals(), err
 }
 
+// InitOrdered is a variant of Init that returns the globals of the
+// program in order of their definition in the source.
+func (prog *Program) InitOrdered(thread *Thread, predeclared StringDict) (*OrderedStringDict, error) {
+	toplevel := makeToplevelFunction(prog.compiled, predeclared)
+
+	span := thread.startSpan(ExecSpan, prog.Filename(), prog.compiled.Toplevel.Pos)
+	_, err := Call(thread, toplevel, nil, nil)
+	err = toplevel.module.settleLazy(thread, err)
+	thread.endSpan(span, err)
+
+	// We return a (partial) dictionary even in case of error.
+	return toplevel.module.makeOrderedGlobalDict(), err
+}
+
 // ExecREPLChunk compiles and executes file f in the specified thread
 // and global environment. This is a variant of ExecFile specialized to
 // the needs of a REPL, in which a sequence of input chunks, each
@@ -467,7 +801,10 @@ func ExecREPLChunk(f *syntax.File, thread *Thread, globals StringDict) error {
 		}
 	}
 
+	span := thread.startSpan(ExecSpan, prog.Filename(), prog.compiled.Toplevel.Pos)
 	_, err := Call(thread, toplevel, nil, nil)
+	err = toplevel.module.settleLazy(thread, err)
+	thread.endSpan(span, err)
 
 	// Reflect changes to globals back to parameter, even after an error.
 	for i, id := range prog.compiled.Globals {
@@ -577,20 +914,101 @@ func makeExprFunc(expr syntax.Expr, env StringDict) (*Function, error) {
 // The following functions are primitive operations of the byte code interpreter.
 
 // list += iterable
-func listExtend(x *List, y Iterable) {
+// The thread, which may be nil, is that of the iteration over y.
+func listExtend(thread *Thread, x *List, y Iterable) error {
 	if ylist, ok := y.(*List); ok {
 		// fast path: list += list
 		x.elems = append(x.elems, ylist.elems...)
 	} else {
-		iter := y.Iterate()
+		iter := iterateOn(thread, y)
 		defer iter.Done()
 		var z Value
 		for iter.Next(&z) {
 			x.elems = append(x.elems, z)
 		}
+		return iterErr(iter)
 	}
+	return nil
 }
 
+// InplaceBinary returns the value of the augmented assignment x op= y.
+// For x += y where x is a list and y is iterable, and for x |= y where
+// both are dicts, it updates x in place and returns it; otherwise it
+// returns Binary(op, x, y).
+func InplaceBinary(op syntax.Token, x, y Value) (Value, error) {
+	switch op {
+	case syntax.PLUS:
+		// It's possible that y is not Iterable but
+		// nonetheless defines x+y, in which case we
+		// should fall back to the general case.
+		if xlist, ok := x.(*List); ok {
+			if yiter, ok := y.(Iterable); ok {
+				if err := xlist.checkMutable("apply += to"); err != nil {
+					return nil, err
+				}
+				if err := listExtend(nil, xlist, yiter); err != nil {
+					return nil, err
+				}
+				return xlist, nil
+			}
+		}
+
+	case syntax.PIPE:
+		// It's possible that y is not Dict but
+		// nonetheless defines x|y, in which case we
+		// should fall back to the general case.
+		if xdict, ok := x.(*Dict); ok {
+			if ydict, ok := y.(*Dict); ok {
+				if err := xdict.ht.checkMutable("apply |= to"); err != nil {
+					return nil, err
+				}
+				xdict.ht.addAll(&ydict.ht) // can't fail
+				return xdict, nil
+			}
+		}
+	}
+	return Binary(op, x, y)
+}
+
+// Attr returns the value of the expression x.name, reporting an error
+// if x has no such field or method.
+//
+// Attr, SetField, DelField, Index, SetIndex, DelIndex, and Slice are
+// the implementations of the corresponding operations of the
+// interpreter, for use by code generators and other tools that execute
+// Starlark semantics in Go.
+func Attr(x Value, name string) (Value, error) { return getAttr(x, name) }
+
+// SetField performs the assignment x.name = y.
+func SetField(x Value, name string, y Value) error { return setField(x, name, y) }
+
+// DelField performs the statement del x.name.
+func DelField(x Value, name string) error { return delField(x, name) }
+
+// Index returns the value of the expression x[y].
+// It does not call the default factory of a dict; see IndexThread.
+func Index(x, y Value) (Value, error) { return getIndex(x, y) }
+
+// IndexThread is like Index, but if x is a dict with a default factory,
+// it calls the factory in the specified thread to obtain the value of a
+// missing key, as the interpreter does.
+func IndexThread(thread *Thread, x, y Value) (Value, error) {
+	if d, ok := x.(*Dict); ok && d.factory != nil {
+		return getDictIndex(thread, d, y)
+	}
+	return getIndex(x, y)
+}
+
+// SetIndex performs the assignment x[y] = z.
+func SetIndex(x, y, z Value) error { return setIndex(x, y, z) }
+
+// DelIndex performs the statement del x[y].
+func DelIndex(x, y Value) error { return delIndex(x, y) }
+
+// Slice returns the value of the expression x[lo:hi:step].
+// An omitted operand is represented by None.
+func Slice(x, lo, hi, step Value) (Value, error) { return slice(x, lo, hi, step) }
+
 // getAttr implements x.dot.
 func getAttr(x Value, name string) (Value, error) {
 	hasAttr, ok := x.(HasAttrs)
@@ -617,6 +1035,9 @@ func getAttr(x Value, name string) (Value, error) {
 		errmsg = fmt.Sprintf("%s (did you mean .%s?)", errmsg, n)
 	}
 
+	if err != nil {
+		return nil, wrappedError{msg: errmsg, cause: err}
+	}
 	return nil, fmt.Errorf("%s", errmsg)
 }
 
@@ -627,7 +1048,10 @@ func setField(x Value, name string, y Value) error {
 		if _, ok := err.(NoSuchAttrError); ok {
 			// No such field: check spelling.
 			if n := spell.Nearest(name, x.AttrNames()); n != "" {
-				err = fmt.Errorf("%s (did you mean .%s?)", err, n)
+				err = wrappedError{
+					msg:   fmt.Sprintf("%s (did you mean .%s?)", err, n),
+					cause: err,
+				}
 			}
 		}
 		return err
@@ -636,6 +1060,25 @@ func setField(x Value, name string, y Value) error {
 	return fmt.Errorf("can't assign to .%s field of %s", name, x.Type())
 }
 
+// delField implements del x.name.
+func delField(x Value, name string) error {
+	if x, ok := x.(HasDelField); ok {
+		err := x.DelField(name)
+		if _, ok := err.(NoSuchAttrError); ok {
+			// No such field: check spelling.
+			if n := spell.Nearest(name, x.AttrNames()); n != "" {
+				err = wrappedError{
+					msg:   fmt.Sprintf("%s (did you mean .%s?)", err, n),
+					cause: err,
+				}
+			}
+		}
+		return err
+	}
+
+	return fmt.Errorf("can't delete .%s field of %s", name, x.Type())
+}
+
 // getIndex implements x[y].
 func getIndex(x, y Value) (Value, error) {
 	switch x := x.(type) {
@@ -645,7 +1088,7 @@ func getIndex(x, y Value) (Value, error) {
 			return nil, err
 		}
 		if !found {
-			return nil, fmt.Errorf("key %v not in %s", y, x.Type())
+			return nil, fmt.Errorf("key %s not in %s", Repr(y), x.Type())
 		}
 		return z, nil
 
@@ -667,6 +1110,25 @@ func getIndex(x, y Value) (Value, error) {
 	return nil, fmt.Errorf("unhandled index operation %s[%s]", x.Type(), y.Type())
 }
 
+// getDictIndex implements d[k] for a dict d with a default factory.
+func getDictIndex(thread *Thread, d *Dict, k Value) (Value, error) {
+	v, found, err := d.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return v, nil
+	}
+	v, err = Call(thread, d.factory, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.SetKey(k, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
 func outOfRange(i, n int, x Value) error {
 	if n == 0 {
 		return fmt.Errorf("index %d out of range: empty %s", i, x.Type())
@@ -704,6 +1166,41 @@ func setIndex(x, y, z Value) error {
 	return nil
 }
 
+// delIndex implements del x[y].
+func delIndex(x, y Value) error {
+	switch x := x.(type) {
+	case *Dict:
+		_, found, err := x.Delete(y)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("key %s not in dict", Repr(y))
+		}
+		return nil
+
+	case *List:
+		n := x.Len()
+		i, err := AsInt32(y)
+		if err != nil {
+			return err
+		}
+		origI := i
+		if i < 0 {
+			i += n
+		}
+		if i < 0 || i >= n {
+			return outOfRange(origI, n, x)
+		}
+		if err := x.checkMutable("delete from"); err != nil {
+			return err
+		}
+		x.elems = append(x.elems[:i], x.elems[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("%s value does not support item deletion", x.Type())
+}
+
 // Unary applies a unary operator (+, -, ~, not) to its operand.
 func Unary(op syntax.Token, x Value) (Value, error) {
 	// The NOT operator is not customizable.
@@ -973,7 +1470,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				return x.Mod(yf), nil
 			}
 		case String:
-			return interpolate(string(x), y)
+			return interpolate(string(x), y, nil, false)
 		}
 
 	case syntax.NOT_IN:
@@ -1003,6 +1500,9 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				}
 			}
 			return False, nil
+		case Container:
+			ok, err := y.Contains(x)
+			return Bool(ok), err
 		case Mapping: // e.g. dict
 			// Ignore error from Get as we cannot distinguish true
 			// errors (value cycle, type error) from "key not found".
@@ -1066,17 +1566,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			}
 		case *Set: // intersection
 			if y, ok := y.(*Set); ok {
-				set := new(Set)
 				if x.Len() > y.Len() {
 					x, y = y, x // opt: range over smaller set
 				}
-				for _, xelem := range x.elems() {
-					// Has, Insert cannot fail here.
-					if found, _ := y.Has(xelem); found {
-						set.Insert(xelem)
-					}
-				}
-				return set, nil
+				iter := Iterate(x)
+				defer iter.Done()
+				return y.Intersection(iter)
 			}
 		}
 
@@ -1088,18 +1583,9 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			}
 		case *Set: // symmetric difference
 			if y, ok := y.(*Set); ok {
-				set := new(Set)
-				for _, xelem := range x.elems() {
-					if found, _ := y.Has(xelem); !found {
-						set.Insert(xelem)
-					}
-				}
-				for _, yelem := range y.elems() {
-					if found, _ := x.Has(yelem); !found {
-						set.Insert(yelem)
-					}
-				}
-				return set, nil
+				iter := Iterate(y)
+				defer iter.Done()
+				return x.SymmetricDifference(iter)
 			}
 		}
 
@@ -1204,7 +1690,7 @@ func stringRepeat(s String, n Int) (String, error) {
 }
 
 // Call calls the function fn with the specified positional and keyword arguments.
-func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
+func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (result Value, err error) {
 	c, ok := fn.(Callable)
 	if !ok {
 		return nil, fmt.Errorf("invalid call of non-function (%s)", fn.Type())
@@ -1228,16 +1714,61 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 		}
 	}
 
+	returned := false // no panic
+	if len(thread.stack) == 0 {
+		// This is a top-level execution.
+		// Call the completion hooks after the frame is popped.
+		thread.setStepTrap()
+		steps := thread.Steps
+		checkLeaks := thread.beginIterLeakCheck()
+		registry := thread.Registry
+		if registry != nil {
+			registry.register(thread)
+		}
+		defer func() {
+			if registry != nil {
+				registry.unregister(thread)
+			}
+			if checkLeaks {
+				thread.endIterLeakCheck()
+			}
+			if ferr := thread.RunFinalizers(); ferr != nil && err == nil && returned {
+				err = ferr
+			}
+			if !returned {
+				return // panic: don't call hooks
+			}
+			ObserveMetric(MetricSteps, float64(thread.Steps-steps))
+			hooks := thread.onDone
+			thread.onDone = nil
+			for _, hook := range hooks {
+				hook(err)
+			}
+		}()
+	}
+
 	thread.stack = append(thread.stack, fr) // push
 
 	fr.callable = c
 
 	thread.beginProfSpan()
 
+	var start time.Time
+	if thread.Instrumenter != nil && thread.CallSpanThreshold > 0 {
+		start = time.Now()
+	}
+	var watch *slowCallWatch
+	if thread.watchingSlowCalls() {
+		watch = thread.watchSlowCall()
+	}
+
 	// Use defer to ensure that panics from built-ins
 	// pass through the interpreter without leaving
 	// it in a bad state.
 	defer func() {
+		if watch != nil {
+			watch.stop()
+		}
 		thread.endProfSpan()
 
 		// clear out any references
@@ -1248,11 +1779,16 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 		thread.stack = thread.stack[:len(thread.stack)-1] // pop
 	}()
 
-	result, err := c.CallInternal(thread, args, kwargs)
+	result, err = c.CallInternal(thread, args, kwargs)
+
+	// If the callee returned a future, suspend until it completes.
+	if f, ok := result.(*Future); ok && err == nil {
+		result, err = thread.await(f)
+	}
 
 	// Sanity check: nil is not a valid Starlark value.
 	if result == nil && err == nil {
-		err = fmt.Errorf("internal error: nil (not None) returned from %s", fn)
+		err = internalError(fmt.Sprintf("nil (not None) returned from %s", fn))
 	}
 
 	// Always return an EvalError with an accurate frame.
@@ -1262,6 +1798,11 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 		}
 	}
 
+	if !start.IsZero() {
+		thread.reportCall(c, start, err)
+	}
+
+	returned = true
 	return result, err
 }
 
@@ -1382,7 +1923,11 @@ func asIndex(v Value, len int, result *int) error {
 
 // setArgs sets the values of the formal parameters of function fn in
 // based on the actual parameter values in args and kwargs.
-func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
+//
+// If kwsrc is non-nil, its entries are additional keyword arguments,
+// as when a function forwards its **kwargs dict unchanged; the names
+// are known to be distinct, and their hashes are reused.
+func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple, kwsrc *Dict) error {
 
 	// This is the general schema of a function:
 	//
@@ -1404,7 +1949,11 @@ func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 
 	// Nullary function?
 	if fn.NumParams() == 0 {
-		if nactual := len(args) + len(kwargs); nactual > 0 {
+		nactual := len(args) + len(kwargs)
+		if kwsrc != nil {
+			nactual += kwsrc.Len()
+		}
+		if nactual > 0 {
 			return fmt.Errorf("function %s accepts no arguments (%d given)", fn.Name(), nactual)
 		}
 		return nil
@@ -1423,6 +1972,9 @@ func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 	if fn.HasKwargs() {
 		nparams--
 		kwdict = new(Dict)
+		if kwsrc != nil {
+			kwdict.ht.init(kwsrc.Len())
+		}
 		locals[nparams] = kwdict
 	}
 	if fn.HasVarargs() {
@@ -1480,6 +2032,25 @@ func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 			return fmt.Errorf("function %s got multiple values for parameter %s", fn.Name(), k)
 		}
 	}
+	if kwsrc != nil {
+		for e := kwsrc.ht.head; e != nil; e = e.next {
+			k, ok := e.key.(String)
+			if !ok {
+				return fmt.Errorf("keywords must be strings, not %s", e.key.Type())
+			}
+			if i := findParam(paramIdents, string(k)); i >= 0 {
+				if locals[i] != nil {
+					return fmt.Errorf("function %s got multiple values for parameter %s", fn.Name(), k)
+				}
+				locals[i] = e.value
+				continue
+			}
+			if kwdict == nil {
+				return fmt.Errorf("function %s got an unexpected keyword argument %s", fn.Name(), k)
+			}
+			kwdict.ht.insertDistinct(k, e.value, e.hash)
+		}
+	}
 
 	// Are defaults required?
 	if n < nparams || fn.NumKwonlyParams() > 0 {
@@ -1524,7 +2095,9 @@ func findParam(params []compile.Binding, name string) int {
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string-interpolation
-func interpolate(format string, x Value) (Value, error) {
+// If bazel is set, it rejects the conversions that Bazel does not support,
+// as listed in the "Dialect differences" section of the spec.
+func interpolate(format string, x Value, limits *StringLimits, bazel bool) (Value, error) {
 	buf := new(strings.Builder)
 	index := 0
 	nargs := 1
@@ -1585,12 +2158,18 @@ func interpolate(format string, x Value) (Value, error) {
 		if format == "" {
 			return nil, fmt.Errorf("incomplete format")
 		}
-		switch c := format[0]; c {
+		c := format[0]
+		if bazel && strings.IndexByte("ioxXc", c) >= 0 {
+			return nil, fmt.Errorf("unknown conversion %%%c", c)
+		}
+		switch c {
 		case 's', 'r':
 			if str, ok := AsString(arg); ok && c == 's' {
 				buf.WriteString(str)
+			} else if c == 's' {
+				writeStr(buf, arg, limits)
 			} else {
-				writeValue(buf, arg, nil)
+				writeValueLimited(buf, arg, limits)
 			}
 		case 'd', 'i', 'o', 'x', 'X':
 			i, err := NumberToInt(arg)
@@ -6,19 +6,28 @@ package starlark_test
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"math"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	gotime "time"
 
 	"go.starlark.net/internal/chunkedfile"
+	"go.starlark.net/lib/bisect"
+	"go.starlark.net/lib/immutable"
 	"go.starlark.net/lib/json"
+	"go.starlark.net/lib/linalg"
 	starlarkmath "go.starlark.net/lib/math"
 	"go.starlark.net/lib/proto"
+	"go.starlark.net/lib/table"
 	"go.starlark.net/lib/time"
 	"go.starlark.net/resolve"
 	"go.starlark.net/starlark"
@@ -30,12 +39,22 @@ import (
 	_ "google.golang.org/protobuf/types/descriptorpb" // example descriptor needed for lib/proto tests
 )
 
+func init() {
+	flag.BoolVar(&starlarktest.UpdateGolden, "update", false, "update golden files in testdata")
+}
+
 // A test may enable non-standard options by containing (e.g.) "option:recursion".
 func setOptions(src string) {
 	resolve.AllowGlobalReassign = option(src, "globalreassign")
 	resolve.LoadBindsGlobally = option(src, "loadbindsglobally")
 	resolve.AllowRecursion = option(src, "recursion")
 	resolve.AllowSet = option(src, "set")
+	resolve.AllowDel = option(src, "del")
+	resolve.AllowWith = option(src, "with")
+	resolve.AllowCatch = option(src, "catch")
+	resolve.AllowYield = option(src, "yield")
+	resolve.LazyIterators = option(src, "lazyiter")
+	resolve.FunctionAttrs = option(src, "funcattrs")
 }
 
 func option(chunk, name string) bool {
@@ -112,40 +131,49 @@ func TestEvalExpr(t *testing.T) {
 	}
 }
 
+// execFiles lists the chunked test files executed by TestExecFile.
+var execFiles = []string{
+	"testdata/assign.star",
+	"testdata/bisect.star",
+	"testdata/bool.star",
+	"testdata/builtins.star",
+	"testdata/bytes.star",
+	"testdata/control.star",
+	"testdata/dict.star",
+	"testdata/float.star",
+	"testdata/function.star",
+	"testdata/immutable.star",
+	"testdata/generator.star",
+	"testdata/int.star",
+	"testdata/json.star",
+	"testdata/linalg.star",
+	"testdata/list.star",
+	"testdata/math.star",
+	"testdata/misc.star",
+	"testdata/proto.star",
+	"testdata/set.star",
+	"testdata/string.star",
+	"testdata/table.star",
+	"testdata/time.star",
+	"testdata/tuple.star",
+	"testdata/recursion.star",
+	"testdata/module.star",
+}
+
 func TestExecFile(t *testing.T) {
 	defer setOptions("")
 	testdata := starlarktest.DataFile("starlark", ".")
 	thread := &starlark.Thread{Load: load}
 	starlarktest.SetReporter(thread, t)
 	proto.SetPool(thread, protoregistry.GlobalFiles)
-	for _, file := range []string{
-		"testdata/assign.star",
-		"testdata/bool.star",
-		"testdata/builtins.star",
-		"testdata/bytes.star",
-		"testdata/control.star",
-		"testdata/dict.star",
-		"testdata/float.star",
-		"testdata/function.star",
-		"testdata/int.star",
-		"testdata/json.star",
-		"testdata/list.star",
-		"testdata/math.star",
-		"testdata/misc.star",
-		"testdata/proto.star",
-		"testdata/set.star",
-		"testdata/string.star",
-		"testdata/time.star",
-		"testdata/tuple.star",
-		"testdata/recursion.star",
-		"testdata/module.star",
-	} {
+	for _, file := range execFiles {
 		filename := filepath.Join(testdata, file)
 		for _, chunk := range chunkedfile.Read(filename, t) {
 			predeclared := starlark.StringDict{
 				"hasfields": starlark.NewBuiltin("hasfields", newHasFields),
 				"fibonacci": fib{},
 				"struct":    starlark.NewBuiltin("struct", starlarkstruct.Make),
+				"resource":  starlark.NewBuiltin("resource", newResource),
 			}
 
 			setOptions(chunk.Source)
@@ -205,6 +233,18 @@ func load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
 	if module == "time.star" {
 		return starlark.StringDict{"time": time.Module}, nil
 	}
+	if module == "linalg.star" {
+		return starlark.StringDict{"linalg": linalg.Module}, nil
+	}
+	if module == "table.star" {
+		return starlark.StringDict{"table": table.Module}, nil
+	}
+	if module == "immutable.star" {
+		return starlark.StringDict{"immutable": immutable.Module}, nil
+	}
+	if module == "bisect.star" {
+		return starlark.StringDict{"bisect": bisect.Module}, nil
+	}
 	if module == "math.star" {
 		return starlark.StringDict{"math": starlarkmath.Module}, nil
 	}
@@ -234,8 +274,9 @@ type hasfields struct {
 }
 
 var (
-	_ starlark.HasAttrs  = (*hasfields)(nil)
-	_ starlark.HasBinary = (*hasfields)(nil)
+	_ starlark.HasAttrs    = (*hasfields)(nil)
+	_ starlark.HasBinary   = (*hasfields)(nil)
+	_ starlark.HasDelField = (*hasfields)(nil)
 )
 
 func (hf *hasfields) String() string        { return "hasfields" }
@@ -265,6 +306,17 @@ func (hf *hasfields) SetField(name string, val starlark.Value) error {
 	return nil
 }
 
+func (hf *hasfields) DelField(name string) error {
+	if hf.frozen {
+		return fmt.Errorf("cannot delete field of a frozen hasfields")
+	}
+	if _, ok := hf.attrs[name]; !ok {
+		return starlark.NoSuchAttrError(fmt.Sprintf("hasfields has no .%s field", name))
+	}
+	delete(hf.attrs, name)
+	return nil
+}
+
 func (hf *hasfields) AttrNames() []string {
 	names := make([]string, 0, len(hf.attrs))
 	for key := range hf.attrs {
@@ -285,6 +337,51 @@ func (hf *hasfields) Binary(op syntax.Token, y starlark.Value, side starlark.Sid
 	return nil, nil
 }
 
+func newResource(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	r := new(resource)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &r.name, "log", &r.log, "fail_exit?", &r.failExit); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// resource is a test-only implementation of ContextManager.
+// It records the calls to its Enter and Exit methods in a list.
+type resource struct {
+	name     string
+	log      *starlark.List
+	failExit bool
+}
+
+var _ starlark.ContextManager = (*resource)(nil)
+
+func (r *resource) String() string        { return fmt.Sprintf("resource(%q)", r.name) }
+func (r *resource) Type() string          { return "resource" }
+func (r *resource) Truth() starlark.Bool  { return true }
+func (r *resource) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: resource") }
+func (r *resource) Freeze()               {}
+
+func (r *resource) Enter(thread *starlark.Thread) (starlark.Value, error) {
+	if err := r.log.Append(starlark.String("enter " + r.name)); err != nil {
+		return nil, err
+	}
+	return starlark.String(r.name), nil
+}
+
+func (r *resource) Exit(thread *starlark.Thread, err error) error {
+	msg := "exit " + r.name
+	if err != nil {
+		msg += ": " + err.Error()
+	}
+	if err := r.log.Append(starlark.String(msg)); err != nil {
+		return err
+	}
+	if r.failExit {
+		return fmt.Errorf("%s: exit failed", r.name)
+	}
+	return nil
+}
+
 func TestParameterPassing(t *testing.T) {
 	const filename = "parameters.go"
 	const src = `
@@ -573,6 +670,75 @@ Error in join: join: in list, want string, got int`,
 	}
 }
 
+// TestCallStack ensures that a built-in may inspect the structured
+// call stack, and that EvalError frames distinguish built-ins.
+func TestCallStack(t *testing.T) {
+	const src = `
+def f(): return stack()
+def g(): return f()
+g()
+min([1], key=lambda x: 1//0)
+`
+	var got []string
+	stack := starlark.NewBuiltin("stack", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		for _, fr := range thread.CallStack() {
+			got = append(got, fmt.Sprintf("%s:%v:%v", fr.Name, fr.Pos, fr.Builtin))
+		}
+		return starlark.None, nil
+	})
+	thread := new(starlark.Thread)
+	_, err := starlark.ExecFile(thread, "stack.star", src, starlark.StringDict{"stack": stack})
+	want := []string{
+		"<toplevel>:stack.star:4:2:false",
+		"g:stack.star:3:18:false",
+		"f:stack.star:2:22:false",
+		"stack:<builtin>:true",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("CallStack = %q, want %q", got, want)
+	}
+
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		t.Fatalf("ExecFile returned %v, want *EvalError", err)
+	}
+	var builtins []bool
+	for _, fr := range evalErr.CallStack {
+		builtins = append(builtins, fr.Builtin)
+	}
+	if want := "[false true false]"; fmt.Sprint(builtins) != want {
+		t.Errorf("EvalError frames Builtin = %v, want %s", builtins, want)
+	}
+}
+
+var errSentinel = errors.New("sentinel")
+
+// TestErrorSpan ensures that errors from built-ins can be matched
+// through an EvalError and that the error carries the source span
+// of the failing operation.
+func TestErrorSpan(t *testing.T) {
+	const src = `
+def f(): return fail_with(1, 2)
+f()
+`
+	failWith := starlark.NewBuiltin("fail_with", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return nil, fmt.Errorf("fail_with: %w", errSentinel)
+	})
+	thread := new(starlark.Thread)
+	_, err := starlark.ExecFile(thread, "span.star", src, starlark.StringDict{"fail_with": failWith})
+	if !errors.Is(err, errSentinel) {
+		t.Errorf("errors.Is(%v, errSentinel) = false", err)
+	}
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) {
+		t.Fatalf("ExecFile returned %v, want *EvalError", err)
+	}
+	start, end := evalErr.Span()
+	if got, want := fmt.Sprintf("%s-%d:%d", start, end.Line, end.Col), "span.star:2:26-2:32"; got != want {
+		t.Errorf("Span = %s, want %s", got, want)
+	}
+}
+
 func TestLoadBacktrace(t *testing.T) {
 	// This test ensures that load() does NOT preserve stack traces,
 	// but that API callers can get them with Unwrap().
@@ -866,6 +1032,33 @@ g(z=7)
 	}
 }
 
+func TestDebugFrameLocals(t *testing.T) {
+	var got string
+	builtin := func(thread *starlark.Thread, _ *starlark.Builtin, _ starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+		got = thread.DebugFrame(1).Locals().String()
+		return starlark.None, nil
+	}
+	predeclared := starlark.StringDict{
+		"builtin": starlark.NewBuiltin("builtin", builtin),
+	}
+	_, err := starlark.ExecFile(&starlark.Thread{}, "foo.star", `
+def f(x):
+	y = x + 1
+	def g():
+		z = x * 2
+		builtin()
+		w = 0
+	g()
+f(1)
+`, predeclared)
+	if err != nil {
+		t.Fatalf("ExecFile failed: %v", err)
+	}
+	if want := `{x: 1, z: 2}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
 type badType string
 
 func (b *badType) String() string        { return "badType" }
@@ -897,6 +1090,62 @@ func TestUnpackErrorBadType(t *testing.T) {
 	}
 }
 
+func TestUnpackArgsInto(t *testing.T) {
+	type dep struct {
+		Label   string `starlark:"label,required"`
+		Private bool   `starlark:"private"`
+	}
+	type params struct {
+		Name    string         `starlark:"name,required"`
+		Srcs    []string       `starlark:"srcs"`
+		Deps    []dep          `starlark:"deps"`
+		Env     map[string]int `starlark:"env,allownone"`
+		Main    *dep           `starlark:"main"`
+		Tags    *starlark.List `starlark:"tags"`
+		Count   int            `starlark:"count"`
+		Ignored string
+	}
+	rule := func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		p := params{Count: 1, Ignored: "x"}
+		if err := starlark.UnpackArgsInto(b.Name(), args, kwargs, &p); err != nil {
+			return nil, err
+		}
+		return starlark.String(fmt.Sprintf("%+v", p)), nil
+	}
+	predeclared := starlark.StringDict{
+		"rule":   starlark.NewBuiltin("rule", rule),
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+	}
+	for _, test := range []struct{ src, want string }{
+		{`rule("a")`, `{Name:a Srcs:[] Deps:[] Env:map[] Main:<nil> Tags:<nil> Count:1 Ignored:x}`},
+		{`rule("a", ["x.go"], count=2, env=None)`, `{Name:a Srcs:[x.go] Deps:[] Env:map[] Main:<nil> Tags:<nil> Count:2 Ignored:x}`},
+		{`rule(name="a", deps=[{"label": "b"}, struct(label="c", private=True)])`, `{Name:a Srcs:[] Deps:[{Label:b Private:false} {Label:c Private:true}] Env:map[] Main:<nil> Tags:<nil> Count:1 Ignored:x}`},
+		{`rule(name="a", env={"k": 1}, main={"label": "m"}, tags=["t"])`, `{Name:a Srcs:[] Deps:[] Env:map[k:1] Main:0x`},
+		{`rule()`, `rule: missing argument for name`},
+		{`rule(srcs=[])`, `rule: missing argument for name`},
+		{`rule("a", srcs="x.go")`, `rule: for parameter "srcs": got string, want iterable`},
+		{`rule("a", srcs=["x", 2])`, `rule: for parameter "srcs": at index 1: got int, want string`},
+		{`rule("a", deps=[{"label": "b"}, {}])`, `rule: for parameter "deps": at index 1: missing field label`},
+		{`rule("a", deps=[{"label": "b", "privat": 1}])`, `rule: for parameter "deps": at index 0: unexpected field privat`},
+		{`rule("a", deps=[struct(label=1)])`, `rule: for parameter "deps": at index 0: in field label: got int, want string`},
+		{`rule("a", env={"k": "v"})`, `rule: for parameter "env": at key "k": got string, want int`},
+		{`rule("a", main=1)`, `rule: for parameter "main": got int, want dict or struct`},
+		{`rule("a", tags=())`, `rule: for parameter "tags": got tuple, want list`},
+		{`rule("a", nmae="a")`, `rule: unexpected keyword argument "nmae"`},
+	} {
+		v, err := starlark.Eval(new(starlark.Thread), "<expr>", test.src, predeclared)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = string(v.(starlark.String))
+		}
+		if !strings.HasPrefix(got, test.want) {
+			t.Errorf("%s: got %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
 // Regression test for github.com/google/starlark-go/issues/233.
 func TestREPLChunk(t *testing.T) {
 	thread := new(starlark.Thread)
@@ -952,8 +1201,459 @@ func TestCancel(t *testing.T) {
 			t.Errorf("execution returned error %q, want cancellation", err)
 		}
 	}
+	// Cancellation cannot be caught by catch.
+	{
+		defer setOptions("")
+		resolve.AllowCatch = true
+		thread := new(starlark.Thread)
+		thread.SetMaxExecutionSteps(1000)
+		_, err := starlark.ExecFile(thread, "catch.star", `
+def loop():
+	for x in range(1000000): pass
+catch(loop)
+`, nil)
+		if fmt.Sprint(err) != "Starlark computation cancelled: too many steps" {
+			t.Errorf("execution returned error %q, want cancellation", err)
+		}
+	}
+	// Nor can the internal error of a built-in that returns nil.
+	{
+		defer setOptions("")
+		resolve.AllowCatch = true
+		predeclared := starlark.StringDict{
+			"broken": starlark.NewBuiltin("broken", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				return nil, nil
+			}),
+		}
+		_, err := starlark.ExecFile(new(starlark.Thread), "catch.star", `catch(broken)`, predeclared)
+		if got := fmt.Sprint(err); !strings.Contains(got, "internal error: nil (not None) returned from") {
+			t.Errorf("execution returned error %q, want internal error", got)
+		}
+	}
+}
+
+// TestFuture exercises built-ins that complete asynchronously.
+func TestFuture(t *testing.T) {
+	// fetch(x) returns a future that another goroutine completes with
+	// x*2, or an error if x is negative. hang() never completes.
+	started := make(chan struct{}, 1)
+	predeclared := starlark.StringDict{
+		"fetch": starlark.NewBuiltin("fetch", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x int
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+				return nil, err
+			}
+			f := starlark.NewFuture()
+			go func() {
+				if x < 0 {
+					f.Complete(nil, fmt.Errorf("negative"))
+				} else {
+					f.Complete(starlark.MakeInt(x*2), nil)
+				}
+			}()
+			return f, nil
+		}),
+		"hang": starlark.NewBuiltin("hang", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			started <- struct{}{}
+			return starlark.NewFuture(), nil
+		}),
+	}
+
+	thread := new(starlark.Thread)
+	globals, err := starlark.ExecFile(thread, "future.star", `x = [fetch(i) for i in range(3)]`, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["x"].String(), "[0, 2, 4]"; got != want {
+		t.Errorf("x = %s, want %s", got, want)
+	}
+
+	_, err = starlark.ExecFile(thread, "future.star", `fetch(-1)`, predeclared)
+	if got, want := fmt.Sprint(err), "negative"; got != want {
+		t.Errorf("fetch(-1) failed with %q, want %q", got, want)
+	}
+
+	// A thread awaiting a future may be cancelled.
+	go func() {
+		<-started
+		thread.Cancel("timeout")
+	}()
+	_, err = starlark.ExecFile(thread, "future.star", `hang()`, predeclared)
+	if got, want := fmt.Sprint(err), "Starlark computation cancelled: timeout"; got != want {
+		t.Errorf("hang() failed with %q, want %q", got, want)
+	}
+
+	// Completion is idempotent and observable.
+	f := starlark.NewFuture()
+	if v, err := f.Result(); v != nil || err != nil {
+		t.Errorf("incomplete future has result (%v, %v)", v, err)
+	}
+	f.Complete(starlark.True, nil)
+	f.Complete(starlark.False, nil)
+	<-f.Done()
+	if v, err := f.Result(); v != starlark.True || err != nil {
+		t.Errorf("completed future has result (%v, %v), want (True, nil)", v, err)
+	}
+}
+
+// TestTimeSleep exercises the time module's use of the thread's clock.
+func TestTimeSleep(t *testing.T) {
+	start := gotime.Date(2021, 1, 1, 0, 0, 0, 0, gotime.UTC)
+	clock := time.NewFakeClock(start)
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	time.SetClock(thread, clock)
+	const src = `
+load("assert.star", "assert")
+load("time.star", "time")
+
+t0 = time.now()
+time.sleep(time.hour)
+assert.eq(time.now() - t0, time.hour)
+
+r = time.rate_limiter(time.second, burst = 3)
+def work():
+    for _ in range(10):
+        r.wait()
+work()
+assert.eq(time.now() - t0, time.hour + 7 * time.second)
+`
+	if _, err := starlark.ExecFile(thread, "sleep.star", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clock.Now().Sub(start), gotime.Hour+7*gotime.Second; got != want {
+		t.Errorf("clock advanced by %v, want %v", got, want)
+	}
+
+	// A thread sleeping on the system clock may be cancelled.
+	thread = &starlark.Thread{Load: load}
+	gotime.AfterFunc(10*gotime.Millisecond, func() { thread.Cancel("timeout") })
+	_, err := starlark.ExecFile(thread, "sleep.star", `load("time.star", "time"); time.sleep("1h")`, nil)
+	if got, want := fmt.Sprint(err), "Starlark computation cancelled: timeout"; got != want {
+		t.Errorf("sleep failed with %q, want %q", got, want)
+	}
+}
+
+func TestFinalizers(t *testing.T) {
+	// open(name) acquires a resource, returning a handle
+	// whose close method releases it.
+	var log []string
+	open := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+			return nil, err
+		}
+		log = append(log, "open "+name)
+		fin := thread.Finalize(func() error {
+			log = append(log, "close "+name)
+			if name == "bad" {
+				return fmt.Errorf("close %s failed", name)
+			}
+			return nil
+		})
+		close := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return starlark.None, fin.Release()
+		}
+		return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"close": starlark.NewBuiltin("close", close),
+		}), nil
+	}
+	predeclared := starlark.StringDict{"open": starlark.NewBuiltin("open", open)}
+
+	thread := new(starlark.Thread)
+	_, err := starlark.ExecFile(thread, "fin.star", `
+a = open("a")
+b = open("bad")
+c = open("c")
+c.close()
+c.close() # no-op
+d = open("d")
+`, predeclared)
+	// The execution releases the outstanding resources when it
+	// finishes, and fails with the first error of a finalizer.
+	if fmt.Sprint(err) != "close bad failed" {
+		t.Errorf("ExecFile returned %v, want close error", err)
+	}
+	if err := thread.RunFinalizers(); err != nil {
+		t.Errorf("RunFinalizers returned %v", err)
+	}
+	got := strings.Join(log, ", ")
+	want := "open a, open bad, open c, close c, open d, close d, close bad, close a"
+	if got != want {
+		t.Errorf("got log %s, want %s", got, want)
+	}
+
+	// Finalizers run before the OnDone hooks, even when the
+	// execution fails, and leave its error alone.
+	log = nil
+	thread.OnDone(func(err error) { log = append(log, "done: "+err.Error()) })
+	_, err = starlark.ExecFile(thread, "fin.star", `
+e = open("e")
+fail("oops")
+`, predeclared)
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("ExecFile returned %v, want oops", err)
+	}
+	got = strings.Join(log, ", ")
+	want = "open e, close e, done: fail: oops"
+	if got != want {
+		t.Errorf("got log %s, want %s", got, want)
+	}
+}
+
+func TestOnDone(t *testing.T) {
+	var log []string
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{
+		"hook": starlark.NewBuiltin("hook", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			name := args[0].String()
+			thread.OnDone(func(err error) {
+				log = append(log, fmt.Sprintf("%s: depth=%d err=%v", name, thread.CallStackDepth(), err))
+			})
+			return starlark.None, nil
+		}),
+	}
+
+	// Hooks are called once, after the outermost call.
+	if _, err := starlark.ExecFile(thread, "done.star", `
+def f(): hook(2)
+hook(1)
+f()
+`, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := starlark.ExecFile(thread, "done.star", `hook(3); 1//0`, predeclared); err == nil {
+		t.Fatal("ExecFile succeeded unexpectedly")
+	}
+	if _, err := starlark.ExecFile(thread, "done.star", `pass`, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(log, "\n")
+	want := `1: depth=0 err=<nil>
+2: depth=0 err=<nil>
+3: depth=0 err=floored division by zero`
+	if got != want {
+		t.Errorf("got log:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestInitOrdered(t *testing.T) {
+	_, prog, err := starlark.SourceProgram("ordered.star", `
+z = 1
+def f(): pass
+x, b = 1, 2
+def g():
+	if False:
+		never = 0
+a = [z, b]
+`, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals, err := prog.InitOrdered(new(starlark.Thread), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(globals.Keys(), " "), "z f x b g a"; got != want {
+		t.Errorf("keys = %s, want %s", got, want)
+	}
+	if got, want := globals.String(), "{z: 1, f: <function f>, x: 1, b: 2, g: <function g>, a: [1, 2]}"; got != want {
+		t.Errorf("globals = %s, want %s", got, want)
+	}
+	if k, v := globals.KeyIndex(5); k != "a" || v.String() != "[1, 2]" {
+		t.Errorf("KeyIndex(5) = %s, %v", k, v)
+	}
+	if got, want := globals.StringDict().String(), "{a: [1, 2], b: 2, f: <function f>, g: <function g>, x: 1, z: 1}"; got != want {
+		t.Errorf("StringDict = %s, want %s", got, want)
+	}
+}
+
+func TestOrderedStringDict(t *testing.T) {
+	d := new(starlark.OrderedStringDict)
+	for i, k := range []string{"a", "b", "c", "d"} {
+		if !d.Insert(k, starlark.MakeInt(i)) {
+			t.Errorf("Insert(%s) reported existing key", k)
+		}
+	}
+	if d.Insert("b", starlark.MakeInt(10)) {
+		t.Errorf("Insert(b) reported new key")
+	}
+	if v, found := d.Delete("b"); !found || v != starlark.MakeInt(10) {
+		t.Errorf("Delete(b) = %v, %t", v, found)
+	}
+	if _, found := d.Delete("b"); found {
+		t.Errorf("second Delete(b) succeeded")
+	}
+	d.Set("b", starlark.MakeInt(20))
+	if got, want := d.String(), "{a: 0, c: 2, d: 3, b: 20}"; got != want {
+		t.Errorf("dict = %s, want %s", got, want)
+	}
+	// The index of each key reflects its new position.
+	for i, k := range d.Keys() {
+		if k2, _ := d.KeyIndex(i); k2 != k {
+			t.Errorf("KeyIndex(%d) = %s, want %s", i, k2, k)
+		}
+		if v, ok := d.Get(k); !ok || v == nil {
+			t.Errorf("Get(%s) failed", k)
+		}
+	}
+	d.Delete("a")
+	d.Delete("d")
+	if got, want := d.String(), "{c: 2, b: 20}"; got != want || d.Len() != 2 {
+		t.Errorf("dict = %s (len %d), want %s", got, d.Len(), want)
+	}
+}
+
+// TestGeneratorThreads checks that a generator may be resumed
+// only by the thread that created it.
+func TestGeneratorThreads(t *testing.T) {
+	const src = `
+# option:yield option:lazyiter
+def gen():
+    yield 1
+    yield 2
+`
+	setOptions(src)
+	defer setOptions("")
+
+	creator := new(starlark.Thread)
+	globals, err := starlark.ExecFile(creator, "gen.star", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := starlark.Call(creator, globals["gen"], nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	if _, err := starlark.ExecFile(thread, "main.star", `
+load("assert.star", "assert")
+want = "cannot resume generator created by another thread"
+def loop():
+    for x in g:
+        pass
+assert.fails(loop, want)
+assert.fails(lambda: list(g), want)
+assert.fails(lambda: [x for x in g], want)
+assert.fails(lambda: list(enumerate(g)), want)
+assert.fails(lambda: list(reversed(g)), want)
+assert.fails(lambda: list(zip(g, g)), want)
+assert.fails(lambda: g.send(None), want)
+`, starlark.StringDict{"g": g}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The creator may still resume it.
+	list, err := starlark.Call(creator, starlark.Universe["list"], starlark.Tuple{g}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list.String(), "[1, 2]"; got != want {
+		t.Errorf("list(g) = %s, want %s", got, want)
+	}
+}
+
+// TestFrozenLazyIterables checks that a frozen map or filter value
+// may be iterated by a thread other than the one that created it.
+func TestFrozenLazyIterables(t *testing.T) {
+	creator := new(starlark.Thread)
+	globals, err := starlark.ExecFile(creator, "lib.star", `
+m = map(lambda x: x * 2, [1, 2, 3])
+evens = filter(lambda x: x % 2 == 0, range(5))
+bad = map(lambda x: 1 // x, [1, 0, 2])
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator.Cancel("done") // the creator can no longer call functions
+
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	if _, err := starlark.ExecFile(thread, "main.star", `
+load("assert.star", "assert")
+assert.eq(list(m), [2, 4, 6])
+assert.eq(list(m), [2, 4, 6])
+assert.eq(list(evens), [0, 2, 4])
+assert.fails(lambda: list(bad), "division by zero")
+`, globals); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealedModule(t *testing.T) {
+	_, prog, err := starlark.SourceProgram("lib.star", `
+primes = [2, 3, 5, 7]
+config = {"name": "lib", "tags": ["a", "b"]}
+def is_prime(n): return n in primes
+`, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals, err := prog.InitOrdered(new(starlark.Thread), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib, err := starlark.Seal("lib", globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(lib.Keys(), " "), "primes config is_prime"; got != want {
+		t.Errorf("keys = %s, want %s", got, want)
+	}
+
+	// Many threads share the module without copying it.
+	// (Run with -race to check that they do not interfere.)
+	const src = `
+n = len([x for x in range(10) if is_prime(x)])
+tags = config["tags"] + ["c"]
+primes.append(11)
+`
+	var wg sync.WaitGroup
+	errs := make([]error, 50)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			thread := &starlark.Thread{Name: fmt.Sprint(i)}
+			_, errs[i] = starlark.ExecFile(thread, "main.star", src, lib.StringDict())
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if got, want := fmt.Sprint(err), "cannot append to frozen list"; !strings.Contains(got, want) {
+			t.Fatalf("ExecFile: got %s, want error containing %q", got, want)
+		}
+	}
+	if v, _ := lib.Get("primes"); v.String() != "[2, 3, 5, 7]" {
+		t.Errorf("primes = %s", v)
+	}
+
+	// A value whose Freeze method leaks a mutable value is rejected.
+	globals = starlark.NewOrderedStringDict(1)
+	globals.Set("box", leakyBox{starlark.NewList(nil)})
+	if _, err := starlark.Seal("bad", globals); err == nil {
+		t.Error("Seal of leaky value succeeded")
+	} else if got, want := err.Error(), "sealing module bad: bad.box.elem is an unfrozen list"; got != want {
+		t.Errorf("Seal: got %s, want %s", got, want)
+	}
 }
 
+// A leakyBox is a value whose Freeze method does not freeze its element.
+type leakyBox struct{ elem *starlark.List }
+
+var _ starlark.FreezeCheckable = leakyBox{}
+
+func (leakyBox) String() string        { return "leakyBox" }
+func (leakyBox) Type() string          { return "leakyBox" }
+func (leakyBox) Freeze()               {}
+func (leakyBox) Truth() starlark.Bool  { return true }
+func (leakyBox) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable") }
+func (leakyBox) Frozen() bool          { return true }
+
+func (b leakyBox) Referents(visit func(path string, v starlark.Value)) { visit(".elem", b.elem) }
+
 func TestExecutionSteps(t *testing.T) {
 	// A Thread records the number of computation steps.
 	thread := new(starlark.Thread)
@@ -1060,3 +1760,929 @@ main()
 		}()
 	}
 }
+
+func TestStub(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"now": starlark.NewBuiltin("now", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+			return nil, fmt.Errorf("not hermetic")
+		}),
+	}
+	orig := predeclared["now"]
+	prog := `x = now("utc", precise=True)`
+
+	t.Run("stubbed", func(t *testing.T) {
+		mock := starlarktest.NewMock("now", starlark.MakeInt(42))
+		starlarktest.Stub(t, predeclared, "now", mock)
+		starlarktest.Stub(t, predeclared, "extra", starlark.None)
+		globals, err := starlark.ExecFile(new(starlark.Thread), "stub.star", prog, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := globals["x"].String(); got != "42" {
+			t.Errorf("x = %s, want 42", got)
+		}
+		if len(mock.Calls) != 1 || mock.Calls[0].Args.String() != `("utc",)` || len(mock.Calls[0].Kwargs) != 1 {
+			t.Errorf("unexpected calls: %v", mock.Calls)
+		}
+	})
+
+	if predeclared["now"] != orig || predeclared.Has("extra") {
+		t.Errorf("stubs not restored: %v", predeclared)
+	}
+}
+
+func TestRunner(t *testing.T) {
+	runner := &starlarktest.Runner{
+		Parallel:     true,
+		Coverage:     starlark.NewCoverage(),
+		CoverProfile: filepath.Join(t.TempDir(), "cover.out"),
+	}
+	t.Run("files", func(t *testing.T) {
+		runner.Run(t, starlarktest.DataFile("starlark", "testdata/runner.star"))
+	})
+
+	// helper is never called.
+	files := runner.Coverage.Files()
+	if len(files) != 1 || len(files[0].Covered) != len(files[0].Lines)-1 {
+		t.Errorf("unexpected coverage: %+v", files)
+	}
+	if _, err := os.Stat(runner.CoverProfile); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	cov := starlark.NewCoverage()
+	thread := &starlark.Thread{Coverage: cov}
+	_, err := starlark.ExecFile(thread, "cov.star", `
+def f(x):
+    if x:
+        return 1
+    return 2
+
+def unused():
+    pass
+
+f(True)
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := cov.Files()
+	if len(files) != 1 {
+		t.Fatalf("got %d files, want 1", len(files))
+	}
+	if got, want := fmt.Sprint(files[0].Lines), "[2 3 4 5 7 8 10]"; got != want {
+		t.Errorf("lines = %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(files[0].Covered), "[2 3 4 7 10]"; got != want {
+		t.Errorf("covered = %s, want %s", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := cov.WriteProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "mode: set\ncov.star:2.1,3.1 1 1\n") {
+		t.Errorf("unexpected profile:\n%s", buf.String())
+	}
+}
+
+// A sized is a value that has a length but is neither iterable nor indexable.
+type sized int
+
+func (sized) Freeze()               {}
+func (sized) String() string        { return "sized" }
+func (sized) Type() string          { return "sized" }
+func (sized) Truth() starlark.Bool  { return true }
+func (sized) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: sized") }
+func (s sized) Len() int            { return int(s) }
+
+func TestSized(t *testing.T) {
+	predeclared := starlark.StringDict{"x": sized(7)}
+	v, err := starlark.Eval(new(starlark.Thread), "<expr>", "len(x)", predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.String() != "7" {
+		t.Errorf("len(x) = %s, want 7", v)
+	}
+	if _, err := starlark.Eval(new(starlark.Thread), "<expr>", "list(x)", predeclared); err == nil {
+		t.Error("list(x) succeeded unexpectedly")
+	}
+}
+
+func TestExecCompiled(t *testing.T) {
+	predeclared := starlark.StringDict{"k": starlark.MakeInt(2)}
+	_, prog, err := starlark.SourceProgram("prog.star", "x = [k] * 3", predeclared.Has)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := prog.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	globals, err := starlark.ExecCompiled(new(starlark.Thread), buf.Bytes(), predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["x"].String(); got != "[2, 2, 2]" {
+		t.Errorf("x = %s, want [2, 2, 2]", got)
+	}
+	if err := globals["x"].(*starlark.List).Append(starlark.None); err == nil {
+		t.Errorf("global x is not frozen")
+	}
+	if _, err := starlark.ExecCompiled(new(starlark.Thread), buf.Bytes()[:10], predeclared); err == nil {
+		t.Errorf("ExecCompiled of truncated program succeeded unexpectedly")
+	}
+}
+
+func TestExecProfile(t *testing.T) {
+	const src = `
+def f(x):
+    if x < 100:
+        return "small"
+    return "big"
+
+y = [f(i) for i in range(10)]
+`
+	// Gather a profile.
+	_, prog, err := starlark.SourceProgram("prog.star", src, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := starlark.NewExecProfile()
+	thread := &starlark.Thread{ExecProfile: profile}
+	if _, err := prog.Init(thread, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Save and restore it.
+	var buf1, buf2 bytes.Buffer
+	if err := profile.Write(&buf1); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf1.String(), `func "prog.star:2:1 f" `) {
+		t.Errorf("profile lacks function f:\n%s", buf1.String())
+	}
+	saved, err := starlark.ReadExecProfile(bytes.NewReader(buf1.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.Write(&buf2); err != nil {
+		t.Fatal(err)
+	}
+	if buf1.String() != buf2.String() {
+		t.Errorf("profile changed after reading and writing:\n%s\nvs.\n%s", buf1.String(), buf2.String())
+	}
+
+	// Compile using the profile: the cold return
+	// is placed last, but the program has the same meaning.
+	f, err := syntax.Parse("prog.star", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized, err := starlark.FileProgramWithProfile(f, func(string) bool { return false }, saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Disassemble(nil) == optimized.Disassemble(nil) {
+		t.Errorf("profile did not change the code:\n%s", optimized.Disassemble(nil))
+	}
+	globals, err := optimized.Init(new(starlark.Thread), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["y"].String(), `["small", "small", "small", "small", "small", "small", "small", "small", "small", "small"]`; got != want {
+		t.Errorf("y = %s, want %s", got, want)
+	}
+
+	if _, err := starlark.ReadExecProfile(strings.NewReader("garbage\n")); err == nil {
+		t.Errorf("ReadExecProfile(garbage) succeeded unexpectedly")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	const src = `
+def f(x):
+    return x + 1
+
+y = f(1)
+`
+	_, prog, err := starlark.SourceProgram("trace.star", src, func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(tracer *starlark.Tracer) {
+		thread := &starlark.Thread{Tracer: tracer}
+		if _, err := prog.Init(thread, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Trace every instruction.
+	var events []string
+	run(&starlark.Tracer{Func: func(thread *starlark.Thread, ev *starlark.TraceEvent) {
+		events = append(events, ev.String())
+	}})
+	got := strings.Join(events, "\n")
+	for _, want := range []string{
+		"trace.star:5:6 <toplevel>@10: call 256 [2] top=int 1",
+		"trace.star:3:12 f@2: constant 0 [1] top=int 1",
+		"trace.star:3:14 f@4: plus [2] top=int 1",
+		"trace.star:3:14 f@5: return [1] top=int 2",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("trace lacks %q:\n%s", want, got)
+		}
+	}
+	all := len(events)
+
+	// Sample every third instruction.
+	n := 0
+	run(&starlark.Tracer{Every: 3, Func: func(thread *starlark.Thread, ev *starlark.TraceEvent) { n++ }})
+	if n != all/3 {
+		t.Errorf("Every=3 traced %d of %d instructions, want %d", n, all, all/3)
+	}
+
+	// Limit the rate: the first event is permitted,
+	// and the rest are dropped.
+	n = 0
+	run(&starlark.Tracer{MaxPerSecond: 1e-3, Func: func(thread *starlark.Thread, ev *starlark.TraceEvent) { n++ }})
+	if n != 1 {
+		t.Errorf("MaxPerSecond traced %d instructions, want 1", n)
+	}
+}
+
+// spanLog is an Instrumenter that records the start and end of each span.
+type spanLog []string
+
+func (log *spanLog) StartSpan(thread *starlark.Thread, span *starlark.Span) {
+	*log = append(*log, fmt.Sprintf("start %s %s", span.Kind, span.Name))
+}
+
+func (log *spanLog) EndSpan(thread *starlark.Thread, span *starlark.Span) {
+	*log = append(*log, fmt.Sprintf("end %s %s err=%v", span.Kind, span.Name, span.Err != nil))
+}
+
+func TestInstrumenter(t *testing.T) {
+	modules := map[string]string{
+		"a.star": `load("b.star", "f"); f()`,
+		"b.star": `def f(): len([])`,
+	}
+	var log spanLog
+	thread := &starlark.Thread{Instrumenter: &log}
+	thread.Load = func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+		return starlark.ExecFile(thread, module, modules[module], nil)
+	}
+	if _, err := starlark.ExecFile(thread, "a.star", modules["a.star"], nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `start exec a.star
+start load b.star
+start exec b.star
+end exec b.star err=false
+end load b.star err=false
+end exec a.star err=false`
+	if got := strings.Join(log, "\n"); got != want {
+		t.Errorf("spans were:\n%s\nwant:\n%s", got, want)
+	}
+
+	// With a (tiny) threshold, calls are reported too,
+	// each when it returns.
+	log = nil
+	thread.CallSpanThreshold = 1
+	if _, err := starlark.ExecFile(thread, "b.star", modules["b.star"]+"\nf()", nil); err != nil {
+		t.Fatal(err)
+	}
+	want = `start exec b.star
+start call len
+end call len err=false
+start call f
+end call f err=false
+start call <toplevel>
+end call <toplevel> err=false
+end exec b.star err=false`
+	if got := strings.Join(log, "\n"); got != want {
+		t.Errorf("spans were:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// metricsLog is a MetricsSink that records the sum of each metric.
+type metricsLog struct {
+	mu    sync.Mutex
+	count map[string]int64
+	sum   map[string]float64
+}
+
+func (m *metricsLog) Count(name string, delta int64) {
+	m.mu.Lock()
+	m.count[name] += delta
+	m.mu.Unlock()
+}
+
+func (m *metricsLog) Observe(name string, value float64) {
+	m.mu.Lock()
+	m.sum[name] += value
+	m.mu.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	m := &metricsLog{count: make(map[string]int64), sum: make(map[string]float64)}
+	starlark.SetMetricsSink(m)
+	defer starlark.SetMetricsSink(nil)
+
+	thread := new(starlark.Thread)
+	if _, err := starlark.ExecFile(thread, "metrics.star", "d = {i: i for i in range(100)}", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.sum[starlark.MetricSteps], float64(thread.ExecutionSteps()); got != want {
+		t.Errorf("%s = %v, want %v", starlark.MetricSteps, got, want)
+	}
+	if m.count[starlark.MetricDictGrowths] == 0 {
+		t.Errorf("%s was not reported", starlark.MetricDictGrowths)
+	}
+	if _, ok := m.sum[starlark.MetricCompileSeconds]; !ok {
+		t.Errorf("%s was not reported", starlark.MetricCompileSeconds)
+	}
+}
+
+func TestHeapDump(t *testing.T) {
+	thread := new(starlark.Thread)
+	a, err := starlark.ExecFile(thread, "a.star", `
+shared = ["x" * 100]
+def f(): return shared
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := starlark.ExecFile(thread, "b.star", `big = {i: str(i) for i in range(1000)}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d starlark.HeapDump
+	d.AddGlobals("a.star", a)
+	d.AddGlobals("b.star", b)
+	d.AddValue("shared", a["shared"]) // already attributed to a.star
+	if len(d.Roots) != 3 {
+		t.Fatalf("got %d roots, want 3", len(d.Roots))
+	}
+	if r := d.Roots[1]; r.Bytes <= d.Roots[0].Bytes || r.Types[0].Type != "dict" {
+		t.Errorf("b.star: got %+v, want largest root dominated by dict", r)
+	}
+	if r := d.Roots[2]; r.Values != 0 {
+		t.Errorf("shared: got %d values, want 0", r.Values)
+	}
+	if d.Values != d.Roots[0].Values+d.Roots[1].Values {
+		t.Errorf("total of %d values is not the sum of the roots", d.Values)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := d.WriteJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"name":"b.star"`) {
+		t.Errorf("JSON lacks root b.star: %s", buf)
+	}
+}
+
+func TestIteratorLeakCheck(t *testing.T) {
+	starlark.SetIteratorLeakCheck(true)
+	defer starlark.SetIteratorLeakCheck(false)
+
+	// leak iterates over its argument but never calls Done.
+	leak := starlark.NewBuiltin("leak", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		iter := starlark.Iterate(args[0])
+		var x starlark.Value
+		iter.Next(&x)
+		return starlark.None, nil
+	})
+	const src = `
+x = [1, 2, 3]
+d = {y: y for y in x}
+def f(): leak(d)
+f()
+`
+	var leaks []string
+	thread := &starlark.Thread{
+		OnIteratorLeak: func(thread *starlark.Thread, leak *starlark.IteratorLeak) {
+			leaks = append(leaks, fmt.Sprintf("%s at %s", leak.Type, leak.CallStack.At(1).Pos))
+		},
+	}
+	if _, err := starlark.ExecFile(thread, "leak.star", src, starlark.StringDict{"leak": leak}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(leaks), "[dict at leak.star:4:14]"; got != want {
+		t.Errorf("leaks = %s, want %s", got, want)
+	}
+
+	// A module loaded on the same goroutine by another thread
+	// does not end the check of the loading thread.
+	leaks = nil
+	thread.Load = func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+		return starlark.ExecFile(&starlark.Thread{Name: module}, module, "x = 1", nil)
+	}
+	const src2 = `
+load("lib.star", "x")
+leak([x])
+`
+	if _, err := starlark.ExecFile(thread, "leak2.star", src2, starlark.StringDict{"leak": leak}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(leaks), "[list at leak2.star:3:5]"; got != want {
+		t.Errorf("leaks after load = %s, want %s", got, want)
+	}
+}
+
+func TestSlowCall(t *testing.T) {
+	// hang blocks in Go until the watchdog has reported it,
+	// so the report must arrive while the call is outstanding.
+	reported := make(chan *starlark.SlowCall, 1)
+	hang := starlark.NewBuiltin("hang", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		select {
+		case call := <-reported:
+			return starlark.String(fmt.Sprintf("%s at %s, returned=%t", call.Frame().Name, call.CallStack.At(1).Pos, call.Returned)), nil
+		case <-gotime.After(10 * gotime.Second):
+			return nil, fmt.Errorf("hang was not reported")
+		}
+	})
+	const src = `
+def f():
+    return hang()
+x = f()
+`
+	thread := &starlark.Thread{
+		OnSlowCall: func(thread *starlark.Thread, call *starlark.SlowCall) {
+			if call.Frame().Name == "hang" {
+				reported <- call
+			}
+		},
+		SlowCallThreshold: 20 * gotime.Millisecond,
+	}
+	globals, err := starlark.ExecFile(thread, "slow.star", src, starlark.StringDict{"hang": hang})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["x"], starlark.String("hang at slow.star:3:16, returned=false"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// With a tiny threshold, reports race with the execution of the
+	// program; run with -race to check that they do so safely.
+	var mu sync.Mutex
+	names := make(map[string]bool)
+	thread = &starlark.Thread{
+		OnSlowCall: func(thread *starlark.Thread, call *starlark.SlowCall) {
+			mu.Lock()
+			names[call.Frame().Name] = true
+			mu.Unlock()
+		},
+		SlowCallThreshold: 1,
+	}
+	const loop = `
+def g(n):
+    return [str(i) for i in range(n)]
+x = [g(100) for i in range(100)]
+`
+	if _, err := starlark.ExecFile(thread, "loop.star", loop, nil); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !names["<toplevel>"] {
+		t.Errorf("slow toplevel not reported; got %v", names)
+	}
+}
+
+func TestThreadRegistry(t *testing.T) {
+	const src = `
+def f():
+    for i in range(1000):
+        pass
+    status()
+f()
+`
+	var registry starlark.ThreadRegistry
+	var got []starlark.ThreadStatus
+	status := starlark.NewBuiltin("status", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		got = registry.Threads()
+		return starlark.None, nil
+	})
+	thread := &starlark.Thread{Name: "worker", Registry: &registry}
+	if _, err := starlark.ExecFile(thread, "status.star", src, starlark.StringDict{"status": status}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d threads, want 1", len(got))
+	}
+	if st := got[0]; st.Thread != thread || st.Name != "worker" || st.Function != "f" || st.Pos.Line != 3 || st.Steps < 1000 {
+		t.Errorf("got status %+v", st)
+	}
+	if n := len(registry.Threads()); n != 0 {
+		t.Errorf("got %d threads after execution, want 0", n)
+	}
+}
+
+// TestMemoizeThreadScoped ensures that the cache of a memoized
+// function belongs to the calling thread.
+func TestMemoizeThreadScoped(t *testing.T) {
+	const src = `
+def _f(x):
+    count()
+    return x
+
+f = memoize(_f)
+`
+	var calls int
+	count := starlark.NewBuiltin("count", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		calls++
+		return starlark.None, nil
+	})
+	globals, err := starlark.ExecFile(new(starlark.Thread), "memo.star", src, starlark.StringDict{"count": count})
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals.Freeze()
+	f := globals["f"]
+	for _, thread := range []*starlark.Thread{new(starlark.Thread), new(starlark.Thread)} {
+		for i := 0; i < 3; i++ {
+			if _, err := starlark.Call(thread, f, starlark.Tuple{starlark.MakeInt(1)}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if calls != 2 {
+		t.Errorf("got %d calls, want 2 (one per thread)", calls)
+	}
+}
+
+func TestLoadLazy(t *testing.T) {
+	defer func(prev bool) { resolve.LoadBindsGlobally = prev }(resolve.LoadBindsGlobally)
+
+	modules := map[string]string{
+		"a.star": "x = 1",
+		"b.star": "y = 2",
+		"c.star": "z = 3",
+	}
+	var loaded []string
+	newThread := func() *starlark.Thread {
+		return &starlark.Thread{
+			LoadLazy: func(thread *starlark.Thread, module string) (func(*starlark.Thread) (starlark.StringDict, error), error) {
+				if _, ok := modules[module]; !ok {
+					return nil, fmt.Errorf("no such module")
+				}
+				return func(thread *starlark.Thread) (starlark.StringDict, error) {
+					loaded = append(loaded, module)
+					return starlark.ExecFile(thread, module, modules[module], nil)
+				}, nil
+			},
+		}
+	}
+
+	// Only modules whose names are used are executed,
+	// and only upon first use.
+	const src = `
+load("a.star", "x")
+load("b.star", "y")
+load("c.star", "z")
+result = x + 1
+def f():
+    return y
+`
+	thread := newThread()
+	globals, err := starlark.ExecFile(thread, "lazy.star", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(loaded); got != "[a.star]" {
+		t.Errorf("after init, loaded %s, want [a.star]", got)
+	}
+	for i := 0; i < 2; i++ {
+		v, err := starlark.Call(thread, globals["f"], nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != starlark.MakeInt(2) {
+			t.Errorf("f() = %v, want 2", v)
+		}
+	}
+	if got := fmt.Sprint(loaded); got != "[a.star b.star]" {
+		t.Errorf("after f(), loaded %s, want [a.star b.star]", got)
+	}
+
+	// Errors are reported upon first use, except for unknown modules.
+	for _, test := range []struct{ src, want string }{
+		{`load("a.star", "nope")`, ""},
+		{`load("a.star", y="xx")` + "\nprint(y)", "load: name xx not found in module a.star"},
+		{`load("d.star", "d")`, "cannot load d.star: no such module"},
+	} {
+		_, err := starlark.ExecFile(newThread(), "lazy.star", test.src, nil)
+		if got := fmt.Sprint(err); test.want == "" && err != nil || test.want != "" && !strings.Contains(got, test.want) {
+			t.Errorf("%s: got error %v, want %q", test.src, err, test.want)
+		}
+	}
+
+	// Globals bound by load statements are forced
+	// when the module's initialization completes.
+	resolve.LoadBindsGlobally = true
+	loaded = nil
+	globals, err = starlark.ExecFile(newThread(), "lazy.star", `load("c.star", "z")`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(loaded, globals["z"]); got != "[c.star] 3" {
+		t.Errorf("got %s, want [c.star] 3", got)
+	}
+
+	// After an error, the partial globals hold no lazy bindings.
+	loaded = nil
+	globals, err = starlark.ExecFile(newThread(), "lazy.star", `load("c.star", "z"); w = 1; fail("oops")`, nil)
+	if err == nil {
+		t.Fatal("ExecFile succeeded unexpectedly")
+	}
+	if _, ok := globals["z"]; ok || globals["w"] != starlark.MakeInt(1) {
+		t.Errorf("partial globals after error = %v, want w only", globals)
+	}
+	for _, v := range globals {
+		v.Truth() // must not panic
+	}
+}
+
+func TestPool(t *testing.T) {
+	var loads []string
+	pool := &starlark.Pool{
+		Predeclared: starlark.StringDict{"shared": starlark.NewList(nil)},
+		Preload:     []string{"lib.star"},
+		Load: func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+			loads = append(loads, module)
+			if module != "lib.star" {
+				return nil, fmt.Errorf("no such module")
+			}
+			return starlark.ExecFile(thread, module, "def double(x): return 2 * x", nil)
+		},
+		Init: func(thread *starlark.Thread) { thread.Name = "request" },
+	}
+
+	// Requests may use preloaded modules, but not modify shared values.
+	for i := 0; i < 3; i++ {
+		globals, err := pool.ExecFile("req.star", "load('lib.star', 'double'); y = double(21)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := globals["y"].String(); got != "42" {
+			t.Errorf("y = %s, want 42", got)
+		}
+	}
+	if got := fmt.Sprint(loads); got != "[lib.star]" {
+		t.Errorf("loads = %s, want [lib.star]", got)
+	}
+	if _, err := pool.ExecFile("req.star", "shared.append(1)"); err == nil || !strings.Contains(err.Error(), "frozen list") {
+		t.Errorf("modifying shared value: got %v, want frozen list error", err)
+	}
+
+	// State left by a request does not leak into the next.
+	thread, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread.SetLocal("tenant", "a")
+	thread.SetMaxExecutionSteps(10)
+	thread.Cancel("done")
+	released := false
+	thread.Finalize(func() error { released = true; return nil })
+	if err := pool.Put(thread); err != nil {
+		t.Fatal(err)
+	}
+	if !released {
+		t.Errorf("Put did not run finalizers")
+	}
+	thread, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread.Local("tenant") != nil || thread.Name != "request" {
+		t.Errorf("thread not reset: tenant=%v name=%q", thread.Local("tenant"), thread.Name)
+	}
+	if _, err := starlark.ExecFile(thread, "req.star", "x = [i for i in range(100)]", pool.Predeclared); err != nil {
+		t.Errorf("reused thread: %v", err)
+	}
+	pool.Put(thread)
+
+	// A preloading error is reported by every Get.
+	bad := &starlark.Pool{Preload: []string{"missing.star"}, Load: pool.Load}
+	for i := 0; i < 2; i++ {
+		if _, err := bad.Get(); err == nil || !strings.Contains(err.Error(), "preloading missing.star: no such module") {
+			t.Errorf("Get = %v, want preloading error", err)
+		}
+	}
+}
+
+func TestCancelGroup(t *testing.T) {
+	const loop = `
+def f():
+    for i in range(1 << 60):
+        pass
+f()
+`
+	var g starlark.CancelGroup
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src := loop
+			if i == 0 {
+				src = "fail('boom')"
+			}
+			thread := &starlark.Thread{Name: fmt.Sprint(i)}
+			errs[i] = g.Run(thread, func(thread *starlark.Thread) error {
+				_, err := starlark.ExecFile(thread, "group.star", src, nil)
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+
+	// The first failure cancels the other threads.
+	if got := fmt.Sprint(errs[0]); !strings.Contains(got, "boom") {
+		t.Errorf("thread 0 failed with %q, want boom", got)
+	}
+	for _, err := range errs[1:] {
+		if got := fmt.Sprint(err); !strings.Contains(got, "Starlark computation cancelled: fail: boom") {
+			t.Errorf("thread failed with %q, want cancellation", got)
+		}
+	}
+	if reason, ok := g.Cancelled(); !ok || reason != "fail: boom" {
+		t.Errorf("Cancelled() = %q, %t", reason, ok)
+	}
+
+	// A thread that joins a cancelled group is cancelled.
+	thread := new(starlark.Thread)
+	g.Join(thread)
+	if _, err := starlark.ExecFile(thread, "late.star", "x = 1", nil); fmt.Sprint(err) != "Starlark computation cancelled: fail: boom" {
+		t.Errorf("late thread: got %v, want cancellation", err)
+	}
+}
+
+func TestRestrictIntrospection(t *testing.T) {
+	defer setOptions("")
+	resolve.AllowCatch = true
+	resolve.FunctionAttrs = true
+
+	predeclared := starlark.StringDict{
+		"host": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{"secret": starlark.String("/etc/passwd")}),
+	}
+	var denied []string
+	thread := &starlark.Thread{
+		RestrictIntrospection: true,
+		IntrospectionPolicy: func(thread *starlark.Thread, kind starlark.IntrospectionKind, x starlark.Value) bool {
+			denied = append(denied, kind.String())
+			return false
+		},
+	}
+	for _, test := range []struct{ src, want string }{
+		{`x = dir([])`, ""},
+		{`x = dir(host)`, "dir: dir of struct is not permitted"},
+		{`def f(x=host): pass
+x = f.__params__`, "__params__ of function is not permitted"},
+		{`def f(x=host): pass
+x = getattr(f, "__params__")`, "getattr: __params__ of function is not permitted"},
+		{`x = (lambda: 1).__name__`, ""},
+		{`def f(): int("x")
+x = catch(f)[1].backtrace
+y = 1 // int(x == "int: invalid literal with base 10: x")`, ""},
+	} {
+		_, err := starlark.ExecFile(thread, "introspect.star", test.src, predeclared)
+		if got := fmt.Sprint(err); test.want == "" && err != nil || test.want != "" && !strings.Contains(got, test.want) {
+			t.Errorf("%s: got error %v, want %q", test.src, err, test.want)
+		}
+	}
+	if got := strings.Join(denied, " "); got != "dir __params__ __params__ backtrace" {
+		t.Errorf("policy consulted for [%s]", got)
+	}
+
+	// Without the restriction, introspection is permitted.
+	thread = new(starlark.Thread)
+	if _, err := starlark.ExecFile(thread, "introspect.star", "x = dir(host)", predeclared); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "corpus.star")
+	const corpus = `load("assert.star", "assert")
+assert.eq(1 + 1, 2)
+---
+x = 1 // 0 ### "division by zero"
+---
+# option:set
+load("assert.star", "assert")
+assert.eq(len(set([1, 1])), 1)
+---
+# This standard chunk fails if globals may be reassigned.
+x = 1
+x = 2 ### "cannot reassign global x"
+---
+load("assert.star", "assert")
+assert.eq(1, 2)
+`
+	if err := os.WriteFile(filename, []byte(corpus), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c := &starlarktest.Conformance{Options: []starlarktest.DialectOption{
+		{Name: "set", Flag: &resolve.AllowSet},
+		{Name: "globalreassign", Flag: &resolve.AllowGlobalReassign},
+	}}
+	report, err := c.Run(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := report.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Replace(buf.String(), filename, "corpus.star", -1)
+	want := `5 chunks in 1 files: 4 passed, 1 failed
+	FAIL corpus.star:14: Error: 1 != 2
+option set: required by 1 chunks; alters 0 standard chunks
+option globalreassign: required by 0 chunks; alters 1 standard chunks
+	ALTERED corpus.star:10: corpus.star:12: expected error matching "cannot reassign global x"
+`
+	if got != want {
+		t.Errorf("report:\n%s\nwant:\n%s", got, want)
+	}
+	if resolve.AllowSet || resolve.AllowGlobalReassign {
+		t.Errorf("options were not restored")
+	}
+
+	if testing.Verbose() {
+		// Report the conformance of the specification tests.
+		var files []string
+		for _, file := range execFiles {
+			files = append(files, filepath.Join(starlarktest.DataFile("starlark", "."), file))
+		}
+		c := &starlarktest.Conformance{
+			Predeclared: starlark.StringDict{
+				"hasfields": starlark.NewBuiltin("hasfields", newHasFields),
+				"fibonacci": fib{},
+				"struct":    starlark.NewBuiltin("struct", starlarkstruct.Make),
+				"resource":  starlark.NewBuiltin("resource", newResource),
+			},
+			Load: load,
+			Init: func(thread *starlark.Thread) { proto.SetPool(thread, protoregistry.GlobalFiles) },
+		}
+		report, err := c.Run(files...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		report.Write(&buf)
+		t.Logf("\n%s", &buf)
+	}
+}
+
+func TestBazelCompatible(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"provider": starlark.NewBuiltin("provider", starlarkstruct.MakeProvider),
+	}
+	for _, test := range []struct{ src, std, bazel string }{
+		{`"abc".elems()`, `"abc".elems()`, `"abc".elems()`},
+		{`list("ab".codepoints())`, `["a", "b"]`, `string has no .codepoints field or method`},
+		{`"x".zfill(3)`, `"00x"`, `string has no .zfill field or method`},
+		{`"zfill" in dir("")`, `True`, `False`},
+		{`hasattr("", "zfill")`, `True`, `False`},
+		{`getattr({}, "setdefault_all", None)`, `<built-in method setdefault_all of dict value>`, `None`},
+		{`{}.setdefault_all`, `<built-in method setdefault_all of dict value>`, `dict has no .setdefault_all field or method`},
+		{`"%x %d" % (255, 3)`, `"ff 3"`, `unknown conversion %x`},
+		{`"%s %r %d %%" % ("a", "b", 1)`, `"a \"b\" 1 %"`, `"a \"b\" 1 %"`},
+		{`str(provider("Info", ["x"])(x = 1))`, `"Info(x = 1)"`, `"struct(x = 1)"`},
+		{`(7 / 2, 7 // 2, -7 % 3, str(1e20))`, `(3.5, 3, 2, "1e+20")`, `(3.5, 3, 2, "1e+20")`},
+	} {
+		for _, compat := range []bool{false, true} {
+			want := test.std
+			if compat {
+				want = test.bazel
+			}
+			thread := &starlark.Thread{BazelCompatible: compat}
+			var got string
+			if v, err := starlark.Eval(thread, "<expr>", test.src, predeclared); err != nil {
+				got = err.Error()
+			} else {
+				got = v.String()
+			}
+			if !strings.Contains(got, want) {
+				t.Errorf("%s (BazelCompatible=%t) = %s, want %s", test.src, compat, got, want)
+			}
+		}
+	}
+
+	// The setting belongs to the thread, not to the values:
+	// Go calls of Attr see every method.
+	if v, err := starlark.String("x").Attr("zfill"); err != nil || v == nil {
+		t.Errorf(`String.Attr("zfill") = %v, %v`, v, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the execution profile used for
+// profile-guided compilation.
+//
+// When a thread has an ExecProfile, the interpreter counts the
+// executions of each instruction of a Starlark function in a table
+// specific to that function's code, obtained once per call. The counts
+// are keyed by the function's name and position, so that a profile
+// saved by one process may guide the compilation of the same source by
+// another.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.starlark.net/internal/compile"
+)
+
+// An ExecProfile records the number of times each instruction of each
+// Starlark function has been executed by threads whose ExecProfile
+// field refers to it. A single ExecProfile may be shared by many
+// threads. It is safe for concurrent use.
+//
+// An ExecProfile may be saved with Write, read back with
+// ReadExecProfile, and passed to FileProgramWithProfile to optimize
+// the compilation of the profiled source files.
+type ExecProfile struct {
+	mu    sync.Mutex
+	funcs map[*compile.Funcode][]uint64 // execution counts, indexed by pc
+	saved compile.Profile               // counts read by ReadExecProfile
+}
+
+// NewExecProfile returns a new, empty execution profile.
+func NewExecProfile() *ExecProfile {
+	return &ExecProfile{funcs: make(map[*compile.Funcode][]uint64)}
+}
+
+// counts returns the table of execution counts for the code of function fn.
+func (p *ExecProfile) counts(fn *Function) []uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	counts := p.funcs[fn.funcode]
+	if counts == nil {
+		counts = make([]uint64, len(fn.funcode.Code))
+		p.funcs[fn.funcode] = counts
+	}
+	return counts
+}
+
+// compileProfile returns the counts of the profile in the form used by
+// the compiler, summing the counts of functions with the same key.
+// It returns nil for a nil profile.
+func (p *ExecProfile) compileProfile() compile.Profile {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	profile := make(compile.Profile, len(p.saved)+len(p.funcs))
+	add := func(key string, counts []uint64, atomically bool) {
+		sum := profile[key]
+		if sum == nil {
+			sum = make([]uint64, len(counts))
+			profile[key] = sum
+		} else if len(sum) != len(counts) {
+			return // a different version of the function; ignore
+		}
+		for pc := range counts {
+			if atomically {
+				sum[pc] += atomic.LoadUint64(&counts[pc])
+			} else {
+				sum[pc] += counts[pc]
+			}
+		}
+	}
+	for key, counts := range p.saved {
+		add(key, counts, false)
+	}
+	for f, counts := range p.funcs {
+		add(f.ProfileKey(), counts, true)
+	}
+	return profile
+}
+
+// Write writes the profile in a line-oriented text format.
+// For each function, a line of the form
+//
+//	func "file.star:12:1 name" 345
+//
+// gives the function's key and code length, and is followed by a line
+// "pc count" for each instruction executed at least once.
+func (p *ExecProfile) Write(w io.Writer) error {
+	profile := p.compileProfile()
+	keys := make([]string, 0, len(profile))
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "starlark execution profile")
+	for _, key := range keys {
+		counts := profile[key]
+		fmt.Fprintf(out, "func %q %d\n", key, len(counts))
+		for pc, count := range counts {
+			if count > 0 {
+				fmt.Fprintf(out, "%d %d\n", pc, count)
+			}
+		}
+	}
+	return out.Flush()
+}
+
+// ReadExecProfile reads a profile in the format written by ExecProfile.Write.
+// Further counts may be added to the result by executing threads.
+func ReadExecProfile(r io.Reader) (*ExecProfile, error) {
+	p := NewExecProfile()
+	p.saved = make(compile.Profile)
+
+	in := bufio.NewScanner(r)
+	line := 0
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("reading execution profile: line %d: %s", line, fmt.Sprintf(format, args...))
+	}
+	var counts []uint64 // counts of current function
+	for in.Scan() {
+		line++
+		text := in.Text()
+		if line == 1 {
+			if text != "starlark execution profile" {
+				return nil, fail("not a Starlark execution profile")
+			}
+			continue
+		}
+		if rest := strings.TrimPrefix(text, "func "); rest != text {
+			i := strings.LastIndexByte(rest, ' ')
+			if i < 0 {
+				return nil, fail("invalid function line")
+			}
+			key, err := strconv.Unquote(rest[:i])
+			if err != nil {
+				return nil, fail("invalid function key: %v", err)
+			}
+			n, err := strconv.Atoi(rest[i+1:])
+			if err != nil || n < 0 {
+				return nil, fail("invalid code length %q", rest[i+1:])
+			}
+			counts = make([]uint64, n)
+			p.saved[key] = counts
+			continue
+		}
+		var pc int
+		var count uint64
+		if _, err := fmt.Sscanf(text, "%d %d", &pc, &count); err != nil {
+			return nil, fail("invalid count: %v", err)
+		}
+		if counts == nil || pc < 0 || pc >= len(counts) {
+			return nil, fail("count for invalid instruction")
+		}
+		counts[pc] += count
+	}
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+	if line == 0 {
+		return nil, fail("empty profile")
+	}
+	return p, nil
+}
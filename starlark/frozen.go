@@ -0,0 +1,120 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+import "fmt"
+
+// A FreezeCheckable is a value that can report whether it is frozen and
+// enumerate the values it refers to, allowing CheckFrozen to traverse it.
+// CheckFrozen assumes that a value of an application-defined type
+// that does not implement this interface is immutable, or frozen,
+// and refers to no other values.
+type FreezeCheckable interface {
+	Value
+	// Frozen reports whether the value itself is frozen.
+	// An immutable value always reports true.
+	Frozen() bool
+	// Referents calls visit for each value that Freeze would freeze
+	// on behalf of this value, along with a path suffix describing
+	// how the value is reached, such as ".f" or "[1]".
+	Referents(visit func(path string, v Value))
+}
+
+// CheckFrozen reports an error if any value reachable from v, including
+// v itself, is mutable but not yet frozen, that is, if v.Freeze() would
+// change the state of any value. The error describes the path by which
+// the first such value is reached. Embedders may use it to assert that
+// a value is safe to share among goroutines, such as the result of a
+// module that is to be loaded by several threads.
+//
+// Only the values that Freeze would freeze are considered;
+// for example, the globals of a function's module are not.
+func CheckFrozen(v Value) error {
+	return checkFrozen("value", v)
+}
+
+// checkFrozen is like CheckFrozen, but path describes v in the error.
+func checkFrozen(path string, v Value) error {
+	c := freezeChecker{seen: make(map[Value]bool)}
+	c.check(path, v)
+	return c.err
+}
+
+type freezeChecker struct {
+	seen map[Value]bool
+	err  error
+}
+
+func (c *freezeChecker) check(path string, v Value) {
+	if c.err != nil || v == nil {
+		return
+	}
+	if HasIdentity(v) {
+		if c.seen[v] {
+			return // cycle or shared value
+		}
+		c.seen[v] = true
+	}
+
+	// frozen reports an error if the value itself is not frozen.
+	frozen := func(ok bool) bool {
+		if !ok {
+			c.err = fmt.Errorf("%s is an unfrozen %s", path, v.Type())
+		}
+		return ok
+	}
+
+	switch v := v.(type) {
+	case *List:
+		if frozen(v.frozen) {
+			for i, elem := range v.elems {
+				c.check(fmt.Sprintf("%s[%d]", path, i), elem)
+			}
+		}
+	case Tuple:
+		for i, elem := range v {
+			c.check(fmt.Sprintf("%s[%d]", path, i), elem)
+		}
+	case *Dict:
+		if frozen(v.ht.frozen) {
+			for _, item := range v.Items() {
+				c.check(fmt.Sprintf("%s[%s]", path, item[0].String()), item[0])
+				c.check(fmt.Sprintf("%s[%s]", path, item[0].String()), item[1])
+			}
+		}
+	case *Set:
+		if frozen(v.ht.frozen) {
+			for _, elem := range v.elems() {
+				c.check(fmt.Sprintf("%s{%s}", path, elem.String()), elem)
+			}
+		}
+	case *Function:
+		for i, x := range v.defaults {
+			c.check(fmt.Sprintf("%s.defaults[%d]", path, i), x)
+		}
+		for i, x := range v.freevars {
+			c.check(fmt.Sprintf("%s.freevars[%s]", path, v.funcode.Freevars[i].Name), x)
+		}
+	case *cell:
+		// A cell is mutable only by its enclosing function.
+		c.check(path, v.v)
+	case *Builtin:
+		c.check(path+".receiver", v.recv)
+	case *Generator:
+		if frozen(v.frozen) {
+			c.check(path+".function", v.fn)
+			for _, x := range v.state.locals {
+				c.check(path+".locals", x)
+			}
+			for _, x := range v.state.stack[:v.state.sp] {
+				c.check(path+".stack", x)
+			}
+		}
+	case FreezeCheckable:
+		if frozen(v.Frozen()) {
+			v.Referents(func(suffix string, x Value) { c.check(path+suffix, x) })
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines futures, which allow a built-in function to
+// complete asynchronously.
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A Future is a placeholder for the result of an operation that
+// completes asynchronously, such as a network request.
+//
+// A built-in function may return a Future instead of its result, having
+// arranged for the operation to complete the Future, typically from
+// another goroutine, by calling its Complete method. The thread that
+// called the built-in function is suspended until the Future completes,
+// at which point the call returns the Future's value or error. The
+// Future itself is never visible to Starlark programs.
+//
+// While suspended, the thread consumes no OS thread and no execution
+// steps, and it may be cancelled by Thread.Cancel, in which case the
+// call fails with the cancellation error and the eventual result of
+// the Future is discarded.
+//
+// Example:
+//
+//	func fetch(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+//		var url string
+//		if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &url); err != nil {
+//			return nil, err
+//		}
+//		f := NewFuture()
+//		client.Get(url, func(body []byte, err error) {
+//			f.Complete(Bytes(body), err)
+//		})
+//		return f, nil
+//	}
+type Future struct {
+	once  sync.Once
+	done  chan struct{} // closed by Complete
+	value Value
+	err   error
+}
+
+var _ Value = (*Future)(nil)
+
+// NewFuture returns a new, incomplete Future.
+func NewFuture() *Future { return &Future{done: make(chan struct{})} }
+
+func (f *Future) String() string        { return "<future>" }
+func (f *Future) Type() string          { return "future" }
+func (f *Future) Freeze()               {} // immutable
+func (f *Future) Truth() Bool           { return True }
+func (f *Future) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: future") }
+
+// Complete records the result of the operation and resumes the thread
+// awaiting the Future, if any. Exactly one of value and err must be
+// non-nil. Only the first call to Complete has any effect.
+//
+// It is safe to call Complete from any goroutine.
+func (f *Future) Complete(value Value, err error) {
+	f.once.Do(func() {
+		if value == nil && err == nil {
+			err = internalError("nil (not None) result of future")
+		}
+		f.value, f.err = value, err
+		close(f.done)
+	})
+}
+
+// Done returns a channel that is closed when the Future completes.
+func (f *Future) Done() <-chan struct{} { return f.done }
+
+// Result returns the result of a completed Future, or (nil, nil)
+// if it is not yet complete.
+func (f *Future) Result() (Value, error) {
+	select {
+	case <-f.done:
+		return f.value, f.err
+	default:
+		return nil, nil
+	}
+}
+
+// await suspends the thread until the Future completes or the thread
+// is cancelled, and returns the Future's result.
+func (thread *Thread) await(f *Future) (Value, error) {
+	// Publish a channel through which Cancel may wake the thread.
+	// Cancel sets the reason before loading the channel, and we
+	// store the channel before loading the reason, so at least
+	// one of us observes the other.
+	wake := make(chan struct{}, 1)
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&thread.wake)), unsafe.Pointer(&wake))
+	defer atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&thread.wake)), nil)
+
+	for {
+		if reason := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason))); reason != nil {
+			return nil, fmt.Errorf("Starlark computation cancelled: %s", *(*string)(reason))
+		}
+		select {
+		case <-f.done:
+			return f.value, f.err
+		case <-wake:
+			// The thread was cancelled (or perhaps uncancelled again).
+		}
+	}
+}
+
+// wakeAwait wakes the thread if it is suspended in await.
+func (thread *Thread) wakeAwait() {
+	if p := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.wake))); p != nil {
+		select {
+		case *(*chan struct{})(p) <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines generators, the values returned by calls to
+// functions containing a yield expression.
+
+import "fmt"
+
+// A Generator is the value returned by a call to a generator function,
+// that is, a Starlark function whose body contains a yield expression.
+// It executes the body of the function incrementally: each time it is
+// resumed, execution continues until the next yield expression, whose
+// operand is the result of the resumption, or until the function returns.
+//
+// A generator is resumed by iterating over it, or by calling its send
+// method, whose argument becomes the value of the suspended yield
+// expression. Its close method abandons the execution, releasing any
+// iterators held by its active for loops and exiting the context
+// managers of its active with statements. A generator abandoned
+// without being exhausted or closed continues to hold these resources.
+//
+// A generator runs in the Thread that called the generator function,
+// and may not be resumed from another thread. (An iterator obtained
+// from Go code by calling Iterate has no way to determine the thread
+// that advances it, and so assumes it is the generator's own.) It may not be resumed
+// while it is executing, nor once it has been frozen, as resumption
+// changes its state. It may not be closed while it is being iterated.
+type Generator struct {
+	thread    *Thread // thread that created the generator, in which it runs
+	fn        *Function
+	state     execState
+	started   bool // execution has begun
+	running   bool // execution is in progress
+	done      bool // execution has ended, or the generator was closed
+	frozen    bool
+	itercount uint32 // number of active iterators (ignored if frozen)
+}
+
+var (
+	_ Iterable = (*Generator)(nil)
+	_ HasAttrs = (*Generator)(nil)
+)
+
+func newGenerator(thread *Thread, fn *Function, locals, stack []Value) *Generator {
+	return &Generator{
+		thread: thread,
+		fn:     fn,
+		state:  execState{locals: locals, stack: stack},
+	}
+}
+
+func (g *Generator) String() string        { return fmt.Sprintf("<generator %s>", g.fn.Name()) }
+func (g *Generator) Type() string          { return "generator" }
+func (g *Generator) Truth() Bool           { return True }
+func (g *Generator) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: generator") }
+
+func (g *Generator) Freeze() {
+	if !g.frozen {
+		g.frozen = true
+		g.fn.Freeze()
+		for _, v := range g.state.locals {
+			if v != nil {
+				v.Freeze()
+			}
+		}
+		for _, v := range g.state.stack[:g.state.sp] {
+			v.Freeze()
+		}
+	}
+}
+
+// Function returns the generator function whose body the generator executes.
+func (g *Generator) Function() *Function { return g.fn }
+
+func (g *Generator) Attr(name string) (Value, error) {
+	return builtinAttr(g, name, generatorMethods)
+}
+func (g *Generator) AttrNames() []string { return builtinAttrNames(generatorMethods) }
+
+func (g *Generator) Iterate() Iterator {
+	if !g.frozen {
+		g.itercount++
+		return &generatorIterator{g: g, rec: trackIterator("generator")}
+	}
+	return &generatorIterator{g: g}
+}
+
+// checkResumable returns an error if the generator may not be
+// resumed or closed by the specified thread.
+func (g *Generator) checkResumable(thread *Thread, verb string) error {
+	if thread != g.thread {
+		return fmt.Errorf("cannot %s generator created by another thread", verb)
+	}
+	if g.running {
+		return fmt.Errorf("cannot %s generator while it is executing", verb)
+	}
+	if g.frozen {
+		return fmt.Errorf("cannot %s frozen generator", verb)
+	}
+	return nil
+}
+
+// resume executes the generator's function, on behalf of the specified
+// thread, until it yields, in which case resume returns the yielded
+// value, or until it returns, in which case resume reports done.
+// The sent value becomes the value of the yield expression at which
+// the generator is suspended.
+func (g *Generator) resume(thread *Thread, sent Value) (v Value, done bool, err error) {
+	if g.done {
+		return nil, true, nil
+	}
+	if err := g.checkResumable(thread, "resume"); err != nil {
+		return nil, false, err
+	}
+	if g.started {
+		g.state.stack[g.state.sp] = sent
+		g.state.sp++
+	} else if sent != None {
+		return nil, false, fmt.Errorf("cannot send non-None value to a just-started generator")
+	}
+	g.started = true
+	g.running = true
+
+	// Push a frame for the generator function. Keep consistent with Call.
+	fr := new(frame)
+	fr.callable = g.fn
+	thread.stack = append(thread.stack, fr) // push
+	thread.beginProfSpan()
+	defer func() {
+		thread.endProfSpan()
+		*fr = frame{}
+		thread.stack = thread.stack[:len(thread.stack)-1] // pop
+		g.running = false
+	}()
+
+	v, err = g.fn.run(thread, fr, &g.state)
+	if err != nil {
+		g.finish()
+		if _, ok := err.(*EvalError); !ok {
+			err = thread.evalError(err)
+		}
+		return nil, false, err
+	}
+	if !g.state.suspended {
+		g.finish()
+		return nil, true, nil
+	}
+	return v, false, nil
+}
+
+// finish marks the generator done and releases its execution state.
+func (g *Generator) finish() {
+	g.done = true
+	g.state = execState{}
+}
+
+// A threadIterator is an iterator that must know the thread that
+// advances it, such as that of a generator, or one that wraps such an
+// iterator.
+type threadIterator interface {
+	Iterator
+	setThread(thread *Thread)
+}
+
+// iterateOn is like Iterate, but informs the iterator of the thread
+// that will advance it, if the iterator needs to know.
+func iterateOn(thread *Thread, x Value) Iterator {
+	iter := Iterate(x)
+	if it, ok := iter.(threadIterator); ok && thread != nil {
+		it.setThread(thread)
+	}
+	return iter
+}
+
+type generatorIterator struct {
+	g      *Generator
+	thread *Thread // thread that advances the iterator, if known
+	err    error
+	rec    *iterRecord // see iterleak.go
+}
+
+func (it *generatorIterator) setThread(thread *Thread) { it.thread = thread }
+
+func (it *generatorIterator) Next(p *Value) bool {
+	if it.err != nil {
+		return false
+	}
+	thread := it.thread
+	if thread == nil {
+		thread = it.g.thread // iterated by Go code; see Generator
+	}
+	v, done, err := it.g.resume(thread, None)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if done {
+		return false
+	}
+	*p = v
+	return true
+}
+
+func (it *generatorIterator) Err() error { return it.err }
+
+func (it *generatorIterator) Done() {
+	if !it.g.frozen {
+		it.g.itercount--
+	}
+	untrackIterator(it.rec)
+}
+
+var generatorMethods = map[string]*Builtin{
+	"close": NewBuiltin("close", generator_close),
+	"send":  NewBuiltin("send", generator_send),
+}
+
+func generator_send(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var value Value
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &value); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Generator)
+	if g.done {
+		return nil, nameErr(b, "generator is exhausted")
+	}
+	if err := g.checkResumable(thread, "resume"); err != nil {
+		return nil, nameErr(b, err)
+	}
+	v, done, err := g.resume(thread, value)
+	if err != nil {
+		return nil, err // to preserve backtrace, don't modify error
+	}
+	if done {
+		return nil, nameErr(b, "generator is exhausted")
+	}
+	return v, nil
+}
+
+func generator_close(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	g := b.Receiver().(*Generator)
+	if g.done {
+		return None, nil
+	}
+	if err := g.checkResumable(thread, "close"); err != nil {
+		return nil, nameErr(b, err)
+	}
+	if g.itercount > 0 {
+		return nil, nameErr(b, "cannot close generator during iteration")
+	}
+
+	// Release the iterators and context managers of the suspended
+	// execution, innermost first, as if it had returned.
+	iterstack, withstack := g.state.iterstack, g.state.withstack
+	g.finish()
+	for _, iter := range iterstack {
+		iter.Done()
+	}
+	var err error
+	for i := len(withstack) - 1; i >= 0; i-- {
+		if err2 := withstack[i].Exit(thread, nil); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	if err != nil {
+		return nil, nameErr(b, err)
+	}
+	return None, nil
+}
@@ -22,6 +22,7 @@ type hashtable struct {
 	head      *entry  // insertion order doubly-linked list; may be nil
 	tailLink  **entry // address of nil link at end of list (perhaps &head)
 	frozen    bool
+	shared    bool // table and entries belong to the frozen table it was forked from
 
 	_ noCopy // triggers vet copylock check on this type.
 }
@@ -155,27 +156,98 @@ retry:
 	return nil
 }
 
+// insertDistinct inserts a key whose hash h is already known, and
+// which is known to be absent from the table, without hashing or
+// comparing keys. The table must be mutable, and initialized with
+// room for the key.
+func (ht *hashtable) insertDistinct(k, v Value, h uint32) {
+	p := &ht.table[h&(uint32(len(ht.table)-1))]
+	for {
+		for i := range p.entries {
+			if e := &p.entries[i]; e.hash == 0 {
+				e.hash = h
+				e.key = k
+				e.value = v
+				e.prevLink = ht.tailLink
+				*ht.tailLink = e
+				ht.tailLink = &e.next
+				ht.len++
+				return
+			}
+		}
+		if p.next == nil {
+			p.next = new(bucket)
+		}
+		p = p.next
+	}
+}
+
+const loadFactor = 6.5 // just a guess
+
 func overloaded(elems, buckets int) bool {
-	const loadFactor = 6.5 // just a guess
 	return elems >= bucketSize && float64(elems) >= loadFactor*float64(buckets)
 }
 
+// underloaded reports whether a table of the specified number of
+// buckets is so sparsely occupied that it should be shrunk.
+// Small tables are never shrunk. The wide gap between the thresholds
+// for growth and shrinkage prevents a table whose size oscillates
+// around either one from being rehashed repeatedly.
+func underloaded(elems, buckets int) bool {
+	return buckets >= 8 && float64(elems) < loadFactor*float64(buckets)/8
+}
+
 func (ht *hashtable) grow() {
 	// Double the number of buckets and rehash.
-	// TODO(adonovan): opt:
-	// - avoid reentrant calls to ht.insert, and specialize it.
-	//   e.g. we know the calls to Equals will return false since
-	//   there are no duplicates among the old keys.
-	// - saving the entire hash in the bucket would avoid the need to
-	//   recompute the hash.
-	// - save the old buckets on a free list.
-	ht.table = make([]bucket, len(ht.table)<<1)
+	// TODO(adonovan): opt: save the old buckets on a free list.
+	CountMetric(MetricDictGrowths, 1)
+	ht.rehash(len(ht.table) << 1)
+}
+
+// shrink halves the number of buckets, repeatedly, while the table
+// would remain at most half full, and rehashes it, so that a dict
+// that was briefly large does not retain its storage indefinitely.
+func (ht *hashtable) shrink() {
+	nb := len(ht.table)
+	for nb > 1 && !overloaded(2*int(ht.len), nb>>1) {
+		nb >>= 1
+	}
+	CountMetric(MetricDictShrinks, 1)
+	ht.rehash(nb)
+}
+
+// reserve ensures that the table has space for at least n more
+// insertions before rehashing, rehashing it now if necessary.
+func (ht *hashtable) reserve(n int) error {
+	if err := ht.checkMutable("insert into"); err != nil {
+		return err
+	}
+	if ht.table == nil {
+		ht.init(n)
+		return nil
+	}
+	nb := len(ht.table)
+	for overloaded(int(ht.len)+n, nb) {
+		nb = nb << 1
+	}
+	if nb > len(ht.table) {
+		CountMetric(MetricDictGrowths, 1)
+		ht.rehash(nb)
+	}
+	return nil
+}
+
+// rehash reinserts all entries into a new table of nb buckets.
+// It uses the hash saved in each entry, and, since the keys are
+// distinct, it neither calls Hash nor compares keys.
+func (ht *hashtable) rehash(nb int) {
+	ht.table = make([]bucket, nb)
 	oldhead := ht.head
 	ht.head = nil
 	ht.tailLink = &ht.head
 	ht.len = 0
 	for e := oldhead; e != nil; e = e.next {
-		ht.insert(e.key, e.value)
+		ht.insertDistinct(e.key, e.value, e.hash)
 	}
 	ht.bucket0[0] = bucket{} // clear out unused initial bucket
 }
@@ -271,6 +343,9 @@ func (ht *hashtable) delete(k Value) (v Value, found bool, err error) {
 					v := e.value
 					*e = entry{}
 					ht.len--
+					if underloaded(int(ht.len), len(ht.table)) {
+						ht.shrink()
+					}
 					return v, true, nil // found
 				}
 			}
@@ -284,6 +359,8 @@ func (ht *hashtable) delete(k Value) (v Value, found bool, err error) {
 
 // checkMutable reports an error if the hash table should not be mutated.
 // verb+" dict" should describe the operation.
+// If the table is shared with the table it was forked from,
+// checkMutable gives it its own copy, as the caller is about to mutate it.
 func (ht *hashtable) checkMutable(verb string) error {
 	if ht.frozen {
 		return fmt.Errorf("cannot %s frozen hash table", verb)
@@ -291,14 +368,50 @@ func (ht *hashtable) checkMutable(verb string) error {
 	if ht.itercount > 0 {
 		return fmt.Errorf("cannot %s hash table during iteration", verb)
 	}
+	if ht.shared {
+		ht.unshare()
+	}
 	return nil
 }
 
+// fork initializes the empty table child to have the same entries as ht.
+// If ht is frozen, child shares its storage until the first mutation.
+func (ht *hashtable) fork(child *hashtable) {
+	if !ht.frozen {
+		child.init(int(ht.len))
+		child.addAll(ht) // can't fail
+		return
+	}
+	if ht.table != nil {
+		child.table = ht.table
+		child.len = ht.len
+		child.head = ht.head
+		child.tailLink = ht.tailLink
+		child.shared = true
+	}
+}
+
+// unshare replaces the shared storage of a forked table by a copy.
+func (ht *hashtable) unshare() {
+	ht.shared = false
+	oldhead, n := ht.head, int(ht.len)
+	ht.head = nil
+	ht.len = 0
+	ht.init(n)
+	for e := oldhead; e != nil; e = e.next {
+		ht.insertDistinct(e.key, e.value, e.hash)
+	}
+}
+
 func (ht *hashtable) clear() error {
 	if err := ht.checkMutable("clear"); err != nil {
 		return err
 	}
-	if ht.table != nil {
+	if underloaded(0, len(ht.table)) {
+		// Release the storage of a large table.
+		ht.bucket0[0] = bucket{}
+		ht.table = ht.bucket0[:1]
+	} else if ht.table != nil {
 		for i := range ht.table {
 			ht.table[i] = bucket{}
 		}
@@ -345,16 +458,20 @@ func (ht *hashtable) dump() {
 	}
 }
 
-func (ht *hashtable) iterate() *keyIterator {
+// iterate returns an iterator over the keys of the table.
+// typ is the type of the dict or set, for leak reports.
+func (ht *hashtable) iterate(typ string) *keyIterator {
 	if !ht.frozen {
 		ht.itercount++
+		return &keyIterator{ht: ht, e: ht.head, rec: trackIterator(typ)}
 	}
 	return &keyIterator{ht: ht, e: ht.head}
 }
 
 type keyIterator struct {
-	ht *hashtable
-	e  *entry
+	ht  *hashtable
+	e   *entry
+	rec *iterRecord // see iterleak.go
 }
 
 func (it *keyIterator) Next(k *Value) bool {
@@ -370,6 +487,7 @@ func (it *keyIterator) Done() {
 	if !it.ht.frozen {
 		it.ht.itercount--
 	}
+	untrackIterator(it.rec)
 }
 
 // TODO(adonovan): use go1.19's maphash.String.
@@ -16,6 +16,84 @@ func TestHashtable(t *testing.T) {
 	testHashtable(t, make(map[int]bool))
 }
 
+func TestHashtableShrink(t *testing.T) {
+	var ht hashtable
+	const n = 10000
+	for i := 0; i < n; i++ {
+		if err := ht.insert(MakeInt(i), None); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := len(ht.table)
+
+	// Deleting most elements shrinks the table.
+	for i := 0; i < n-10; i++ {
+		if _, found, err := ht.delete(MakeInt(i)); err != nil || !found {
+			t.Fatalf("delete(%d) = %t, %v", i, found, err)
+		}
+	}
+	if len(ht.table) >= big/8 {
+		t.Errorf("after deletions, table has %d buckets, want fewer than %d", len(ht.table), big/8)
+	}
+	// The remaining elements are present, in order.
+	if got, want := fmt.Sprint(ht.keys()), "[9990 9991 9992 9993 9994 9995 9996 9997 9998 9999]"; got != want {
+		t.Errorf("keys = %s, want %s", got, want)
+	}
+	for i := n - 10; i < n; i++ {
+		if _, found, _ := ht.lookup(MakeInt(i)); !found {
+			t.Errorf("lookup(%d) failed after shrink", i)
+		}
+	}
+
+	// Clearing a large table releases its storage.
+	for i := 0; i < n; i++ {
+		ht.insert(MakeInt(i), None)
+	}
+	if err := ht.clear(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ht.table) != 1 {
+		t.Errorf("after clear, table has %d buckets, want 1", len(ht.table))
+	}
+	ht.insert(MakeInt(1), None)
+	if _, found, _ := ht.lookup(MakeInt(1)); !found || ht.len != 1 {
+		t.Errorf("lookup after clear failed")
+	}
+}
+
+func TestStringHashtable(t *testing.T) {
+	var tab StringHashtable
+	for i, k := range []string{"one", "two", "three", "two"} {
+		if err := tab.Insert(k, MakeInt(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, found := tab.Lookup("two"); !found || v != MakeInt(3) {
+		t.Errorf("Lookup(two) = %v, %t", v, found)
+	}
+	if v, found := tab.Lookup("four"); found || v != nil {
+		t.Errorf("Lookup(four) = %v, %t", v, found)
+	}
+	if v, found, err := tab.Delete("one"); err != nil || !found || v != MakeInt(0) {
+		t.Errorf("Delete(one) = %v, %t, %v", v, found, err)
+	}
+	var got []string
+	tab.Iterate(func(k string, v Value) bool {
+		got = append(got, fmt.Sprintf("%s=%v", k, v))
+		if err := tab.Insert("x", None); err == nil {
+			t.Error("Insert during iteration succeeded")
+		}
+		return true
+	})
+	if fmt.Sprint(got) != "[two=3 three=2]" || fmt.Sprint(tab.Keys()) != "[two three]" || tab.Len() != 2 {
+		t.Errorf("entries = %v, keys = %v, len = %d", got, tab.Keys(), tab.Len())
+	}
+	tab.Freeze()
+	if err := tab.Insert("x", None); err == nil {
+		t.Error("Insert into frozen table succeeded")
+	}
+}
+
 func BenchmarkStringHash(b *testing.B) {
 	for len := 1; len <= 1024; len *= 2 {
 		buf := make([]byte, len)
@@ -43,6 +121,22 @@ func BenchmarkHashtable(b *testing.B) {
 	}
 }
 
+// BenchmarkHashtableGrow measures the insertion of long string keys,
+// whose hashes are costly to compute, into a table that grows.
+func BenchmarkHashtableGrow(b *testing.B) {
+	keys := make([]Value, 1000)
+	for i := range keys {
+		keys[i] = String(fmt.Sprintf("a long string key, number %d", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ht hashtable
+		for _, k := range keys {
+			ht.insert(k, None)
+		}
+	}
+}
+
 const testIters = 10000
 
 var (
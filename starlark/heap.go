@@ -0,0 +1,299 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines heap inspection, which enumerates the values
+// reachable from a set of roots and summarizes them by type.
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"unsafe"
+)
+
+// A HeapDump summarizes the values reachable from a set of roots, such
+// as the globals of loaded modules and the stacks of threads, to help
+// diagnose which of them retains the most memory.
+//
+// Roots are added in order, and each value is attributed to the first
+// root from which it is reached, so the statistics of a root exclude
+// the values it shares with earlier roots. The sizes are estimates of
+// the memory occupied by each value, excluding that of the values it
+// refers to, and are approximate: strings and other values without
+// identity are counted at each reference.
+//
+// A value of an application-defined type is traversed only if it
+// implements FreezeCheckable.
+//
+// The zero value is an empty dump. A HeapDump must not be used while
+// any thread is modifying the values reachable from its roots.
+type HeapDump struct {
+	Values int64           `json:"values"` // number of values
+	Bytes  int64           `json:"bytes"`  // estimated size of values
+	Types  []HeapTypeStats `json:"types"`  // statistics of each type, largest first
+	Roots  []HeapRootStats `json:"roots"`  // statistics of each root, in order
+
+	seen map[interface{}]bool
+}
+
+// HeapRootStats holds the statistics of the values attributed to a root.
+type HeapRootStats struct {
+	Name   string          `json:"name"`
+	Values int64           `json:"values"`
+	Bytes  int64           `json:"bytes"`
+	Types  []HeapTypeStats `json:"types"` // largest first
+}
+
+// HeapTypeStats holds the statistics of the values of one type.
+type HeapTypeStats struct {
+	Type   string `json:"type"`
+	Values int64  `json:"values"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// AddGlobals adds the values of a module's global environment
+// as a root of the specified name.
+func (d *HeapDump) AddGlobals(name string, globals StringDict) {
+	var roots []interface{}
+	for _, k := range globals.Keys() {
+		roots = append(roots, globals[k])
+	}
+	d.add(name, roots)
+}
+
+// AddThread adds the functions and local variables of the call stack
+// of a thread as a root of the specified name. The thread must not be
+// executing, other than by calling the built-in that calls AddThread.
+func (d *HeapDump) AddThread(name string, thread *Thread) {
+	var roots []interface{}
+	for _, fr := range thread.stack {
+		roots = append(roots, fr.callable)
+		for _, v := range fr.locals {
+			roots = append(roots, v)
+		}
+	}
+	d.add(name, roots)
+}
+
+// AddValue adds a single value as a root of the specified name.
+func (d *HeapDump) AddValue(name string, v Value) {
+	d.add(name, []interface{}{v})
+}
+
+// WriteJSON writes the dump to w as a JSON object of the form
+//
+//	{"values": 123, "bytes": 4567,
+//	 "types": [{"type": "list", "values": 10, "bytes": 2000}, ...],
+//	 "roots": [{"name": "a.star", "values": 100, "bytes": 4000, "types": [...]}, ...]}
+func (d *HeapDump) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(d)
+}
+
+// add traverses the values reachable from roots that were not
+// reached from an earlier root, and attributes them to a new root.
+func (d *HeapDump) add(name string, roots []interface{}) {
+	if d.seen == nil {
+		d.seen = make(map[interface{}]bool)
+	}
+	root := HeapRootStats{Name: name}
+	types := make(map[string]*HeapTypeStats)
+	work := roots
+	for len(work) > 0 {
+		x := work[len(work)-1]
+		work = work[:len(work)-1]
+		if x == nil {
+			continue
+		}
+		if key := heapKey(x); key != nil {
+			if d.seen[key] {
+				continue
+			}
+			d.seen[key] = true
+		}
+
+		typ, size := heapVisit(x, func(y interface{}) { work = append(work, y) })
+		t := types[typ]
+		if t == nil {
+			t = &HeapTypeStats{Type: typ}
+			types[typ] = t
+		}
+		t.Values++
+		t.Bytes += size
+		root.Values++
+		root.Bytes += size
+	}
+
+	for _, t := range types {
+		root.Types = append(root.Types, *t)
+	}
+	sortHeapTypeStats(root.Types)
+	d.Roots = append(d.Roots, root)
+
+	d.Values += root.Values
+	d.Bytes += root.Bytes
+	for _, t := range root.Types {
+		found := false
+		for i := range d.Types {
+			if d.Types[i].Type == t.Type {
+				d.Types[i].Values += t.Values
+				d.Types[i].Bytes += t.Bytes
+				found = true
+				break
+			}
+		}
+		if !found {
+			d.Types = append(d.Types, t)
+		}
+	}
+	sortHeapTypeStats(d.Types)
+}
+
+func sortHeapTypeStats(types []HeapTypeStats) {
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Bytes != types[j].Bytes {
+			return types[i].Bytes > types[j].Bytes
+		}
+		return types[i].Type < types[j].Type
+	})
+}
+
+// heapKey returns the key by which a value with identity is recorded
+// as seen, or nil if the value has no identity.
+func heapKey(x interface{}) interface{} {
+	switch x := x.(type) {
+	case *module:
+		return x
+	case Tuple:
+		if len(x) > 0 {
+			return &x[0]
+		}
+		return nil
+	case Value:
+		if HasIdentity(x) {
+			return x
+		}
+	}
+	return nil
+}
+
+const (
+	wordSize  = int64(unsafe.Sizeof(uintptr(0)))
+	valueSize = int64(unsafe.Sizeof(Value(nil)))
+)
+
+// heapVisit calls visit for each value to which x refers,
+// and returns the type of x and its estimated size.
+func heapVisit(x interface{}, visit func(interface{})) (string, int64) {
+	switch x := x.(type) {
+	case *module:
+		for _, v := range x.globals {
+			visit(v)
+		}
+		for _, v := range x.constants {
+			visit(v)
+		}
+		for _, v := range x.predeclared {
+			visit(v)
+		}
+		size := int64(unsafe.Sizeof(*x)) + valueSize*int64(len(x.globals)+len(x.constants))
+		return "module", size
+	case String:
+		return x.Type(), 2*wordSize + int64(len(x))
+	case Bytes:
+		return x.Type(), 2*wordSize + int64(len(x))
+	case Int:
+		size := wordSize
+		if _, big := x.get(); big != nil {
+			size += int64(unsafe.Sizeof(*big)) + wordSize*int64(len(big.Bits()))
+		}
+		return x.Type(), size
+	case Tuple:
+		for _, v := range x {
+			visit(v)
+		}
+		return x.Type(), 3*wordSize + valueSize*int64(len(x))
+	case *List:
+		for _, v := range x.elems {
+			visit(v)
+		}
+		return x.Type(), int64(unsafe.Sizeof(*x)) + valueSize*int64(cap(x.elems))
+	case *Dict:
+		for e := x.ht.head; e != nil; e = e.next {
+			visit(e.key)
+			visit(e.value)
+		}
+		if x.factory != nil {
+			visit(x.factory)
+		}
+		return x.Type(), int64(unsafe.Sizeof(*x)) + x.ht.heapSize()
+	case *Set:
+		for e := x.ht.head; e != nil; e = e.next {
+			visit(e.key)
+		}
+		return x.Type(), int64(unsafe.Sizeof(*x)) + x.ht.heapSize()
+	case *Function:
+		visit(x.module)
+		for _, v := range x.defaults {
+			visit(v)
+		}
+		for _, v := range x.freevars {
+			visit(v)
+		}
+		size := int64(unsafe.Sizeof(*x)) + valueSize*int64(len(x.defaults)+len(x.freevars))
+		return x.Type(), size
+	case *cell:
+		visit(x.v)
+		return x.Type(), int64(unsafe.Sizeof(*x))
+	case *Builtin:
+		visit(x.recv)
+		return x.Type(), int64(unsafe.Sizeof(*x))
+	case *Generator:
+		visit(x.fn)
+		for _, v := range x.state.locals {
+			visit(v)
+		}
+		for _, v := range x.state.stack[:x.state.sp] {
+			visit(v)
+		}
+		size := int64(unsafe.Sizeof(*x)) + valueSize*int64(len(x.state.locals)+len(x.state.stack))
+		return x.Type(), size
+	case *Future:
+		visit(x.value)
+		return x.Type(), int64(unsafe.Sizeof(*x))
+	case FreezeCheckable:
+		x.Referents(func(_ string, v Value) { visit(v) })
+		return x.Type(), reflectSize(x)
+	case Value:
+		return x.Type(), reflectSize(x)
+	}
+	panic("unreachable")
+}
+
+// reflectSize returns the size of the variable that holds
+// a value of an unknown type, or to which it points.
+func reflectSize(v Value) int64 {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return int64(t.Size())
+}
+
+// heapSize returns the size of the buckets of the hash table,
+// excluding the inline bucket.
+func (ht *hashtable) heapSize() int64 {
+	var n int64
+	for i := range ht.table {
+		for p := ht.table[i].next; p != nil; p = p.next {
+			n++ // overflow bucket
+		}
+	}
+	if len(ht.table) > 1 {
+		n += int64(len(ht.table))
+	}
+	return n * int64(unsafe.Sizeof(bucket{}))
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the instrumentation hooks, which report the
+// execution of files, loads, and slow function calls as spans
+// suitable for a distributed tracing system such as OpenTelemetry.
+//
+// This package does not depend on any tracing system; an adapter
+// implements Instrumenter by starting and ending spans of its own.
+
+import (
+	"time"
+
+	"go.starlark.net/syntax"
+)
+
+// An Instrumenter is notified of the start and end of operations
+// performed by a thread whose Instrumenter field refers to it.
+//
+// StartSpan and EndSpan are called in matching pairs on the
+// thread's goroutine, and the spans of ExecSpan and LoadSpan kind
+// are properly nested, so an adapter may maintain a stack of spans
+// in a thread-local value (see Thread.SetLocal) to establish
+// parent-child relationships.
+//
+// Spans of CallSpan kind are an exception: because whether a call
+// exceeds the thread's CallSpanThreshold is known only when it
+// returns, StartSpan and EndSpan are called in succession when the
+// call ends, and the span's Start field records the actual start time.
+// Their parent is the innermost enclosing span that is still open.
+type Instrumenter interface {
+	StartSpan(thread *Thread, span *Span)
+	EndSpan(thread *Thread, span *Span)
+}
+
+// A SpanKind identifies the kind of operation described by a Span.
+type SpanKind uint8
+
+const (
+	ExecSpan SpanKind = iota // execution of a file's top-level statements
+	LoadSpan                 // execution of a load statement
+	CallSpan                 // a function call that exceeded CallSpanThreshold
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case ExecSpan:
+		return "exec"
+	case LoadSpan:
+		return "load"
+	case CallSpan:
+		return "call"
+	}
+	return "unknown"
+}
+
+// A Span describes an operation reported to an Instrumenter.
+// The fields End and Err are set only when the span ends.
+type Span struct {
+	Kind  SpanKind
+	Name  string          // file name, module name, or function name
+	Pos   syntax.Position // position of the file, load statement, or function
+	Start time.Time
+	End   time.Time
+	Err   error // the operation's error, if any
+}
+
+// Duration returns the elapsed time of an ended span.
+func (span *Span) Duration() time.Duration { return span.End.Sub(span.Start) }
+
+// startSpan notifies the thread's Instrumenter, if any, of the start
+// of an operation. It returns nil if the thread is not instrumented.
+func (thread *Thread) startSpan(kind SpanKind, name string, pos syntax.Position) *Span {
+	if thread.Instrumenter == nil {
+		return nil
+	}
+	span := &Span{Kind: kind, Name: name, Pos: pos, Start: time.Now()}
+	thread.Instrumenter.StartSpan(thread, span)
+	return span
+}
+
+// endSpan notifies the thread's Instrumenter of the end of the
+// operation described by span, which may be nil.
+func (thread *Thread) endSpan(span *Span, err error) {
+	if span == nil {
+		return
+	}
+	span.End = time.Now()
+	span.Err = err
+	thread.Instrumenter.EndSpan(thread, span)
+}
+
+// reportCall reports a CallSpan for a call of fn that began at start,
+// if it exceeded the thread's CallSpanThreshold.
+func (thread *Thread) reportCall(fn Callable, start time.Time, err error) {
+	end := time.Now()
+	if end.Sub(start) < thread.CallSpanThreshold {
+		return
+	}
+	span := &Span{Kind: CallSpan, Name: fn.Name(), Start: start}
+	if fn, ok := fn.(callableWithPosition); ok {
+		span.Pos = fn.Position()
+	} else {
+		span.Pos = syntax.MakePosition(&builtinFilename, 0, 0)
+	}
+	thread.Instrumenter.StartSpan(thread, span)
+	span.End = end
+	span.Err = err
+	thread.Instrumenter.EndSpan(thread, span)
+}
@@ -255,7 +255,7 @@ func (x Int) Mul(y Int) Int {
 	xSmall, xBig := x.get()
 	ySmall, yBig := y.get()
 	if xBig != nil || yBig != nil {
-		return MakeBigInt(new(big.Int).Mul(x.bigInt(), y.bigInt()))
+		return MakeBigInt(bigMul(x.bigInt(), y.bigInt()))
 	}
 	return MakeInt64(xSmall * ySmall)
 }
@@ -301,12 +301,11 @@ func (x Int) Div(y Int) Int {
 	if xBig != nil || yBig != nil {
 		xb, yb := x.bigInt(), y.bigInt()
 
-		var quo, rem big.Int
-		quo.QuoRem(xb, yb, &rem)
+		quo, rem := bigQuoRem(xb, yb)
 		if (xb.Sign() < 0) != (yb.Sign() < 0) && rem.Sign() != 0 {
-			quo.Sub(&quo, oneBig)
+			quo.Sub(quo, oneBig)
 		}
-		return MakeBigInt(&quo)
+		return MakeBigInt(quo)
 	}
 	quo := xSmall / ySmall
 	rem := xSmall % ySmall
@@ -323,12 +322,11 @@ func (x Int) Mod(y Int) Int {
 	if xBig != nil || yBig != nil {
 		xb, yb := x.bigInt(), y.bigInt()
 
-		var quo, rem big.Int
-		quo.QuoRem(xb, yb, &rem)
+		_, rem := bigQuoRem(xb, yb)
 		if (xb.Sign() < 0) != (yb.Sign() < 0) && rem.Sign() != 0 {
-			rem.Add(&rem, yb)
+			rem.Add(rem, yb)
 		}
-		return MakeBigInt(&rem)
+		return MakeBigInt(rem)
 	}
 	rem := xSmall % ySmall
 	if (xSmall < 0) != (ySmall < 0) && rem != 0 {
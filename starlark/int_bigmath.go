@@ -0,0 +1,19 @@
+//go:build !gmp || !cgo
+// +build !gmp !cgo
+
+package starlark
+
+// This file defines the arithmetic on big Int values that has an
+// alternative implementation in int_gmp.go. By default, it uses
+// math/big.
+
+import "math/big"
+
+// bigMul returns the product x*y.
+func bigMul(x, y *big.Int) *big.Int { return new(big.Int).Mul(x, y) }
+
+// bigQuoRem returns the truncated quotient and remainder of x/y.
+// Precondition: y is nonzero.
+func bigQuoRem(x, y *big.Int) (quo, rem *big.Int) {
+	return new(big.Int).QuoRem(x, y, new(big.Int))
+}
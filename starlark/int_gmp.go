@@ -0,0 +1,95 @@
+//go:build gmp && cgo
+// +build gmp,cgo
+
+package starlark
+
+// This file defines an implementation of the arithmetic on big Int
+// values that uses the GNU Multiple Precision Arithmetic Library
+// (GMP), selected by the "gmp" build tag. Applications that compute
+// with huge integers, as in cryptography or combinatorics, may build
+// with -tags gmp to use GMP's asymptotically faster algorithms.
+//
+// Operands are copied between math/big and GMP representations, so
+// GMP is used only for operands large enough that the cost of copying
+// is small compared to that of the operation itself; smaller ones use
+// math/big as usual.
+
+// #cgo LDFLAGS: -lgmp
+// #include <gmp.h>
+import "C"
+
+import (
+	"math/big"
+	"unsafe"
+)
+
+// gmpMinBits is the least total size in bits of the operands of an
+// operation for which GMP is used.
+const gmpMinBits = 1 << 14
+
+// bigMul returns the product x*y.
+func bigMul(x, y *big.Int) *big.Int {
+	if x.BitLen()+y.BitLen() < gmpMinBits {
+		return new(big.Int).Mul(x, y)
+	}
+	var zx, zy, zz C.mpz_t
+	gmpInit(&zx[0], x)
+	gmpInit(&zy[0], y)
+	C.mpz_init(&zz[0])
+	defer C.mpz_clear(&zx[0])
+	defer C.mpz_clear(&zy[0])
+	defer C.mpz_clear(&zz[0])
+
+	C.mpz_mul(&zz[0], &zx[0], &zy[0])
+	return gmpGet(&zz[0])
+}
+
+// bigQuoRem returns the truncated quotient and remainder of x/y.
+// Precondition: y is nonzero.
+func bigQuoRem(x, y *big.Int) (quo, rem *big.Int) {
+	if x.BitLen()+y.BitLen() < gmpMinBits {
+		return new(big.Int).QuoRem(x, y, new(big.Int))
+	}
+	var zx, zy, zq, zr C.mpz_t
+	gmpInit(&zx[0], x)
+	gmpInit(&zy[0], y)
+	C.mpz_init(&zq[0])
+	C.mpz_init(&zr[0])
+	defer C.mpz_clear(&zx[0])
+	defer C.mpz_clear(&zy[0])
+	defer C.mpz_clear(&zq[0])
+	defer C.mpz_clear(&zr[0])
+
+	C.mpz_tdiv_qr(&zq[0], &zr[0], &zx[0], &zy[0])
+	return gmpGet(&zq[0]), gmpGet(&zr[0])
+}
+
+const gmpWordSize = C.size_t(unsafe.Sizeof(big.Word(0)))
+
+// gmpInit initializes z to the value of x.
+func gmpInit(z *C.__mpz_struct, x *big.Int) {
+	C.mpz_init(z)
+	words := x.Bits()
+	if len(words) > 0 {
+		// Import the words least significant first, in native byte order.
+		C.mpz_import(z, C.size_t(len(words)), -1, gmpWordSize, 0, 0, unsafe.Pointer(&words[0]))
+	}
+	if x.Sign() < 0 {
+		C.mpz_neg(z, z)
+	}
+}
+
+// gmpGet returns the value of z as a new big.Int.
+func gmpGet(z *C.__mpz_struct) *big.Int {
+	n := (C.mpz_sizeinbase(z, 2) + 8*gmpWordSize - 1) / (8 * gmpWordSize)
+	words := make([]big.Word, n)
+	var count C.size_t
+	if n > 0 {
+		C.mpz_export(unsafe.Pointer(&words[0]), &count, -1, gmpWordSize, 0, 0, z)
+	}
+	x := new(big.Int).SetBits(words[:count])
+	if z._mp_size < 0 { // (mpz_sgn is a macro)
+		x.Neg(x)
+	}
+	return x
+}
@@ -107,6 +107,41 @@ func TestImmutabilityBigInt(t *testing.T) {
 	}
 }
 
+// TestHugeIntArith checks the arithmetic of values large enough to use
+// the alternative implementation of int_gmp.go, if enabled, against math/big.
+func TestHugeIntArith(t *testing.T) {
+	x := new(big.Int).Lsh(big.NewInt(3), 20000)
+	x.Sub(x, big.NewInt(12345))
+	y := new(big.Int).Lsh(big.NewInt(7), 9000)
+	y.Add(y, big.NewInt(1))
+	for _, signs := range [][2]int{{1, 1}, {1, -1}, {-1, 1}, {-1, -1}} {
+		xb, yb := new(big.Int).Set(x), new(big.Int).Set(y)
+		if signs[0] < 0 {
+			xb.Neg(xb)
+		}
+		if signs[1] < 0 {
+			yb.Neg(yb)
+		}
+		xi, yi := MakeBigInt(xb), MakeBigInt(yb)
+
+		if got, want := xi.Mul(yi).BigInt(), new(big.Int).Mul(xb, yb); got.Cmp(want) != 0 {
+			t.Errorf("x*y mismatch for signs %v", signs)
+		}
+		// Div and Mod round toward negative infinity.
+		quo, rem := new(big.Int).DivMod(xb, yb, new(big.Int))
+		if yb.Sign() < 0 && rem.Sign() != 0 {
+			quo.Sub(quo, big.NewInt(1))
+			rem.Add(rem, yb)
+		}
+		if got := xi.Div(yi).BigInt(); got.Cmp(quo) != 0 {
+			t.Errorf("x//y mismatch for signs %v", signs)
+		}
+		if got := xi.Mod(yi).BigInt(); got.Cmp(rem) != 0 {
+			t.Errorf("x%%y mismatch for signs %v", signs)
+		}
+	}
+}
+
 // TestIntFallback creates a small Int value in a child process with
 // limited address space to ensure that it still works, but prints a warning.
 func TestIntFallback(t *testing.T) {
@@ -24,6 +24,10 @@ func (fn *Function) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Va
 	// Postcondition: args is not mutated. This is stricter than required by Callable,
 	// but allows CALL to avoid a copy.
 
+	// Take the **kwargs dict forwarded by CALL, if any.
+	kwsrc := thread.fwdKwargs
+	thread.fwdKwargs = nil
+
 	if !resolve.AllowRecursion {
 		// detect recursion
 		for _, fr := range thread.stack[:len(thread.stack)-1] {
@@ -56,54 +60,146 @@ func (fn *Function) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Va
 	stack := space[nlocals:]          // operand stack
 
 	// Digest arguments and set parameters.
-	err := setArgs(locals, fn, args, kwargs)
+	err := setArgs(locals, fn, args, kwargs, kwsrc)
 	if err != nil {
 		return nil, thread.evalError(err)
 	}
 
+	// Spill indicated locals to cells.
+	// Each cell is a separate alloc to avoid spurious liveness.
+	for _, index := range f.Cells {
+		locals[index] = &cell{locals[index]}
+	}
+
+	if f.Generator {
+		// The body is executed by the generator's methods.
+		return newGenerator(thread, fn, locals, stack), nil
+	}
+
+	return fn.run(thread, fr, &execState{locals: locals, stack: stack})
+}
+
+// instrHooks holds the per-instruction hooks enabled for an execution
+// of a function. They are called on the slow path of the interpreter
+// loop, which the thread's stepTrap diverts every instruction to while
+// hooks are enabled, so that disabled hooks cost nothing beyond the
+// step-limit check the loop makes anyway.
+type instrHooks struct {
+	fn       *Function
+	hits     []uint32 // coverage hit flags, indexed by pc
+	counts   []uint64 // execution counts, indexed by pc
+	tracer   *Tracer
+	registry *ThreadRegistry
+}
+
+// hooksFor returns the per-instruction hooks of the thread for an
+// execution of fn, or nil if there are none.
+func (thread *Thread) hooksFor(fn *Function) *instrHooks {
+	if thread.Coverage == nil && thread.ExecProfile == nil && thread.Tracer == nil && thread.Registry == nil {
+		return nil
+	}
+	hooks := &instrHooks{fn: fn, tracer: thread.Tracer, registry: thread.Registry}
+	if thread.Coverage != nil {
+		hooks.hits = thread.Coverage.hits(fn)
+	}
+	if thread.ExecProfile != nil {
+		hooks.counts = thread.ExecProfile.counts(fn)
+	}
+	return hooks
+}
+
+// step calls the hooks for the instruction at pc,
+// given the operand stack before it executes.
+func (hooks *instrHooks) step(thread *Thread, pc uint32, stack []Value) {
+	fn := hooks.fn
+	if hooks.hits != nil && atomic.LoadUint32(&hooks.hits[pc]) == 0 {
+		atomic.StoreUint32(&hooks.hits[pc], 1)
+	}
+	if hooks.counts != nil {
+		atomic.AddUint64(&hooks.counts[pc], 1)
+	}
+	if hooks.tracer != nil {
+		op, arg, _ := compile.DecodeOp(fn.funcode.Code, pc)
+		hooks.tracer.trace(thread, fn, pc, op, arg, stack)
+	}
+	if hooks.registry != nil && thread.Steps%registrySampleInterval == 0 {
+		hooks.registry.sample(thread, fn, pc)
+	}
+}
+
+// An execState holds the state of an execution of a function body,
+// which in a generator may be suspended and later resumed.
+type execState struct {
+	locals    []Value          // local variables, starting with parameters
+	stack     []Value          // operand stack
+	sp        int              // operand stack pointer
+	pc        uint32           // program counter of next instruction
+	iterstack []Iterator       // stack of active iterators
+	withstack []ContextManager // stack of active with statements
+	suspended bool             // execution is suspended at a yield
+}
+
+// run executes the body of fn, starting from state st, until it
+// returns, fails, or yields. If it yields, run returns the yielded value
+// and sets st.suspended, and the state may later be resumed by another
+// call to run.
+func (fn *Function) run(thread *Thread, fr *frame, st *execState) (Value, error) {
+	f := fn.funcode
+	locals, stack := st.locals, st.stack
+	iterstack, withstack := st.iterstack, st.withstack
+	st.suspended = false
+
 	fr.locals = locals
 
 	if vmdebug {
-		fmt.Printf("Entering %s @ %s\n", f.Name, f.Position(0))
+		fmt.Printf("Entering %s @ %s\n", f.Name, f.Position(st.pc))
 		fmt.Printf("%d stack, %d locals\n", len(stack), len(locals))
 		defer fmt.Println("Leaving ", f.Name)
 	}
 
-	// Spill indicated locals to cells.
-	// Each cell is a separate alloc to avoid spurious liveness.
-	for _, index := range f.Cells {
-		locals[index] = &cell{locals[index]}
-	}
-
 	// TODO(adonovan): add static check that beneath this point
 	// - there is exactly one return statement
 	// - there is no redefinition of 'err'.
 
-	var iterstack []Iterator // stack of active iterators
+	hooks := thread.hooksFor(fn) // nil unless a per-instruction hook is enabled
+	if hooks != nil {
+		thread.stepTrap = 0
+	}
+	lazy := fn.module.lazy // some variables may hold lazy load bindings
 
 	// Use defer so that application panics can pass through
 	// interpreter without leaving thread in a bad state.
 	defer func() {
-		// ITERPOP the rest of the iterator stack.
-		for _, iter := range iterstack {
-			iter.Done()
+		// ITERPOP the rest of the iterator stack,
+		// unless it is retained by a suspended generator.
+		if !st.suspended {
+			for _, iter := range iterstack {
+				iter.Done()
+			}
 		}
 
 		fr.locals = nil
 	}()
 
-	sp := 0
-	var pc uint32
+	sp := st.sp
+	pc := st.pc
 	var result Value
+	var err error
 	code := f.Code
 loop:
 	for {
 		thread.Steps++
-		if thread.Steps >= thread.maxSteps {
-			if thread.OnMaxSteps != nil {
-				thread.OnMaxSteps(thread)
-			} else {
-				thread.Cancel("too many steps")
+		if thread.Steps >= thread.stepTrap {
+			// Slow path: a hook is enabled or the step limit is reached.
+			if hooks != nil {
+				hooks.step(thread, pc, stack[:sp])
+			}
+			if thread.Steps >= thread.maxSteps {
+				if thread.OnMaxSteps != nil {
+					thread.OnMaxSteps(thread)
+				} else {
+					thread.Cancel("too many steps")
+				}
 			}
 		}
 		if reason := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason))); reason != nil {
@@ -184,7 +280,13 @@ loop:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
-			z, err2 := Binary(binop, x, y)
+			var z Value
+			var err2 error
+			if s, ok := x.(String); ok && binop == syntax.PERCENT {
+				z, err2 = interpolate(string(s), y, thread.StringLimits, thread.BazelCompatible)
+			} else {
+				z, err2 = Binary(binop, x, y)
+			}
 			if err2 != nil {
 				err = err2
 				break loop
@@ -207,59 +309,20 @@ loop:
 			}
 			stack[sp-1] = y
 
-		case compile.INPLACE_ADD:
+		case compile.INPLACE_ADD, compile.INPLACE_PIPE:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
 
-			// It's possible that y is not Iterable but
-			// nonetheless defines x+y, in which case we
-			// should fall back to the general case.
-			var z Value
-			if xlist, ok := x.(*List); ok {
-				if yiter, ok := y.(Iterable); ok {
-					if err = xlist.checkMutable("apply += to"); err != nil {
-						break loop
-					}
-					listExtend(xlist, yiter)
-					z = xlist
-				}
-			}
-			if z == nil {
-				z, err = Binary(syntax.PLUS, x, y)
-				if err != nil {
-					break loop
-				}
+			binop := syntax.PLUS
+			if op == compile.INPLACE_PIPE {
+				binop = syntax.PIPE
 			}
-
-			stack[sp] = z
-			sp++
-
-		case compile.INPLACE_PIPE:
-			y := stack[sp-1]
-			x := stack[sp-2]
-			sp -= 2
-
-			// It's possible that y is not Dict but
-			// nonetheless defines x|y, in which case we
-			// should fall back to the general case.
-			var z Value
-			if xdict, ok := x.(*Dict); ok {
-				if ydict, ok := y.(*Dict); ok {
-					if err = xdict.ht.checkMutable("apply |= to"); err != nil {
-						break loop
-					}
-					xdict.ht.addAll(&ydict.ht) // can't fail
-					z = xdict
-				}
-			}
-			if z == nil {
-				z, err = Binary(syntax.PIPE, x, y)
-				if err != nil {
-					break loop
-				}
+			z, err2 := InplaceBinary(binop, x, y)
+			if err2 != nil {
+				err = err2
+				break loop
 			}
-
 			stack[sp] = z
 			sp++
 
@@ -309,6 +372,18 @@ loop:
 					kvpairs = append(kvpairs, pair)
 				}
 			}
+			// Optimization: when a call such as f(*args, **kwargs) forwards
+			// a tuple and dict unchanged to another Starlark function,
+			// which can be trusted not to mutate them, pass the tuple
+			// as is, and the dict directly to setArgs, to avoid
+			// flattening it and rehashing its keys.
+			npos := int(arg >> 8)
+			_, toFunction := stack[sp-npos-1].(*Function)
+			var fwdKwargs *Dict
+			if dict, ok := kwargs.(*Dict); ok && toFunction && kvpairs == nil {
+				fwdKwargs = dict
+				kwargs = nil
+			}
 			if kwargs != nil {
 				// Add key/value items from **kwargs dictionary.
 				dict, ok := kwargs.(IterableMapping)
@@ -332,20 +407,22 @@ loop:
 
 			// positional args
 			var positional Tuple
-			if npos := int(arg >> 8); npos > 0 {
+			if npos > 0 {
 				positional = stack[sp-npos : sp]
 				sp -= npos
 
 				// Copy positional arguments into a new array,
 				// unless the callee is another Starlark function,
 				// in which case it can be trusted not to mutate them.
-				if _, ok := stack[sp-1].(*Function); !ok || args != nil {
+				if !toFunction || args != nil {
 					positional = append(Tuple(nil), positional...)
 				}
 			}
-			if args != nil {
+			if tuple, ok := args.(Tuple); ok && toFunction && positional == nil {
+				positional = tuple
+			} else if args != nil {
 				// Add elements from *args sequence.
-				iter := Iterate(args)
+				iter := iterateOn(thread, args)
 				if iter == nil {
 					err = fmt.Errorf("argument after * must be iterable, not %s", args.Type())
 					break loop
@@ -354,7 +431,12 @@ loop:
 				for iter.Next(&elem) {
 					positional = append(positional, elem)
 				}
+				err2 := iterErr(iter)
 				iter.Done()
+				if err2 != nil {
+					err = err2
+					break loop
+				}
 			}
 
 			function := stack[sp-1]
@@ -365,6 +447,7 @@ loop:
 			}
 
 			thread.endProfSpan()
+			thread.fwdKwargs = fwdKwargs
 			z, err2 := Call(thread, function, positional, kvpairs)
 			thread.beginProfSpan()
 			if err2 != nil {
@@ -379,7 +462,7 @@ loop:
 		case compile.ITERPUSH:
 			x := stack[sp-1]
 			sp--
-			iter := Iterate(x)
+			iter := iterateOn(thread, x)
 			if iter == nil {
 				err = fmt.Errorf("%s value is not iterable", x.Type())
 				break loop
@@ -390,6 +473,9 @@ loop:
 			iter := iterstack[len(iterstack)-1]
 			if iter.Next(&stack[sp]) {
 				sp++
+			} else if err2 := iterErr(iter); err2 != nil {
+				err = err2
+				break loop
 			} else {
 				pc = arg
 			}
@@ -399,6 +485,38 @@ loop:
 			iterstack[n].Done()
 			iterstack = iterstack[:n]
 
+		case compile.WITHENTER:
+			x := stack[sp-1]
+			cm, ok := x.(ContextManager)
+			if !ok {
+				err = fmt.Errorf("%s value is not a context manager", x.Type())
+				break loop
+			}
+			y, err2 := cm.Enter(thread)
+			if err2 != nil {
+				err = err2
+				break loop
+			}
+			withstack = append(withstack, cm)
+			stack[sp-1] = y
+
+		case compile.WITHEXIT:
+			n := len(withstack) - 1
+			cm := withstack[n]
+			withstack = withstack[:n]
+			if err2 := cm.Exit(thread, nil); err2 != nil {
+				err = err2
+				break loop
+			}
+
+		case compile.YIELD:
+			result = stack[sp-1]
+			sp-- // the resumer pushes the sent value
+			st.sp, st.pc = sp, pc
+			st.iterstack, st.withstack = iterstack, withstack
+			st.suspended = true
+			break loop
+
 		case compile.NOT:
 			stack[sp-1] = !stack[sp-1].Truth()
 
@@ -416,11 +534,20 @@ loop:
 				break loop
 			}
 
+		case compile.DELINDEX:
+			y := stack[sp-1]
+			x := stack[sp-2]
+			sp -= 2
+			if err2 := delIndex(x, y); err2 != nil {
+				err = err2
+				break loop
+			}
+
 		case compile.INDEX:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
-			z, err2 := getIndex(x, y)
+			z, err2 := IndexThread(thread, x, y)
 			if err2 != nil {
 				err = err2
 				break loop
@@ -431,7 +558,13 @@ loop:
 		case compile.ATTR:
 			x := stack[sp-1]
 			name := f.Prog.Names[arg]
-			y, err2 := getAttr(x, name)
+			if thread.RestrictIntrospection {
+				if err2 := thread.checkAttr(x, name); err2 != nil {
+					err = err2
+					break loop
+				}
+			}
+			y, err2 := getAttr(thread.attrsOf(x), name)
 			if err2 != nil {
 				err = err2
 				break loop
@@ -448,12 +581,25 @@ loop:
 				break loop
 			}
 
+		case compile.DELFIELD:
+			x := stack[sp-1]
+			sp--
+			name := f.Prog.Names[arg]
+			if err2 := delField(x, name); err2 != nil {
+				err = err2
+				break loop
+			}
+
 		case compile.MAKEDICT:
 			stack[sp] = new(Dict)
 			sp++
 
 		case compile.SETDICT, compile.SETDICTUNIQ:
-			dict := stack[sp-3].(*Dict)
+			dict, ok := stack[sp-3].(*Dict)
+			if !ok {
+				err = fmt.Errorf("internal error: %s operand is %s, want dict", op, stack[sp-3].Type())
+				break loop
+			}
 			k := stack[sp-2]
 			v := stack[sp-1]
 			sp -= 3
@@ -469,7 +615,11 @@ loop:
 
 		case compile.APPEND:
 			elem := stack[sp-1]
-			list := stack[sp-2].(*List)
+			list, ok := stack[sp-2].(*List)
+			if !ok {
+				err = fmt.Errorf("internal error: %s operand is %s, want list", op, stack[sp-2].Type())
+				break loop
+			}
 			sp -= 2
 			list.elems = append(list.elems, elem)
 
@@ -491,7 +641,7 @@ loop:
 			n := int(arg)
 			iterable := stack[sp-1]
 			sp--
-			iter := Iterate(iterable)
+			iter := iterateOn(thread, iterable)
 			if iter == nil {
 				err = fmt.Errorf("got %s in sequence assignment", iterable.Type())
 				break loop
@@ -507,7 +657,12 @@ loop:
 				err = fmt.Errorf("too many values to unpack (got %d, want %d)", Len(iterable), n)
 				break loop
 			}
+			err2 := iterErr(iter)
 			iter.Done()
+			if err2 != nil {
+				err = err2
+				break loop
+			}
 			if i < n {
 				err = fmt.Errorf("too few values to unpack (got %d, want %d)", i, n)
 				break loop
@@ -541,10 +696,20 @@ loop:
 
 		case compile.MAKEFUNC:
 			funcode := f.Prog.Functions[arg]
-			tuple := stack[sp-1].(Tuple)
+			tuple, ok := stack[sp-1].(Tuple)
 			n := len(tuple) - len(funcode.Freevars)
+			if !ok || n < 0 {
+				err = fmt.Errorf("internal error: invalid %s operand", op)
+				break loop
+			}
 			defaults := tuple[:n:n]
 			freevars := tuple[n:]
+			for _, fv := range freevars {
+				if _, ok := fv.(*cell); !ok {
+					err = fmt.Errorf("internal error: invalid %s operand", op)
+					break loop
+				}
+			}
 			stack[sp-1] = &Function{
 				funcode:  funcode,
 				module:   fn.module,
@@ -554,16 +719,46 @@ loop:
 
 		case compile.LOAD:
 			n := int(arg)
-			module := string(stack[sp-1].(String))
+			s, ok := stack[sp-1].(String)
+			if !ok {
+				err = fmt.Errorf("internal error: %s operand is %s, want string", op, stack[sp-1].Type())
+				break loop
+			}
+			module := string(s)
 			sp--
 
+			if thread.LoadLazy != nil {
+				force, err2 := thread.LoadLazy(thread, module)
+				if err2 != nil {
+					err = wrappedError{
+						msg:   fmt.Sprintf("cannot load %s: %v", module, err2),
+						cause: err2,
+					}
+					break loop
+				}
+				m := &lazyModule{name: module, force: force}
+				for i := 0; i < n; i++ {
+					s, ok := stack[sp-1-i].(String)
+					if !ok {
+						err = fmt.Errorf("internal error: %s operand is %s, want string", op, stack[sp-1-i].Type())
+						break loop
+					}
+					stack[sp-1-i] = &lazyBinding{module: m, name: string(s)}
+				}
+				fn.module.lazy = true
+				lazy = true
+				break
+			}
+
 			if thread.Load == nil {
 				err = fmt.Errorf("load not implemented by this application")
 				break loop
 			}
 
 			thread.endProfSpan()
+			span := thread.startSpan(LoadSpan, module, fr.Position())
 			dict, err2 := thread.Load(thread, module)
+			thread.endSpan(span, err2)
 			thread.beginProfSpan()
 			if err2 != nil {
 				err = wrappedError{
@@ -574,7 +769,12 @@ loop:
 			}
 
 			for i := 0; i < n; i++ {
-				from := string(stack[sp-1-i].(String))
+				s, ok := stack[sp-1-i].(String)
+				if !ok {
+					err = fmt.Errorf("internal error: %s operand is %s, want string", op, stack[sp-1-i].Type())
+					break loop
+				}
+				from := string(s)
 				v, ok := dict[from]
 				if !ok {
 					err = fmt.Errorf("load: name %s not found in module %s", from, module)
@@ -604,6 +804,14 @@ loop:
 				err = fmt.Errorf("local variable %s referenced before assignment", f.Locals[arg].Name)
 				break loop
 			}
+			if lazy {
+				if b, ok := x.(*lazyBinding); ok {
+					if x, err = b.get(thread); err != nil {
+						break loop
+					}
+					locals[arg] = x
+				}
+			}
 			stack[sp] = x
 			sp++
 
@@ -617,6 +825,15 @@ loop:
 				err = fmt.Errorf("local variable %s referenced before assignment", f.Locals[arg].Name)
 				break loop
 			}
+			if lazy {
+				if b, ok := v.(*lazyBinding); ok {
+					// The cell may be shared by functions called
+					// concurrently, so it is not updated.
+					if v, err = b.get(thread); err != nil {
+						break loop
+					}
+				}
+			}
 			stack[sp] = v
 			sp++
 
@@ -626,6 +843,13 @@ loop:
 				err = fmt.Errorf("local variable %s referenced before assignment", f.Freevars[arg].Name)
 				break loop
 			}
+			if lazy {
+				if b, ok := v.(*lazyBinding); ok {
+					if v, err = b.get(thread); err != nil {
+						break loop
+					}
+				}
+			}
 			stack[sp] = v
 			sp++
 
@@ -635,6 +859,14 @@ loop:
 				err = fmt.Errorf("global variable %s referenced before assignment", f.Prog.Globals[arg].Name)
 				break loop
 			}
+			if lazy {
+				if b, ok := x.(*lazyBinding); ok {
+					if x, err = b.get(thread); err != nil {
+						break loop
+					}
+					fn.module.globals[arg] = x
+				}
+			}
 			stack[sp] = x
 			sp++
 
@@ -657,6 +889,19 @@ loop:
 			break loop
 		}
 	}
+
+	if st.suspended {
+		return result, nil
+	}
+
+	// Exit the context managers of any with statements still active
+	// because of a return statement or an error, innermost first.
+	for i := len(withstack) - 1; i >= 0; i-- {
+		if err2 := withstack[i].Exit(thread, err); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+
 	// (deferred cleanup runs here)
 	return result, err
 }
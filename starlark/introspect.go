@@ -0,0 +1,81 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the restriction of introspection for sandboxes.
+
+import "fmt"
+
+// An IntrospectionKind identifies an introspection facility that may
+// reveal details of the host application to a Starlark program, and so
+// is denied to the programs executed by a thread whose
+// RestrictIntrospection field is set, unless its IntrospectionPolicy
+// permits it.
+type IntrospectionKind uint8
+
+const (
+	// IntrospectDir is a call of dir on a value of a type defined by
+	// the application, rather than a core type such as list or dict;
+	// it reveals the names of the value's host-backed attributes.
+	IntrospectDir IntrospectionKind = iota
+
+	// IntrospectParams is a reference to the __params__ attribute of a
+	// function, which reveals its default values, and thus the
+	// globals and host values to which they refer.
+	IntrospectParams
+
+	// IntrospectBacktrace is the catching of an error whose backtrace
+	// attribute would reveal the file names, which may be host paths,
+	// of the functions active when the error occurred. If it is
+	// denied, the attribute is the error message alone. The value is
+	// the function called by catch.
+	IntrospectBacktrace
+)
+
+var introspectionKindNames = [...]string{
+	IntrospectDir:       "dir",
+	IntrospectParams:    "__params__",
+	IntrospectBacktrace: "backtrace",
+}
+
+func (k IntrospectionKind) String() string {
+	if int(k) < len(introspectionKindNames) {
+		return introspectionKindNames[k]
+	}
+	return fmt.Sprintf("IntrospectionKind(%d)", k)
+}
+
+// introspect returns an error if the thread may not use
+// the specified introspection facility on value x.
+func (thread *Thread) introspect(kind IntrospectionKind, x Value) error {
+	if !thread.RestrictIntrospection {
+		return nil
+	}
+	if thread.IntrospectionPolicy != nil && thread.IntrospectionPolicy(thread, kind, x) {
+		return nil
+	}
+	return fmt.Errorf("%s of %s is not permitted", kind, x.Type())
+}
+
+// checkAttr returns an error if the thread may
+// not obtain the specified attribute of x.
+func (thread *Thread) checkAttr(x Value, name string) error {
+	if name == "__params__" {
+		if _, ok := x.(*Function); ok {
+			return thread.introspect(IntrospectParams, x)
+		}
+	}
+	return nil
+}
+
+// isCoreValue reports whether x is of a core Starlark type,
+// whose attributes are defined by this package.
+func isCoreValue(x Value) bool {
+	switch x.(type) {
+	case NoneType, Bool, Int, Float, String, Bytes, Tuple, *List, *Dict, *Set, *Function, *Builtin:
+		return true
+	}
+	return false
+}
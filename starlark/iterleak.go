@@ -0,0 +1,179 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the iterator leak detector.
+//
+// An iterator over an unfrozen list, dict, set, or generator prevents
+// mutation of the underlying value until its Done method is called, so
+// a built-in that forgets to call Done causes confusing errors much
+// later. When leak checking is enabled, each such iterator records the
+// Starlark and Go call stacks at its creation, and the record is
+// discarded by Done; any record that remains when a top-level execution
+// of the creating thread finishes is reported as a leak.
+//
+// The creating thread is found from the current goroutine, whose ID
+// is parsed from the output of runtime.Stack. This is slow, but the
+// detector is intended only for debugging and tests. When it is
+// disabled, the cost is an atomic load per iterator. A top-level
+// execution may be nested within another on the same goroutine, as
+// when a Load function executes a module in a new thread; the inner
+// thread is checked until it finishes, and then the outer one again.
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var iterLeakCheck uint32 // atomic; nonzero => leak checking enabled
+
+// SetIteratorLeakCheck enables or disables the iterator leak detector.
+//
+// While it is enabled, each iterator created by a thread over an
+// unfrozen list, dict, set, or generator whose Done method has not been
+// called by the end of the thread's top-level execution is reported to
+// the thread's OnIteratorLeak function, or to os.Stderr if it is nil.
+// Only top-level executions that begin while the detector is enabled
+// are checked.
+func SetIteratorLeakCheck(enabled bool) {
+	var x uint32
+	if enabled {
+		x = 1
+	}
+	atomic.StoreUint32(&iterLeakCheck, x)
+}
+
+// An IteratorLeak describes an iterator whose Done method was not called.
+type IteratorLeak struct {
+	Type      string    // type of the iterated value, such as "list"
+	CallStack CallStack // Starlark call stack at the creation of the iterator
+	GoStack   string    // Go call stack at the creation of the iterator
+}
+
+// String returns a description of the leak and the call stacks
+// at which the iterator was created.
+func (leak *IteratorLeak) String() string {
+	return fmt.Sprintf("leaked iterator over %s, created at:\n%s%s", leak.Type, leak.CallStack, leak.GoStack)
+}
+
+// An iterRecord records the creation of an active iterator.
+type iterRecord struct {
+	thread *Thread
+	seq    uint64 // order of creation
+	leak   IteratorLeak
+}
+
+var iterLeaks struct {
+	mu      sync.Mutex
+	threads map[uint64]*Thread // threads in top-level execution, by goroutine ID
+	seq     uint64             // number of records created
+}
+
+// trackIterator returns a record of the creation of an iterator over a
+// value of the specified type, or nil if leak checking is disabled or
+// the iterator was not created by a checked thread.
+func trackIterator(typ string) *iterRecord {
+	if atomic.LoadUint32(&iterLeakCheck) == 0 {
+		return nil
+	}
+	id := goroutineID()
+	iterLeaks.mu.Lock()
+	defer iterLeaks.mu.Unlock()
+	thread := iterLeaks.threads[id]
+	if thread == nil {
+		return nil
+	}
+	buf := make([]byte, 4096)
+	buf = buf[:runtime.Stack(buf, false)]
+	iterLeaks.seq++
+	rec := &iterRecord{
+		thread: thread,
+		seq:    iterLeaks.seq,
+		leak: IteratorLeak{
+			Type:      typ,
+			CallStack: thread.CallStack(),
+			GoStack:   string(buf),
+		},
+	}
+	if thread.iterators == nil {
+		thread.iterators = make(map[*iterRecord]bool)
+	}
+	thread.iterators[rec] = true
+	return rec
+}
+
+// untrackIterator discards the record of an iterator whose Done
+// method has been called. The record may be nil.
+func untrackIterator(rec *iterRecord) {
+	if rec == nil {
+		return
+	}
+	iterLeaks.mu.Lock()
+	delete(rec.thread.iterators, rec)
+	iterLeaks.mu.Unlock()
+}
+
+// beginIterLeakCheck begins checking the top-level execution of thread
+// on the current goroutine. It reports whether checking is enabled.
+func (thread *Thread) beginIterLeakCheck() bool {
+	if atomic.LoadUint32(&iterLeakCheck) == 0 {
+		return false
+	}
+	id := goroutineID()
+	iterLeaks.mu.Lock()
+	if iterLeaks.threads == nil {
+		iterLeaks.threads = make(map[uint64]*Thread)
+	}
+	thread.leakGoroutine = id
+	thread.leakOuter = iterLeaks.threads[id]
+	iterLeaks.threads[id] = thread
+	iterLeaks.mu.Unlock()
+	return true
+}
+
+// endIterLeakCheck ends checking the top-level execution of thread,
+// and reports the iterators it leaked, in order of creation.
+func (thread *Thread) endIterLeakCheck() {
+	iterLeaks.mu.Lock()
+	if outer := thread.leakOuter; outer != nil {
+		iterLeaks.threads[thread.leakGoroutine] = outer
+	} else {
+		delete(iterLeaks.threads, thread.leakGoroutine)
+	}
+	thread.leakOuter = nil
+	var recs []*iterRecord
+	for rec := range thread.iterators {
+		recs = append(recs, rec)
+	}
+	thread.iterators = nil
+	iterLeaks.mu.Unlock()
+
+	sort.Slice(recs, func(i, j int) bool { return recs[i].seq < recs[j].seq })
+	for _, rec := range recs {
+		if thread.OnIteratorLeak != nil {
+			thread.OnIteratorLeak(thread, &rec.leak)
+		} else {
+			fmt.Fprintln(os.Stderr, &rec.leak)
+		}
+	}
+}
+
+// goroutineID returns the ID of the current goroutine.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines lazy load bindings.
+//
+// When a thread's LoadLazy hook is set, a load statement binds each
+// name to a lazyBinding placeholder instead of executing the module.
+// The interpreter replaces a placeholder by the value it denotes when
+// a variable holding it is first read. Placeholders never escape to
+// Starlark values: the instructions that read variables are the only
+// way to observe them, and the globals of a module are forced when its
+// initialization completes, as they become visible to its clients, or
+// unbound if it fails.
+//
+// The per-read check is enabled only in modules that have executed a
+// lazy load statement, so the cost to other code is a single
+// predictable branch per variable read.
+
+import (
+	"fmt"
+	"sync"
+
+	"go.starlark.net/internal/spell"
+	"go.starlark.net/syntax"
+)
+
+// A lazyModule is a module loaded by a lazy load statement.
+type lazyModule struct {
+	name  string
+	force func(thread *Thread) (StringDict, error)
+
+	once    sync.Once
+	globals StringDict
+	err     error
+}
+
+// A lazyBinding is a placeholder for a name bound by a lazy load statement.
+type lazyBinding struct {
+	module *lazyModule
+	name   string
+}
+
+var _ Value = (*lazyBinding)(nil)
+
+func (b *lazyBinding) String() string        { return fmt.Sprintf("<lazy %s from %s>", b.name, b.module.name) }
+func (b *lazyBinding) Type() string          { return "lazy_binding" }
+func (b *lazyBinding) Freeze()               {}
+func (b *lazyBinding) Truth() Bool           { panic("unreachable") }
+func (b *lazyBinding) Hash() (uint32, error) { panic("unreachable") }
+
+// get returns the value denoted by the binding, executing the module if
+// this is the first use of any of its bindings. The module is executed
+// at most once, by the first thread to use it.
+func (b *lazyBinding) get(thread *Thread) (Value, error) {
+	m := b.module
+	m.once.Do(func() {
+		thread.endProfSpan()
+		var pos syntax.Position // position of first use, if within a call
+		if len(thread.stack) > 0 {
+			pos = thread.frameAt(0).Position()
+		}
+		span := thread.startSpan(LoadSpan, m.name, pos)
+		m.globals, m.err = m.force(thread)
+		thread.endSpan(span, m.err)
+		thread.beginProfSpan()
+	})
+	if m.err != nil {
+		return nil, wrappedError{
+			msg:   fmt.Sprintf("cannot load %s: %v", m.name, m.err),
+			cause: m.err,
+		}
+	}
+	v, ok := m.globals[b.name]
+	if !ok {
+		err := fmt.Errorf("load: name %s not found in module %s", b.name, m.name)
+		if n := spell.Nearest(b.name, m.globals.Keys()); n != "" {
+			err = fmt.Errorf("%s (did you mean %s?)", err, n)
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// settleLazy ensures that no lazyBinding escapes the module when its
+// initialization ends with the specified error. If it succeeded, the
+// lazy globals are forced, as by forceLazy; if it or forcing failed,
+// the lazy globals that remain are unbound, since the (partial) globals
+// of a module are returned to its client even after an error.
+func (m *module) settleLazy(thread *Thread, err error) error {
+	if err == nil {
+		err = m.forceLazy(thread)
+	}
+	if err != nil && m.lazy {
+		for i, v := range m.globals {
+			if _, ok := v.(*lazyBinding); ok {
+				m.globals[i] = nil
+			}
+		}
+	}
+	return err
+}
+
+// forceLazy replaces each global of the module that
+// is bound lazily by the value it denotes.
+func (m *module) forceLazy(thread *Thread) error {
+	if !m.lazy {
+		return nil
+	}
+	for i, v := range m.globals {
+		if b, ok := v.(*lazyBinding); ok {
+			v, err := b.get(thread)
+			if err != nil {
+				return err
+			}
+			m.globals[i] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the lazy iterables returned by map and filter,
+// and by enumerate, zip, and reversed when resolve.LazyIterators is
+// enabled.
+
+import "fmt"
+
+// A lazyIterable is an iterable whose elements are computed on demand
+// from those of other values. Each call to Iterate begins a new pass
+// over the underlying values, so a lazy iterable may be iterated more
+// than once if they can.
+//
+// The iterators of map and filter call functions on the thread that
+// created the iterable. Because a frozen value may be iterated by other
+// threads, freezing such an iterable computes its elements at once, on
+// that thread; subsequent passes yield the saved elements.
+type lazyIterable struct {
+	typ     string  // type name, such as "zip"
+	args    []Value // underlying values
+	thread  *Thread // thread used by iterate to call functions, or nil
+	iterate func() Iterator
+
+	frozen bool
+	elems  Tuple // elements computed by Freeze, if thread != nil
+	err    error // error encountered by Freeze, if any
+}
+
+var _ Iterable = (*lazyIterable)(nil)
+
+func (it *lazyIterable) String() string        { return fmt.Sprintf("<%s object>", it.typ) }
+func (it *lazyIterable) Type() string          { return it.typ }
+func (it *lazyIterable) Truth() Bool           { return True }
+func (it *lazyIterable) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", it.typ) }
+
+func (it *lazyIterable) Iterate() Iterator {
+	if it.frozen && it.thread != nil {
+		return &savedIterator{elems: it.elems, err: it.err}
+	}
+	return it.iterate()
+}
+
+func (it *lazyIterable) Freeze() {
+	if it.frozen {
+		return
+	}
+	it.frozen = true
+	for _, arg := range it.args {
+		arg.Freeze()
+	}
+	if it.thread != nil {
+		iter := it.iterate()
+		var x Value
+		for iter.Next(&x) {
+			x.Freeze()
+			it.elems = append(it.elems, x)
+		}
+		it.err = iterErr(iter)
+		iter.Done()
+	}
+}
+
+// A savedIterator yields the elements computed when a lazy iterable was
+// frozen, followed by the error, if any, that ended the computation.
+type savedIterator struct {
+	elems Tuple
+	err   error
+}
+
+func (it *savedIterator) Next(p *Value) bool {
+	if len(it.elems) == 0 {
+		return false
+	}
+	*p = it.elems[0]
+	it.elems = it.elems[1:]
+	return true
+}
+func (it *savedIterator) Done()      {}
+func (it *savedIterator) Err() error { return it.err }
+
+// An enumerateIterator yields (index, element) pairs of another iterator.
+type enumerateIterator struct {
+	iter Iterator
+	i    int
+}
+
+func (it *enumerateIterator) Next(p *Value) bool {
+	var x Value
+	if !it.iter.Next(&x) {
+		return false
+	}
+	*p = Tuple{MakeInt(it.i), x}
+	it.i++
+	return true
+}
+func (it *enumerateIterator) Done()                    { it.iter.Done() }
+func (it *enumerateIterator) setThread(thread *Thread) { setThread(thread, it.iter) }
+func (it *enumerateIterator) Err() error               { return iterErr(it.iter) }
+
+// A zipIterator yields tuples of the corresponding elements of
+// several iterators, until the first of them is exhausted.
+type zipIterator struct {
+	iters []Iterator
+	err   error
+}
+
+func (it *zipIterator) Next(p *Value) bool {
+	if len(it.iters) == 0 {
+		return false
+	}
+	tuple := make(Tuple, len(it.iters))
+	for i, iter := range it.iters {
+		if !iter.Next(&tuple[i]) {
+			it.err = iterErr(iter)
+			return false
+		}
+	}
+	*p = tuple
+	return true
+}
+func (it *zipIterator) Done() {
+	for _, iter := range it.iters {
+		iter.Done()
+	}
+}
+func (it *zipIterator) Err() error               { return it.err }
+func (it *zipIterator) setThread(thread *Thread) { setThread(thread, it.iters...) }
+
+// A reversedIterator yields the elements of a sequence in reverse order.
+type reversedIterator struct {
+	seq Indexable
+	i   int      // index of previous element
+	pin Iterator // prevents mutation of seq during iteration; may be nil
+	src Iterator // iterator whose elements are yet to be gathered; may be nil
+	err error
+}
+
+// reverseIterate returns an iterator over the elements of iterable x
+// in reverse order. If x is not indexable, its elements are gathered
+// into a tuple before the first element is yielded.
+func reverseIterate(x Iterable) Iterator {
+	if seq, ok := x.(Indexable); ok {
+		return &reversedIterator{seq: seq, i: seq.Len(), pin: x.Iterate()}
+	}
+	return &reversedIterator{src: x.Iterate()}
+}
+
+func (it *reversedIterator) Next(p *Value) bool {
+	if it.src != nil {
+		var elems Tuple
+		var elem Value
+		for it.src.Next(&elem) {
+			elems = append(elems, elem)
+		}
+		it.seq, it.i, it.err = elems, len(elems), iterErr(it.src)
+		it.src.Done()
+		it.src = nil
+	}
+	if it.err != nil || it.i == 0 {
+		return false
+	}
+	it.i--
+	*p = it.seq.Index(it.i)
+	return true
+}
+func (it *reversedIterator) Done() {
+	if it.pin != nil {
+		it.pin.Done()
+	}
+	if it.src != nil {
+		it.src.Done()
+	}
+}
+func (it *reversedIterator) setThread(thread *Thread) { setThread(thread, it.src) }
+func (it *reversedIterator) Err() error               { return it.err }
+
+// A mapIterator yields the results of applying a function to the
+// corresponding elements of several iterators, until the first of
+// them is exhausted or a call fails.
+type mapIterator struct {
+	thread *Thread
+	fn     Callable
+	iters  []Iterator
+	err    error
+}
+
+func (it *mapIterator) Next(p *Value) bool {
+	if it.err != nil {
+		return false
+	}
+	args := make(Tuple, len(it.iters))
+	for i, iter := range it.iters {
+		if !iter.Next(&args[i]) {
+			it.err = iterErr(iter)
+			return false
+		}
+	}
+	v, err := Call(it.thread, it.fn, args, nil)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	*p = v
+	return true
+}
+func (it *mapIterator) Done() {
+	for _, iter := range it.iters {
+		iter.Done()
+	}
+}
+func (it *mapIterator) Err() error               { return it.err }
+func (it *mapIterator) setThread(thread *Thread) { setThread(thread, it.iters...) }
+
+// A filterIterator yields the elements of another iterator for which
+// a predicate is true, or which are themselves true if it is nil.
+type filterIterator struct {
+	thread *Thread
+	pred   Callable // may be nil
+	iter   Iterator
+	err    error
+}
+
+func (it *filterIterator) Next(p *Value) bool {
+	if it.err != nil {
+		return false
+	}
+	var x Value
+	for it.iter.Next(&x) {
+		ok := x.Truth()
+		if it.pred != nil {
+			v, err := Call(it.thread, it.pred, Tuple{x}, nil)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			ok = v.Truth()
+		}
+		if ok {
+			*p = x
+			return true
+		}
+	}
+	it.err = iterErr(it.iter)
+	return false
+}
+func (it *filterIterator) Done()                    { it.iter.Done() }
+func (it *filterIterator) Err() error               { return it.err }
+func (it *filterIterator) setThread(thread *Thread) { setThread(thread, it.iter) }
+
+// setThread informs those of the iterators that need to know
+// of the thread that will advance them.
+func setThread(thread *Thread, iters ...Iterator) {
+	for _, iter := range iters {
+		if it, ok := iter.(threadIterator); ok {
+			it.setThread(thread)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"unicode/utf16"
 	"unicode/utf8"
 
+	"go.starlark.net/resolve"
 	"go.starlark.net/syntax"
 )
 
@@ -36,39 +37,45 @@ var Universe StringDict
 func init() {
 	// https://github.com/google/starlark-go/blob/master/doc/spec.md#built-in-constants-and-functions
 	Universe = StringDict{
-		"None":      None,
-		"True":      True,
-		"False":     False,
-		"abs":       NewBuiltin("abs", abs),
-		"any":       NewBuiltin("any", any),
-		"all":       NewBuiltin("all", all),
-		"bool":      NewBuiltin("bool", bool_),
-		"bytes":     NewBuiltin("bytes", bytes_),
-		"chr":       NewBuiltin("chr", chr),
-		"dict":      NewBuiltin("dict", dict),
-		"dir":       NewBuiltin("dir", dir),
-		"enumerate": NewBuiltin("enumerate", enumerate),
-		"fail":      NewBuiltin("fail", fail),
-		"float":     NewBuiltin("float", float),
-		"getattr":   NewBuiltin("getattr", getattr),
-		"hasattr":   NewBuiltin("hasattr", hasattr),
-		"hash":      NewBuiltin("hash", hash),
-		"int":       NewBuiltin("int", int_),
-		"len":       NewBuiltin("len", len_),
-		"list":      NewBuiltin("list", list),
-		"max":       NewBuiltin("max", minmax),
-		"min":       NewBuiltin("min", minmax),
-		"ord":       NewBuiltin("ord", ord),
-		"print":     NewBuiltin("print", print),
-		"range":     NewBuiltin("range", range_),
-		"repr":      NewBuiltin("repr", repr),
-		"reversed":  NewBuiltin("reversed", reversed),
-		"set":       NewBuiltin("set", set), // requires resolve.AllowSet
-		"sorted":    NewBuiltin("sorted", sorted),
-		"str":       NewBuiltin("str", str),
-		"tuple":     NewBuiltin("tuple", tuple),
-		"type":      NewBuiltin("type", type_),
-		"zip":       NewBuiltin("zip", zip),
+		"None":        None,
+		"True":        True,
+		"False":       False,
+		"abs":         NewBuiltin("abs", abs),
+		"any":         NewBuiltin("any", any),
+		"all":         NewBuiltin("all", all),
+		"bool":        NewBuiltin("bool", bool_),
+		"bytes":       NewBuiltin("bytes", bytes_),
+		"catch":       NewBuiltin("catch", catch), // requires resolve.AllowCatch
+		"chr":         NewBuiltin("chr", chr),
+		"defaultdict": NewBuiltin("defaultdict", defaultdict),
+		"dict":        NewBuiltin("dict", dict),
+		"dir":         NewBuiltin("dir", dir),
+		"enumerate":   NewBuiltin("enumerate", enumerate),
+		"fail":        NewBuiltin("fail", fail),
+		"filter":      NewBuiltin("filter", filter),
+		"float":       NewBuiltin("float", float),
+		"getattr":     NewBuiltin("getattr", getattr),
+		"hasattr":     NewBuiltin("hasattr", hasattr),
+		"hash":        NewBuiltin("hash", hash),
+		"int":         NewBuiltin("int", int_),
+		"len":         NewBuiltin("len", len_),
+		"list":        NewBuiltin("list", list),
+		"map":         NewBuiltin("map", map_),
+		"max":         NewBuiltin("max", minmax),
+		"memoize":     NewBuiltin("memoize", memoize),
+		"min":         NewBuiltin("min", minmax),
+		"ord":         NewBuiltin("ord", ord),
+		"partial":     NewBuiltin("partial", partial_),
+		"print":       NewBuiltin("print", print),
+		"range":       NewBuiltin("range", range_),
+		"repr":        NewBuiltin("repr", repr),
+		"reversed":    NewBuiltin("reversed", reversed),
+		"set":         NewBuiltin("set", set), // requires resolve.AllowSet
+		"sorted":      NewBuiltin("sorted", sorted),
+		"str":         NewBuiltin("str", str),
+		"tuple":       NewBuiltin("tuple", tuple),
+		"type":        NewBuiltin("type", type_),
+		"zip":         NewBuiltin("zip", zip),
 	}
 }
 
@@ -80,15 +87,16 @@ var (
 	}
 
 	dictMethods = map[string]*Builtin{
-		"clear":      NewBuiltin("clear", dict_clear),
-		"get":        NewBuiltin("get", dict_get),
-		"items":      NewBuiltin("items", dict_items),
-		"keys":       NewBuiltin("keys", dict_keys),
-		"pop":        NewBuiltin("pop", dict_pop),
-		"popitem":    NewBuiltin("popitem", dict_popitem),
-		"setdefault": NewBuiltin("setdefault", dict_setdefault),
-		"update":     NewBuiltin("update", dict_update),
-		"values":     NewBuiltin("values", dict_values),
+		"clear":          NewBuiltin("clear", dict_clear),
+		"get":            NewBuiltin("get", dict_get),
+		"items":          NewBuiltin("items", dict_items),
+		"keys":           NewBuiltin("keys", dict_keys),
+		"pop":            NewBuiltin("pop", dict_pop),
+		"popitem":        NewBuiltin("popitem", dict_popitem),
+		"setdefault":     NewBuiltin("setdefault", dict_setdefault),
+		"setdefault_all": NewBuiltin("setdefault_all", dict_setdefault_all),
+		"update":         NewBuiltin("update", dict_update),
+		"values":         NewBuiltin("values", dict_values),
 	}
 
 	listMethods = map[string]*Builtin{
@@ -103,12 +111,14 @@ var (
 
 	stringMethods = map[string]*Builtin{
 		"capitalize":     NewBuiltin("capitalize", string_capitalize),
+		"center":         NewBuiltin("center", string_pad),
 		"codepoint_ords": NewBuiltin("codepoint_ords", string_iterable),
 		"codepoints":     NewBuiltin("codepoints", string_iterable), // sic
 		"count":          NewBuiltin("count", string_count),
 		"elem_ords":      NewBuiltin("elem_ords", string_iterable),
 		"elems":          NewBuiltin("elems", string_iterable),      // sic
 		"endswith":       NewBuiltin("endswith", string_startswith), // sic
+		"expandtabs":     NewBuiltin("expandtabs", string_expandtabs),
 		"find":           NewBuiltin("find", string_find),
 		"format":         NewBuiltin("format", string_format),
 		"index":          NewBuiltin("index", string_index),
@@ -120,14 +130,17 @@ var (
 		"istitle":        NewBuiltin("istitle", string_istitle),
 		"isupper":        NewBuiltin("isupper", string_isupper),
 		"join":           NewBuiltin("join", string_join),
+		"ljust":          NewBuiltin("ljust", string_pad), // sic
 		"lower":          NewBuiltin("lower", string_lower),
 		"lstrip":         NewBuiltin("lstrip", string_strip), // sic
+		"maketrans":      NewBuiltin("maketrans", string_maketrans),
 		"partition":      NewBuiltin("partition", string_partition),
 		"removeprefix":   NewBuiltin("removeprefix", string_removefix),
 		"removesuffix":   NewBuiltin("removesuffix", string_removefix),
 		"replace":        NewBuiltin("replace", string_replace),
 		"rfind":          NewBuiltin("rfind", string_rfind),
 		"rindex":         NewBuiltin("rindex", string_rindex),
+		"rjust":          NewBuiltin("rjust", string_pad),            // sic
 		"rpartition":     NewBuiltin("rpartition", string_partition), // sic
 		"rsplit":         NewBuiltin("rsplit", string_split),         // sic
 		"rstrip":         NewBuiltin("rstrip", string_strip),         // sic
@@ -136,7 +149,9 @@ var (
 		"startswith":     NewBuiltin("startswith", string_startswith),
 		"strip":          NewBuiltin("strip", string_strip),
 		"title":          NewBuiltin("title", string_title),
+		"translate":      NewBuiltin("translate", string_translate),
 		"upper":          NewBuiltin("upper", string_upper),
+		"zfill":          NewBuiltin("zfill", string_zfill),
 	}
 
 	setMethods = map[string]*Builtin{
@@ -188,7 +203,7 @@ func all(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if err := UnpackPositionalArgs("all", args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
+	iter := iterateOn(thread, iterable)
 	defer iter.Done()
 	var x Value
 	for iter.Next(&x) {
@@ -196,6 +211,9 @@ func all(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			return False, nil
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return True, nil
 }
 
@@ -205,7 +223,7 @@ func any(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if err := UnpackPositionalArgs("any", args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
+	iter := iterateOn(thread, iterable)
 	defer iter.Done()
 	var x Value
 	for iter.Next(&x) {
@@ -213,6 +231,9 @@ func any(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			return True, nil
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return False, nil
 }
 
@@ -246,7 +267,7 @@ func bytes_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 			// common case: known length
 			buf.Grow(n)
 		}
-		iter := x.Iterate()
+		iter := iterateOn(thread, x)
 		defer iter.Done()
 		var elem Value
 		var b byte
@@ -256,6 +277,9 @@ func bytes_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 			}
 			buf.WriteByte(b)
 		}
+		if err := iterErr(iter); err != nil {
+			return nil, err
+		}
 		return Bytes(buf.String()), nil
 
 	default:
@@ -264,6 +288,71 @@ func bytes_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	}
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#catch
+func catch(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("catch: missing argument for fn")
+	}
+	fn := args[0]
+	if _, ok := fn.(Callable); !ok {
+		return nil, fmt.Errorf("catch: for parameter fn: got %s, want callable", fn.Type())
+	}
+	result, err := Call(thread, fn, args[1:], kwargs)
+	if err == nil {
+		return Tuple{result, None}, nil
+	}
+	// Cancellation, including exceeding the step limit, is not recoverable.
+	if thread.cancelled() || !recoverable(err) {
+		return nil, err
+	}
+	hideBacktrace := thread.introspect(IntrospectBacktrace, fn) != nil
+	return Tuple{None, caughtError{err, hideBacktrace}}, nil
+}
+
+// recoverable reports whether catch may recover from err, the error of
+// a call. Only an error reported by a built-in function is recoverable;
+// errors reported by fail, internal errors, and the failures of the
+// operations of Starlark code, such as division by zero, are not.
+func recoverable(err error) bool {
+	evalErr, ok := err.(*EvalError)
+	if !ok || len(evalErr.CallStack) == 0 || !evalErr.CallStack.At(0).Builtin {
+		return false
+	}
+	var failed failError
+	var internal internalError
+	return !errors.As(err, &failed) && !errors.As(err, &internal)
+}
+
+// A caughtError is the Starlark value of an error caught by catch.
+type caughtError struct {
+	err           error
+	hideBacktrace bool // see IntrospectBacktrace
+}
+
+var _ HasAttrs = caughtError{}
+
+func (e caughtError) String() string        { return fmt.Sprintf("error(%s)", String(e.err.Error())) }
+func (e caughtError) Type() string          { return "error" }
+func (e caughtError) Freeze()               {} // immutable
+func (e caughtError) Truth() Bool           { return True }
+func (e caughtError) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: error") }
+func (e caughtError) Unwrap() error         { return e.err }
+
+func (e caughtError) Attr(name string) (Value, error) {
+	switch name {
+	case "message":
+		return String(e.err.Error()), nil
+	case "backtrace":
+		if evalErr, ok := e.err.(*EvalError); ok && !e.hideBacktrace {
+			return String(evalErr.Backtrace()), nil
+		}
+		return String(e.err.Error()), nil
+	}
+	return nil, nil
+}
+
+func (e caughtError) AttrNames() []string { return []string{"backtrace", "message"} }
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#chr
 func chr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(kwargs) > 0 {
@@ -291,12 +380,31 @@ func dict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		return nil, fmt.Errorf("dict: got %d arguments, want at most 1", len(args))
 	}
 	dict := new(Dict)
-	if err := updateDict(dict, args, kwargs); err != nil {
+	if err := updateDict(thread, dict, args, kwargs); err != nil {
 		return nil, fmt.Errorf("dict: %v", err)
 	}
 	return dict, nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#defaultdict
+func defaultdict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("defaultdict: got %d arguments, want 1 or 2", len(args))
+	}
+	factory, ok := args[0].(Callable)
+	if !ok {
+		return nil, fmt.Errorf("defaultdict: got %s for factory, want callable", args[0].Type())
+	}
+	dict := new(Dict)
+	if err := updateDict(thread, dict, args[1:], kwargs); err != nil {
+		return nil, fmt.Errorf("defaultdict: %v", err)
+	}
+	if err := dict.SetDefaultFactory(factory); err != nil {
+		return nil, fmt.Errorf("defaultdict: %v", err)
+	}
+	return dict, nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#dir
 func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(kwargs) > 0 {
@@ -308,7 +416,12 @@ func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
 	var names []string
 	if x, ok := args[0].(HasAttrs); ok {
-		names = x.AttrNames()
+		if !isCoreValue(x) {
+			if err := thread.introspect(IntrospectDir, x); err != nil {
+				return nil, fmt.Errorf("dir: %v", err)
+			}
+		}
+		names = thread.attrsOf(x).(HasAttrs).AttrNames()
 	}
 	sort.Strings(names)
 	elems := make([]Value, len(names))
@@ -326,7 +439,17 @@ func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, e
 		return nil, err
 	}
 
-	iter := iterable.Iterate()
+	if resolve.LazyIterators {
+		return &lazyIterable{
+			typ:  "enumerate",
+			args: []Value{iterable},
+			iterate: func() Iterator {
+				return &enumerateIterator{iter: iterable.Iterate(), i: start}
+			},
+		}, nil
+	}
+
+	iter := iterateOn(thread, iterable)
 	defer iter.Done()
 
 	var pairs []Value
@@ -350,6 +473,9 @@ func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, e
 			pairs = append(pairs, pair)
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 
 	return NewList(pairs), nil
 }
@@ -369,11 +495,40 @@ func fail(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		if s, ok := AsString(v); ok {
 			buf.WriteString(s)
 		} else {
-			writeValue(buf, v, nil)
+			writeStr(buf, v, thread.StringLimits)
 		}
 	}
 
-	return nil, errors.New(buf.String())
+	return nil, failError(buf.String())
+}
+
+// A failError is the error reported by fail.
+type failError string
+
+func (e failError) Error() string { return string(e) }
+
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#filter
+func filter(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var pred Value
+	var iterable Iterable
+	if err := UnpackPositionalArgs("filter", args, kwargs, 2, &pred, &iterable); err != nil {
+		return nil, err
+	}
+	var fn Callable
+	if pred != None {
+		var ok bool
+		if fn, ok = pred.(Callable); !ok {
+			return nil, fmt.Errorf("filter: got %s, want callable or None", pred.Type())
+		}
+	}
+	return &lazyIterable{
+		typ:    "filter",
+		args:   []Value{pred, iterable},
+		thread: thread,
+		iterate: func() Iterator {
+			return &filterIterator{thread: thread, pred: fn, iter: iterable.Iterate()}
+		},
+	}, nil
 }
 
 func float(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
@@ -447,7 +602,10 @@ func getattr(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	if err := UnpackPositionalArgs("getattr", args, kwargs, 2, &object, &name, &dflt); err != nil {
 		return nil, err
 	}
-	if object, ok := object.(HasAttrs); ok {
+	if err := thread.checkAttr(object, name); err != nil {
+		return nil, fmt.Errorf("getattr: %v", err)
+	}
+	if object, ok := thread.attrsOf(object).(HasAttrs); ok {
 		v, err := object.Attr(name)
 		if err != nil {
 			// An error could mean the field doesn't exist,
@@ -475,7 +633,7 @@ func hasattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	if err := UnpackPositionalArgs("hasattr", args, kwargs, 2, &object, &name); err != nil {
 		return nil, err
 	}
-	if object, ok := object.(HasAttrs); ok {
+	if object, ok := thread.attrsOf(object).(HasAttrs); ok {
 		v, err := object.Attr(name)
 		if err == nil {
 			return Bool(v != nil), nil
@@ -673,7 +831,7 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	}
 	var elems []Value
 	if iterable != nil {
-		iter := iterable.Iterate()
+		iter := iterateOn(thread, iterable)
 		defer iter.Done()
 		if n := Len(iterable); n > 0 {
 			elems = make([]Value, 0, n) // preallocate if length known
@@ -682,10 +840,47 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		for iter.Next(&x) {
 			elems = append(elems, x)
 		}
+		if err := iterErr(iter); err != nil {
+			return nil, err
+		}
 	}
 	return NewList(elems), nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#map
+func map_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("map does not accept keyword arguments")
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("map: got %d arguments, want at least 2", len(args))
+	}
+	fn, ok := args[0].(Callable)
+	if !ok {
+		return nil, fmt.Errorf("map: got %s, want callable", args[0].Type())
+	}
+	iterables := make([]Iterable, len(args)-1)
+	for i, seq := range args[1:] {
+		iterable, ok := seq.(Iterable)
+		if !ok {
+			return nil, fmt.Errorf("map: argument #%d is not iterable: %s", i+2, seq.Type())
+		}
+		iterables[i] = iterable
+	}
+	return &lazyIterable{
+		typ:    "map",
+		args:   append([]Value(nil), args...),
+		thread: thread,
+		iterate: func() Iterator {
+			iters := make([]Iterator, len(iterables))
+			for i, iterable := range iterables {
+				iters[i] = iterable.Iterate()
+			}
+			return &mapIterator{thread: thread, fn: fn, iters: iters}
+		},
+	}, nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#min
 func minmax(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) == 0 {
@@ -707,13 +902,16 @@ func minmax(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	} else {
 		iterable = args
 	}
-	iter := Iterate(iterable)
+	iter := iterateOn(thread, iterable)
 	if iter == nil {
 		return nil, fmt.Errorf("%s: %s value is not iterable", b.Name(), iterable.Type())
 	}
 	defer iter.Done()
 	var extremum Value
 	if !iter.Next(&extremum) {
+		if err := iterErr(iter); err != nil {
+			return nil, err
+		}
 		return nil, nameErr(b, "argument is an empty sequence")
 	}
 
@@ -751,6 +949,9 @@ func minmax(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 			extremeKey = key
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return extremum, nil
 }
 
@@ -799,8 +1000,10 @@ func print(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error
 			buf.WriteString(s)
 		} else if b, ok := v.(Bytes); ok {
 			buf.WriteString(string(b))
+		} else if _, ok := v.(Reprer); !ok && thread.PrettyOptions != nil {
+			buf.WriteString(PrettyPrint(v, *thread.PrettyOptions))
 		} else {
-			writeValue(buf, v, nil)
+			writeStr(buf, v, thread.StringLimits)
 		}
 	}
 
@@ -950,7 +1153,7 @@ func repr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if err := UnpackPositionalArgs("repr", args, kwargs, 1, &x); err != nil {
 		return nil, err
 	}
-	return String(x.String()), nil
+	return String(toStringLimited(x, thread.StringLimits)), nil
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#reversed
@@ -959,7 +1162,14 @@ func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, er
 	if err := UnpackPositionalArgs("reversed", args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
+	if resolve.LazyIterators {
+		return &lazyIterable{
+			typ:     "reversed",
+			args:    []Value{iterable},
+			iterate: func() Iterator { return reverseIterate(iterable) },
+		}, nil
+	}
+	iter := iterateOn(thread, iterable)
 	defer iter.Done()
 	var elems []Value
 	if n := Len(args[0]); n >= 0 {
@@ -969,6 +1179,9 @@ func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, er
 	for iter.Next(&x) {
 		elems = append(elems, x)
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	n := len(elems)
 	for i := 0; i < n>>1; i++ {
 		elems[i], elems[n-1-i] = elems[n-1-i], elems[i]
@@ -984,7 +1197,7 @@ func set(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	}
 	set := new(Set)
 	if iterable != nil {
-		iter := iterable.Iterate()
+		iter := iterateOn(thread, iterable)
 		defer iter.Done()
 		var x Value
 		for iter.Next(&x) {
@@ -992,6 +1205,9 @@ func set(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 				return nil, nameErr(b, err)
 			}
 		}
+		if err := iterErr(iter); err != nil {
+			return nil, err
+		}
 	}
 	return set, nil
 }
@@ -1010,7 +1226,7 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		return nil, err
 	}
 
-	iter := iterable.Iterate()
+	iter := iterateOn(thread, iterable)
 	defer iter.Done()
 	var values []Value
 	if n := Len(iterable); n > 0 {
@@ -1020,6 +1236,9 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	for iter.Next(&x) {
 		values = append(values, x)
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 
 	// Derive keys from values by applying key function.
 	var keys []Value
@@ -1083,7 +1302,9 @@ func str(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		// Invalid encodings are replaced by that of U+FFFD.
 		return String(utf8Transcode(string(x))), nil
 	default:
-		return String(x.String()), nil
+		buf := new(strings.Builder)
+		writeStr(buf, x, thread.StringLimits)
+		return String(buf.String()), nil
 	}
 }
 
@@ -1110,7 +1331,7 @@ func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	if len(args) == 0 {
 		return Tuple(nil), nil
 	}
-	iter := iterable.Iterate()
+	iter := iterateOn(thread, iterable)
 	defer iter.Done()
 	var elems Tuple
 	if n := Len(iterable); n > 0 {
@@ -1120,6 +1341,9 @@ func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	for iter.Next(&x) {
 		elems = append(elems, x)
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return elems, nil
 }
 
@@ -1139,6 +1363,27 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if len(kwargs) > 0 {
 		return nil, fmt.Errorf("zip does not accept keyword arguments")
 	}
+	if resolve.LazyIterators {
+		iterables := make([]Iterable, len(args))
+		for i, seq := range args {
+			iterable, ok := seq.(Iterable)
+			if !ok {
+				return nil, fmt.Errorf("zip: argument #%d is not iterable: %s", i+1, seq.Type())
+			}
+			iterables[i] = iterable
+		}
+		return &lazyIterable{
+			typ:  "zip",
+			args: append([]Value(nil), args...),
+			iterate: func() Iterator {
+				iters := make([]Iterator, len(iterables))
+				for i, iterable := range iterables {
+					iters[i] = iterable.Iterate()
+				}
+				return &zipIterator{iters: iters}
+			},
+		}, nil
+	}
 	rows, cols := 0, len(args)
 	iters := make([]Iterator, cols)
 	defer func() {
@@ -1149,7 +1394,7 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		}
 	}()
 	for i, seq := range args {
-		it := Iterate(seq)
+		it := iterateOn(thread, seq)
 		if it == nil {
 			return nil, fmt.Errorf("zip: argument #%d is not iterable: %s", i+1, seq.Type())
 		}
@@ -1179,6 +1424,9 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			tuple := make(Tuple, cols)
 			for i, iter := range iters {
 				if !iter.Next(&tuple[i]) {
+					if err := iterErr(iter); err != nil {
+						return nil, err
+					}
 					break outer
 				}
 			}
@@ -1286,12 +1534,47 @@ func dict_setdefault(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value,
 	}
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#dict·setdefault_all
+func dict_setdefault_all(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var keys Iterable
+	var dflt Value
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &keys, &dflt); err != nil {
+		return nil, err
+	}
+	dict := b.Receiver().(*Dict)
+	iter := iterateOn(thread, keys)
+	defer iter.Done()
+	var key Value
+	for iter.Next(&key) {
+		if _, ok, err := dict.Get(key); err != nil {
+			return nil, nameErr(b, err)
+		} else if ok {
+			continue
+		}
+		v := dflt
+		if v == nil {
+			if dict.factory != nil {
+				var err error
+				if v, err = Call(thread, dict.factory, nil, nil); err != nil {
+					return nil, err
+				}
+			} else {
+				v = None
+			}
+		}
+		if err := dict.SetKey(key, v); err != nil {
+			return nil, nameErr(b, err)
+		}
+	}
+	return None, nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#dict·update
-func dict_update(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_update(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) > 1 {
 		return nil, fmt.Errorf("update: got %d arguments, want at most 1", len(args))
 	}
-	if err := updateDict(b.Receiver().(*Dict), args, kwargs); err != nil {
+	if err := updateDict(thread, b.Receiver().(*Dict), args, kwargs); err != nil {
 		return nil, fmt.Errorf("update: %v", err)
 	}
 	return None, nil
@@ -1336,7 +1619,7 @@ func list_clear(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#list·extend
-func list_extend(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+func list_extend(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := b.Receiver().(*List)
 	var iterable Iterable
 	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &iterable); err != nil {
@@ -1345,7 +1628,9 @@ func list_extend(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	if err := recv.checkMutable("extend"); err != nil {
 		return nil, nameErr(b, err)
 	}
-	listExtend(recv, iterable)
+	if err := listExtend(thread, recv, iterable); err != nil {
+		return nil, err
+	}
 	return None, nil
 }
 
@@ -1520,6 +1805,34 @@ func (it *bytesIterator) Next(p *Value) bool {
 
 func (*bytesIterator) Done() {}
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#string·center
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#string·ljust
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#string·rjust
+func string_pad(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	recv := string(b.Receiver().(String))
+	var width int
+	fill := " "
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &width, &fill); err != nil {
+		return nil, err
+	}
+	if utf8.RuneCountInString(fill) != 1 {
+		return nil, fmt.Errorf("%s: fill character must be a single code point, got %q", b.Name(), fill)
+	}
+	pad := width - utf8.RuneCountInString(recv)
+	if pad <= 0 {
+		return String(recv), nil
+	}
+	var left int
+	switch b.name {
+	case "center":
+		// Like Python, favor the left when the string and width are both odd.
+		left = pad/2 + (pad & width & 1)
+	case "rjust":
+		left = pad
+	}
+	return String(strings.Repeat(fill, left) + recv + strings.Repeat(fill, pad-left)), nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·count
 func string_count(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var sub string
@@ -1664,13 +1977,45 @@ func string_isupper(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, e
 	return Bool(isCasedString(recv) && recv == strings.ToUpper(recv)), nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#string·expandtabs
+func string_expandtabs(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	tabsize := 8
+	if err := UnpackArgs(b.Name(), args, kwargs, "tabsize?", &tabsize); err != nil {
+		return nil, err
+	}
+	s := string(b.Receiver().(String))
+	if !strings.Contains(s, "\t") {
+		return String(s), nil
+	}
+	buf := new(strings.Builder)
+	buf.Grow(len(s))
+	col := 0 // column, in code points
+	for _, r := range s {
+		switch r {
+		case '\t':
+			if tabsize > 0 {
+				n := tabsize - col%tabsize
+				buf.WriteString(strings.Repeat(" ", n))
+				col += n
+			}
+		case '\n', '\r':
+			buf.WriteRune(r)
+			col = 0
+		default:
+			buf.WriteRune(r)
+			col++
+		}
+	}
+	return String(buf.String()), nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·find
 func string_find(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(b, args, kwargs, true, false)
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·format
-func string_format(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+func string_format(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	format := string(b.Receiver().(String))
 	var auto, manual bool // kinds of positional indexing used
 	buf := new(strings.Builder)
@@ -1798,10 +2143,10 @@ func string_format(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, er
 			if str, ok := AsString(arg); ok {
 				buf.WriteString(str)
 			} else {
-				writeValue(buf, arg, nil)
+				writeStr(buf, arg, thread.StringLimits)
 			}
 		case "r":
-			writeValue(buf, arg, nil)
+			writeValueLimited(buf, arg, thread.StringLimits)
 		default:
 			return nil, fmt.Errorf("format: unknown conversion %q", conv)
 		}
@@ -1831,13 +2176,13 @@ func string_index(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, err
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·join
-func string_join(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+func string_join(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(b.Receiver().(String))
 	var iterable Iterable
 	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
+	iter := iterateOn(thread, iterable)
 	defer iter.Done()
 	buf := new(strings.Builder)
 	var x Value
@@ -1851,6 +2196,9 @@ func string_join(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		}
 		buf.WriteString(s)
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return String(buf.String()), nil
 }
 
@@ -1862,6 +2210,65 @@ func string_lower(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	return String(strings.ToLower(string(b.Receiver().(String)))), nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#string·maketrans
+func string_maketrans(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	var y, z string
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x, &y, &z); err != nil {
+		return nil, err
+	}
+	table := new(Dict)
+	if len(args) == 1 {
+		// maketrans(dict)
+		m, ok := x.(IterableMapping)
+		if !ok {
+			return nil, fmt.Errorf("%s: got %s, want dict", b.Name(), x.Type())
+		}
+		for _, item := range m.Items() {
+			k, v := item[0], item[1]
+			switch key := k.(type) {
+			case String:
+				r, size := utf8.DecodeRuneInString(string(key))
+				if size == 0 || size != len(key) {
+					return nil, fmt.Errorf("%s: string keys must have length 1, got %s", b.Name(), key)
+				}
+				k = MakeInt(int(r))
+			case Int:
+				// ok
+			default:
+				return nil, fmt.Errorf("%s: got %s key, want string or int", b.Name(), k.Type())
+			}
+			switch v.(type) {
+			case String, Int, NoneType:
+				// ok
+			default:
+				return nil, fmt.Errorf("%s: got %s value, want string, int, or None", b.Name(), v.Type())
+			}
+			if err := table.SetKey(k, v); err != nil {
+				return nil, nameErr(b, err)
+			}
+		}
+		return table, nil
+	}
+
+	// maketrans(x, y[, z])
+	from, ok := AsString(x)
+	if !ok {
+		return nil, fmt.Errorf("%s: got %s, want string", b.Name(), x.Type())
+	}
+	fromRunes, toRunes := []rune(from), []rune(y)
+	if len(fromRunes) != len(toRunes) {
+		return nil, fmt.Errorf("%s: arguments must have equal length, got %d and %d", b.Name(), len(fromRunes), len(toRunes))
+	}
+	for i, r := range fromRunes {
+		table.SetKey(MakeInt(int(r)), MakeInt(int(toRunes[i]))) // can't fail
+	}
+	for _, r := range z {
+		table.SetKey(MakeInt(int(r)), None) // can't fail
+	}
+	return table, nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·partition
 func string_partition(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(b.Receiver().(String))
@@ -2031,6 +2438,52 @@ func string_title(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	return String(buf.String()), nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#string·translate
+func string_translate(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var table Mapping
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &table); err != nil {
+		return nil, err
+	}
+
+	s := string(b.Receiver().(String))
+	buf := new(strings.Builder)
+	buf.Grow(len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			// Copy invalid bytes unchanged.
+			buf.WriteByte(s[i])
+			i++
+			continue
+		}
+		v, found, err := table.Get(MakeInt(int(r)))
+		if err != nil {
+			return nil, nameErr(b, err)
+		}
+		if !found {
+			buf.WriteString(s[i : i+size]) // no mapping
+			i += size
+			continue
+		}
+		switch v := v.(type) {
+		case NoneType:
+			// delete
+		case String:
+			buf.WriteString(string(v))
+		case Int:
+			c, err := AsInt32(v)
+			if err != nil || c < 0 || c > unicode.MaxRune {
+				return nil, fmt.Errorf("%s: invalid code point %s in table", b.Name(), v)
+			}
+			buf.WriteRune(rune(c))
+		default:
+			return nil, fmt.Errorf("%s: got %s in table, want string, int, or None", b.Name(), v.Type())
+		}
+		i += size
+	}
+	return String(buf.String()), nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·upper
 func string_upper(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
@@ -2039,6 +2492,24 @@ func string_upper(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	return String(strings.ToUpper(string(b.Receiver().(String)))), nil
 }
 
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#string·zfill
+func string_zfill(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var width int
+	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 1, &width); err != nil {
+		return nil, err
+	}
+	s := string(b.Receiver().(String))
+	pad := width - utf8.RuneCountInString(s)
+	if pad <= 0 {
+		return String(s), nil
+	}
+	sign := ""
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		sign, s = s[:1], s[1:]
+	}
+	return String(sign + strings.Repeat("0", pad) + s), nil
+}
+
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·split
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#string·rsplit
 func string_split(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
@@ -2169,12 +2640,12 @@ func string_splitlines(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://github.com/google/starlark-go/blob/master/doc/spec.md#set·union.
-func set_union(_ *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+func set_union(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
 	if err := UnpackPositionalArgs(b.Name(), args, kwargs, 0, &iterable); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
+	iter := iterateOn(thread, iterable)
 	defer iter.Done()
 	union, err := b.Receiver().(*Set).Union(iter)
 	if err != nil {
@@ -2218,26 +2689,35 @@ func string_find_impl(b *Builtin, args Tuple, kwargs []Tuple, allowError, last b
 
 // Common implementation of builtin dict function and dict.update method.
 // Precondition: len(updates) == 0 or 1.
-func updateDict(dict *Dict, updates Tuple, kwargs []Tuple) error {
+func updateDict(thread *Thread, dict *Dict, updates Tuple, kwargs []Tuple) error {
 	if len(updates) == 1 {
 		switch updates := updates[0].(type) {
 		case IterableMapping:
+			// Allocate space for the new entries at once.
+			// (The length of any other iterable is not a reliable
+			// guide, as its elements may not be valid pairs.)
+			items := updates.Items()
+			if len(items) > 0 {
+				if err := dict.ht.reserve(len(items) + len(kwargs)); err != nil {
+					return err // dict is frozen
+				}
+			}
 			// Iterate over dict's key/value pairs, not just keys.
-			for _, item := range updates.Items() {
+			for _, item := range items {
 				if err := dict.SetKey(item[0], item[1]); err != nil {
 					return err // dict is frozen
 				}
 			}
 		default:
 			// all other sequences
-			iter := Iterate(updates)
+			iter := iterateOn(thread, updates)
 			if iter == nil {
 				return fmt.Errorf("got %s, want iterable", updates.Type())
 			}
 			defer iter.Done()
 			var pair Value
 			for i := 0; iter.Next(&pair); i++ {
-				iter2 := Iterate(pair)
+				iter2 := iterateOn(thread, pair)
 				if iter2 == nil {
 					return fmt.Errorf("dictionary update sequence element #%d is not iterable (%s)", i, pair.Type())
 
@@ -2256,6 +2736,9 @@ func updateDict(dict *Dict, updates Tuple, kwargs []Tuple) error {
 					return err
 				}
 			}
+			if err := iterErr(iter); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -0,0 +1,92 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the memoize built-in.
+//
+// The caches of a memoized function belong to the threads that call it,
+// not to the function, so a function memoized by a module and shared by
+// many threads is safe for concurrent use, and its cached results live
+// only as long as the thread.
+
+import "fmt"
+
+// defaultMemoSize is the default bound on the number of results
+// cached by a thread for a memoized function.
+const defaultMemoSize = 128
+
+// A memoized is a function that caches its results; see memoize.
+type memoized struct {
+	fn      Callable
+	maxsize int
+}
+
+var _ Callable = (*memoized)(nil)
+
+// A memoCache holds the results of a memoized function, keyed by
+// arguments, in order of last use.
+type memoCache struct {
+	ht hashtable
+}
+
+func (m *memoized) Name() string          { return m.fn.Name() }
+func (m *memoized) String() string        { return fmt.Sprintf("<memoized %s>", m.fn.Name()) }
+func (m *memoized) Type() string          { return "memoized" }
+func (m *memoized) Freeze()               { m.fn.Freeze() }
+func (m *memoized) Truth() Bool           { return True }
+func (m *memoized) Hash() (uint32, error) { return hashString(m.fn.Name()), nil }
+
+func (m *memoized) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	// The key is a pair of tuples, copied as the caller may reuse them.
+	kw := make(Tuple, len(kwargs))
+	for i, kwarg := range kwargs {
+		kw[i] = kwarg
+	}
+	key := Tuple{append(Tuple(nil), args...), kw}
+	if _, err := key.Hash(); err != nil {
+		return nil, fmt.Errorf("%s: memoized function called with %v", m.Name(), err)
+	}
+
+	cache := thread.memo[m]
+	if cache == nil {
+		if thread.memo == nil {
+			thread.memo = make(map[*memoized]*memoCache)
+		}
+		cache = new(memoCache)
+		thread.memo[m] = cache
+	}
+	if v, found, err := cache.ht.delete(key); err != nil {
+		return nil, err
+	} else if found {
+		cache.ht.insert(key, v) // mark as most recently used; can't fail
+		return v, nil
+	}
+
+	v, err := Call(thread, m.fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if _, found, _ := cache.ht.lookup(key); !found {
+		// Evict the least recently used results.
+		for int(cache.ht.len) >= m.maxsize {
+			cache.ht.delete(cache.ht.head.key) // can't fail
+		}
+		cache.ht.insert(key, v) // can't fail
+	}
+	return v, nil
+}
+
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#memoize
+func memoize(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var fn Callable
+	maxsize := defaultMemoSize
+	if err := UnpackArgs(b.Name(), args, kwargs, "fn", &fn, "maxsize?", &maxsize); err != nil {
+		return nil, err
+	}
+	if maxsize < 1 {
+		return nil, fmt.Errorf("%s: maxsize must be positive, got %d", b.Name(), maxsize)
+	}
+	return &memoized{fn: fn, maxsize: maxsize}, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// A Metadata is a side table that associates embedder-defined metadata,
+// such as provenance, source positions, or taint labels, with values.
+// It allows an application to trace, for example, which configuration
+// file a value came from, without changing the representation of values.
+//
+// Metadata is keyed by value identity, so it may be associated only
+// with values represented by a pointer, such as a *List, *Dict, or
+// *Function, or an application-defined pointer type. Values such as
+// strings, ints, and tuples have no identity and carry no metadata.
+//
+// Operations that create new values do not propagate metadata; the
+// built-in functions of the application that copy or derive values may
+// use Copy or Merge to do so.
+//
+// A Metadata holds a reference to each value that has metadata,
+// so the value remains live until its metadata is deleted.
+//
+// The zero value is an empty table ready to use.
+// A Metadata is safe for concurrent use by multiple goroutines.
+type Metadata struct {
+	mu sync.Mutex
+	m  map[Value]interface{}
+}
+
+// HasIdentity reports whether metadata may be associated with v.
+func HasIdentity(v Value) bool {
+	return v != nil && reflect.TypeOf(v).Kind() == reflect.Ptr
+}
+
+// Set associates data with the value v, replacing any previous
+// metadata. It returns an error if v has no identity.
+func (md *Metadata) Set(v Value, data interface{}) error {
+	if !HasIdentity(v) {
+		return fmt.Errorf("cannot associate metadata with %s value: no identity", v.Type())
+	}
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if md.m == nil {
+		md.m = make(map[Value]interface{})
+	}
+	md.m[v] = data
+	return nil
+}
+
+// Get returns the metadata associated with v, if any.
+func (md *Metadata) Get(v Value) (data interface{}, ok bool) {
+	if !HasIdentity(v) {
+		return nil, false
+	}
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	data, ok = md.m[v]
+	return data, ok
+}
+
+// Delete removes the metadata associated with v, if any.
+func (md *Metadata) Delete(v Value) {
+	if !HasIdentity(v) {
+		return
+	}
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	delete(md.m, v)
+}
+
+// Len returns the number of values that have metadata.
+func (md *Metadata) Len() int {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return len(md.m)
+}
+
+// Copy associates the metadata of src, if any, with dst,
+// typically a copy of src. It reports whether src had metadata.
+// It returns an error if src has metadata but dst has no identity.
+func (md *Metadata) Copy(dst, src Value) (bool, error) {
+	data, ok := md.Get(src)
+	if !ok {
+		return false, nil
+	}
+	return true, md.Set(dst, data)
+}
+
+// Merge associates with dst the result of combining the metadata of
+// the values in srcs that have any, such as the operands of an
+// operation whose result is dst. The combine function is called with
+// the metadata of each such value in order; if there are none, the
+// metadata of dst is unchanged. It returns an error if dst has no
+// identity but there is metadata to associate with it.
+func (md *Metadata) Merge(dst Value, combine func(datas []interface{}) interface{}, srcs ...Value) error {
+	var datas []interface{}
+	for _, src := range srcs {
+		if data, ok := md.Get(src); ok {
+			datas = append(datas, data)
+		}
+	}
+	if datas == nil {
+		return nil
+	}
+	return md.Set(dst, combine(datas))
+}
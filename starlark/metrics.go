@@ -0,0 +1,93 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the metrics hooks, through which the runtime
+// reports counters and distributions to a monitoring system.
+//
+// Some events, such as the growth of a dict's hash table, occur where
+// no thread is available, so the sink is global to the process.
+// When no sink is set, the cost of each report is an atomic load.
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A MetricsSink receives metrics reported by the runtime, for export
+// to a monitoring system such as Prometheus. Its methods may be called
+// concurrently by many goroutines, and should be fast.
+type MetricsSink interface {
+	// Count adds delta to the named counter.
+	Count(name string, delta int64)
+
+	// Observe adds a sample to the named distribution.
+	Observe(name string, value float64)
+}
+
+// Names of the metrics reported by this module.
+const (
+	// MetricSteps is the distribution of the number of computation
+	// steps (see Thread.ExecutionSteps) of each top-level execution.
+	MetricSteps = "starlark.steps"
+
+	// MetricDictGrowths counts the times the hash table of a dict
+	// or set was enlarged.
+	MetricDictGrowths = "starlark.dict.growths"
+
+	// MetricDictShrinks counts the times the hash table of a dict
+	// or set was reduced after the deletion of most of its elements.
+	MetricDictShrinks = "starlark.dict.shrinks"
+
+	// MetricCompileSeconds is the distribution of the time taken to
+	// resolve and compile a file by FileProgram, in seconds.
+	MetricCompileSeconds = "starlark.compile.seconds"
+
+	// MetricLoadCacheHits and MetricLoadCacheMisses count the loads of
+	// a module that were satisfied by a cache, and those that executed
+	// the module, as reported by go.starlark.net/loader.
+	MetricLoadCacheHits   = "starlark.load.cache_hits"
+	MetricLoadCacheMisses = "starlark.load.cache_misses"
+)
+
+var metricsSink atomic.Value // holds a metricsHolder
+
+type metricsHolder struct{ sink MetricsSink }
+
+// SetMetricsSink sets the sink to which the runtime reports metrics,
+// replacing any previous one. A nil sink disables reporting.
+func SetMetricsSink(sink MetricsSink) {
+	metricsSink.Store(metricsHolder{sink})
+}
+
+func metrics() MetricsSink {
+	h, _ := metricsSink.Load().(metricsHolder)
+	return h.sink
+}
+
+// CountMetric adds delta to the named counter of the current metrics
+// sink, if any. It allows packages that extend the runtime to report
+// their own metrics.
+func CountMetric(name string, delta int64) {
+	if sink := metrics(); sink != nil {
+		sink.Count(name, delta)
+	}
+}
+
+// ObserveMetric adds a sample to the named distribution of the
+// current metrics sink, if any.
+func ObserveMetric(name string, value float64) {
+	if sink := metrics(); sink != nil {
+		sink.Observe(name, value)
+	}
+}
+
+// observeSince reports the time elapsed since start, in seconds,
+// to the named distribution.
+func observeSince(name string, start time.Time) {
+	if sink := metrics(); sink != nil {
+		sink.Observe(name, time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+import "strings"
+
+// An OrderedStringDict is a mapping from names to values that, unlike
+// StringDict, preserves the order in which its entries were added.
+// It represents an environment such as the global variables of a
+// module, in order of definition, for tools that render or serialize
+// such an environment and require a stable order.
+// Like StringDict, it is not a true starlark.Value.
+//
+// The zero value is an empty dictionary ready to use.
+type OrderedStringDict struct {
+	entries []stringDictEntry
+	index   map[string]int // maps each key to its index in entries
+}
+
+type stringDictEntry struct {
+	key   string
+	value Value
+}
+
+// NewOrderedStringDict returns an empty dictionary with initial
+// space for at least size entries.
+func NewOrderedStringDict(size int) *OrderedStringDict {
+	return &OrderedStringDict{
+		entries: make([]stringDictEntry, 0, size),
+		index:   make(map[string]int, size),
+	}
+}
+
+// Len returns the number of entries in the dictionary.
+func (d *OrderedStringDict) Len() int { return len(d.entries) }
+
+// Get returns the value associated with key, if any.
+func (d *OrderedStringDict) Get(key string) (v Value, ok bool) {
+	if i, ok := d.index[key]; ok {
+		return d.entries[i].value, true
+	}
+	return nil, false
+}
+
+// Has reports whether the dictionary contains the specified key.
+func (d *OrderedStringDict) Has(key string) bool { _, ok := d.index[key]; return ok }
+
+// Set associates value with key. A new key is added after all
+// existing ones; an existing key retains its position.
+func (d *OrderedStringDict) Set(key string, value Value) {
+	if i, ok := d.index[key]; ok {
+		d.entries[i].value = value
+		return
+	}
+	if d.index == nil {
+		d.index = make(map[string]int)
+	}
+	d.index[key] = len(d.entries)
+	d.entries = append(d.entries, stringDictEntry{key, value})
+}
+
+// Insert is like Set, but reports whether key was newly added.
+func (d *OrderedStringDict) Insert(key string, value Value) bool {
+	n := len(d.entries)
+	d.Set(key, value)
+	return len(d.entries) > n
+}
+
+// Delete removes the entry for key, if present, and returns its value.
+// The remaining entries retain their relative order; those after the
+// deleted one move down by one index. Its cost is proportional to the
+// number of entries after the deleted one.
+func (d *OrderedStringDict) Delete(key string) (v Value, found bool) {
+	i, ok := d.index[key]
+	if !ok {
+		return nil, false
+	}
+	v = d.entries[i].value
+	delete(d.index, key)
+	copy(d.entries[i:], d.entries[i+1:])
+	d.entries[len(d.entries)-1] = stringDictEntry{} // aid GC
+	d.entries = d.entries[:len(d.entries)-1]
+	for j := i; j < len(d.entries); j++ {
+		d.index[d.entries[j].key] = j
+	}
+	return v, true
+}
+
+// KeyIndex returns the key and value of the ith entry,
+// where 0 <= i < Len().
+func (d *OrderedStringDict) KeyIndex(i int) (string, Value) {
+	e := d.entries[i]
+	return e.key, e.value
+}
+
+// Keys returns a new slice of d's keys, in order.
+func (d *OrderedStringDict) Keys() []string {
+	keys := make([]string, len(d.entries))
+	for i, e := range d.entries {
+		keys[i] = e.key
+	}
+	return keys
+}
+
+// StringDict returns a new, unordered StringDict of d's entries.
+func (d *OrderedStringDict) StringDict() StringDict {
+	r := make(StringDict, len(d.entries))
+	for _, e := range d.entries {
+		r[e.key] = e.value
+	}
+	return r
+}
+
+func (d *OrderedStringDict) String() string {
+	buf := new(strings.Builder)
+	buf.WriteByte('{')
+	for i, e := range d.entries {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(e.key)
+		buf.WriteString(": ")
+		writeValue(buf, e.value, nil)
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// Freeze freezes each value in the dictionary.
+func (d *OrderedStringDict) Freeze() {
+	for _, e := range d.entries {
+		e.value.Freeze()
+	}
+}
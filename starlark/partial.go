@@ -0,0 +1,106 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the partial built-in.
+
+import "fmt"
+
+// A partial is a callable that calls another with some of its
+// arguments supplied in advance; see partial.
+type partial struct {
+	fn     Callable
+	args   Tuple
+	kwargs []Tuple // each a (String, Value) pair; no duplicate names
+}
+
+var (
+	_ Callable = (*partial)(nil)
+	_ HasAttrs = (*partial)(nil)
+)
+
+func (p *partial) Name() string          { return p.fn.Name() }
+func (p *partial) String() string        { return fmt.Sprintf("<partial %s>", p.fn.Name()) }
+func (p *partial) Type() string          { return "partial" }
+func (p *partial) Truth() Bool           { return True }
+func (p *partial) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: partial") }
+func (p *partial) Freeze() {
+	p.fn.Freeze()
+	p.args.Freeze()
+	for _, kwarg := range p.kwargs {
+		kwarg[1].Freeze()
+	}
+}
+
+func (p *partial) Attr(name string) (Value, error) {
+	switch name {
+	case "func":
+		return p.fn, nil
+	case "args":
+		return p.args, nil
+	case "keywords":
+		// Return a new dict, as p is immutable.
+		dict := NewDict(len(p.kwargs))
+		for _, kwarg := range p.kwargs {
+			dict.SetKey(kwarg[0], kwarg[1]) // can't fail
+		}
+		return dict, nil
+	}
+	return nil, nil
+}
+
+func (p *partial) AttrNames() []string { return []string{"args", "func", "keywords"} }
+
+// CallInternal calls p.fn with p's arguments followed by args, and with
+// p's keyword arguments updated by kwargs. When the call supplies no
+// arguments of either kind, p's own are passed without allocation.
+func (p *partial) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	switch {
+	case len(args) == 0:
+		args = p.args
+	case len(p.args) > 0:
+		merged := make(Tuple, 0, len(p.args)+len(args))
+		merged = append(merged, p.args...)
+		args = append(merged, args...)
+	}
+
+	switch {
+	case len(kwargs) == 0:
+		kwargs = p.kwargs
+	case len(p.kwargs) > 0:
+		merged := make([]Tuple, 0, len(p.kwargs)+len(kwargs))
+	outer:
+		for _, kwarg := range p.kwargs {
+			for _, override := range kwargs {
+				if override[0] == kwarg[0] {
+					continue outer
+				}
+			}
+			merged = append(merged, kwarg)
+		}
+		kwargs = append(merged, kwargs...)
+	}
+
+	return Call(thread, p.fn, args, kwargs)
+}
+
+// https://github.com/google/starlark-go/blob/master/doc/spec.md#partial
+func partial_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("partial: got %d arguments, want at least 1", len(args))
+	}
+	fn, ok := args[0].(Callable)
+	if !ok {
+		return nil, fmt.Errorf("partial: got %s, want callable", args[0].Type())
+	}
+	p := &partial{fn: fn}
+	if len(args) > 1 {
+		p.args = append(Tuple(nil), args[1:]...)
+	}
+	if len(kwargs) > 0 {
+		p.kwargs = append([]Tuple(nil), kwargs...)
+	}
+	return p, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines Pool, a source of pre-initialized threads.
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A Pool maintains warm environments for the evaluation of independent
+// requests, such as those of a multi-tenant service, so that the cost
+// of setting up an environment is paid once rather than per request.
+//
+// When first used, the pool freezes its predeclared environment and
+// loads the modules it is to preload, such as a standard library; both
+// are then shared, immutably, by all threads of the pool. Each call to
+// Get checks out a thread whose Load hook returns the preloaded modules
+// without loading them again, and Put returns the thread to the pool
+// after discarding all state left by the request: its thread-local
+// values, cancellation, step count and limit, hooks, and finalizers.
+// Only the capacity of the thread's call stack is retained.
+//
+// Because the shared values are frozen, a request cannot observe the
+// effects of another. However, the pool cannot isolate requests that
+// share mutable state through the application's own built-ins or its
+// Load function.
+//
+// The fields of a Pool must not be modified after its first use.
+// A Pool is safe for concurrent use.
+type Pool struct {
+	// Predeclared is the predeclared environment of the programs
+	// executed by the threads of the pool. It is frozen on first use.
+	Predeclared StringDict
+
+	// Preload lists the modules to load, using Load, when the pool is
+	// first used. Their globals are shared by all threads of the pool.
+	Preload []string
+
+	// Load, if non-nil, loads the modules listed in Preload, and any
+	// other module loaded by a thread of the pool. Since the results
+	// of loading other modules are not cached by the pool, Load should
+	// cache them if they are to be shared between requests.
+	Load func(thread *Thread, module string) (StringDict, error)
+
+	// Init, if non-nil, is called for each thread as it is checked out
+	// by Get, after it has been reset, allowing the application to set
+	// its Print function, thread-local values, and so on.
+	Init func(thread *Thread)
+
+	once    sync.Once
+	err     error                 // error from preloading
+	modules map[string]StringDict // preloaded modules
+	free    sync.Pool             // of *Thread
+}
+
+// init prepares the shared state of the pool, once.
+func (p *Pool) init() {
+	p.Predeclared.Freeze()
+	p.modules = make(map[string]StringDict, len(p.Preload))
+	if len(p.Preload) > 0 && p.Load == nil {
+		p.err = fmt.Errorf("starlark.Pool: Preload without Load")
+		return
+	}
+	thread := &Thread{Name: "pool preload", Load: p.Load}
+	for _, module := range p.Preload {
+		globals, err := p.Load(thread, module)
+		if err != nil {
+			p.err = fmt.Errorf("preloading %s: %w", module, err)
+			return
+		}
+		globals.Freeze()
+		p.modules[module] = globals
+	}
+}
+
+// Get returns a thread from the pool, creating one if necessary.
+// The caller should return it to the pool by calling Put once the
+// request is complete. Get fails only if preloading failed.
+func (p *Pool) Get() (*Thread, error) {
+	p.once.Do(p.init)
+	if p.err != nil {
+		return nil, p.err
+	}
+	thread, _ := p.free.Get().(*Thread)
+	if thread == nil {
+		thread = new(Thread)
+	}
+	thread.Load = p.load
+	if p.Init != nil {
+		p.Init(thread)
+	}
+	return thread, nil
+}
+
+// Put runs the outstanding finalizers of a thread obtained from Get,
+// resets it, and returns it to the pool. It returns the first error
+// reported by a finalizer. The thread must not be used after the call.
+// Put panics if the thread is executing.
+func (p *Pool) Put(thread *Thread) error {
+	if len(thread.stack) > 0 {
+		panic("starlark.Pool.Put: thread is executing")
+	}
+	err := thread.RunFinalizers()
+	thread.reset()
+	p.free.Put(thread)
+	return err
+}
+
+// ExecFile executes a file in a thread from the pool, with the pool's
+// predeclared environment, and returns the thread to the pool.
+// See the package-level ExecFile function for the meaning of the
+// parameters.
+func (p *Pool) ExecFile(filename string, src interface{}) (StringDict, error) {
+	thread, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	globals, err := ExecFile(thread, filename, src, p.Predeclared)
+	if err2 := p.Put(thread); err == nil {
+		err = err2
+	}
+	return globals, err
+}
+
+// load is the Load hook of the threads of the pool.
+func (p *Pool) load(thread *Thread, module string) (StringDict, error) {
+	if globals, ok := p.modules[module]; ok {
+		return globals, nil
+	}
+	if p.Load == nil {
+		return nil, fmt.Errorf("no such module")
+	}
+	return p.Load(thread, module)
+}
+
+// reset restores the thread to its zero state,
+// but for the capacity of its call stack.
+func (thread *Thread) reset() {
+	stack := thread.stack[:0]
+	*thread = Thread{stack: stack}
+	if stack != nil {
+		// Repeat the one-time initialization
+		// performed by Call for a new thread.
+		thread.maxSteps--
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines a configurable pretty-printer for values.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PrettyOptions controls the formatting performed by PrettyPrint.
+// The zero value formats values exactly as String does,
+// on a single line with no limits.
+type PrettyOptions struct {
+	// MaxDepth is the maximum nesting depth of collections to print.
+	// Collections nested more deeply are abbreviated as [...], (...),
+	// {...}, or set([...]). Zero means no limit.
+	MaxDepth int
+
+	// MaxElems is the maximum number of elements of each collection
+	// to print. Surplus elements are replaced by a note of how many
+	// were omitted. Zero means no limit.
+	MaxElems int
+
+	// Width is the target line width. A collection whose compact
+	// form does not fit within the remaining width is printed one
+	// element per line. Zero means never break lines.
+	Width int
+
+	// Indent is the string used to indent each level of a
+	// collection printed across several lines. If empty, two spaces
+	// are used.
+	Indent string
+}
+
+// StringLimits bounds the string form of a value, so that the
+// accidental conversion of a huge or deeply nested data structure, as
+// by print(config), cannot exhaust memory. Elided parts are abbreviated
+// as by PrettyPrint, and cycles are printed as "..." as usual.
+type StringLimits struct {
+	MaxDepth int // maximum nesting depth of collections; zero means no limit
+	MaxElems int // maximum number of elements printed per collection; zero means no limit
+}
+
+// writeValueLimited is like writeValue but respects the limits,
+// if non-nil.
+func writeValueLimited(out *strings.Builder, x Value, limits *StringLimits) {
+	if limits == nil || limits.MaxDepth <= 0 && limits.MaxElems <= 0 {
+		writeValue(out, x, nil)
+		return
+	}
+	p := &prettyPrinter{opts: PrettyOptions{MaxDepth: limits.MaxDepth, MaxElems: limits.MaxElems}}
+	p.write(out, x, 0, 0, nil)
+}
+
+// PrettyPrint returns the string form of value v formatted according
+// to the specified options. Cyclic data structures are printed using
+// the same "..." notation as String.
+func PrettyPrint(v Value, opts PrettyOptions) string {
+	p := &prettyPrinter{opts: opts}
+	if p.opts.Indent == "" {
+		p.opts.Indent = "  "
+	}
+	buf := new(strings.Builder)
+	p.write(buf, v, 0, 0, nil)
+	return buf.String()
+}
+
+// A PrettyValue is a value whose structure is visible to PrettyPrint,
+// so that it may be broken across lines and abbreviated in the same way
+// as the built-in collections. Its compact form should match its String
+// method, for example "struct(a = 1, b = 2)".
+type PrettyValue interface {
+	Value
+	// PrettyElems returns the opening and closing delimiters of the
+	// value's string form, and its elements. If names is non-nil, it
+	// has the same length as values, and each value is preceded by its
+	// name and " = ".
+	PrettyElems() (open, close string, names []string, values []Value)
+}
+
+type prettyPrinter struct {
+	opts PrettyOptions
+}
+
+// A prettyElem is one element of a collection being pretty-printed.
+// For a dict entry, key is non-nil; for a named field, name is non-empty.
+type prettyElem struct {
+	key, value Value
+	name       string
+}
+
+// collection returns the delimiters of x, its number of elements, and
+// its first elements, up to the limit of MaxElems; or ok=false if x is
+// not a collection known to the printer.
+func (p *prettyPrinter) collection(x Value) (open, close string, elems []prettyElem, n int, ok bool) {
+	limit := func(n int) int {
+		if p.opts.MaxElems > 0 && n > p.opts.MaxElems {
+			return p.opts.MaxElems
+		}
+		return n
+	}
+	switch x := x.(type) {
+	case *List:
+		elems = make([]prettyElem, limit(len(x.elems)))
+		for i := range elems {
+			elems[i].value = x.elems[i]
+		}
+		return "[", "]", elems, len(x.elems), true
+	case Tuple:
+		elems = make([]prettyElem, limit(len(x)))
+		for i := range elems {
+			elems[i].value = x[i]
+		}
+		return "(", ")", elems, len(x), true
+	case *Dict:
+		n := x.Len()
+		elems = make([]prettyElem, 0, limit(n))
+		for e := x.ht.head; e != nil && len(elems) < cap(elems); e = e.next {
+			elems = append(elems, prettyElem{key: e.key, value: e.value})
+		}
+		return "{", "}", elems, n, true
+	case *Set:
+		n := x.Len()
+		elems = make([]prettyElem, 0, limit(n))
+		for e := x.ht.head; e != nil && len(elems) < cap(elems); e = e.next {
+			elems = append(elems, prettyElem{value: e.key})
+		}
+		return "set([", "])", elems, n, true
+	case PrettyValue:
+		open, close, names, values := x.PrettyElems()
+		elems = make([]prettyElem, limit(len(values)))
+		for i := range elems {
+			elems[i].value = values[i]
+			if names != nil {
+				elems[i].name = names[i]
+			}
+		}
+		return open, close, elems, len(values), true
+	}
+	return "", "", nil, 0, false
+}
+
+// write writes x to out. depth is the nesting depth of x, col is the
+// current column (for line breaking), and path holds the enclosing
+// collections, for cycle detection.
+func (p *prettyPrinter) write(out *strings.Builder, x Value, depth, col int, path []Value) {
+	open, close, elems, n, ok := p.collection(x)
+	if !ok {
+		writeValue(out, x, nil)
+		return
+	}
+
+	if pathContains(path, x) || (p.opts.MaxDepth > 0 && depth >= p.opts.MaxDepth && len(elems) > 0) {
+		out.WriteString(open)
+		out.WriteString("...")
+		out.WriteString(close)
+		return
+	}
+	path = append(path, x)
+
+	omitted := n - len(elems)
+
+	// Use the compact form if it fits.
+	if p.opts.Width <= 0 || len(elems) == 0 {
+		p.writeCompact(out, x, open, close, elems, omitted, depth, path)
+		return
+	}
+	compact := new(strings.Builder)
+	p.writeCompact(compact, x, open, close, elems, omitted, depth, path)
+	if col+compact.Len() <= p.opts.Width {
+		out.WriteString(compact.String())
+		return
+	}
+
+	// Print one element per line.
+	indent := strings.Repeat(p.opts.Indent, depth+1)
+	out.WriteString(open)
+	for _, elem := range elems {
+		out.WriteByte('\n')
+		out.WriteString(indent)
+		ecol := len(indent)
+		if elem.name != "" {
+			out.WriteString(elem.name)
+			out.WriteString(" = ")
+			ecol += len(elem.name) + len(" = ")
+		} else if elem.key != nil {
+			start := out.Len()
+			p.write(out, elem.key, depth+1, ecol, path)
+			out.WriteString(": ")
+			ecol += out.Len() - start
+		}
+		p.write(out, elem.value, depth+1, ecol, path)
+		out.WriteByte(',')
+	}
+	if omitted > 0 {
+		out.WriteByte('\n')
+		out.WriteString(indent)
+		fmt.Fprintf(out, "... %d more", omitted)
+	}
+	out.WriteByte('\n')
+	out.WriteString(strings.Repeat(p.opts.Indent, depth))
+	out.WriteString(close)
+}
+
+// writeCompact writes the single-line form of collection x,
+// whose delimiters and (possibly truncated) elements are provided.
+func (p *prettyPrinter) writeCompact(out *strings.Builder, x Value, open, close string, elems []prettyElem, omitted, depth int, path []Value) {
+	out.WriteString(open)
+	for i, elem := range elems {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		if elem.name != "" {
+			out.WriteString(elem.name)
+			out.WriteString(" = ")
+		} else if elem.key != nil {
+			p.writeLine(out, elem.key, depth+1, path)
+			out.WriteString(": ")
+		}
+		p.writeLine(out, elem.value, depth+1, path)
+	}
+	if omitted > 0 {
+		if len(elems) > 0 {
+			out.WriteString(", ")
+		}
+		fmt.Fprintf(out, "... %d more", omitted)
+	}
+	if _, ok := x.(Tuple); ok && len(elems) == 1 && omitted == 0 {
+		out.WriteByte(',')
+	}
+	out.WriteString(close)
+}
+
+// writeLine writes x to out on a single line, respecting the depth
+// and element limits but not the width.
+func (p *prettyPrinter) writeLine(out *strings.Builder, x Value, depth int, path []Value) {
+	width := p.opts.Width
+	p.opts.Width = 0
+	p.write(out, x, depth, 0, path)
+	p.opts.Width = width
+}
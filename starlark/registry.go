@@ -0,0 +1,117 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the registry of executing threads.
+//
+// A thread's state may not be read by other goroutines while it is
+// executing, so a registered thread publishes a sample of its state
+// to the registry at the start of each top-level execution and every
+// registrySampleInterval steps thereafter.
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.starlark.net/syntax"
+)
+
+// registrySampleInterval is the number of steps between samples
+// of the state of a registered thread.
+const registrySampleInterval = 1024
+
+// A ThreadRegistry records the threads that are executing, allowing an
+// application to list the Starlark programs currently running, for
+// example on an administrative web page. A thread is registered for
+// the duration of each top-level execution (see Thread.OnDone) while its
+// Registry field refers to the registry. The zero value is an empty
+// registry. It is safe for concurrent use.
+type ThreadRegistry struct {
+	mu      sync.Mutex
+	threads map[*Thread]*registryEntry
+}
+
+type registryEntry struct {
+	name   string
+	start  time.Time
+	steps0 uint64    // thread.Steps at start
+	steps  uint64    // thread.Steps at last sample
+	fn     *Function // innermost Starlark function at last sample, or nil
+	pc     uint32
+}
+
+// A ThreadStatus is a snapshot of the state of an executing thread.
+// The Function, Pos, and Steps fields are sampled periodically,
+// and so may lag slightly behind the thread.
+type ThreadStatus struct {
+	Thread   *Thread         // must not be used except for its concurrency-safe methods, such as Cancel
+	Name     string          // the thread's Name
+	Start    time.Time       // start time of the thread's top-level execution
+	Function string          // name of the innermost Starlark function, if any
+	Pos      syntax.Position // current position within Function
+	Steps    uint64          // computation steps executed since Start
+}
+
+// Threads returns the status of each registered thread,
+// in order of start time.
+func (r *ThreadRegistry) Threads() []ThreadStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]ThreadStatus, 0, len(r.threads))
+	for thread, e := range r.threads {
+		st := ThreadStatus{
+			Thread: thread,
+			Name:   e.name,
+			Start:  e.start,
+			Steps:  e.steps - e.steps0,
+		}
+		if e.fn != nil {
+			st.Function = e.fn.Name()
+			st.Pos = e.fn.funcode.Position(e.pc)
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if !statuses[i].Start.Equal(statuses[j].Start) {
+			return statuses[i].Start.Before(statuses[j].Start)
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// register records the start of a top-level execution of thread.
+func (r *ThreadRegistry) register(thread *Thread) {
+	r.mu.Lock()
+	if r.threads == nil {
+		r.threads = make(map[*Thread]*registryEntry)
+	}
+	r.threads[thread] = &registryEntry{
+		name:   thread.Name,
+		start:  time.Now(),
+		steps0: thread.Steps,
+		steps:  thread.Steps,
+	}
+	r.mu.Unlock()
+}
+
+// unregister records the end of a top-level execution of thread.
+func (r *ThreadRegistry) unregister(thread *Thread) {
+	r.mu.Lock()
+	delete(r.threads, thread)
+	r.mu.Unlock()
+}
+
+// sample records the current state of thread, which is executing fn at pc.
+func (r *ThreadRegistry) sample(thread *Thread, fn *Function, pc uint32) {
+	r.mu.Lock()
+	if e := r.threads[thread]; e != nil {
+		e.steps = thread.Steps
+		e.fn = fn
+		e.pc = pc
+	}
+	r.mu.Unlock()
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines SealedModule, a module environment
+// that is safe to share among concurrent threads.
+
+import "fmt"
+
+// A SealedModule is the environment of a module that has been
+// initialized once and frozen, so that it may be shared, without
+// copying, by any number of concurrently executing threads: for
+// example, as the predeclared environment of each request of a server,
+// or as the result of a Load function.
+//
+// The pattern is as follows:
+//
+//	globals, err := prog.InitOrdered(thread, predeclared) // once
+//	...
+//	lib, err := starlark.Seal("lib", globals)
+//	...
+//	// concurrently, in each of many threads:
+//	starlark.ExecFile(thread, filename, src, lib.StringDict())
+//
+// Seal freezes every value reachable from the globals, then verifies,
+// using CheckFrozen, that they are indeed all frozen, and fails
+// otherwise. The check detects values of application-defined types
+// whose Freeze method does not freeze all the values they refer to;
+// such values could be mutated by one thread while they are read by
+// another. A SealedModule's own dictionaries are never modified.
+type SealedModule struct {
+	name    string
+	globals *OrderedStringDict
+	dict    StringDict
+}
+
+// Seal freezes the specified globals of the named module and returns
+// them as a SealedModule, or an error describing a reachable value that
+// remains unfrozen. The module takes ownership of globals, which the
+// caller must not subsequently modify.
+func Seal(name string, globals *OrderedStringDict) (*SealedModule, error) {
+	globals.Freeze()
+	for _, e := range globals.entries {
+		if err := checkFrozen(name+"."+e.key, e.value); err != nil {
+			return nil, fmt.Errorf("sealing module %s: %v", name, err)
+		}
+	}
+	return &SealedModule{name: name, globals: globals, dict: globals.StringDict()}, nil
+}
+
+// Name returns the name of the module.
+func (m *SealedModule) Name() string { return m.name }
+
+// Len returns the number of globals of the module.
+func (m *SealedModule) Len() int { return m.globals.Len() }
+
+// Get returns the value of the named global, if any.
+func (m *SealedModule) Get(name string) (Value, bool) { return m.dict[name], m.dict.Has(name) }
+
+// KeyIndex returns the name and value of the ith global, in order of
+// definition, where 0 <= i < Len().
+func (m *SealedModule) KeyIndex(i int) (string, Value) { return m.globals.KeyIndex(i) }
+
+// Keys returns a new slice of the names of the globals, in order of
+// definition.
+func (m *SealedModule) Keys() []string { return m.globals.Keys() }
+
+// StringDict returns the globals of the module as a StringDict, for
+// use as the predeclared environment of other programs or as the
+// result of a Load function. The result is shared, not copied, and
+// must not be modified.
+func (m *SealedModule) StringDict() StringDict { return m.dict }
+
+func (m *SealedModule) String() string { return fmt.Sprintf("<sealed module %q>", m.name) }
@@ -0,0 +1,102 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the slow-call watchdog.
+//
+// Each call made by a watched thread starts a timer that fires once the
+// call has been outstanding for the thread's SlowCallThreshold, so that
+// a call blocked in a built-in, which never returns to the interpreter,
+// is reported while it is still running. The timer function runs on its
+// own goroutine, concurrently with the thread; it reads only the frames
+// of the slow call's callers, which cannot change until the call
+// returns, and the slow call's function. When the call returns, the
+// thread waits for a report in progress to finish before popping the
+// frame.
+
+import (
+	"sync"
+	"time"
+)
+
+// A SlowCall describes a call that exceeded its thread's SlowCallThreshold.
+type SlowCall struct {
+	// CallStack holds the slow call, which is the innermost frame,
+	// and its callers. Unless the call was detected as it returned,
+	// the position of a slow Starlark function is that of its
+	// definition, as its current position is changing.
+	CallStack CallStack
+	Elapsed   time.Duration // time since the call began
+	Returned  bool          // the call was detected as it returned
+}
+
+// Frame returns the frame of the slow call.
+func (call *SlowCall) Frame() CallFrame { return call.CallStack.At(0) }
+
+// watchingSlowCalls reports whether the slow-call watchdog is enabled.
+func (thread *Thread) watchingSlowCalls() bool {
+	return thread.OnSlowCall != nil && thread.SlowCallThreshold > 0
+}
+
+// A slowCallWatch times a single call for the watchdog.
+type slowCallWatch struct {
+	thread *Thread
+	frames []*frame // the call's frame (last) and those of its callers
+	start  time.Time
+	timer  *time.Timer
+
+	mu       sync.Mutex
+	done     bool // the call has returned
+	reported bool
+}
+
+// watchSlowCall starts timing the innermost call of the thread.
+func (thread *Thread) watchSlowCall() *slowCallWatch {
+	w := &slowCallWatch{thread: thread, frames: thread.stack, start: time.Now()}
+	w.timer = time.AfterFunc(thread.SlowCallThreshold, w.fire)
+	return w
+}
+
+// fire reports the call, if it is still outstanding.
+// It is called by the timer, on its own goroutine.
+func (w *slowCallWatch) fire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.done {
+		w.report(false)
+	}
+}
+
+// stop ends the watch when the call returns. If the call has exceeded
+// the threshold but the timer has not yet reported it, stop reports it.
+func (w *slowCallWatch) stop() {
+	w.timer.Stop()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done = true
+	if !w.reported && time.Since(w.start) >= w.thread.SlowCallThreshold {
+		w.report(true)
+	}
+}
+
+// report calls the thread's OnSlowCall function. Its caller holds w.mu.
+func (w *slowCallWatch) report(returned bool) {
+	w.reported = true
+	stack := make(CallStack, len(w.frames))
+	last := len(w.frames) - 1
+	for i, fr := range w.frames[:last] {
+		stack[i] = fr.asCallFrame()
+	}
+	if fn, ok := w.frames[last].callable.(*Function); ok && !returned {
+		stack[last] = CallFrame{Name: fn.Name(), Pos: fn.Position()}
+	} else {
+		stack[last] = w.frames[last].asCallFrame()
+	}
+	w.thread.OnSlowCall(w.thread, &SlowCall{
+		CallStack: stack,
+		Elapsed:   time.Since(w.start),
+		Returned:  returned,
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines StringHashtable, the hash table of dicts
+// specialized to string keys, for use by other value types.
+
+// A StringHashtable is a mapping from strings to values that preserves
+// insertion order. It is the hash table that underlies Dict, exported
+// for use by implementations of other types of values, such as modules
+// or the attributes of a HasAttrs type, that need a mutable, freezable
+// mapping with efficient lookup and deterministic iteration.
+//
+// The zero value is an empty table ready to use. A StringHashtable
+// must not be copied after first use.
+type StringHashtable struct {
+	ht hashtable
+}
+
+// NewStringHashtable returns a new table with space for size entries.
+func NewStringHashtable(size int) *StringHashtable {
+	t := new(StringHashtable)
+	t.ht.init(size)
+	return t
+}
+
+// Len returns the number of entries in the table.
+func (t *StringHashtable) Len() int { return int(t.ht.len) }
+
+// Insert sets the value associated with key k, adding it to the end
+// of the table if not already present. It fails if the table is frozen
+// or is being iterated.
+func (t *StringHashtable) Insert(k string, v Value) error { return t.ht.insert(String(k), v) }
+
+// Lookup returns the value associated with key k, if any.
+func (t *StringHashtable) Lookup(k string) (v Value, found bool) {
+	v, found, _ = t.ht.lookup(String(k)) // can't fail
+	if !found {
+		v = nil
+	}
+	return v, found
+}
+
+// Delete removes the entry for key k, if present, and returns its value.
+// It fails if the table is frozen or is being iterated.
+func (t *StringHashtable) Delete(k string) (v Value, found bool, err error) {
+	v, found, err = t.ht.delete(String(k))
+	if !found {
+		v = nil
+	}
+	return v, found, err
+}
+
+// Clear removes all entries from the table.
+// It fails if the table is frozen or is being iterated.
+func (t *StringHashtable) Clear() error { return t.ht.clear() }
+
+// Iterate calls f for each entry of the table, in insertion order,
+// until f returns false. The table may not be modified during the call.
+func (t *StringHashtable) Iterate(f func(k string, v Value) bool) {
+	if !t.ht.frozen {
+		t.ht.itercount++
+		defer func() { t.ht.itercount-- }()
+	}
+	for e := t.ht.head; e != nil; e = e.next {
+		if !f(string(e.key.(String)), e.value) {
+			break
+		}
+	}
+}
+
+// Keys returns a new slice of the keys of the table, in insertion order.
+func (t *StringHashtable) Keys() []string {
+	keys := make([]string, 0, t.ht.len)
+	for e := t.ht.head; e != nil; e = e.next {
+		keys = append(keys, string(e.key.(String)))
+	}
+	return keys
+}
+
+// Freeze makes the table immutable and freezes its values.
+func (t *StringHashtable) Freeze() { t.ht.freeze() }
+
+// Frozen reports whether the table is frozen.
+func (t *StringHashtable) Frozen() bool { return t.ht.frozen }
@@ -0,0 +1,140 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the instruction-level tracing hook.
+//
+// The interpreter loads the thread's Tracer once per call; when it is
+// nil, the cost of tracing is a single predictable branch per
+// instruction, as for Coverage and ExecProfile.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.starlark.net/internal/compile"
+	"go.starlark.net/syntax"
+)
+
+// A Tracer receives an event describing each instruction of Starlark
+// code executed by a thread whose Tracer field refers to it, for
+// building debuggers that record and replay execution, or tools that
+// illustrate how the interpreter works. Instructions of built-in
+// functions are not traced.
+//
+// A Tracer must not be shared by threads that execute concurrently.
+type Tracer struct {
+	// Func is called before the execution of each traced instruction.
+	// The event, and the values it refers to, must not be modified or
+	// retained after Func returns. Func may cancel the thread, but must
+	// not otherwise use it.
+	Func func(thread *Thread, event *TraceEvent)
+
+	// Every, if greater than one, causes only one instruction
+	// in every Every instructions executed to be traced.
+	Every uint64
+
+	// MaxPerSecond, if positive, limits the average rate of events,
+	// allowing bursts of up to one second's worth. Instructions in
+	// excess of the limit are not traced.
+	MaxPerSecond float64
+
+	event   TraceEvent // the event passed to Func
+	skipped uint64     // instructions since the last sampled one
+	dropped uint64     // sampled instructions dropped by the rate limit
+	tokens  float64    // events permitted by the rate limit
+	last    time.Time  // time at which tokens was computed
+}
+
+// A TraceEvent describes an instruction about to be executed.
+type TraceEvent struct {
+	Function *Function // the function executing the instruction
+	PC       uint32    // offset of the instruction within the function's code
+	Opcode   string    // name of the instruction, such as "call"
+	Arg      uint32    // operand of the instruction, or zero if it has none
+	Depth    int       // depth of the operand stack
+	Top      Value     // value atop the operand stack, or nil if it is empty
+
+	// Dropped is the number of instructions since the previous event
+	// that were not traced because of the tracer's rate limit.
+	Dropped uint64
+
+	op compile.Opcode
+}
+
+// Position returns the source position of the instruction.
+func (ev *TraceEvent) Position() syntax.Position {
+	return ev.Function.funcode.Position(ev.PC)
+}
+
+// String returns a one-line summary of the event, such as
+//
+//	x.star:3:9 f@12: call 256 [2] top=int 1
+//
+// in which the value atop the operand stack, if any, is truncated.
+func (ev *TraceEvent) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s %s@%d: %s", ev.Position(), ev.Function.Name(), ev.PC, ev.Opcode)
+	if ev.op >= compile.OpcodeArgMin {
+		fmt.Fprintf(&buf, " %d", ev.Arg)
+	}
+	fmt.Fprintf(&buf, " [%d]", ev.Depth)
+	if ev.Top != nil {
+		const max = 40
+		s := ev.Top.String()
+		if len(s) > max {
+			s = s[:max-3] + "..."
+		}
+		fmt.Fprintf(&buf, " top=%s %s", ev.Top.Type(), s)
+	}
+	return buf.String()
+}
+
+// trace reports the execution of an instruction, if it is sampled
+// and permitted by the rate limit.
+func (t *Tracer) trace(thread *Thread, fn *Function, pc uint32, op compile.Opcode, arg uint32, stack []Value) {
+	if t.Every > 1 {
+		t.skipped++
+		if t.skipped < t.Every {
+			return
+		}
+		t.skipped = 0
+	}
+	if t.MaxPerSecond > 0 {
+		now := time.Now()
+		if t.last.IsZero() {
+			t.tokens = 1
+		} else {
+			t.tokens += now.Sub(t.last).Seconds() * t.MaxPerSecond
+			if t.tokens > t.MaxPerSecond {
+				t.tokens = t.MaxPerSecond
+			}
+		}
+		t.last = now
+		if t.tokens < 1 {
+			t.dropped++
+			return
+		}
+		t.tokens--
+	}
+
+	ev := &t.event
+	*ev = TraceEvent{
+		Function: fn,
+		PC:       pc,
+		Opcode:   op.String(),
+		Arg:      arg,
+		Depth:    len(stack),
+		Dropped:  t.dropped,
+		op:       op,
+	}
+	if len(stack) > 0 {
+		ev.Top = stack[len(stack)-1]
+	}
+	t.dropped = 0
+	t.Func(thread, ev)
+	*ev = TraceEvent{} // don't retain values
+}
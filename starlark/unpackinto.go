@@ -0,0 +1,281 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines UnpackArgsInto, which unpacks arguments
+// into the fields of a Go struct described by struct tags.
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// UnpackArgsInto unpacks the positional and keyword arguments into the
+// fields of the struct pointed to by params, as if by UnpackArgs. Each
+// field that is a parameter has a tag of the form `starlark:"name"`,
+// optionally followed by comma-separated options:
+//
+//	required   the parameter must be specified
+//	allownone  None is treated as if the argument were absent
+//
+// Other fields are ignored. Parameters are optional unless required,
+// and may be specified positionally in the order of the fields.
+//
+// A field may have any type accepted by UnpackArgs, or be a slice,
+// a map with string keys, a struct (or pointer to struct) whose fields
+// are tagged in the same way, or any combination of these. A slice is
+// unpacked from any iterable value other than a string; a map from a
+// mapping; and a struct from a mapping with string keys, or from a
+// value with attributes, such as a struct. An error concerning an
+// element of such a value reports its location, for example:
+//
+//	rule: for parameter "deps": at index 2: got int, want string
+//
+// Example:
+//
+//	var params struct {
+//		Name string            `starlark:"name,required"`
+//		Deps []string          `starlark:"deps"`
+//		Env  map[string]string `starlark:"env,allownone"`
+//	}
+//	if err := starlark.UnpackArgsInto(b.Name(), args, kwargs, &params); err != nil {
+//		return nil, err
+//	}
+//
+// A field retains its previous value if its argument is absent, so
+// that default values may be set before the call.
+func UnpackArgsInto(fnname string, args Tuple, kwargs []Tuple, params interface{}) error {
+	ptr := reflect.ValueOf(params)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Struct {
+		log.Panicf("UnpackArgsInto: params is %T, not a pointer to a struct", params)
+	}
+	fields := structFields(ptr.Elem().Type())
+	set := make([]bool, len(fields))
+	pairs := make([]interface{}, 0, 2*len(fields))
+	for i, f := range fields {
+		name := f.name + "?"
+		if f.allowNone {
+			name += "?"
+		}
+		pairs = append(pairs, name, &fieldUnpacker{dst: ptr.Elem().FieldByIndex(f.index), set: &set[i]})
+	}
+	if err := UnpackArgs(fnname, args, kwargs, pairs...); err != nil {
+		return err
+	}
+	for i, f := range fields {
+		if f.required && !set[i] {
+			return fmt.Errorf("%s: missing argument for %s", fnname, f.name)
+		}
+	}
+	return nil
+}
+
+// A structField describes a tagged field of a struct.
+type structField struct {
+	name      string
+	index     []int
+	required  bool
+	allowNone bool
+}
+
+var structFieldCache sync.Map // map[reflect.Type][]structField
+
+// structFields returns the tagged fields of struct type t.
+func structFields(t reflect.Type) []structField {
+	if fields, ok := structFieldCache.Load(t); ok {
+		return fields.([]structField)
+	}
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("starlark")
+		if !ok || tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		f := structField{name: opts[0], index: t.Field(i).Index}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "required":
+				f.required = true
+			case "allownone":
+				f.allowNone = true
+			default:
+				log.Panicf("%s.%s: invalid starlark tag option %q", t, t.Field(i).Name, opt)
+			}
+		}
+		fields = append(fields, f)
+	}
+	structFieldCache.Store(t, fields)
+	return fields
+}
+
+// A fieldUnpacker unpacks an argument into a field,
+// and records that it has done so.
+type fieldUnpacker struct {
+	dst reflect.Value
+	set *bool
+}
+
+func (u *fieldUnpacker) Unpack(v Value) error {
+	if err := unpackReflect(v, u.dst); err != nil {
+		return err
+	}
+	*u.set = true
+	return nil
+}
+
+var (
+	valueType    = reflect.TypeOf((*Value)(nil)).Elem()
+	unpackerType = reflect.TypeOf((*Unpacker)(nil)).Elem()
+)
+
+// unpackReflect unpacks v into the addressable variable dst.
+// On failure, it does not modify dst.
+func unpackReflect(v Value, dst reflect.Value) error {
+	t := dst.Type()
+	switch {
+	case reflect.PtrTo(t).Implements(unpackerType), t.Implements(valueType):
+		return unpackOneArg(v, dst.Addr().Interface())
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		if _, ok := v.(String); ok {
+			return fmt.Errorf("got string, want iterable")
+		}
+		iter := Iterate(v)
+		if iter == nil {
+			return fmt.Errorf("got %s, want iterable", v.Type())
+		}
+		defer iter.Done()
+		n := Len(v)
+		if n < 0 {
+			n = 0
+		}
+		slice := reflect.MakeSlice(t, 0, n)
+		var x Value
+		for i := 0; iter.Next(&x); i++ {
+			elem := reflect.New(t.Elem()).Elem()
+			if err := unpackReflect(x, elem); err != nil {
+				return fmt.Errorf("at index %d: %v", i, err)
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		if err := iterErr(iter); err != nil {
+			return err
+		}
+		dst.Set(slice)
+		return nil
+
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			break
+		}
+		mapping, ok := v.(IterableMapping)
+		if !ok {
+			return fmt.Errorf("got %s, want dict", v.Type())
+		}
+		m := reflect.MakeMap(t)
+		for _, item := range mapping.Items() {
+			k, ok := AsString(item[0])
+			if !ok {
+				return fmt.Errorf("got %s key, want string", item[0].Type())
+			}
+			elem := reflect.New(t.Elem()).Elem()
+			if err := unpackReflect(item[1], elem); err != nil {
+				return fmt.Errorf("at key %q: %v", k, err)
+			}
+			m.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), elem)
+		}
+		dst.Set(m)
+		return nil
+
+	case reflect.Struct:
+		s := reflect.New(t).Elem()
+		s.Set(dst) // retain defaults
+		if err := unpackStruct(v, s); err != nil {
+			return err
+		}
+		dst.Set(s)
+		return nil
+
+	case reflect.Ptr:
+		if t.Elem().Kind() != reflect.Struct {
+			break
+		}
+		s := reflect.New(t.Elem())
+		if !dst.IsNil() {
+			s.Elem().Set(dst.Elem()) // retain defaults
+		}
+		if err := unpackStruct(v, s.Elem()); err != nil {
+			return err
+		}
+		dst.Set(s)
+		return nil
+	}
+	return unpackOneArg(v, dst.Addr().Interface())
+}
+
+// unpackStruct unpacks the fields of a mapping or a value
+// with attributes into the tagged fields of struct s.
+func unpackStruct(v Value, s reflect.Value) error {
+	fields := structFields(s.Type())
+	var get func(name string) (Value, error)
+	switch v := v.(type) {
+	case IterableMapping:
+		// Reject unknown keys.
+		for _, item := range v.Items() {
+			k, ok := AsString(item[0])
+			if !ok {
+				return fmt.Errorf("got %s key, want string", item[0].Type())
+			}
+			known := false
+			for _, f := range fields {
+				if f.name == k {
+					known = true
+					break
+				}
+			}
+			if !known {
+				return fmt.Errorf("unexpected field %s", k)
+			}
+		}
+		get = func(name string) (Value, error) {
+			x, found, err := v.Get(String(name))
+			if !found {
+				x = nil
+			}
+			return x, err
+		}
+	case HasAttrs:
+		get = func(name string) (Value, error) {
+			x, err := v.Attr(name)
+			if _, ok := err.(NoSuchAttrError); ok {
+				return nil, nil
+			}
+			return x, err
+		}
+	default:
+		return fmt.Errorf("got %s, want dict or struct", v.Type())
+	}
+	for _, f := range fields {
+		x, err := get(f.name)
+		if err != nil {
+			return fmt.Errorf("in field %s: %v", f.name, err)
+		}
+		if x == nil || x == None && f.allowNone {
+			if f.required {
+				return fmt.Errorf("missing field %s", f.name)
+			}
+			continue
+		}
+		if err := unpackReflect(x, s.FieldByIndex(f.index)); err != nil {
+			return fmt.Errorf("in field %s: %v", f.name, err)
+		}
+	}
+	return nil
+}
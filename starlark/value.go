@@ -26,13 +26,18 @@
 //
 //      Callable        -- value is callable like a function
 //      Comparable      -- value defines its own comparison operations
+//      MixedComparable -- value defines comparisons against other types
 //      Iterable        -- value is iterable using 'for' loops
 //      Sequence        -- value is iterable sequence of known length
+//      Sized           -- value has a known length, reported by len
 //      Indexable       -- value is sequence with efficient random access
 //      Mapping         -- value maps from keys to values, like a dictionary
+//      Container       -- value defines its own membership test (x in y)
+//      ContextManager  -- value may be used in a with statement
 //      HasBinary       -- value defines binary operations such as * and +
 //      HasAttrs        -- value has readable fields or methods x.f
 //      HasSetField     -- value has settable fields x.f
+//      HasDelField     -- value has deletable fields (del x.f)
 //      HasSetIndex     -- value supports element update using x[i]=y
 //      HasSetKey       -- value supports map update using x[k]=v
 //      HasUnary        -- value defines unary operations such as + and -
@@ -78,6 +83,7 @@ import (
 	"unicode/utf8"
 
 	"go.starlark.net/internal/compile"
+	"go.starlark.net/resolve"
 	"go.starlark.net/syntax"
 )
 
@@ -108,6 +114,17 @@ type Value interface {
 	Hash() (uint32, error)
 }
 
+// A Reprer is a value whose precise string representation, as produced
+// by repr, the %r and {!r} conversions, the REPL, and the string forms
+// of the collections that contain it, differs from its friendly one,
+// as produced by its String method for use by str, print, and the %s
+// and {} conversions. Ideally, a value's repr is a Starlark expression
+// that evaluates to an equal value.
+type Reprer interface {
+	Value
+	Repr() string
+}
+
 // A Comparable is a value that defines its own equivalence relation and
 // perhaps ordered comparisons.
 type Comparable interface {
@@ -132,6 +149,26 @@ type Comparable interface {
 	CompareSameType(op syntax.Token, y Value, depth int) (bool, error)
 }
 
+// A MixedComparable is a value that defines equality and perhaps
+// ordered comparisons against values of other types, such as a decimal
+// type that may be compared with int and float.
+//
+// The Side argument indicates whether the receiver is the left or right
+// operand: if side is Right, the requested comparison is y op x.
+//
+// An implementation may decline to handle a comparison by returning
+// handled=false, in which case the other operand is consulted, and if
+// it too declines, the values compare unequal. For this reason, clients
+// should always call the standalone Compare function rather than
+// calling the method directly.
+//
+// Values that compare equal must have equal hashes, if both are hashable,
+// for them to be interchangeable as dict keys.
+type MixedComparable interface {
+	Value
+	CompareMixed(op syntax.Token, y Value, side Side, depth int) (result, handled bool, err error)
+}
+
 var (
 	_ Comparable = Int{}
 	_ Comparable = False
@@ -178,6 +215,20 @@ type Sequence interface {
 	Len() int
 }
 
+// A Sized is a value of known length, as reported by the built-in
+// len function. Unlike a Sequence or Indexable, it need not support
+// iteration or random access.
+type Sized interface {
+	Value
+	Len() int
+}
+
+var (
+	_ Sized = String("")
+	_ Sized = (*List)(nil)
+	_ Sized = (*Dict)(nil)
+)
+
 var (
 	_ Sequence = (*Dict)(nil)
 	_ Sequence = (*Set)(nil)
@@ -244,6 +295,24 @@ type Iterator interface {
 	Done()
 }
 
+// An ErrIterator is an Iterator whose sequence may be cut short by an
+// error, such as the iterator of a generator whose function fails.
+// Once Next has returned false, Err returns the error, or nil if the
+// sequence was exhausted. Operations that consume an Iterator report
+// this error as their own.
+type ErrIterator interface {
+	Iterator
+	Err() error
+}
+
+// iterErr returns the error, if any, that ended the sequence of iter.
+func iterErr(iter Iterator) error {
+	if iter, ok := iter.(ErrIterator); ok {
+		return iter.Err()
+	}
+	return nil
+}
+
 // A Mapping is a mapping from keys to values, such as a dictionary.
 //
 // If a type satisfies both Mapping and Iterable, the iterator yields
@@ -275,6 +344,31 @@ type HasSetKey interface {
 
 var _ HasSetKey = (*Dict)(nil)
 
+// A Container is a value that defines its own membership test,
+// used by the 'in' and 'not in' operators when it is the right operand.
+// It is useful for values such as large indexes that can answer
+// membership queries more efficiently than by enumerating their elements.
+type Container interface {
+	Value
+	Contains(x Value) (bool, error)
+}
+
+// A ContextManager is a value that may be used in a with statement,
+// such as a file, lock, or transaction whose release must not depend
+// on the statements of the block completing normally.
+//
+// The statement 'with x as y: body' calls x.Enter, binds its result to y,
+// and executes body. Exit is then called exactly once, whether body
+// completed normally or was left by a break, continue, or return
+// statement, or by an error. In the last case, err is the error,
+// which Exit cannot suppress; otherwise err is nil and any error
+// returned by Exit becomes the error of the with statement.
+type ContextManager interface {
+	Value
+	Enter(thread *Thread) (Value, error)
+	Exit(thread *Thread, err error) error
+}
+
 // A HasBinary value may be used as either operand of these binary operators:
 //     +   -   *   /   //   %   in   not in   |   &   ^   <<   >>
 //
@@ -335,6 +429,17 @@ type HasSetField interface {
 	SetField(name string, val Value) error
 }
 
+// A HasDelField value has fields that may be removed by a del statement (del x.f).
+// Deleting a field of a frozen value should fail.
+//
+// An implementation of DelField may return a NoSuchAttrError,
+// in which case the runtime may augment the error message to
+// warn of possible misspelling.
+type HasDelField interface {
+	HasSetField
+	DelField(name string) error
+}
+
 // A NoSuchAttrError may be returned by an implementation of
 // HasAttrs.Attr or HasSetField.SetField to indicate that no such field
 // exists. In that case the runtime may augment the error message to
@@ -670,6 +775,7 @@ type module struct {
 	predeclared StringDict
 	globals     []Value
 	constants   []Value
+	lazy        bool // module has executed a lazy load statement; see lazy.go
 }
 
 // makeGlobalDict returns a new, unfrozen StringDict containing all global
@@ -684,6 +790,18 @@ func (m *module) makeGlobalDict() StringDict {
 	return r
 }
 
+// makeOrderedGlobalDict returns a new, ordered dictionary of the
+// module's defined globals, in order of definition.
+func (m *module) makeOrderedGlobalDict() *OrderedStringDict {
+	r := NewOrderedStringDict(len(m.program.Globals))
+	for i, id := range m.program.Globals {
+		if v := m.globals[i]; v != nil {
+			r.Set(id.Name, v)
+		}
+	}
+	return r
+}
+
 func (fn *Function) Name() string          { return fn.funcode.Name } // "lambda" for anonymous functions
 func (fn *Function) Doc() string           { return fn.funcode.Doc }
 func (fn *Function) Hash() (uint32, error) { return hashString(fn.funcode.Name), nil }
@@ -742,6 +860,106 @@ func (fn *Function) ParamDefault(i int) Value {
 func (fn *Function) HasVarargs() bool { return fn.funcode.HasVarargs }
 func (fn *Function) HasKwargs() bool  { return fn.funcode.HasKwargs }
 
+// ParamNames returns a new slice of the names of the function's
+// parameters, in the order used by Param.
+func (fn *Function) ParamNames() []string {
+	names := make([]string, fn.NumParams())
+	for i := range names {
+		names[i], _ = fn.Param(i)
+	}
+	return names
+}
+
+// IsKwonlyParam reports whether the specified parameter
+// (0 <= i < NumParams()) is keyword-only, that is, it follows
+// the *args or bare * parameter.
+func (fn *Function) IsKwonlyParam(i int) bool {
+	if i < 0 || i >= fn.NumParams() {
+		panic(i)
+	}
+	end := fn.NumParams() // end of named parameters
+	if fn.HasVarargs() {
+		end--
+	}
+	if fn.HasKwargs() {
+		end--
+	}
+	return end-fn.NumKwonlyParams() <= i && i < end
+}
+
+// NumFreeVars returns the number of free variables of the function,
+// that is, the local variables of enclosing functions that it uses.
+func (fn *Function) NumFreeVars() int { return len(fn.funcode.Freevars) }
+
+// FreeVar returns the name and current value of the ith free variable,
+// where 0 <= i < NumFreeVars(). The value is nil if the variable
+// has not yet been assigned.
+func (fn *Function) FreeVar(i int) (string, Value) {
+	name := fn.funcode.Freevars[i].Name
+	if c, ok := fn.freevars[i].(*cell); ok {
+		return name, c.v
+	}
+	return name, nil
+}
+
+// Attr returns the introspection attributes of a function, if
+// resolve.FunctionAttrs is set: __name__, __doc__ (None if absent),
+// and __params__, a tuple of dicts describing each parameter by its
+// "name", its "kind" ("positional", "keyword_only", "varargs", or
+// "kwargs"), and, if it is optional, its "default" value.
+// Otherwise a function has no attributes.
+func (fn *Function) Attr(name string) (Value, error) {
+	if !resolve.FunctionAttrs {
+		return nil, nil
+	}
+	switch name {
+	case "__name__":
+		return String(fn.Name()), nil
+	case "__doc__":
+		if doc := fn.Doc(); doc != "" {
+			return String(doc), nil
+		}
+		return None, nil
+	case "__params__":
+		params := make(Tuple, fn.NumParams())
+		for i := range params {
+			params[i] = fn.paramDict(i)
+		}
+		return params, nil
+	}
+	return nil, nil
+}
+
+func (fn *Function) AttrNames() []string {
+	if !resolve.FunctionAttrs {
+		return nil
+	}
+	return []string{"__doc__", "__name__", "__params__"}
+}
+
+// paramDict returns a new dict describing the ith parameter.
+func (fn *Function) paramDict(i int) *Dict {
+	name, _ := fn.Param(i)
+	var kind string
+	switch {
+	case fn.HasKwargs() && i == fn.NumParams()-1:
+		kind = "kwargs"
+	case fn.HasVarargs() && i == fn.NumParams()-1-b2i(fn.HasKwargs()):
+		kind = "varargs"
+	case fn.IsKwonlyParam(i):
+		kind = "keyword_only"
+	default:
+		kind = "positional"
+	}
+	d := NewDict(3)
+	d.SetKey(String("name"), String(name))
+	d.SetKey(String("kind"), String(kind))
+	if dflt := fn.ParamDefault(i); dflt != nil {
+		d.SetKey(String("default"), dflt)
+	}
+	return d
+}
+
 // A Builtin is a function implemented in Go.
 type Builtin struct {
 	name string
@@ -798,7 +1016,8 @@ func (b *Builtin) BindReceiver(recv Value) *Builtin {
 // If you know the exact final number of entries,
 // it is more efficient to call NewDict.
 type Dict struct {
-	ht hashtable
+	ht      hashtable
+	factory Callable // optional; see SetDefaultFactory
 }
 
 // NewDict returns a set with initial space for
@@ -809,20 +1028,94 @@ func NewDict(size int) *Dict {
 	return dict
 }
 
+// NewDictFromItems returns a new dictionary containing the specified
+// key/value pairs, in order. Each item must be a tuple of length 2.
+// It is more efficient than repeated calls to SetKey, as the
+// dictionary is allocated at its final size.
+func NewDictFromItems(items []Tuple) (*Dict, error) {
+	dict := NewDict(len(items))
+	if err := dict.Update(items); err != nil {
+		return nil, err
+	}
+	return dict, nil
+}
+
+// NewDictFromStringMap returns a new dictionary containing an entry
+// for each element of the map, whose key is a String. The entries
+// are inserted in order of their keys.
+func NewDictFromStringMap(m map[string]Value) *Dict {
+	dict := NewDict(len(m))
+	for _, k := range StringDict(m).Keys() {
+		dict.ht.insert(String(k), m[k]) // can't fail
+	}
+	return dict
+}
+
+// Update inserts the specified key/value pairs into the dictionary,
+// in order, as if by repeated calls to SetKey. Each item must be a
+// tuple of length 2. It resizes the dictionary at most once.
+func (d *Dict) Update(items []Tuple) error {
+	if err := d.ht.reserve(len(items)); err != nil {
+		return err
+	}
+	for i, item := range items {
+		if len(item) != 2 {
+			return fmt.Errorf("dictionary update sequence element #%d has length %d, want 2", i, len(item))
+		}
+		if err := d.ht.insert(item[0], item[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Dict) Clear() error                                    { return d.ht.clear() }
 func (d *Dict) Delete(k Value) (v Value, found bool, err error) { return d.ht.delete(k) }
 func (d *Dict) Get(k Value) (v Value, found bool, err error)    { return d.ht.lookup(k) }
 func (d *Dict) Items() []Tuple                                  { return d.ht.items() }
 func (d *Dict) Keys() []Value                                   { return d.ht.keys() }
 func (d *Dict) Len() int                                        { return int(d.ht.len) }
-func (d *Dict) Iterate() Iterator                               { return d.ht.iterate() }
+func (d *Dict) Iterate() Iterator                               { return d.ht.iterate("dict") }
 func (d *Dict) SetKey(k, v Value) error                         { return d.ht.insert(k, v) }
 func (d *Dict) String() string                                  { return toString(d) }
 func (d *Dict) Type() string                                    { return "dict" }
-func (d *Dict) Freeze()                                         { d.ht.freeze() }
 func (d *Dict) Truth() Bool                                     { return d.Len() > 0 }
 func (d *Dict) Hash() (uint32, error)                           { return 0, fmt.Errorf("unhashable type: dict") }
 
+func (d *Dict) Freeze() {
+	d.ht.freeze()
+	if d.factory != nil {
+		d.factory.Freeze()
+	}
+}
+
+// Fork returns a new, mutable dict with the same items and default
+// factory as d. If d is frozen, the new dict shares its storage until
+// it is first modified, so forking is cheap even for a large dict;
+// otherwise the items are copied at once.
+func (d *Dict) Fork() *Dict {
+	child := &Dict{factory: d.factory}
+	d.ht.fork(&child.ht)
+	return child
+}
+
+// SetDefaultFactory sets the function that the index operation d[k]
+// calls, with no arguments, to obtain the value of a missing key k,
+// which it then inserts into the dictionary, like Python's defaultdict.
+// A nil factory restores the usual behavior, in which d[k] fails if k
+// is missing. Other operations, such as Get, the get method, and the
+// in operator, are unaffected. It fails if the dictionary is frozen.
+func (d *Dict) SetDefaultFactory(factory Callable) error {
+	if d.ht.frozen {
+		return fmt.Errorf("cannot set default factory of frozen dict")
+	}
+	d.factory = factory
+	return nil
+}
+
+// DefaultFactory returns the dictionary's default factory, or nil.
+func (d *Dict) DefaultFactory() Callable { return d.factory }
+
 func (x *Dict) Union(y *Dict) *Dict {
 	z := new(Dict)
 	z.ht.init(x.Len()) // a lower bound
@@ -870,6 +1163,7 @@ func dictsEqual(x, y *Dict, depth int) (bool, error) {
 type List struct {
 	elems     []Value
 	frozen    bool
+	shared    bool   // elems belongs to the frozen list it was forked from
 	itercount uint32 // number of active iterators (ignored if frozen)
 }
 
@@ -877,6 +1171,13 @@ type List struct {
 // Callers should not subsequently modify elems.
 func NewList(elems []Value) *List { return &List{elems: elems} }
 
+// NewListTakingOwnership returns a list whose elements are the
+// specified slice, without copying it. The list takes ownership of
+// elems, including any spare capacity, which it may use for subsequent
+// appends; the caller must not retain or modify the slice. It is
+// equivalent to NewList, but documents the intent at the call site.
+func NewListTakingOwnership(elems []Value) *List { return &List{elems: elems} }
+
 func (l *List) Freeze() {
 	if !l.frozen {
 		l.frozen = true
@@ -886,8 +1187,21 @@ func (l *List) Freeze() {
 	}
 }
 
+// Fork returns a new, mutable list with the same elements as l.
+// If l is frozen, the new list shares its elements until it is first
+// modified, so forking is cheap even for a large list; otherwise
+// the elements are copied at once.
+func (l *List) Fork() *List {
+	if !l.frozen {
+		return NewList(append([]Value(nil), l.elems...))
+	}
+	return &List{elems: l.elems[:len(l.elems):len(l.elems)], shared: true}
+}
+
 // checkMutable reports an error if the list should not be mutated.
 // verb+" list" should describe the operation.
+// If the list shares its elements with the list it was forked from,
+// checkMutable gives it its own copy, as the caller is about to mutate it.
 func (l *List) checkMutable(verb string) error {
 	if l.frozen {
 		return fmt.Errorf("cannot %s frozen list", verb)
@@ -895,6 +1209,10 @@ func (l *List) checkMutable(verb string) error {
 	if l.itercount > 0 {
 		return fmt.Errorf("cannot %s list during iteration", verb)
 	}
+	if l.shared {
+		l.elems = append([]Value(nil), l.elems...)
+		l.shared = false
+	}
 	return nil
 }
 
@@ -925,6 +1243,7 @@ func (l *List) AttrNames() []string             { return builtinAttrNames(listMe
 func (l *List) Iterate() Iterator {
 	if !l.frozen {
 		l.itercount++
+		return &listIterator{l: l, rec: trackIterator("list")}
 	}
 	return &listIterator{l: l}
 }
@@ -962,8 +1281,9 @@ func sliceCompare(op syntax.Token, x, y []Value, depth int) (bool, error) {
 }
 
 type listIterator struct {
-	l *List
-	i int
+	l   *List
+	i   int
+	rec *iterRecord // see iterleak.go
 }
 
 func (it *listIterator) Next(p *Value) bool {
@@ -979,6 +1299,7 @@ func (it *listIterator) Done() {
 	if !it.l.frozen {
 		it.l.itercount--
 	}
+	untrackIterator(it.rec)
 }
 
 func (l *List) SetIndex(i int, v Value) error {
@@ -997,6 +1318,50 @@ func (l *List) Append(v Value) error {
 	return nil
 }
 
+// InsertAll inserts the specified values before the element at index i,
+// which must be in the range [0:Len()], in a single operation.
+// The list does not retain the values slice.
+func (l *List) InsertAll(i int, values []Value) error {
+	if err := l.checkMutable("insert into"); err != nil {
+		return err
+	}
+	n := len(l.elems)
+	if i < 0 || i > n {
+		return fmt.Errorf("insertion index %d out of range [0:%d] of list", i, n)
+	}
+	if cap(l.elems) < n+len(values) {
+		// Reallocate, copying each element once.
+		elems := make([]Value, n+len(values))
+		copy(elems, l.elems[:i])
+		copy(elems[i:], values)
+		copy(elems[i+len(values):], l.elems[i:])
+		l.elems = elems
+		return nil
+	}
+	l.elems = l.elems[:n+len(values)]
+	copy(l.elems[i+len(values):], l.elems[i:n]) // slide up
+	copy(l.elems[i:], values)
+	return nil
+}
+
+// RemoveRange removes the elements l[start:end], where
+// 0 <= start <= end <= Len(), in a single operation.
+func (l *List) RemoveRange(start, end int) error {
+	if err := l.checkMutable("remove from"); err != nil {
+		return err
+	}
+	n := len(l.elems)
+	if start < 0 || start > end || end > n {
+		return fmt.Errorf("invalid range [%d:%d] of list of length %d", start, end, n)
+	}
+	copy(l.elems[start:], l.elems[end:]) // slide down
+	for i := n - (end - start); i < n; i++ {
+		l.elems[i] = nil // aid GC
+	}
+	l.elems = l.elems[:n-(end-start)]
+	return nil
+}
+
 func (l *List) Clear() error {
 	if err := l.checkMutable("clear"); err != nil {
 		return err
@@ -1085,12 +1450,23 @@ func NewSet(size int) *Set {
 	return set
 }
 
+// NewSetFromElems returns a new set containing the specified elements.
+// It is more efficient than repeated calls to Insert, as the
+// set is allocated at its final size.
+func NewSetFromElems(elems []Value) (*Set, error) {
+	set := NewSet(len(elems))
+	if err := set.InsertAll(elems); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
 func (s *Set) Delete(k Value) (found bool, err error) { _, found, err = s.ht.delete(k); return }
 func (s *Set) Clear() error                           { return s.ht.clear() }
 func (s *Set) Has(k Value) (found bool, err error)    { _, found, err = s.ht.lookup(k); return }
 func (s *Set) Insert(k Value) error                   { return s.ht.insert(k, None) }
 func (s *Set) Len() int                               { return int(s.ht.len) }
-func (s *Set) Iterate() Iterator                      { return s.ht.iterate() }
+func (s *Set) Iterate() Iterator                      { return s.ht.iterate("set") }
 func (s *Set) String() string                         { return toString(s) }
 func (s *Set) Type() string                           { return "set" }
 func (s *Set) elems() []Value                         { return s.ht.keys() }
@@ -1138,14 +1514,117 @@ func (s *Set) Union(iter Iterator) (Value, error) {
 			return nil, err
 		}
 	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
 	return set, nil
 }
 
+// InsertAll inserts each of the specified elements into the set,
+// as if by repeated calls to Insert. It resizes the set at most once.
+func (s *Set) InsertAll(elems []Value) error {
+	if err := s.ht.reserve(len(elems)); err != nil {
+		return err
+	}
+	for _, elem := range elems {
+		if err := s.ht.insert(elem, None); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Intersection returns a new set containing the elements of s that
+// are also among those of iter, in the order they appear in iter.
+func (s *Set) Intersection(iter Iterator) (Value, error) {
+	set := new(Set)
+	var x Value
+	for iter.Next(&x) {
+		found, err := s.Has(x)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			set.Insert(x) // can't fail
+		}
+	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// Difference returns a new set containing the elements of s that
+// are not among those of iter.
+func (s *Set) Difference(iter Iterator) (Value, error) {
+	set := new(Set)
+	set.ht.init(s.Len())
+	set.ht.addAll(&s.ht) // can't fail
+	var x Value
+	for iter.Next(&x) {
+		if _, err := set.Delete(x); err != nil {
+			return nil, err
+		}
+	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// SymmetricDifference returns a new set containing the elements that
+// are among those of either s or iter, but not both.
+func (s *Set) SymmetricDifference(iter Iterator) (Value, error) {
+	other := new(Set)
+	var x Value
+	for iter.Next(&x) {
+		if err := other.Insert(x); err != nil {
+			return nil, err
+		}
+	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
+	set := new(Set)
+	for _, elem := range s.elems() {
+		if found, _ := other.Has(elem); !found {
+			set.Insert(elem) // can't fail
+		}
+	}
+	for _, elem := range other.elems() {
+		if found, _ := s.Has(elem); !found {
+			set.Insert(elem) // can't fail
+		}
+	}
+	return set, nil
+}
+
+// Repr returns the precise string representation of value v:
+// the result of its Repr method, if it is a Reprer,
+// or else its usual string form.
+func Repr(v Value) string { return toString(v) }
+
+// writeStr is like writeValueLimited, but writes the friendly
+// string form of a Reprer, as required by str and print.
+func writeStr(out *strings.Builder, x Value, limits *StringLimits) {
+	if x, ok := x.(Reprer); ok {
+		out.WriteString(x.String())
+		return
+	}
+	writeValueLimited(out, x, limits)
+}
+
 // toString returns the string form of value v.
 // It may be more efficient than v.String() for larger values.
 func toString(v Value) string {
+	return toStringLimited(v, nil)
+}
+
+// toStringLimited returns the string form of value v,
+// respecting the specified limits, if non-nil.
+func toStringLimited(v Value, limits *StringLimits) string {
 	buf := new(strings.Builder)
-	writeValue(buf, v, nil)
+	writeValueLimited(buf, v, limits)
 	return buf.String()
 }
 
@@ -1242,6 +1721,9 @@ func writeValue(out *strings.Builder, x Value, path []Value) {
 		}
 		out.WriteString("])")
 
+	case Reprer:
+		out.WriteString(x.Repr())
+
 	default:
 		out.WriteString(x.String())
 	}
@@ -1347,6 +1829,18 @@ func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 		}
 	}
 
+	// user-defined comparisons against other types
+	if x, ok := x.(MixedComparable); ok {
+		if result, handled, err := x.CompareMixed(op, y, Left, depth); handled || err != nil {
+			return result, err
+		}
+	}
+	if y, ok := y.(MixedComparable); ok {
+		if result, handled, err := y.CompareMixed(op, x, Right, depth); handled || err != nil {
+			return result, err
+		}
+	}
+
 	// All other values of different types compare unequal.
 	switch op {
 	case syntax.EQL:
@@ -1389,18 +1883,13 @@ func b2i(b bool) int {
 	}
 }
 
-// Len returns the length of a string or sequence value,
+// Len returns the length of a string, sequence, or other Sized value,
 // and -1 for all others.
 //
 // Warning: Len(x) >= 0 does not imply Iterate(x) != nil.
 // A string has a known length but is not directly iterable.
 func Len(x Value) int {
-	switch x := x.(type) {
-	case String:
-		return x.Len()
-	case Indexable:
-		return x.Len()
-	case Sequence:
+	if x, ok := x.(Sized); ok {
 		return x.Len()
 	}
 	return -1
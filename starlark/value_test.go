@@ -12,6 +12,9 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/starlarktest"
+	"go.starlark.net/syntax"
 )
 
 func TestStringMethod(t *testing.T) {
@@ -155,3 +158,704 @@ func TestParamDefault(t *testing.T) {
 		})
 	}
 }
+
+func TestPrettyPrint(t *testing.T) {
+	thread := new(starlark.Thread)
+	v, err := starlark.Eval(thread, "<expr>", `{"a": [1, 2, 3, 4, 5], "b": {"c": (1,), "d": [[[1]]]}, "e": "f" * 40}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cyclic := starlark.NewList(nil)
+	cyclic.Append(cyclic)
+	for _, test := range []struct {
+		v    starlark.Value
+		opts starlark.PrettyOptions
+		want string
+	}{
+		{v, starlark.PrettyOptions{}, v.String()},
+		{cyclic, starlark.PrettyOptions{}, `[[...]]`},
+		{
+			starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{"a": v, "b": starlark.None}),
+			starlark.PrettyOptions{Width: 60, MaxDepth: 2},
+			`struct(
+  a = {
+    "a": [...],
+    "b": {...},
+    "e": "ffffffffffffffffffffffffffffffffffffffff",
+  },
+  b = None,
+)`,
+		},
+		{v, starlark.PrettyOptions{MaxElems: 2}, `{"a": [1, 2, ... 3 more], "b": {"c": (1,), "d": [[[1]]]}, ... 1 more}`},
+		{v, starlark.PrettyOptions{MaxDepth: 2}, `{"a": [1, 2, 3, 4, 5], "b": {"c": (...), "d": [...]}, "e": "ffffffffffffffffffffffffffffffffffffffff"}`},
+		{v, starlark.PrettyOptions{Width: 40}, `{
+  "a": [1, 2, 3, 4, 5],
+  "b": {"c": (1,), "d": [[[1]]]},
+  "e": "ffffffffffffffffffffffffffffffffffffffff",
+}`},
+		{v, starlark.PrettyOptions{Width: 20, Indent: "\t", MaxElems: 4}, `{
+	"a": [
+		1,
+		2,
+		3,
+		4,
+		... 1 more
+	],
+	"b": {
+		"c": (1,),
+		"d": [[[1]]],
+	},
+	"e": "ffffffffffffffffffffffffffffffffffffffff",
+}`},
+	} {
+		if got := starlark.PrettyPrint(test.v, test.opts); got != test.want {
+			t.Errorf("PrettyPrint(%+v) = <<%s>>, want <<%s>>", test.opts, got, test.want)
+		}
+	}
+}
+
+func TestStringLimits(t *testing.T) {
+	const src = `
+x = [1, [2, [3, [4]]], 5, 6]
+x.append(x)
+huge = list(range(1000000))
+`
+	globals, err := starlark.ExecFile(new(starlark.Thread), "limits.star", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := globals["x"]
+
+	// String is never limited.
+	if got, want := x.String(), `[1, [2, [3, [4]]], 5, 6, [...]]`; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	limited := &starlark.Thread{StringLimits: &starlark.StringLimits{MaxDepth: 2, MaxElems: 3}}
+	v, err := starlark.Eval(limited, "<expr>", `(str(x), len(str(huge)))`, globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.(starlark.Tuple)[0].(starlark.String), starlark.String(`[1, [2, [...]], 5, ... 2 more]`); got != want {
+		t.Errorf("str(x) = %s, want %s", got, want)
+	}
+	if got, want := v.(starlark.Tuple)[1], starlark.MakeInt(len(`[0, 1, 2, ... 999997 more]`)); got != want {
+		t.Errorf("len(str(huge)) = %s, want %s", got, want)
+	}
+
+	// A thread's limits take precedence in str, repr, print, format and %.
+	var printed string
+	thread := &starlark.Thread{
+		Print:        func(_ *starlark.Thread, msg string) { printed = msg },
+		StringLimits: &starlark.StringLimits{MaxElems: 10},
+	}
+	v, err = starlark.Eval(thread, "<expr>", `(str(x), repr(x), "{}".format(x), "%s" % (x,), "%r" % (x,), print(x))`, starlark.StringDict{"x": x, "print": starlark.Universe["print"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[1, [2, [3, [4]]], 5, 6, [...]]`
+	for _, got := range append(v.(starlark.Tuple)[:5:5], starlark.String(printed)) {
+		if s, _ := starlark.AsString(got); s != want {
+			t.Errorf("got %s, want %s", s, want)
+		}
+	}
+
+	// A small thread limit applies to % formatting too.
+	thread.StringLimits = &starlark.StringLimits{MaxElems: 2}
+	v, err = starlark.Eval(thread, "<expr>", `"x=%s" % (x,)`, starlark.StringDict{"x": x})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := v.(starlark.String), starlark.String(`x=[1, [2, [3, [4]]], ... 3 more]`); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// version is a test type with distinct str and repr, for TestReprer.
+type version struct{ major, minor int }
+
+var _ starlark.Reprer = version{}
+
+func (v version) String() string        { return fmt.Sprintf("%d.%d", v.major, v.minor) }
+func (v version) Repr() string          { return fmt.Sprintf("version(%d, %d)", v.major, v.minor) }
+func (v version) Type() string          { return "version" }
+func (v version) Freeze()               {}
+func (v version) Truth() starlark.Bool  { return true }
+func (v version) Hash() (uint32, error) { return uint32(v.major<<16 | v.minor), nil }
+
+func TestReprer(t *testing.T) {
+	var printed string
+	thread := &starlark.Thread{Print: func(_ *starlark.Thread, msg string) { printed = msg }}
+	predeclared := starlark.StringDict{"v": version{1, 2}}
+	for k, v := range starlark.Universe {
+		predeclared[k] = v
+	}
+	for _, test := range []struct{ expr, want string }{
+		{`str(v)`, `1.2`},
+		{`repr(v)`, `version(1, 2)`},
+		{`"%s %r" % (v, v)`, `1.2 version(1, 2)`},
+		{`"{} {!s} {!r}".format(v, v, v)`, `1.2 1.2 version(1, 2)`},
+		{`str([v, (v,), {v: v}])`, `[version(1, 2), (version(1, 2),), {version(1, 2): version(1, 2)}]`},
+		{`print("v", v) or printed()`, `v 1.2`},
+		{`fail(v)`, `fail: 1.2`},
+		{`{}[v]`, `key version(1, 2) not in dict`},
+	} {
+		predeclared["printed"] = starlark.NewBuiltin("printed", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+			return starlark.String(printed), nil
+		})
+		v, err := starlark.Eval(thread, "<expr>", test.expr, predeclared)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got, _ = starlark.AsString(v)
+		}
+		if got != test.want {
+			t.Errorf("%s = %s, want %s", test.expr, got, test.want)
+		}
+	}
+	if got, want := starlark.Repr(version{3, 4}), `version(3, 4)`; got != want {
+		t.Errorf("Repr = %s, want %s", got, want)
+	}
+}
+
+// cents is a test type that compares with int, for TestMixedComparable.
+type cents int64
+
+var _ starlark.MixedComparable = cents(0)
+
+func (c cents) String() string        { return fmt.Sprintf("%d.%02d", c/100, c%100) }
+func (c cents) Type() string          { return "cents" }
+func (c cents) Freeze()               {}
+func (c cents) Truth() starlark.Bool  { return c != 0 }
+func (c cents) Hash() (uint32, error) { return starlark.MakeInt64(int64(c) / 100).Hash() }
+
+func (c cents) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	return compareInt64(op, int64(c), int64(y.(cents))), nil
+}
+
+func (c cents) CompareMixed(op syntax.Token, y starlark.Value, side starlark.Side, depth int) (bool, bool, error) {
+	i, ok := y.(starlark.Int)
+	if !ok {
+		return false, false, nil
+	}
+	i64, ok := i.Int64()
+	if !ok {
+		return false, true, fmt.Errorf("int too large to compare with cents")
+	}
+	x, z := int64(c), i64*100
+	if side == starlark.Right {
+		x, z = z, x
+	}
+	return compareInt64(op, x, z), true, nil
+}
+
+func compareInt64(op syntax.Token, x, y int64) bool {
+	switch op {
+	case syntax.EQL:
+		return x == y
+	case syntax.NEQ:
+		return x != y
+	case syntax.LT:
+		return x < y
+	case syntax.LE:
+		return x <= y
+	case syntax.GT:
+		return x > y
+	default:
+		return x >= y
+	}
+}
+
+func TestMixedComparable(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"one":        cents(100),
+		"one_fifty": cents(150),
+	}
+	for _, test := range []struct{ src, want string }{
+		{`one == 1`, `True`},
+		{`1 == one`, `True`},
+		{`one != 1`, `False`},
+		{`one_fifty > 1`, `True`},
+		{`one_fifty < 2`, `True`},
+		{`2 < one_fifty`, `False`},
+		{`1 <= one`, `True`},
+		{`one == "1"`, `False`},
+		{`one < "1"`, `cents < string not implemented`},
+		{`sorted([2, one_fifty, 1])`, `[1, 1.50, 2]`},
+		{`1 in [one]`, `True`},
+		{`{1: "a"}[one]`, `"a"`},
+		{`one < 1 << 70`, `int too large to compare with cents`},
+	} {
+		var got string
+		if v, err := starlark.Eval(new(starlark.Thread), "<expr>", test.src, predeclared); err != nil {
+			got = err.Error()
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("eval %s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+// evens is a test Container holding all even ints.
+type evens struct{}
+
+var _ starlark.Container = evens{}
+
+func (evens) String() string        { return "evens" }
+func (evens) Type() string          { return "evens" }
+func (evens) Freeze()               {}
+func (evens) Truth() starlark.Bool  { return true }
+func (evens) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: evens") }
+
+func (evens) Contains(x starlark.Value) (bool, error) {
+	i, ok := x.(starlark.Int)
+	if !ok {
+		return false, fmt.Errorf("'in evens' requires int as left operand, not %s", x.Type())
+	}
+	rem, _ := i.Mod(starlark.MakeInt(2)).Int64()
+	return rem == 0, nil
+}
+
+func TestContainer(t *testing.T) {
+	predeclared := starlark.StringDict{"evens": evens{}}
+	for _, test := range []struct{ src, want string }{
+		{`4 in evens`, `True`},
+		{`3 in evens`, `False`},
+		{`3 not in evens`, `True`},
+		{`(1 << 100) in evens`, `True`},
+		{`"x" in evens`, `'in evens' requires int as left operand, not string`},
+		{`[x for x in range(5) if x in evens]`, `[0, 2, 4]`},
+	} {
+		var got string
+		if v, err := starlark.Eval(new(starlark.Thread), "<expr>", test.src, predeclared); err != nil {
+			got = err.Error()
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("eval %s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	var md starlark.Metadata
+
+	// Record which file each list came from.
+	a := starlark.NewList(nil)
+	b := starlark.NewList(nil)
+	if err := md.Set(a, "a.star"); err != nil {
+		t.Fatal(err)
+	}
+	if err := md.Set(b, "b.star"); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := md.Get(a); !ok || data != "a.star" {
+		t.Errorf("Get(a) = %v, %t, want a.star", data, ok)
+	}
+
+	// Values without identity carry no metadata.
+	if err := md.Set(starlark.String("x"), "x.star"); fmt.Sprint(err) != "cannot associate metadata with string value: no identity" {
+		t.Errorf("Set(string) returned %v", err)
+	}
+	if _, ok := md.Get(starlark.Tuple{a}); ok {
+		t.Errorf("Get(tuple) succeeded unexpectedly")
+	}
+
+	// Propagate metadata to a copy, and to a derived value.
+	c := starlark.NewList(nil)
+	if ok, err := md.Copy(c, a); !ok || err != nil {
+		t.Errorf("Copy = %t, %v", ok, err)
+	}
+	d := starlark.NewDict(0)
+	join := func(datas []interface{}) interface{} { return fmt.Sprint(datas) }
+	if err := md.Merge(d, join, a, starlark.None, b); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := md.Get(c); data != "a.star" {
+		t.Errorf("Get(c) = %v, want a.star", data)
+	}
+	if data, _ := md.Get(d); data != "[a.star b.star]" {
+		t.Errorf("Get(d) = %v, want [a.star b.star]", data)
+	}
+
+	md.Delete(a)
+	if _, ok := md.Get(a); ok {
+		t.Errorf("Get(a) succeeded after Delete")
+	}
+	if md.Len() != 3 {
+		t.Errorf("Len = %d, want 3", md.Len())
+	}
+}
+
+func TestCheckFrozen(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+	}
+	for _, test := range []struct{ src, want string }{
+		{`1`, ``},
+		{`[1, (2, "three")]`, `value is an unfrozen list`},
+		{`struct(a = 1, b = [2])`, `value.b is an unfrozen list`},
+		{`{"k": (1, [])}`, `value is an unfrozen dict`},
+		{`(lambda x=[]: x)`, `value.defaults[0] is an unfrozen list`},
+		{`[].append`, `value.receiver is an unfrozen list`},
+	} {
+		thread := new(starlark.Thread)
+		v, err := starlark.Eval(thread, "<expr>", test.src, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(starlark.CheckFrozen(v)); test.want == "" && got != "<nil>" || test.want != "" && got != test.want {
+			t.Errorf("CheckFrozen(%s) = %s, want %q", test.src, got, test.want)
+		}
+		v.Freeze()
+		if err := starlark.CheckFrozen(v); err != nil {
+			t.Errorf("CheckFrozen(%s) after Freeze = %v", test.src, err)
+		}
+	}
+
+	// Shared and cyclic references are visited once.
+	list := starlark.NewList([]starlark.Value{starlark.None})
+	outer := starlark.NewDict(1)
+	outer.SetKey(starlark.String("x"), list)
+	outer.SetKey(starlark.String("y"), list)
+	outer.SetKey(starlark.String("z"), outer)
+	outer.Freeze()
+	if err := starlark.CheckFrozen(outer); err != nil {
+		t.Errorf("CheckFrozen(outer) = %v", err)
+	}
+
+	// Paths describe how an unfrozen value is reached.
+	s := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"d": starlark.NewDict(0),
+	})
+	if got, want := fmt.Sprint(starlark.CheckFrozen(starlark.Tuple{outer, s})), `value[1].d is an unfrozen dict`; got != want {
+		t.Errorf("CheckFrozen(tuple) = %s, want %s", got, want)
+	}
+}
+
+func TestDictBulk(t *testing.T) {
+	d, err := starlark.NewDictFromItems([]starlark.Tuple{
+		{starlark.String("b"), starlark.MakeInt(1)},
+		{starlark.String("a"), starlark.MakeInt(2)},
+		{starlark.String("b"), starlark.MakeInt(3)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.String(), `{"b": 3, "a": 2}`; got != want {
+		t.Errorf("NewDictFromItems = %s, want %s", got, want)
+	}
+	if _, err := starlark.NewDictFromItems([]starlark.Tuple{{starlark.None}}); fmt.Sprint(err) != "dictionary update sequence element #0 has length 1, want 2" {
+		t.Errorf("NewDictFromItems(bad item) returned %v", err)
+	}
+	if _, err := starlark.NewDictFromItems([]starlark.Tuple{{starlark.NewList(nil), starlark.None}}); fmt.Sprint(err) != "unhashable type: list" {
+		t.Errorf("NewDictFromItems(unhashable) returned %v", err)
+	}
+
+	d = starlark.NewDictFromStringMap(map[string]starlark.Value{
+		"y": starlark.True,
+		"x": starlark.False,
+		"z": starlark.None,
+	})
+	if got, want := d.String(), `{"x": False, "y": True, "z": None}`; got != want {
+		t.Errorf("NewDictFromStringMap = %s, want %s", got, want)
+	}
+
+	// Update a small dict with many items, forcing a resize.
+	const n = 1000
+	items := make([]starlark.Tuple, n)
+	for i := range items {
+		items[i] = starlark.Tuple{starlark.MakeInt(i), starlark.MakeInt(i * i)}
+	}
+	if err := d.Update(items); err != nil {
+		t.Fatal(err)
+	}
+	if d.Len() != n+3 {
+		t.Errorf("Len = %d, want %d", d.Len(), n+3)
+	}
+	for i := 0; i < n; i++ {
+		if v, found, _ := d.Get(starlark.MakeInt(i)); !found || v.(starlark.Int) != starlark.MakeInt(i*i) {
+			t.Fatalf("Get(%d) = %v, %t", i, v, found)
+		}
+	}
+	if keys := d.Keys(); keys[2] != starlark.String("z") || keys[3] != starlark.MakeInt(0) || keys[n+2] != starlark.MakeInt(n-1) {
+		t.Errorf("Update did not preserve insertion order: %v...", keys[:5])
+	}
+
+	d.Freeze()
+	if err := d.Update(items[:1]); fmt.Sprint(err) != "cannot insert into frozen hash table" {
+		t.Errorf("Update(frozen) returned %v", err)
+	}
+}
+
+func TestListBulk(t *testing.T) {
+	ints := func(xs ...int) []starlark.Value {
+		var elems []starlark.Value
+		for _, x := range xs {
+			elems = append(elems, starlark.MakeInt(x))
+		}
+		return elems
+	}
+
+	l := starlark.NewListTakingOwnership(ints(1, 2, 3))
+	for _, test := range []struct {
+		i      int
+		values []starlark.Value
+		want   string
+	}{
+		{0, ints(-1, 0), "[-1, 0, 1, 2, 3]"},
+		{5, ints(4), "[-1, 0, 1, 2, 3, 4]"},
+		{2, nil, "[-1, 0, 1, 2, 3, 4]"},
+		{3, ints(10, 11), "[-1, 0, 1, 10, 11, 2, 3, 4]"},
+		{9, ints(0), "insertion index 9 out of range [0:8] of list"},
+		{-1, ints(0), "insertion index -1 out of range [0:8] of list"},
+	} {
+		var got string
+		if err := l.InsertAll(test.i, test.values); err != nil {
+			got = err.Error()
+		} else {
+			got = l.String()
+		}
+		if got != test.want {
+			t.Errorf("InsertAll(%d, %v) = %s, want %s", test.i, test.values, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		start, end int
+		want       string
+	}{
+		{3, 5, "[-1, 0, 1, 2, 3, 4]"},
+		{0, 0, "[-1, 0, 1, 2, 3, 4]"},
+		{4, 6, "[-1, 0, 1, 2]"},
+		{2, 1, "invalid range [2:1] of list of length 4"},
+		{0, 5, "invalid range [0:5] of list of length 4"},
+		{0, 4, "[]"},
+	} {
+		var got string
+		if err := l.RemoveRange(test.start, test.end); err != nil {
+			got = err.Error()
+		} else {
+			got = l.String()
+		}
+		if got != test.want {
+			t.Errorf("RemoveRange(%d, %d) = %s, want %s", test.start, test.end, got, test.want)
+		}
+	}
+
+	l.Freeze()
+	if err := l.InsertAll(0, ints(1)); fmt.Sprint(err) != "cannot insert into frozen list" {
+		t.Errorf("InsertAll(frozen) returned %v", err)
+	}
+	if err := l.RemoveRange(0, 0); fmt.Sprint(err) != "cannot remove from frozen list" {
+		t.Errorf("RemoveRange(frozen) returned %v", err)
+	}
+}
+
+func TestSetAPI(t *testing.T) {
+	ints := func(xs ...int) []starlark.Value {
+		var elems []starlark.Value
+		for _, x := range xs {
+			elems = append(elems, starlark.MakeInt(x))
+		}
+		return elems
+	}
+	x, err := starlark.NewSetFromElems(ints(1, 2, 3, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := x.String(), "set([1, 2, 3])"; got != want {
+		t.Errorf("NewSetFromElems = %s, want %s", got, want)
+	}
+	if _, err := starlark.NewSetFromElems([]starlark.Value{starlark.NewList(nil)}); fmt.Sprint(err) != "unhashable type: list" {
+		t.Errorf("NewSetFromElems(unhashable) returned %v", err)
+	}
+
+	y := starlark.NewList(ints(4, 3, 2))
+	for _, test := range []struct {
+		name string
+		op   func(starlark.Iterator) (starlark.Value, error)
+		want string
+	}{
+		{"Union", x.Union, "set([1, 2, 3, 4])"},
+		{"Intersection", x.Intersection, "set([3, 2])"},
+		{"Difference", x.Difference, "set([1])"},
+		{"SymmetricDifference", x.SymmetricDifference, "set([1, 4])"},
+	} {
+		iter := y.Iterate()
+		z, err := test.op(iter)
+		iter.Done()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if got := z.String(); got != test.want {
+			t.Errorf("%s = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	if err := x.InsertAll(ints(5, 1, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := x.String(), "set([1, 2, 3, 5, 6])"; got != want {
+		t.Errorf("InsertAll = %s, want %s", got, want)
+	}
+	x.Freeze()
+	if err := x.InsertAll(ints(7)); fmt.Sprint(err) != "cannot insert into frozen hash table" {
+		t.Errorf("InsertAll(frozen) returned %v", err)
+	}
+}
+
+func TestFunctionIntrospection(t *testing.T) {
+	globals, err := starlark.ExecFile(new(starlark.Thread), "introspect.star", `
+def outer():
+	x, y = 1, [2]
+	def f(a, b=1, *args, c, d=2, **kwargs):
+		return x, y
+	return f
+
+f = outer()
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := globals["f"].(*starlark.Function)
+	if got, want := fmt.Sprint(f.ParamNames()), "[a b c d args kwargs]"; got != want {
+		t.Errorf("ParamNames = %s, want %s", got, want)
+	}
+	var kwonly []bool
+	for i := 0; i < f.NumParams(); i++ {
+		kwonly = append(kwonly, f.IsKwonlyParam(i))
+	}
+	if got, want := fmt.Sprint(kwonly), "[false false true true false false]"; got != want {
+		t.Errorf("IsKwonlyParam = %s, want %s", got, want)
+	}
+	var freevars []string
+	for i := 0; i < f.NumFreeVars(); i++ {
+		name, v := f.FreeVar(i)
+		freevars = append(freevars, fmt.Sprintf("%s=%v", name, v))
+	}
+	if got, want := fmt.Sprint(freevars), "[x=1 y=[2]]"; got != want {
+		t.Errorf("FreeVars = %s, want %s", got, want)
+	}
+}
+
+func TestFork(t *testing.T) {
+	const n = 100
+	base := starlark.NewDict(n)
+	elems := make([]starlark.Value, n)
+	for i := 0; i < n; i++ {
+		base.SetKey(starlark.MakeInt(i), starlark.MakeInt(i*i))
+		elems[i] = starlark.MakeInt(i)
+	}
+	baseList := starlark.NewList(elems)
+	small := starlark.NewDict(1)
+	small.SetKey(starlark.String("a"), starlark.None)
+	base.Freeze()
+	baseList.Freeze()
+	small.Freeze()
+
+	predeclared := starlark.StringDict{
+		"d":  base.Fork(),
+		"d2": base.Fork(),
+		"l":  baseList.Fork(),
+		"s":  small.Fork(),
+		"e":  new(starlark.Dict).Fork(),
+	}
+	const src = `
+load("assert.star", "assert")
+assert.eq(len(d), 100)
+assert.eq(d[7], 49)
+d[7] = "seven"
+d.pop(8)
+d["x"] = 1
+assert.eq((len(d), d[7], d["x"], 8 in d), (100, "seven", 1, False))
+assert.eq(list(d)[-1], "x")
+assert.eq(d2[7], 49)
+d2.clear()
+assert.eq(len(d2), 0)
+
+assert.eq(l[:3], [0, 1, 2])
+l[0] = "zero"
+l.extend([100])
+l.pop(1)
+assert.eq((len(l), l[0], l[1], l[-1]), (100, "zero", 2, 100))
+
+s["b"] = True
+assert.eq(s, {"a": None, "b": True})
+e["k"] = "v"
+assert.eq(e, {"k": "v"})
+`
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	if _, err := starlark.ExecFile(thread, "fork.star", src, predeclared); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parents are unchanged.
+	if v, _, _ := base.Get(starlark.MakeInt(7)); base.Len() != n || v != starlark.MakeInt(49) {
+		t.Errorf("forked dict modified its parent: len=%d, [7]=%v", base.Len(), v)
+	}
+	if baseList.Len() != n || baseList.Index(0) != starlark.MakeInt(0) || baseList.Index(1) != starlark.MakeInt(1) {
+		t.Errorf("forked list modified its parent: %v", baseList)
+	}
+	if got, want := small.String(), `{"a": None}`; got != want {
+		t.Errorf("forked dict modified its parent: %s, want %s", got, want)
+	}
+
+	// A fork of an unfrozen value is an independent copy.
+	list := starlark.NewList([]starlark.Value{starlark.True})
+	fork := list.Fork()
+	list.SetIndex(0, starlark.False)
+	if got := fork.Index(0); got != starlark.True {
+		t.Errorf("fork of unfrozen list changed with parent: %v", got)
+	}
+}
+
+func TestDictDefaultFactory(t *testing.T) {
+	factory := starlark.NewBuiltin("zero", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.MakeInt(0), nil
+	})
+	d := new(starlark.Dict)
+	if err := d.SetDefaultFactory(factory); err != nil {
+		t.Fatal(err)
+	}
+
+	// Index, which has no thread, does not call the factory.
+	if _, err := starlark.Index(d, starlark.String("k")); err == nil {
+		t.Error("Index of missing key in defaultdict succeeded")
+	} else if d.Len() != 0 {
+		t.Errorf("Index of missing key in defaultdict inserted it")
+	}
+
+	// IndexThread calls it in the caller's thread, like the interpreter.
+	thread := &starlark.Thread{Name: "caller"}
+	var caller string
+	factory = starlark.NewBuiltin("zero", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		caller = thread.Name
+		return starlark.MakeInt(0), nil
+	})
+	if err := d.SetDefaultFactory(factory); err != nil {
+		t.Fatal(err)
+	}
+	v, err := starlark.IndexThread(thread, d, starlark.String("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != starlark.MakeInt(0) || d.Len() != 1 || caller != "caller" {
+		t.Errorf("IndexThread on defaultdict = %v (len %d, thread %q), want 0 (len 1, thread caller)", v, d.Len(), caller)
+	}
+
+	// The factory of a frozen dict cannot be changed.
+	d.Freeze()
+	if err := d.SetDefaultFactory(nil); err == nil {
+		t.Error("SetDefaultFactory on frozen dict succeeded")
+	} else if got, want := err.Error(), "cannot set default factory of frozen dict"; got != want {
+		t.Errorf("SetDefaultFactory on frozen dict: got %q, want %q", got, want)
+	}
+	if d.DefaultFactory() != factory {
+		t.Error("SetDefaultFactory on frozen dict changed the factory")
+	}
+}
@@ -0,0 +1,786 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkgo translates Starlark functions to Go.
+//
+// THIS PACKAGE IS EXPERIMENTAL AND ITS INTERFACE MAY CHANGE.
+//
+// An application that has identified a few hot, pure Starlark functions
+// may use Translate to convert them ahead of time into Go functions
+// with the signature of a starlark.Builtin, avoiding the overheads of
+// the bytecode interpreter. The Go code performs the same operations as
+// the interpreter would, through the public API of the starlark package,
+// so the translated functions have the same meaning as the originals.
+//
+// Only a subset of Starlark may be translated. A translated function
+// may have ordinary parameters, with optional defaults that are literal
+// constants, but not *args or **kwargs. Its body may contain
+// assignments (including augmented and sequence assignments) to local
+// variables, list and dict elements; if, for, while, break, continue,
+// pass, and return statements; and expression statements. Its
+// expressions may refer only to its own parameters and locals and to
+// universal built-ins such as len, and may use literals, operators,
+// calls (without *args or **kwargs), attributes, indexing, slicing, and
+// list, tuple, and dict displays. Nested functions, lambdas,
+// comprehensions, and references to global or predeclared names are not
+// supported.
+//
+// Translated functions report errors in argument binding in the manner
+// of built-in functions, so the messages differ from those of the
+// interpreter. Translated code does not count execution steps and does not check for
+// cancellation except in the functions it calls.
+package starlarkgo // import "go.starlark.net/starlarkgo"
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// A Config specifies how to translate a file.
+type Config struct {
+	Package string   // name of the Go package of the generated file
+	Funcs   []string // names of the Starlark functions to translate
+
+	// Var is the name of the generated starlark.StringDict variable
+	// that maps each Starlark function name to a Builtin for its
+	// translation. The default is "Builtins". Distinct files translated
+	// into the same Go package must use distinct names.
+	Var string
+}
+
+// Translate parses and resolves the specified Starlark file and returns
+// the source of a Go file that declares, for each function named by the
+// configuration, a Go function suitable for starlark.NewBuiltin whose
+// name is the exported form of the Starlark name (for example, FibSum
+// for fib_sum), and a variable mapping each Starlark name to a Builtin.
+//
+// The filename and src parameters are as for syntax.Parse. Names that
+// are neither defined in the file nor universal are assumed to be
+// predeclared, though translated functions may not refer to them.
+//
+// Translate reports an error if a function is not found or uses a
+// feature outside the supported subset.
+func Translate(filename string, src interface{}, config Config) ([]byte, error) {
+	f, err := syntax.Parse(filename, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	isPredeclared := func(name string) bool { return !starlark.Universe.Has(name) }
+	if err := resolve.File(f, isPredeclared, starlark.Universe.Has); err != nil {
+		return nil, err
+	}
+
+	defs := make(map[string]*syntax.DefStmt)
+	for _, stmt := range f.Stmts {
+		if def, ok := stmt.(*syntax.DefStmt); ok {
+			defs[def.Name.Name] = def
+		}
+	}
+
+	v := config.Var
+	if v == "" {
+		v = "Builtins"
+	}
+	g := &generator{
+		consts: make(map[int64]string),
+		unpack: "unpack" + v,
+	}
+	goNames := make(map[string]string) // maps Go name to Starlark name
+	var names []string
+	for _, name := range config.Funcs {
+		def := defs[name]
+		if def == nil {
+			return nil, fmt.Errorf("%s: no function %s", filename, name)
+		}
+		goName := exportedName(name)
+		if prev, ok := goNames[goName]; ok {
+			return nil, fmt.Errorf("%s: functions %s and %s both translate to %s", filename, prev, name, goName)
+		}
+		goNames[goName] = name
+		names = append(names, name)
+		if err := g.function(goName, def.Function.(*resolve.Function)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Assemble the file.
+	out := new(bytes.Buffer)
+	fmt.Fprintf(out, "// Code generated by starlarkgo from %s. DO NOT EDIT.\n\n", f.Path)
+	fmt.Fprintf(out, "package %s\n\n", config.Package)
+	fmt.Fprintf(out, "import (\n")
+	if g.usesFmt || g.usesUnpack {
+		fmt.Fprintf(out, "\t\"fmt\"\n\n")
+	}
+	fmt.Fprintf(out, "\t\"go.starlark.net/starlark\"\n")
+	if g.usesSyntax {
+		fmt.Fprintf(out, "\t\"go.starlark.net/syntax\"\n")
+	}
+	fmt.Fprintf(out, ")\n\n")
+
+	sort.Strings(names)
+	fmt.Fprintf(out, "// %s maps the name of each translated function to a Builtin.\n", v)
+	fmt.Fprintf(out, "var %s = starlark.StringDict{\n", v)
+	for _, name := range names {
+		fmt.Fprintf(out, "\t%q: starlark.NewBuiltin(%q, %s),\n", name, name, exportedName(name))
+	}
+	fmt.Fprintf(out, "}\n\n")
+
+	if len(g.consts) > 0 {
+		ints := make([]int64, 0, len(g.consts))
+		for x := range g.consts {
+			ints = append(ints, x)
+		}
+		sort.Slice(ints, func(i, j int) bool { return g.consts[ints[i]] < g.consts[ints[j]] })
+		fmt.Fprintf(out, "var (\n")
+		for _, x := range ints {
+			fmt.Fprintf(out, "\t%s = starlark.MakeInt64(%d)\n", g.consts[x], x)
+		}
+		fmt.Fprintf(out, ")\n\n")
+	}
+
+	out.Write(g.funcs.Bytes())
+
+	if g.usesUnpack {
+		fmt.Fprintf(out, unpackTemplate, g.unpack, g.unpack)
+	}
+
+	return format.Source(out.Bytes())
+}
+
+const unpackTemplate = `
+// %s returns the n elements of x, as for a sequence assignment.
+func %s(x starlark.Value, n int) ([]starlark.Value, error) {
+	iter := starlark.Iterate(x)
+	if iter == nil {
+		return nil, fmt.Errorf("got %%s in sequence assignment", x.Type())
+	}
+	defer iter.Done()
+	elems := make([]starlark.Value, 0, n)
+	var elem starlark.Value
+	for iter.Next(&elem) {
+		if len(elems) == n {
+			return nil, fmt.Errorf("too many values to unpack (got %%d, want %%d)", starlark.Len(x), n)
+		}
+		elems = append(elems, elem)
+	}
+	if iter, ok := iter.(starlark.ErrIterator); ok {
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(elems) < n {
+		return nil, fmt.Errorf("too few values to unpack (got %%d, want %%d)", len(elems), n)
+	}
+	return elems, nil
+}
+`
+
+// A generator holds the state of the translation of a file.
+type generator struct {
+	funcs                           bytes.Buffer     // generated functions
+	consts                          map[int64]string // names of hoisted int constants
+	unpack                          string           // name of sequence assignment helper
+	usesFmt, usesSyntax, usesUnpack bool
+
+	// per function
+	fn     *resolve.Function
+	body   *bytes.Buffer
+	temps  int
+	iters  []string        // iterators of enclosing loops, innermost last ("" for while)
+	params map[string]bool // names of parameters
+	read   map[string]bool // names of locals that are read
+}
+
+// An unsupportedError reports a feature outside the supported subset.
+type unsupportedError struct {
+	pos syntax.Position
+	msg string
+}
+
+func (g *generator) unsupported(pos syntax.Position, format string, args ...interface{}) {
+	panic(unsupportedError{pos, fmt.Sprintf(format, args...)})
+}
+
+// function translates the Starlark function fn to a Go function named goName.
+func (g *generator) function(goName string, fn *resolve.Function) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			u, ok := x.(unsupportedError)
+			if !ok {
+				panic(x)
+			}
+			err = fmt.Errorf("%s: in function %s: %s is not supported", u.pos, fn.Name, u.msg)
+		}
+	}()
+
+	g.fn = fn
+	g.body = new(bytes.Buffer)
+	g.temps = 0
+	g.iters = nil
+	g.params = make(map[string]bool)
+	g.read = make(map[string]bool)
+
+	if fn.HasVarargs || fn.HasKwargs || fn.NumKwonlyParams > 0 {
+		g.unsupported(fn.Pos, "a function with *args, **kwargs, or keyword-only parameters")
+	}
+	if fn.Generator {
+		g.unsupported(fn.Pos, "a generator function")
+	}
+
+	// Unpack the parameters, setting optional ones to their defaults.
+	var pairs []string
+	for _, param := range fn.Params {
+		switch param := param.(type) {
+		case *syntax.Ident:
+			g.params[param.Name] = true
+			pairs = append(pairs, fmt.Sprintf("%q, &l_%s", param.Name, param.Name))
+		case *syntax.BinaryExpr:
+			id := param.X.(*syntax.Ident)
+			g.params[id.Name] = true
+			dflt, ok := g.constant(param.Y)
+			if !ok {
+				start, _ := param.Y.Span()
+				g.unsupported(start, "a parameter default that is not a literal")
+			}
+			fmt.Fprintf(g.body, "l_%s = %s\n", id.Name, dflt)
+			pairs = append(pairs, fmt.Sprintf("%q, &l_%s", id.Name+"?", id.Name))
+		default:
+			start, _ := param.Span()
+			g.unsupported(start, "this parameter")
+		}
+	}
+	if len(pairs) > 0 {
+		fmt.Fprintf(g.body, "if err := starlark.UnpackArgs(b.Name(), args, kwargs, %s); err != nil {\nreturn nil, err\n}\n",
+			strings.Join(pairs, ", "))
+	} else {
+		fmt.Fprintf(g.body, "if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {\nreturn nil, err\n}\n")
+	}
+
+	g.stmts(fn.Body)
+	if !terminates(fn.Body) {
+		fmt.Fprintf(g.body, "return starlark.None, nil\n")
+	}
+
+	// Emit the function.
+	w := &g.funcs
+	fmt.Fprintf(w, "// %s is the translation of the Starlark function %s at %s.\n", goName, fn.Name, fn.Pos)
+	fmt.Fprintf(w, "func %s(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {\n", goName)
+	if len(fn.Locals) > 0 {
+		fmt.Fprintf(w, "var (\n")
+		for _, local := range fn.Locals {
+			fmt.Fprintf(w, "l_%s starlark.Value\n", local.First.Name)
+		}
+		fmt.Fprintf(w, ")\n")
+		for _, local := range fn.Locals {
+			if name := local.First.Name; !g.read[name] {
+				fmt.Fprintf(w, "_ = l_%s\n", name)
+			}
+		}
+	}
+	w.Write(g.body.Bytes())
+	fmt.Fprintf(w, "}\n\n")
+	return nil
+}
+
+// terminates reports whether execution of stmts never
+// reaches its end, in the sense of a Go terminating statement.
+func terminates(stmts []syntax.Stmt) bool {
+	if len(stmts) == 0 {
+		return false
+	}
+	switch stmt := stmts[len(stmts)-1].(type) {
+	case *syntax.ReturnStmt:
+		return true
+	case *syntax.IfStmt:
+		return len(stmt.False) > 0 && terminates(stmt.True) && terminates(stmt.False)
+	}
+	return false
+}
+
+func (g *generator) emit(format string, args ...interface{}) {
+	fmt.Fprintf(g.body, format, args...)
+	g.body.WriteByte('\n')
+}
+
+// temp returns the name of a new temporary variable.
+func (g *generator) temp() string {
+	g.temps++
+	return fmt.Sprintf("t%d", g.temps)
+}
+
+// fail emits code to return the error err, first releasing the
+// iterators of all enclosing loops.
+func (g *generator) fail(err string) {
+	g.done(0)
+	g.emit("return nil, %s", err)
+}
+
+// done emits calls to release the iterators of the enclosing loops,
+// innermost first, down to the specified depth.
+func (g *generator) done(depth int) {
+	for i := len(g.iters) - 1; i >= depth; i-- {
+		if iter := g.iters[i]; iter != "" {
+			g.emit("%s.Done()", iter)
+		}
+	}
+}
+
+// check emits code to return err if it is non-nil.
+func (g *generator) check() {
+	g.emit("if err != nil {")
+	g.fail("err")
+	g.emit("}")
+}
+
+func (g *generator) stmts(stmts []syntax.Stmt) {
+	for _, stmt := range stmts {
+		g.stmt(stmt)
+	}
+}
+
+func (g *generator) stmt(stmt syntax.Stmt) {
+	switch stmt := stmt.(type) {
+	case *syntax.ExprStmt:
+		g.emit("_ = %s", g.expr(stmt.X))
+
+	case *syntax.BranchStmt:
+		switch stmt.Token {
+		case syntax.PASS:
+			// no-op
+		case syntax.BREAK:
+			g.emit("break")
+		case syntax.CONTINUE:
+			g.emit("continue")
+		}
+
+	case *syntax.IfStmt:
+		cond := g.expr(stmt.Cond)
+		g.emit("if %s.Truth() {", cond)
+		g.stmts(stmt.True)
+		if len(stmt.False) > 0 {
+			g.emit("} else {")
+			g.stmts(stmt.False)
+		}
+		g.emit("}")
+
+	case *syntax.AssignStmt:
+		if stmt.Op == syntax.EQ {
+			g.assign(stmt.LHS, g.expr(stmt.RHS))
+			break
+		}
+
+		// augmented assignment: x op= y
+		op := stmt.Op - syntax.PLUS_EQ + syntax.PLUS
+		switch lhs := unparen(stmt.LHS).(type) {
+		case *syntax.Ident:
+			x := g.ident(lhs)
+			y := g.expr(stmt.RHS)
+			z := g.temp()
+			g.emit("%s, err := starlark.InplaceBinary(%s, %s, %s)", z, g.token(op), x, y)
+			g.check()
+			g.assign(lhs, z)
+
+		case *syntax.IndexExpr:
+			x := g.expr(lhs.X)
+			i := g.expr(lhs.Y)
+			cur := g.temp()
+			g.emit("%s, err := starlark.Index(%s, %s)", cur, x, i)
+			g.check()
+			y := g.expr(stmt.RHS)
+			z := g.temp()
+			g.emit("%s, err := starlark.InplaceBinary(%s, %s, %s)", z, g.token(op), cur, y)
+			g.check()
+			g.emit("if err := starlark.SetIndex(%s, %s, %s); err != nil {", x, i, z)
+			g.fail("err")
+			g.emit("}")
+
+		default:
+			g.unsupported(stmt.OpPos, "this augmented assignment")
+		}
+
+	case *syntax.ForStmt:
+		x := g.expr(stmt.X)
+		iter := g.temp()
+		elem := g.temp()
+		g.emit("%s := starlark.Iterate(%s)", iter, x)
+		g.emit("if %s == nil {", iter)
+		g.usesFmt = true
+		g.fail(fmt.Sprintf("fmt.Errorf(\"%%s value is not iterable\", %s.Type())", x))
+		g.emit("}")
+		g.iters = append(g.iters, iter)
+		g.emit("var %s starlark.Value", elem)
+		g.emit("for %s.Next(&%s) {", iter, elem)
+		g.assign(stmt.Vars, elem)
+		g.stmts(stmt.Body)
+		g.emit("}")
+		g.emit("if %s, ok := %s.(starlark.ErrIterator); ok {", iter, iter)
+		g.emit("if err := %s.Err(); err != nil {", iter)
+		g.fail("err")
+		g.emit("}")
+		g.emit("}")
+		g.iters = g.iters[:len(g.iters)-1]
+		g.emit("%s.Done()", iter)
+
+	case *syntax.WhileStmt:
+		g.emit("for {")
+		g.iters = append(g.iters, "")
+		cond := g.expr(stmt.Cond)
+		g.emit("if !%s.Truth() {", cond)
+		g.emit("break")
+		g.emit("}")
+		g.stmts(stmt.Body)
+		g.iters = g.iters[:len(g.iters)-1]
+		g.emit("}")
+
+	case *syntax.ReturnStmt:
+		result := "starlark.None"
+		if stmt.Result != nil {
+			result = g.expr(stmt.Result)
+		}
+		g.done(0)
+		g.emit("return %s, nil", result)
+
+	default:
+		start, _ := stmt.Span()
+		g.unsupported(start, "this statement")
+	}
+}
+
+// assign emits code to assign the value of the Go expression v to lhs.
+func (g *generator) assign(lhs syntax.Expr, v string) {
+	switch lhs := unparen(lhs).(type) {
+	case *syntax.Ident:
+		bind := lhs.Binding.(*resolve.Binding)
+		if bind.Scope != resolve.Local {
+			g.unsupported(lhs.NamePos, "assignment to %s variable %s", bind.Scope, lhs.Name)
+		}
+		g.emit("l_%s = %s", lhs.Name, v)
+
+	case *syntax.IndexExpr:
+		x := g.expr(lhs.X)
+		i := g.expr(lhs.Y)
+		g.emit("if err := starlark.SetIndex(%s, %s, %s); err != nil {", x, i, v)
+		g.fail("err")
+		g.emit("}")
+
+	case *syntax.TupleExpr:
+		g.assignSequence(lhs.List, v)
+
+	case *syntax.ListExpr:
+		g.assignSequence(lhs.List, v)
+
+	default:
+		start, _ := lhs.Span()
+		g.unsupported(start, "this assignment")
+	}
+}
+
+func (g *generator) assignSequence(lhs []syntax.Expr, v string) {
+	g.usesUnpack = true
+	elems := g.temp()
+	g.emit("%s, err := %s(%s, %d)", elems, g.unpack, v, len(lhs))
+	g.check()
+	for i, elem := range lhs {
+		g.assign(elem, fmt.Sprintf("%s[%d]", elems, i))
+	}
+}
+
+// expr emits code to evaluate e, and returns a Go
+// expression of type starlark.Value for its value.
+func (g *generator) expr(e syntax.Expr) string {
+	if v, ok := g.constant(e); ok {
+		return v
+	}
+
+	switch e := e.(type) {
+	case *syntax.ParenExpr:
+		return g.expr(e.X)
+
+	case *syntax.Ident:
+		return g.ident(e)
+
+	case *syntax.Literal:
+		g.unsupported(e.TokenPos, "this literal")
+
+	case *syntax.ListExpr:
+		elems := make([]string, len(e.List))
+		for i, x := range e.List {
+			elems[i] = g.expr(x)
+		}
+		return fmt.Sprintf("starlark.NewList([]starlark.Value{%s})", strings.Join(elems, ", "))
+
+	case *syntax.TupleExpr:
+		elems := make([]string, len(e.List))
+		for i, x := range e.List {
+			elems[i] = g.expr(x)
+		}
+		return fmt.Sprintf("starlark.Tuple{%s}", strings.Join(elems, ", "))
+
+	case *syntax.DictExpr:
+		d := g.temp()
+		g.emit("%s := starlark.NewDict(%d)", d, len(e.List))
+		for _, entry := range e.List {
+			entry := entry.(*syntax.DictEntry)
+			k := g.expr(entry.Key)
+			v := g.expr(entry.Value)
+			n := g.temp()
+			g.emit("%s := %s.Len()", n, d)
+			g.emit("if err := %s.SetKey(%s, %s); err != nil {", d, k, v)
+			g.fail("err")
+			g.emit("}")
+			g.emit("if %s.Len() == %s {", d, n)
+			g.usesFmt = true
+			g.fail(fmt.Sprintf("fmt.Errorf(\"duplicate key: %%v\", %s)", k))
+			g.emit("}")
+		}
+		return d
+
+	case *syntax.UnaryExpr:
+		x := g.expr(e.X)
+		if e.Op == syntax.NOT {
+			return fmt.Sprintf("starlark.Bool(!%s.Truth())", x)
+		}
+		z := g.temp()
+		g.emit("%s, err := starlark.Unary(%s, %s)", z, g.token(e.Op), x)
+		g.check()
+		return z
+
+	case *syntax.BinaryExpr:
+		switch e.Op {
+		case syntax.AND, syntax.OR:
+			z := g.temp()
+			g.emit("var %s starlark.Value = %s", z, g.expr(e.X))
+			if e.Op == syntax.AND {
+				g.emit("if %s.Truth() {", z)
+			} else {
+				g.emit("if !%s.Truth() {", z)
+			}
+			g.emit("%s = %s", z, g.expr(e.Y))
+			g.emit("}")
+			return z
+
+		case syntax.EQL, syntax.NEQ, syntax.LT, syntax.GT, syntax.LE, syntax.GE:
+			x := g.expr(e.X)
+			y := g.expr(e.Y)
+			z := g.temp()
+			g.emit("%s, err := starlark.Compare(%s, %s, %s)", z, g.token(e.Op), x, y)
+			g.check()
+			return fmt.Sprintf("starlark.Bool(%s)", z)
+
+		case syntax.NOT_IN:
+			x := g.expr(e.X)
+			y := g.expr(e.Y)
+			z := g.temp()
+			g.emit("%s, err := starlark.Binary(%s, %s, %s)", z, g.token(syntax.IN), x, y)
+			g.check()
+			return fmt.Sprintf("starlark.Bool(!%s.Truth())", z)
+
+		default:
+			x := g.expr(e.X)
+			y := g.expr(e.Y)
+			z := g.temp()
+			g.emit("%s, err := starlark.Binary(%s, %s, %s)", z, g.token(e.Op), x, y)
+			g.check()
+			return z
+		}
+
+	case *syntax.CondExpr:
+		z := g.temp()
+		cond := g.expr(e.Cond)
+		g.emit("var %s starlark.Value", z)
+		g.emit("if %s.Truth() {", cond)
+		g.emit("%s = %s", z, g.expr(e.True))
+		g.emit("} else {")
+		g.emit("%s = %s", z, g.expr(e.False))
+		g.emit("}")
+		return z
+
+	case *syntax.DotExpr:
+		x := g.expr(e.X)
+		z := g.temp()
+		g.emit("%s, err := starlark.Attr(%s, %q)", z, x, e.Name.Name)
+		g.check()
+		return z
+
+	case *syntax.IndexExpr:
+		x := g.expr(e.X)
+		y := g.expr(e.Y)
+		z := g.temp()
+		g.emit("%s, err := starlark.Index(%s, %s)", z, x, y)
+		g.check()
+		return z
+
+	case *syntax.SliceExpr:
+		x := g.expr(e.X)
+		operand := func(e syntax.Expr) string {
+			if e == nil {
+				return "starlark.None"
+			}
+			return g.expr(e)
+		}
+		lo, hi, step := operand(e.Lo), operand(e.Hi), operand(e.Step)
+		z := g.temp()
+		g.emit("%s, err := starlark.Slice(%s, %s, %s, %s)", z, x, lo, hi, step)
+		g.check()
+		return z
+
+	case *syntax.CallExpr:
+		fn := g.expr(e.Fn)
+		var args, kwargs []string
+		for _, arg := range e.Args {
+			if unop, ok := arg.(*syntax.UnaryExpr); ok && (unop.Op == syntax.STAR || unop.Op == syntax.STARSTAR) {
+				g.unsupported(unop.OpPos, "a call with *args or **kwargs")
+			}
+			if binop, ok := arg.(*syntax.BinaryExpr); ok && binop.Op == syntax.EQ {
+				name := binop.X.(*syntax.Ident).Name
+				kwargs = append(kwargs, fmt.Sprintf("{starlark.String(%q), %s}", name, g.expr(binop.Y)))
+			} else {
+				args = append(args, g.expr(arg))
+			}
+		}
+		argsExpr, kwargsExpr := "nil", "nil"
+		if args != nil {
+			argsExpr = fmt.Sprintf("starlark.Tuple{%s}", strings.Join(args, ", "))
+		}
+		if kwargs != nil {
+			kwargsExpr = fmt.Sprintf("[]starlark.Tuple{%s}", strings.Join(kwargs, ", "))
+		}
+		z := g.temp()
+		g.emit("%s, err := starlark.Call(thread, %s, %s, %s)", z, fn, argsExpr, kwargsExpr)
+		g.check()
+		return z
+	}
+
+	start, _ := e.Span()
+	g.unsupported(start, "this expression")
+	panic("unreachable")
+}
+
+// ident returns a Go expression for the value of the identifier,
+// emitting a check that a local variable has been assigned.
+func (g *generator) ident(id *syntax.Ident) string {
+	bind := id.Binding.(*resolve.Binding)
+	switch bind.Scope {
+	case resolve.Local:
+		g.read[id.Name] = true
+		if !g.params[id.Name] {
+			g.emit("if l_%s == nil {", id.Name)
+			g.usesFmt = true
+			g.fail(fmt.Sprintf("fmt.Errorf(\"local variable %s referenced before assignment\")", id.Name))
+			g.emit("}")
+		}
+		return "l_" + id.Name
+
+	case resolve.Universal:
+		return fmt.Sprintf("starlark.Universe[%q]", id.Name)
+	}
+	g.unsupported(id.NamePos, "reference to %s variable %s", bind.Scope, id.Name)
+	panic("unreachable")
+}
+
+// constant returns a Go expression for the value of e if it is a
+// literal constant or one of None, True, and False.
+func (g *generator) constant(e syntax.Expr) (string, bool) {
+	switch e := unparen(e).(type) {
+	case *syntax.Literal:
+		switch v := e.Value.(type) {
+		case int64:
+			name, ok := g.consts[v]
+			if !ok {
+				name = fmt.Sprintf("k%d", len(g.consts))
+				g.consts[v] = name
+			}
+			return name, true
+		case float64:
+			return fmt.Sprintf("starlark.Float(%s)", strconv.FormatFloat(v, 'g', -1, 64)), true
+		case string:
+			if e.Token == syntax.BYTES {
+				return fmt.Sprintf("starlark.Bytes(%q)", v), true
+			}
+			return fmt.Sprintf("starlark.String(%q)", v), true
+		}
+	case *syntax.Ident:
+		if bind, ok := e.Binding.(*resolve.Binding); ok && bind.Scope == resolve.Universal {
+			switch e.Name {
+			case "None":
+				return "starlark.None", true
+			case "True":
+				return "starlark.True", true
+			case "False":
+				return "starlark.False", true
+			}
+		}
+	}
+	return "", false
+}
+
+// token returns a Go expression for the token.
+func (g *generator) token(tok syntax.Token) string {
+	name, ok := tokenNames[tok]
+	if !ok {
+		panic(tok)
+	}
+	g.usesSyntax = true
+	return "syntax." + name
+}
+
+var tokenNames = map[syntax.Token]string{
+	syntax.PLUS:       "PLUS",
+	syntax.MINUS:      "MINUS",
+	syntax.STAR:       "STAR",
+	syntax.SLASH:      "SLASH",
+	syntax.SLASHSLASH: "SLASHSLASH",
+	syntax.PERCENT:    "PERCENT",
+	syntax.AMP:        "AMP",
+	syntax.PIPE:       "PIPE",
+	syntax.CIRCUMFLEX: "CIRCUMFLEX",
+	syntax.LTLT:       "LTLT",
+	syntax.GTGT:       "GTGT",
+	syntax.TILDE:      "TILDE",
+	syntax.IN:         "IN",
+	syntax.EQL:        "EQL",
+	syntax.NEQ:        "NEQ",
+	syntax.LT:         "LT",
+	syntax.GT:         "GT",
+	syntax.LE:         "LE",
+	syntax.GE:         "GE",
+}
+
+func unparen(e syntax.Expr) syntax.Expr {
+	if p, ok := e.(*syntax.ParenExpr); ok {
+		return unparen(p.X)
+	}
+	return e
+}
+
+// exportedName converts a Starlark name such as "fib_sum" to
+// an exported Go identifier such as "FibSum".
+func exportedName(s string) string {
+	var buf strings.Builder
+	upper := true
+	for _, r := range s {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		buf.WriteRune(r)
+	}
+	if buf.Len() == 0 || !unicode.IsUpper([]rune(buf.String())[0]) {
+		return "X" + buf.String()
+	}
+	return buf.String()
+}
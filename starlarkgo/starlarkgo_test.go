@@ -0,0 +1,146 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkgo_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkgo"
+)
+
+var update = flag.Bool("update", false, "update zz_example_test.go")
+
+var exampleFuncs = []string{"fib", "collatz", "classify", "histogram", "window", "nothing"}
+
+// TestGolden checks that zz_example_test.go, which declares the
+// Builtins used by TestTranslated, is the translation of example.star.
+func TestGolden(t *testing.T) {
+	defer setRecursion()()
+	got, err := starlarkgo.Translate("testdata/example.star", nil, starlarkgo.Config{
+		Package: "starlarkgo_test",
+		Funcs:   exampleFuncs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := ioutil.WriteFile("zz_example_test.go", got, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile("zz_example_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("zz_example_test.go is stale; run 'go test -update' to regenerate it")
+	}
+}
+
+// TestTranslated checks that each translated function computes
+// the same result as the interpreted function.
+func TestTranslated(t *testing.T) {
+	defer setRecursion()()
+	thread := new(starlark.Thread)
+	globals, err := starlark.ExecFile(thread, "testdata/example.star", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		fn     string
+		args   string // Starlark expressions for the arguments
+		argErr bool   // call fails in argument binding, whose messages differ
+	}{
+		{"fib", "0", false},
+		{"fib", "1", false},
+		{"fib", "90", false},
+		{"fib", "100", false},
+		{"fib", "n=10", false},
+		{"fib", "'x'", false},
+		{"fib", "", true},
+		{"collatz", "1", false},
+		{"collatz", "27", false},
+		{"collatz", "837799", false},
+		{"classify", "-1", false},
+		{"classify", "5", false},
+		{"classify", "50", false},
+		{"classify", "50, 100", false},
+		{"classify", "x=50, small=100", false},
+		{"classify", "'x'", false},
+		{"classify", "1, 2, 3", true},
+		{"histogram", "'the cat, a dog, the cat,,bird'", false},
+		{"histogram", "'x;y;x', sep=';'", false},
+		{"histogram", "1", false},
+		{"window", "[1, 2, 3, 4]", false},
+		{"window", "[1, 2, 3, 4], 0", false},
+		{"window", "[]", false},
+		{"window", "'abc'", false},
+		{"window", "{}", false},
+		{"nothing", "", false},
+		{"nothing", "1", true},
+	} {
+		call := fmt.Sprintf("f(%s)", test.args)
+		eval := func(f starlark.Value) string {
+			v, err := starlark.Eval(thread, "<expr>", call, starlark.StringDict{"f": f})
+			if err != nil {
+				msg := err.Error()
+				if err, ok := err.(*starlark.EvalError); ok {
+					msg = err.Msg
+				}
+				return "error: " + msg
+			}
+			return v.String()
+		}
+		want := eval(globals[test.fn])
+		got := eval(Builtins[test.fn])
+		if test.argErr && strings.HasPrefix(got, "error: ") && strings.HasPrefix(want, "error: ") {
+			continue
+		}
+		if got != want {
+			t.Errorf("%s%s: translated got %s, interpreted got %s", test.fn, call[1:], got, want)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	defer setRecursion()()
+	for _, test := range []struct {
+		src, want string
+	}{
+		{"x = 1\ndef f(): return x", "f.star:2:17: in function f: reference to global variable x is not supported"},
+		{"def f(): return y", "f.star:1:17: in function f: reference to predeclared variable y is not supported"},
+		{"def f(*args): pass", "f.star:1:1: in function f: a function with *args, **kwargs, or keyword-only parameters is not supported"},
+		{"def f(x=[]): pass", "f.star:1:9: in function f: a parameter default that is not a literal is not supported"},
+		{"def f(): return [x for x in ()]", "f.star:1:17: in function f: this expression is not supported"},
+		{"def f(): return lambda: 1", "f.star:1:17: in function f: this expression is not supported"},
+		{"def f(x): x.y = 1", "f.star:1:11: in function f: this assignment is not supported"},
+		{"def f(x): return len(*x)", "f.star:1:22: in function f: a call with *args or **kwargs is not supported"},
+		{"def f(x):\n  def g(): pass", "f.star:2:3: in function f: this statement is not supported"},
+		{"def f(): pass", ""},
+		{"def g(): pass", "f.star: no function f"},
+	} {
+		_, err := starlarkgo.Translate("f.star", test.src, starlarkgo.Config{Package: "p", Funcs: []string{"f"}})
+		if got := fmt.Sprint(err); test.want == "" && err != nil || test.want != "" && got != test.want {
+			t.Errorf("%q: got %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+// setRecursion enables while loops, and returns a function
+// to restore the previous setting.
+func setRecursion() func() {
+	prev := resolve.AllowRecursion
+	resolve.AllowRecursion = true
+	return func() { resolve.AllowRecursion = prev }
+}
@@ -0,0 +1,408 @@
+// Code generated by starlarkgo from testdata/example.star. DO NOT EDIT.
+
+package starlarkgo_test
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Builtins maps the name of each translated function to a Builtin.
+var Builtins = starlark.StringDict{
+	"classify":  starlark.NewBuiltin("classify", Classify),
+	"collatz":   starlark.NewBuiltin("collatz", Collatz),
+	"fib":       starlark.NewBuiltin("fib", Fib),
+	"histogram": starlark.NewBuiltin("histogram", Histogram),
+	"nothing":   starlark.NewBuiltin("nothing", Nothing),
+	"window":    starlark.NewBuiltin("window", Window),
+}
+
+var (
+	k0 = starlark.MakeInt64(0)
+	k1 = starlark.MakeInt64(1)
+	k2 = starlark.MakeInt64(2)
+	k3 = starlark.MakeInt64(3)
+	k4 = starlark.MakeInt64(10)
+)
+
+// Fib is the translation of the Starlark function fib at testdata/example.star:3:1.
+func Fib(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		l_n starlark.Value
+		l_a starlark.Value
+		l_b starlark.Value
+		l__ starlark.Value
+	)
+	_ = l__
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "n", &l_n); err != nil {
+		return nil, err
+	}
+	t1, err := unpackBuiltins(starlark.Tuple{k0, k1}, 2)
+	if err != nil {
+		return nil, err
+	}
+	l_a = t1[0]
+	l_b = t1[1]
+	t2, err := starlark.Call(thread, starlark.Universe["range"], starlark.Tuple{l_n}, nil)
+	if err != nil {
+		return nil, err
+	}
+	t3 := starlark.Iterate(t2)
+	if t3 == nil {
+		return nil, fmt.Errorf("%s value is not iterable", t2.Type())
+	}
+	var t4 starlark.Value
+	for t3.Next(&t4) {
+		l__ = t4
+		if l_b == nil {
+			t3.Done()
+			return nil, fmt.Errorf("local variable b referenced before assignment")
+		}
+		if l_a == nil {
+			t3.Done()
+			return nil, fmt.Errorf("local variable a referenced before assignment")
+		}
+		if l_b == nil {
+			t3.Done()
+			return nil, fmt.Errorf("local variable b referenced before assignment")
+		}
+		t5, err := starlark.Binary(syntax.PLUS, l_a, l_b)
+		if err != nil {
+			t3.Done()
+			return nil, err
+		}
+		t6, err := unpackBuiltins(starlark.Tuple{l_b, t5}, 2)
+		if err != nil {
+			t3.Done()
+			return nil, err
+		}
+		l_a = t6[0]
+		l_b = t6[1]
+	}
+	if t3, ok := t3.(starlark.ErrIterator); ok {
+		if err := t3.Err(); err != nil {
+			t3.Done()
+			return nil, err
+		}
+	}
+	t3.Done()
+	if l_a == nil {
+		return nil, fmt.Errorf("local variable a referenced before assignment")
+	}
+	return l_a, nil
+}
+
+// Collatz is the translation of the Starlark function collatz at testdata/example.star:9:1.
+func Collatz(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		l_n     starlark.Value
+		l_steps starlark.Value
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "n", &l_n); err != nil {
+		return nil, err
+	}
+	l_steps = k0
+	for {
+		t1, err := starlark.Compare(syntax.NEQ, l_n, k1)
+		if err != nil {
+			return nil, err
+		}
+		if !starlark.Bool(t1).Truth() {
+			break
+		}
+		t2, err := starlark.Binary(syntax.PERCENT, l_n, k2)
+		if err != nil {
+			return nil, err
+		}
+		t3, err := starlark.Compare(syntax.EQL, t2, k0)
+		if err != nil {
+			return nil, err
+		}
+		if starlark.Bool(t3).Truth() {
+			t4, err := starlark.Binary(syntax.SLASHSLASH, l_n, k2)
+			if err != nil {
+				return nil, err
+			}
+			l_n = t4
+		} else {
+			t5, err := starlark.Binary(syntax.STAR, k3, l_n)
+			if err != nil {
+				return nil, err
+			}
+			t6, err := starlark.Binary(syntax.PLUS, t5, k1)
+			if err != nil {
+				return nil, err
+			}
+			l_n = t6
+		}
+		if l_steps == nil {
+			return nil, fmt.Errorf("local variable steps referenced before assignment")
+		}
+		t7, err := starlark.InplaceBinary(syntax.PLUS, l_steps, k1)
+		if err != nil {
+			return nil, err
+		}
+		l_steps = t7
+	}
+	if l_steps == nil {
+		return nil, fmt.Errorf("local variable steps referenced before assignment")
+	}
+	return l_steps, nil
+}
+
+// Classify is the translation of the Starlark function classify at testdata/example.star:19:1.
+func Classify(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		l_x     starlark.Value
+		l_small starlark.Value
+	)
+	l_small = k4
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &l_x, "small?", &l_small); err != nil {
+		return nil, err
+	}
+	t1, err := starlark.Compare(syntax.LT, l_x, k0)
+	if err != nil {
+		return nil, err
+	}
+	if starlark.Bool(t1).Truth() {
+		return starlark.String("negative"), nil
+	} else {
+		t2, err := starlark.Compare(syntax.LT, l_x, l_small)
+		if err != nil {
+			return nil, err
+		}
+		if starlark.Bool(t2).Truth() {
+			return starlark.String("small"), nil
+		}
+	}
+	return starlark.String("large"), nil
+}
+
+// Histogram is the translation of the Starlark function histogram at testdata/example.star:26:1.
+func Histogram(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		l_words  starlark.Value
+		l_sep    starlark.Value
+		l_counts starlark.Value
+		l_w      starlark.Value
+	)
+	l_sep = starlark.String(",")
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "words", &l_words, "sep?", &l_sep); err != nil {
+		return nil, err
+	}
+	t1 := starlark.NewDict(0)
+	l_counts = t1
+	t2, err := starlark.Attr(l_words, "split")
+	if err != nil {
+		return nil, err
+	}
+	t3, err := starlark.Call(thread, t2, starlark.Tuple{l_sep}, nil)
+	if err != nil {
+		return nil, err
+	}
+	t4 := starlark.Iterate(t3)
+	if t4 == nil {
+		return nil, fmt.Errorf("%s value is not iterable", t3.Type())
+	}
+	var t5 starlark.Value
+	for t4.Next(&t5) {
+		l_w = t5
+		if l_w == nil {
+			t4.Done()
+			return nil, fmt.Errorf("local variable w referenced before assignment")
+		}
+		t6, err := starlark.Attr(l_w, "strip")
+		if err != nil {
+			t4.Done()
+			return nil, err
+		}
+		t7, err := starlark.Call(thread, t6, nil, nil)
+		if err != nil {
+			t4.Done()
+			return nil, err
+		}
+		l_w = t7
+		if l_w == nil {
+			t4.Done()
+			return nil, fmt.Errorf("local variable w referenced before assignment")
+		}
+		var t8 starlark.Value = starlark.Bool(!l_w.Truth())
+		if !t8.Truth() {
+			if l_w == nil {
+				t4.Done()
+				return nil, fmt.Errorf("local variable w referenced before assignment")
+			}
+			t9, err := starlark.Binary(syntax.IN, l_w, starlark.Tuple{starlark.String("the"), starlark.String("a")})
+			if err != nil {
+				t4.Done()
+				return nil, err
+			}
+			t8 = t9
+		}
+		if t8.Truth() {
+			continue
+		}
+		if l_counts == nil {
+			t4.Done()
+			return nil, fmt.Errorf("local variable counts referenced before assignment")
+		}
+		t10, err := starlark.Attr(l_counts, "get")
+		if err != nil {
+			t4.Done()
+			return nil, err
+		}
+		if l_w == nil {
+			t4.Done()
+			return nil, fmt.Errorf("local variable w referenced before assignment")
+		}
+		t11, err := starlark.Call(thread, t10, starlark.Tuple{l_w, k0}, nil)
+		if err != nil {
+			t4.Done()
+			return nil, err
+		}
+		t12, err := starlark.Binary(syntax.PLUS, t11, k1)
+		if err != nil {
+			t4.Done()
+			return nil, err
+		}
+		if l_counts == nil {
+			t4.Done()
+			return nil, fmt.Errorf("local variable counts referenced before assignment")
+		}
+		if l_w == nil {
+			t4.Done()
+			return nil, fmt.Errorf("local variable w referenced before assignment")
+		}
+		if err := starlark.SetIndex(l_counts, l_w, t12); err != nil {
+			t4.Done()
+			return nil, err
+		}
+	}
+	if t4, ok := t4.(starlark.ErrIterator); ok {
+		if err := t4.Err(); err != nil {
+			t4.Done()
+			return nil, err
+		}
+	}
+	t4.Done()
+	if l_counts == nil {
+		return nil, fmt.Errorf("local variable counts referenced before assignment")
+	}
+	t13, err := starlark.Attr(l_counts, "items")
+	if err != nil {
+		return nil, err
+	}
+	t14, err := starlark.Call(thread, t13, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	t15, err := starlark.Call(thread, starlark.Universe["sorted"], starlark.Tuple{t14}, []starlark.Tuple{{starlark.String("key"), starlark.None}, {starlark.String("reverse"), starlark.False}})
+	if err != nil {
+		return nil, err
+	}
+	return t15, nil
+}
+
+// Window is the translation of the Starlark function window at testdata/example.star:35:1.
+func Window(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		l_xs  starlark.Value
+		l_lo  starlark.Value
+		l_out starlark.Value
+	)
+	l_lo = k1
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "xs", &l_xs, "lo?", &l_lo); err != nil {
+		return nil, err
+	}
+	l_out = starlark.NewList([]starlark.Value{})
+	if l_out == nil {
+		return nil, fmt.Errorf("local variable out referenced before assignment")
+	}
+	t1, err := starlark.Unary(syntax.MINUS, k1)
+	if err != nil {
+		return nil, err
+	}
+	t2, err := starlark.Slice(l_xs, l_lo, t1, starlark.None)
+	if err != nil {
+		return nil, err
+	}
+	t3, err := starlark.InplaceBinary(syntax.PLUS, l_out, t2)
+	if err != nil {
+		return nil, err
+	}
+	l_out = t3
+	if l_out == nil {
+		return nil, fmt.Errorf("local variable out referenced before assignment")
+	}
+	t4, err := starlark.Call(thread, starlark.Universe["len"], starlark.Tuple{l_xs}, nil)
+	if err != nil {
+		return nil, err
+	}
+	t5 := starlark.NewDict(1)
+	var t6 starlark.Value
+	if l_xs.Truth() {
+		t7, err := starlark.Index(l_xs, k0)
+		if err != nil {
+			return nil, err
+		}
+		t6 = t7
+	} else {
+		t6 = starlark.None
+	}
+	t8 := t5.Len()
+	if err := t5.SetKey(starlark.String("first"), t6); err != nil {
+		return nil, err
+	}
+	if t5.Len() == t8 {
+		return nil, fmt.Errorf("duplicate key: %v", starlark.String("first"))
+	}
+	t9, err := starlark.InplaceBinary(syntax.PLUS, l_out, starlark.NewList([]starlark.Value{t4, t5}))
+	if err != nil {
+		return nil, err
+	}
+	l_out = t9
+	if l_out == nil {
+		return nil, fmt.Errorf("local variable out referenced before assignment")
+	}
+	t10, err := starlark.Call(thread, starlark.Universe["tuple"], starlark.Tuple{l_out}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return t10, nil
+}
+
+// Nothing is the translation of the Starlark function nothing at testdata/example.star:41:1.
+func Nothing(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+// unpackBuiltins returns the n elements of x, as for a sequence assignment.
+func unpackBuiltins(x starlark.Value, n int) ([]starlark.Value, error) {
+	iter := starlark.Iterate(x)
+	if iter == nil {
+		return nil, fmt.Errorf("got %s in sequence assignment", x.Type())
+	}
+	defer iter.Done()
+	elems := make([]starlark.Value, 0, n)
+	var elem starlark.Value
+	for iter.Next(&elem) {
+		if len(elems) == n {
+			return nil, fmt.Errorf("too many values to unpack (got %d, want %d)", starlark.Len(x), n)
+		}
+		elems = append(elems, elem)
+	}
+	if iter, ok := iter.(starlark.ErrIterator); ok {
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(elems) < n {
+		return nil, fmt.Errorf("too few values to unpack (got %d, want %d)", len(elems), n)
+	}
+	return elems, nil
+}
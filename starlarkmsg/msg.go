@@ -0,0 +1,278 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkmsg renders the messages of Starlark errors for the
+// authors of Starlark programs, who may not be engineers and may not
+// read English.
+//
+// The interpreter reports static and dynamic errors as English text.
+// Parse classifies the common messages by Code and extracts their
+// variable parts as arguments, so that an application can render them
+// using a template of its own per code, such as a translation:
+//
+//	r := &starlarkmsg.Renderer{Catalogs: map[string]starlarkmsg.Catalog{
+//		"de": {
+//			starlarkmsg.Undefined:      "{0} ist nicht definiert",
+//			starlarkmsg.DivisionByZero: "Division durch Null",
+//		},
+//	}}
+//	if _, err := starlark.ExecFile(thread, filename, src, predeclared); err != nil {
+//		fmt.Fprintln(os.Stderr, r.Render(err, "de-CH"))
+//	}
+//
+// A message that has no code, or whose code has no template in the
+// catalog of the requested language, is rendered in English.
+package starlarkmsg // import "go.starlark.net/starlarkmsg"
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// A Code identifies a kind of error message.
+// The comment of each code lists the arguments of its messages.
+type Code string
+
+// Codes of static errors.
+const (
+	Syntax        Code = "syntax"          // message of the parser
+	Undefined     Code = "undefined"       // name, suggested name or ""
+	Reassign      Code = "reassign"        // kind of binding, name, position of previous binding
+	Unsupported   Code = "unsupported"     // feature not supported by the dialect
+	NotInFunction Code = "not-in-function" // statement
+	NotInLoop     Code = "not-in-loop"     // "break" or "continue"
+)
+
+// Codes of dynamic errors.
+const (
+	Fail              Code = "fail"               // message passed to fail
+	Cancelled         Code = "cancelled"          // reason
+	DivisionByZero    Code = "division-by-zero"   // (none)
+	UnknownBinaryOp   Code = "unknown-binary-op"  // type of left operand, operator, type of right operand
+	UnknownUnaryOp    Code = "unknown-unary-op"   // operator, type of operand
+	NoAttr            Code = "no-attr"            // type, name of attribute
+	IndexOutOfRange   Code = "index-out-of-range" // index, type
+	KeyNotFound       Code = "key-not-found"      // key, type
+	NotIterable       Code = "not-iterable"       // type
+	NotCallable       Code = "not-callable"       // type
+	Unhashable        Code = "unhashable"         // type
+	Frozen            Code = "frozen"             // operation, type
+	ArgumentCount     Code = "argument-count"     // function, number of arguments given, number wanted
+	MissingArgument   Code = "missing-argument"   // function, names of parameters
+	UnexpectedKeyword Code = "unexpected-keyword" // function, name of keyword
+	ArgumentType      Code = "argument-type"      // function, parameter, type given, type wanted
+)
+
+// A Message is a classified error message.
+type Message struct {
+	Code Code            // kind of message, or "" if unclassified
+	Args []string        // variable parts of the message, as documented by Code
+	Pos  syntax.Position // position of the error, if known
+	Text string          // English text of the message, without position
+}
+
+// A pattern recognizes the English text of messages of one code.
+// The submatches of the expression are the arguments of the message,
+// in the order given by args, if non-nil.
+type pattern struct {
+	code Code
+	re   *regexp.Regexp
+	args []int // indices of submatches
+}
+
+// patterns are tried in order against the text of a message; the first
+// match classifies it. A builtin's error may be prefixed by its name.
+var patterns = []pattern{
+	{Undefined, regexp.MustCompile(`^undefined: (\S+?)(?: \(did you mean (\S+)\?\))?$`), nil},
+	{Reassign, regexp.MustCompile(`^cannot reassign (\S+(?: \S+)?) (\S+) declared at (.+)$`), nil},
+	{Unsupported, regexp.MustCompile(`^this Starlark dialect does not support (.+)$`), nil},
+	{NotInFunction, regexp.MustCompile(`^(.+) not within a function$`), nil},
+	{NotInLoop, regexp.MustCompile(`^(break|continue) not in a loop$`), nil},
+
+	{Fail, regexp.MustCompile(`(?s)^fail: (.*)$`), nil},
+	{Cancelled, regexp.MustCompile(`(?s)^Starlark computation cancelled: (.*)$`), nil},
+	{DivisionByZero, regexp.MustCompile(`division by zero$`), nil},
+	{UnknownBinaryOp, regexp.MustCompile(`^unknown binary op: (\S+) (\S+) (\S+)$`), nil},
+	{UnknownUnaryOp, regexp.MustCompile(`^unknown unary op: (\S+) (\S+)$`), nil},
+	{NoAttr, regexp.MustCompile(`^(?:\w+: )?(\S+) has no \.(\w+) field or method$`), nil},
+	{IndexOutOfRange, regexp.MustCompile(`^index (-?\d+) out of range: empty (\S+)$`), nil},
+	{IndexOutOfRange, regexp.MustCompile(`^(\S+) index (-?\d+) out of range`), []int{2, 1}},
+	{KeyNotFound, regexp.MustCompile(`(?s)^key (.+) not in (\w+)$`), nil},
+	{NotIterable, regexp.MustCompile(`^(?:\w+: )?(\S+) value is not iterable$`), nil},
+	{NotCallable, regexp.MustCompile(`^invalid call of non-function \((\S+)\)$`), nil},
+	{Unhashable, regexp.MustCompile(`^(?:\w+: )?unhashable(?: type)?: (\S+)$`), nil},
+	{Frozen, regexp.MustCompile(`^(?:\w+: )?cannot (.+) frozen (\S+)$`), nil},
+	{ArgumentCount, regexp.MustCompile(`^(\S+): got (\d+) arguments?, want (.+)$`), nil},
+	{ArgumentCount, regexp.MustCompile(`^function (\S+) accepts (.+) positional arguments? \((\d+) given\)$`), []int{1, 3, 2}},
+	{ArgumentCount, regexp.MustCompile(`^function (\S+) accepts no arguments \((\d+) given\)$`), nil},
+	{MissingArgument, regexp.MustCompile(`^(\S+): missing argument for (\S+)$`), nil},
+	{MissingArgument, regexp.MustCompile(`^function (\S+) missing \d+ arguments? \((.+)\)$`), nil},
+	{UnexpectedKeyword, regexp.MustCompile(`^(\S+): unexpected keyword argument (\S+)$`), nil},
+	{UnexpectedKeyword, regexp.MustCompile(`^function (\S+) got an unexpected keyword argument "?(\w+)"?$`), nil},
+	{ArgumentType, regexp.MustCompile(`^(\S+): for parameter (\S+): got (\S+), want (.+)$`), nil},
+}
+
+// Classify returns the message of the specified English text.
+// The Pos field of the result is not set.
+func Classify(text string) Message {
+	for _, p := range patterns {
+		sub := p.re.FindStringSubmatch(text)
+		if sub == nil {
+			continue
+		}
+		m := Message{Code: p.code, Text: text}
+		if p.args == nil {
+			m.Args = sub[1:]
+		} else {
+			for _, i := range p.args {
+				m.Args = append(m.Args, sub[i])
+			}
+		}
+		return m
+	}
+	return Message{Text: text}
+}
+
+// Parse returns the messages of an error returned by the parser, the
+// resolver, or the interpreter. A resolve.ErrorList yields a message
+// per error; any other error yields one message, which is unclassified
+// if the error is not a syntax.Error, resolve.Error, or
+// *starlark.EvalError. Parse returns nil for a nil error.
+func Parse(err error) []Message {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case syntax.Error:
+		return []Message{{Code: Syntax, Args: []string{err.Msg}, Pos: err.Pos, Text: err.Msg}}
+	case resolve.Error:
+		m := Classify(err.Msg)
+		m.Pos = err.Pos
+		return []Message{m}
+	case resolve.ErrorList:
+		msgs := make([]Message, len(err))
+		for i, e := range err {
+			msgs[i] = Classify(e.Msg)
+			msgs[i].Pos = e.Pos
+		}
+		return msgs
+	case *starlark.EvalError:
+		m := Classify(err.Msg)
+		m.Pos, _ = err.Span()
+		return []Message{m}
+	default:
+		return []Message{{Text: err.Error()}}
+	}
+}
+
+// A Catalog maps codes to message templates, such as the translations
+// of the messages into one language. In a template, "{i}" stands for
+// the ith argument of the message, counting from zero, and "{{" for a
+// literal brace.
+type Catalog map[Code]string
+
+// Format returns the text of the message according to its template
+// in the catalog. It reports false if the catalog has no template
+// for the message or the template refers to a missing argument.
+func (c Catalog) Format(m Message) (string, bool) {
+	tmpl, ok := c[m.Code]
+	if !ok || m.Code == "" {
+		return "", false
+	}
+	var buf strings.Builder
+	for {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			buf.WriteString(tmpl)
+			break
+		}
+		buf.WriteString(tmpl[:i])
+		tmpl = tmpl[i+1:]
+		if strings.HasPrefix(tmpl, "{") {
+			buf.WriteByte('{')
+			tmpl = tmpl[1:]
+			continue
+		}
+		j := strings.IndexByte(tmpl, '}')
+		if j < 0 {
+			return "", false
+		}
+		n, err := strconv.Atoi(tmpl[:j])
+		if err != nil || n < 0 || n >= len(m.Args) {
+			return "", false
+		}
+		buf.WriteString(m.Args[n])
+		tmpl = tmpl[j+1:]
+	}
+	return buf.String(), true
+}
+
+// A Renderer renders error messages using a catalog per language.
+type Renderer struct {
+	// Catalogs maps a language tag, such as "pt" or "pt-BR",
+	// to the catalog of that language.
+	Catalogs map[string]Catalog
+
+	// Text, if non-nil, is called to render each message in place of
+	// the catalogs, allowing the application complete control. The
+	// result of the catalogs is passed to it as the default text.
+	Text func(m Message, lang, text string) string
+}
+
+// Message returns the text of the message in the specified language.
+// The catalog of the language tag is consulted first, then that of
+// its primary language, such as "pt" for "pt-BR"; if neither has a
+// template for the message, its English text is returned.
+func (r *Renderer) Message(m Message, lang string) string {
+	text := r.format(m, lang)
+	if r.Text != nil {
+		text = r.Text(m, lang, text)
+	}
+	return text
+}
+
+func (r *Renderer) format(m Message, lang string) string {
+	for lang != "" {
+		if text, ok := r.Catalogs[lang].Format(m); ok {
+			return text
+		}
+		i := strings.LastIndexByte(lang, '-')
+		if i < 0 {
+			break
+		}
+		lang = lang[:i]
+	}
+	return m.Text
+}
+
+// Render returns the messages of the error in the specified language,
+// one per line, each preceded by its position, if known.
+// For an *starlark.EvalError, see also Backtrace.
+func (r *Renderer) Render(err error, lang string) string {
+	var buf strings.Builder
+	for i, m := range Parse(err) {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		if m.Pos.IsValid() {
+			buf.WriteString(m.Pos.String())
+			buf.WriteString(": ")
+		}
+		buf.WriteString(r.Message(m, lang))
+	}
+	return buf.String()
+}
+
+// Backtrace is like the Backtrace method of the error,
+// but renders its message in the specified language.
+func (r *Renderer) Backtrace(err *starlark.EvalError, lang string) string {
+	m := Classify(err.Msg)
+	localized := *err
+	localized.Msg = r.Message(m, lang)
+	return localized.Backtrace()
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkmsg_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkmsg"
+)
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		src  string
+		code starlarkmsg.Code
+		args []string
+	}{
+		{"x = y", starlarkmsg.Undefined, []string{"y", ""}},
+		{"length = 1\nx = lenght", starlarkmsg.Undefined, []string{"lenght", "length"}},
+		{"break", starlarkmsg.NotInLoop, []string{"break"}},
+		{"x = 1 // 0", starlarkmsg.DivisionByZero, []string{}},
+		{"x = 1 + 'a'", starlarkmsg.UnknownBinaryOp, []string{"int", "+", "string"}},
+		{"x = [1][3]", starlarkmsg.IndexOutOfRange, []string{"3", "list"}},
+		{"x = {}['k']", starlarkmsg.KeyNotFound, []string{`"k"`, "dict"}},
+		{"x = (1).f", starlarkmsg.NoAttr, []string{"int", "f"}},
+		{"x = [y for y in 1]", starlarkmsg.NotIterable, []string{"int"}},
+		{"x = 1()", starlarkmsg.NotCallable, []string{"int"}},
+		{"x = {[]: 1}", starlarkmsg.Unhashable, []string{"list"}},
+		{"len()", starlarkmsg.ArgumentCount, []string{"len", "0", "1"}},
+		{"def f(a): pass\nf()", starlarkmsg.MissingArgument, []string{"f", "a"}},
+		{"def f(): pass\nf(1)", starlarkmsg.ArgumentCount, []string{"f", "1"}},
+		{"def f(a): pass\nf(a=1, k=1)", starlarkmsg.UnexpectedKeyword, []string{"f", "k"}},
+		{"'a'.join(1)", starlarkmsg.ArgumentType, []string{"join", "1", "int", "iterable"}},
+		{"fail('oops', 1)", starlarkmsg.Fail, []string{"oops 1"}},
+		{"x = (", starlarkmsg.Syntax, []string{"got end of file, want primary expression"}},
+		{"x = 'unclassified'.f(", starlarkmsg.Syntax, nil},
+	} {
+		thread := new(starlark.Thread)
+		_, err := starlark.ExecFile(thread, "test.star", test.src, starlark.Universe)
+		msgs := starlarkmsg.Parse(err)
+		if len(msgs) != 1 {
+			t.Errorf("%q: got %d messages (%v), want 1", test.src, len(msgs), err)
+			continue
+		}
+		m := msgs[0]
+		if m.Code != test.code || test.args != nil && !reflect.DeepEqual(append([]string{}, m.Args...), test.args) {
+			t.Errorf("%q: got %s %q, want %s %q (error: %v)", test.src, m.Code, m.Args, test.code, test.args, err)
+		}
+		if !m.Pos.IsValid() {
+			t.Errorf("%q: message has no position", test.src)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	r := &starlarkmsg.Renderer{Catalogs: map[string]starlarkmsg.Catalog{
+		"de": {
+			starlarkmsg.Undefined:      "{0} ist nicht definiert",
+			starlarkmsg.DivisionByZero: "Division durch Null",
+			starlarkmsg.NotIterable:    "Wert vom Typ {3} ist nicht iterierbar", // bad index
+		},
+		"de-CH": {
+			starlarkmsg.Undefined: "{0} isch nöd definiert",
+		},
+	}}
+
+	_, err := starlark.ExecFile(new(starlark.Thread), "a.star", "x = y\nz = w", nil)
+	for _, test := range []struct{ lang, want string }{
+		{"de", "a.star:1:5: y ist nicht definiert\na.star:2:5: w ist nicht definiert"},
+		{"de-CH", "a.star:1:5: y isch nöd definiert\na.star:2:5: w isch nöd definiert"},
+		{"fr", "a.star:1:5: undefined: y\na.star:2:5: undefined: w"},
+		{"", "a.star:1:5: undefined: y\na.star:2:5: undefined: w"},
+	} {
+		if got := r.Render(err, test.lang); got != test.want {
+			t.Errorf("Render(%s) = %q, want %q", test.lang, got, test.want)
+		}
+	}
+
+	// Dynamic errors; the Swiss catalog falls back to German.
+	_, err = starlark.ExecFile(new(starlark.Thread), "b.star", "def f(): return 1 // 0\nf()", nil)
+	if got, want := r.Render(err, "de-CH"), "b.star:1:19: Division durch Null"; got != want {
+		t.Errorf("Render = %q, want %q", got, want)
+	}
+	bt := r.Backtrace(err.(*starlark.EvalError), "de")
+	if !strings.HasPrefix(bt, "Traceback") || !strings.HasSuffix(bt, "Error: Division durch Null") {
+		t.Errorf("Backtrace = %q", bt)
+	}
+
+	// A template with a bad argument index is ignored.
+	_, err = starlark.ExecFile(new(starlark.Thread), "c.star", "x = [y for y in 1]", nil)
+	if got, want := r.Render(err, "de"), "c.star:1:8: int value is not iterable"; got != want {
+		t.Errorf("Render = %q, want %q", got, want)
+	}
+
+	// The Text hook has the last word.
+	r.Text = func(m starlarkmsg.Message, lang, text string) string {
+		return "[" + string(m.Code) + "] " + text
+	}
+	if got, want := r.Render(err, "de"), "c.star:1:8: [not-iterable] int value is not iterable"; got != want {
+		t.Errorf("Render = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkstruct
+
+// This file defines the schema-numbered binary encoding of structs.
+//
+// Each value is encoded as a tag byte followed by a payload:
+//
+//	None		tagNone
+//	False, True	tagFalse, tagTrue
+//	int		tagInt varint, if it fits in int64, else
+//			tagBigInt sign:byte len:uvarint magnitude:[len]byte (big-endian)
+//	float		tagFloat bits:[8]byte (little-endian IEEE 754)
+//	string		tagString len:uvarint [len]byte
+//	bytes		tagBytes len:uvarint [len]byte
+//	list, tuple	tagList/tagTuple n:uvarint [n]value
+//	dict		tagDict n:uvarint [n](key:value value:value), ordered by key encoding
+//	set		tagSet n:uvarint [n]value, ordered by encoding
+//	struct		tagStruct n:uvarint [n](number:uvarint value:value), ordered by number
+//
+// Dicts and sets are ordered by the encodings of their elements, so that
+// values that compare equal have the same encoding regardless of the
+// order of insertion. A struct's constructor is not encoded; as in a
+// protocol buffer, the meaning of each field number is established by
+// the schema.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"go.starlark.net/starlark"
+)
+
+// A Schema is a struct constructor that assigns a stable number to
+// each field name, for use by EncodeBinary. Numbers must be distinct,
+// and should not be reused when fields are removed, so that encodings
+// remain comparable across versions of the schema.
+type Schema interface {
+	starlark.Value
+
+	// FieldNumber returns the number of the named field,
+	// or false if the schema has no such field.
+	FieldNumber(name string) (uint64, bool)
+}
+
+const (
+	tagNone = iota
+	tagFalse
+	tagTrue
+	tagInt
+	tagBigInt
+	tagFloat
+	tagString
+	tagBytes
+	tagList
+	tagTuple
+	tagDict
+	tagSet
+	tagStruct
+)
+
+// EncodeBinary returns a compact, deterministic binary encoding of the
+// struct s, whose constructor must implement Schema. Two structs whose
+// fields are equal values of the same types have the same encoding,
+// making it suitable as a key for hashing and caching of values across
+// executions.
+//
+// The fields of s may be None, bool, int, float, string, bytes, list,
+// tuple, dict, set, or a struct whose constructor is itself a Schema,
+// recursively. Encoding any other value, or a struct with a field
+// unknown to its schema, yields an error.
+func EncodeBinary(s *Struct) ([]byte, error) {
+	var e encoder
+	if err := e.encodeStruct(s); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uvarint(x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+}
+
+func (e *encoder) varint(x int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, tmp[:binary.PutVarint(tmp[:], x)]...)
+}
+
+func (e *encoder) bytes(b string) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) encodeStruct(s *Struct) error {
+	schema, ok := s.constructor.(Schema)
+	if !ok {
+		return fmt.Errorf("cannot encode struct: constructor %s is not a schema", s.constructorName())
+	}
+	type field struct {
+		number uint64
+		value  starlark.Value
+	}
+	entries := s.all()
+	fields := make([]field, len(entries))
+	for i, ent := range entries {
+		num, ok := schema.FieldNumber(ent.name)
+		if !ok {
+			return fmt.Errorf("cannot encode struct: %s has no field %s", s.constructorName(), ent.name)
+		}
+		fields[i] = field{num, ent.value}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].number < fields[j].number })
+
+	e.buf = append(e.buf, tagStruct)
+	e.uvarint(uint64(len(fields)))
+	for i, f := range fields {
+		if i > 0 && f.number == fields[i-1].number {
+			return fmt.Errorf("cannot encode struct: %s assigns number %d to more than one field", s.constructorName(), f.number)
+		}
+		e.uvarint(f.number)
+		if err := e.encode(f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encode(v starlark.Value) error {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		e.buf = append(e.buf, tagNone)
+	case starlark.Bool:
+		if v {
+			e.buf = append(e.buf, tagTrue)
+		} else {
+			e.buf = append(e.buf, tagFalse)
+		}
+	case starlark.Int:
+		if x, ok := v.Int64(); ok {
+			e.buf = append(e.buf, tagInt)
+			e.varint(x)
+		} else {
+			e.buf = append(e.buf, tagBigInt)
+			b := v.BigInt()
+			e.buf = append(e.buf, byte(b.Sign()+1))
+			e.bytes(string(b.Bytes()))
+		}
+	case starlark.Float:
+		e.buf = append(e.buf, tagFloat)
+		var tmp [8]byte
+		binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(float64(v)))
+		e.buf = append(e.buf, tmp[:]...)
+	case starlark.String:
+		e.buf = append(e.buf, tagString)
+		e.bytes(string(v))
+	case starlark.Bytes:
+		e.buf = append(e.buf, tagBytes)
+		e.bytes(string(v))
+	case *starlark.List:
+		e.buf = append(e.buf, tagList)
+		e.uvarint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case starlark.Tuple:
+		e.buf = append(e.buf, tagTuple)
+		e.uvarint(uint64(len(v)))
+		for _, x := range v {
+			if err := e.encode(x); err != nil {
+				return err
+			}
+		}
+	case *starlark.Dict:
+		items := v.Items()
+		elems := make([][]byte, len(items))
+		for i, item := range items {
+			var sub encoder
+			if err := sub.encode(item[0]); err != nil {
+				return err
+			}
+			if err := sub.encode(item[1]); err != nil {
+				return err
+			}
+			elems[i] = sub.buf
+		}
+		e.sorted(tagDict, elems)
+	case *starlark.Set:
+		var elems [][]byte
+		iter := v.Iterate()
+		defer iter.Done()
+		var x starlark.Value
+		for iter.Next(&x) {
+			var sub encoder
+			if err := sub.encode(x); err != nil {
+				return err
+			}
+			elems = append(elems, sub.buf)
+		}
+		e.sorted(tagSet, elems)
+	case *Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("cannot encode %s", v.Type())
+	}
+	return nil
+}
+
+// sorted appends the tag, the number of elements,
+// and the encoded elements in increasing order.
+func (e *encoder) sorted(tag byte, elems [][]byte) {
+	sort.Slice(elems, func(i, j int) bool { return bytes.Compare(elems[i], elems[j]) < 0 })
+	e.buf = append(e.buf, tag)
+	e.uvarint(uint64(len(elems)))
+	for _, elem := range elems {
+		e.buf = append(e.buf, elem...)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkstruct
+
+// This file defines structs that may be called.
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// CallField is the name of the field that makes a struct callable.
+const CallField = "__call__"
+
+// A CallableStruct is a struct with a callable __call__ field.
+// Calling the struct calls the value of that field with the same
+// arguments; as with any other field, the struct is not passed to it.
+// Together with closures, this allows a script to define lightweight
+// objects, such as configuration builders, without new Go types:
+//
+//	def counter():
+//	    state = {"n": 0}
+//	    def incr():
+//	        state["n"] += 1
+//	        return state["n"]
+//	    return callable_struct(__call__ = incr, value = lambda: state["n"])
+//
+// A CallableStruct behaves in all other respects like the struct it
+// embeds. It is created only by NewCallable and MakeCallable; a
+// __call__ field does not make an ordinary struct callable. The sum
+// of a callable struct and another struct, and a struct that extends
+// a callable one, are callable if their __call__ field is.
+type CallableStruct struct {
+	*Struct
+}
+
+var (
+	_ starlark.Callable  = (*CallableStruct)(nil)
+	_ starlark.HasBinary = (*CallableStruct)(nil)
+)
+
+// MakeCallable is the implementation of a built-in function that
+// instantiates a callable struct from the specified keyword arguments,
+// which must include a callable __call__ field.
+//
+//	globals := starlark.StringDict{
+//		"callable_struct": starlark.NewBuiltin("callable_struct", starlarkstruct.MakeCallable),
+//	}
+func MakeCallable(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%s: unexpected positional arguments", b.Name())
+	}
+	c, err := NewCallable(FromKeywords(Default, kwargs))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return c, nil
+}
+
+// NewCallable returns a callable struct of the same constructor and
+// fields as s. It fails if s has no callable __call__ field.
+func NewCallable(s *Struct) (*CallableStruct, error) {
+	fn, ok := s.field(CallField)
+	if !ok {
+		return nil, fmt.Errorf("struct has no .%s field", CallField)
+	}
+	if _, ok := fn.(starlark.Callable); !ok {
+		return nil, fmt.Errorf("struct field .%s is not callable: %s", CallField, fn.Type())
+	}
+	return &CallableStruct{s}, nil
+}
+
+// callableIfPossible returns a CallableStruct for s if it has
+// a callable __call__ field, or s itself otherwise.
+func callableIfPossible(s *Struct) starlark.Value {
+	if c, err := NewCallable(s); err == nil {
+		return c
+	}
+	return s
+}
+
+// asStruct returns the struct underlying v, if any.
+func asStruct(v starlark.Value) (*Struct, bool) {
+	switch v := v.(type) {
+	case *Struct:
+		return v, true
+	case *CallableStruct:
+		return v.Struct, true
+	}
+	return nil, false
+}
+
+// Name returns the name of the function in the __call__ field.
+func (c *CallableStruct) Name() string {
+	fn, _ := c.field(CallField)
+	return fn.(starlark.Callable).Name()
+}
+
+func (c *CallableStruct) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if y, ok := asStruct(y); ok && op == syntax.PLUS {
+		x := c.Struct
+		if side == starlark.Right {
+			x, y = y, x
+		}
+		s, err := add(x, y)
+		if err != nil {
+			return nil, err
+		}
+		return callableIfPossible(s), nil
+	}
+	return nil, nil // unhandled
+}
+
+func (c *CallableStruct) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	fn, _ := c.field(CallField)
+	return starlark.Call(thread, fn, args, kwargs)
+}
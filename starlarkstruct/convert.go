@@ -0,0 +1,62 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkstruct
+
+// This file defines the to_dict and to_json methods of structs.
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// EncodeJSON is the function used by the to_json method of structs to
+// encode a struct as JSON. It is set by the go.starlark.net/lib/json
+// package, which this package cannot import; an application whose
+// scripts call to_json must link that package, if only for its side
+// effect, or set EncodeJSON itself:
+//
+//	import _ "go.starlark.net/lib/json"
+//
+// If EncodeJSON is nil, to_json fails with an error that says so.
+var EncodeJSON func(v starlark.Value) (string, error)
+
+// struct_to_dict implements the to_dict method of a struct:
+//
+//	s.to_dict()
+//
+// It returns a new dict of the struct's fields, in name order.
+// Nested structs are not converted.
+func struct_to_dict(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	s := b.Receiver().(*Struct)
+	entries := s.all()
+	d := starlark.NewDict(len(entries))
+	for _, e := range entries {
+		d.SetKey(starlark.String(e.name), e.value) // can't fail
+	}
+	return d, nil
+}
+
+// struct_to_json implements the to_json method of a struct:
+//
+//	s.to_json()
+//
+// It returns the JSON encoding of the struct, as by json.encode(s).
+func struct_to_json(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	if EncodeJSON == nil {
+		return nil, fmt.Errorf("%s: no JSON encoder: the application must import go.starlark.net/lib/json or set starlarkstruct.EncodeJSON", b.Name())
+	}
+	data, err := EncodeJSON(b.Receiver())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.String(data), nil
+}
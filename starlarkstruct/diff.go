@@ -0,0 +1,178 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkstruct
+
+// This file defines the structural diff and patch of structs.
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// A ChangeKind is the kind of a Change.
+type ChangeKind uint8
+
+const (
+	Added   ChangeKind = iota // the field is present only in the new struct
+	Removed                   // the field is present only in the old struct
+	Changed                   // the field has different values in the two structs
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Changed:
+		return "changed"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", k)
+}
+
+// A Change describes a difference in a single field of two structs.
+type Change struct {
+	Kind ChangeKind
+	Path []string       // field names from the outermost struct to the field
+	Old  starlark.Value // value in the old struct; nil if Added
+	New  starlark.Value // value in the new struct; nil if Removed
+}
+
+// String returns the change in the form "+ a.b = new",
+// "- a.b = old", or "~ a.b: old -> new".
+func (c Change) String() string {
+	path := strings.Join(c.Path, ".")
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("+ %s = %s", path, c.New)
+	case Removed:
+		return fmt.Sprintf("- %s = %s", path, c.Old)
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", path, c.Old, c.New)
+	}
+}
+
+// Diff returns the changes that transform struct a into struct b, in
+// order of field path. Fields whose values in a and b are both structs
+// with equal constructors are compared recursively; other values are
+// compared for equality as if by ==, and reported as a single change.
+// Diff fails if the comparison of any values fails.
+func Diff(a, b *Struct) ([]Change, error) {
+	var changes []Change
+	if err := diff(nil, a, b, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func diff(path []string, a, b *Struct, changes *[]Change) error {
+	at := func(name string) []string {
+		return append(path[:len(path):len(path)], name)
+	}
+	// Merge the sorted entries.
+	ae, be := a.all(), b.all()
+	i, j := 0, 0
+	for i < len(ae) || j < len(be) {
+		switch {
+		case j == len(be) || i < len(ae) && ae[i].name < be[j].name:
+			e := ae[i]
+			*changes = append(*changes, Change{Kind: Removed, Path: at(e.name), Old: e.value})
+			i++
+		case i == len(ae) || be[j].name < ae[i].name:
+			e := be[j]
+			*changes = append(*changes, Change{Kind: Added, Path: at(e.name), New: e.value})
+			j++
+		default:
+			x, y := ae[i].value, be[j].value
+			name := ae[i].name
+			i++
+			j++
+			if xs, ok := asStruct(x); ok {
+				if ys, ok := asStruct(y); ok {
+					if eq, err := starlark.Equal(xs.constructor, ys.constructor); err != nil {
+						return err
+					} else if eq {
+						if err := diff(at(name), xs, ys, changes); err != nil {
+							return err
+						}
+						continue
+					}
+				}
+			}
+			if eq, err := starlark.Equal(x, y); err != nil {
+				return fmt.Errorf("comparing .%s: %v", strings.Join(at(name), "."), err)
+			} else if !eq {
+				*changes = append(*changes, Change{Kind: Changed, Path: at(name), Old: x, New: y})
+			}
+		}
+	}
+	return nil
+}
+
+// Apply returns a new struct that is the result of applying the changes
+// to struct s, which is not modified. Each change's path must lead
+// through fields of s whose values are structs. Apply fails if a change
+// does not apply: if the field of an Added change is present, or if the
+// field of a Removed or Changed change is absent or its value is not
+// equal to Old.
+func Apply(s *Struct, changes []Change) (*Struct, error) {
+	for _, c := range changes {
+		if len(c.Path) == 0 {
+			return nil, fmt.Errorf("invalid change %v: empty path", c)
+		}
+		var err error
+		s, err = apply(s, c, c.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// apply returns a copy of s with change c applied to the field at path,
+// which is relative to s.
+func apply(s *Struct, c Change, path []string) (*Struct, error) {
+	name := path[0]
+	old, found := s.field(name)
+	fields := make(starlark.StringDict, s.len()+1)
+	s.ToStringDict(fields)
+
+	if len(path) > 1 {
+		sub, ok := asStruct(old)
+		if !ok {
+			return nil, fmt.Errorf("change %v does not apply: .%s is not a struct",
+				c, strings.Join(c.Path[:len(c.Path)-len(path)+1], "."))
+		}
+		sub, err := apply(sub, c, path[1:])
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = sub
+		return NewFromStringDict(s.constructor, fields)
+	}
+
+	if c.Kind == Added {
+		if found {
+			return nil, fmt.Errorf("change %v does not apply: field is present", c)
+		}
+	} else {
+		if !found {
+			return nil, fmt.Errorf("change %v does not apply: field is absent", c)
+		}
+		if eq, err := starlark.Equal(old, c.Old); err != nil {
+			return nil, err
+		} else if !eq {
+			return nil, fmt.Errorf("change %v does not apply: field has value %s", c, old)
+		}
+	}
+	if c.Kind == Removed {
+		delete(fields, name)
+	} else {
+		fields[name] = c.New
+	}
+	return NewFromStringDict(s.constructor, fields)
+}
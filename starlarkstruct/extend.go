@@ -0,0 +1,106 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkstruct
+
+// This file defines prototype-based composition of structs.
+
+import (
+	"fmt"
+	"sort"
+
+	"go.starlark.net/starlark"
+)
+
+// NewExtended returns a new struct with the same constructor as base,
+// whose fields are those of base overridden or supplemented by the
+// key/value pairs in kwargs. (Each kwargs[i][0] must be a
+// starlark.String.)
+//
+// The new struct does not copy the fields of base but delegates to it
+// any field it does not define itself, so the cost of a layer of
+// overrides is proportional to the number of overrides, not to the
+// width of base. Operations on the struct as a whole, such as String,
+// ==, and +, see the combined fields, as if the struct had been
+// constructed directly.
+//
+// NewExtended returns an error if the constructor is a Validator that
+// rejects the new struct.
+func NewExtended(base *Struct, kwargs []starlark.Tuple) (*Struct, error) {
+	s := &Struct{
+		constructor: base.constructor,
+		entries:     make(entries, 0, len(kwargs)),
+		proto:       base,
+	}
+	for _, kwarg := range kwargs {
+		k := string(kwarg[0].(starlark.String))
+		s.entries = append(s.entries, entry{k, kwarg[1]})
+	}
+	sort.Sort(s.entries)
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Extend is the implementation of a built-in function that returns
+// a new struct that extends the specified one, as if by NewExtended.
+//
+//	base = struct(host = "localhost", port = 80, ...)
+//	dev = extend(base, port = 8080)
+func Extend(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var base starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, nil, 1, &base); err != nil {
+		return nil, err
+	}
+	s, ok := asStruct(base)
+	if !ok {
+		return nil, fmt.Errorf("%s: got %s, want struct", b.Name(), base.Type())
+	}
+	s, err := NewExtended(s, kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	if _, ok := base.(*CallableStruct); ok {
+		return callableIfPossible(s), nil
+	}
+	return s, nil
+}
+
+// StructFunc is a 'struct' built-in function equivalent to
+// starlark.NewBuiltin("struct", Make) that additionally has an
+// 'extend' method, the Extend function, allowing a script to call
+// struct.extend(base, **overrides):
+//
+//	globals := starlark.StringDict{
+//		"struct": starlarkstruct.StructFunc,
+//	}
+var StructFunc starlark.Callable = structFunc{}
+
+type structFunc struct{}
+
+var (
+	_ starlark.HasAttrs = structFunc{}
+
+	extendMethod = starlark.NewBuiltin("struct.extend", Extend)
+)
+
+func (structFunc) Name() string          { return "struct" }
+func (structFunc) String() string        { return "<built-in function struct>" }
+func (structFunc) Type() string          { return "builtin_function_or_method" }
+func (structFunc) Freeze()               {}
+func (structFunc) Truth() starlark.Bool  { return true }
+func (structFunc) Hash() (uint32, error) { return starlark.String("struct").Hash() }
+func (structFunc) AttrNames() []string   { return []string{"extend"} }
+
+func (structFunc) Attr(name string) (starlark.Value, error) {
+	if name == "extend" {
+		return extendMethod, nil
+	}
+	return nil, nil
+}
+
+func (structFunc) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return Make(thread, nil, args, kwargs)
+}
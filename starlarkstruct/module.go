@@ -11,20 +11,57 @@ import (
 //
 // It differs from Struct primarily in that its string representation
 // does not enumerate its fields.
+//
+// If Fallback is non-nil, it is called to obtain the value of any
+// attribute that is not among Members, allowing a module to provide
+// lazily computed members, such as wrappers generated on demand for a
+// large set of rules, without materializing them all. It should return
+// (nil, nil) if there is no such attribute. The names it provides do
+// not appear among the module's AttrNames.
 type Module struct {
-	Name    string
-	Members starlark.StringDict
+	Name     string
+	Members  starlark.StringDict
+	Fallback AttrFallback
 }
 
-var _ starlark.HasAttrs = (*Module)(nil)
+// An AttrFallback computes the value of an attribute that is missing
+// from a Module or Struct. It returns (nil, nil) if the attribute does
+// not exist. It may be called concurrently by several threads.
+type AttrFallback func(name string) (starlark.Value, error)
+
+var (
+	_ starlark.HasAttrs        = (*Module)(nil)
+	_ starlark.FreezeCheckable = (*Module)(nil)
+)
+
+func (m *Module) AttrNames() []string   { return m.Members.Keys() }
+func (m *Module) Freeze()               { m.Members.Freeze() }
+func (m *Module) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", m.Type()) }
+func (m *Module) String() string        { return fmt.Sprintf("<module %q>", m.Name) }
+func (m *Module) Truth() starlark.Bool  { return true }
+func (m *Module) Type() string          { return "module" }
 
-func (m *Module) Attr(name string) (starlark.Value, error) { return m.Members[name], nil }
-func (m *Module) AttrNames() []string                      { return m.Members.Keys() }
-func (m *Module) Freeze()                                  { m.Members.Freeze() }
-func (m *Module) Hash() (uint32, error)                    { return 0, fmt.Errorf("unhashable: %s", m.Type()) }
-func (m *Module) String() string                           { return fmt.Sprintf("<module %q>", m.Name) }
-func (m *Module) Truth() starlark.Bool                     { return true }
-func (m *Module) Type() string                             { return "module" }
+// Attr returns the named member of the module,
+// or the value provided by its Fallback function.
+func (m *Module) Attr(name string) (starlark.Value, error) {
+	if v, ok := m.Members[name]; ok {
+		return v, nil
+	}
+	if m.Fallback != nil {
+		return m.Fallback(name)
+	}
+	return nil, nil
+}
+
+// Frozen reports true: a module is immutable, though its members may not be.
+func (m *Module) Frozen() bool { return true }
+
+// Referents calls visit for each member of the module, in name order.
+func (m *Module) Referents(visit func(path string, v starlark.Value)) {
+	for _, name := range m.Members.Keys() {
+		visit("."+name, m.Members[name])
+	}
+}
 
 // MakeModule may be used as the implementation of a Starlark built-in
 // function, module(name, **kwargs). It returns a new module with the
@@ -39,5 +76,5 @@ func MakeModule(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tupl
 		k := string(kwarg[0].(starlark.String))
 		members[k] = kwarg[1]
 	}
-	return &Module{name, members}, nil
+	return &Module{Name: name, Members: members}, nil
 }
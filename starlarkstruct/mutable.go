@@ -0,0 +1,181 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkstruct
+
+// This file defines MutableStruct, a struct whose fields
+// may be assigned until it is frozen.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// MakeMutable is the implementation of a built-in function that
+// instantiates a mutable struct from the specified keyword arguments.
+//
+//	globals := starlark.StringDict{
+//		"mutable_struct": starlark.NewBuiltin("mutable_struct", starlarkstruct.MakeMutable),
+//	}
+func MakeMutable(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%s: unexpected positional arguments", b.Name())
+	}
+	return MutableFromKeywords(Default, kwargs), nil
+}
+
+// MutableFromKeywords returns a new mutable struct whose fields are
+// specified by the key/value pairs in kwargs. (Each kwargs[i][0] must be
+// a starlark.String.)
+func MutableFromKeywords(constructor starlark.Value, kwargs []starlark.Tuple) *MutableStruct {
+	if constructor == nil {
+		panic("nil constructor")
+	}
+	s := &MutableStruct{constructor: constructor}
+	for _, kwarg := range kwargs {
+		s.fields.Insert(string(kwarg[0].(starlark.String)), kwarg[1]) // can't fail
+	}
+	return s
+}
+
+// MutableFromStringDict returns a new mutable struct whose fields are
+// those of d.
+func MutableFromStringDict(constructor starlark.Value, d starlark.StringDict) *MutableStruct {
+	if constructor == nil {
+		panic("nil constructor")
+	}
+	s := &MutableStruct{constructor: constructor}
+	for _, k := range d.Keys() {
+		s.fields.Insert(k, d[k]) // can't fail
+	}
+	return s
+}
+
+// A MutableStruct is like a Struct, but the values of its fields may
+// be reassigned (s.f = x) until it is frozen, as in Bazel before the
+// analysis phase. Its set of fields is fixed at construction, so that
+// the assignment of a misspelled field is an error.
+//
+// Unlike a Struct, a MutableStruct is not hashable, and it supports
+// only the == and != operators. Its type is "mutable_struct".
+type MutableStruct struct {
+	constructor starlark.Value
+	fields      starlark.StringHashtable
+}
+
+var (
+	_ starlark.HasSetField     = (*MutableStruct)(nil)
+	_ starlark.Comparable      = (*MutableStruct)(nil)
+	_ starlark.FreezeCheckable = (*MutableStruct)(nil)
+)
+
+// Constructor returns the constructor used to create this struct.
+func (s *MutableStruct) Constructor() starlark.Value { return s.constructor }
+
+func (s *MutableStruct) Type() string         { return "mutable_struct" }
+func (s *MutableStruct) Truth() starlark.Bool { return true }
+func (s *MutableStruct) Freeze()              { s.fields.Freeze() }
+func (s *MutableStruct) Frozen() bool         { return s.fields.Frozen() }
+
+func (s *MutableStruct) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", s.Type())
+}
+
+func (s *MutableStruct) String() string {
+	buf := new(strings.Builder)
+	buf.WriteString(constructorName(s.constructor))
+	buf.WriteByte('(')
+	for i, name := range s.AttrNames() {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		v, _ := s.fields.Lookup(name)
+		buf.WriteString(name)
+		buf.WriteString(" = ")
+		buf.WriteString(starlark.Repr(v))
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// Attr returns the value of the specified field.
+func (s *MutableStruct) Attr(name string) (starlark.Value, error) {
+	v, _ := s.fields.Lookup(name)
+	return v, nil
+}
+
+// AttrNames returns a new sorted list of the struct fields.
+func (s *MutableStruct) AttrNames() []string {
+	names := s.fields.Keys()
+	sort.Strings(names)
+	return names
+}
+
+// SetField sets the value of an existing field.
+// It fails if the struct is frozen.
+func (s *MutableStruct) SetField(name string, v starlark.Value) error {
+	if _, ok := s.fields.Lookup(name); !ok {
+		return starlark.NoSuchAttrError(fmt.Sprintf("%s has no .%s field", s.Type(), name))
+	}
+	if s.fields.Frozen() {
+		return fmt.Errorf("cannot set .%s field of frozen %s", name, s.Type())
+	}
+	return s.fields.Insert(name, v)
+}
+
+// ToStringDict adds a name/value entry to d for each field of the struct.
+func (s *MutableStruct) ToStringDict(d starlark.StringDict) {
+	s.fields.Iterate(func(k string, v starlark.Value) bool {
+		d[k] = v
+		return true
+	})
+}
+
+// Referents calls visit for each field of the struct, in name order.
+func (s *MutableStruct) Referents(visit func(path string, v starlark.Value)) {
+	for _, name := range s.AttrNames() {
+		v, _ := s.fields.Lookup(name)
+		visit("."+name, v)
+	}
+}
+
+func (x *MutableStruct) CompareSameType(op syntax.Token, y_ starlark.Value, depth int) (bool, error) {
+	y := y_.(*MutableStruct)
+	switch op {
+	case syntax.EQL:
+		return mutableStructsEqual(x, y, depth)
+	case syntax.NEQ:
+		eq, err := mutableStructsEqual(x, y, depth)
+		return !eq, err
+	default:
+		return false, fmt.Errorf("%s %s %s not implemented", x.Type(), op, y.Type())
+	}
+}
+
+func mutableStructsEqual(x, y *MutableStruct, depth int) (bool, error) {
+	if x.fields.Len() != y.fields.Len() {
+		return false, nil
+	}
+	if eq, err := starlark.Equal(x.constructor, y.constructor); err != nil {
+		return false, fmt.Errorf("error comparing struct constructors %v and %v: %v",
+			x.constructor, y.constructor, err)
+	} else if !eq {
+		return false, nil
+	}
+	for _, name := range x.fields.Keys() {
+		xv, _ := x.fields.Lookup(name)
+		yv, ok := y.fields.Lookup(name)
+		if !ok {
+			return false, nil
+		}
+		if eq, err := starlark.EqualDepth(xv, yv, depth-1); err != nil || !eq {
+			return eq, err
+		}
+	}
+	return true, nil
+}
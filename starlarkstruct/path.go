@@ -0,0 +1,154 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkstruct
+
+// This file defines path-based access to nested values.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// A pathStep is one step of a parsed path: a field or key
+// name, or an index.
+type pathStep struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// parsePath parses a path such as `a.b[2].c` or `a["k"][-1]`.
+func parsePath(path string) ([]pathStep, error) {
+	var steps []pathStep
+	rest := path
+	for first := true; rest != ""; first = false {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unclosed '['", path)
+			}
+			sub := rest[1:end]
+			rest = rest[end+1:]
+			if strings.HasPrefix(sub, `"`) {
+				name, err := strconv.Unquote(sub)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path %q: bad key %s", path, sub)
+				}
+				steps = append(steps, pathStep{name: name})
+			} else {
+				i, err := strconv.Atoi(sub)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path %q: bad index [%s]", path, sub)
+				}
+				steps = append(steps, pathStep{index: i, isIndex: true})
+			}
+		case first || rest[0] == '.':
+			if !first {
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path %q: empty field name", path)
+			}
+			steps = append(steps, pathStep{name: rest[:end]})
+			rest = rest[end:]
+		default:
+			return nil, fmt.Errorf("invalid path %q: unexpected %q", path, rest[0])
+		}
+	}
+	if steps == nil {
+		return nil, fmt.Errorf("empty path")
+	}
+	return steps, nil
+}
+
+// GetPath returns the value reached from x by following a path of
+// field names and indices, such as `a.b[2].c`. A name selects a field
+// of a value with attributes, such as a struct, or a string key of a
+// mapping, such as a dict; a quoted name in brackets (`["a.b"]`)
+// does the same for names that are not identifiers. An integer in
+// brackets selects an element of an indexable value, such as a list,
+// counting from the end if negative.
+//
+// If any step of the path cannot be followed, because the value has
+// no such field, key, or index, or because it is None or of another
+// type, GetPath returns false. It returns an error only if the path
+// is malformed or a lookup fails for some other reason.
+func GetPath(x starlark.Value, path string) (starlark.Value, bool, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, step := range steps {
+		var found bool
+		x, found, err = getStep(x, step)
+		if err != nil || !found {
+			return nil, false, err
+		}
+	}
+	return x, true, nil
+}
+
+func getStep(x starlark.Value, step pathStep) (starlark.Value, bool, error) {
+	if step.isIndex {
+		seq, ok := x.(starlark.Indexable)
+		if !ok {
+			return nil, false, nil
+		}
+		i, n := step.index, seq.Len()
+		if i < 0 {
+			i += n
+		}
+		if i < 0 || i >= n {
+			return nil, false, nil
+		}
+		return seq.Index(i), true, nil
+	}
+
+	switch x := x.(type) {
+	case *Struct:
+		v, ok := x.field(step.name)
+		return v, ok, nil
+	case starlark.Mapping:
+		return x.Get(starlark.String(step.name))
+	case starlark.HasAttrs:
+		v, err := x.Attr(step.name)
+		if _, ok := err.(starlark.NoSuchAttrError); ok {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		return v, v != nil, nil
+	}
+	return nil, false, nil
+}
+
+// struct_get_path implements the get_path method of a struct:
+//
+//	s.get_path(path, default=None)
+//
+// It returns the value of GetPath(s, path), or default if not found.
+func struct_get_path(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path string
+	var dflt starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &path, "default?", &dflt); err != nil {
+		return nil, err
+	}
+	v, found, err := GetPath(b.Receiver(), path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	if !found {
+		return dflt, nil
+	}
+	return v, nil
+}
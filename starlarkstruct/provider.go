@@ -0,0 +1,241 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkstruct
+
+// This file defines Provider, a struct constructor
+// with a declared set of fields.
+
+import (
+	"fmt"
+	"sort"
+
+	"go.starlark.net/internal/spell"
+	"go.starlark.net/starlark"
+)
+
+// A Field declares a field of the structs of a Provider.
+type Field struct {
+	Name string
+
+	// Default is the value of the field if it is not specified.
+	// If nil, the field is required. NewProvider freezes it, as it is
+	// shared by all the structs that use it.
+	Default starlark.Value
+
+	// Check, if non-nil, reports an error if a value is not
+	// acceptable for the field, such as a value of the wrong type.
+	Check func(v starlark.Value) error
+}
+
+// A Provider is a callable constructor of structs that have a declared
+// set of fields, like the providers of Bazel. Calling it with keyword
+// arguments returns a struct branded by the provider, whose omitted
+// fields take their default values. It fails if an argument is not a
+// declared field, if a required field is omitted, or if a value is
+// rejected by the Check function of its field.
+//
+// Provider is a Defaulter and a Validator, so the same defaults and
+// constraints apply to the structs it brands that are created by other
+// means, such as FromKeywords or +.
+//
+//	config := starlarkstruct.NewProvider("config", []starlarkstruct.Field{
+//		{Name: "host"},
+//		{Name: "port", Default: starlark.MakeInt(80), Check: starlarkstruct.TypeCheck("int")},
+//	})
+type Provider struct {
+	name     string
+	fields   []Field             // sorted by name
+	defaults starlark.StringDict // frozen
+	bazel    bool                // created by a Bazel-compatible thread
+}
+
+var (
+	_ starlark.Callable        = (*Provider)(nil)
+	_ starlark.FreezeCheckable = (*Provider)(nil)
+	_ Defaulter                = (*Provider)(nil)
+	_ Validator                = (*Provider)(nil)
+)
+
+// NewProvider returns a new provider of the specified name and fields.
+// It freezes the default values of the fields.
+func NewProvider(name string, fields []Field) *Provider {
+	p := &Provider{
+		name:     name,
+		fields:   append([]Field(nil), fields...),
+		defaults: make(starlark.StringDict),
+	}
+	sort.Slice(p.fields, func(i, j int) bool { return p.fields[i].Name < p.fields[j].Name })
+	for _, f := range p.fields {
+		if f.Default != nil {
+			f.Default.Freeze()
+			p.defaults[f.Name] = f.Default
+		}
+	}
+	return p
+}
+
+// TypeCheck returns a Field.Check function that accepts
+// only values whose Type is one of the specified types.
+func TypeCheck(types ...string) func(v starlark.Value) error {
+	return func(v starlark.Value) error {
+		for _, t := range types {
+			if v.Type() == t {
+				return nil
+			}
+		}
+		if len(types) == 1 {
+			return fmt.Errorf("got %s, want %s", v.Type(), types[0])
+		}
+		return fmt.Errorf("got %s, want one of %v", v.Type(), types)
+	}
+}
+
+func (p *Provider) Name() string          { return p.name }
+func (p *Provider) String() string        { return p.name }
+func (p *Provider) Type() string          { return "provider" }
+func (p *Provider) Truth() starlark.Bool  { return true }
+func (p *Provider) Hash() (uint32, error) { return starlark.String(p.name).Hash() }
+func (p *Provider) Freeze()               {} // immutable
+func (p *Provider) Frozen() bool          { return true }
+
+// StructDefaults returns the default values of the fields.
+func (p *Provider) StructDefaults() starlark.StringDict { return p.defaults }
+
+// Referents calls visit for the default value of each field that has one.
+func (p *Provider) Referents(visit func(path string, v starlark.Value)) {
+	for _, f := range p.fields {
+		if f.Default != nil {
+			visit(".defaults."+f.Name, f.Default)
+		}
+	}
+}
+
+// Fields returns the names of the declared fields, in lexical order.
+func (p *Provider) Fields() []string {
+	names := make([]string, len(p.fields))
+	for i, f := range p.fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// lookup returns the declared field of the specified name, if any.
+func (p *Provider) lookup(name string) (*Field, bool) {
+	i := sort.Search(len(p.fields), func(i int) bool { return p.fields[i].Name >= name })
+	if i < len(p.fields) && p.fields[i].Name == name {
+		return &p.fields[i], true
+	}
+	return nil, false
+}
+
+func (p *Provider) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%s: unexpected positional arguments", p.name)
+	}
+	return NewFromKeywords(p, kwargs)
+}
+
+// ValidateStruct reports an error if s has an undeclared field,
+// lacks a required one, or has a field whose value is rejected
+// by the field's Check function.
+func (p *Provider) ValidateStruct(s *Struct) error {
+	for _, e := range s.all() {
+		f, ok := p.lookup(e.name)
+		if !ok {
+			if n := spell.Nearest(e.name, p.Fields()); n != "" {
+				return fmt.Errorf("%s: unexpected field %q (did you mean %q?)", p.name, e.name, n)
+			}
+			return fmt.Errorf("%s: unexpected field %q", p.name, e.name)
+		}
+		if f.Check != nil {
+			if err := f.Check(e.value); err != nil {
+				return fmt.Errorf("%s: for field %q: %v", p.name, e.name, err)
+			}
+		}
+	}
+	for _, f := range p.fields {
+		if _, ok := s.field(f.Name); !ok {
+			return fmt.Errorf("%s: missing field %q", p.name, f.Name)
+		}
+	}
+	return nil
+}
+
+// MakeProvider is the implementation of a built-in function that
+// returns a new Provider:
+//
+//	provider(name, fields, defaults={}, types={})
+//
+// fields is a list of the names of the fields; defaults maps the names
+// of optional fields to their default values; and types maps the names
+// of fields to the required type of their values, as reported by the
+// type function. For example:
+//
+//	config = provider("config", ["host", "port"], defaults = {"port": 80}, types = {"port": "int"})
+//	c = config(host = "localhost")
+//
+// If the thread is Bazel-compatible (see starlark.Thread), the structs
+// branded by the provider print as struct(...), as they do in Bazel.
+func MakeProvider(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name            string
+		names           *starlark.List
+		defaults, types *starlark.Dict
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"name", &name, "fields", &names, "defaults?", &defaults, "types?", &types); err != nil {
+		return nil, err
+	}
+	fields := make([]Field, names.Len())
+	index := make(map[string]*Field, names.Len())
+	for i := range fields {
+		s, ok := starlark.AsString(names.Index(i))
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter fields: got %s, want string", b.Name(), names.Index(i).Type())
+		}
+		if index[s] != nil {
+			return nil, fmt.Errorf("%s: duplicate field %q", b.Name(), s)
+		}
+		fields[i].Name = s
+		index[s] = &fields[i]
+	}
+	// field returns the declared field named by the key of a dict item.
+	field := func(param string, k starlark.Value) (*Field, error) {
+		s, ok := starlark.AsString(k)
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter %s: got %s key, want string", b.Name(), param, k.Type())
+		}
+		f := index[s]
+		if f == nil {
+			return nil, fmt.Errorf("%s: for parameter %s: %q is not a field", b.Name(), param, s)
+		}
+		return f, nil
+	}
+	if defaults != nil {
+		for _, item := range defaults.Items() {
+			f, err := field("defaults", item[0])
+			if err != nil {
+				return nil, err
+			}
+			f.Default = item[1]
+		}
+	}
+	if types != nil {
+		for _, item := range types.Items() {
+			f, err := field("types", item[0])
+			if err != nil {
+				return nil, err
+			}
+			t, ok := starlark.AsString(item[1])
+			if !ok {
+				return nil, fmt.Errorf("%s: for parameter types: got %s value, want string", b.Name(), item[1].Type())
+			}
+			f.Check = TypeCheck(t)
+		}
+	}
+	p := NewProvider(name, fields)
+	p.bazel = thread.BazelCompatible
+	return p, nil
+}
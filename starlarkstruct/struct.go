@@ -49,6 +49,8 @@ func Make(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs [
 
 // FromKeywords returns a new struct instance whose fields are specified by the
 // key/value pairs in kwargs.  (Each kwargs[i][0] must be a starlark.String.)
+// It does not validate the struct; use NewFromKeywords if the
+// constructor may be a Validator.
 func FromKeywords(constructor starlark.Value, kwargs []starlark.Tuple) *Struct {
 	if constructor == nil {
 		panic("nil constructor")
@@ -63,11 +65,24 @@ func FromKeywords(constructor starlark.Value, kwargs []starlark.Tuple) *Struct {
 		s.entries = append(s.entries, entry{k, v})
 	}
 	sort.Sort(s.entries)
+	s.addDefaults()
 	return s
 }
 
+// NewFromKeywords is like FromKeywords, but returns an error if the
+// constructor is a Validator that rejects the struct.
+func NewFromKeywords(constructor starlark.Value, kwargs []starlark.Tuple) (*Struct, error) {
+	s := FromKeywords(constructor, kwargs)
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 // FromStringDict returns a new struct instance whose elements are those of d.
 // The constructor parameter specifies the constructor; use Default for an ordinary struct.
+// It does not validate the struct; use NewFromStringDict if the
+// constructor may be a Validator.
 func FromStringDict(constructor starlark.Value, d starlark.StringDict) *Struct {
 	if constructor == nil {
 		panic("nil constructor")
@@ -80,9 +95,73 @@ func FromStringDict(constructor starlark.Value, d starlark.StringDict) *Struct {
 		s.entries = append(s.entries, entry{k, v})
 	}
 	sort.Sort(s.entries)
+	s.addDefaults()
 	return s
 }
 
+// NewFromStringDict is like FromStringDict, but returns an error if the
+// constructor is a Validator that rejects the struct.
+func NewFromStringDict(constructor starlark.Value, d starlark.StringDict) (*Struct, error) {
+	s := FromStringDict(constructor, d)
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// A Validator is a constructor that enforces invariants of the structs
+// it brands, such as mutually exclusive or required fields.
+// ValidateStruct is called once for each new struct made by a
+// Starlark operation, such as a call of a Provider, +, or extend, or by
+// a function of this package that returns an error, such as
+// NewFromKeywords, and should report an error if the struct is
+// invalid. FromKeywords and FromStringDict do not call it.
+type Validator interface {
+	starlark.Value
+	ValidateStruct(s *Struct) error
+}
+
+// A Defaulter is a constructor that supplies default values for the
+// fields of the structs it brands. Each struct created by FromKeywords,
+// FromStringDict, or their variants, including the result of +, has a
+// field for each default that it does not otherwise specify.
+//
+// The default values are shared by all such structs and must be
+// frozen. StructDefaults should return the same dictionary each time,
+// and it must not be modified.
+type Defaulter interface {
+	starlark.Value
+	StructDefaults() starlark.StringDict
+}
+
+// addDefaults adds the default value of each field of the struct's
+// constructor, if it is a Defaulter, that the struct lacks.
+// s.entries must be sorted.
+func (s *Struct) addDefaults() {
+	d, ok := s.constructor.(Defaulter)
+	if !ok {
+		return
+	}
+	given := s.entries
+	for name, v := range d.StructDefaults() {
+		i := sort.Search(len(given), func(i int) bool { return given[i].name >= name })
+		if i == len(given) || given[i].name != name {
+			s.entries = append(s.entries, entry{name, v})
+		}
+	}
+	if len(s.entries) > len(given) {
+		sort.Sort(s.entries)
+	}
+}
+
+// validate calls the constructor's ValidateStruct method, if any.
+func (s *Struct) validate() error {
+	if v, ok := s.constructor.(Validator); ok {
+		return v.ValidateStruct(s)
+	}
+	return nil
+}
+
 // Struct is an immutable Starlark type that maps field names to values.
 // It is not iterable and does not support len.
 //
@@ -100,7 +179,9 @@ func FromStringDict(constructor starlark.Value, d starlark.StringDict) *Struct {
 // Use Attr to access its fields and AttrNames to enumerate them.
 type Struct struct {
 	constructor starlark.Value
-	entries     entries // sorted by name
+	entries     entries      // sorted by name
+	proto       *Struct      // optional; see NewExtended
+	fallback    AttrFallback // optional; see WithFallback
 }
 
 // Default is the default constructor for structs.
@@ -109,6 +190,32 @@ const Default = starlark.String("struct")
 
 type entries []entry
 
+// all returns the fields of the struct, including those it inherits
+// from its prototype, sorted by name.
+func (s *Struct) all() entries {
+	if s.proto == nil {
+		return s.entries
+	}
+	own, inherited := s.entries, s.proto.all()
+	merged := make(entries, 0, len(own)+len(inherited))
+	i, j := 0, 0
+	for i < len(own) || j < len(inherited) {
+		switch {
+		case j == len(inherited) || i < len(own) && own[i].name < inherited[j].name:
+			merged = append(merged, own[i])
+			i++
+		case i == len(own) || inherited[j].name < own[i].name:
+			merged = append(merged, inherited[j])
+			j++
+		default: // overridden
+			merged = append(merged, own[i])
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
 func (a entries) Len() int           { return len(a) }
 func (a entries) Less(i, j int) bool { return a[i].name < a[j].name }
 func (a entries) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -121,38 +228,73 @@ type entry struct {
 var (
 	_ starlark.HasAttrs  = (*Struct)(nil)
 	_ starlark.HasBinary = (*Struct)(nil)
+
+	_ starlark.PrettyValue     = (*Struct)(nil)
+	_ starlark.FreezeCheckable = (*Struct)(nil)
 )
 
 // ToStringDict adds a name/value entry to d for each field of the struct.
 func (s *Struct) ToStringDict(d starlark.StringDict) {
-	for _, e := range s.entries {
+	for _, e := range s.all() {
 		d[e.name] = e.value
 	}
 }
 
 func (s *Struct) String() string {
 	buf := new(strings.Builder)
-	switch constructor := s.constructor.(type) {
-	case starlark.String:
-		// NB: The Java implementation always prints struct
-		// even for Bazel provider instances.
-		buf.WriteString(constructor.GoString()) // avoid String()'s quotation
-	default:
-		buf.WriteString(s.constructor.String())
-	}
+	buf.WriteString(s.constructorName())
 	buf.WriteByte('(')
-	for i, e := range s.entries {
+	for i, e := range s.all() {
 		if i > 0 {
 			buf.WriteString(", ")
 		}
 		buf.WriteString(e.name)
 		buf.WriteString(" = ")
-		buf.WriteString(e.value.String())
+		buf.WriteString(starlark.Repr(e.value))
 	}
 	buf.WriteByte(')')
 	return buf.String()
 }
 
+// constructorName returns the name of the struct's constructor
+// as it appears in its string form.
+func (s *Struct) constructorName() string { return constructorName(s.constructor) }
+
+func constructorName(constructor starlark.Value) string {
+	if p, ok := constructor.(*Provider); ok && p.bazel {
+		return "struct"
+	}
+	if constructor, ok := constructor.(starlark.String); ok {
+		// NB: The Java implementation always prints struct
+		// even for Bazel provider instances.
+		return constructor.GoString() // avoid String()'s quotation
+	}
+	return constructor.String()
+}
+
+// PrettyElems returns the elements of the struct for starlark.PrettyPrint.
+func (s *Struct) PrettyElems() (open, close string, names []string, values []starlark.Value) {
+	entries := s.all()
+	names = make([]string, len(entries))
+	values = make([]starlark.Value, len(entries))
+	for i, e := range entries {
+		names[i] = e.name
+		values[i] = e.value
+	}
+	return s.constructorName() + "(", ")", names, values
+}
+
+// WithFallback returns a new struct with the same constructor and
+// fields as s, whose Attr method calls fallback to obtain the value of
+// any attribute that is not a field, allowing a struct to provide
+// lazily computed attributes. The attributes provided by fallback do
+// not appear among the struct's AttrNames, nor do they take part in
+// comparisons. The struct returned by s + t has no fallback, but
+// a struct that extends s (see NewExtended) consults it in turn.
+func (s *Struct) WithFallback(fallback AttrFallback) *Struct {
+	return &Struct{constructor: s.constructor, entries: s.entries, proto: s.proto, fallback: fallback}
+}
+
 // Constructor returns the constructor used to create this struct.
 func (s *Struct) Constructor() starlark.Value { return s.constructor }
 
@@ -161,7 +303,7 @@ func (s *Struct) Truth() starlark.Bool { return true } // even when empty
 func (s *Struct) Hash() (uint32, error) {
 	// Same algorithm as Tuple.hash, but with different primes.
 	var x, m uint32 = 8731, 9839
-	for _, e := range s.entries {
+	for _, e := range s.all() {
 		namehash, _ := starlark.String(e.name).Hash()
 		x = x ^ 3*namehash
 		y, err := e.value.Hash()
@@ -177,37 +319,94 @@ func (s *Struct) Freeze() {
 	for _, e := range s.entries {
 		e.value.Freeze()
 	}
+	if s.proto != nil {
+		s.proto.Freeze()
+	}
+}
+
+// Frozen reports true: a struct is immutable, though its fields may not be.
+func (s *Struct) Frozen() bool { return true }
+
+// Referents calls visit for each field of the struct, in order.
+func (s *Struct) Referents(visit func(path string, v starlark.Value)) {
+	for _, e := range s.all() {
+		visit("."+e.name, e.value)
+	}
 }
 
 func (x *Struct) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if _, ok := y.(*CallableStruct); ok {
+		return nil, nil // let the callable struct handle it
+	}
 	if y, ok := y.(*Struct); ok && op == syntax.PLUS {
 		if side == starlark.Right {
 			x, y = y, x
 		}
+		return add(x, y)
+	}
+	return nil, nil // unhandled
+}
 
-		if eq, err := starlark.Equal(x.constructor, y.constructor); err != nil {
-			return nil, fmt.Errorf("in %s + %s: error comparing constructors: %v",
-				x.constructor, y.constructor, err)
-		} else if !eq {
-			return nil, fmt.Errorf("cannot add structs of different constructors: %s + %s",
-				x.constructor, y.constructor)
-		}
-
-		z := make(starlark.StringDict, x.len()+y.len())
-		for _, e := range x.entries {
-			z[e.name] = e.value
-		}
-		for _, e := range y.entries {
-			z[e.name] = e.value
-		}
+// add returns the struct x + y.
+func add(x, y *Struct) (*Struct, error) {
+	if eq, err := starlark.Equal(x.constructor, y.constructor); err != nil {
+		return nil, fmt.Errorf("in %s + %s: error comparing constructors: %v",
+			x.constructor, y.constructor, err)
+	} else if !eq {
+		return nil, fmt.Errorf("cannot add structs of different constructors: %s + %s",
+			x.constructor, y.constructor)
+	}
 
-		return FromStringDict(x.constructor, z), nil
+	z := make(starlark.StringDict, x.len()+y.len())
+	for _, e := range x.all() {
+		z[e.name] = e.value
 	}
-	return nil, nil // unhandled
+	for _, e := range y.all() {
+		z[e.name] = e.value
+	}
+	return NewFromStringDict(x.constructor, z)
 }
 
 // Attr returns the value of the specified field.
+//
+// If the struct has no such field, Attr calls its fallback function,
+// if any (see WithFallback), and then those of the structs it extends
+// (see NewExtended). Failing that, Attr returns one of the following
+// methods of the struct, which do not appear among its AttrNames:
+//
+//	s.get_path(path, default=None)  the value of GetPath(s, path), or default if not found
+//	s.to_dict()                     a new dict of the fields of s
+//	s.to_json()                     the JSON encoding of s (see EncodeJSON)
 func (s *Struct) Attr(name string) (starlark.Value, error) {
+	if v, ok := s.field(name); ok {
+		return v, nil
+	}
+	for p := s; p != nil; p = p.proto {
+		if p.fallback != nil {
+			if v, err := p.fallback(name); err != nil || v != nil {
+				return v, err
+			}
+		}
+	}
+	switch name {
+	case "get_path":
+		return starlark.NewBuiltin("get_path", struct_get_path).BindReceiver(s), nil
+	case "to_dict":
+		return starlark.NewBuiltin("to_dict", struct_to_dict).BindReceiver(s), nil
+	case "to_json":
+		return starlark.NewBuiltin("to_json", struct_to_json).BindReceiver(s), nil
+	}
+
+	var ctor string
+	if s.constructor != Default {
+		ctor = s.constructor.String() + " "
+	}
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%sstruct has no .%s attribute", ctor, name))
+}
+
+// field returns the value of the specified field, if present.
+func (s *Struct) field(name string) (starlark.Value, bool) {
 	// Binary search the entries.
 	// This implementation is a specialization of
 	// sort.Search that avoids dynamic dispatch.
@@ -222,30 +421,28 @@ func (s *Struct) Attr(name string) (starlark.Value, error) {
 		}
 	}
 	if i < n && s.entries[i].name == name {
-		return s.entries[i].value, nil
+		return s.entries[i].value, true
 	}
-
-	var ctor string
-	if s.constructor != Default {
-		ctor = s.constructor.String() + " "
+	if s.proto != nil {
+		return s.proto.field(name)
 	}
-	return nil, starlark.NoSuchAttrError(
-		fmt.Sprintf("%sstruct has no .%s attribute", ctor, name))
+	return nil, false
 }
 
-func (s *Struct) len() int { return len(s.entries) }
+func (s *Struct) len() int { return len(s.all()) }
 
 // AttrNames returns a new sorted list of the struct fields.
 func (s *Struct) AttrNames() []string {
-	names := make([]string, len(s.entries))
-	for i, e := range s.entries {
+	entries := s.all()
+	names := make([]string, len(entries))
+	for i, e := range entries {
 		names[i] = e.name
 	}
 	return names
 }
 
 func (x *Struct) CompareSameType(op syntax.Token, y_ starlark.Value, depth int) (bool, error) {
-	y := y_.(*Struct)
+	y, _ := asStruct(y_)
 	switch op {
 	case syntax.EQL:
 		return structsEqual(x, y, depth)
@@ -258,7 +455,8 @@ func (x *Struct) CompareSameType(op syntax.Token, y_ starlark.Value, depth int)
 }
 
 func structsEqual(x, y *Struct, depth int) (bool, error) {
-	if x.len() != y.len() {
+	xe, ye := x.all(), y.all()
+	if len(xe) != len(ye) {
 		return false, nil
 	}
 
@@ -269,10 +467,10 @@ func structsEqual(x, y *Struct, depth int) (bool, error) {
 		return false, nil
 	}
 
-	for i, n := 0, x.len(); i < n; i++ {
-		if x.entries[i].name != y.entries[i].name {
+	for i := range xe {
+		if xe[i].name != ye[i].name {
 			return false, nil
-		} else if eq, err := starlark.EqualDepth(x.entries[i].value, y.entries[i].value, depth-1); err != nil {
+		} else if eq, err := starlark.EqualDepth(xe[i].value, ye[i].value, depth-1); err != nil {
 			return false, err
 		} else if !eq {
 			return false, nil
@@ -7,11 +7,14 @@ package starlarkstruct_test
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	_ "go.starlark.net/lib/json" // for struct.to_json
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 	"go.starlark.net/starlarktest"
+	"go.starlark.net/syntax"
 )
 
 func Test(t *testing.T) {
@@ -20,8 +23,12 @@ func Test(t *testing.T) {
 	starlarktest.SetReporter(thread, t)
 	filename := filepath.Join(testdata, "testdata/struct.star")
 	predeclared := starlark.StringDict{
-		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+		"struct": starlarkstruct.StructFunc,
 		"gensym": starlark.NewBuiltin("gensym", gensym),
+
+		"mutable_struct":  starlark.NewBuiltin("mutable_struct", starlarkstruct.MakeMutable),
+		"provider":        starlark.NewBuiltin("provider", starlarkstruct.MakeProvider),
+		"callable_struct": starlark.NewBuiltin("callable_struct", starlarkstruct.MakeCallable),
 	}
 	if _, err := starlark.ExecFile(thread, filename, nil, predeclared); err != nil {
 		if err, ok := err.(*starlark.EvalError); ok {
@@ -67,3 +74,297 @@ func (sym *symbol) CallInternal(thread *starlark.Thread, args starlark.Tuple, kw
 	}
 	return starlarkstruct.FromKeywords(sym, kwargs), nil
 }
+
+// A schema is a symbol that assigns numbers to its fields.
+type schema struct {
+	symbol
+	fields map[string]uint64
+}
+
+func (sc *schema) FieldNumber(name string) (uint64, bool) {
+	num, ok := sc.fields[name]
+	return num, ok
+}
+
+func TestEncodeBinary(t *testing.T) {
+	point := &schema{symbol{"point"}, map[string]uint64{"x": 1, "y": 2}}
+	shape := &schema{symbol{"shape"}, map[string]uint64{"name": 1, "points": 2, "tags": 3}}
+	mkpoint := func(x, y int) *starlarkstruct.Struct {
+		return starlarkstruct.FromStringDict(point, starlark.StringDict{
+			"x": starlark.MakeInt(x),
+			"y": starlark.MakeInt(y),
+		})
+	}
+
+	got, err := starlarkstruct.EncodeBinary(mkpoint(1, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\x0c\x02\x01\x03\x02\x02\x03\x01"; string(got) != want {
+		t.Errorf("EncodeBinary(point) = %q, want %q", got, want)
+	}
+
+	// Dicts with the same items have the same encoding.
+	encodeShape := func(tags ...string) []byte {
+		dict := new(starlark.Dict)
+		for _, tag := range tags {
+			dict.SetKey(starlark.String(tag), starlark.True)
+		}
+		s := starlarkstruct.FromStringDict(shape, starlark.StringDict{
+			"name":   starlark.String("tri"),
+			"points": starlark.NewList([]starlark.Value{mkpoint(0, 0), mkpoint(1, 0), mkpoint(0, 1)}),
+			"tags":   dict,
+		})
+		data, err := starlarkstruct.EncodeBinary(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	if x, y := encodeShape("a", "b"), encodeShape("b", "a"); string(x) != string(y) {
+		t.Errorf("encodings of equal dicts differ: %q, %q", x, y)
+	}
+
+	for _, test := range []struct {
+		s    *starlarkstruct.Struct
+		want string
+	}{
+		{starlarkstruct.FromStringDict(starlarkstruct.Default, nil),
+			"cannot encode struct: constructor struct is not a schema"},
+		{starlarkstruct.FromStringDict(point, starlark.StringDict{"z": starlark.None}),
+			"cannot encode struct: point has no field z"},
+		{starlarkstruct.FromStringDict(point, starlark.StringDict{"x": starlark.NewBuiltin("f", nil)}),
+			"cannot encode builtin_function_or_method"},
+	} {
+		if _, err := starlarkstruct.EncodeBinary(test.s); err == nil || err.Error() != test.want {
+			t.Errorf("EncodeBinary(%v) = %v, want error %q", test.s, err, test.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	mk := func(kv ...interface{}) *starlarkstruct.Struct {
+		d := make(starlark.StringDict)
+		for i := 0; i < len(kv); i += 2 {
+			d[kv[i].(string)] = kv[i+1].(starlark.Value)
+		}
+		return starlarkstruct.FromStringDict(starlarkstruct.Default, d)
+	}
+	one, two := starlark.MakeInt(1), starlark.MakeInt(2)
+	a := mk("a", one, "b", mk("c", one, "d", one), "e", one)
+	b := mk("a", one, "b", mk("c", two, "f", two), "g", two)
+
+	changes, err := starlarkstruct.Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := "[~ b.c: 1 -> 2 - b.d = 1 + b.f = 2 - e = 1 + g = 2]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("Diff = %s, want %s", got, want)
+	}
+
+	patched, err := starlarkstruct.Apply(a, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq, err := starlark.Equal(patched, b); err != nil || !eq {
+		t.Errorf("Apply(a, Diff(a, b)) = %v, want %v", patched, b)
+	}
+
+	// A patch does not apply to a struct that differs from its origin.
+	if _, err := starlarkstruct.Apply(b, changes); err == nil {
+		t.Errorf("Apply(b, Diff(a, b)) succeeded unexpectedly")
+	} else if want := "change ~ b.c: 1 -> 2 does not apply: field has value 2"; err.Error() != want {
+		t.Errorf("Apply(b, Diff(a, b)) = %v, want %s", err, want)
+	}
+}
+
+func TestAttrFallback(t *testing.T) {
+	var calls []string
+	fallback := func(name string) (starlark.Value, error) {
+		calls = append(calls, name)
+		if strings.HasPrefix(name, "gen_") {
+			return starlark.String(strings.TrimPrefix(name, "gen_")), nil
+		}
+		return nil, nil
+	}
+	s := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"x": starlark.MakeInt(2),
+	}).WithFallback(fallback)
+	e, err := starlarkstruct.NewExtended(s, []starlark.Tuple{{starlark.String("y"), starlark.MakeInt(3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	predeclared := starlark.StringDict{
+		"m": &starlarkstruct.Module{
+			Name:     "m",
+			Members:  starlark.StringDict{"x": starlark.MakeInt(1)},
+			Fallback: fallback,
+		},
+		"s": s,
+		"e": e,
+	}
+	const src = `
+load("assert.star", "assert")
+assert.eq(m.x, 1)
+assert.eq(m.gen_foo, "foo")
+assert.eq(dir(m), ["x"])
+assert.fails(lambda: m.y, "module has no .y field or method")
+assert.eq(s.x, 2)
+assert.eq(s.gen_bar, "bar")
+assert.eq(dir(s), ["x"])
+assert.fails(lambda: s.y, "struct has no .y attribute")
+assert.eq(e.y, 3)
+assert.eq(e.gen_baz, "baz")
+assert.eq(dir(e), ["x", "y"])
+`
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	if _, err := starlark.ExecFile(thread, "fallback.star", src, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(calls), "[gen_foo y gen_bar y gen_baz]"; got != want {
+		t.Errorf("fallback calls = %s, want %s", got, want)
+	}
+}
+
+// An exclusive is a symbol whose structs may not have both of two fields.
+type exclusive struct {
+	symbol
+	a, b string
+}
+
+func (ex *exclusive) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%s: unexpected positional arguments", ex)
+	}
+	return starlarkstruct.NewFromKeywords(ex, kwargs)
+}
+
+func (ex *exclusive) ValidateStruct(s *starlarkstruct.Struct) error {
+	a, _ := s.Attr(ex.a)
+	b, _ := s.Attr(ex.b)
+	if a != nil && b != nil {
+		return fmt.Errorf("%s: fields %s and %s are mutually exclusive", ex, ex.a, ex.b)
+	}
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+	src := &exclusive{symbol{"source"}, "path", "content"}
+	predeclared := starlark.StringDict{
+		"source": src,
+		"p":      starlarkstruct.FromStringDict(src, starlark.StringDict{"path": starlark.String("a.txt")}),
+	}
+	const code = `
+load("assert.star", "assert")
+c = source(content = "hello")
+assert.eq(c.content, "hello")
+assert.fails(lambda: source(path = "a.txt", content = "hello"), "fields path and content are mutually exclusive")
+assert.fails(lambda: p + c, "fields path and content are mutually exclusive")
+assert.eq((p + source(mode = 1)).mode, 1)
+`
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	if _, err := starlark.ExecFile(thread, "validator.star", code, predeclared); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := starlarkstruct.NewFromStringDict(src, starlark.StringDict{
+		"path":    starlark.String("a.txt"),
+		"content": starlark.String("hello"),
+	}); err == nil {
+		t.Errorf("NewFromStringDict succeeded unexpectedly")
+	}
+
+	// FromStringDict does not validate, so it does not panic.
+	both := starlarkstruct.FromStringDict(src, starlark.StringDict{
+		"path":    starlark.String("a.txt"),
+		"content": starlark.String("hello"),
+	})
+	if got, want := both.String(), `source(content = "hello", path = "a.txt")`; got != want {
+		t.Errorf("FromStringDict = %s, want %s", got, want)
+	}
+}
+
+func TestDefaulter(t *testing.T) {
+	deps := starlark.NewList(nil)
+	rule := starlarkstruct.NewProvider("rule", []starlarkstruct.Field{
+		{Name: "name"},
+		{Name: "deps", Default: deps},
+		{Name: "visibility", Default: starlark.String("private")},
+	})
+	if err := deps.Append(starlark.None); err == nil {
+		t.Error("default value was not frozen by NewProvider")
+	}
+
+	// Omitted fields take their defaults, however the struct is made.
+	s := starlarkstruct.FromKeywords(rule, []starlark.Tuple{
+		{starlark.String("name"), starlark.String("x")},
+		{starlark.String("visibility"), starlark.String("public")},
+	})
+	if got, want := s.String(), `rule(deps = [], name = "x", visibility = "public")`; got != want {
+		t.Errorf("FromKeywords = %s, want %s", got, want)
+	}
+	s = starlarkstruct.FromStringDict(rule, starlark.StringDict{"name": starlark.String("y")})
+	if got, want := s.String(), `rule(deps = [], name = "y", visibility = "private")`; got != want {
+		t.Errorf("FromStringDict = %s, want %s", got, want)
+	}
+
+	// Required fields are still required.
+	if _, err := starlarkstruct.NewFromStringDict(rule, nil); err == nil || err.Error() != `rule: missing field "name"` {
+		t.Errorf("NewFromStringDict(nil) = %v, want missing field error", err)
+	}
+}
+
+func TestCallableStructType(t *testing.T) {
+	fn := starlark.NewBuiltin("fn", func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+		return starlark.None, nil
+	})
+	kwargs := []starlark.Tuple{{starlark.String(starlarkstruct.CallField), fn}}
+
+	// A __call__ field does not change the type of an ordinary struct.
+	v, err := starlarkstruct.Make(nil, nil, nil, kwargs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := v.(*starlarkstruct.Struct)
+	if !ok {
+		t.Fatalf("Make returned %T, want *Struct", v)
+	}
+	if v, err := starlark.Binary(syntax.PLUS, s, s); err != nil {
+		t.Fatal(err)
+	} else if _, ok := v.(*starlarkstruct.Struct); !ok {
+		t.Errorf("struct + struct returned %T, want *Struct", v)
+	}
+
+	// Only the explicit constructor makes it callable.
+	c, err := starlarkstruct.NewCallable(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := starlark.Binary(syntax.PLUS, s, c); err != nil {
+		t.Fatal(err)
+	} else if _, ok := v.(*starlarkstruct.CallableStruct); !ok {
+		t.Errorf("struct + callable struct returned %T, want *CallableStruct", v)
+	}
+}
+
+func TestToJSONWithoutEncoder(t *testing.T) {
+	defer func(saved func(starlark.Value) (string, error)) { starlarkstruct.EncodeJSON = saved }(starlarkstruct.EncodeJSON)
+	starlarkstruct.EncodeJSON = nil
+
+	s := starlarkstruct.FromStringDict(starlarkstruct.Default, nil)
+	toJSON, err := s.Attr("to_json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = starlark.Call(new(starlark.Thread), toJSON, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "import go.starlark.net/lib/json") {
+		t.Errorf("to_json without encoder: got error %v", err)
+	}
+}
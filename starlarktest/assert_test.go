@@ -0,0 +1,56 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktest_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarktest"
+)
+
+// errorRecorder is a Reporter that records the errors reported to it.
+type errorRecorder struct{ errors []string }
+
+func (r *errorRecorder) Error(args ...interface{}) { r.errors = append(r.errors, fmt.Sprint(args...)) }
+
+func TestFailsWithRegex(t *testing.T) {
+	const src = `
+load("assert.star", "assert")
+
+f = lambda: 1 // 0
+assert.fails(f, "division by zero")            # ok: matches part of the error
+assert.fails_with_regex(f, "division by zero") # fails: must match all of it
+assert.fails_with_regex(f, "floored division by zero")
+assert.fails_with_regex(f, "floored|division by zero") # the alternation is grouped
+`
+	thread := &starlark.Thread{
+		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+			return starlarktest.LoadAssertModule()
+		},
+	}
+	var r errorRecorder
+	starlarktest.SetReporter(thread, &r)
+	if _, err := starlark.ExecFile(thread, "fails.star", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"fails.star:6:24: regular expression (division by zero) did not match all of error (floored division by zero)",
+		"fails.star:8:24: regular expression (floored|division by zero) did not match all of error (floored division by zero)",
+	}
+	if len(r.errors) != len(want) {
+		t.Fatalf("got %d errors %q, want %d", len(r.errors), r.errors, len(want))
+	}
+	for i, err := range r.errors {
+		// Reduce each backtrace to its outermost position and message.
+		lines := strings.Split(err, "\n")
+		got := strings.TrimSpace(strings.TrimSuffix(lines[1], " in <toplevel>")) + " " + strings.TrimPrefix(lines[len(lines)-1], "Error: ")
+		if got != want[i] {
+			t.Errorf("error %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
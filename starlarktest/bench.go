@@ -0,0 +1,104 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+// RunBenchmarks runs each function in globals whose name begins with
+// "bench_" as a sub-benchmark of b, in name order. Typically globals
+// is the result of executing a Starlark test or benchmark file.
+//
+// Each function is called with a single argument, a benchmark value
+// that provides b.n, the number of iterations that must be executed by
+// the function, which is typically of the form:
+//
+//	def bench_foo(b):
+//	    for _ in range(b.n):
+//	        ...work...
+//
+// It also provides stop, start, and restart methods to stop the clock in case
+// there is significant set-up work that should not count against the measured
+// operation.
+//
+// (This interface is inspired by Go's testing.B, and is also implemented
+// by the java.starlark.net implementation; see
+// https://github.com/bazelbuild/starlark/pull/75#pullrequestreview-275604129.)
+//
+// While each function runs, the thread's reporter is the sub-benchmark,
+// so assertions made by the function are reported against it.
+// An evaluation error fails the sub-benchmark.
+func RunBenchmarks(b *testing.B, thread *starlark.Thread, globals starlark.StringDict) {
+	b.Helper()
+	prev := thread.Local(localKey)
+	defer thread.SetLocal(localKey, prev)
+
+	for _, name := range globals.Keys() {
+		fn, ok := globals[name].(*starlark.Function)
+		if !ok || !strings.HasPrefix(name, "bench_") {
+			continue
+		}
+		b.Run(name, func(b *testing.B) {
+			SetReporter(thread, b)
+			if _, err := starlark.Call(thread, fn, starlark.Tuple{benchmark{b}}, nil); err != nil {
+				if evalErr, ok := err.(*starlark.EvalError); ok {
+					b.Fatal(evalErr.Backtrace())
+				}
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// A benchmark is passed to each bench_xyz(b) function by RunBenchmarks.
+type benchmark struct {
+	b *testing.B
+}
+
+func (benchmark) Freeze()               {}
+func (benchmark) Truth() starlark.Bool  { return true }
+func (benchmark) Type() string          { return "benchmark" }
+func (benchmark) String() string        { return "<benchmark>" }
+func (benchmark) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: benchmark") }
+func (benchmark) AttrNames() []string   { return []string{"n", "restart", "start", "stop"} }
+func (b benchmark) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "n":
+		return starlark.MakeInt(b.b.N), nil
+	case "restart":
+		return benchmarkRestart.BindReceiver(b), nil
+	case "start":
+		return benchmarkStart.BindReceiver(b), nil
+	case "stop":
+		return benchmarkStop.BindReceiver(b), nil
+	}
+	return nil, nil
+}
+
+var (
+	benchmarkRestart = starlark.NewBuiltin("restart", benchmarkRestartImpl)
+	benchmarkStart   = starlark.NewBuiltin("start", benchmarkStartImpl)
+	benchmarkStop    = starlark.NewBuiltin("stop", benchmarkStopImpl)
+)
+
+func benchmarkRestartImpl(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	b.Receiver().(benchmark).b.ResetTimer()
+	return starlark.None, nil
+}
+
+func benchmarkStartImpl(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	b.Receiver().(benchmark).b.StartTimer()
+	return starlark.None, nil
+}
+
+func benchmarkStopImpl(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	b.Receiver().(benchmark).b.StopTimer()
+	return starlark.None, nil
+}
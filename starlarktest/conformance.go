@@ -0,0 +1,287 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktest
+
+// This file defines a runner for the specification test corpus.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.starlark.net/internal/chunkedfile"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// A DialectOption is a non-standard option of the Starlark dialect,
+// controlled by a variable of the resolve package.
+type DialectOption struct {
+	Name string // name used in "option:name" markers of test files
+	Flag *bool  // the variable that enables the option
+}
+
+// DialectOptions lists the non-standard dialect options.
+var DialectOptions = []DialectOption{
+	{"globalreassign", &resolve.AllowGlobalReassign},
+	{"loadbindsglobally", &resolve.LoadBindsGlobally},
+	{"recursion", &resolve.AllowRecursion},
+	{"set", &resolve.AllowSet},
+	{"del", &resolve.AllowDel},
+	{"with", &resolve.AllowWith},
+	{"catch", &resolve.AllowCatch},
+	{"yield", &resolve.AllowYield},
+	{"lazyiter", &resolve.LazyIterators},
+	{"funcattrs", &resolve.FunctionAttrs},
+}
+
+// A Conformance runs a corpus of chunked test files, such as those of
+// the Starlark specification in starlark/testdata, and reports which
+// chunks pass, and how each dialect option alters the outcome.
+//
+// A chunked file consists of chunks separated by "---" lines, each
+// executed independently; a line containing ### followed by a quoted
+// regular expression expects an error, static or dynamic, matching it
+// on that line. A
+// chunk that contains a marker of the form "option:name" requires the
+// named dialect option; other chunks are standard.
+//
+// Each chunk is first executed with only the options it requires, as
+// the baseline. Then, for each option, every standard chunk that
+// passed in the baseline is executed again with the option enabled;
+// a chunk that then fails is evidence that the option deviates from
+// the specification, rather than merely extending it.
+//
+// Because dialect options are global variables, a Conformance must not
+// run concurrently with other uses of the resolve package. The
+// variables are restored when Run returns.
+type Conformance struct {
+	// Predeclared is the predeclared environment of each chunk.
+	Predeclared starlark.StringDict
+
+	// Load, if non-nil, loads the modules of a chunk other than
+	// "assert.star", which is always the assert module.
+	Load func(thread *starlark.Thread, module string) (starlark.StringDict, error)
+
+	// Init, if non-nil, is called to prepare the thread
+	// of each chunk, for example by setting thread-local values.
+	Init func(thread *starlark.Thread)
+
+	// Options lists the dialect options to evaluate.
+	// If nil, DialectOptions is used.
+	Options []DialectOption
+}
+
+// A ChunkResult is the outcome of executing one chunk of a test file.
+type ChunkResult struct {
+	File    string   // name of the test file
+	Line    int      // line of the file at which the chunk starts
+	Options []string // dialect options required by the chunk
+	Errors  []string // failures, or nil if the chunk passed
+}
+
+// Passed reports whether the chunk passed.
+func (r *ChunkResult) Passed() bool { return len(r.Errors) == 0 }
+
+// A ConformanceReport is the result of a Conformance run.
+type ConformanceReport struct {
+	Chunks  []*ChunkResult // baseline result of each chunk, in order
+	Options []*OptionReport
+}
+
+// An OptionReport describes the effect of a dialect option.
+type OptionReport struct {
+	Name     string
+	Required []*ChunkResult // baseline results of the chunks that require the option
+	Altered  []*ChunkResult // results of standard chunks that fail only with the option
+}
+
+// Run executes the specified test files and returns the report.
+// It fails only if a file cannot be read.
+func (c *Conformance) Run(filenames ...string) (*ConformanceReport, error) {
+	options := c.Options
+	if options == nil {
+		options = DialectOptions
+	}
+	saved := make([]bool, len(options))
+	for i, opt := range options {
+		saved[i] = *opt.Flag
+	}
+	defer func() {
+		for i, opt := range options {
+			*opt.Flag = saved[i]
+		}
+	}()
+
+	report := new(ConformanceReport)
+	for _, filename := range filenames {
+		if _, err := os.Stat(filename); err != nil {
+			return nil, err
+		}
+		report.Chunks = append(report.Chunks, c.runFile(filename, options, nil)...)
+	}
+
+	for _, opt := range options {
+		or := &OptionReport{Name: opt.Name}
+		for _, res := range report.Chunks {
+			for _, name := range res.Options {
+				if name == opt.Name {
+					or.Required = append(or.Required, res)
+					break
+				}
+			}
+		}
+		for _, filename := range filenames {
+			for _, res := range c.runFile(filename, options, []string{opt.Name}) {
+				if len(res.Options) == 0 && !res.Passed() && baselinePassed(report.Chunks, res) {
+					or.Altered = append(or.Altered, res)
+				}
+			}
+		}
+		report.Options = append(report.Options, or)
+	}
+	return report, nil
+}
+
+// baselinePassed reports whether the chunk of res passed in the baseline.
+func baselinePassed(chunks []*ChunkResult, res *ChunkResult) bool {
+	for _, x := range chunks {
+		if x.File == res.File && x.Line == res.Line {
+			return x.Passed()
+		}
+	}
+	return false
+}
+
+// runFile executes each chunk of the file with the options it
+// requires, and the extra ones, enabled, and returns their results.
+func (c *Conformance) runFile(filename string, options []DialectOption, extra []string) []*ChunkResult {
+	var results []*ChunkResult
+	rep := new(collector)
+	for _, chunk := range chunkedfile.Read(filename, rep) {
+		rep.errors = nil
+		res := &ChunkResult{
+			File: filename,
+			Line: strings.Count(chunk.Source, "\n") - strings.Count(strings.TrimLeft(chunk.Source, "\n"), "\n") + 1,
+		}
+		for _, opt := range options {
+			required := strings.Contains(chunk.Source, "option:"+opt.Name)
+			if required {
+				res.Options = append(res.Options, opt.Name)
+			}
+			*opt.Flag = required || contains(extra, opt.Name)
+		}
+
+		thread := &starlark.Thread{Name: "conformance", Load: c.load}
+		SetReporter(thread, rep)
+		if c.Init != nil {
+			c.Init(thread)
+		}
+		_, err := starlark.ExecFile(thread, filename, chunk.Source, c.Predeclared)
+		switch err := err.(type) {
+		case *starlark.EvalError:
+			found := false
+			for i := range err.CallStack {
+				if posn := err.CallStack.At(i).Pos; posn.Filename() == filename {
+					chunk.GotError(int(posn.Line), err.Error())
+					found = true
+					break
+				}
+			}
+			if !found {
+				rep.Errorf("%s", err.Backtrace())
+			}
+		case resolve.ErrorList:
+			// Static errors may be expected too.
+			for _, e := range err {
+				chunk.GotError(int(e.Pos.Line), e.Msg)
+			}
+		case syntax.Error:
+			chunk.GotError(int(err.Pos.Line), err.Msg)
+		case nil:
+			// success
+		default:
+			rep.Errorf("%s", err)
+		}
+		chunk.Done()
+		res.Errors = rep.errors
+		results = append(results, res)
+	}
+	return results
+}
+
+func (c *Conformance) load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	if module == "assert.star" {
+		return LoadAssertModule()
+	}
+	if c.Load == nil {
+		return nil, fmt.Errorf("load not implemented")
+	}
+	return c.Load(thread, module)
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A collector is a Reporter that collects the failures of a chunk.
+type collector struct{ errors []string }
+
+func (c *collector) Error(args ...interface{}) {
+	c.errors = append(c.errors, strings.TrimSpace(fmt.Sprint(args...)))
+}
+
+func (c *collector) Errorf(format string, args ...interface{}) {
+	c.errors = append(c.errors, strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+// Write writes the report to w in a form intended for people.
+func (r *ConformanceReport) Write(w io.Writer) error {
+	var buf strings.Builder
+	files := make(map[string]bool)
+	failed := 0
+	for _, res := range r.Chunks {
+		files[res.File] = true
+		if !res.Passed() {
+			failed++
+		}
+	}
+	fmt.Fprintf(&buf, "%d chunks in %d files: %d passed, %d failed\n",
+		len(r.Chunks), len(files), len(r.Chunks)-failed, failed)
+	for _, res := range r.Chunks {
+		if !res.Passed() {
+			writeChunkResult(&buf, "FAIL", res)
+		}
+	}
+	for _, or := range r.Options {
+		fmt.Fprintf(&buf, "option %s: required by %d chunks; alters %d standard chunks\n",
+			or.Name, len(or.Required), len(or.Altered))
+		for _, res := range or.Altered {
+			writeChunkResult(&buf, "ALTERED", res)
+		}
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+func writeChunkResult(buf *strings.Builder, verb string, res *ChunkResult) {
+	fmt.Fprintf(buf, "\t%s %s:%d", verb, res.File, res.Line)
+	if len(res.Options) > 0 {
+		fmt.Fprintf(buf, " (options: %s)", strings.Join(res.Options, ", "))
+	}
+	if len(res.Errors) > 0 {
+		// Show the last line of a backtrace.
+		msg := res.Errors[0]
+		fmt.Fprintf(buf, ": %s", msg[strings.LastIndexByte(msg, '\n')+1:])
+	}
+	buf.WriteByte('\n')
+}
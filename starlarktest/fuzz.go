@@ -0,0 +1,299 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package starlarktest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+// Fuzz adds the specified seed inputs to the corpus of f, then runs the
+// Starlark function fn as its fuzz target, so that property-based tests
+// written in Starlark may run under 'go test -fuzz'.
+//
+// Each seed is a tuple of arguments to fn, and all seeds must have the
+// same number and types of elements. Their types determine the types of
+// the inputs generated by the fuzzer. The permitted element types are
+// string, bytes, int (which must fit in 64 bits), float, and bool.
+// Seeds are typically defined by the Starlark test file itself, for
+// example as a list of tuples alongside the target function.
+//
+// For each input, fn is called in the specified thread, whose reporter
+// is temporarily set to the testing.T of that input so that calls to
+// assert functions report errors against it. An evaluation error from
+// fn fails the input. The thread must not be used concurrently.
+func Fuzz(f *testing.F, thread *starlark.Thread, fn starlark.Callable, seeds ...starlark.Tuple) {
+	f.Helper()
+	if len(seeds) == 0 {
+		f.Fatalf("starlarktest.Fuzz: %s: no seed inputs", fn.Name())
+	}
+
+	// Derive the Go parameter types of the target from the first seed.
+	params := []reflect.Type{reflect.TypeOf((*testing.T)(nil))}
+	for i, arg := range seeds[0] {
+		t, err := fuzzType(arg)
+		if err != nil {
+			f.Fatalf("starlarktest.Fuzz: %s: seed 0, argument %d: %v", fn.Name(), i, err)
+		}
+		params = append(params, t)
+	}
+
+	for i, seed := range seeds {
+		if len(seed) != len(seeds[0]) {
+			f.Fatalf("starlarktest.Fuzz: %s: seed %d has %d arguments, want %d", fn.Name(), i, len(seed), len(seeds[0]))
+		}
+		goArgs := make([]interface{}, len(seed))
+		for j, arg := range seed {
+			v, err := fromStarlark(arg, params[j+1])
+			if err != nil {
+				f.Fatalf("starlarktest.Fuzz: %s: seed %d, argument %d: %v", fn.Name(), i, j, err)
+			}
+			goArgs[j] = v
+		}
+		f.Add(goArgs...)
+	}
+
+	target := reflect.MakeFunc(reflect.FuncOf(params, nil, false), func(in []reflect.Value) []reflect.Value {
+		t := in[0].Interface().(*testing.T)
+		args := make(starlark.Tuple, len(in)-1)
+		for i, v := range in[1:] {
+			args[i] = toStarlark(v)
+		}
+
+		prev := thread.Local(localKey)
+		SetReporter(thread, t)
+		defer thread.SetLocal(localKey, prev)
+
+		if _, err := starlark.Call(thread, fn, args, nil); err != nil {
+			reportError(t, err)
+		}
+		return nil
+	})
+	f.Fuzz(target.Interface())
+}
+
+// ReadCorpus reads the Go fuzzing corpus in the directory dir, such as
+// testdata/fuzz/FuzzName, and returns its entries as tuples, so that
+// Starlark test functions may be run over the inputs found by 'go test
+// -fuzz'. It is the converse of the seeds passed to Fuzz: each file is
+// one entry, and its values must be of the types Fuzz generates.
+// Entries are returned in file name order. A missing directory is an
+// empty corpus.
+func ReadCorpus(dir string) ([]starlark.Tuple, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var corpus []starlark.Tuple
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		filename := filepath.Join(dir, file.Name())
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := parseCorpusEntry(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		corpus = append(corpus, entry)
+	}
+	return corpus, nil
+}
+
+// corpusHeader is the first line of every file in a Go fuzzing corpus.
+const corpusHeader = "go test fuzz v1"
+
+// parseCorpusEntry parses the contents of a Go fuzzing corpus file,
+// one Go conversion expression such as string("x") per line.
+func parseCorpusEntry(data []byte) (starlark.Tuple, error) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, len(data)+1)
+	if !sc.Scan() || sc.Text() != corpusHeader {
+		return nil, fmt.Errorf("not a fuzzing corpus file (want %q header)", corpusHeader)
+	}
+	var entry starlark.Tuple
+	for line := 2; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		v, err := parseCorpusValue(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		entry = append(entry, v)
+	}
+	return entry, sc.Err()
+}
+
+// parseCorpusValue converts a line of a corpus file to a Starlark value.
+func parseCorpusValue(text string) (starlark.Value, error) {
+	expr, err := parser.ParseExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return nil, fmt.Errorf("got %s, want a conversion such as string(\"x\")", text)
+	}
+	arg := call.Args[0]
+
+	var typ string
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		typ = fun.Name
+	case *ast.ArrayType:
+		if elt, ok := fun.Elt.(*ast.Ident); ok && fun.Len == nil && elt.Name == "byte" {
+			typ = "[]byte"
+		}
+	case *ast.SelectorExpr:
+		// Non-finite floats are recorded as math.Float64frombits(0x...).
+		if pkg, ok := fun.X.(*ast.Ident); ok && pkg.Name == "math" && fun.Sel.Name == "Float64frombits" {
+			lit, ok := arg.(*ast.BasicLit)
+			if !ok || lit.Kind != token.INT {
+				break
+			}
+			bits, err := strconv.ParseUint(lit.Value, 0, 64)
+			if err != nil {
+				return nil, err
+			}
+			return starlark.Float(math.Float64frombits(bits)), nil
+		}
+	}
+
+	switch typ {
+	case "string", "[]byte":
+		lit, ok := arg.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			break
+		}
+		s, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			return nil, err
+		}
+		if typ == "string" {
+			return starlark.String(s), nil
+		}
+		return starlark.Bytes(s), nil
+	case "int64":
+		i, err := strconv.ParseInt(signedLiteral(arg, token.INT), 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.MakeInt64(i), nil
+	case "float64":
+		f, err := strconv.ParseFloat(signedLiteral(arg, token.FLOAT, token.INT), 64)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Float(f), nil
+	case "bool":
+		if id, ok := arg.(*ast.Ident); ok && (id.Name == "true" || id.Name == "false") {
+			return starlark.Bool(id.Name == "true"), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value %s", text)
+	}
+	return nil, fmt.Errorf("invalid %s value %s", typ, text)
+}
+
+// signedLiteral returns the text of the numeric literal x, with its
+// sign if negated, or "" if x is not a literal of one of the kinds.
+func signedLiteral(x ast.Expr, kinds ...token.Token) string {
+	sign := ""
+	if u, ok := x.(*ast.UnaryExpr); ok && u.Op == token.SUB {
+		sign, x = "-", u.X
+	}
+	if lit, ok := x.(*ast.BasicLit); ok {
+		for _, kind := range kinds {
+			if lit.Kind == kind {
+				return sign + lit.Value
+			}
+		}
+	}
+	return ""
+}
+
+// fuzzType returns the Go type used by the fuzzer to generate values
+// for the Starlark argument x.
+func fuzzType(x starlark.Value) (reflect.Type, error) {
+	switch x.(type) {
+	case starlark.String:
+		return reflect.TypeOf(""), nil
+	case starlark.Bytes:
+		return reflect.TypeOf([]byte(nil)), nil
+	case starlark.Int:
+		return reflect.TypeOf(int64(0)), nil
+	case starlark.Float:
+		return reflect.TypeOf(0.0), nil
+	case starlark.Bool:
+		return reflect.TypeOf(false), nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", x.Type())
+}
+
+// fromStarlark converts the Starlark seed argument x to a Go value of type t.
+func fromStarlark(x starlark.Value, t reflect.Type) (interface{}, error) {
+	if xt, err := fuzzType(x); err != nil {
+		return nil, err
+	} else if xt != t {
+		return nil, fmt.Errorf("got %s, want %s", x.Type(), t)
+	}
+	switch x := x.(type) {
+	case starlark.String:
+		return string(x), nil
+	case starlark.Bytes:
+		return []byte(x), nil
+	case starlark.Int:
+		i, ok := x.Int64()
+		if !ok {
+			return nil, fmt.Errorf("int %s out of range", x)
+		}
+		return i, nil
+	case starlark.Float:
+		return float64(x), nil
+	case starlark.Bool:
+		return bool(x), nil
+	}
+	panic(x)
+}
+
+// toStarlark converts a fuzzer-generated Go value to a Starlark value.
+func toStarlark(v reflect.Value) starlark.Value {
+	switch v := v.Interface().(type) {
+	case string:
+		return starlark.String(v)
+	case []byte:
+		return starlark.Bytes(v)
+	case int64:
+		return starlark.MakeInt64(v)
+	case float64:
+		return starlark.Float(v)
+	case bool:
+		return starlark.Bool(v)
+	}
+	panic(v)
+}
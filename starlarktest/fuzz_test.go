@@ -0,0 +1,116 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package starlarktest_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarktest"
+)
+
+const fuzzSrc = `
+load("assert.star", "assert")
+
+seeds = [("", 0), ("a|b", 1), ("|", -1)]
+
+def check(s, n):
+    assert.eq("|".join(s.split("|")), s)
+    assert.eq(int(str(n)), n)
+`
+
+// loadFuzzTarget executes fuzzSrc and returns its thread and globals.
+func loadFuzzTarget(tb testing.TB) (*starlark.Thread, starlark.StringDict) {
+	thread := &starlark.Thread{
+		Load: func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
+			return starlarktest.LoadAssertModule()
+		},
+	}
+	starlarktest.SetReporter(thread, tb)
+	globals, err := starlark.ExecFile(thread, "fuzz.star", fuzzSrc, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return thread, globals
+}
+
+// FuzzStarlark runs check over the seeds of fuzz.star and the corpus in
+// testdata/fuzz/FuzzStarlark.
+func FuzzStarlark(f *testing.F) {
+	thread, globals := loadFuzzTarget(f)
+	var seeds []starlark.Tuple
+	iter := starlark.Iterate(globals["seeds"])
+	defer iter.Done()
+	var x starlark.Value
+	for iter.Next(&x) {
+		seeds = append(seeds, x.(starlark.Tuple))
+	}
+	starlarktest.Fuzz(f, thread, globals["check"].(starlark.Callable), seeds...)
+}
+
+func TestReadCorpus(t *testing.T) {
+	corpus, err := starlarktest.ReadCorpus("testdata/fuzz/FuzzStarlark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range corpus {
+		got = append(got, entry.String())
+	}
+	want := []string{
+		`("a|b|", -42)`,
+		`("\x00\xff☺", 9223372036854775807)`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ReadCorpus returned %d entries %v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+
+	// The corpus may be passed back to a Starlark test function.
+	thread, globals := loadFuzzTarget(t)
+	for _, entry := range corpus {
+		if _, err := starlark.Call(thread, globals["check"], entry, nil); err != nil {
+			t.Errorf("check%s: %v", entry, err)
+		}
+	}
+
+	// Each type generated by Fuzz may appear in a corpus file.
+	dir := t.TempDir()
+	const data = "go test fuzz v1\n[]byte(\"\\x01\")\nfloat64(-1.5)\nfloat64(3)\nmath.Float64frombits(0x7ff0000000000000)\nbool(true)\n"
+	if err := os.WriteFile(filepath.Join(dir, "types"), []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	corpus, err = starlarktest.ReadCorpus(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(corpus), `[(b"\x01", -1.5, 3.0, +inf, True)]`; got != want {
+		t.Errorf("ReadCorpus = %s, want %s", got, want)
+	}
+
+	// A malformed file is an error.
+	if err := os.WriteFile(filepath.Join(dir, "types"), []byte("go test fuzz v1\nint(1)\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := starlarktest.ReadCorpus(dir); err == nil || !strings.Contains(err.Error(), "line 2: unsupported value int(1)") {
+		t.Errorf("ReadCorpus of malformed file: got error %v", err)
+	}
+
+	// A missing corpus is empty.
+	if corpus, err := starlarktest.ReadCorpus("testdata/fuzz/FuzzMissing"); err != nil || corpus != nil {
+		t.Errorf("ReadCorpus of missing directory = %v, %v, want nil, nil", corpus, err)
+	}
+}
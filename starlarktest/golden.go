@@ -0,0 +1,141 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// UpdateGolden causes assert.golden to write the rendered form of each
+// value to its golden file instead of comparing against it.
+// Tests typically set it from a command-line flag:
+//
+//	flag.BoolVar(&starlarktest.UpdateGolden, "update", false, "update golden files")
+var UpdateGolden = false
+
+// goldenOptions determines the rendered form of non-string values
+// compared by assert.golden.
+var goldenOptions = starlark.PrettyOptions{Width: 80}
+
+// golden(name, value) compares the rendered form of value against the
+// contents of the file name + ".golden" in the directory of the calling
+// file, reporting an error if they differ. A string value is rendered
+// as its contents; other values are rendered by PrettyPrint.
+// If UpdateGolden is set, it writes the file instead.
+func golden(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var value starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &name, &value); err != nil {
+		return nil, err
+	}
+	if name == "" || filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+		return nil, fmt.Errorf("%s: invalid golden file name %q", b.Name(), name)
+	}
+
+	var got string
+	if s, ok := starlark.AsString(value); ok {
+		got = s
+	} else {
+		got = starlark.PrettyPrint(value, goldenOptions) + "\n"
+	}
+
+	stk := thread.CallStack()
+	stk.Pop()
+	dir := filepath.Dir(stk.At(0).Pos.Filename())
+	filename := filepath.Join(dir, name+".golden")
+
+	if UpdateGolden {
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(got), 0666); err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		return starlark.None, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			reportf(thread, stk, "golden file %s does not exist (set UpdateGolden to create it)", filename)
+			return starlark.None, nil
+		}
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	if want := string(data); got != want {
+		reportf(thread, stk, "value does not match golden file %s (-want +got):\n%s", filename, lineDiff(want, got))
+	}
+	return starlark.None, nil
+}
+
+// reportf reports an error, preceded by the specified call stack,
+// to the thread's reporter.
+func reportf(thread *starlark.Thread, stk starlark.CallStack, format string, args ...interface{}) {
+	GetReporter(thread).Error(fmt.Sprintf("%sError: ", stk) + fmt.Sprintf(format, args...))
+}
+
+// lineDiff returns a line-oriented description of the differences
+// between x and y, in which each line is prefixed by "-" if it appears
+// only in x, "+" if only in y, or " " if in both.
+func lineDiff(x, y string) string {
+	xs := strings.SplitAfter(x, "\n")
+	ys := strings.SplitAfter(y, "\n")
+
+	// lcs[i][j] is the length of the longest common
+	// subsequence of xs[i:] and ys[j:].
+	lcs := make([][]int, len(xs)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(ys)+1)
+	}
+	for i := len(xs) - 1; i >= 0; i-- {
+		for j := len(ys) - 1; j >= 0; j-- {
+			if xs[i] == ys[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	buf := new(strings.Builder)
+	line := func(prefix, s string) {
+		if s == "" {
+			return // final empty line after trailing newline
+		}
+		buf.WriteString(prefix)
+		buf.WriteString(strings.TrimSuffix(s, "\n"))
+		buf.WriteByte('\n')
+	}
+	i, j := 0, 0
+	for i < len(xs) && j < len(ys) {
+		switch {
+		case xs[i] == ys[j]:
+			line(" ", xs[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			line("-", xs[i])
+			i++
+		default:
+			line("+", ys[j])
+			j++
+		}
+	}
+	for ; i < len(xs); i++ {
+		line("-", xs[i])
+	}
+	for ; j < len(ys); j++ {
+		line("+", ys[j])
+	}
+	return buf.String()
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+// A Runner runs Starlark test files as Go tests.
+//
+// Each file runs as a subtest, named by the file, in a Thread of its
+// own with its own cache of loaded modules. After the toplevel
+// statements of a file have been executed and its globals frozen, each
+// global function whose name begins with "test_" is called with no
+// arguments as a further subtest, also in a Thread of its own.
+// Evaluation errors are reported, with their backtraces, as failures of
+// the enclosing subtest.
+type Runner struct {
+	// Predeclared is the predeclared environment of each file.
+	// If Parallel is set, its values must be frozen.
+	Predeclared starlark.StringDict
+
+	// Load, if non-nil, loads the modules of a file other than
+	// "assert.star", which is always the assert module. It is called
+	// at most once for each module name within a file; results are not
+	// shared between files. The default implementation executes the
+	// named file, relative to the directory of the test file, with the
+	// same predeclared environment.
+	Load func(thread *starlark.Thread, module string) (starlark.StringDict, error)
+
+	// Parallel causes each file, and each test function within a file,
+	// to run in parallel with the others, subject to the -parallel flag
+	// of 'go test'. Tests that mutate shared state, such as Stub or the
+	// options of the resolve package, must not run in parallel.
+	Parallel bool
+
+	// Coverage, if non-nil, records the lines executed by each file,
+	// its test functions, and the modules it loads, other than the
+	// assert module, which is excluded. A Coverage shared
+	// by several Runners or calls to Run accumulates their coverage.
+	Coverage *starlark.Coverage
+
+	// CoverProfile, if non-empty, is the name of a file to which the
+	// Coverage is written, in the format of a Go coverage profile,
+	// once all the tests of a call to Run have completed. A summary
+	// like that of 'go test -cover' is also logged to the test.
+	CoverProfile string
+}
+
+// Run runs each of the specified Starlark files as a subtest of t.
+func (r *Runner) Run(t *testing.T, filenames ...string) {
+	t.Helper()
+	if r.Coverage != nil {
+		r.Coverage.Exclude("assert.star")
+	}
+	if r.Coverage != nil && r.CoverProfile != "" {
+		t.Cleanup(func() {
+			if err := r.writeCoverProfile(); err != nil {
+				t.Error(err)
+				return
+			}
+			t.Logf("coverage: %.1f%% of Starlark lines", r.Coverage.Percent())
+		})
+	}
+	for _, filename := range filenames {
+		filename := filename
+		t.Run(filepath.Base(filename), func(t *testing.T) {
+			if r.Parallel {
+				t.Parallel()
+			}
+			r.runFile(t, filename)
+		})
+	}
+}
+
+func (r *Runner) runFile(t *testing.T, filename string) {
+	thread := r.newThread("exec "+filename, filename)
+	SetReporter(thread, t)
+	globals, err := starlark.ExecFile(thread, filename, nil, r.Predeclared)
+	if err != nil {
+		reportError(t, err)
+		return
+	}
+
+	for _, name := range globals.Keys() {
+		fn, ok := globals[name].(*starlark.Function)
+		if !ok || !strings.HasPrefix(name, "test_") {
+			continue
+		}
+		name := name
+		t.Run(name, func(t *testing.T) {
+			if r.Parallel {
+				t.Parallel()
+			}
+			thread := r.newThread(name, filename)
+			SetReporter(thread, t)
+			if _, err := starlark.Call(thread, fn, nil, nil); err != nil {
+				reportError(t, err)
+			}
+		})
+	}
+}
+
+// newThread returns a new thread with its own module cache for
+// executing the specified file.
+func (r *Runner) newThread(name, filename string) *starlark.Thread {
+	type entry struct {
+		globals starlark.StringDict
+		err     error
+	}
+	cache := make(map[string]*entry)
+
+	load := r.Load
+	if load == nil {
+		dir := filepath.Dir(filename)
+		load = func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+			return starlark.ExecFile(thread, filepath.Join(dir, module), nil, r.Predeclared)
+		}
+	}
+
+	return &starlark.Thread{
+		Name:     name,
+		Coverage: r.Coverage,
+		Load: func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+			if module == "assert.star" {
+				return LoadAssertModule()
+			}
+			e, ok := cache[module]
+			if e == nil {
+				if ok {
+					// request for module whose loading is in progress
+					return nil, fmt.Errorf("cycle in load graph")
+				}
+				cache[module] = nil // placeholder to indicate "load in progress"
+				globals, err := load(thread, module)
+				e = &entry{globals, err}
+				cache[module] = e
+			}
+			return e.globals, e.err
+		},
+	}
+}
+
+func (r *Runner) writeCoverProfile() error {
+	f, err := os.Create(r.CoverProfile)
+	if err != nil {
+		return err
+	}
+	if err := r.Coverage.WriteProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reportError reports an evaluation error, with its backtrace if any.
+func reportError(r Reporter, err error) {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		r.Error(evalErr.Backtrace())
+	} else {
+		r.Error(err)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktest_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarktest"
+)
+
+func TestRunnerParallel(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "parallel.star")
+	const src = `
+def test_a(): record("a")
+def test_b(): record("b")
+def test_c(): record("c")
+`
+	if err := os.WriteFile(filename, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	record := func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		ran = append(ran, thread.Name+":"+name)
+		mu.Unlock()
+		return starlark.None, nil
+	}
+	r := &starlarktest.Runner{
+		Predeclared: starlark.StringDict{"record": starlark.NewBuiltin("record", record)},
+		Parallel:    true,
+	}
+	// Parallel subtests complete before the enclosing subtest returns.
+	t.Run("run", func(t *testing.T) { r.Run(t, filename) })
+
+	sort.Strings(ran)
+	if got, want := strings.Join(ran, " "), "test_a:a test_b:b test_c:c"; got != want {
+		t.Errorf("test functions run (thread:function): %s, want %s", got, want)
+	}
+}
@@ -10,6 +10,26 @@
 //
 // The assert.error function, which reports errors to the current Go
 // testing.T, requires that clients call SetReporter(thread, t) before use.
+//
+// The assert.cases function runs a test function once for each of a
+// list of parameterized cases. If the reporter is a *testing.T, each
+// case runs as a separate Go subtest.
+//
+// The assert.golden function compares a value against the contents of
+// a golden file; see UpdateGolden.
+//
+// The Stub function and Mock type replace built-in functions or module
+// members for the duration of a test, so that programs that depend on
+// external resources may be tested hermetically.
+//
+// A Runner runs Starlark test files and their test_* functions as Go
+// subtests, optionally in parallel.
+//
+// The RunBenchmarks function runs the bench_* functions of a Starlark
+// file as Go sub-benchmarks.
+//
+// The Fuzz function runs a Starlark function as a Go fuzz target, and
+// ReadCorpus returns the inputs of a Go fuzzing corpus as Starlark values.
 package starlarktest // import "go.starlark.net/starlarktest"
 
 import (
@@ -20,6 +40,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"testing"
 
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -50,6 +71,13 @@ func GetReporter(thread *starlark.Thread) Reporter {
 	return r
 }
 
+// A SubtestReporter is a Reporter that can run named subtests.
+// It is satisfied by *testing.T.
+type SubtestReporter interface {
+	Reporter
+	Run(name string, f func(t *testing.T)) bool
+}
+
 var (
 	once   sync.Once
 	assert starlark.StringDict
@@ -66,6 +94,9 @@ func LoadAssertModule() (starlark.StringDict, error) {
 			"error":   starlark.NewBuiltin("error", error_),
 			"catch":   starlark.NewBuiltin("catch", catch),
 			"matches": starlark.NewBuiltin("matches", matches),
+			"subtest": starlark.NewBuiltin("subtest", subtest),
+			"golden":  starlark.NewBuiltin("golden", golden),
+			"diff":    starlark.NewBuiltin("diff", diff),
 			"module":  starlark.NewBuiltin("module", starlarkstruct.MakeModule),
 			"_freeze": starlark.NewBuiltin("freeze", freeze),
 		}
@@ -101,6 +132,63 @@ func matches(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple,
 	return starlark.Bool(ok), nil
 }
 
+// subtest(name, fn) calls fn() as a subtest of the current test.
+// If the reporter is a SubtestReporter, fn runs as a Go subtest whose
+// reporter is the subtest's testing.T; otherwise errors are reported
+// to the current reporter, prefixed by the subtest name.
+// An evaluation error in fn is reported, with its backtrace, as a
+// failure of the subtest alone.
+func subtest(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var fn starlark.Callable
+	if err := starlark.UnpackArgs("subtest", args, kwargs, "name", &name, "fn", &fn); err != nil {
+		return nil, err
+	}
+
+	parent := GetReporter(thread)
+	defer SetReporter(thread, parent)
+
+	run := func(r Reporter) {
+		SetReporter(thread, r)
+		if _, err := starlark.Call(thread, fn, nil, nil); err != nil {
+			reportError(r, err)
+		}
+	}
+	if st, ok := parent.(SubtestReporter); ok {
+		st.Run(name, func(t *testing.T) { run(t) })
+	} else {
+		run(prefixReporter{name + ": ", parent})
+	}
+	return starlark.None, nil
+}
+
+// A prefixReporter reports errors to another Reporter
+// after prefixing them with a fixed string.
+type prefixReporter struct {
+	prefix string
+	r      Reporter
+}
+
+func (p prefixReporter) Error(args ...interface{}) {
+	p.r.Error(p.prefix + fmt.Sprint(args...))
+}
+
+// diff(x, y) returns a line-oriented description of the differences
+// between the pretty-printed forms of x and y, or "" if both fit on a
+// single line, in which case the values themselves are more readable.
+func diff(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x, y starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &x, &y); err != nil {
+		return nil, err
+	}
+	xs := starlark.PrettyPrint(x, goldenOptions)
+	ys := starlark.PrettyPrint(y, goldenOptions)
+	if !strings.Contains(xs, "\n") && !strings.Contains(ys, "\n") {
+		return starlark.String(""), nil
+	}
+	return starlark.String(lineDiff(ys, xs)), nil
+}
+
 // error(x) reports an error to the Go test framework.
 func error_(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	if len(args) != 1 {
@@ -0,0 +1,89 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktest
+
+import (
+	"fmt"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+// Stub sets env[name] to v for the duration of the test tb, restoring
+// the previous value (or absence) of env[name] when the test and its
+// subtests complete.
+//
+// The environment may be the predeclared environment of a program
+// under test, starlark.Universe, or the members of a loaded module such
+// as a starlarkstruct.Module, since the interpreter consults these
+// dictionaries each time a predeclared or universal name is used or a
+// module member is selected. Stubbing a member of a module has no
+// effect on names already bound by a load statement.
+//
+// Stub must not be called while the environment is in use by another
+// goroutine, such as a parallel test.
+func Stub(tb testing.TB, env starlark.StringDict, name string, v starlark.Value) {
+	tb.Helper()
+	prev, ok := env[name]
+	env[name] = v
+	tb.Cleanup(func() {
+		if ok {
+			env[name] = prev
+		} else {
+			delete(env, name)
+		}
+	})
+}
+
+// A Mock is a callable Starlark value that records each call made to
+// it, for use as a stub of a built-in function. It returns the result
+// of calling Func, if non-nil, or Result otherwise.
+//
+// A Mock is not safe for concurrent use.
+type Mock struct {
+	name string
+
+	// Result is the result of each call when Func is nil.
+	// If nil, None is returned.
+	Result starlark.Value
+
+	// Func, if non-nil, computes the result of each call.
+	Func starlark.Callable
+
+	// Calls records the arguments of each call, in order.
+	Calls []MockCall
+}
+
+// A MockCall records the arguments of a call to a Mock.
+type MockCall struct {
+	Args   starlark.Tuple
+	Kwargs []starlark.Tuple
+}
+
+var _ starlark.Callable = (*Mock)(nil)
+
+// NewMock returns a new Mock with the specified name, which returns
+// result from each call.
+func NewMock(name string, result starlark.Value) *Mock {
+	return &Mock{name: name, Result: result}
+}
+
+func (m *Mock) Name() string          { return m.name }
+func (m *Mock) String() string        { return fmt.Sprintf("<mock %s>", m.name) }
+func (m *Mock) Type() string          { return "builtin_function_or_method" }
+func (m *Mock) Freeze()               {} // calls are recorded even when frozen
+func (m *Mock) Truth() starlark.Bool  { return true }
+func (m *Mock) Hash() (uint32, error) { return starlark.String(m.name).Hash() }
+
+func (m *Mock) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	m.Calls = append(m.Calls, MockCall{args, kwargs})
+	if m.Func != nil {
+		return starlark.Call(thread, m.Func, args, kwargs)
+	}
+	if m.Result == nil {
+		return starlark.None, nil
+	}
+	return m.Result, nil
+}
@@ -0,0 +1,662 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkwasm
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"go.starlark.net/internal/compile"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// A Host implements the functions imported by a module produced by
+// Compile for a particular program, and holds the program's global
+// variables and the values denoted by handles.
+//
+// The module refers to values by handles, which the host allocates as
+// it executes imported functions. Handles created during a call of a
+// Starlark function are released when the call returns; those created
+// by the toplevel code, or by a long-running loop within a single
+// function, are retained until it returns.
+//
+// A Host, like a Thread, is not safe for concurrent use.
+type Host struct {
+	// Invoke calls the named exported function of the module
+	// instance with the specified parameters, and returns its result.
+	// It must permit reentrant calls: an imported function may
+	// invoke another exported function before it returns.
+	// Invoke reports an error only if execution traps.
+	Invoke func(export string, params []int32) (int32, error)
+
+	prog        *compile.Program
+	predeclared starlark.StringDict
+	constants   []starlark.Value
+	globals     []starlark.Value
+	thread      *starlark.Thread // thread of current call
+
+	values []starlark.Value    // values denoted by handles; values[0] is nil
+	iters  []starlark.Iterator // active iterators, indexed by iterator handle
+	args   []starlark.Value    // values staged by push
+	elems  []starlark.Value    // results of last unpack
+	err    error               // error of the failed imported function
+}
+
+// NewHost returns a host for the module compiled from prog, whose
+// predeclared names are defined by predeclared, and that executes the
+// module using the specified function (see Host.Invoke).
+func NewHost(prog *starlark.Program, predeclared starlark.StringDict, invoke func(export string, params []int32) (int32, error)) (*Host, error) {
+	compiled, err := decode(prog)
+	if err != nil {
+		return nil, err
+	}
+	constants := make([]starlark.Value, len(compiled.Constants))
+	for i, c := range compiled.Constants {
+		switch c := c.(type) {
+		case int64:
+			constants[i] = starlark.MakeInt64(c)
+		case *big.Int:
+			constants[i] = starlark.MakeBigInt(c)
+		case string:
+			constants[i] = starlark.String(c)
+		case compile.Bytes:
+			constants[i] = starlark.Bytes(c)
+		case float64:
+			constants[i] = starlark.Float(c)
+		default:
+			return nil, fmt.Errorf("unexpected constant %T: %v", c, c)
+		}
+	}
+	return &Host{
+		Invoke:      invoke,
+		prog:        compiled,
+		predeclared: predeclared,
+		constants:   constants,
+		globals:     make([]starlark.Value, len(compiled.Globals)),
+		values:      []starlark.Value{nil},
+	}, nil
+}
+
+// Imports returns the functions the module imports from the module
+// "starlark", keyed by name. Each is a Go function whose parameters
+// and results are of type int32, suitable for registration with a
+// WebAssembly runtime that binds host functions by reflection.
+func (h *Host) Imports() map[string]interface{} {
+	return map[string]interface{}{
+		"value":     h.value,
+		"setglobal": h.setglobal,
+		"unbound":   h.unbound,
+		"unary":     h.unary,
+		"binary":    h.binary,
+		"truth":     h.truth,
+		"push":      h.push,
+		"call":      h.call,
+		"collect":   h.collect,
+		"makefunc":  h.makefunc,
+		"iterate":   h.iterate,
+		"next":      h.next,
+		"done":      h.done,
+		"attr":      h.attr,
+		"setfield":  h.setfield,
+		"delfield":  h.delfield,
+		"index":     h.index,
+		"setindex":  h.setindex,
+		"delindex":  h.delindex,
+		"slice":     h.slice,
+		"setdict":   h.setdict,
+		"append":    h.append,
+		"unpack":    h.unpack,
+		"elem":      h.elem,
+	}
+}
+
+// Init executes the toplevel code of the program in the specified
+// thread, and returns a new, unfrozen dictionary of its globals,
+// as for starlark.Program.Init. Functions defined by the program are
+// executed by the module when called.
+func (h *Host) Init(thread *starlark.Thread) (starlark.StringDict, error) {
+	toplevel := &Function{host: h, funcode: h.prog.Toplevel}
+	_, err := starlark.Call(thread, toplevel, nil, nil)
+
+	// We return a (partial) map even in case of error.
+	globals := make(starlark.StringDict, len(h.globals))
+	for i, v := range h.globals {
+		if v != nil {
+			globals[h.prog.Globals[i].Name] = v
+		}
+	}
+	return globals, err
+}
+
+// handle returns a new handle for v.
+func (h *Host) handle(v starlark.Value) int32 {
+	if v == nil {
+		return 0
+	}
+	h.values = append(h.values, v)
+	return int32(len(h.values) - 1)
+}
+
+// fail records the error of an imported function, and returns -1.
+func (h *Host) fail(err error) int32 {
+	h.err = err
+	return -1
+}
+
+// status returns the result of an imported function
+// that returns no value and may fail.
+func (h *Host) status(err error) int32 {
+	if err != nil {
+		return h.fail(err)
+	}
+	return 0
+}
+
+// result returns the result of an imported function that returns a value.
+func (h *Host) result(v starlark.Value, err error) int32 {
+	if err != nil {
+		return h.fail(err)
+	}
+	return h.handle(v)
+}
+
+// funcode returns the function of the specified index,
+// counting the toplevel function as zero.
+func (h *Host) funcode(index int32) *compile.Funcode {
+	if index == 0 {
+		return h.prog.Toplevel
+	}
+	return h.prog.Functions[index-1]
+}
+
+func (h *Host) value(op, arg int32) int32 {
+	switch compile.Opcode(op) {
+	case compile.NONE:
+		return h.handle(starlark.None)
+	case compile.TRUE:
+		return h.handle(starlark.True)
+	case compile.FALSE:
+		return h.handle(starlark.False)
+	case compile.MANDATORY:
+		return h.handle(mandatory{})
+	case compile.MAKEDICT:
+		return h.handle(new(starlark.Dict))
+	case compile.CONSTANT:
+		return h.handle(h.constants[arg])
+	case compile.GLOBAL:
+		x := h.globals[arg]
+		if x == nil {
+			return h.fail(fmt.Errorf("global variable %s referenced before assignment", h.prog.Globals[arg].Name))
+		}
+		return h.handle(x)
+	case compile.PREDECLARED:
+		name := h.prog.Names[arg]
+		x := h.predeclared[name]
+		if x == nil {
+			return h.fail(fmt.Errorf("internal error: predeclared variable %s is uninitialized", name))
+		}
+		return h.handle(x)
+	case compile.UNIVERSAL:
+		return h.handle(starlark.Universe[h.prog.Names[arg]])
+	}
+	return h.fail(fmt.Errorf("internal error: invalid value operation %d", op))
+}
+
+func (h *Host) setglobal(index, x int32) {
+	h.globals[index] = h.values[x]
+}
+
+func (h *Host) unbound(fn, local int32) {
+	h.err = fmt.Errorf("local variable %s referenced before assignment", h.funcode(fn).Locals[local].Name)
+}
+
+func (h *Host) unary(op, x int32) int32 {
+	var unop syntax.Token
+	switch compile.Opcode(op) {
+	case compile.NOT:
+		return h.handle(!h.values[x].Truth())
+	case compile.UPLUS:
+		unop = syntax.PLUS
+	case compile.UMINUS:
+		unop = syntax.MINUS
+	case compile.TILDE:
+		unop = syntax.TILDE
+	default:
+		return h.fail(fmt.Errorf("internal error: invalid unary operation %d", op))
+	}
+	return h.result(starlark.Unary(unop, h.values[x]))
+}
+
+func (h *Host) binary(op, x, y int32) int32 {
+	xv, yv := h.values[x], h.values[y]
+	switch op := compile.Opcode(op); op {
+	case compile.EQL, compile.NEQ, compile.GT, compile.LT, compile.LE, compile.GE:
+		ok, err := starlark.Compare(syntax.Token(op-compile.EQL)+syntax.EQL, xv, yv)
+		return h.result(starlark.Bool(ok), err)
+	case compile.IN:
+		return h.result(starlark.Binary(syntax.IN, xv, yv))
+	case compile.INPLACE_ADD:
+		return h.result(starlark.InplaceBinary(syntax.PLUS, xv, yv))
+	case compile.INPLACE_PIPE:
+		return h.result(starlark.InplaceBinary(syntax.PIPE, xv, yv))
+	default:
+		if compile.PLUS <= op && op <= compile.GTGT {
+			return h.result(starlark.Binary(syntax.Token(op-compile.PLUS)+syntax.PLUS, xv, yv))
+		}
+	}
+	return h.fail(fmt.Errorf("internal error: invalid binary operation %d", op))
+}
+
+func (h *Host) truth(x int32) int32 {
+	if h.values[x].Truth() {
+		return 1
+	}
+	return 0
+}
+
+func (h *Host) push(x int32) {
+	h.args = append(h.args, h.values[x])
+}
+
+// staged returns and clears the values staged by push.
+func (h *Host) staged() []starlark.Value {
+	args := append([]starlark.Value(nil), h.args...)
+	h.args = h.args[:0]
+	return args
+}
+
+func (h *Host) call(op, arg, fn int32) int32 {
+	stack := h.staged()
+
+	var kwargs starlark.Value
+	if op := compile.Opcode(op); op == compile.CALL_KW || op == compile.CALL_VAR_KW {
+		kwargs = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+	var args starlark.Value
+	if op := compile.Opcode(op); op == compile.CALL_VAR || op == compile.CALL_VAR_KW {
+		args = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+
+	// named args (pairs)
+	npos := int(arg >> 8)
+	var kvpairs []starlark.Tuple
+	for i := npos; i < len(stack); i += 2 {
+		kvpairs = append(kvpairs, starlark.Tuple{stack[i], stack[i+1]})
+	}
+	if kwargs != nil {
+		// Add key/value items from **kwargs dictionary.
+		dict, ok := kwargs.(starlark.IterableMapping)
+		if !ok {
+			return h.fail(fmt.Errorf("argument after ** must be a mapping, not %s", kwargs.Type()))
+		}
+		items := dict.Items()
+		for _, item := range items {
+			if _, ok := item[0].(starlark.String); !ok {
+				return h.fail(fmt.Errorf("keywords must be strings, not %s", item[0].Type()))
+			}
+		}
+		kvpairs = append(kvpairs, items...)
+	}
+
+	// positional args
+	positional := starlark.Tuple(stack[:npos])
+	if args != nil {
+		// Add elements from *args sequence.
+		iter := starlark.Iterate(args)
+		if iter == nil {
+			return h.fail(fmt.Errorf("argument after * must be iterable, not %s", args.Type()))
+		}
+		var elem starlark.Value
+		for iter.Next(&elem) {
+			positional = append(positional, elem)
+		}
+		err := iterErr(iter)
+		iter.Done()
+		if err != nil {
+			return h.fail(err)
+		}
+	}
+
+	return h.result(starlark.Call(h.thread, h.values[fn], positional, kvpairs))
+}
+
+func (h *Host) collect(op, n int32) int32 {
+	elems := h.staged()
+	if compile.Opcode(op) == compile.MAKETUPLE {
+		return h.handle(starlark.Tuple(elems))
+	}
+	return h.handle(starlark.NewList(elems))
+}
+
+func (h *Host) makefunc(index, defaults int32) int32 {
+	tuple, ok := h.values[defaults].(starlark.Tuple)
+	funcode := h.prog.Functions[index]
+	if !ok || len(funcode.Freevars) > 0 {
+		return h.fail(fmt.Errorf("internal error: invalid %s operand", compile.MAKEFUNC))
+	}
+	return h.handle(&Function{host: h, funcode: funcode, index: int(index) + 1, defaults: tuple})
+}
+
+func (h *Host) iterate(x int32) int32 {
+	iter := starlark.Iterate(h.values[x])
+	if iter == nil {
+		return h.fail(fmt.Errorf("%s value is not iterable", h.values[x].Type()))
+	}
+	h.iters = append(h.iters, iter)
+	return int32(len(h.iters) - 1)
+}
+
+func (h *Host) next(iter int32) int32 {
+	var elem starlark.Value
+	if h.iters[iter].Next(&elem) {
+		return h.handle(elem)
+	}
+	if err := iterErr(h.iters[iter]); err != nil {
+		return h.fail(err)
+	}
+	return 0
+}
+
+func (h *Host) done(iter int32) {
+	if it := h.iters[iter]; it != nil {
+		it.Done()
+		h.iters[iter] = nil
+	}
+}
+
+func (h *Host) attr(x, name int32) int32 {
+	return h.result(starlark.Attr(h.values[x], h.prog.Names[name]))
+}
+
+func (h *Host) setfield(x, name, y int32) int32 {
+	return h.status(starlark.SetField(h.values[x], h.prog.Names[name], h.values[y]))
+}
+
+func (h *Host) delfield(x, name int32) int32 {
+	return h.status(starlark.DelField(h.values[x], h.prog.Names[name]))
+}
+
+func (h *Host) index(x, y int32) int32 {
+	return h.result(starlark.Index(h.values[x], h.values[y]))
+}
+
+func (h *Host) setindex(x, y, z int32) int32 {
+	return h.status(starlark.SetIndex(h.values[x], h.values[y], h.values[z]))
+}
+
+func (h *Host) delindex(x, y int32) int32 {
+	return h.status(starlark.DelIndex(h.values[x], h.values[y]))
+}
+
+func (h *Host) slice(x, lo, hi, step int32) int32 {
+	return h.result(starlark.Slice(h.values[x], h.values[lo], h.values[hi], h.values[step]))
+}
+
+func (h *Host) setdict(op, d, k, v int32) int32 {
+	dict, ok := h.values[d].(*starlark.Dict)
+	if !ok {
+		return h.fail(fmt.Errorf("internal error: %s operand is %s, want dict", compile.Opcode(op), h.values[d].Type()))
+	}
+	oldlen := dict.Len()
+	if err := dict.SetKey(h.values[k], h.values[v]); err != nil {
+		return h.fail(err)
+	}
+	if compile.Opcode(op) == compile.SETDICTUNIQ && dict.Len() == oldlen {
+		return h.fail(fmt.Errorf("duplicate key: %v", h.values[k]))
+	}
+	return 0
+}
+
+func (h *Host) append(l, x int32) int32 {
+	list, ok := h.values[l].(*starlark.List)
+	if !ok {
+		return h.fail(fmt.Errorf("internal error: %s operand is %s, want list", compile.APPEND, h.values[l].Type()))
+	}
+	return h.status(list.Append(h.values[x]))
+}
+
+func (h *Host) unpack(x, n int32) int32 {
+	iterable := h.values[x]
+	iter := starlark.Iterate(iterable)
+	if iter == nil {
+		return h.fail(fmt.Errorf("got %s in sequence assignment", iterable.Type()))
+	}
+	defer iter.Done()
+	h.elems = h.elems[:0]
+	var elem starlark.Value
+	for len(h.elems) < int(n) && iter.Next(&elem) {
+		h.elems = append(h.elems, elem)
+	}
+	var dummy starlark.Value
+	if iter.Next(&dummy) {
+		// NB: Len may return -1 here in obscure cases.
+		return h.fail(fmt.Errorf("too many values to unpack (got %d, want %d)", starlark.Len(iterable), n))
+	}
+	if err := iterErr(iter); err != nil {
+		return h.fail(err)
+	}
+	if len(h.elems) < int(n) {
+		return h.fail(fmt.Errorf("too few values to unpack (got %d, want %d)", len(h.elems), n))
+	}
+	return 0
+}
+
+func (h *Host) elem(i int32) int32 {
+	return h.handle(h.elems[i])
+}
+
+// iterErr returns the error, if any, that ended the sequence of iter.
+func iterErr(iter starlark.Iterator) error {
+	if iter, ok := iter.(starlark.ErrIterator); ok {
+		return iter.Err()
+	}
+	return nil
+}
+
+// A Function is a Starlark function executed by a WebAssembly module.
+type Function struct {
+	host     *Host
+	funcode  *compile.Funcode
+	index    int            // index of module export
+	defaults starlark.Tuple // default values of optional parameters
+}
+
+var _ starlark.Callable = (*Function)(nil)
+
+func (fn *Function) Name() string          { return fn.funcode.Name }
+func (fn *Function) String() string        { return fmt.Sprintf("<function %s>", fn.Name()) }
+func (fn *Function) Type() string          { return "function" }
+func (fn *Function) Freeze()               { fn.defaults.Freeze() }
+func (fn *Function) Truth() starlark.Bool  { return true }
+func (fn *Function) Hash() (uint32, error) { return starlark.String(fn.Name()).Hash() }
+
+func (fn *Function) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if !resolve.AllowRecursion {
+		// detect recursion
+		for depth := 1; depth < thread.CallStackDepth(); depth++ {
+			if caller, ok := thread.DebugFrame(depth).Callable().(*Function); ok && caller.funcode == fn.funcode {
+				return nil, fmt.Errorf("function %s called recursively", fn.Name())
+			}
+		}
+	}
+
+	locals := make([]starlark.Value, len(fn.funcode.Locals))
+	if err := fn.setArgs(locals, args, kwargs); err != nil {
+		return nil, err
+	}
+
+	h := fn.host
+	prev := h.thread
+	h.thread = thread
+	defer func() { h.thread = prev }()
+
+	// Release the handles and iterators created by the call.
+	mark, itermark := len(h.values), len(h.iters)
+	defer func() {
+		for i := mark; i < len(h.values); i++ {
+			h.values[i] = nil // aid GC
+		}
+		h.values = h.values[:mark]
+		for i := itermark; i < len(h.iters); i++ {
+			h.done(int32(i))
+		}
+		h.iters = h.iters[:itermark]
+	}()
+
+	params := make([]int32, len(locals))
+	for i, v := range locals {
+		params[i] = h.handle(v)
+	}
+	r, err := h.Invoke(fmt.Sprintf("f%d", fn.index), params)
+	if err != nil {
+		return nil, err
+	}
+	if r == -1 {
+		err, h.err = h.err, nil
+		if err == nil {
+			err = fmt.Errorf("internal error: function %s failed without an error", fn.Name())
+		}
+		return nil, err
+	}
+	if r <= 0 || int(r) >= len(h.values) {
+		return nil, fmt.Errorf("internal error: function %s returned invalid handle %d", fn.Name(), r)
+	}
+	return h.values[r], nil
+}
+
+// setArgs binds the arguments of a call to the function's
+// parameters, as the interpreter does for a starlark.Function.
+func (fn *Function) setArgs(locals []starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple) error {
+	f := fn.funcode
+
+	// Nullary function?
+	if f.NumParams == 0 {
+		if nactual := len(args) + len(kwargs); nactual > 0 {
+			return fmt.Errorf("function %s accepts no arguments (%d given)", fn.Name(), nactual)
+		}
+		return nil
+	}
+
+	cond := func(x bool, y, z interface{}) interface{} {
+		if x {
+			return y
+		}
+		return z
+	}
+
+	// nparams is the number of ordinary parameters (sans *args and **kwargs).
+	nparams := f.NumParams
+	var kwdict *starlark.Dict
+	if f.HasKwargs {
+		nparams--
+		kwdict = new(starlark.Dict)
+		locals[nparams] = kwdict
+	}
+	if f.HasVarargs {
+		nparams--
+	}
+
+	// nonkwonly is the number of non-kwonly parameters.
+	nonkwonly := nparams - f.NumKwonlyParams
+
+	// Too many positional args?
+	n := len(args)
+	if len(args) > nonkwonly {
+		if !f.HasVarargs {
+			return fmt.Errorf("function %s accepts %s%d positional argument%s (%d given)",
+				fn.Name(),
+				cond(len(fn.defaults) > f.NumKwonlyParams, "at most ", ""),
+				nonkwonly,
+				cond(nonkwonly == 1, "", "s"),
+				len(args))
+		}
+		n = nonkwonly
+	}
+
+	// Bind positional arguments to non-kwonly parameters.
+	copy(locals, args[:n])
+
+	// Bind surplus positional arguments to *args parameter.
+	if f.HasVarargs {
+		locals[nparams] = append(starlark.Tuple{}, args[n:]...)
+	}
+
+	// Bind keyword arguments to parameters.
+	paramIdents := f.Locals[:nparams]
+	for _, pair := range kwargs {
+		k, v := pair[0].(starlark.String), pair[1]
+		if i := findParam(paramIdents, string(k)); i >= 0 {
+			if locals[i] != nil {
+				return fmt.Errorf("function %s got multiple values for parameter %s", fn.Name(), k)
+			}
+			locals[i] = v
+			continue
+		}
+		if kwdict == nil {
+			return fmt.Errorf("function %s got an unexpected keyword argument %s", fn.Name(), k)
+		}
+		oldlen := kwdict.Len()
+		kwdict.SetKey(k, v)
+		if kwdict.Len() == oldlen {
+			return fmt.Errorf("function %s got multiple values for parameter %s", fn.Name(), k)
+		}
+	}
+
+	// Are defaults required?
+	if n < nparams || f.NumKwonlyParams > 0 {
+		m := nparams - len(fn.defaults) // first default
+
+		// Report errors for missing required arguments.
+		var missing []string
+		var i int
+		for i = n; i < m; i++ {
+			if locals[i] == nil {
+				missing = append(missing, paramIdents[i].Name)
+			}
+		}
+
+		// Bind default values to parameters.
+		for ; i < nparams; i++ {
+			if locals[i] == nil {
+				dflt := fn.defaults[i-m]
+				if _, ok := dflt.(mandatory); ok {
+					missing = append(missing, paramIdents[i].Name)
+					continue
+				}
+				locals[i] = dflt
+			}
+		}
+
+		if missing != nil {
+			return fmt.Errorf("function %s missing %d argument%s (%s)",
+				fn.Name(), len(missing), cond(len(missing) > 1, "s", ""), strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+func findParam(params []compile.Binding, name string) int {
+	for i, param := range params {
+		if param.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// mandatory is a sentinel value used in a function's defaults tuple
+// to indicate that a (keyword-only) parameter is mandatory.
+type mandatory struct{}
+
+func (mandatory) String() string        { return "mandatory" }
+func (mandatory) Type() string          { return "mandatory" }
+func (mandatory) Freeze()               {} // immutable
+func (mandatory) Truth() starlark.Bool  { return starlark.False }
+func (mandatory) Hash() (uint32, error) { return 0, nil }
@@ -0,0 +1,679 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkwasm compiles Starlark programs to WebAssembly.
+//
+// THIS PACKAGE IS EXPERIMENTAL AND ITS INTERFACE MAY CHANGE.
+//
+// Compile translates the bytecode of a compiled Starlark program into a
+// WebAssembly module, so that the control flow of the program executes
+// within a WebAssembly sandbox. The module manipulates Starlark values
+// only indirectly, through 32-bit handles, by calling functions that it
+// imports from the host; a Host provides these functions, implemented
+// by the operations of the starlark package. An application
+// instantiates the module using the WebAssembly runtime of its choice,
+// binding the imports to the functions returned by Host.Imports, and
+// then executes the program's toplevel code by calling Host.Init.
+//
+// The module exports one function for each function of the program,
+// named "f0" for the toplevel code and "f1", "f2", and so on for the
+// functions in order of their appearance. Each exported function takes
+// one i32 parameter for each of the function's local variables,
+// starting with its parameters, and returns an i32 handle for its
+// result, or -1 if it failed, in which case the host holds the error.
+// All imports belong to the module "starlark".
+//
+// The backend does not support nested functions that refer to the
+// variables of enclosing ones, generators, with statements, and load
+// statements. Execution within the module does not count steps toward
+// the thread's limit.
+package starlarkwasm // import "go.starlark.net/starlarkwasm"
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"go.starlark.net/internal/compile"
+	"go.starlark.net/starlark"
+)
+
+// The functions imported from the host, in order of their indices.
+const (
+	impValue     = iota // value(op, arg) h: push a constant or variable
+	impSetGlobal        // setglobal(index, x)
+	impUnbound          // unbound(fn, local): report a reference to an unbound local
+	impUnary            // unary(op, x) h
+	impBinary           // binary(op, x, y) h: binary operators and comparisons
+	impTruth            // truth(x) bool
+	impPush             // push(x): stage an argument of call or collect
+	impCall             // call(op, arg, fn) h
+	impCollect          // collect(op, n) h: make a tuple or list
+	impMakeFunc         // makefunc(index, defaults) h
+	impIterate          // iterate(x) iter
+	impNext             // next(iter) h, or 0 when exhausted
+	impDone             // done(iter)
+	impAttr             // attr(x, name) h
+	impSetField         // setfield(x, name, y) status
+	impDelField         // delfield(x, name) status
+	impIndex            // index(x, y) h
+	impSetIndex         // setindex(x, y, z) status
+	impDelIndex         // delindex(x, y) status
+	impSlice            // slice(x, lo, hi, step) h
+	impSetDict          // setdict(op, dict, k, v) status
+	impAppend           // append(list, x) status
+	impUnpack           // unpack(x, n) status
+	impElem             // elem(i) h: the ith element of the last unpack
+	numImports
+)
+
+// importSigs gives the name, number of parameters, and number of
+// results of each imported function.
+var importSigs = [numImports]struct {
+	name            string
+	params, results int
+}{
+	impValue:     {"value", 2, 1},
+	impSetGlobal: {"setglobal", 2, 0},
+	impUnbound:   {"unbound", 2, 0},
+	impUnary:     {"unary", 2, 1},
+	impBinary:    {"binary", 3, 1},
+	impTruth:     {"truth", 1, 1},
+	impPush:      {"push", 1, 0},
+	impCall:      {"call", 3, 1},
+	impCollect:   {"collect", 2, 1},
+	impMakeFunc:  {"makefunc", 2, 1},
+	impIterate:   {"iterate", 1, 1},
+	impNext:      {"next", 1, 1},
+	impDone:      {"done", 1, 0},
+	impAttr:      {"attr", 2, 1},
+	impSetField:  {"setfield", 3, 1},
+	impDelField:  {"delfield", 2, 1},
+	impIndex:     {"index", 2, 1},
+	impSetIndex:  {"setindex", 3, 1},
+	impDelIndex:  {"delindex", 2, 1},
+	impSlice:     {"slice", 4, 1},
+	impSetDict:   {"setdict", 4, 1},
+	impAppend:    {"append", 2, 1},
+	impUnpack:    {"unpack", 2, 1},
+	impElem:      {"elem", 1, 1},
+}
+
+// WebAssembly opcodes and types.
+const (
+	wasmUnreachable = 0x00
+	wasmBlock       = 0x02
+	wasmLoop        = 0x03
+	wasmIf          = 0x04
+	wasmEnd         = 0x0b
+	wasmBr          = 0x0c
+	wasmBrTable     = 0x0e
+	wasmReturn      = 0x0f
+	wasmCall        = 0x10
+	wasmLocalGet    = 0x20
+	wasmLocalSet    = 0x21
+	wasmI32Const    = 0x41
+	wasmI32Eqz      = 0x45
+	wasmI32Eq       = 0x46
+
+	wasmVoid = 0x40 // empty block type
+	wasmI32  = 0x7f
+	wasmFunc = 0x60
+)
+
+// Compile returns the binary encoding of a WebAssembly module that
+// executes the specified program. It reports an error if the program
+// uses a feature the backend does not support.
+func Compile(prog *starlark.Program) ([]byte, error) {
+	compiled, err := decode(prog)
+	if err != nil {
+		return nil, err
+	}
+
+	funcs := append([]*compile.Funcode{compiled.Toplevel}, compiled.Functions...)
+	bodies := make([][]byte, len(funcs))
+	for i, fn := range funcs {
+		body, err := compileFunc(fn)
+		if err != nil {
+			return nil, err
+		}
+		bodies[i] = body
+	}
+
+	// Assign a type index to each distinct signature.
+	type sig struct{ params, results int }
+	var types []sig
+	typeIndex := make(map[sig]int)
+	typeOf := func(s sig) int {
+		i, ok := typeIndex[s]
+		if !ok {
+			i = len(types)
+			types = append(types, s)
+			typeIndex[s] = i
+		}
+		return i
+	}
+	var importTypes, funcTypes []int
+	for _, imp := range importSigs {
+		importTypes = append(importTypes, typeOf(sig{imp.params, imp.results}))
+	}
+	for _, fn := range funcs {
+		funcTypes = append(funcTypes, typeOf(sig{len(fn.Locals), 1}))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("\x00asm\x01\x00\x00\x00")
+	section := func(id byte, n int, emit func(w *writer, i int)) {
+		var w writer
+		w.uint(uint32(n))
+		for i := 0; i < n; i++ {
+			emit(&w, i)
+		}
+		out.WriteByte(id)
+		var size writer
+		size.uint(uint32(len(w.buf)))
+		out.Write(size.buf)
+		out.Write(w.buf)
+	}
+	section(1, len(types), func(w *writer, i int) {
+		w.byte(wasmFunc)
+		w.uint(uint32(types[i].params))
+		for j := 0; j < types[i].params; j++ {
+			w.byte(wasmI32)
+		}
+		w.uint(uint32(types[i].results))
+		for j := 0; j < types[i].results; j++ {
+			w.byte(wasmI32)
+		}
+	})
+	section(2, numImports, func(w *writer, i int) {
+		w.name("starlark")
+		w.name(importSigs[i].name)
+		w.byte(0x00) // function import
+		w.uint(uint32(importTypes[i]))
+	})
+	section(3, len(funcs), func(w *writer, i int) {
+		w.uint(uint32(funcTypes[i]))
+	})
+	section(7, len(funcs), func(w *writer, i int) {
+		w.name(fmt.Sprintf("f%d", i))
+		w.byte(0x00) // function export
+		w.uint(uint32(numImports + i))
+	})
+	section(10, len(funcs), func(w *writer, i int) {
+		w.uint(uint32(len(bodies[i])))
+		w.buf = append(w.buf, bodies[i]...)
+	})
+	return out.Bytes(), nil
+}
+
+// decode returns the compiled form of prog.
+func decode(prog *starlark.Program) (*compile.Program, error) {
+	var buf bytes.Buffer
+	if err := prog.Write(&buf); err != nil {
+		return nil, err
+	}
+	return compile.DecodeProgram(buf.Bytes())
+}
+
+// A writer accumulates the binary encoding of a module.
+type writer struct{ buf []byte }
+
+func (w *writer) byte(b byte) { w.buf = append(w.buf, b) }
+
+// uint appends x in unsigned LEB128 encoding.
+func (w *writer) uint(x uint32) {
+	for x >= 0x80 {
+		w.buf = append(w.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	w.buf = append(w.buf, byte(x))
+}
+
+// int appends x in signed LEB128 encoding.
+func (w *writer) int(x int32) {
+	for {
+		b := byte(x & 0x7f)
+		x >>= 7
+		if x == 0 && b&0x40 == 0 || x == -1 && b&0x40 != 0 {
+			w.buf = append(w.buf, b)
+			return
+		}
+		w.buf = append(w.buf, b|0x80)
+	}
+}
+
+func (w *writer) name(s string) {
+	w.uint(uint32(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// An fcomp holds the state of the compilation of one function.
+//
+// The operand stack and iterator stack of the interpreter become
+// WebAssembly locals, since their depth before each instruction is
+// known statically. The function's code is divided into segments, each
+// starting at a jump target, and jumps are implemented by a loop
+// around a br_table that dispatches on the index of the next segment.
+type fcomp struct {
+	fn     *compile.Funcode
+	w      writer
+	sp, it []int       // depths of operand and iterator stacks, by pc
+	segs   map[int]int // segment index of each jump target pc
+	nsegs  int
+	seg    int // index of current segment
+	nest   int // number of enclosing if blocks within current segment
+
+	stack, iters, pc, tmp uint32 // indices of the first local of each kind
+}
+
+func compileFunc(fn *compile.Funcode) ([]byte, error) {
+	fc := &fcomp{fn: fn}
+	pos := fn.Pos
+	unsupported := func(what string) error {
+		return fmt.Errorf("%s: in function %s: %s not supported by the WebAssembly backend", pos, fn.Name, what)
+	}
+	if fn.Generator {
+		return nil, unsupported("generators are")
+	}
+	if len(fn.Cells) > 0 || len(fn.Freevars) > 0 {
+		return nil, unsupported("variables shared with nested functions are")
+	}
+
+	sp, it, err := fn.StackDepths()
+	if err != nil {
+		return nil, err
+	}
+	fc.sp, fc.it = sp, it
+
+	// Find the jump targets, and check for unsupported instructions.
+	maxIters := 0
+	targets := map[int]bool{0: true}
+	for pc := 0; pc < len(fn.Code); {
+		op, arg, next := compile.DecodeOp(fn.Code, uint32(pc))
+		if sp[pc] >= 0 {
+			pos = fn.Position(uint32(pc))
+			switch op {
+			case compile.JMP, compile.CJMP, compile.ITERJMP:
+				targets[int(arg)] = true
+			case compile.LOAD:
+				return nil, unsupported("load statements are")
+			case compile.WITHENTER, compile.WITHEXIT:
+				return nil, unsupported("with statements are")
+			case compile.LOCALCELL, compile.SETLOCALCELL, compile.FREE, compile.FREECELL, compile.YIELD:
+				return nil, unsupported(fmt.Sprintf("the %s instruction is", op))
+			}
+			if it[pc]+1 > maxIters {
+				maxIters = it[pc] + 1
+			}
+		}
+		pc = int(next)
+	}
+	pcs := make([]int, 0, len(targets))
+	for pc := range targets {
+		pcs = append(pcs, pc)
+	}
+	sort.Ints(pcs)
+	fc.segs = make(map[int]int)
+	for i, pc := range pcs {
+		fc.segs[pc] = i
+	}
+	fc.nsegs = len(pcs)
+
+	nlocals := uint32(len(fn.Locals))
+	fc.stack = nlocals
+	fc.iters = fc.stack + uint32(fn.MaxStack)
+	fc.pc = fc.iters + uint32(maxIters)
+	fc.tmp = fc.pc + 1
+
+	// Generate the code of each segment.
+	segcode := make([][]byte, fc.nsegs)
+	fc.seg = -1
+	for pc := 0; pc < len(fn.Code); {
+		op, arg, next := compile.DecodeOp(fn.Code, uint32(pc))
+		if seg, ok := fc.segs[pc]; ok {
+			if fc.seg >= 0 {
+				segcode[fc.seg] = fc.w.buf
+			}
+			fc.seg, fc.w.buf = seg, nil
+		}
+		if sp[pc] >= 0 {
+			fc.op(op, arg, sp[pc], it[pc])
+		}
+		pc = int(next)
+	}
+	segcode[fc.seg] = fc.w.buf
+
+	// Assemble the function body.
+	var w writer
+	w.uint(1) // one group of local declarations
+	w.uint(fc.tmp + 1 - nlocals)
+	w.byte(wasmI32)
+	w.byte(wasmLoop)
+	w.byte(wasmVoid)
+	for i := 0; i < fc.nsegs; i++ {
+		w.byte(wasmBlock)
+		w.byte(wasmVoid)
+	}
+	w.byte(wasmLocalGet)
+	w.uint(fc.pc)
+	w.byte(wasmBrTable)
+	w.uint(uint32(fc.nsegs))
+	for i := 0; i < fc.nsegs; i++ {
+		w.uint(uint32(i))
+	}
+	w.uint(0) // default
+	for i := 0; i < fc.nsegs; i++ {
+		w.byte(wasmEnd)
+		w.buf = append(w.buf, segcode[i]...)
+	}
+	w.byte(wasmEnd) // loop
+	w.byte(wasmUnreachable)
+	w.byte(wasmEnd)
+	return w.buf, nil
+}
+
+func (fc *fcomp) get(local uint32) {
+	fc.w.byte(wasmLocalGet)
+	fc.w.uint(local)
+}
+
+func (fc *fcomp) set(local uint32) {
+	fc.w.byte(wasmLocalSet)
+	fc.w.uint(local)
+}
+
+func (fc *fcomp) i32(x int32) {
+	fc.w.byte(wasmI32Const)
+	fc.w.int(x)
+}
+
+func (fc *fcomp) call(imp int) {
+	fc.w.byte(wasmCall)
+	fc.w.uint(uint32(imp))
+}
+
+// slot returns the local that holds the operand at stack depth i.
+func (fc *fcomp) slot(i int) uint32 { return fc.stack + uint32(i) }
+
+// beginIf and endIf bracket a conditional block
+// that executes if the value atop the stack is nonzero.
+func (fc *fcomp) beginIf() {
+	fc.w.byte(wasmIf)
+	fc.w.byte(wasmVoid)
+	fc.nest++
+}
+
+func (fc *fcomp) endIf() {
+	fc.w.byte(wasmEnd)
+	fc.nest--
+}
+
+// exit emits code to release the iterators of the active loops.
+func (fc *fcomp) exit(iters int) {
+	for i := iters - 1; i >= 0; i-- {
+		fc.get(fc.iters + uint32(i))
+		fc.call(impDone)
+	}
+}
+
+// checkStatus emits code to fail if the value atop the stack is -1.
+func (fc *fcomp) checkStatus(iters int) {
+	fc.i32(-1)
+	fc.w.byte(wasmI32Eq)
+	fc.beginIf()
+	fc.exit(iters)
+	fc.i32(-1)
+	fc.w.byte(wasmReturn)
+	fc.endIf()
+}
+
+// result emits code to store the handle atop the stack in
+// the specified local, and to fail if it denotes an error.
+func (fc *fcomp) result(local uint32, iters int) {
+	fc.set(local)
+	fc.get(local)
+	fc.checkStatus(iters)
+}
+
+// jump emits code to continue execution at the specified pc.
+func (fc *fcomp) jump(pc uint32) {
+	fc.i32(int32(fc.segs[int(pc)]))
+	fc.set(fc.pc)
+	fc.w.byte(wasmBr)
+	fc.w.uint(uint32(fc.nsegs - 1 - fc.seg + fc.nest))
+}
+
+// op emits the code for one instruction, executed
+// with operand and iterator stacks of the specified depths.
+func (fc *fcomp) op(op compile.Opcode, arg uint32, sp, iters int) {
+	switch op {
+	case compile.NOP, compile.POP:
+		// nop
+
+	case compile.DUP:
+		fc.get(fc.slot(sp - 1))
+		fc.set(fc.slot(sp))
+
+	case compile.DUP2:
+		fc.get(fc.slot(sp - 2))
+		fc.set(fc.slot(sp))
+		fc.get(fc.slot(sp - 1))
+		fc.set(fc.slot(sp + 1))
+
+	case compile.EXCH:
+		fc.get(fc.slot(sp - 2))
+		fc.set(fc.tmp)
+		fc.get(fc.slot(sp - 1))
+		fc.set(fc.slot(sp - 2))
+		fc.get(fc.tmp)
+		fc.set(fc.slot(sp - 1))
+
+	case compile.EQL, compile.NEQ, compile.GT, compile.LT, compile.LE, compile.GE,
+		compile.PLUS, compile.MINUS, compile.STAR, compile.SLASH, compile.SLASHSLASH,
+		compile.PERCENT, compile.AMP, compile.PIPE, compile.CIRCUMFLEX,
+		compile.LTLT, compile.GTGT, compile.IN,
+		compile.INPLACE_ADD, compile.INPLACE_PIPE:
+		fc.i32(int32(op))
+		fc.get(fc.slot(sp - 2))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impBinary)
+		fc.result(fc.slot(sp-2), iters)
+
+	case compile.UPLUS, compile.UMINUS, compile.TILDE, compile.NOT:
+		fc.i32(int32(op))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impUnary)
+		fc.result(fc.slot(sp-1), iters)
+
+	case compile.NONE, compile.TRUE, compile.FALSE, compile.MANDATORY, compile.MAKEDICT,
+		compile.CONSTANT, compile.GLOBAL, compile.PREDECLARED, compile.UNIVERSAL:
+		fc.i32(int32(op))
+		fc.i32(int32(arg))
+		fc.call(impValue)
+		fc.result(fc.slot(sp), iters)
+
+	case compile.SETGLOBAL:
+		fc.i32(int32(arg))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impSetGlobal)
+
+	case compile.LOCAL:
+		fc.get(arg)
+		fc.w.byte(wasmI32Eqz)
+		fc.beginIf()
+		fc.i32(int32(fc.index()))
+		fc.i32(int32(arg))
+		fc.call(impUnbound)
+		fc.exit(iters)
+		fc.i32(-1)
+		fc.w.byte(wasmReturn)
+		fc.endIf()
+		fc.get(arg)
+		fc.set(fc.slot(sp))
+
+	case compile.SETLOCAL:
+		fc.get(fc.slot(sp - 1))
+		fc.set(arg)
+
+	case compile.JMP:
+		fc.jump(arg)
+
+	case compile.CJMP:
+		fc.get(fc.slot(sp - 1))
+		fc.call(impTruth)
+		fc.beginIf()
+		fc.jump(arg)
+		fc.endIf()
+
+	case compile.CALL, compile.CALL_VAR, compile.CALL_KW, compile.CALL_VAR_KW:
+		n := 1 + int(arg>>8) + 2*int(arg&0xff)
+		if op == compile.CALL_VAR || op == compile.CALL_VAR_KW {
+			n++
+		}
+		if op == compile.CALL_KW || op == compile.CALL_VAR_KW {
+			n++
+		}
+		base := sp - n
+		for i := base + 1; i < sp; i++ {
+			fc.get(fc.slot(i))
+			fc.call(impPush)
+		}
+		fc.i32(int32(op))
+		fc.i32(int32(arg))
+		fc.get(fc.slot(base))
+		fc.call(impCall)
+		fc.result(fc.slot(base), iters)
+
+	case compile.MAKETUPLE, compile.MAKELIST:
+		base := sp - int(arg)
+		for i := base; i < sp; i++ {
+			fc.get(fc.slot(i))
+			fc.call(impPush)
+		}
+		fc.i32(int32(op))
+		fc.i32(int32(arg))
+		fc.call(impCollect)
+		fc.result(fc.slot(base), iters)
+
+	case compile.MAKEFUNC:
+		fc.i32(int32(arg))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impMakeFunc)
+		fc.result(fc.slot(sp-1), iters)
+
+	case compile.ITERPUSH:
+		fc.get(fc.slot(sp - 1))
+		fc.call(impIterate)
+		fc.result(fc.iters+uint32(iters), iters)
+
+	case compile.ITERJMP:
+		fc.get(fc.iters + uint32(iters-1))
+		fc.call(impNext)
+		fc.result(fc.slot(sp), iters)
+		fc.get(fc.slot(sp))
+		fc.w.byte(wasmI32Eqz)
+		fc.beginIf()
+		fc.jump(arg)
+		fc.endIf()
+
+	case compile.ITERPOP:
+		fc.get(fc.iters + uint32(iters-1))
+		fc.call(impDone)
+
+	case compile.RETURN:
+		fc.exit(iters)
+		fc.get(fc.slot(sp - 1))
+		fc.w.byte(wasmReturn)
+
+	case compile.ATTR:
+		fc.get(fc.slot(sp - 1))
+		fc.i32(int32(arg))
+		fc.call(impAttr)
+		fc.result(fc.slot(sp-1), iters)
+
+	case compile.SETFIELD:
+		fc.get(fc.slot(sp - 2))
+		fc.i32(int32(arg))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impSetField)
+		fc.checkStatus(iters)
+
+	case compile.DELFIELD:
+		fc.get(fc.slot(sp - 1))
+		fc.i32(int32(arg))
+		fc.call(impDelField)
+		fc.checkStatus(iters)
+
+	case compile.INDEX:
+		fc.get(fc.slot(sp - 2))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impIndex)
+		fc.result(fc.slot(sp-2), iters)
+
+	case compile.SETINDEX:
+		fc.get(fc.slot(sp - 3))
+		fc.get(fc.slot(sp - 2))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impSetIndex)
+		fc.checkStatus(iters)
+
+	case compile.DELINDEX:
+		fc.get(fc.slot(sp - 2))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impDelIndex)
+		fc.checkStatus(iters)
+
+	case compile.SLICE:
+		for i := sp - 4; i < sp; i++ {
+			fc.get(fc.slot(i))
+		}
+		fc.call(impSlice)
+		fc.result(fc.slot(sp-4), iters)
+
+	case compile.SETDICT, compile.SETDICTUNIQ:
+		fc.i32(int32(op))
+		for i := sp - 3; i < sp; i++ {
+			fc.get(fc.slot(i))
+		}
+		fc.call(impSetDict)
+		fc.checkStatus(iters)
+
+	case compile.APPEND:
+		fc.get(fc.slot(sp - 2))
+		fc.get(fc.slot(sp - 1))
+		fc.call(impAppend)
+		fc.checkStatus(iters)
+
+	case compile.UNPACK:
+		// The first element ends up on top of the stack.
+		n := int(arg)
+		fc.get(fc.slot(sp - 1))
+		fc.i32(int32(n))
+		fc.call(impUnpack)
+		fc.checkStatus(iters)
+		for i := 0; i < n; i++ {
+			fc.i32(int32(i))
+			fc.call(impElem)
+			fc.set(fc.slot(sp - 1 + n - 1 - i))
+		}
+
+	default:
+		panic(fmt.Sprintf("unexpected opcode %s", op))
+	}
+}
+
+// index returns the index of the function among the program's
+// functions, counting the toplevel function as zero.
+func (fc *fcomp) index() int {
+	if fc.fn == fc.fn.Prog.Toplevel {
+		return 0
+	}
+	for i, fn := range fc.fn.Prog.Functions {
+		if fn == fc.fn {
+			return i + 1
+		}
+	}
+	panic("function not found")
+}
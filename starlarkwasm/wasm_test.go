@@ -0,0 +1,422 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkwasm_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkwasm"
+)
+
+const src = `
+def fib(n):
+    a, b = 0, 1
+    for _ in range(n):
+        a, b = b, a + b
+    return a
+
+def squares(n, *, odd = False):
+    return [x * x for x in range(n) if not odd or x % 2]
+
+def params(a, b = 2, *args, c, d = 4, **kwargs):
+    return (a, b, args, c, d, sorted(kwargs.items()))
+
+def words(s):
+    counts = {}
+    for w in s.split():
+        counts[w] = counts.get(w, 0) + 1
+    return {k: v for k, v in counts.items() if v > 1}
+
+def ops(x, y):
+    l = [x, y]
+    l += [x // y, x % y, -x, ~y, x in l, x not in l]
+    l[0] = l[-1]
+    del l[1]
+    return l[1:-1], l[::-1], x if x < y else y, x and y, x or y
+
+def nested(rows):
+    total = 0
+    for row in rows:
+        for x in row:
+            if x < 0:
+                return "negative"
+            if x == 0:
+                break
+            total += x
+    return total
+
+def calls():
+    return fib(*[10]), squares(**dict(n = 3)), len("abc"), greeting
+
+def failing(x):
+    for y in [1, 2, 3]:
+        if y == 2:
+            return x[y]
+
+def unbound(cond):
+    if cond:
+        v = 1
+    return v
+
+greeting = "hello"
+fib10 = fib(10)
+`
+
+// TestCompile checks that the functions of a program executed by
+// the compiled module behave as when executed by the interpreter.
+func TestCompile(t *testing.T) {
+	defer func(prev bool) { resolve.AllowDel = prev }(resolve.AllowDel)
+	resolve.AllowDel = true
+	thread := &starlark.Thread{Name: "test"}
+	isPredeclared := func(string) bool { return false }
+	_, prog, err := starlark.SourceProgram("test.star", src, isPredeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := prog.Init(thread, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	module, err := starlarkwasm.Compile(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseModule(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := starlarkwasm.NewHost(prog, nil, m.invoke)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.imports = host.Imports()
+	got, err := host.Init(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := fmt.Sprint(got["fib10"], got["greeting"]), fmt.Sprint(want["fib10"], want["greeting"]); g != w {
+		t.Errorf("globals: got %s, want %s", g, w)
+	}
+	if _, ok := got["fib"].(*starlarkwasm.Function); !ok {
+		t.Errorf("fib is %T, want *starlarkwasm.Function", got["fib"])
+	}
+
+	for _, call := range []string{
+		"fib(0)",
+		"fib(20)",
+		"fib(100)",
+		"fib('x')",
+		"fib()",
+		"fib(1, 2)",
+		"squares(5)",
+		"squares(5, odd=True)",
+		"squares(5, True)",
+		"params(1, c=3)",
+		"params(1, 2, 3, 4, c=5, d=6, e=7, f=8)",
+		"params(1)",
+		"params(1, a=2, c=3)",
+		"words('a b a c b a')",
+		"ops(7, 2)",
+		"ops(7, 0)",
+		"ops('a', 'b')",
+		"nested([[1, 2], [3, 0, 100], [4]])",
+		"nested([[1], [-1]])",
+		"calls()",
+		"failing([1, 2, 3])",
+		"failing([1])",
+		"unbound(True)",
+		"unbound(False)",
+	} {
+		eval := func(globals starlark.StringDict) string {
+			v, err := starlark.Eval(thread, "<expr>", call, globals)
+			if err != nil {
+				if err, ok := err.(*starlark.EvalError); ok {
+					return "error: " + err.Msg
+				}
+				return "error: " + err.Error()
+			}
+			return v.String()
+		}
+		if g, w := eval(got), eval(want); g != w {
+			t.Errorf("%s: got %s, want %s", call, g, w)
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	defer func(prev bool) { resolve.AllowRecursion = prev }(resolve.AllowRecursion)
+	resolve.AllowRecursion = true
+	for _, test := range []struct{ src, want string }{
+		{"def f():\n  x = 1\n  return lambda: x", "test.star:3:10: in function lambda: variables shared with nested functions are not supported by the WebAssembly backend"},
+		{"load('m', 'x')", "test.star:1:1: in function <toplevel>: load statements are not supported by the WebAssembly backend"},
+		{"def f():\n  while True:\n    return 1\n", ""},
+	} {
+		_, prog, err := starlark.SourceProgram("test.star", test.src, func(string) bool { return false })
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = starlarkwasm.Compile(prog)
+		if got := fmt.Sprint(err); test.want == "" && err != nil || test.want != "" && got != test.want {
+			t.Errorf("%q: got %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+// A module is a minimal WebAssembly interpreter, sufficient to
+// execute modules produced by Compile.
+type module struct {
+	types   [][2]int // number of params and results, by type index
+	funcs   []int    // type index, by function index
+	nimport int
+	names   []string // names of imported functions
+	exports map[string]int
+	code    [][]byte // bodies of defined functions
+	imports map[string]interface{}
+}
+
+type reader struct {
+	buf []byte
+	pos int
+}
+
+func (r *reader) byte() byte {
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *reader) uint() uint32 {
+	var x uint32
+	for s := uint(0); ; s += 7 {
+		b := r.byte()
+		x |= uint32(b&0x7f) << s
+		if b < 0x80 {
+			return x
+		}
+	}
+}
+
+func (r *reader) int() int32 {
+	var x int32
+	var s uint
+	for {
+		b := r.byte()
+		x |= int32(b&0x7f) << s
+		s += 7
+		if b < 0x80 {
+			if s < 32 && b&0x40 != 0 {
+				x |= -1 << s
+			}
+			return x
+		}
+	}
+}
+
+func (r *reader) name() string {
+	n := int(r.uint())
+	s := string(r.buf[r.pos : r.pos+n])
+	r.pos += n
+	return s
+}
+
+func parseModule(data []byte) (m *module, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("malformed module: %v", x)
+		}
+	}()
+	if !strings.HasPrefix(string(data), "\x00asm\x01\x00\x00\x00") {
+		return nil, fmt.Errorf("bad header")
+	}
+	m = &module{exports: make(map[string]int)}
+	r := &reader{buf: data, pos: 8}
+	for r.pos < len(data) {
+		id := r.byte()
+		size := int(r.uint())
+		end := r.pos + size
+		n := int(r.uint())
+		for i := 0; i < n; i++ {
+			switch id {
+			case 1:
+				if r.byte() != 0x60 {
+					return nil, fmt.Errorf("bad type")
+				}
+				np := int(r.uint())
+				r.pos += np
+				nr := int(r.uint())
+				r.pos += nr
+				m.types = append(m.types, [2]int{np, nr})
+			case 2:
+				r.name()
+				m.names = append(m.names, r.name())
+				r.byte()
+				m.funcs = append(m.funcs, int(r.uint()))
+				m.nimport++
+			case 3:
+				m.funcs = append(m.funcs, int(r.uint()))
+			case 7:
+				name := r.name()
+				r.byte()
+				m.exports[name] = int(r.uint())
+			case 10:
+				size := int(r.uint())
+				m.code = append(m.code, r.buf[r.pos:r.pos+size])
+				r.pos += size
+			default:
+				return nil, fmt.Errorf("unexpected section %d", id)
+			}
+		}
+		if r.pos != end {
+			return nil, fmt.Errorf("section %d: size mismatch", id)
+		}
+	}
+	return m, nil
+}
+
+func (m *module) invoke(export string, params []int32) (int32, error) {
+	index, ok := m.exports[export]
+	if !ok {
+		return 0, fmt.Errorf("no export %s", export)
+	}
+	if n := m.types[m.funcs[index]][0]; n != len(params) {
+		return 0, fmt.Errorf("%s: got %d params, want %d", export, len(params), n)
+	}
+	return m.exec(index-m.nimport, params)
+}
+
+// A label is an entry of the control stack.
+type label struct {
+	loop       bool
+	start, end int // offsets after the block type, and of the matching end
+}
+
+func (m *module) exec(fn int, params []int32) (result int32, err error) {
+	r := &reader{buf: m.code[fn]}
+	locals := append([]int32(nil), params...)
+	for n := r.uint(); n > 0; n-- {
+		count := r.uint()
+		r.byte()
+		locals = append(locals, make([]int32, count)...)
+	}
+
+	var stack []int32
+	pop := func() int32 {
+		x := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return x
+	}
+	var labels []label
+	br := func(depth int) {
+		l := labels[len(labels)-1-depth]
+		if l.loop {
+			labels = labels[:len(labels)-depth]
+			r.pos = l.start
+		} else {
+			labels = labels[:len(labels)-1-depth]
+			r.pos = l.end + 1
+		}
+	}
+	for steps := 0; ; steps++ {
+		if steps > 1e7 {
+			return 0, fmt.Errorf("too many steps")
+		}
+		switch op := r.byte(); op {
+		case 0x00: // unreachable
+			return 0, fmt.Errorf("unreachable")
+		case 0x02, 0x03, 0x04: // block, loop, if
+			r.byte()
+			l := label{loop: op == 0x03, start: r.pos, end: matchingEnd(r.buf, r.pos)}
+			if op == 0x04 && pop() == 0 {
+				r.pos = l.end + 1
+				continue
+			}
+			labels = append(labels, l)
+		case 0x0b: // end
+			if len(labels) == 0 {
+				return pop(), nil
+			}
+			labels = labels[:len(labels)-1]
+		case 0x0c: // br
+			br(int(r.uint()))
+		case 0x0e: // br_table
+			n := int(r.uint())
+			targets := make([]int, n+1)
+			for i := range targets {
+				targets[i] = int(r.uint())
+			}
+			i := int(pop())
+			if i < 0 || i >= n {
+				i = n
+			}
+			br(targets[i])
+		case 0x0f: // return
+			return pop(), nil
+		case 0x10: // call
+			index := int(r.uint())
+			typ := m.types[m.funcs[index]]
+			args := make([]reflect.Value, typ[0])
+			for i := typ[0] - 1; i >= 0; i-- {
+				args[i] = reflect.ValueOf(pop())
+			}
+			results := reflect.ValueOf(m.imports[m.names[index]]).Call(args)
+			for _, res := range results {
+				stack = append(stack, int32(res.Int()))
+			}
+		case 0x20: // local.get
+			stack = append(stack, locals[r.uint()])
+		case 0x21: // local.set
+			locals[r.uint()] = pop()
+		case 0x41: // i32.const
+			stack = append(stack, r.int())
+		case 0x45: // i32.eqz
+			stack = append(stack, b2i(pop() == 0))
+		case 0x46: // i32.eq
+			y, x := pop(), pop()
+			stack = append(stack, b2i(x == y))
+		default:
+			return 0, fmt.Errorf("unexpected opcode %#x at %d", op, r.pos-1)
+		}
+	}
+}
+
+// matchingEnd returns the offset of the end instruction
+// that closes the block whose body starts at pos.
+func matchingEnd(code []byte, pos int) int {
+	r := &reader{buf: code, pos: pos}
+	depth := 0
+	for {
+		switch op := r.byte(); op {
+		case 0x02, 0x03, 0x04:
+			r.byte()
+			depth++
+		case 0x0b:
+			if depth == 0 {
+				return r.pos - 1
+			}
+			depth--
+		case 0x0c, 0x10, 0x20, 0x21:
+			r.uint()
+		case 0x0e:
+			for n := r.uint() + 1; n > 0; n-- {
+				r.uint()
+			}
+		case 0x41:
+			r.int()
+		}
+	}
+}
+
+func b2i(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -48,7 +48,7 @@ func Parse(filename string, src interface{}, mode Mode) (f *File, err error) {
 }
 
 // ParseCompoundStmt parses a single compound statement:
-// a blank line, a def, for, while, or if statement, or a
+// a blank line, a def, for, while, with, or if statement, or a
 // semicolon-separated list of simple statements followed
 // by a newline. These are the units on which the REPL operates.
 // ParseCompoundStmt does not consume any following input.
@@ -67,7 +67,7 @@ func ParseCompoundStmt(filename string, readline func() ([]byte, error)) (f *Fil
 
 	var stmts []Stmt
 	switch p.tok {
-	case DEF, IF, FOR, WHILE:
+	case DEF, IF, FOR, WHILE, WITH:
 		stmts = p.parseStmt(stmts)
 	case NEWLINE:
 		// blank line
@@ -151,6 +151,8 @@ func (p *parser) parseStmt(stmts []Stmt) []Stmt {
 		return append(stmts, p.parseForStmt())
 	} else if p.tok == WHILE {
 		return append(stmts, p.parseWhileStmt())
+	} else if p.tok == WITH {
+		return append(stmts, p.parseWithStmt())
 	}
 	return p.parseSimpleStmt(stmts, true)
 }
@@ -231,6 +233,27 @@ func (p *parser) parseWhileStmt() Stmt {
 	}
 }
 
+// with_stmt = WITH test [AS primary_with_suffix] ':' suite
+func (p *parser) parseWithStmt() Stmt {
+	withpos := p.nextToken() // consume WITH
+	x := p.parseTest()
+	var aspos Position
+	var v Expr
+	if p.tok == AS {
+		aspos = p.nextToken() // consume AS
+		v = p.parsePrimaryWithSuffix()
+	}
+	p.consume(COLON)
+	body := p.parseSuite()
+	return &WithStmt{
+		With: withpos,
+		X:    x,
+		As:   aspos,
+		Var:  v,
+		Body: body,
+	}
+}
+
 // Equivalent to 'exprlist' production in Python grammar.
 //
 // loop_variables = primary_with_suffix (COMMA primary_with_suffix)* COMMA?
@@ -276,9 +299,11 @@ func (p *parser) parseSimpleStmt(stmts []Stmt, consumeNL bool) []Stmt {
 
 // small_stmt = RETURN expr?
 //            | PASS | BREAK | CONTINUE
+//            | DEL primary_with_suffix
 //            | LOAD ...
-//            | expr ('=' | '+=' | '-=' | '*=' | '/=' | '%=' | '&=' | '|=' | '^=' | '<<=' | '>>=') expr   // assign
+//            | expr ('=' | '+=' | '-=' | '*=' | '/=' | '%=' | '&=' | '|=' | '^=' | '<<=' | '>>=') (expr | yield_expr)   // assign
 //            | expr
+//            | yield_expr
 func (p *parser) parseSmallStmt() Stmt {
 	switch p.tok {
 	case RETURN:
@@ -296,6 +321,19 @@ func (p *parser) parseSmallStmt() Stmt {
 
 	case LOAD:
 		return p.parseLoadStmt()
+
+	case DEL:
+		pos := p.nextToken() // consume DEL
+		x := p.parsePrimaryWithSuffix()
+		switch x.(type) {
+		case *DotExpr, *IndexExpr:
+		default:
+			p.in.errorf(pos, "del statement requires a field or index operand")
+		}
+		return &DelStmt{Del: pos, X: x}
+
+	case YIELD:
+		return &ExprStmt{X: p.parseYieldExpr()}
 	}
 
 	// Assignment
@@ -304,7 +342,12 @@ func (p *parser) parseSmallStmt() Stmt {
 	case EQ, PLUS_EQ, MINUS_EQ, STAR_EQ, SLASH_EQ, SLASHSLASH_EQ, PERCENT_EQ, AMP_EQ, PIPE_EQ, CIRCUMFLEX_EQ, LTLT_EQ, GTGT_EQ:
 		op := p.tok
 		pos := p.nextToken() // consume op
-		rhs := p.parseExpr(false)
+		var rhs Expr
+		if p.tok == YIELD {
+			rhs = p.parseYieldExpr()
+		} else {
+			rhs = p.parseExpr(false)
+		}
 		return &AssignStmt{OpPos: pos, Op: op, LHS: x, RHS: rhs}
 	}
 
@@ -312,6 +355,16 @@ func (p *parser) parseSmallStmt() Stmt {
 	return &ExprStmt{X: x}
 }
 
+// yield_expr = YIELD expr?
+func (p *parser) parseYieldExpr() *YieldExpr {
+	pos := p.nextToken() // consume YIELD
+	var value Expr
+	if !terminatesExprList(p.tok) {
+		value = p.parseExpr(false)
+	}
+	return &YieldExpr{Yield: pos, Value: value}
+}
+
 // stmt = LOAD '(' STRING {',' (IDENT '=')? STRING} [','] ')'
 func (p *parser) parseLoadStmt() *LoadStmt {
 	loadPos := p.nextToken() // consume LOAD
@@ -813,7 +866,12 @@ func (p *parser) parsePrimary() Expr {
 			rparen := p.nextToken()
 			return &TupleExpr{Lparen: lparen, Rparen: rparen}
 		}
-		e := p.parseExpr(true) // allow trailing comma
+		var e Expr
+		if p.tok == YIELD {
+			e = p.parseYieldExpr()
+		} else {
+			e = p.parseExpr(true) // allow trailing comma
+		}
 		rparen := p.consume(RPAREN)
 		return &ParenExpr{
 			Lparen: lparen,
@@ -82,9 +82,11 @@ const (
 
 	// Keywords
 	AND
+	AS
 	BREAK
 	CONTINUE
 	DEF
+	DEL
 	ELIF
 	ELSE
 	FOR
@@ -98,6 +100,8 @@ const (
 	PASS
 	RETURN
 	WHILE
+	WITH
+	YIELD
 
 	maxToken
 )
@@ -165,9 +169,11 @@ var tokenNames = [...]string{
 	GTGT_EQ:       ">>=",
 	STARSTAR:      "**",
 	AND:           "and",
+	AS:            "as",
 	BREAK:         "break",
 	CONTINUE:      "continue",
 	DEF:           "def",
+	DEL:           "del",
 	ELIF:          "elif",
 	ELSE:          "else",
 	FOR:           "for",
@@ -181,6 +187,8 @@ var tokenNames = [...]string{
 	PASS:          "pass",
 	RETURN:        "return",
 	WHILE:         "while",
+	WITH:          "with",
+	YIELD:         "yield",
 }
 
 // A FilePortion describes the content of a portion of a file.
@@ -1088,9 +1096,11 @@ func isbdigit(c rune) bool { return '0' == c || c == '1' }
 // strings that should not be treated as ordinary identifiers.
 var keywordToken = map[string]Token{
 	"and":      AND,
+	"as":       AS,
 	"break":    BREAK,
 	"continue": CONTINUE,
 	"def":      DEF,
+	"del":      DEL,
 	"elif":     ELIF,
 	"else":     ELSE,
 	"for":      FOR,
@@ -1103,12 +1113,12 @@ var keywordToken = map[string]Token{
 	"pass":     PASS,
 	"return":   RETURN,
 	"while":    WHILE,
+	"with":     WITH,
+	"yield":    YIELD,
 
 	// reserved words:
-	"as": ILLEGAL,
 	// "assert":   ILLEGAL, // heavily used by our tests
 	"class":    ILLEGAL,
-	"del":      ILLEGAL,
 	"except":   ILLEGAL,
 	"finally":  ILLEGAL,
 	"from":     ILLEGAL,
@@ -1118,6 +1128,4 @@ var keywordToken = map[string]Token{
 	"nonlocal": ILLEGAL,
 	"raise":    ILLEGAL,
 	"try":      ILLEGAL,
-	"with":     ILLEGAL,
-	"yield":    ILLEGAL,
 }
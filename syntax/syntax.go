@@ -91,9 +91,11 @@ type Stmt interface {
 func (*AssignStmt) stmt() {}
 func (*BranchStmt) stmt() {}
 func (*DefStmt) stmt()    {}
+func (*DelStmt) stmt()    {}
 func (*ExprStmt) stmt()   {}
 func (*ForStmt) stmt()    {}
 func (*WhileStmt) stmt()  {}
+func (*WithStmt) stmt()   {}
 func (*IfStmt) stmt()     {}
 func (*LoadStmt) stmt()   {}
 func (*ReturnStmt) stmt() {}
@@ -132,6 +134,18 @@ func (x *DefStmt) Span() (start, end Position) {
 	return x.Def, end
 }
 
+// A DelStmt deletes a field or element of a value: del x.f, del x[k].
+type DelStmt struct {
+	commentsRef
+	Del Position
+	X   Expr // a DotExpr or IndexExpr
+}
+
+func (x *DelStmt) Span() (start, end Position) {
+	_, end = x.X.Span()
+	return x.Del, end
+}
+
 // An ExprStmt is an expression evaluated for side effects.
 type ExprStmt struct {
 	commentsRef
@@ -234,6 +248,7 @@ func (*ParenExpr) expr()     {}
 func (*SliceExpr) expr()     {}
 func (*TupleExpr) expr()     {}
 func (*UnaryExpr) expr()     {}
+func (*YieldExpr) expr()     {}
 
 // An Ident represents an identifier.
 type Ident struct {
@@ -344,6 +359,21 @@ func (x *WhileStmt) Span() (start, end Position) {
 	return x.While, end
 }
 
+// A WithStmt represents a with statement: with X as Var: Body.
+type WithStmt struct {
+	commentsRef
+	With Position
+	X    Expr
+	As   Position // zero if Var is nil
+	Var  Expr     // may be nil
+	Body []Stmt
+}
+
+func (x *WithStmt) Span() (start, end Position) {
+	_, end = x.Body[len(x.Body)-1].Span()
+	return x.With, end
+}
+
 // A ForClause represents a for clause in a list comprehension: for Vars in X.
 type ForClause struct {
 	commentsRef
@@ -476,6 +506,23 @@ func (x *UnaryExpr) Span() (start, end Position) {
 	return x.OpPos, end
 }
 
+// A YieldExpr represents a yield expression: yield Value.
+// It may appear only as an expression statement, as the right operand
+// of an assignment, or within parentheses.
+type YieldExpr struct {
+	commentsRef
+	Yield Position
+	Value Expr // may be nil
+}
+
+func (x *YieldExpr) Span() (start, end Position) {
+	if x.Value == nil {
+		return x.Yield, x.Yield.add("yield")
+	}
+	_, end = x.Value.Span()
+	return x.Yield, end
+}
+
 // A BinaryExpr represents a binary expression: X Op Y.
 //
 // As a special case, BinaryExpr{Op:EQ} may also
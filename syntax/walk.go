@@ -49,6 +49,16 @@ func Walk(n Node, f func(Node) bool) {
 		Walk(n.X, f)
 		walkStmts(n.Body, f)
 
+	case *WithStmt:
+		Walk(n.X, f)
+		if n.Var != nil {
+			Walk(n.Var, f)
+		}
+		walkStmts(n.Body, f)
+
+	case *DelStmt:
+		Walk(n.X, f)
+
 	case *ReturnStmt:
 		if n.Result != nil {
 			Walk(n.Result, f)
@@ -127,6 +137,11 @@ func Walk(n Node, f func(Node) bool) {
 			Walk(n.X, f)
 		}
 
+	case *YieldExpr:
+		if n.Value != nil {
+			Walk(n.Value, f)
+		}
+
 	case *BinaryExpr:
 		Walk(n.X, f)
 		Walk(n.Y, f)